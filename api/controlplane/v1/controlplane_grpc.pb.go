@@ -0,0 +1,262 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             v5.29.3
+// source: controlplane/v1/controlplane.proto
+
+// The control plane lets fleet tooling manage many caches programmatically.
+// It is served on CONTROL_PLANE_GRPC_ADDR and uses the same credentials as
+// the admin listener (ADMIN_TOKEN as a bearer token, or an mTLS client
+// certificate).
+
+package controlplanev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ControlPlane_Purge_FullMethodName     = "/ocipullthrough.controlplane.v1.ControlPlane/Purge"
+	ControlPlane_Warm_FullMethodName      = "/ocipullthrough.controlplane.v1.ControlPlane/Warm"
+	ControlPlane_Stats_FullMethodName     = "/ocipullthrough.controlplane.v1.ControlPlane/Stats"
+	ControlPlane_Inventory_FullMethodName = "/ocipullthrough.controlplane.v1.ControlPlane/Inventory"
+)
+
+// ControlPlaneClient is the client API for ControlPlane service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlPlaneClient interface {
+	// Purge deletes cached objects, streaming one message per key.
+	Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PurgeProgress], error)
+	// Warm pulls images through the cache, streaming one message per
+	// manifest or blob as it is resolved.
+	Warm(ctx context.Context, in *WarmRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WarmProgress], error)
+	// Stats streams cache statistics, once or at a fixed interval.
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[StatsSnapshot], error)
+	// Inventory streams the cached objects under a key prefix.
+	Inventory(ctx context.Context, in *InventoryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[InventoryEntry], error)
+}
+
+type controlPlaneClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlPlaneClient(cc grpc.ClientConnInterface) ControlPlaneClient {
+	return &controlPlaneClient{cc}
+}
+
+func (c *controlPlaneClient) Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PurgeProgress], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ControlPlane_ServiceDesc.Streams[0], ControlPlane_Purge_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[PurgeRequest, PurgeProgress]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ControlPlane_PurgeClient = grpc.ServerStreamingClient[PurgeProgress]
+
+func (c *controlPlaneClient) Warm(ctx context.Context, in *WarmRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WarmProgress], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ControlPlane_ServiceDesc.Streams[1], ControlPlane_Warm_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WarmRequest, WarmProgress]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ControlPlane_WarmClient = grpc.ServerStreamingClient[WarmProgress]
+
+func (c *controlPlaneClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[StatsSnapshot], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ControlPlane_ServiceDesc.Streams[2], ControlPlane_Stats_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StatsRequest, StatsSnapshot]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ControlPlane_StatsClient = grpc.ServerStreamingClient[StatsSnapshot]
+
+func (c *controlPlaneClient) Inventory(ctx context.Context, in *InventoryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[InventoryEntry], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ControlPlane_ServiceDesc.Streams[3], ControlPlane_Inventory_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[InventoryRequest, InventoryEntry]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ControlPlane_InventoryClient = grpc.ServerStreamingClient[InventoryEntry]
+
+// ControlPlaneServer is the server API for ControlPlane service.
+// All implementations must embed UnimplementedControlPlaneServer
+// for forward compatibility.
+type ControlPlaneServer interface {
+	// Purge deletes cached objects, streaming one message per key.
+	Purge(*PurgeRequest, grpc.ServerStreamingServer[PurgeProgress]) error
+	// Warm pulls images through the cache, streaming one message per
+	// manifest or blob as it is resolved.
+	Warm(*WarmRequest, grpc.ServerStreamingServer[WarmProgress]) error
+	// Stats streams cache statistics, once or at a fixed interval.
+	Stats(*StatsRequest, grpc.ServerStreamingServer[StatsSnapshot]) error
+	// Inventory streams the cached objects under a key prefix.
+	Inventory(*InventoryRequest, grpc.ServerStreamingServer[InventoryEntry]) error
+	mustEmbedUnimplementedControlPlaneServer()
+}
+
+// UnimplementedControlPlaneServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedControlPlaneServer struct{}
+
+func (UnimplementedControlPlaneServer) Purge(*PurgeRequest, grpc.ServerStreamingServer[PurgeProgress]) error {
+	return status.Error(codes.Unimplemented, "method Purge not implemented")
+}
+func (UnimplementedControlPlaneServer) Warm(*WarmRequest, grpc.ServerStreamingServer[WarmProgress]) error {
+	return status.Error(codes.Unimplemented, "method Warm not implemented")
+}
+func (UnimplementedControlPlaneServer) Stats(*StatsRequest, grpc.ServerStreamingServer[StatsSnapshot]) error {
+	return status.Error(codes.Unimplemented, "method Stats not implemented")
+}
+func (UnimplementedControlPlaneServer) Inventory(*InventoryRequest, grpc.ServerStreamingServer[InventoryEntry]) error {
+	return status.Error(codes.Unimplemented, "method Inventory not implemented")
+}
+func (UnimplementedControlPlaneServer) mustEmbedUnimplementedControlPlaneServer() {}
+func (UnimplementedControlPlaneServer) testEmbeddedByValue()                      {}
+
+// UnsafeControlPlaneServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlPlaneServer will
+// result in compilation errors.
+type UnsafeControlPlaneServer interface {
+	mustEmbedUnimplementedControlPlaneServer()
+}
+
+func RegisterControlPlaneServer(s grpc.ServiceRegistrar, srv ControlPlaneServer) {
+	// If the following call panics, it indicates UnimplementedControlPlaneServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ControlPlane_ServiceDesc, srv)
+}
+
+func _ControlPlane_Purge_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PurgeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlPlaneServer).Purge(m, &grpc.GenericServerStream[PurgeRequest, PurgeProgress]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ControlPlane_PurgeServer = grpc.ServerStreamingServer[PurgeProgress]
+
+func _ControlPlane_Warm_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WarmRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlPlaneServer).Warm(m, &grpc.GenericServerStream[WarmRequest, WarmProgress]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ControlPlane_WarmServer = grpc.ServerStreamingServer[WarmProgress]
+
+func _ControlPlane_Stats_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StatsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlPlaneServer).Stats(m, &grpc.GenericServerStream[StatsRequest, StatsSnapshot]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ControlPlane_StatsServer = grpc.ServerStreamingServer[StatsSnapshot]
+
+func _ControlPlane_Inventory_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(InventoryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlPlaneServer).Inventory(m, &grpc.GenericServerStream[InventoryRequest, InventoryEntry]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ControlPlane_InventoryServer = grpc.ServerStreamingServer[InventoryEntry]
+
+// ControlPlane_ServiceDesc is the grpc.ServiceDesc for ControlPlane service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ControlPlane_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ocipullthrough.controlplane.v1.ControlPlane",
+	HandlerType: (*ControlPlaneServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Purge",
+			Handler:       _ControlPlane_Purge_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Warm",
+			Handler:       _ControlPlane_Warm_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Stats",
+			Handler:       _ControlPlane_Stats_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Inventory",
+			Handler:       _ControlPlane_Inventory_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "controlplane/v1/controlplane.proto",
+}
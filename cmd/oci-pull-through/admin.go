@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"google.golang.org/grpc"
+
+	"github.com/danielloader/oci-pull-through/internal/admin"
+	"github.com/danielloader/oci-pull-through/internal/config"
+	"github.com/danielloader/oci-pull-through/internal/controlplane"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+	"github.com/danielloader/oci-pull-through/internal/recovery"
+	"github.com/danielloader/oci-pull-through/internal/tlsgen"
+)
+
+// newAdminServer builds the management listener. It serves /metrics, plus
+// the admin API when ADMIN_ENABLED is set, and is kept off the data-plane
+// listener so publishing the registry never publishes cache management.
+func newAdminServer(cfg config.Config, api *admin.Handler) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	if api != nil {
+		mux.Handle("/admin/", api)
+	}
+
+	tlsConfig, err := adminTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AdminToken == "" && tlsConfig.ClientCAs == nil && !isLoopback(cfg.AdminListenAddr) {
+		return nil, fmt.Errorf("ADMIN_LISTEN_ADDR %s is not a loopback address; set ADMIN_TOKEN or ADMIN_CLIENT_CA", cfg.AdminListenAddr)
+	}
+
+	var handler http.Handler = recovery.Middleware(admin.RequireToken(cfg.AdminToken, mux))
+	if cfg.HSTSMaxAge > 0 {
+		handler = tlsgen.HSTS(handler, cfg.HSTSMaxAge, cfg.HSTSSubdomains)
+	}
+	srv := &http.Server{
+		Addr:    cfg.AdminListenAddr,
+		Handler: handler,
+	}
+	if len(tlsConfig.Certificates) > 0 {
+		srv.TLSConfig = tlsConfig
+		srv.Protocols = tlsOptions(cfg).Protocols()
+	}
+	return srv, nil
+}
+
+// adminTLSConfig loads the admin listener's certificate and, for mTLS, the
+// CA that client certificates must chain to. Setting ADMIN_CLIENT_CA without
+// a certificate uses a generated self-signed one.
+func adminTLSConfig(cfg config.Config) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	switch {
+	case cfg.AdminTLSCert != "" || cfg.AdminTLSKey != "":
+		cert, err := tls.LoadX509KeyPair(cfg.AdminTLSCert, cfg.AdminTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading ADMIN_TLS_CERT/ADMIN_TLS_KEY: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	case cfg.AdminClientCA != "":
+		cert, err := tlsgen.SelfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.AdminClientCA != "" {
+		pem, err := os.ReadFile(cfg.AdminClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading ADMIN_CLIENT_CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("ADMIN_CLIENT_CA contains no PEM certificates")
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if err := hardenServerTLS(cfg, tc); err != nil {
+		return nil, fmt.Errorf("admin listener TLS: %w", err)
+	}
+	return tc, nil
+}
+
+// isLoopback reports whether a listen address only accepts local
+// connections. An empty host (":9090") listens on all interfaces.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newControlPlaneServer builds the gRPC control plane. It shares the admin
+// listener's credentials and the same rule against exposing it unauthenticated.
+func newControlPlaneServer(cfg config.Config, srv *controlplane.Server) (*grpc.Server, error) {
+	tlsConfig, err := adminTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AdminToken == "" && tlsConfig.ClientCAs == nil && !isLoopback(cfg.ControlPlaneGRPCAddr) {
+		return nil, fmt.Errorf("CONTROL_PLANE_GRPC_ADDR %s is not a loopback address; set ADMIN_TOKEN or ADMIN_CLIENT_CA", cfg.ControlPlaneGRPCAddr)
+	}
+	if len(tlsConfig.Certificates) == 0 {
+		tlsConfig = nil
+	}
+	return controlplane.NewGRPCServer(srv, cfg.AdminToken, tlsConfig), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+
+	"github.com/danielloader/oci-pull-through/internal/config"
+	"github.com/danielloader/oci-pull-through/internal/upstreamauth"
+)
+
+// dockerHubNames are the registry names Docker Hub is addressed by.
+var dockerHubNames = []string{"docker.io", "index.docker.io", "registry.docker.io", "registry-1.docker.io"}
+
+// newUpstreamAuth builds the upstream credential chains from
+// UPSTREAM_AUTH_FILE, plus a token provider for Docker Hub when
+// DOCKERHUB_USERNAME is set, an ECR login for each UPSTREAM_ECR_HOSTS
+// entry and a SigV4 chain for each UPSTREAM_SIGV4_HOSTS entry. The AWS
+// ones share credentials from the default AWS chain.
+func newUpstreamAuth(ctx context.Context, cfg config.Config) (*upstreamauth.Chain, error) {
+	chain := upstreamauth.NewChain()
+	if cfg.UpstreamAuthFile != "" {
+		var err error
+		if chain, err = upstreamauth.LoadFile(ctx, cfg.UpstreamAuthFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DockerHubUsername != "" || cfg.DockerHubToken != "" {
+		if cfg.DockerHubUsername == "" || cfg.DockerHubToken == "" {
+			return nil, errors.New("DOCKERHUB_USERNAME and DOCKERHUB_TOKEN must be set together")
+		}
+		hub := upstreamauth.Exchange(upstreamauth.StaticSource(upstreamauth.Credential{
+			Username: cfg.DockerHubUsername,
+			Password: cfg.DockerHubToken,
+		}))
+		for _, name := range dockerHubNames {
+			chain.Add(name, "dockerhub", hub)
+		}
+	}
+	if len(cfg.UpstreamSigV4Hosts) == 0 && len(cfg.UpstreamECRHosts) == 0 {
+		return chain, nil
+	}
+
+	if len(cfg.UpstreamSigV4Hosts) > 0 && cfg.UpstreamSigV4Region == "" {
+		return nil, errors.New("UPSTREAM_SIGV4_REGION is required with UPSTREAM_SIGV4_HOSTS")
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	if len(cfg.UpstreamECRHosts) > 0 {
+		login := upstreamauth.NewECR(awsCfg.Credentials, "", "")
+		for _, host := range cfg.UpstreamECRHosts {
+			chain.Add(host, "ecr", login)
+		}
+	}
+	signer := upstreamauth.NewSigV4(awsCfg.Credentials, cfg.UpstreamSigV4Region, cfg.UpstreamSigV4Service)
+	for _, host := range cfg.UpstreamSigV4Hosts {
+		chain.Add(host, "sigv4", signer)
+	}
+	return chain, nil
+}
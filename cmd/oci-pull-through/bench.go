@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/bench"
+)
+
+// runBench pulls images through a running proxy from many concurrent
+// clients and prints throughput and latency percentiles, returning the
+// process exit code (1 if any pull failed).
+//
+// Usage: oci-pull-through bench -target http://cache:8080 -image org/app:v1[,org/db:v2] [-c 16] [-duration 30s] [-pulls N] [-miss-ratio 0.1] [-json]
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("target", "", "proxy base URL (required)")
+	images := fs.String("image", "", "comma-separated images to pull, as repository paths on the proxy (required)")
+	platform := fs.String("platform", "linux/amd64", "platform to pull from multi-arch images")
+	concurrency := fs.Int("c", 16, "concurrent clients")
+	duration := fs.Duration("duration", 30*time.Second, "how long to run")
+	pulls := fs.Int("pulls", 0, "stop after this many pulls (default: run for -duration)")
+	missRatio := fs.Float64("miss-ratio", 0, "fraction of pulls that bypass the cache; the proxy must trust this host via CACHE_BYPASS_TRUSTED_CIDRS")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *target == "" || *images == "" {
+		fmt.Fprintln(os.Stderr, "bench: -target and -image are required")
+		return 1
+	}
+	if *missRatio < 0 || *missRatio > 1 {
+		fmt.Fprintln(os.Stderr, "bench: -miss-ratio must be between 0 and 1")
+		return 1
+	}
+
+	var refs []string
+	for ref := range strings.SplitSeq(*images, ",") {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *concurrency
+	if *insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	report, err := bench.Run(ctx, bench.Options{
+		Target:        *target,
+		Images:        refs,
+		Platform:      *platform,
+		Concurrency:   *concurrency,
+		Duration:      *duration,
+		Pulls:         *pulls,
+		MissRatio:     *missRatio,
+		Authorization: os.Getenv("BENCH_AUTHORIZATION"),
+		Client:        &http.Client{Transport: transport},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.WriteText(os.Stdout)
+	}
+	if report.FailedPulls > 0 {
+		return 1
+	}
+	return 0
+}
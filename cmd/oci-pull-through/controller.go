@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/admin"
+	"github.com/danielloader/oci-pull-through/internal/fleet"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+	"github.com/danielloader/oci-pull-through/internal/recovery"
+)
+
+// runController serves the fleet controller that edge proxies register
+// with, and returns the process exit code. FLEET_TOKEN, if set, must be
+// presented by edges and operators alike.
+//
+// Usage: oci-pull-through controller [-listen :9400] [-policy policy.json] [-tls-cert c -tls-key k]
+func runController(args []string) int {
+	fs := flag.NewFlagSet("controller", flag.ContinueOnError)
+	listen := fs.String("listen", ":9400", "address to serve the fleet API on")
+	policyFile := fs.String("policy", "", "JSON file with the initial fleet policy")
+	certFile := fs.String("tls-cert", "", "TLS certificate file")
+	keyFile := fs.String("tls-key", "", "TLS key file")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		fmt.Fprintln(os.Stderr, "controller: -tls-cert and -tls-key must be set together")
+		return 1
+	}
+
+	token := os.Getenv("FLEET_TOKEN")
+	if token == "" && !isLoopback(*listen) {
+		fmt.Fprintf(os.Stderr, "controller: %s is not a loopback address; set FLEET_TOKEN\n", *listen)
+		return 1
+	}
+
+	c := fleet.NewController()
+	if *policyFile != "" {
+		data, err := os.ReadFile(*policyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "controller: %v\n", err)
+			return 1
+		}
+		var p proxy.Policy
+		if err := json.Unmarshal(data, &p); err != nil {
+			fmt.Fprintf(os.Stderr, "controller: parsing %s: %v\n", *policyFile, err)
+			return 1
+		}
+		c.SetPolicy(p)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: *listen, Handler: recovery.Middleware(admin.RequireToken(token, c))}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("starting fleet controller", "addr", *listen, "tls", *certFile != "", "token", token != "")
+	var err error
+	if *certFile != "" {
+		err = srv.ListenAndServeTLS(*certFile, *keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "controller: %v\n", err)
+		return 1
+	}
+	return 0
+}
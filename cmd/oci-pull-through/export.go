@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/export"
+)
+
+// runExport writes cached images to a directory in skopeo's dir layout and
+// returns the process exit code. It reads the storage backend from the
+// same environment as the server.
+//
+// Usage: oci-pull-through export -dir /out [-repo 'ghcr.io/org/*'] [-digests]
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dir := fs.String("dir", "", "output directory (required)")
+	repos := fs.String("repo", "", "comma-separated registry/name patterns to export (default all)")
+	digests := fs.Bool("digests", false, "also export digest manifests as repo@digest images")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "export: -dir is required")
+		return 1
+	}
+
+	cfg, err := loadConfig("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	store, err := newStore(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+
+	var patterns []string
+	for p := range strings.SplitSeq(*repos, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+
+	schema, err := cache.ParseKeySchema(cfg.StorageKeySchema)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: STORAGE_KEY_SCHEMA: %v\n", err)
+		return 1
+	}
+
+	res, err := export.Export(ctx, store, *dir, export.Options{Repositories: patterns, Digests: *digests, KeySchema: schema})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("exported %d images (%d blobs, %d bytes), skipped %d incomplete\n", res.Images, res.Blobs, res.Bytes, res.Skipped)
+	return 0
+}
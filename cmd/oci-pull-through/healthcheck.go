@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// runHealthcheck probes the locally running server and returns the process
+// exit code. It derives the target from the same environment as the server
+// (LISTEN_ADDR, GENERATE_SELF_SIGNED_TLS) so scratch-container healthchecks
+// work unchanged on custom ports and HTTPS deployments.
+//
+// Usage: oci-pull-through -healthcheck [-ready]
+func runHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	ready := fs.Bool("ready", false, "check /readyz instead of /healthz")
+	timeout := fs.Duration("timeout", 5*time.Second, "request timeout")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	cfg, err := loadConfig("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck: %v\n", err)
+		return 1
+	}
+
+	path := "/healthz"
+	if *ready {
+		path = "/readyz"
+	}
+
+	scheme := "http"
+	client := &http.Client{Timeout: *timeout}
+	if cfg.GenerateSelfSignedTLS {
+		scheme = "https"
+		// The self-signed certificate can't be verified, but we only ever
+		// talk to our own process over loopback.
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	url := fmt.Sprintf("%s://%s%s", scheme, loopbackAddr(cfg.ListenAddr), path)
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck failed: %v\n", err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "healthcheck failed: %s returned %d\n", path, resp.StatusCode)
+		return 1
+	}
+	return 0
+}
+
+// loopbackAddr converts a listen address into one dialable from the same
+// host. Wildcard or empty hosts (":8080", "0.0.0.0:8080", "[::]:8080") are
+// replaced with 127.0.0.1; explicit hosts are kept.
+func loopbackAddr(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
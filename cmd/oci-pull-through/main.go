@@ -4,52 +4,225 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 
+	"github.com/danielloader/oci-pull-through/internal/adaptive"
+	"github.com/danielloader/oci-pull-through/internal/admin"
+	"github.com/danielloader/oci-pull-through/internal/audit"
 	"github.com/danielloader/oci-pull-through/internal/cache"
 	"github.com/danielloader/oci-pull-through/internal/config"
+	"github.com/danielloader/oci-pull-through/internal/controlplane"
+	"github.com/danielloader/oci-pull-through/internal/dnscache"
+	"github.com/danielloader/oci-pull-through/internal/faults"
+	"github.com/danielloader/oci-pull-through/internal/fleet"
+	"github.com/danielloader/oci-pull-through/internal/gc"
+	"github.com/danielloader/oci-pull-through/internal/health"
+	"github.com/danielloader/oci-pull-through/internal/index"
+	"github.com/danielloader/oci-pull-through/internal/k8swarm"
+	"github.com/danielloader/oci-pull-through/internal/lifecycle"
+	"github.com/danielloader/oci-pull-through/internal/maintenance"
 	"github.com/danielloader/oci-pull-through/internal/proxy"
+	"github.com/danielloader/oci-pull-through/internal/recording"
+	"github.com/danielloader/oci-pull-through/internal/standby"
+	"github.com/danielloader/oci-pull-through/internal/stream"
 	"github.com/danielloader/oci-pull-through/internal/tlsgen"
+	"github.com/danielloader/oci-pull-through/internal/tracing"
 )
 
-func main() {
+// subcommands run instead of the proxy when named by the first argument.
+// Most are accepted bare or with a leading dash.
+var subcommands = map[string]func(args []string) int{
 	// Self-contained healthcheck for scratch containers (no curl/wget available).
-	// Usage: oci-pull-through -healthcheck
-	if len(os.Args) > 1 && os.Args[1] == "-healthcheck" {
-		resp, err := http.Get("http://127.0.0.1:8080/healthz")
-		if err != nil || resp.StatusCode != http.StatusOK {
+	// Usage: oci-pull-through -healthcheck [-ready]
+	"-healthcheck":     runHealthcheck,
+	"export":           runExport,
+	"-export":          runExport,
+	"migrate-keys":     runMigrateKeys,
+	"-migrate-keys":    runMigrateKeys,
+	"sync":             runSync,
+	"-sync":            runSync,
+	"controller":       runController,
+	"-controller":      runController,
+	"bench":            runBench,
+	"-bench":           runBench,
+	"verify":           runVerify,
+	"-verify":          runVerify,
+	"validate-config":  runValidateConfig,
+	"-validate-config": runValidateConfig,
+}
+
+// subcommand returns the subcommand args name, if any.
+func subcommand(args []string) (func(args []string) int, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	run, ok := subcommands[args[0]]
+	return run, ok
+}
+
+func main() {
+	if run, ok := subcommand(os.Args[1:]); ok {
+		os.Exit(run(os.Args[2:]))
+	}
+
+	// Usage: oci-pull-through [-config config.yaml]
+	flags := flag.NewFlagSet("oci-pull-through", flag.ExitOnError)
+	configFile := flags.String("config", "", "YAML or JSON config file, overridden by environment variables (default CONFIG_FILE)")
+	flags.Parse(os.Args[1:])
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.FIPSMode {
+		if err := tlsgen.CheckFIPS(); err != nil {
+			fmt.Fprintf(os.Stderr, "FIPS_MODE: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.UpstreamRegistry == "" && len(cfg.UpstreamHosts) == 0 && len(cfg.UpstreamPaths) == 0 && len(cfg.ContainerdMirrors) == 0 && len(cfg.HarborProjects) == 0 {
+		fmt.Fprintln(os.Stderr, "no upstream configured: set UPSTREAM_REGISTRY (e.g. https://ghcr.io, https://registry-1.docker.io), UPSTREAM_HOSTS, UPSTREAM_PATHS, CONTAINERD_MIRRORS or HARBOR_PROJECTS")
+		os.Exit(1)
+	}
+	if len(cfg.UpstreamNamespaces[""]) > 0 && cfg.UpstreamRegistry == "" {
+		fmt.Fprintln(os.Stderr, "UPSTREAM_NAMESPACES: patterns not keyed by registry (e.g. docker.io=library/*) apply to UPSTREAM_REGISTRY, which is unset")
+		os.Exit(1)
+	}
+	upstreamURL := &url.URL{Scheme: "https"}
+	if cfg.UpstreamRegistry != "" {
+		u, err := parseUpstreamURL(cfg.UpstreamRegistry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "UPSTREAM_REGISTRY: %v\n", err)
+			os.Exit(1)
+		}
+		upstreamURL = u
+	}
+
+	hostRoutes := make(map[string]string, len(cfg.UpstreamHosts))
+	upstreamSchemes := make(map[string]string)
+	for host, raw := range cfg.UpstreamHosts {
+		u, err := parseUpstreamURL(raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "UPSTREAM_HOSTS entry for %s: %v\n", host, err)
+			os.Exit(1)
+		}
+		hostRoutes[host] = u.Host
+		upstreamSchemes[u.Host] = u.Scheme
+	}
+	pathRoutes := make(map[string]string, len(cfg.UpstreamPaths))
+	for prefix, raw := range cfg.UpstreamPaths {
+		u, err := parseUpstreamURL(raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "UPSTREAM_PATHS entry for %s: %v\n", prefix, err)
+			os.Exit(1)
+		}
+		pathRoutes[prefix] = u.Host
+		upstreamSchemes[u.Host] = u.Scheme
+	}
+	mirrorRoutes := make(map[string]string, len(cfg.ContainerdMirrors))
+	for ns, raw := range cfg.ContainerdMirrors {
+		u, err := parseUpstreamURL(raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "CONTAINERD_MIRRORS entry for %s: %v\n", ns, err)
 			os.Exit(1)
 		}
-		os.Exit(0)
+		mirrorRoutes[ns] = u.Host
+		upstreamSchemes[u.Host] = u.Scheme
+	}
+	projectRoutes := make(map[string]string, len(cfg.HarborProjects))
+	for project, raw := range cfg.HarborProjects {
+		u, err := parseUpstreamURL(raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "HARBOR_PROJECTS entry for %s: %v\n", project, err)
+			os.Exit(1)
+		}
+		projectRoutes[project] = u.Host
+		upstreamSchemes[u.Host] = u.Scheme
+	}
+
+	schema1Policy := proxy.Schema1Policy(cfg.Schema1Policy)
+	if schema1Policy != proxy.Schema1Passthrough && schema1Policy != proxy.Schema1Reject {
+		fmt.Fprintf(os.Stderr, "SCHEMA1_POLICY must be passthrough or reject, got %q\n", cfg.Schema1Policy)
+		os.Exit(1)
 	}
 
-	cfg := config.Load()
+	if cfg.Mode != modeAll && cfg.Mode != modeData && cfg.Mode != modeControl {
+		fmt.Fprintf(os.Stderr, "MODE must be all, data or control, got %q\n", cfg.Mode)
+		os.Exit(1)
+	}
+	// Background work runs unless this process only serves pulls.
+	background := cfg.Mode != modeData
+
+	chain, err := proxy.NewChain(cfg.Middleware)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "MIDDLEWARE: %v\n", err)
+		os.Exit(1)
+	}
+	traceCfg, tracingOn, err := tracing.ConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tracing: %v\n", err)
+		os.Exit(1)
+	}
 
-	if cfg.UpstreamRegistry == "" {
-		fmt.Fprintln(os.Stderr, "UPSTREAM_REGISTRY is required (e.g. https://ghcr.io, https://registry-1.docker.io)")
+	flattenPlatforms, err := proxy.ParsePlatforms(cfg.FlattenPlatforms)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FLATTEN_INDEX_PLATFORMS: %v\n", err)
 		os.Exit(1)
 	}
-	upstreamURL, err := url.Parse(cfg.UpstreamRegistry)
-	if err != nil || upstreamURL.Host == "" {
-		fmt.Fprintf(os.Stderr, "UPSTREAM_REGISTRY %q is not a valid URL (expected https://host or http://host)\n", cfg.UpstreamRegistry)
+
+	bypassNets, err := proxy.ParseCIDRs(cfg.CacheBypassCIDRs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "CACHE_BYPASS_TRUSTED_CIDRS: %v\n", err)
 		os.Exit(1)
 	}
-	if upstreamURL.Scheme != "https" && upstreamURL.Scheme != "http" {
-		fmt.Fprintf(os.Stderr, "UPSTREAM_REGISTRY scheme must be http or https, got %q\n", upstreamURL.Scheme)
+
+	forwardHeaders, err := proxy.ParseForwardHeaders(cfg.UpstreamFwdHeaders)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "UPSTREAM_FORWARD_HEADERS: %v\n", err)
+		os.Exit(1)
+	}
+
+	artifacts, err := proxy.ParseArtifactSources(cfg.ArtifactSources, cfg.ArtifactGitHubToken)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ARTIFACT_SOURCES: %v\n", err)
+		os.Exit(1)
+	}
+
+	keySchema, err := cache.ParseKeySchema(cfg.StorageKeySchema)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "STORAGE_KEY_SCHEMA: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.CacheIsolatePrivate && cfg.CacheIsolationKey == "" {
+		fmt.Fprintln(os.Stderr, "CACHE_ISOLATE_PRIVATE requires CACHE_ISOLATION_KEY")
 		os.Exit(1)
 	}
 
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: cfg.LogLevel})))
+	if cfg.FIPSMode {
+		slog.Info("FIPS mode: TLS restricted to approved versions, cipher suites and curves")
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
@@ -64,9 +237,355 @@ func main() {
 		slog.Error("failed to initialise store", "backend", cfg.StorageBackend, "error", err)
 		os.Exit(1)
 	}
+	// The self-test probes the backend itself, before the index and other
+	// wrappers are layered on.
+	baseStore := store
+	selfTest := func(ctx context.Context) error { return cache.SelfTest(ctx, baseStore) }
+	if cfg.StorageSelfTest {
+		if err := selfTest(ctx); err != nil {
+			slog.Error("storage self-test failed", "backend", cfg.StorageBackend, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("storage self-test passed", "backend", cfg.StorageBackend)
+	}
+	// Faults go in after the self-test, so startup itself isn't failed.
+	if cfg.StorageFaults != "" {
+		spec, err := faults.Parse(cfg.StorageFaults)
+		if err != nil {
+			slog.Error("invalid STORAGE_FAULTS", "error", err)
+			os.Exit(1)
+		}
+		store = faults.Wrap(store, spec, nil)
+		slog.Warn("injecting storage faults; do not use in production", "faults", cfg.StorageFaults)
+	}
+	// Store writes, and below upstream fetches, are limited to what the
+	// backends' latency and errors show they can take.
+	concurrency := adaptive.Config{Min: cfg.AdaptiveMin, Max: cfg.AdaptiveMax, Tolerance: cfg.AdaptiveTolerance}
+	if cfg.AdaptiveConcurrency {
+		store = adaptive.LimitStore(store, adaptive.New("store", concurrency))
+	}
+
+	// Subsystems run on a context that outlives the signal so the manager
+	// can stop them one at a time, servers first.
+	subsystems := lifecycle.New()
+	runCtx := context.WithoutCancel(ctx)
+
+	// The exporter starts first so it stops last, sending the spans of
+	// the requests the servers drain.
+	if tracingOn {
+		tracer := tracing.New(traceCfg)
+		tracing.SetDefault(tracer)
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "trace-exporter", Run: tracer.Run})
+		slog.Info("exporting traces", "endpoint", traceCfg.Endpoint, "service", traceCfg.Resource["service.name"])
+	}
+
+	// A warm standby runs everything but reports not ready, so it is sent
+	// no traffic, until the admin API or the leader lease promotes it.
+	var gate *standby.Gate
+	if cfg.Standby || cfg.StandbyElection {
+		gate = standby.New(true)
+		slog.Info("starting as a warm standby", "leader_election", cfg.StandbyElection)
+	}
+	if cfg.StandbyElection {
+		if cfg.StandbyLeaseTTL < time.Second {
+			fmt.Fprintf(os.Stderr, "STANDBY_LEASE_TTL: must be at least 1s, got %s\n", cfg.StandbyLeaseTTL)
+			os.Exit(1)
+		}
+		election := &standby.Election{Gate: gate, Store: store, ID: cfg.StandbyID, TTL: cfg.StandbyLeaseTTL}
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "leader-election", Run: election.Run})
+	}
 
-	upstreamClient := proxy.NewUpstreamClient()
+	var ready func() error
+	var idx *index.Index
+	if cfg.CacheIndex {
+		idx = index.New()
+		var snapshotKey string
+		if name := cfg.CacheIndexSnapshotKey; name != "" {
+			if strings.Contains(name, "/") {
+				fmt.Fprintf(os.Stderr, "CACHE_INDEX_SNAPSHOT_KEY: %q is a name, not a path\n", name)
+				os.Exit(1)
+			}
+			snapshotKey = cache.StatePrefix + "index/" + name
+		}
+		builder := &index.Builder{
+			Index:        idx,
+			Store:        store,
+			SnapshotPath: cfg.CacheIndexSnapshot,
+			SnapshotKey:  snapshotKey,
+			LogEvery:     10 * time.Second,
+			SaveEvery:    time.Minute,
+		}
+		if gate != nil {
+			builder.Standby = gate.Standby
+			builder.RefreshEvery = cfg.StandbyIndexRefresh
+		}
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "cache-index", Run: builder.Run})
+		store = index.Track(store, idx)
+		if cfg.CacheIndexWait {
+			ready = func() error {
+				if !idx.Ready() {
+					return errors.New("cache index build in progress")
+				}
+				return nil
+			}
+		}
+	}
+	if gate != nil {
+		indexReady := ready
+		ready = func() error {
+			if err := gate.Ready(); err != nil {
+				return err
+			}
+			if indexReady != nil {
+				return indexReady()
+			}
+			return nil
+		}
+	}
+
+	// Degraded states are entered and left automatically from error rates
+	// seen by the store wrapper and the upstream client.
+	var monitor *health.Monitor
+	if cfg.HealthErrorThreshold > 0 {
+		monitor = health.NewMonitor(cfg.HealthWindow, cfg.HealthErrorThreshold, cfg.HealthMinErrors, cfg.HealthProbeInterval)
+		monitor.Cooldowns = map[string]time.Duration{health.RedirectsDisabled: cfg.RedirectRetryCooldown}
+		store = health.Track(store, monitor)
+	}
+
+	// Maintenance windows pin what they warm, so the pins have to reach
+	// the collectors and the handler before any of them start.
+	var windows *maintenance.Scheduler
+	var pinned func(key string) bool
+	if cfg.MaintenanceWindows != "" && background {
+		list, err := maintenance.Load(cfg.MaintenanceWindows)
+		if err != nil {
+			slog.Error("failed to load maintenance windows", "error", err)
+			os.Exit(1)
+		}
+		windows = &maintenance.Scheduler{Windows: list}
+		pinned = windows.Pinned
+	}
+
+	if cfg.RetentionRulesFile != "" && background {
+		rules, err := gc.LoadRules(cfg.RetentionRulesFile)
+		if err != nil {
+			slog.Error("failed to load retention rules", "error", err)
+			os.Exit(1)
+		}
+		collector := &gc.Collector{
+			Store:    store,
+			Rules:    rules,
+			Pinned:   pinned,
+			DryRun:   cfg.RetentionDryRun,
+			Interval: cfg.RetentionInterval,
+		}
+		if idx != nil {
+			collector.LastAccess = idx.LastAccess
+		} else {
+			slog.Warn("CACHE_INDEX is off; retention max_idle rules will use time cached instead of last pull")
+		}
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "retention", Run: collector.Run})
+		slog.Info("retention enabled", "rules", len(rules), "interval", cfg.RetentionInterval, "dry_run", cfg.RetentionDryRun)
+	}
+
+	if cfg.S3MaxBytes > 0 && background {
+		if cfg.StorageBackend != "s3" {
+			slog.Error("S3_MAX_BYTES requires STORAGE_BACKEND=s3", "backend", cfg.StorageBackend)
+			os.Exit(1)
+		}
+		if idx == nil {
+			slog.Error("S3_MAX_BYTES requires CACHE_INDEX=true")
+			os.Exit(1)
+		}
+		budget := &gc.Budget{
+			Store:    store,
+			Index:    idx,
+			MaxBytes: cfg.S3MaxBytes,
+			Pinned:   pinned,
+			DryRun:   cfg.RetentionDryRun,
+			Interval: cfg.S3EvictionInterval,
+		}
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "size-limit", Run: budget.Run})
+		slog.Info("cache size limit enabled", "max_bytes", cfg.S3MaxBytes, "interval", cfg.S3EvictionInterval)
+	}
+
+	if (cfg.FSMaxBytes > 0 || cfg.FSMaxAge > 0) && background {
+		evicter, ok := baseStore.(cache.Evicter)
+		if !ok {
+			slog.Error("FS_MAX_BYTES and FS_MAX_AGE require STORAGE_BACKEND=fs", "backend", cfg.StorageBackend)
+			os.Exit(1)
+		}
+		eviction := &gc.Eviction{
+			Store:    evicter,
+			Limits:   cache.EvictLimits{MaxBytes: cfg.FSMaxBytes, MaxAge: cfg.FSMaxAge},
+			Pinned:   pinned,
+			DryRun:   cfg.RetentionDryRun,
+			Interval: cfg.FSEvictionInterval,
+		}
+		if idx != nil {
+			eviction.Forget = idx.Remove
+		}
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "fs-eviction", Run: eviction.Run})
+		slog.Info("filesystem eviction enabled", "max_bytes", cfg.FSMaxBytes, "max_age", cfg.FSMaxAge, "interval", cfg.FSEvictionInterval)
+	}
+
+	if cleaner, ok := baseStore.(cache.Cleaner); ok && cfg.JanitorInterval > 0 && background {
+		janitor := &gc.Janitor{
+			Store:    cleaner,
+			MinAge:   cfg.JanitorMinAge,
+			DryRun:   cfg.RetentionDryRun,
+			Interval: cfg.JanitorInterval,
+		}
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "janitor", Run: janitor.Run})
+	}
+
+	if cfg.UsageScanInterval > 0 && background {
+		usage := &gc.Usage{
+			Store:       baseStore,
+			Concurrency: cfg.UsageScanConcurrency,
+			Interval:    cfg.UsageScanInterval,
+		}
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "usage-scan", Run: usage.Run})
+	}
+
+	var auditOut io.Writer
+	if cfg.TagAuditLog != "" {
+		f, err := os.OpenFile(cfg.TagAuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			slog.Error("failed to open tag audit log", "path", cfg.TagAuditLog, "error", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		auditOut = f
+	}
+
+	inflight := stream.NewInflight()
+	uploads := stream.NewUploads(cfg.UploadTimeout)
+	uploads.FinishBytes = cfg.FinishFillBytes
+	uploads.FinishTimeout = cfg.FinishFillTimeout
+	uploads.SpoolBytes = cfg.SpoolFillBytes
+	uploads.SpoolMemoryBytes = cfg.SpoolMemoryBytes
+	uploads.SpoolDir = cfg.SpoolDir
+
+	var resolver *dnscache.Resolver
+	if cfg.DNSCacheTTL > 0 {
+		resolver = dnscache.New(cfg.DNSCacheTTL, cfg.DNSCacheMaxStale)
+	}
+	upstreamClient := proxy.NewUpstreamClient(resolver)
+	if cfg.FIPSMode {
+		transport := upstreamClient.Client.Transport.(*http.Transport)
+		transport.TLSClientConfig = &tls.Config{}
+		if err := tlsgen.RestrictFIPS(transport.TLSClientConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "FIPS_MODE: upstream TLS settings: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	upstreamClient.Scheme = upstreamURL.Scheme
+	upstreamClient.Schemes = upstreamSchemes
+	upstreamClient.MaxRedirects = cfg.UpstreamMaxRedirects
+	if cfg.AdaptiveConcurrency {
+		upstreamClient.Concurrency = adaptive.NewSet("upstream", concurrency)
+	}
+	upstreamClient.CDNRewrites = cfg.UpstreamCDNRewrites
+	upstreamClient.Freeze = &proxy.Freeze{}
+	transferCaps := make(map[string]proxy.TransferCaps)
+	for env, caps := range map[string]map[string]string{
+		"UPSTREAM_TRANSFER_SOFT_CAPS": cfg.TransferSoftCaps,
+		"UPSTREAM_TRANSFER_HARD_CAPS": cfg.TransferHardCaps,
+	} {
+		for host, v := range caps {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s: %v\n", env, host, err)
+				os.Exit(1)
+			}
+			c := transferCaps[host]
+			if env == "UPSTREAM_TRANSFER_SOFT_CAPS" {
+				c.Soft = n
+			} else {
+				c.Hard = n
+			}
+			transferCaps[host] = c
+		}
+	}
+	upstreamClient.Transfer, err = proxy.NewTransfer(cfg.TransferPeriod, transferCaps)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "UPSTREAM_TRANSFER_PERIOD: %v\n", err)
+		os.Exit(1)
+	}
+	upstreamClient.Health = monitor
+	upstreamClient.ForwardHeaders = forwardHeaders
+	upstreamClient.UserAgent = cfg.UpstreamUserAgent
+	if upstreamClient.UserAgent == "" {
+		upstreamClient.UserAgent = proxy.UserAgent(buildVersion(), cfg.DeploymentName)
+	}
+	switch {
+	case cfg.UpstreamReplayFile != "":
+		replayer, err := recording.Load(cfg.UpstreamReplayFile)
+		if err != nil {
+			slog.Error("failed to load upstream recording", "path", cfg.UpstreamReplayFile, "error", err)
+			os.Exit(1)
+		}
+		upstreamClient.Client.Transport = replayer
+		slog.Warn("replaying upstream responses from a recording; the network is not used", "path", cfg.UpstreamReplayFile)
+	case cfg.UpstreamRecordFile != "":
+		f, err := os.OpenFile(cfg.UpstreamRecordFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			slog.Error("failed to open upstream recording", "path", cfg.UpstreamRecordFile, "error", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		upstreamClient.Client.Transport = &recording.Recorder{
+			Next:    upstreamClient.Client.Transport,
+			W:       f,
+			MaxBody: cfg.UpstreamRecordMaxBody,
+		}
+		slog.Warn("recording upstream traffic", "path", cfg.UpstreamRecordFile, "max_body", cfg.UpstreamRecordMaxBody)
+	}
+	upstreamClient.Quirks = make(map[string]proxy.Quirks)
+	for host, spec := range cfg.UpstreamQuirks {
+		q, err := proxy.ParseQuirks(spec)
+		if err != nil {
+			slog.Error("invalid UPSTREAM_QUIRKS", "host", host, "error", err)
+			os.Exit(1)
+		}
+		upstreamClient.Quirks[host] = q
+	}
+	for host, prefix := range cfg.UpstreamPathPrefixes {
+		q := upstreamClient.Quirks[host]
+		q.PathPrefix = "/" + strings.Trim(prefix, "/")
+		upstreamClient.Quirks[host] = q
+	}
+	upstreamClient.PreferredRegions = make(map[string][]string)
+	for host, spec := range cfg.UpstreamRegions {
+		regions, err := proxy.ParseRegions(spec)
+		if err != nil {
+			slog.Error("invalid UPSTREAM_PREFERRED_REGIONS", "host", host, "error", err)
+			os.Exit(1)
+		}
+		upstreamClient.PreferredRegions[host] = regions
+	}
+	if cfg.UpstreamAuthFile != "" || cfg.DockerHubUsername != "" || cfg.DockerHubToken != "" || len(cfg.UpstreamECRHosts) > 0 || len(cfg.UpstreamSigV4Hosts) > 0 {
+		auth, err := newUpstreamAuth(ctx, cfg)
+		if err != nil {
+			slog.Error("failed to configure upstream auth", "error", err)
+			os.Exit(1)
+		}
+		upstreamClient.Auth = auth
+	}
+
+	var canaries []proxy.Canary
+	if cfg.PolicyCanaryFile != "" {
+		var err error
+		canaries, err = proxy.LoadCanaries(cfg.PolicyCanaryFile)
+		if err != nil {
+			slog.Error("failed to load policy canaries", "error", err)
+			os.Exit(1)
+		}
+		for _, c := range canaries {
+			slog.Info("policy canary", "name", c.Name, "repositories", c.Repositories, "percent", c.Percent)
+		}
+	}
 
 	handler := &proxy.Handler{
 		Registry:          upstreamURL.Host,
@@ -74,28 +593,177 @@ func main() {
 		Upstream:          upstreamClient,
 		CacheTagManifests: cfg.CacheTagManifests,
 		CacheLatestTag:    cfg.CacheLatestTag,
+		TagTTL:            cfg.TagManifestTTL,
+		TagMaxStale:       cfg.TagManifestMaxStale,
+		TagStaleIfError:   cfg.TagStaleIfError,
+		Canaries:          canaries,
+		MaxManifestSize:   cfg.MaxManifestSize,
+		Timeouts: proxy.Timeouts{
+			Short:    cfg.ShortRequestTimeout,
+			Manifest: cfg.ManifestTimeout,
+			Blob:     cfg.BlobTimeout,
+		},
+		MaxBufferedBytes:      cfg.MaxBufferedBytes,
+		KeySchema:             keySchema,
+		ChunkSize:             cfg.BlobChunkSize,
+		Schema1Policy:         schema1Policy,
+		FlattenPlatforms:      flattenPlatforms,
+		HostRoutes:            hostRoutes,
+		PathRoutes:            pathRoutes,
+		MirrorRoutes:          mirrorRoutes,
+		Projects:              projectRoutes,
+		AllowedNamespaces:     cfg.UpstreamNamespaces,
+		DigestPinned:          cfg.DigestPinned,
+		TagAudit:              audit.NewTagLog(auditOut),
+		Inflight:              inflight,
+		Uploads:               uploads,
+		Ready:                 ready,
+		Health:                monitor,
+		SelfTest:              selfTest,
+		RedirectRetryWindow:   cfg.RedirectRetryWindow,
+		RedirectRetryCooldown: cfg.RedirectRetryCooldown,
+		V2CheckTTL:            cfg.V2CheckTTL,
+		BypassTrustedNets:     bypassNets,
+		IsolatePrivate:        cfg.CacheIsolatePrivate,
+		SharedRepositories:    cfg.CacheSharedRepos,
+		IsolationKey:          []byte(cfg.CacheIsolationKey),
+		Pinned:                pinned,
+		Artifacts:             artifacts,
+		HelmFacade:            cfg.HelmFacade,
+		// Artifact sources redirect freely (GitHub to its CDN), unlike
+		// registries, whose redirects the upstream client follows itself.
+		ArtifactClient: &http.Client{Transport: upstreamClient.Client.Transport},
+	}
+	if cfg.PrefetchBudget > 0 {
+		handler.Prefetch = &proxy.Prefetcher{
+			Budget:       cfg.PrefetchBudget,
+			BudgetPeriod: cfg.PrefetchBudgetPeriod,
+			Window:       cfg.PrefetchWindow,
+			MinSupport:   cfg.PrefetchMinSupport,
+			Confidence:   cfg.PrefetchConfidence,
+		}
+	}
+
+	var adminAPI *admin.Handler
+	if cfg.AdminEnabled {
+		adminAPI = admin.NewHandler(inflight, upstreamClient)
+		adminAPI.Subsystems = subsystems.Statuses
+		adminAPI.Simulate = handler.Simulate
+		adminAPI.Freeze = upstreamClient.Freeze
+		adminAPI.Transfer = upstreamClient.Transfer
+		adminAPI.Store = store
+		adminAPI.CacheKey = handler.CacheKey
+		adminAPI.CacheRepository = handler.CacheRepository
+		adminAPI.Standby = gate
+		if idx != nil {
+			adminAPI.References = idx.References
+			adminAPI.LastAccess = idx.LastAccess
+		}
+	}
+	adminServer, err := newAdminServer(cfg, adminAPI)
+	if err != nil {
+		slog.Error("invalid admin listener configuration", "error", err)
+		os.Exit(1)
+	}
+
+	var controlPlane *grpc.Server
+	if cfg.ControlPlaneGRPCAddr != "" {
+		controlPlane, err = newControlPlaneServer(cfg, &controlplane.Server{
+			Store:    store,
+			Warmer:   handler,
+			Inflight: inflight,
+			Index:    idx,
+		})
+		if err != nil {
+			slog.Error("invalid control plane configuration", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.FleetControllerURL != "" && cfg.Mode != modeControl {
+		agent := &fleet.Agent{
+			ControllerURL: cfg.FleetControllerURL,
+			Token:         cfg.FleetToken,
+			ID:            cfg.FleetEdgeID,
+			Upstream:      cfg.UpstreamRegistry,
+			Interval:      cfg.FleetInterval,
+			Client:        &http.Client{Timeout: 30 * time.Second},
+			Store:         store,
+			Warm:          handler.Warm,
+			ApplyPolicy:   handler.SetPolicy,
+			Stats: func() fleet.Stats {
+				s := fleet.Stats{InflightFills: len(inflight.List())}
+				if idx != nil {
+					s.IndexReady = idx.Ready()
+					for _, st := range idx.Stats() {
+						s.Objects += st.Objects
+						s.Bytes += st.Bytes
+					}
+				}
+				return s
+			},
+		}
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "fleet-agent", Run: agent.Run})
+		slog.Info("fleet mode enabled", "controller", cfg.FleetControllerURL, "edge", cfg.FleetEdgeID, "interval", cfg.FleetInterval)
 	}
 
-	logged := proxy.LoggingMiddleware(handler)
+	if len(cfg.K8sPrewarmNamespaces) > 0 && background {
+		discoverer, err := k8swarm.InCluster(cfg.K8sPrewarmNamespaces)
+		if err != nil {
+			slog.Error("K8S_PREWARM_NAMESPACES is set but the Kubernetes API is unavailable", "error", err)
+			os.Exit(1)
+		}
+		prewarmer := &k8swarm.Prewarmer{
+			Discoverer: discoverer,
+			Warm:       handler.Warm,
+			Serves:     handler.ServesImage,
+			Interval:   cfg.K8sPrewarmInterval,
+		}
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "k8s-prewarm", Run: prewarmer.Run})
+		slog.Info("kubernetes prewarm enabled", "namespaces", cfg.K8sPrewarmNamespaces, "interval", cfg.K8sPrewarmInterval)
+	}
+
+	if windows != nil {
+		windows.Warm = handler.WarmFresh
+		windows.Serves = handler.ServesImage
+		subsystems.Start(runCtx, lifecycle.Subsystem{Name: "maintenance-windows", Run: windows.Run})
+		slog.Info("maintenance windows enabled", "windows", len(windows.Windows))
+	}
+
+	var served http.Handler = handler
+	if cfg.Mode == modeControl {
+		served = healthOnly(handler)
+	}
+	logged := chain.Then(served)
 
 	var server *http.Server
 
 	if cfg.GenerateSelfSignedTLS {
-		cert, err := tlsgen.SelfSignedCert()
+		cert, err := tlsgen.SelfSignedCert(slices.Collect(maps.Keys(hostRoutes))...)
 		if err != nil {
 			slog.Error("failed to generate self-signed certificate", "error", err)
 			os.Exit(1)
 		}
 		slog.Info("generated self-signed TLS certificate")
 
+		var handler http.Handler = logged
+		if cfg.HSTSMaxAge > 0 {
+			handler = tlsgen.HSTS(handler, cfg.HSTSMaxAge, cfg.HSTSSubdomains)
+		}
 		server = &http.Server{
 			Addr:    cfg.ListenAddr,
-			Handler: logged,
+			Handler: handler,
 			TLSConfig: &tls.Config{
 				Certificates: []tls.Certificate{cert},
 			},
+			// http2 is configured automatically by ListenAndServeTLS,
+			// unless TLS_ALPN leaves it out.
+			Protocols: tlsOptions(cfg).Protocols(),
+		}
+		if err := hardenServerTLS(cfg, server.TLSConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "TLS settings: %v\n", err)
+			os.Exit(1)
 		}
-		// http2 is configured automatically by ListenAndServeTLS
 	} else {
 		// Wrap with h2c for cleartext HTTP/2 support alongside HTTP/1.1
 		h2s := &http2.Server{}
@@ -105,39 +773,114 @@ func main() {
 		}
 	}
 
-	go func() {
-		slog.Info("starting server", "addr", cfg.ListenAddr, "upstream", cfg.UpstreamRegistry, "tls", cfg.GenerateSelfSignedTLS, "backend", cfg.StorageBackend)
-		var err error
-		if cfg.GenerateSelfSignedTLS {
-			err = server.ListenAndServeTLS("", "")
-		} else {
-			err = server.ListenAndServe()
-		}
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			slog.Error("server error", "error", err)
+	// Cache uploads get a grace period once the server starts draining,
+	// then are cut off, so a slow store can't run out the shutdown
+	// timeout the index snapshot still needs.
+	server.RegisterOnShutdown(func() { uploads.AbortAfter(cfg.UploadShutdownGrace) })
+
+	slog.Info("starting admin server", "addr", cfg.AdminListenAddr, "api", cfg.AdminEnabled,
+		"token", cfg.AdminToken != "", "mtls", cfg.AdminClientCA != "")
+	subsystems.Start(runCtx, lifecycle.Subsystem{
+		Name:     "admin-server",
+		Critical: true,
+		Run: func(context.Context) error {
+			if adminServer.TLSConfig != nil {
+				return ignoreServerClosed(adminServer.ListenAndServeTLS("", ""))
+			}
+			return ignoreServerClosed(adminServer.ListenAndServe())
+		},
+		Stop: adminServer.Shutdown,
+	})
+
+	if controlPlane != nil {
+		lis, err := net.Listen("tcp", cfg.ControlPlaneGRPCAddr)
+		if err != nil {
+			slog.Error("control plane listen failed", "addr", cfg.ControlPlaneGRPCAddr, "error", err)
 			os.Exit(1)
 		}
-	}()
+		slog.Info("starting control plane", "addr", cfg.ControlPlaneGRPCAddr)
+		subsystems.Start(runCtx, lifecycle.Subsystem{
+			Name:     "control-plane",
+			Critical: true,
+			Run:      func(context.Context) error { return controlPlane.Serve(lis) },
+			// Stats streams run until cancelled, so don't wait for them.
+			Stop: func(context.Context) error { controlPlane.Stop(); return nil },
+		})
+	}
 
-	<-ctx.Done()
-	slog.Info("shutting down gracefully")
+	slog.Info("starting server", "mode", cfg.Mode, "addr", cfg.ListenAddr, "upstream", cfg.UpstreamRegistry, "tls", cfg.GenerateSelfSignedTLS, "backend", cfg.StorageBackend,
+		"user_agent", upstreamClient.UserAgent)
+	subsystems.Start(runCtx, lifecycle.Subsystem{
+		Name:     "server",
+		Critical: true,
+		Run: func(context.Context) error {
+			if cfg.GenerateSelfSignedTLS {
+				return ignoreServerClosed(server.ListenAndServeTLS("", ""))
+			}
+			return ignoreServerClosed(server.ListenAndServe())
+		},
+		Stop: server.Shutdown,
+	})
+
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down gracefully")
+	case err := <-subsystems.Fatal():
+		slog.Error("shutting down after subsystem failure", "error", err)
+		exitCode = 1
+	}
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
+	// Servers drain first; the index builder, started first, stops last so
+	// its final snapshot covers every fill.
+	if err := subsystems.Shutdown(shutdownCtx); err != nil {
 		slog.Error("shutdown error", "error", err)
-		os.Exit(1)
+		exitCode = 1
 	}
 	slog.Info("shutdown complete")
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// ignoreServerClosed treats http.ErrServerClosed, returned once Shutdown
+// starts, as a clean stop.
+func ignoreServerClosed(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// parseUpstreamURL validates an upstream registry URL of the form
+// https://host or http://host.
+func parseUpstreamURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a valid URL (expected https://host or http://host)", raw)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	}
+	return u, nil
 }
 
 func newStore(ctx context.Context, cfg config.Config) (cache.Store, error) {
 	switch cfg.StorageBackend {
 	case "s3":
-		return cache.NewS3Store(ctx, cfg.S3Bucket, cfg.S3Prefix, cfg.S3ForcePathStyle, cfg.S3LifecycleDays)
+		s, err := cache.NewS3Store(ctx, cfg.S3Bucket, cfg.S3Prefix, cfg.S3ForcePathStyle, cfg.S3LifecycleDays)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.S3RequestRate > 0 {
+			s.LimitRequests(cfg.S3RequestRate, cfg.S3RequestBurst, cfg.S3RequestMaxWait)
+		}
+		return s, nil
 	case "fs":
-		return cache.NewFSStore(cfg.FSRoot), nil
+		return cache.NewFSStore(cfg.FSRoot, cfg.FSMinFreePercent), nil
 	default:
 		return nil, fmt.Errorf("unknown storage backend: %q", cfg.StorageBackend)
 	}
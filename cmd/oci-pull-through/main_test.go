@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubcommand(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want func([]string) int
+	}{
+		{[]string{"bench", "-target", "http://cache:8080", "-image", "org/app:v1"}, runBench},
+		{[]string{"-bench", "-target", "http://cache:8080"}, runBench},
+		{[]string{"verify", "-image", "library/alpine:3.20"}, runVerify},
+		{[]string{"validate-config"}, runValidateConfig},
+		{[]string{"sync", "-to", "s3://bucket/prefix"}, runSync},
+		{[]string{"-sync", "-to", "s3://bucket/prefix"}, runSync},
+		{[]string{"export", "-dir", "/out"}, runExport},
+		{[]string{"-export", "-dir", "/out"}, runExport},
+		{[]string{"migrate-keys", "-to", "registry"}, runMigrateKeys},
+		{[]string{"-migrate-keys", "-to", "registry"}, runMigrateKeys},
+		{[]string{"controller", "-listen", ":9400"}, runController},
+		{[]string{"-controller"}, runController},
+		{[]string{"-healthcheck", "-ready"}, runHealthcheck},
+	} {
+		run, ok := subcommand(tt.args)
+		if !ok || reflect.ValueOf(run).Pointer() != reflect.ValueOf(tt.want).Pointer() {
+			t.Errorf("%q: not dispatched to its subcommand", tt.args)
+		}
+	}
+
+	// Anything else starts the proxy.
+	for _, args := range [][]string{nil, {"-config", "config.yaml"}, {"serve"}} {
+		if _, ok := subcommand(args); ok {
+			t.Errorf("%q: dispatched to a subcommand", args)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// runMigrateKeys moves cached blobs to the keys of another key schema and
+// returns the process exit code. It reads the storage backend from the
+// same environment as the server.
+//
+// Usage: oci-pull-through migrate-keys -to registry|global [-delete] [-dry-run]
+func runMigrateKeys(args []string) int {
+	fs := flag.NewFlagSet("migrate-keys", flag.ContinueOnError)
+	to := fs.String("to", "", "key schema to move blobs to: registry or global (required)")
+	deleteOld := fs.Bool("delete", false, "remove each blob from its old key once copied")
+	dryRun := fs.Bool("dry-run", false, "report what would be copied without writing")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *to == "" {
+		fmt.Fprintln(os.Stderr, "migrate-keys: -to is required")
+		return 1
+	}
+	schema, err := cache.ParseKeySchema(*to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate-keys: %v\n", err)
+		return 1
+	}
+
+	cfg, err := loadConfig("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate-keys: %v\n", err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	store, err := newStore(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate-keys: %v\n", err)
+		return 1
+	}
+
+	res, err := cache.MigrateKeys(ctx, store, schema, *deleteOld, *dryRun)
+	fmt.Printf("copied %d objects (%d bytes), %d already present, deleted %d, %d unreferenced blobs left in place\n",
+		res.Copied, res.Bytes, res.Present, res.Deleted, res.Unreferenced)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate-keys failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
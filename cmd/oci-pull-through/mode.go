@@ -0,0 +1,28 @@
+package main
+
+import "net/http"
+
+// Process modes, set by MODE. A data-plane process serves pulls and
+// nothing else; a control-plane process runs the background subsystems
+// (retention, size limit, janitor, usage scans, prewarming, maintenance
+// windows) against the same store, so their listing and warming never
+// share CPU or network with client traffic.
+const (
+	modeAll     = "all"
+	modeData    = "data"
+	modeControl = "control"
+)
+
+// healthOnly serves just the health endpoints of h, for a control-plane
+// process: container health checks keep working, but it takes no pulls.
+func healthOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[{"code":"UNSUPPORTED","message":"control-plane process: pulls are served by the data plane"}]}`))
+	})
+}
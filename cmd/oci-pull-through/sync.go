@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/config"
+)
+
+// runSync copies cached content from one store to another and returns the
+// process exit code. The source is the storage backend configured in the
+// environment, as for the server, unless -from names another.
+//
+// Usage: oci-pull-through sync -to s3://bucket/prefix [-from /var/cache/oci] [-repo 'ghcr.io/org/*'] [-since 720h] [-dry-run]
+func runSync(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	to := fs.String("to", "", "destination store: s3://bucket[/prefix] or a filesystem path (required)")
+	from := fs.String("from", "", "source store, as for -to (default the configured backend)")
+	repos := fs.String("repo", "", "comma-separated registry/name patterns to copy, with the blobs they reference (default everything)")
+	since := fs.Duration("since", 0, "only copy manifests written within this long (and without -repo, blobs too)")
+	dryRun := fs.Bool("dry-run", false, "report what would be copied without writing")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *to == "" {
+		fmt.Fprintln(os.Stderr, "sync: -to is required")
+		return 1
+	}
+
+	cfg, err := loadConfig("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sync: %v\n", err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	src, err := newStore(ctx, cfg)
+	if *from != "" {
+		src, err = storeAt(ctx, cfg, *from)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sync: source: %v\n", err)
+		return 1
+	}
+	dst, err := storeAt(ctx, cfg, *to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sync: destination: %v\n", err)
+		return 1
+	}
+
+	opts := cache.SyncOptions{DryRun: *dryRun}
+	for p := range strings.SplitSeq(*repos, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			opts.Repositories = append(opts.Repositories, p)
+		}
+	}
+	if *since > 0 {
+		opts.Since = time.Now().Add(-*since)
+	}
+
+	res, err := cache.Sync(ctx, src, dst, opts)
+	fmt.Printf("copied %d objects (%d bytes), %d already present\n", res.Copied, res.Bytes, res.Present)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sync failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// storeAt opens the store named by spec: s3://bucket[/prefix], with the
+// S3 settings of cfg, or a filesystem path.
+func storeAt(ctx context.Context, cfg config.Config, spec string) (cache.Store, error) {
+	if rest, ok := strings.CutPrefix(spec, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("%q has no bucket", spec)
+		}
+		return cache.NewS3Store(ctx, bucket, prefix, cfg.S3ForcePathStyle, cfg.S3LifecycleDays)
+	}
+	return cache.NewFSStore(strings.TrimPrefix(spec, "file://"), cfg.FSMinFreePercent), nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"github.com/danielloader/oci-pull-through/internal/config"
+	"github.com/danielloader/oci-pull-through/internal/tlsgen"
+)
+
+// tlsOptions are the operator's TLS_* settings for the HTTPS listeners.
+func tlsOptions(cfg config.Config) tlsgen.ServerOptions {
+	return tlsgen.ServerOptions{
+		MinVersion:   cfg.TLSMinVersion,
+		CipherSuites: cfg.TLSCipherSuites,
+		Curves:       cfg.TLSCurves,
+		ALPN:         cfg.TLSALPN,
+	}
+}
+
+// hardenServerTLS applies the TLS_* settings to a listener's config, then
+// in FIPS mode narrows them to approved choices, so FIPS always wins.
+func hardenServerTLS(cfg config.Config, tc *tls.Config) error {
+	if err := tlsOptions(cfg).Apply(tc); err != nil {
+		return err
+	}
+	if cfg.FIPSMode {
+		return tlsgen.RestrictFIPS(tc)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/config"
+	"github.com/danielloader/oci-pull-through/internal/faults"
+	"github.com/danielloader/oci-pull-through/internal/gc"
+	"github.com/danielloader/oci-pull-through/internal/maintenance"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+	"github.com/danielloader/oci-pull-through/internal/tlsgen"
+	"github.com/danielloader/oci-pull-through/internal/tracing"
+)
+
+// loadConfig reads the configuration from the file at path, or CONFIG_FILE
+// if path is empty, with environment variables overriding it. Without
+// either it reads the environment alone.
+func loadConfig(path string) (config.Config, error) {
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path == "" {
+		return config.Load(), nil
+	}
+	return config.LoadFile(path)
+}
+
+// runValidateConfig checks the configuration the server would start with,
+// without starting it, and prints every problem found, returning the
+// process exit code (1 if there are any). It doesn't reach the store or
+// upstream registries.
+//
+// Usage: oci-pull-through validate-config [-config config.yaml]
+func runValidateConfig(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	path := fs.String("config", "", "config file (default CONFIG_FILE, or environment variables only)")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "validate-config: %v\n", err)
+		return 1
+	}
+	errs := checkConfig(cfg)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("configuration is valid")
+	return 0
+}
+
+// checkConfig makes the checks main makes at startup that need nothing but
+// the configuration and the files it names.
+func checkConfig(cfg config.Config) []error {
+	var errs []error
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	if cfg.FIPSMode {
+		check("FIPS_MODE", tlsgen.CheckFIPS())
+	}
+
+	if cfg.UpstreamRegistry == "" && len(cfg.UpstreamHosts) == 0 && len(cfg.UpstreamPaths) == 0 && len(cfg.ContainerdMirrors) == 0 && len(cfg.HarborProjects) == 0 {
+		check("UPSTREAM_REGISTRY", errors.New("no upstream configured: set it (e.g. https://ghcr.io, https://registry-1.docker.io), UPSTREAM_HOSTS, UPSTREAM_PATHS, CONTAINERD_MIRRORS or HARBOR_PROJECTS"))
+	}
+	if cfg.UpstreamRegistry != "" {
+		_, err := parseUpstreamURL(cfg.UpstreamRegistry)
+		check("UPSTREAM_REGISTRY", err)
+	}
+	if len(cfg.UpstreamNamespaces[""]) > 0 && cfg.UpstreamRegistry == "" {
+		check("UPSTREAM_NAMESPACES", errors.New("patterns not keyed by registry apply to UPSTREAM_REGISTRY, which is unset"))
+	}
+	for env, routes := range map[string]map[string]string{
+		"UPSTREAM_HOSTS":     cfg.UpstreamHosts,
+		"UPSTREAM_PATHS":     cfg.UpstreamPaths,
+		"CONTAINERD_MIRRORS": cfg.ContainerdMirrors,
+		"HARBOR_PROJECTS":    cfg.HarborProjects,
+	} {
+		for key, raw := range routes {
+			_, err := parseUpstreamURL(raw)
+			check(env+" entry for "+key, err)
+		}
+	}
+
+	if p := proxy.Schema1Policy(cfg.Schema1Policy); p != proxy.Schema1Passthrough && p != proxy.Schema1Reject {
+		check("SCHEMA1_POLICY", fmt.Errorf("must be passthrough or reject, got %q", cfg.Schema1Policy))
+	}
+	if cfg.Mode != modeAll && cfg.Mode != modeData && cfg.Mode != modeControl {
+		check("MODE", fmt.Errorf("must be all, data or control, got %q", cfg.Mode))
+	}
+
+	_, err := proxy.NewChain(cfg.Middleware)
+	check("MIDDLEWARE", err)
+	_, _, err = tracing.ConfigFromEnv()
+	check("tracing", err)
+	_, err = proxy.ParsePlatforms(cfg.FlattenPlatforms)
+	check("FLATTEN_INDEX_PLATFORMS", err)
+	_, err = proxy.ParseCIDRs(cfg.CacheBypassCIDRs)
+	check("CACHE_BYPASS_TRUSTED_CIDRS", err)
+	_, err = proxy.ParseForwardHeaders(cfg.UpstreamFwdHeaders)
+	check("UPSTREAM_FORWARD_HEADERS", err)
+	_, err = proxy.ParseArtifactSources(cfg.ArtifactSources, cfg.ArtifactGitHubToken)
+	check("ARTIFACT_SOURCES", err)
+	_, err = cache.ParseKeySchema(cfg.StorageKeySchema)
+	check("STORAGE_KEY_SCHEMA", err)
+	for host, spec := range cfg.UpstreamQuirks {
+		_, err := proxy.ParseQuirks(spec)
+		check("UPSTREAM_QUIRKS for "+host, err)
+	}
+	for host, spec := range cfg.UpstreamRegions {
+		_, err := proxy.ParseRegions(spec)
+		check("UPSTREAM_PREFERRED_REGIONS for "+host, err)
+	}
+
+	if cfg.CacheIsolatePrivate && cfg.CacheIsolationKey == "" {
+		check("CACHE_ISOLATE_PRIVATE", errors.New("requires CACHE_ISOLATION_KEY"))
+	}
+	if cfg.StorageBackend != "s3" && cfg.StorageBackend != "fs" {
+		check("STORAGE_BACKEND", fmt.Errorf("must be s3 or fs, got %q", cfg.StorageBackend))
+	}
+	if cfg.StorageFaults != "" {
+		_, err := faults.Parse(cfg.StorageFaults)
+		check("STORAGE_FAULTS", err)
+	}
+	if strings.Contains(cfg.CacheIndexSnapshotKey, "/") {
+		check("CACHE_INDEX_SNAPSHOT_KEY", fmt.Errorf("%q is a name, not a path", cfg.CacheIndexSnapshotKey))
+	}
+	if cfg.S3MaxBytes > 0 {
+		if cfg.StorageBackend != "s3" {
+			check("S3_MAX_BYTES", errors.New("requires STORAGE_BACKEND=s3"))
+		}
+		if !cfg.CacheIndex {
+			check("S3_MAX_BYTES", errors.New("requires CACHE_INDEX=true"))
+		}
+	}
+	if (cfg.FSMaxBytes > 0 || cfg.FSMaxAge > 0) && cfg.StorageBackend != "fs" {
+		check("FS_MAX_BYTES and FS_MAX_AGE", errors.New("require STORAGE_BACKEND=fs"))
+	}
+
+	if cfg.AdaptiveConcurrency {
+		if cfg.AdaptiveMin < 1 || cfg.AdaptiveMax < cfg.AdaptiveMin {
+			check("ADAPTIVE_CONCURRENCY_MIN and ADAPTIVE_CONCURRENCY_MAX", fmt.Errorf("need 1 <= min <= max, got %d and %d", cfg.AdaptiveMin, cfg.AdaptiveMax))
+		}
+		if cfg.AdaptiveTolerance < 1 {
+			check("ADAPTIVE_CONCURRENCY_TOLERANCE", fmt.Errorf("must be at least 1, got %g", cfg.AdaptiveTolerance))
+		}
+	}
+
+	if cfg.SpoolFillBytes > 0 && cfg.SpoolDir != "" {
+		if fi, err := os.Stat(cfg.SpoolDir); err != nil {
+			check("FILL_SPOOL_DIR", err)
+		} else if !fi.IsDir() {
+			check("FILL_SPOOL_DIR", fmt.Errorf("%s is not a directory", cfg.SpoolDir))
+		}
+	}
+
+	if cfg.StandbyElection {
+		if cfg.StandbyLeaseTTL < time.Second {
+			check("STANDBY_LEASE_TTL", fmt.Errorf("must be at least 1s, got %s", cfg.StandbyLeaseTTL))
+		}
+		if cfg.StandbyID == "" {
+			check("STANDBY_ID", errors.New("required with STANDBY_LEADER_ELECTION when the hostname is unknown"))
+		}
+	}
+
+	if cfg.MaintenanceWindows != "" {
+		_, err := maintenance.Load(cfg.MaintenanceWindows)
+		check("MAINTENANCE_WINDOWS_FILE", err)
+	}
+	if cfg.RetentionRulesFile != "" {
+		_, err := gc.LoadRules(cfg.RetentionRulesFile)
+		check("RETENTION_RULES_FILE", err)
+	}
+	if cfg.PolicyCanaryFile != "" {
+		_, err := proxy.LoadCanaries(cfg.PolicyCanaryFile)
+		check("POLICY_CANARY_FILE", err)
+	}
+
+	for env, caps := range map[string]map[string]string{
+		"UPSTREAM_TRANSFER_SOFT_CAPS": cfg.TransferSoftCaps,
+		"UPSTREAM_TRANSFER_HARD_CAPS": cfg.TransferHardCaps,
+	} {
+		for host, v := range caps {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err == nil && n < 0 {
+				err = errors.New("negative transfer cap")
+			}
+			check(env+" for "+host, err)
+		}
+	}
+	_, err = proxy.NewTransfer(cfg.TransferPeriod, nil)
+	check("UPSTREAM_TRANSFER_PERIOD", err)
+
+	check("TLS settings", hardenServerTLS(cfg, &tls.Config{}))
+	return errs
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/danielloader/oci-pull-through/internal/config"
+	"github.com/danielloader/oci-pull-through/internal/verify"
+)
+
+// runVerify pulls an image from its registry and through a running proxy,
+// compares the two byte for byte and prints what differs, returning the
+// process exit code (1 on any difference).
+//
+// Usage: oci-pull-through verify -image library/alpine:3.20 -proxy http://cache:8080 [-upstream https://registry-1.docker.io] [-platform linux/amd64] [-json]
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	image := fs.String("image", "", "image to verify, as a repository reference upstream (required)")
+	proxyImage := fs.String("proxy-image", "", "the image's repository reference on the proxy, if different")
+	target := fs.String("proxy", "", "proxy base URL (required)")
+	upstream := fs.String("upstream", "", "upstream registry base URL (default: https:// and UPSTREAM_REGISTRY)")
+	platform := fs.String("platform", "", "verify only this platform of multi-arch images (default: all)")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *upstream == "" {
+		if registry := config.Load().UpstreamRegistry; registry != "" {
+			*upstream = "https://" + strings.TrimPrefix(registry, "https://")
+		}
+	}
+	if *image == "" || *target == "" || *upstream == "" {
+		fmt.Fprintln(os.Stderr, "verify: -image, -proxy and -upstream (or UPSTREAM_REGISTRY) are required")
+		return 1
+	}
+	// Docker Hub serves its API from a different host, as the proxy knows.
+	if *upstream == "https://docker.io" {
+		*upstream = "https://registry-1.docker.io"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	report, err := verify.Run(ctx, verify.Options{
+		Upstream:   *upstream,
+		Proxy:      *target,
+		Image:      *image,
+		ProxyImage: *proxyImage,
+		Platform:   *platform,
+		Username:   os.Getenv("VERIFY_USERNAME"),
+		Password:   os.Getenv("VERIFY_PASSWORD"),
+		Client:     &http.Client{Transport: transport},
+	})
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify: %v\n", err)
+		return 1
+	}
+	if report.Mismatches > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,18 @@
+package main
+
+import "runtime/debug"
+
+// version is set at release time with -ldflags "-X main.version=...".
+var version string
+
+// buildVersion returns version, or the module version recorded by
+// go install when it wasn't set.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return ""
+}
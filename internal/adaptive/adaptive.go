@@ -0,0 +1,266 @@
+// Package adaptive limits concurrency to what the system behind it can
+// take, found from the latency and errors it shows, rather than to a fixed
+// number tuned for one deployment size.
+//
+// A Limiter shrinks its limit when recent latency rises above its long-term
+// average (a latency gradient) and multiplicatively on errors, and grows it
+// while latency holds and the limit is in use.
+package adaptive
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var (
+	limitGauge = metrics.NewGaugeVec("oci_concurrency_limit",
+		"Current adaptive concurrency limit, by limiter.", "limiter")
+	inflightGauge = metrics.NewGaugeVec("oci_concurrency_inflight",
+		"Requests holding an adaptive concurrency slot, by limiter.", "limiter")
+	limited = metrics.NewCounterVec("oci_concurrency_limited_total",
+		"Requests held back by an adaptive concurrency limit, by limiter and outcome (queued, rejected).", "limiter", "outcome")
+)
+
+const (
+	// shortAlpha and longAlpha weight new samples in the short-term
+	// (about the last 10) and long-term (about the last 600) latency
+	// averages.
+	shortAlpha = 2.0 / 11
+	longAlpha  = 2.0 / 601
+	// smoothing is how far the limit moves towards each new estimate.
+	smoothing = 0.2
+	// backoff multiplies the limit on an error.
+	backoff = 0.9
+)
+
+// Config bounds a Limiter. Zero values use the defaults.
+type Config struct {
+	// Initial is the limit before any samples; default 20.
+	Initial int
+	// Min and Max bound the limit; default 1 and 1000.
+	Min, Max int
+	// Tolerance is how far recent latency may rise above the long-term
+	// average, as a ratio, before the limit shrinks; default 1.5.
+	Tolerance float64
+}
+
+// Limiter bounds the requests in flight to one backend. A nil Limiter
+// doesn't limit.
+type Limiter struct {
+	name string
+	cfg  Config
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	short    float64 // seconds
+	long     float64 // seconds
+	lastDrop time.Time
+	waiters  []chan struct{}
+}
+
+// New returns a Limiter reporting its metrics under name.
+func New(name string, cfg Config) *Limiter {
+	cfg.Min = max(cfg.Min, 1)
+	cfg.Max = max(cmp.Or(cfg.Max, 1000), cfg.Min)
+	cfg.Tolerance = max(cmp.Or(cfg.Tolerance, 1.5), 1)
+	l := &Limiter{name: name, cfg: cfg}
+	l.setLimit(float64(cmp.Or(cfg.Initial, 20)))
+	return l
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.slots()
+}
+
+// Acquire waits for a slot, in turn with other waiters, until ctx is
+// done. The returned Token must be released with one of its methods. A nil
+// Limiter returns a nil Token, whose methods do nothing.
+func (l *Limiter) Acquire(ctx context.Context) (*Token, error) {
+	if l == nil {
+		return nil, nil
+	}
+	l.mu.Lock()
+	if len(l.waiters) == 0 && l.inflight < l.slots() {
+		t := l.take()
+		l.mu.Unlock()
+		return t, nil
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	l.mu.Unlock()
+	limited.Inc(l.name, "queued")
+
+	select {
+	case <-ch:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return &Token{l: l, start: time.Now(), inflight: l.inflight}, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if i := slices.Index(l.waiters, ch); i >= 0 {
+			l.waiters = slices.Delete(l.waiters, i, i+1)
+		} else {
+			// Granted as ctx ended: pass the slot on.
+			l.inflight--
+			l.grant()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// TryAcquire takes a slot if one is free, without waiting.
+func (l *Limiter) TryAcquire() (*Token, bool) {
+	if l == nil {
+		return nil, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) > 0 || l.inflight >= l.slots() {
+		limited.Inc(l.name, "rejected")
+		return nil, false
+	}
+	return l.take(), true
+}
+
+// take claims a slot. l.mu must be held.
+func (l *Limiter) take() *Token {
+	l.inflight++
+	inflightGauge.Set(float64(l.inflight), l.name)
+	return &Token{l: l, start: time.Now(), inflight: l.inflight}
+}
+
+// slots is the limit as a whole number of requests. l.mu must be held.
+func (l *Limiter) slots() int { return max(int(l.limit), 1) }
+
+// grant hands freed slots to waiters, first come first served. l.mu must
+// be held.
+func (l *Limiter) grant() {
+	for len(l.waiters) > 0 && l.inflight < l.slots() {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		l.inflight++
+	}
+	inflightGauge.Set(float64(l.inflight), l.name)
+}
+
+func (l *Limiter) setLimit(v float64) {
+	l.limit = min(max(v, float64(l.cfg.Min)), float64(l.cfg.Max))
+	limitGauge.Set(l.limit, l.name)
+}
+
+// sample adjusts the limit for a request that succeeded in rtt seconds
+// with inflight requests running.
+func (l *Limiter) sample(rtt float64, inflight int) {
+	rtt = max(rtt, 1e-6)
+	if l.long == 0 {
+		l.short, l.long = rtt, rtt
+	} else {
+		l.short += (rtt - l.short) * shortAlpha
+		l.long += (rtt - l.long) * longAlpha
+		// After a congested spell the long-term average lags behind;
+		// let it catch up rather than hold the limit high.
+		if l.long > 2*l.short {
+			l.long *= 0.95
+		}
+	}
+	gradient := max(0.5, min(1, l.cfg.Tolerance*l.long/l.short))
+	// A limit the traffic isn't reaching says nothing about capacity.
+	if gradient == 1 && inflight*2 < l.slots() {
+		return
+	}
+	next := l.limit*gradient + math.Sqrt(l.limit)
+	l.setLimit(l.limit*(1-smoothing) + next*smoothing)
+}
+
+// Token is a slot taken from a Limiter.
+type Token struct {
+	l        *Limiter
+	start    time.Time
+	inflight int
+	done     bool
+}
+
+// Success releases the slot, recording that the request succeeded with
+// the given latency.
+func (t *Token) Success(latency time.Duration) {
+	t.release(func(l *Limiter) { l.sample(latency.Seconds(), t.inflight) })
+}
+
+// Dropped releases the slot, recording that the request failed in a way
+// that suggests overload: an error, a timeout, a 5xx or a 429.
+func (t *Token) Dropped() {
+	t.release(func(l *Limiter) {
+		// Requests started before the last decrease ran under the old
+		// limit, so they don't decrease it again.
+		if t.start.After(l.lastDrop) {
+			l.setLimit(l.limit * backoff)
+			l.lastDrop = time.Now()
+		}
+	})
+}
+
+// Ignore releases the slot without recording anything, for requests whose
+// outcome says nothing about the backend, such as ones the client
+// cancelled.
+func (t *Token) Ignore() {
+	t.release(func(*Limiter) {})
+}
+
+func (t *Token) release(record func(*Limiter)) {
+	if t == nil || t.done {
+		return
+	}
+	t.done = true
+	l := t.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	record(l)
+	l.grant()
+}
+
+// Set holds a Limiter per key, such as per upstream registry, so that one
+// slow backend doesn't hold back the others. A nil Set returns nil
+// Limiters.
+type Set struct {
+	name string
+	cfg  Config
+
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+}
+
+// NewSet returns a Set whose Limiters use cfg and report their metrics
+// under name/key.
+func NewSet(name string, cfg Config) *Set {
+	return &Set{name: name, cfg: cfg, limiters: make(map[string]*Limiter)}
+}
+
+// Get returns key's Limiter, creating it on first use.
+func (s *Set) Get(key string) *Limiter {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.limiters[key]
+	if !ok {
+		l = New(s.name+"/"+key, s.cfg)
+		s.limiters[key] = l
+	}
+	return l
+}
@@ -0,0 +1,195 @@
+package adaptive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestLimiterGrowsUnderLoad(t *testing.T) {
+	l := New("test", Config{Initial: 10, Max: 50})
+	for range 200 {
+		var slots []*Token
+		for range l.Limit() {
+			s, ok := l.TryAcquire()
+			if !ok {
+				t.Fatal("slot refused below the limit")
+			}
+			slots = append(slots, s)
+		}
+		for _, s := range slots {
+			s.Success(10 * time.Millisecond)
+		}
+	}
+	if got := l.Limit(); got != 50 {
+		t.Errorf("limit = %d after steady latency at full use, want the max 50", got)
+	}
+}
+
+func TestLimiterIdleDoesNotGrow(t *testing.T) {
+	l := New("test", Config{Initial: 10})
+	for range 200 {
+		s, _ := l.TryAcquire()
+		s.Success(10 * time.Millisecond)
+	}
+	if got := l.Limit(); got != 10 {
+		t.Errorf("limit = %d with one request at a time, want 10 unchanged", got)
+	}
+}
+
+func TestLimiterShrinksOnLatency(t *testing.T) {
+	l := New("test", Config{Initial: 40, Min: 2})
+	for range 100 {
+		s, _ := l.TryAcquire()
+		s.Success(10 * time.Millisecond)
+	}
+	for range 50 {
+		s, _ := l.TryAcquire()
+		s.Success(200 * time.Millisecond)
+	}
+	if got := l.Limit(); got >= 40 {
+		t.Errorf("limit = %d after latency rose twentyfold, want below 40", got)
+	}
+}
+
+func TestLimiterDropped(t *testing.T) {
+	l := New("test", Config{Initial: 100, Min: 5})
+	a, _ := l.TryAcquire()
+	b, _ := l.TryAcquire()
+	a.Dropped()
+	if got := l.Limit(); got != 90 {
+		t.Fatalf("limit = %d after an error, want 90", got)
+	}
+	// b started before the decrease, so its failure doesn't count again.
+	b.Dropped()
+	if got := l.Limit(); got != 90 {
+		t.Fatalf("limit = %d after a second error from the same round, want 90", got)
+	}
+	for range 100 {
+		time.Sleep(time.Microsecond)
+		s, _ := l.TryAcquire()
+		s.Dropped()
+	}
+	if got := l.Limit(); got != 5 {
+		t.Errorf("limit = %d after repeated errors, want the min 5", got)
+	}
+}
+
+func TestLimiterQueues(t *testing.T) {
+	l := New("test", Config{Initial: 1})
+	held, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.TryAcquire(); ok {
+		t.Fatal("TryAcquire succeeded over the limit")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := l.Acquire(ctx)
+		cancelled <- err
+	}()
+	granted := make(chan *Token)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s, _ := l.Acquire(context.Background())
+		granted <- s
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled wait returned %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-granted:
+		t.Fatal("granted while the slot was held")
+	default:
+	}
+	held.Ignore()
+	held.Ignore() // releasing twice is harmless
+	select {
+	case s := <-granted:
+		s.Ignore()
+	case <-time.After(time.Second):
+		t.Fatal("waiter not granted the released slot")
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var s *Set
+	l := s.Get("ghcr.io")
+	tok, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok.Success(time.Second)
+	tok.Dropped()
+}
+
+// slowStore takes delay to commit each Put after reading its body.
+type slowStore struct {
+	cache.Store
+	delay time.Duration
+	err   error
+}
+
+func (s *slowStore) Put(_ context.Context, _ string, body io.Reader, _ cache.ObjectMeta) error {
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	time.Sleep(s.delay)
+	return s.err
+}
+
+func TestLimitStore(t *testing.T) {
+	l := New("store", Config{Initial: 1})
+	store := LimitStore(&slowStore{delay: 50 * time.Millisecond}, l)
+
+	done := make(chan error)
+	go func() {
+		done <- store.Put(context.Background(), "a", strings.NewReader("a"), cache.ObjectMeta{})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	err := store.Put(cache.WithShedding(context.Background()), "b", strings.NewReader("b"), cache.ObjectMeta{})
+	if !errors.Is(err, cache.ErrSaturated) {
+		t.Fatalf("shedding Put while full: got %v, want ErrSaturated", err)
+	}
+	// Without shedding it waits its turn.
+	if err := store.Put(context.Background(), "c", strings.NewReader("c"), cache.ObjectMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitStoreErrors(t *testing.T) {
+	l := New("store", Config{Initial: 10})
+	boom := errors.New("boom")
+	store := LimitStore(&slowStore{err: boom}, l)
+	if err := store.Put(context.Background(), "a", strings.NewReader("a"), cache.ObjectMeta{}); !errors.Is(err, boom) {
+		t.Fatalf("Put = %v", err)
+	}
+	if got := l.Limit(); got != 9 {
+		t.Errorf("limit = %d after a store error, want 9", got)
+	}
+
+	// A body that fails to arrive isn't the store's doing.
+	store = LimitStore(&slowStore{}, l)
+	body := io.MultiReader(strings.NewReader("a"), iotest.ErrReader(errors.New("client went away")))
+	store.Put(context.Background(), "b", body, cache.ObjectMeta{})
+	if got := l.Limit(); got != 9 {
+		t.Errorf("limit = %d after a body error, want 9 unchanged", got)
+	}
+}
@@ -0,0 +1,85 @@
+package adaptive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// LimitStore wraps store so that no more writes run at once than l allows.
+// Writes marked cache.WithShedding, such as cache fills streaming to a
+// client, fail with cache.ErrSaturated when l is full rather than stall
+// the client behind them; others wait their turn. The returned store
+// still implements cache.Redirector when store does.
+func LimitStore(store cache.Store, l *Limiter) cache.Store {
+	s := &limitedStore{Store: store, l: l}
+	if r, ok := store.(cache.Redirector); ok {
+		return &limitedRedirector{limitedStore: s, Redirector: r}
+	}
+	return s
+}
+
+type limitedStore struct {
+	cache.Store
+	l *Limiter
+}
+
+func (s *limitedStore) Put(ctx context.Context, key string, body io.Reader, meta cache.ObjectMeta) error {
+	var t *Token
+	if cache.Shedding(ctx) {
+		var ok bool
+		if t, ok = s.l.TryAcquire(); !ok {
+			return fmt.Errorf("%w: %d concurrent writes", cache.ErrSaturated, s.l.Limit())
+		}
+	} else {
+		var err error
+		if t, err = s.l.Acquire(ctx); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	br := &bodyReader{r: body}
+	err := s.Store.Put(ctx, key, br, meta)
+	switch {
+	case br.err != nil || ctx.Err() != nil:
+		// A body that failed to arrive is no fault of the store.
+		t.Ignore()
+	case err != nil:
+		t.Dropped()
+	default:
+		// The body arrives at the pace of its source, often a client, so
+		// latency counts from its end: the time the store took to commit.
+		if !br.end.IsZero() {
+			start = br.end
+		}
+		t.Success(time.Since(start))
+	}
+	return err
+}
+
+type limitedRedirector struct {
+	*limitedStore
+	cache.Redirector
+}
+
+// bodyReader remembers when its reader ended, and the error, other than
+// EOF, it returned.
+type bodyReader struct {
+	r   io.Reader
+	end time.Time
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	switch {
+	case err == io.EOF:
+		b.end = time.Now()
+	case err != nil:
+		b.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,245 @@
+// Package admin implements the operator-facing HTTP API for inspecting and
+// managing the cache. It is separate from the registry data plane and is
+// only mounted when explicitly enabled.
+package admin
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/index"
+	"github.com/danielloader/oci-pull-through/internal/lifecycle"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+	"github.com/danielloader/oci-pull-through/internal/standby"
+	"github.com/danielloader/oci-pull-through/internal/stream"
+)
+
+// SimulateAuthHeader carries the upstream credentials a simulated pull
+// should present, since Authorization holds the admin token.
+const SimulateAuthHeader = "X-Upstream-Authorization"
+
+// ConnRecycler drops pooled upstream connections.
+type ConnRecycler interface {
+	RecycleConnections() int
+}
+
+// Handler serves the admin API under /admin/.
+type Handler struct {
+	Inflight *stream.Inflight
+	Upstream ConnRecycler
+
+	// Subsystems, when set, reports background subsystem health.
+	Subsystems func() []lifecycle.Status
+
+	// Simulate, when set, dry-runs image pulls; see proxy.Handler.Simulate.
+	Simulate func(ctx context.Context, image, platform, authorization string) (*proxy.Simulation, error)
+
+	// References, when set, finds the cached tags resolving to a manifest
+	// digest; see index.Index.References.
+	References func(digest string) []index.Reference
+
+	// Freeze, when set, lets operators cut off upstream access; see
+	// proxy.Freeze.
+	Freeze *proxy.Freeze
+
+	// Transfer, when set, reports bytes fetched from upstream against
+	// their caps; see proxy.Transfer.
+	Transfer *proxy.Transfer
+
+	// Store, when set, lets operators inspect and purge the cache. It
+	// should be the index-tracking store, so purged keys leave the index.
+	Store cache.Store
+
+	// CacheKey and CacheRepository map image references and repositories
+	// to what they are cached under; see proxy.Handler.CacheKey.
+	CacheKey        func(image string) (string, error)
+	CacheRepository func(repository string) (string, error)
+
+	// LastAccess, when set, reports when a key was last pulled, for the
+	// content report; see index.Index.LastAccess.
+	LastAccess func(key string) (time.Time, bool)
+
+	// Standby, when set, reports and promotes a warm standby; see
+	// standby.Gate.
+	Standby *standby.Gate
+
+	mux *http.ServeMux
+}
+
+// NewHandler builds the admin API routes.
+func NewHandler(inflight *stream.Inflight, upstream ConnRecycler) *Handler {
+	h := &Handler{Inflight: inflight, Upstream: upstream, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /admin/inflight", h.listInflight)
+	h.mux.HandleFunc("DELETE /admin/inflight/{id}", h.cancelInflight)
+	h.mux.HandleFunc("POST /admin/upstream/recycle", h.recycleUpstream)
+	h.mux.HandleFunc("GET /admin/subsystems", h.listSubsystems)
+	h.mux.HandleFunc("GET /admin/simulate", h.simulate)
+	h.mux.HandleFunc("GET /admin/inventory/references", h.listReferences)
+	h.mux.HandleFunc("GET /admin/freeze", h.listFreezes)
+	h.mux.HandleFunc("POST /admin/freeze", h.freeze)
+	h.mux.HandleFunc("DELETE /admin/freeze", h.unfreeze)
+	h.mux.HandleFunc("GET /admin/transfer", h.transfer)
+	h.mux.HandleFunc("GET /admin/cache/entries", h.listEntries)
+	h.mux.HandleFunc("GET /admin/cache/usage", h.cacheUsage)
+	h.mux.HandleFunc("DELETE /admin/cache", h.purge)
+	h.mux.HandleFunc("GET /admin/report", h.report)
+	h.mux.HandleFunc("GET /admin/standby", h.standbyStatus)
+	h.mux.HandleFunc("POST /admin/standby/promote", h.promote)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// listInflight returns cache fills currently streaming from upstream.
+func (h *Handler) listInflight(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"fills": h.Inflight.List()})
+}
+
+// cancelInflight aborts a fill by ID. The client receiving it sees a
+// truncated response and nothing is committed to the cache.
+func (h *Handler) cancelInflight(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !h.Inflight.Cancel(id) {
+		writeJSONError(w, http.StatusNotFound, "no in-flight fill with id "+id)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recycleUpstream closes idle upstream keep-alive connections so the next
+// requests dial fresh ones, e.g. after an upstream load balancer change.
+func (h *Handler) recycleUpstream(w http.ResponseWriter, _ *http.Request) {
+	closed := h.Upstream.RecycleConnections()
+	writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+}
+
+// listSubsystems reports each background subsystem's state. The status is
+// 503 if any has failed, so it can back an external health check.
+func (h *Handler) listSubsystems(w http.ResponseWriter, _ *http.Request) {
+	var subs []lifecycle.Status
+	if h.Subsystems != nil {
+		subs = h.Subsystems()
+	}
+	status := http.StatusOK
+	for _, s := range subs {
+		if s.State == lifecycle.StateFailed {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, map[string]any{"subsystems": subs})
+}
+
+// standbyStatus reports whether the instance is a warm standby or active.
+func (h *Handler) standbyStatus(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, h.Standby.Status())
+}
+
+// promote makes a warm standby active, so it reports ready and serves
+// straight away. Promoting an active instance changes nothing.
+func (h *Handler) promote(w http.ResponseWriter, _ *http.Request) {
+	h.Standby.Promote("admin")
+	writeJSON(w, http.StatusOK, h.Standby.Status())
+}
+
+// simulate reports what pulling ?image= would fetch from the cache and
+// from upstream, without filling the cache.
+func (h *Handler) simulate(w http.ResponseWriter, r *http.Request) {
+	if h.Simulate == nil {
+		writeJSONError(w, http.StatusNotImplemented, "pull simulation is not available")
+		return
+	}
+	q := r.URL.Query()
+	image := q.Get("image")
+	if image == "" {
+		writeJSONError(w, http.StatusBadRequest, "image is required")
+		return
+	}
+	sim, err := h.Simulate(r.Context(), image, q.Get("platform"), r.Header.Get(SimulateAuthHeader))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sim)
+}
+
+// listReferences answers "which tags point at ?digest=", for incident
+// response on a vulnerable image. A platform manifest's digest also finds
+// the tags of indexes listing it.
+func (h *Handler) listReferences(w http.ResponseWriter, r *http.Request) {
+	if h.References == nil {
+		writeJSONError(w, http.StatusNotImplemented, "the digest index requires CACHE_INDEX=true")
+		return
+	}
+	digest := r.URL.Query().Get("digest")
+	if alg, hex, ok := strings.Cut(digest, ":"); !ok || alg == "" || hex == "" {
+		writeJSONError(w, http.StatusBadRequest, "digest must be algorithm:hex")
+		return
+	}
+	refs := h.References(digest)
+	if refs == nil {
+		refs = []index.Reference{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"digest": digest, "references": refs})
+}
+
+// listFreezes reports the upstream freezes in force.
+func (h *Handler) listFreezes(w http.ResponseWriter, _ *http.Request) {
+	frozen := h.Freeze.List()
+	if frozen == nil {
+		frozen = []proxy.Frozen{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"frozen": frozen})
+}
+
+// freeze stops the proxy fetching from the registry in the body, or from
+// every registry if none is named. Cached content is still served.
+func (h *Handler) freeze(w http.ResponseWriter, r *http.Request) {
+	if h.Freeze == nil {
+		writeJSONError(w, http.StatusNotImplemented, "freezing upstream access is not available")
+		return
+	}
+	var req struct {
+		Registry string `json:"registry"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Freeze.Set(req.Registry, req.Reason))
+}
+
+// unfreeze lifts the freeze on ?registry=, or the freeze on every
+// registry if none is named.
+func (h *Handler) unfreeze(w http.ResponseWriter, r *http.Request) {
+	registry := r.URL.Query().Get("registry")
+	if h.Freeze == nil || !h.Freeze.Lift(registry) {
+		writeJSONError(w, http.StatusNotFound, "no freeze in force for "+cmp.Or(registry, proxy.AllRegistries))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// transfer reports bytes fetched from each upstream this UTC day and
+// month, with their caps.
+func (h *Handler) transfer(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, h.Transfer.Report())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,148 @@
+package admin
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// Entry is a cached manifest listed by the cache inspection endpoints.
+type Entry struct {
+	Key      string    `json:"key"`
+	Kind     string    `json:"kind"` // "tag" or "manifest"
+	Tag      string    `json:"tag,omitempty"`
+	Digest   string    `json:"digest,omitempty"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// RepositoryUsage is what one repository's manifests take up.
+type RepositoryUsage struct {
+	Repository string `json:"repository"`
+	Objects    int64  `json:"objects"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// listEntries lists the manifests cached for ?repository=, tags and
+// digests alike. Blobs are shared between repositories, so they aren't
+// listed against any one of them.
+func (h *Handler) listEntries(w http.ResponseWriter, r *http.Request) {
+	if h.Store == nil || h.CacheRepository == nil {
+		writeJSONError(w, http.StatusNotImplemented, "cache inspection is not available")
+		return
+	}
+	repo, err := h.CacheRepository(r.URL.Query().Get("repository"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entries := []Entry{}
+	for obj, err := range h.Store.List(r.Context(), "manifests/"+repo+"/", "") {
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, "listing cache: "+err.Error())
+			return
+		}
+		k, ok := cache.ParseKey(obj.Key)
+		if !ok || k.Repository != repo {
+			continue // a repository nested below this one
+		}
+		entries = append(entries, Entry{Key: obj.Key, Kind: k.Kind, Tag: k.Tag, Digest: k.Digest, Size: obj.Size, Modified: obj.LastModified})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"repository": repo, "entries": entries})
+}
+
+// cacheUsage reports the objects and bytes of each repository's manifests,
+// largest first, and of the shared blobs. It lists the whole store, so on
+// S3 it costs a LIST request per thousand objects.
+func (h *Handler) cacheUsage(w http.ResponseWriter, r *http.Request) {
+	if h.Store == nil {
+		writeJSONError(w, http.StatusNotImplemented, "cache inspection is not available")
+		return
+	}
+	byRepo := make(map[string]*RepositoryUsage)
+	var blobs RepositoryUsage
+	for _, prefix := range []string{"manifests/", "blobs/"} {
+		for obj, err := range h.Store.List(r.Context(), prefix, "") {
+			if err != nil {
+				writeJSONError(w, http.StatusBadGateway, "listing cache: "+err.Error())
+				return
+			}
+			k, ok := cache.ParseKey(obj.Key)
+			if !ok {
+				continue
+			}
+			u := &blobs
+			if k.Kind != "blob" {
+				if u = byRepo[k.Repository]; u == nil {
+					u = &RepositoryUsage{Repository: k.Repository}
+					byRepo[k.Repository] = u
+				}
+			}
+			u.Objects++
+			u.Bytes += obj.Size
+		}
+	}
+	repos := make([]RepositoryUsage, 0, len(byRepo))
+	for _, u := range byRepo {
+		repos = append(repos, *u)
+	}
+	slices.SortFunc(repos, func(a, b RepositoryUsage) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Repository, b.Repository))
+	})
+	writeJSON(w, http.StatusOK, map[string]any{
+		"repositories": repos,
+		"blobs":        map[string]int64{"objects": blobs.Objects, "bytes": blobs.Bytes},
+	})
+}
+
+// purge deletes one cached object, named by ?key= or by an image
+// reference in ?image= (its tag, or its manifest by digest). The layers a
+// manifest references are kept, as other images may share them; purge
+// them by key. Only cache content can be purged, not the proxy's state.
+func (h *Handler) purge(w http.ResponseWriter, r *http.Request) {
+	if h.Store == nil {
+		writeJSONError(w, http.StatusNotImplemented, "cache purging is not available")
+		return
+	}
+	q := r.URL.Query()
+	key := q.Get("key")
+	switch image := q.Get("image"); {
+	case key != "" && image != "":
+		writeJSONError(w, http.StatusBadRequest, "give key or image, not both")
+		return
+	case image != "":
+		if h.CacheKey == nil {
+			writeJSONError(w, http.StatusNotImplemented, "purging by image is not available")
+			return
+		}
+		var err error
+		if key, err = h.CacheKey(image); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case key == "":
+		writeJSONError(w, http.StatusBadRequest, "key or image is required")
+		return
+	}
+	if _, ok := cache.ParseKey(key); !ok || cache.IsSidecar(key) {
+		writeJSONError(w, http.StatusBadRequest, "not a cache object key: "+key)
+		return
+	}
+	found, err := h.Store.Stat(r.Context(), []string{key})
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "checking cache: "+err.Error())
+		return
+	}
+	if _, ok := found[key]; !ok {
+		writeJSONError(w, http.StatusNotFound, key+" is not cached")
+		return
+	}
+	if err := h.Store.Delete(r.Context(), key); err != nil {
+		writeJSONError(w, http.StatusBadGateway, "deleting "+key+": "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"deleted": key, "size": found[key].Size})
+}
@@ -0,0 +1,88 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestCacheEndpoints(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewFSStore(t.TempDir(), 0)
+	for key, body := range map[string]string{
+		"manifests/ghcr.io/org/app/tags/v1":       "{}",
+		"manifests/ghcr.io/org/app/sha256-aaa":    "{...}",
+		"manifests/ghcr.io/org/app/sub/tags/v1":   "{}",
+		"manifests/ghcr.io/org/other/sha256-bbb":  "{}",
+		"blobs/sha256-ccc":                        "layer-data",
+		cache.StatePrefix + "index/snapshot.json": "{}",
+	} {
+		if err := store.Put(ctx, key, strings.NewReader(body), cache.ObjectMeta{ContentLength: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewHandler(nil, nil)
+	h.Store = store
+	h.CacheRepository = func(repo string) (string, error) { return repo, nil }
+	h.CacheKey = func(image string) (string, error) {
+		repo, tag, _ := strings.Cut(image, ":")
+		return cache.TagKey(repo, tag), nil
+	}
+	do := func(method, target string, out any) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		if out != nil {
+			if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+				t.Fatalf("%s %s: %v", method, target, err)
+			}
+		}
+		return rec.Code
+	}
+
+	var listed struct{ Entries []Entry }
+	if code := do(http.MethodGet, "/admin/cache/entries?repository=ghcr.io/org/app", &listed); code != http.StatusOK {
+		t.Fatalf("entries: status %d", code)
+	}
+	if len(listed.Entries) != 2 {
+		t.Fatalf("entries = %+v, want the repository's tag and manifest only", listed.Entries)
+	}
+
+	var usage struct {
+		Repositories []RepositoryUsage
+		Blobs        struct{ Objects, Bytes int64 }
+	}
+	if code := do(http.MethodGet, "/admin/cache/usage", &usage); code != http.StatusOK {
+		t.Fatalf("usage: status %d", code)
+	}
+	if len(usage.Repositories) != 3 || usage.Repositories[0].Repository != "ghcr.io/org/app" || usage.Repositories[0].Bytes != 7 {
+		t.Errorf("repositories = %+v", usage.Repositories)
+	}
+	if usage.Blobs.Objects != 1 || usage.Blobs.Bytes != 10 {
+		t.Errorf("blobs = %+v", usage.Blobs)
+	}
+
+	if code := do(http.MethodDelete, "/admin/cache?image=ghcr.io/org/app:v1", nil); code != http.StatusOK {
+		t.Fatalf("purge by image: status %d", code)
+	}
+	if _, err := store.Head(ctx, "manifests/ghcr.io/org/app/tags/v1"); err == nil {
+		t.Error("purged tag still cached")
+	}
+	if code := do(http.MethodDelete, "/admin/cache?key=blobs/sha256-ccc", nil); code != http.StatusOK {
+		t.Fatalf("purge by key: status %d", code)
+	}
+	for target, want := range map[string]int{
+		"/admin/cache?key=blobs/sha256-ccc":                             http.StatusNotFound,
+		"/admin/cache?key=" + cache.StatePrefix + "index/snapshot.json": http.StatusBadRequest,
+		"/admin/cache?key=blobs/sha256-ccc.meta.json":                   http.StatusBadRequest,
+		"/admin/cache": http.StatusBadRequest,
+	} {
+		if code := do(http.MethodDelete, target, nil); code != want {
+			t.Errorf("DELETE %s: status %d, want %d", target, code, want)
+		}
+	}
+}
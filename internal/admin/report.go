@@ -0,0 +1,186 @@
+package admin
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// ReportImage is one cached image in the content report: a manifest, by
+// digest, with the tags it was pulled by.
+type ReportImage struct {
+	Repository   string    `json:"repository"`
+	Digest       string    `json:"digest"`
+	Tags         []string  `json:"tags"`
+	MediaType    string    `json:"media_type,omitempty"`
+	Platforms    []string  `json:"platforms,omitempty"`    // an index's platforms
+	ManifestSize int64     `json:"manifest_size"`          // bytes
+	ContentSize  int64     `json:"content_size,omitempty"` // an image's config and layers, in bytes
+	Private      bool      `json:"private,omitempty"`      // isolated to one client's credentials
+	FirstCached  time.Time `json:"first_cached"`
+	LastPulled   time.Time `json:"last_pulled,omitzero"`
+}
+
+// reportColumns heads the CSV report.
+var reportColumns = []string{"repository", "digest", "tags", "media_type", "platforms",
+	"manifest_size", "content_size", "private", "first_cached", "last_pulled"}
+
+// report lists every cached image, for asset inventories and audits of
+// what has entered the environment: JSON by default, CSV with
+// ?format=csv. It lists the whole store and reads every cached manifest,
+// so it is as costly as the cache is large.
+func (h *Handler) report(w http.ResponseWriter, r *http.Request) {
+	if h.Store == nil {
+		writeJSONError(w, http.StatusNotImplemented, "cache inspection is not available")
+		return
+	}
+	format := cmp.Or(r.URL.Query().Get("format"), "json")
+	if format != "json" && format != "csv" {
+		writeJSONError(w, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+	images, err := h.reportImages(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "listing cache: "+err.Error())
+		return
+	}
+	if format == "json" {
+		writeJSON(w, http.StatusOK, map[string]any{"generated": time.Now().UTC(), "images": images})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="cache-report.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(reportColumns)
+	for _, img := range images {
+		var lastPulled string
+		if !img.LastPulled.IsZero() {
+			lastPulled = img.LastPulled.Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			img.Repository, img.Digest, strings.Join(img.Tags, " "), img.MediaType, strings.Join(img.Platforms, " "),
+			strconv.FormatInt(img.ManifestSize, 10), strconv.FormatInt(img.ContentSize, 10), strconv.FormatBool(img.Private),
+			img.FirstCached.Format(time.RFC3339), lastPulled,
+		})
+	}
+	cw.Flush()
+}
+
+// reportImages gathers the cached manifests, by digest and by tag, into
+// one ReportImage per repository and digest, ordered by both.
+func (h *Handler) reportImages(ctx context.Context) ([]ReportImage, error) {
+	type imageKey struct{ principal, repository, digest string }
+	byImage := make(map[imageKey]*ReportImage)
+	for _, prefix := range []string{"manifests/", "private/"} {
+		for obj, err := range h.Store.List(ctx, prefix, "") {
+			if err != nil {
+				return nil, err
+			}
+			k, ok := cache.ParseKey(obj.Key)
+			if !ok || (k.Kind != "manifest" && k.Kind != "tag") || cache.IsSidecar(obj.Key) {
+				continue
+			}
+			// The manifest is read for a tag's digest, and for the sizes
+			// and platforms of an image not seen yet.
+			digest := k.Digest
+			var body []byte
+			var meta cache.ObjectMeta
+			if digest == "" || byImage[imageKey{k.Principal, k.Repository, digest}] == nil {
+				if body, meta, err = h.readManifest(ctx, obj.Key); err != nil {
+					continue // gone since the listing, or unreadable
+				}
+				if digest == "" {
+					digest = meta.DockerContentDigest
+				}
+				if digest == "" {
+					sum := sha256.Sum256(body)
+					digest = "sha256:" + hex.EncodeToString(sum[:])
+				}
+			}
+
+			id := imageKey{k.Principal, k.Repository, digest}
+			img := byImage[id]
+			if img == nil {
+				img = &ReportImage{Repository: k.Repository, Digest: digest, Tags: []string{}, Private: k.Principal != "",
+					ManifestSize: obj.Size, FirstCached: obj.LastModified}
+				describeManifest(img, body)
+				img.MediaType = cmp.Or(img.MediaType, meta.ContentType)
+				byImage[id] = img
+			}
+			if k.Tag != "" {
+				img.Tags = append(img.Tags, k.Tag)
+			}
+			if obj.LastModified.Before(img.FirstCached) {
+				img.FirstCached = obj.LastModified
+			}
+			if h.LastAccess != nil {
+				if t, ok := h.LastAccess(obj.Key); ok && t.After(img.LastPulled) {
+					img.LastPulled = t
+				}
+			}
+		}
+	}
+
+	images := make([]ReportImage, 0, len(byImage))
+	for _, img := range byImage {
+		slices.Sort(img.Tags)
+		images = append(images, *img)
+	}
+	slices.SortFunc(images, func(a, b ReportImage) int {
+		if c := cmp.Or(cmp.Compare(a.Repository, b.Repository), cmp.Compare(a.Digest, b.Digest)); c != 0 {
+			return c
+		}
+		switch {
+		case a.Private == b.Private:
+			return 0
+		case b.Private:
+			return -1 // shared copies first
+		}
+		return 1
+	})
+	return images, nil
+}
+
+// readManifest reads a cached manifest, up to the manifest size limit.
+func (h *Handler) readManifest(ctx context.Context, key string) ([]byte, cache.ObjectMeta, error) {
+	res, err := h.Store.GetWithMeta(ctx, key)
+	if err != nil {
+		return nil, cache.ObjectMeta{}, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, manifest.DefaultMaxSize))
+	return body, res.Meta, err
+}
+
+// describeManifest fills in what img's manifest body says about it.
+// Documents that aren't schema 2 manifests are reported without.
+func describeManifest(img *ReportImage, body []byte) {
+	m, err := manifest.Parse(body)
+	if err != nil {
+		return
+	}
+	img.MediaType = m.MediaType
+	if m.IsIndex() {
+		for _, d := range m.Manifests {
+			if d.Platform != nil {
+				img.Platforms = append(img.Platforms, d.Platform.String())
+			}
+		}
+		return
+	}
+	for _, d := range m.Blobs() {
+		img.ContentSize += d.Size
+	}
+}
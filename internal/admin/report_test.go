@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestReport(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewFSStore(t.TempDir(), 0)
+	put := func(key, digest, body string) {
+		t.Helper()
+		meta := cache.ObjectMeta{DockerContentDigest: digest, ContentLength: int64(len(body)),
+			Header: http.Header{"Docker-Content-Digest": {digest}}}
+		if err := store.Put(ctx, key, strings.NewReader(body), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"digest":"sha256:c","size":100},"layers":[{"digest":"sha256:l","size":900}]}`
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json",` +
+		`"manifests":[{"digest":"sha256:amd64","platform":{"os":"linux","architecture":"amd64"}}]}`
+	put(cache.ManifestKey("ghcr.io/org/app", "sha256:app"), "sha256:app", image)
+	put(cache.TagKey("ghcr.io/org/app", "v1"), "sha256:app", image)
+	put(cache.TagKey("ghcr.io/org/app", "latest"), "sha256:app", image)
+	put(cache.TagKey("ghcr.io/org/multi", "v2"), "sha256:multi", index)
+	put(cache.PrivateKey("abc", cache.TagKey("ghcr.io/org/app", "v1")), "sha256:app", image)
+	put("blobs/sha256-l", "sha256:l", "layer")
+
+	pulled := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := NewHandler(nil, nil)
+	h.Store = store
+	h.LastAccess = func(key string) (time.Time, bool) {
+		return pulled, key == cache.TagKey("ghcr.io/org/app", "v1")
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/report", nil))
+	var got struct{ Images []ReportImage }
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, %v", rec.Code, err)
+	}
+	if len(got.Images) != 3 {
+		t.Fatalf("images = %+v, want app, its private copy and multi", got.Images)
+	}
+	app, private, multi := got.Images[0], got.Images[1], got.Images[2]
+	if app.Digest != "sha256:app" || strings.Join(app.Tags, ",") != "latest,v1" || app.Private ||
+		app.ContentSize != 1000 || !app.LastPulled.Equal(pulled) || app.FirstCached.IsZero() {
+		t.Errorf("app: %+v", app)
+	}
+	if !private.Private || strings.Join(private.Tags, ",") != "v1" || !private.LastPulled.IsZero() {
+		t.Errorf("private copy: %+v", private)
+	}
+	if multi.Repository != "ghcr.io/org/multi" || strings.Join(multi.Platforms, ",") != "linux/amd64" {
+		t.Errorf("multi: %+v", multi)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/report?format=csv", nil))
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || rows[0][0] != "repository" || rows[1][2] != "latest v1" {
+		t.Errorf("csv = %q", rows)
+	}
+}
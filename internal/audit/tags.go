@@ -0,0 +1,96 @@
+// Package audit records events operators need to be able to review after
+// the fact, such as upstream tags changing the digest they point at.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var tagMutations = metrics.NewCounterVec("oci_tag_mutations_total",
+	"Upstream tags observed pointing at a different digest than before.",
+	"registry")
+
+// maxTrackedTags bounds memory for the last-seen table; beyond it the
+// table is reset and baselines are re-learned.
+const maxTrackedTags = 100_000
+
+// TagMutation is an audit event for a tag that now resolves to a new
+// digest.
+type TagMutation struct {
+	Time      time.Time `json:"time"`
+	Registry  string    `json:"registry"`
+	Name      string    `json:"name"`
+	Tag       string    `json:"tag"`
+	OldDigest string    `json:"old_digest"`
+	NewDigest string    `json:"new_digest"`
+}
+
+// TagLog remembers the digest each tag last resolved to and records a
+// TagMutation whenever that changes.
+type TagLog struct {
+	mu   sync.Mutex
+	seen map[string]string
+	out  io.Writer // JSON lines; may be nil
+}
+
+// NewTagLog returns a TagLog that appends events to out as JSON lines.
+// out may be nil to only log and count mutations.
+func NewTagLog(out io.Writer) *TagLog {
+	return &TagLog{seen: make(map[string]string), out: out}
+}
+
+// Observe records that registry/name:tag resolved to digest. previous, if
+// non-nil, is consulted for a baseline (e.g. a cached tag manifest's
+// digest) when the tag hasn't been seen since startup. It returns the
+// mutation event, or nil if the digest is unchanged or there was no
+// baseline.
+func (t *TagLog) Observe(registry, name, tag, digest string, previous func() string) *TagMutation {
+	if digest == "" {
+		return nil
+	}
+	key := registry + "/" + name + ":" + tag
+
+	t.mu.Lock()
+	old, ok := t.seen[key]
+	t.mu.Unlock()
+	if !ok && previous != nil {
+		old = previous()
+	}
+
+	t.mu.Lock()
+	if len(t.seen) >= maxTrackedTags {
+		clear(t.seen)
+	}
+	t.seen[key] = digest
+	t.mu.Unlock()
+
+	if old == "" || old == digest {
+		return nil
+	}
+	ev := &TagMutation{
+		Time:      time.Now().UTC(),
+		Registry:  registry,
+		Name:      name,
+		Tag:       tag,
+		OldDigest: old,
+		NewDigest: digest,
+	}
+	tagMutations.Inc(registry)
+	slog.Warn("upstream tag changed digest", "image", registry+"/"+name, "tag", tag, "old", old, "new", digest)
+	if t.out != nil {
+		line, _ := json.Marshal(ev)
+		t.mu.Lock()
+		_, err := t.out.Write(append(line, '\n'))
+		t.mu.Unlock()
+		if err != nil {
+			slog.Error("failed to write tag audit event", "error", err)
+		}
+	}
+	return ev
+}
@@ -0,0 +1,40 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestTagLogRecordsMutations(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewTagLog(&buf)
+
+	if ev := log.Observe("ghcr.io", "org/app", "v1", "sha256:aaa", nil); ev != nil {
+		t.Fatalf("first observation should set the baseline, got %+v", ev)
+	}
+	if ev := log.Observe("ghcr.io", "org/app", "v1", "sha256:aaa", nil); ev != nil {
+		t.Fatalf("unchanged digest should not be an event, got %+v", ev)
+	}
+	ev := log.Observe("ghcr.io", "org/app", "v1", "sha256:bbb", nil)
+	if ev == nil || ev.OldDigest != "sha256:aaa" || ev.NewDigest != "sha256:bbb" {
+		t.Fatalf("expected mutation aaa -> bbb, got %+v", ev)
+	}
+
+	// A cached copy provides the baseline for tags not seen since startup.
+	ev = log.Observe("ghcr.io", "org/other", "v1", "sha256:new", func() string { return "sha256:cached" })
+	if ev == nil || ev.OldDigest != "sha256:cached" {
+		t.Fatalf("expected mutation from cached baseline, got %+v", ev)
+	}
+
+	var lines int
+	for dec := json.NewDecoder(&buf); dec.More(); lines++ {
+		var got TagMutation
+		if err := dec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines != 2 {
+		t.Fatalf("expected 2 audit lines, got %d", lines)
+	}
+}
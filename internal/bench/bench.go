@@ -0,0 +1,319 @@
+// Package bench generates synthetic pull workloads against a running proxy
+// and reports throughput and latency, for sizing deployments and catching
+// regressions before rollout.
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// bypassHeader forces an upstream fetch on proxies that trust the client;
+// see proxy.BypassHeader.
+const bypassHeader = "X-Oci-Cache-Bypass"
+
+// Options describes a workload.
+type Options struct {
+	// Target is the proxy's base URL, e.g. http://cache.internal:8080.
+	Target string
+	// Images are repository references as the proxy sees them
+	// ("org/app:v1", "library/nginx@sha256:...").
+	Images []string
+	// Platform picks the child manifest of multi-arch images ("os/arch").
+	Platform string
+	// Concurrency is the number of simulated clients pulling in parallel.
+	Concurrency int
+	// Duration bounds the run; Pulls, if positive, stops it earlier.
+	Duration time.Duration
+	Pulls    int
+	// MissRatio is the fraction of pulls sent with the cache bypass header,
+	// so the proxy fetches from upstream. The proxy must trust this client
+	// (CACHE_BYPASS_TRUSTED_CIDRS) or these are served as hits.
+	MissRatio float64
+	// Authorization is sent with every request, if set.
+	Authorization string
+	Client        *http.Client
+}
+
+// image is a resolved pull: the URL paths of its manifests (an index and
+// the chosen child, or a single manifest) and of the blobs they reference.
+type image struct {
+	manifests []string
+	blobs     []string
+}
+
+// Run resolves each image, then pulls them from Concurrency workers until
+// Duration or Pulls is reached, and reports what it measured.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	opts.Target = strings.TrimSuffix(opts.Target, "/")
+	opts.Concurrency = max(opts.Concurrency, 1)
+
+	images := make([]image, 0, len(opts.Images))
+	for _, ref := range opts.Images {
+		img, err := resolve(ctx, opts, ref)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %w", ref, err)
+		}
+		images = append(images, img)
+	}
+	if len(images) == 0 {
+		return nil, errors.New("no images to pull")
+	}
+
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+
+	rec := newRecorder()
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		issued int
+	)
+	start := time.Now()
+	for range opts.Concurrency {
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				mu.Lock()
+				if opts.Pulls > 0 && issued >= opts.Pulls {
+					mu.Unlock()
+					return
+				}
+				issued++
+				mu.Unlock()
+
+				img := images[rand.IntN(len(images))]
+				miss := rand.Float64() < opts.MissRatio
+				pull(ctx, opts, img, miss, rec)
+			}
+		})
+	}
+	wg.Wait()
+	return rec.report(time.Since(start)), nil
+}
+
+// pull fetches an image's manifest and then each of its blobs, as a
+// container runtime would (minus the parallel layer downloads).
+func pull(ctx context.Context, opts Options, img image, miss bool, rec *recorder) {
+	ok := true
+	for i, p := range slices.Concat(img.manifests, img.blobs) {
+		if ctx.Err() != nil {
+			return
+		}
+		kind := "blob"
+		if i < len(img.manifests) {
+			kind = "manifest"
+		}
+		if _, err := fetch(ctx, opts, p, miss, kind, rec); err != nil {
+			ok = false
+		}
+	}
+	if ctx.Err() == nil {
+		rec.pull(ok)
+	}
+}
+
+// fetch GETs one path and records its latency. Requests cut off by the end
+// of the run are not recorded.
+func fetch(ctx context.Context, opts Options, path string, miss bool, kind string, rec *recorder) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.Target+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", manifest.Accept)
+	if opts.Authorization != "" {
+		req.Header.Set("Authorization", opts.Authorization)
+	}
+	if miss {
+		req.Header.Set(bypassHeader, "true")
+	}
+
+	start := time.Now()
+	resp, err := opts.Client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			rec.request(kind, miss, time.Since(start), 0, err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	var n int64
+	if kind == "manifest" {
+		body, err = io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+		n = int64(len(body))
+	} else {
+		n, err = io.Copy(io.Discard, resp.Body)
+	}
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s returned %d", path, resp.StatusCode)
+	}
+	if ctx.Err() == nil {
+		rec.request(kind, miss, time.Since(start), n, err)
+	}
+	return body, err
+}
+
+// resolve fetches an image's manifest, following an index to the child for
+// opts.Platform, and collects the blobs a pull would download.
+func resolve(ctx context.Context, opts Options, ref string) (image, error) {
+	name, reference, ok := strings.Cut(ref, "@")
+	if !ok {
+		name, reference = ref, "latest"
+		if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+			name, reference = ref[:i], ref[i+1:]
+		}
+	}
+	img := image{manifests: []string{"/v2/" + name + "/manifests/" + reference}}
+
+	body, err := fetch(ctx, opts, img.manifests[0], false, "manifest", newRecorder())
+	if err != nil {
+		return image{}, err
+	}
+	m, err := manifest.Parse(body)
+	if err != nil {
+		return image{}, fmt.Errorf("parsing manifest: %w", err)
+	}
+
+	if len(m.Manifests) > 0 {
+		child := m.Manifests[0].Digest
+		for _, c := range m.Manifests {
+			if c.MatchesPlatform(opts.Platform) {
+				child = c.Digest
+				break
+			}
+		}
+		// The index is fetched per pull too, like a runtime resolving a tag.
+		childImg, err := resolve(ctx, opts, name+"@"+child)
+		if err != nil {
+			return image{}, err
+		}
+		img.manifests = append(img.manifests, childImg.manifests...)
+		img.blobs = childImg.blobs
+		return img, nil
+	}
+
+	for _, b := range m.Blobs() {
+		img.blobs = append(img.blobs, "/v2/"+name+"/blobs/"+b.Digest)
+	}
+	return img, nil
+}
+
+// recorder collects measurements from concurrent workers.
+type recorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration // by kind and hit/miss
+	bytes     int64
+	errors    int
+	pulls     int
+	failed    int
+}
+
+func newRecorder() *recorder {
+	return &recorder{latencies: make(map[string][]time.Duration)}
+}
+
+func (r *recorder) request(kind string, miss bool, d time.Duration, n int64, err error) {
+	class := kind + " hit"
+	if miss {
+		class = kind + " miss"
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bytes += n
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.latencies[class] = append(r.latencies[class], d)
+}
+
+func (r *recorder) pull(ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pulls++
+	if !ok {
+		r.failed++
+	}
+}
+
+// Report summarises a run.
+type Report struct {
+	Elapsed     time.Duration `json:"elapsed"`
+	Pulls       int           `json:"pulls"`
+	FailedPulls int           `json:"failed_pulls"`
+	Requests    int           `json:"requests"`
+	Errors      int           `json:"errors"`
+	Bytes       int64         `json:"bytes"`
+	Classes     []Latency     `json:"latency"`
+}
+
+// Latency holds percentiles for one request class ("manifest hit",
+// "blob miss", ...).
+type Latency struct {
+	Class string        `json:"class"`
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+func (r *recorder) report(elapsed time.Duration) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rep := &Report{Elapsed: elapsed, Pulls: r.pulls, FailedPulls: r.failed, Errors: r.errors, Bytes: r.bytes}
+	rep.Requests = r.errors
+	for class, ds := range r.latencies {
+		slices.Sort(ds)
+		rep.Requests += len(ds)
+		rep.Classes = append(rep.Classes, Latency{
+			Class: class,
+			Count: len(ds),
+			P50:   percentile(ds, 0.50),
+			P90:   percentile(ds, 0.90),
+			P99:   percentile(ds, 0.99),
+			Max:   ds[len(ds)-1],
+		})
+	}
+	slices.SortFunc(rep.Classes, func(a, b Latency) int { return strings.Compare(a.Class, b.Class) })
+	return rep
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// WriteText renders the report for a terminal.
+func (r *Report) WriteText(w io.Writer) {
+	secs := r.Elapsed.Seconds()
+	fmt.Fprintf(w, "elapsed %s: %d pulls (%d failed), %d requests (%d errors)\n",
+		r.Elapsed.Round(time.Millisecond), r.Pulls, r.FailedPulls, r.Requests, r.Errors)
+	if secs > 0 {
+		fmt.Fprintf(w, "throughput: %.1f pulls/s, %.1f requests/s, %.1f MiB/s\n",
+			float64(r.Pulls)/secs, float64(r.Requests)/secs, float64(r.Bytes)/secs/(1<<20))
+	}
+	fmt.Fprintf(w, "\n%-14s %8s %10s %10s %10s %10s\n", "class", "count", "p50", "p90", "p99", "max")
+	for _, l := range r.Classes {
+		fmt.Fprintf(w, "%-14s %8d %10s %10s %10s %10s\n", l.Class, l.Count,
+			l.P50.Round(time.Microsecond), l.P90.Round(time.Microsecond), l.P99.Round(time.Microsecond), l.Max.Round(time.Microsecond))
+	}
+}
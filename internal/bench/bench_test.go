@@ -0,0 +1,73 @@
+package bench
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	objects := map[string]string{
+		"/v2/org/app/manifests/v1": `{"manifests":[
+			{"digest":"sha256:arm","platform":{"os":"linux","architecture":"arm64"}},
+			{"digest":"sha256:amd","platform":{"os":"linux","architecture":"amd64"}}]}`,
+		"/v2/org/app/manifests/sha256:amd": `{"config":{"digest":"sha256:cfg"},"layers":[{"digest":"sha256:l1"}]}`,
+		"/v2/org/app/blobs/sha256:cfg":     "{}",
+		"/v2/org/app/blobs/sha256:l1":      "layer",
+	}
+	var bypassed atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get(bypassHeader) != "" {
+			bypassed.Add(1)
+		}
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	rep, err := Run(context.Background(), Options{
+		Target:      srv.URL,
+		Images:      []string{"org/app:v1"},
+		Platform:    "linux/amd64",
+		Concurrency: 3,
+		Pulls:       10,
+		MissRatio:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Pulls != 10 || rep.FailedPulls != 0 || rep.Requests != 40 || rep.Errors != 0 {
+		t.Fatalf("unexpected totals %+v", rep)
+	}
+	if got := bypassed.Load(); got != 40 {
+		t.Errorf("expected every request to bypass the cache, got %d", got)
+	}
+	counts := map[string]int{}
+	for _, l := range rep.Classes {
+		counts[l.Class] = l.Count
+		if l.P50 > l.P99 || l.P99 > l.Max {
+			t.Errorf("%s: percentiles out of order %+v", l.Class, l)
+		}
+	}
+	if counts["manifest miss"] != 20 || counts["blob miss"] != 20 {
+		t.Errorf("unexpected classes %v", counts)
+	}
+
+	var out strings.Builder
+	rep.WriteText(&out)
+	if !strings.Contains(out.String(), "blob miss") {
+		t.Errorf("text report missing classes:\n%s", out.String())
+	}
+
+	if _, err := Run(context.Background(), Options{Target: srv.URL, Images: []string{"org/missing:v1"}, Pulls: 1}); err == nil {
+		t.Error("expected an unresolvable image to fail the run")
+	}
+}
@@ -3,18 +3,51 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/fs"
+	"iter"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/digest"
 )
 
+// metaSuffix is appended to a data key to form its metadata sidecar key.
+const metaSuffix = ".meta.json"
+
+// IsSidecar reports whether key names a metadata sidecar rather than a
+// data object.
+func IsSidecar(key string) bool {
+	return strings.HasSuffix(key, metaSuffix)
+}
+
 // Store is the interface for OCI object storage backends.
 type Store interface {
 	Init(ctx context.Context) error
 	Head(ctx context.Context, key string) (ObjectMeta, error)
 	GetWithMeta(ctx context.Context, key string) (*GetResult, error)
 	Put(ctx context.Context, key string, body io.Reader, meta ObjectMeta) error
+
+	// Stat reports which of keys are cached, returning info for each key
+	// whose data object exists (a missing sidecar is recovered on read,
+	// so it doesn't make the key a miss). Absent keys are
+	// omitted from the result. Backends answer in bulk (listings, directory
+	// reads) rather than issuing one request per key.
+	Stat(ctx context.Context, keys []string) (map[string]ObjectInfo, error)
+
+	// Delete removes an object and its metadata sidecar. The sidecar goes
+	// first, so a partially failed delete leaves an entry that reads as a
+	// miss rather than one served without metadata. Deleting a missing key
+	// is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List streams data objects whose keys start with prefix, in key order.
+	// Metadata sidecars are never yielded. Passing the last key processed as
+	// startAfter resumes an interrupted scan.
+	List(ctx context.Context, prefix, startAfter string) iter.Seq2[ObjectInfo, error]
 }
 
 // ObjectMeta holds metadata for cached objects.
@@ -27,9 +60,9 @@ type ObjectMeta struct {
 
 // MarshalMeta serializes an ObjectMeta to JSON for sidecar storage.
 // Only the Header map is persisted; the explicit struct fields are derived
-// from it on read.
+// from it on read. Oversized header sets are trimmed to fit MaxMetaSize.
 func MarshalMeta(m ObjectMeta) ([]byte, error) {
-	return json.Marshal(m.Header)
+	return trimMeta(m.Header)
 }
 
 // UnmarshalMeta deserializes JSON from a sidecar file into an ObjectMeta.
@@ -57,6 +90,19 @@ type Redirector interface {
 	RedirectURL(ctx context.Context, key string) (url string, meta ObjectMeta, err error)
 }
 
+// IsNotFound reports whether err is a backend's answer for a missing key,
+// as opposed to a failure to ask.
+func IsNotFound(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || isNotFound(err)
+}
+
+// ObjectInfo describes a cached data object returned by a listing.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
 // GetResult holds the body and metadata from a single get call.
 type GetResult struct {
 	Body io.ReadCloser
@@ -67,13 +113,5 @@ type GetResult struct {
 // SeaweedFS mangles colons to hyphens in S3 metadata values, so
 // "sha256:abc..." becomes "sha256-abc..." on read-back. This restores the colon.
 func NormalizeDigest(s string) string {
-	if strings.Contains(s, ":") {
-		return s
-	}
-	for _, alg := range []string{"sha256", "sha512"} {
-		if strings.HasPrefix(s, alg+"-") {
-			return alg + ":" + s[len(alg)+1:]
-		}
-	}
-	return s
+	return digest.Normalize(s)
 }
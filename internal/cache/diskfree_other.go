@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package cache
+
+import "errors"
+
+// diskUsage is not implemented on this platform; the free-space guard is
+// disabled when it returns an error.
+func diskUsage(_ string) (avail, total uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
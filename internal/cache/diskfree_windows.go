@@ -0,0 +1,18 @@
+//go:build windows
+
+package cache
+
+import "golang.org/x/sys/windows"
+
+// diskUsage returns the bytes available to this process and the total size
+// of the volume containing path.
+func diskUsage(path string) (avail, total uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(p, &avail, &total, nil); err != nil {
+		return 0, 0, err
+	}
+	return avail, total, nil
+}
@@ -1,21 +1,41 @@
 package cache
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
 // FSStore provides filesystem-backed caching for OCI objects.
 type FSStore struct {
-	root string
+	root           string
+	minFreePercent float64
+
+	// escapeNames maps keys onto Windows-safe file names (see fs_names.go).
+	escapeNames bool
+
+	spaceMu        sync.Mutex
+	spaceCheckedAt time.Time
+	readOnly       bool
 }
 
 // NewFSStore creates a new filesystem cache store rooted at root.
-func NewFSStore(root string) *FSStore {
-	return &FSStore{root: root}
+// When free space on the filesystem drops below minFreePercent, Put rejects
+// new entries with ErrInsufficientSpace; zero disables the guard.
+func NewFSStore(root string, minFreePercent float64) *FSStore {
+	return &FSStore{root: root, minFreePercent: minFreePercent, escapeNames: runtime.GOOS == "windows"}
 }
 
 // Init ensures the root directory exists.
@@ -24,11 +44,11 @@ func (f *FSStore) Init(_ context.Context) error {
 }
 
 func (f *FSStore) dataPath(key string) string {
-	return filepath.Join(f.root, filepath.FromSlash(key))
+	return filepath.Join(f.root, filepath.FromSlash(f.fsKey(key)))
 }
 
 func (f *FSStore) metaPath(key string) string {
-	return f.dataPath(key) + ".meta.json"
+	return f.dataPath(key) + metaSuffix
 }
 
 // Head checks if an object exists and returns its metadata from the sidecar file.
@@ -51,24 +71,46 @@ func (f *FSStore) GetWithMeta(_ context.Context, key string) (*GetResult, error)
 	if err != nil {
 		return nil, err
 	}
+	f.touch(key)
 
 	return &GetResult{Body: file, Meta: meta}, nil
 }
 
-// Put writes an object and its metadata sidecar atomically using temp file + rename.
+// Put writes an object and its metadata sidecar with create-if-absent
+// semantics, mirroring the S3 store's conditional PUT. The data file is
+// written to a temp file and hard-linked into place, which fails atomically
+// if another writer (a concurrent fill, or another process sharing FS_ROOT)
+// got there first. The loser discards its copy rather than interleaving
+// with the winner's data and sidecar.
 func (f *FSStore) Put(_ context.Context, key string, body io.Reader, meta ObjectMeta) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	if !f.hasFreeSpace() {
+		return ErrInsufficientSpace
+	}
+
 	dp := f.dataPath(key)
 
 	if err := os.MkdirAll(filepath.Dir(dp), 0o755); err != nil {
 		return fmt.Errorf("creating directory: %w", err)
 	}
 
-	// Write data file atomically
-	if err := atomicWrite(dp, body); err != nil {
+	created, err := atomicCreate(dp, body)
+	if err != nil {
 		return fmt.Errorf("writing data: %w", err)
 	}
+	if !created {
+		// Another writer won the race, and the sidecar is its to write:
+		// this one describes a different body, which for a tag can differ
+		// in length and digest. A winner that crashed before writing it
+		// leaves the data file alone, and reads recover the sidecar from it.
+		slog.Debug("object already cached, skipping duplicate write", "key", key)
+		return nil
+	}
 
-	// Write metadata sidecar atomically
+	// The data file is this writer's, so its sidecar replaces any left
+	// behind, such as one recovered by a read in the meantime.
 	metaJSON, err := MarshalMeta(meta)
 	if err != nil {
 		return fmt.Errorf("marshalling metadata: %w", err)
@@ -81,40 +123,295 @@ func (f *FSStore) Put(_ context.Context, key string, body io.Reader, meta Object
 	return nil
 }
 
+// List walks the cache directory and yields data objects whose keys start
+// with prefix. Keys are yielded in path-component order (the order
+// filepath.WalkDir visits them), and startAfter is compared the same way so
+// whole directories before the resume point are skipped without reading.
+// With escaped names the order is that of the names on disk.
+func (f *FSStore) List(ctx context.Context, prefix, startAfter string) iter.Seq2[ObjectInfo, error] {
+	if startAfter != "" {
+		startAfter = f.fsKey(startAfter)
+	}
+	return func(yield func(ObjectInfo, error) bool) {
+		err := filepath.WalkDir(f.root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(f.root, path)
+			if err != nil {
+				return err
+			}
+			onDisk := filepath.ToSlash(rel)
+			if onDisk == "." {
+				return nil
+			}
+			key := f.keyFromFS(onDisk)
+
+			if d.IsDir() {
+				// Prune directories that can't contain the prefix or that lie
+				// entirely before the resume point.
+				if !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+					return fs.SkipDir
+				}
+				if startAfter != "" && !strings.HasPrefix(startAfter, onDisk+"/") && compareKeyPath(onDisk, startAfter) < 0 {
+					return fs.SkipDir
+				}
+				return nil
+			}
+
+			name := d.Name()
+			if strings.HasSuffix(name, metaSuffix) || strings.HasPrefix(name, ".tmp-") {
+				return nil
+			}
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			if startAfter != "" && compareKeyPath(onDisk, startAfter) <= 0 {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil // removed mid-walk
+				}
+				return err
+			}
+			if !yield(ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil) {
+				return errStopWalk
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopWalk) {
+			yield(ObjectInfo{}, err)
+		}
+	}
+}
+
+// errStopWalk aborts a WalkDir when the List consumer stops iterating.
+var errStopWalk = errors.New("stop walk")
+
+// compareKeyPath orders slash-separated keys component by component, which
+// matches the depth-first lexical order of filepath.WalkDir (unlike a plain
+// string comparison, where "a-b/x" sorts before "a/x").
+func compareKeyPath(a, b string) int {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// Delete removes the sidecar and then the data file for key.
+func (f *FSStore) Delete(_ context.Context, key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	if err := removeFile(f.metaPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing metadata: %w", err)
+	}
+	if err := removeFile(f.dataPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing data: %w", err)
+	}
+	return nil
+}
+
+// statReadDirThreshold is the number of keys in a single directory above
+// which Stat reads the directory once instead of stat'ing each key.
+const statReadDirThreshold = 32
+
+// Stat reports which keys are cached. Keys are grouped by directory; large
+// groups are answered from a single directory read, small ones by stat'ing
+// each data file. A data file whose sidecar is missing still counts, since
+// reads recover the sidecar from it.
+func (f *FSStore) Stat(ctx context.Context, keys []string) (map[string]ObjectInfo, error) {
+	byDir := make(map[string][]string)
+	for _, key := range keys {
+		dir := path.Dir(key)
+		byDir[dir] = append(byDir[dir], key)
+	}
+
+	out := make(map[string]ObjectInfo, len(keys))
+	for dir, group := range byDir {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if len(group) < statReadDirThreshold {
+			for _, key := range group {
+				info, ok, err := f.statOne(key)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					out[key] = info
+				}
+			}
+			continue
+		}
+
+		if !validKey(dir) {
+			continue
+		}
+		entries, err := os.ReadDir(f.dataPath(dir))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		names := make(map[string]fs.DirEntry, len(entries))
+		for _, e := range entries {
+			names[e.Name()] = e
+		}
+		for _, key := range group {
+			name := path.Base(f.fsKey(key))
+			data, ok := names[name]
+			if !ok || data.IsDir() {
+				continue
+			}
+			fi, err := data.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			out[key] = ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}
+		}
+	}
+	return out, nil
+}
+
+// statOne checks a single key's data file.
+func (f *FSStore) statOne(key string) (ObjectInfo, bool, error) {
+	if !validKey(key) {
+		return ObjectInfo{}, false, nil
+	}
+	fi, err := os.Stat(f.dataPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, false, nil
+	}
+	if err != nil {
+		return ObjectInfo{}, false, err
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, false, nil
+	}
+	return ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}, true, nil
+}
+
 func (f *FSStore) readMeta(key string) (ObjectMeta, error) {
-	data, err := os.ReadFile(f.metaPath(key))
+	if !validKey(key) {
+		return ObjectMeta{}, ErrInvalidKey
+	}
+	file, err := os.Open(f.metaPath(key))
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return f.recoverSidecar(key, false, err)
+		}
 		return ObjectMeta{}, err
 	}
+	defer file.Close()
+	data, err := readMetaLimited(file)
+	if err != nil {
+		return ObjectMeta{}, fmt.Errorf("reading metadata: %w", err)
+	}
 
 	meta, err := UnmarshalMeta(data)
 	if err != nil {
-		return ObjectMeta{}, fmt.Errorf("parsing metadata: %w", err)
+		slog.Warn("corrupt meta sidecar", "key", key, "error", err)
+		return f.recoverSidecar(key, true, fmt.Errorf("parsing metadata: %w", err))
+	}
+	return meta, nil
+}
+
+// recoverSidecar synthesizes key's metadata from its data file when the
+// sidecar is missing (replace false) or corrupt (replace true), and writes
+// it back so the next read is a plain sidecar hit. cause is returned when
+// there is no data file either.
+func (f *FSStore) recoverSidecar(key string, replace bool, cause error) (ObjectMeta, error) {
+	dp := f.dataPath(key)
+	fi, err := os.Stat(dp)
+	if err != nil || fi.IsDir() {
+		return ObjectMeta{}, cause
+	}
+	var body []byte
+	if needsManifestBody(key, "", "") && fi.Size() <= maxSniffSize {
+		if body, err = os.ReadFile(dp); err != nil {
+			return ObjectMeta{}, fmt.Errorf("reading data to recover metadata: %w", err)
+		}
+	}
+	meta := recoverMeta(key, fi.Size(), "", "", body)
+
+	metaJSON, err := MarshalMeta(meta)
+	if err != nil {
+		return ObjectMeta{}, fmt.Errorf("marshalling metadata: %w", err)
+	}
+	// A missing sidecar is only filled in if still missing, so a Put
+	// finishing concurrently keeps the sidecar it wrote.
+	if replace {
+		err = atomicWriteBytes(f.metaPath(key), metaJSON)
+	} else {
+		_, err = atomicCreate(f.metaPath(key), bytes.NewReader(metaJSON))
+	}
+	if err != nil {
+		slog.Warn("failed to write recovered meta sidecar", "key", key, "error", err)
+	} else {
+		slog.Info("recovered meta sidecar from data file", "key", key, "digest", meta.DockerContentDigest)
 	}
 	return meta, nil
 }
 
-// atomicWrite writes data from a reader to dst via a temp file + rename.
-func atomicWrite(dst string, r io.Reader) error {
+// atomicCreate writes data from a reader to a temp file and links it to dst
+// only if dst does not already exist. It reports false (with no error) when
+// dst already existed. On filesystems without hard-link support it falls
+// back to a racy existence check followed by rename.
+func atomicCreate(dst string, r io.Reader) (bool, error) {
 	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
 	if err != nil {
-		return err
+		return false, err
 	}
 	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
 
 	if _, err := io.Copy(tmp, r); err != nil {
 		tmp.Close()
-		os.Remove(tmpName)
-		return err
+		return false, err
 	}
 	if err := tmp.Close(); err != nil {
-		os.Remove(tmpName)
-		return err
+		return false, err
 	}
-	return os.Rename(tmpName, dst)
+
+	err = os.Link(tmpName, dst)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, fs.ErrExist):
+		return false, nil
+	}
+
+	// Link unsupported (some FUSE and network filesystems).
+	slog.Debug("hard link failed, falling back to rename", "path", dst, "error", err)
+	if _, err := os.Stat(dst); err == nil {
+		return false, nil
+	}
+	if err := replaceFile(tmpName, dst); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// atomicWriteBytes writes bytes to dst via a temp file + rename.
+// atomicWriteBytes writes bytes to dst via a temp file + rename, replacing
+// any existing file.
 func atomicWriteBytes(dst string, data []byte) error {
 	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
 	if err != nil {
@@ -131,5 +428,9 @@ func atomicWriteBytes(dst string, data []byte) error {
 		os.Remove(tmpName)
 		return err
 	}
-	return os.Rename(tmpName, dst)
+	if err := replaceFile(tmpName, dst); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
 }
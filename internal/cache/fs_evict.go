@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Reasons an object is evicted.
+const (
+	EvictMaxBytes = "max_bytes"
+	EvictMaxAge   = "max_age"
+)
+
+// accessResolution is how stale a recorded access time may get before a
+// read refreshes it, so a hot object costs one stat per read rather than
+// a metadata write.
+const accessResolution = time.Minute
+
+// EvictLimits bound what an Evicter keeps. Zero disables a limit.
+type EvictLimits struct {
+	MaxBytes int64         // total size of data and sidecars
+	MaxAge   time.Duration // since the object was last read
+}
+
+// Evicted is an object removed, or that would have been, by Evict.
+type Evicted struct {
+	Key        string
+	Size       int64
+	LastAccess time.Time
+	Reason     string // EvictMaxBytes or EvictMaxAge
+}
+
+// Evicter is implemented by stores that record when each object was last
+// read and can evict the least recently read ones to stay within limits.
+// Keys pinned reports true for are kept. With dryRun the objects are
+// reported but kept.
+type Evicter interface {
+	Evict(ctx context.Context, limits EvictLimits, pinned func(key string) bool, dryRun bool) ([]Evicted, error)
+}
+
+// touch records a read of key in its sidecar's modification time, which
+// is otherwise the time the object was cached. Filesystem atimes can't be
+// relied on (noatime and relatime mounts), so the sidecar stands in.
+func (f *FSStore) touch(key string) {
+	mp := f.metaPath(key)
+	fi, err := os.Stat(mp)
+	if err != nil {
+		return
+	}
+	if now := time.Now(); now.Sub(fi.ModTime()) >= accessResolution {
+		_ = os.Chtimes(mp, time.Time{}, now)
+	}
+}
+
+// fsEntry is a cached object found by Evict's walk.
+type fsEntry struct {
+	key    string
+	size   int64
+	access time.Time
+}
+
+// Evict removes objects, least recently read first, until the store is
+// within limits.MaxBytes, along with any not read for limits.MaxAge. Only
+// cache objects are candidates: index snapshots and self-test probes are
+// left alone, though they count towards the total.
+func (f *FSStore) Evict(ctx context.Context, limits EvictLimits, pinned func(key string) bool, dryRun bool) ([]Evicted, error) {
+	var total int64
+	var entries []fsEntry
+	sidecars := make(map[string]fs.FileInfo) // by data file path
+	err := filepath.WalkDir(f.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed mid-walk
+			}
+			return err
+		}
+		total += info.Size()
+		if strings.HasSuffix(p, metaSuffix) {
+			sidecars[strings.TrimSuffix(p, metaSuffix)] = info
+			return nil
+		}
+		key := f.keyFromPath(p)
+		if _, ok := ParseKey(key); !ok {
+			return nil
+		}
+		entries = append(entries, fsEntry{key: key, size: info.Size(), access: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if meta, ok := sidecars[f.dataPath(e.key)]; ok {
+			entries[i].size += meta.Size()
+			entries[i].access = meta.ModTime()
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b fsEntry) int { return a.access.Compare(b.access) })
+	var cutoff time.Time
+	if limits.MaxAge > 0 {
+		cutoff = time.Now().Add(-limits.MaxAge)
+	}
+	var evicted []Evicted
+	for _, e := range entries {
+		var reason string
+		switch {
+		case limits.MaxAge > 0 && e.access.Before(cutoff):
+			reason = EvictMaxAge
+		case limits.MaxBytes > 0 && total > limits.MaxBytes:
+			reason = EvictMaxBytes
+		default:
+			// Entries are in access order, so nothing later is older.
+			return evicted, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return evicted, err
+		}
+		if pinned != nil && pinned(e.key) {
+			continue
+		}
+		if !dryRun {
+			ok, err := f.evict(e.key, e.access)
+			if err != nil {
+				return evicted, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		total -= e.size
+		evicted = append(evicted, Evicted{Key: e.key, Size: e.size, LastAccess: e.access, Reason: reason})
+	}
+	return evicted, nil
+}
+
+// keyFromPath is the key of the data file at p under the root.
+func (f *FSStore) keyFromPath(p string) string {
+	rel, err := filepath.Rel(f.root, p)
+	if err != nil {
+		return ""
+	}
+	return f.keyFromFS(filepath.ToSlash(rel))
+}
+
+// evict removes key's data file and sidecar unless it has been read since
+// access, reporting whether it did. The data file is renamed aside first,
+// so readers see a miss at once rather than a sidecar without data; the
+// janitor removes the renamed file if the process dies before it does.
+func (f *FSStore) evict(key string, access time.Time) (bool, error) {
+	mp, dp := f.metaPath(key), f.dataPath(key)
+	if fi, err := os.Stat(mp); err == nil && fi.ModTime().After(access) {
+		return false, nil
+	}
+	aside := filepath.Join(filepath.Dir(dp), fmt.Sprintf(".tmp-evict-%d-%s", time.Now().UnixNano(), filepath.Base(dp)))
+	if err := replaceFile(dp, aside); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("evicting %s: %w", key, err)
+	}
+	if err := removeFile(mp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("evicting %s: removing metadata: %w", key, err)
+	}
+	if err := removeFile(aside); err != nil {
+		return false, fmt.Errorf("evicting %s: removing data: %w", key, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFSEvict(t *testing.T) {
+	ctx := context.Background()
+	f := NewFSStore(t.TempDir(), 0)
+	now := time.Now()
+	keys := map[string]time.Duration{ // key: time since last read
+		"blobs/sha256-cold":    10 * time.Hour,
+		"blobs/sha256-pinned":  9 * time.Hour,
+		"blobs/sha256-warm":    2 * time.Hour,
+		"blobs/sha256-hot":     time.Hour,
+		"blobs/sha256-ancient": 100 * time.Hour,
+	}
+	for key, ago := range keys {
+		if err := f.Put(ctx, key, strings.NewReader(strings.Repeat("x", 100)), ObjectMeta{ContentLength: 100}); err != nil {
+			t.Fatal(err)
+		}
+		at := now.Add(-ago)
+		os.Chtimes(f.metaPath(key), at, at)
+	}
+	meta, err := os.Stat(f.metaPath("blobs/sha256-hot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := 100 + meta.Size()
+	pinned := func(key string) bool { return key == "blobs/sha256-pinned" }
+	limits := EvictLimits{MaxBytes: 3 * entry, MaxAge: 50 * time.Hour}
+
+	dry, err := f.Evict(ctx, limits, pinned, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dry) != 2 {
+		t.Fatalf("dry run evicted %v", dry)
+	}
+	if _, err := f.Head(ctx, "blobs/sha256-ancient"); err != nil {
+		t.Fatal("dry run removed an object")
+	}
+
+	evicted, err := f.Evict(ctx, limits, pinned, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Evicted{
+		{Key: "blobs/sha256-ancient", Reason: EvictMaxAge},
+		{Key: "blobs/sha256-cold", Reason: EvictMaxBytes},
+	}
+	if len(evicted) != len(want) {
+		t.Fatalf("evicted %v, want %v", evicted, want)
+	}
+	for i, w := range want {
+		if evicted[i].Key != w.Key || evicted[i].Reason != w.Reason || evicted[i].Size != entry {
+			t.Errorf("evicted[%d] = %+v, want %s (%s, %d bytes)", i, evicted[i], w.Key, w.Reason, entry)
+		}
+		if _, err := os.Stat(f.dataPath(w.Key)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: data file still present", w.Key)
+		}
+		if _, err := os.Stat(f.metaPath(w.Key)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: sidecar still present", w.Key)
+		}
+	}
+	for _, key := range []string{"blobs/sha256-pinned", "blobs/sha256-warm", "blobs/sha256-hot"} {
+		if _, err := f.Head(ctx, key); err != nil {
+			t.Errorf("%s was evicted: %v", key, err)
+		}
+	}
+}
+
+func TestFSEvictKeepsObjectReadDuringSweep(t *testing.T) {
+	ctx := context.Background()
+	f := NewFSStore(t.TempDir(), 0)
+	key := "blobs/sha256-abc"
+	if err := f.Put(ctx, key, strings.NewReader("data"), ObjectMeta{ContentLength: 4}); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(f.metaPath(key), old, old)
+
+	// A read after the walk saw the old access time.
+	res, err := f.GetWithMeta(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	ok, err := f.evict(key, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("evicted an object read since the walk")
+	}
+	if _, err := f.Head(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+}
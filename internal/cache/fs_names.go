@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Windows file names can't contain <>:"\|?* or control characters, can't
+// end in a dot or space, can't be a device name (CON, NUL, COM1, ...), and
+// are compared case-insensitively. Registry hosts ("localhost:5000") and
+// tags ("Latest" next to "latest") run into all of these, so when
+// escapeNames is set each key segment is escaped on its way to the
+// filesystem: offending bytes, '%' itself and upper-case letters become
+// %xx (lower-case hex, so names stay case-free). Keys seen by callers are
+// unchanged; only the on-disk layout differs.
+
+// windowsDeviceNames are reserved regardless of extension ("nul.json").
+var windowsDeviceNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com0": true, "com1": true, "com2": true, "com3": true, "com4": true,
+	"com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt0": true, "lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true,
+	"lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// escapeName makes one key segment a valid, case-distinct Windows name.
+func escapeName(seg string) string {
+	var b strings.Builder
+	for i := 0; i < len(seg); i++ {
+		c := seg[i]
+		last := i == len(seg)-1
+		switch {
+		case c < 0x20, strings.IndexByte(`<>:"\|?*%`, c) >= 0,
+			'A' <= c && c <= 'Z',
+			last && (c == '.' || c == ' '),
+			i == 0 && isDeviceName(seg):
+			fmt.Fprintf(&b, "%%%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isDeviceName(seg string) bool {
+	base, _, _ := strings.Cut(seg, ".")
+	return windowsDeviceNames[strings.ToLower(base)]
+}
+
+// unescapeName reverses escapeName. Malformed escapes are kept literally.
+func unescapeName(seg string) string {
+	if !strings.Contains(seg, "%") {
+		return seg
+	}
+	var b strings.Builder
+	for i := 0; i < len(seg); i++ {
+		if seg[i] == '%' && i+2 < len(seg) && isHex(seg[i+1]) && isHex(seg[i+2]) {
+			b.WriteByte(unhex(seg[i+1])<<4 | unhex(seg[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(seg[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'A' <= c && c <= 'F' || 'a' <= c && c <= 'f'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// fsKey maps a key to the slash-separated path it is stored under.
+func (f *FSStore) fsKey(key string) string {
+	if !f.escapeNames {
+		return key
+	}
+	segs := strings.Split(key, "/")
+	for i, s := range segs {
+		segs[i] = escapeName(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+// keyFromFS maps a slash-separated path under the root back to its key.
+func (f *FSStore) keyFromFS(p string) string {
+	if !f.escapeNames {
+		return p
+	}
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = unescapeName(s)
+	}
+	return strings.Join(segs, "/")
+}
@@ -0,0 +1,39 @@
+package cache
+
+import (
+	"os"
+	"time"
+)
+
+// On Windows a file can't be replaced or removed while another handle has
+// it open without FILE_SHARE_DELETE, which Go's os.Open doesn't request, so
+// a rename over a sidecar that a reader is parsing fails with a sharing
+// violation. Those readers finish in milliseconds, so the operation is
+// retried briefly. isTransientFSError is false on other platforms.
+
+// fsRetryDelays are the waits between attempts.
+var fsRetryDelays = []time.Duration{10 * time.Millisecond, 50 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond}
+
+// retryFS runs op, retrying while it fails with an error transient
+// reports as retryable.
+func retryFS(op func() error, transient func(error) bool) error {
+	err := op()
+	for _, d := range fsRetryDelays {
+		if err == nil || !transient(err) {
+			return err
+		}
+		time.Sleep(d)
+		err = op()
+	}
+	return err
+}
+
+// replaceFile renames src over dst, replacing dst if it exists.
+func replaceFile(src, dst string) error {
+	return retryFS(func() error { return os.Rename(src, dst) }, isTransientFSError)
+}
+
+// removeFile removes name.
+func removeFile(name string) error {
+	return retryFS(func() error { return os.Remove(name) }, isTransientFSError)
+}
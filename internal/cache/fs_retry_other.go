@@ -0,0 +1,7 @@
+//go:build !windows
+
+package cache
+
+// isTransientFSError is always false: POSIX renames and unlinks don't
+// conflict with open handles.
+func isTransientFSError(error) bool { return false }
@@ -0,0 +1,17 @@
+//go:build windows
+
+package cache
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isTransientFSError reports errors caused by another handle holding the
+// file open.
+func isTransientFSError(err error) bool {
+	return errors.Is(err, windows.ERROR_SHARING_VIOLATION) ||
+		errors.Is(err, windows.ERROR_ACCESS_DENIED) ||
+		errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
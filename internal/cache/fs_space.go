@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// ErrInsufficientSpace is returned by FSStore.Put when free space on the
+// cache filesystem has dropped below the configured threshold. The store
+// keeps serving hits but stops accepting new entries until space recovers.
+var ErrInsufficientSpace = errors.New("insufficient free space on cache filesystem")
+
+// spaceCheckInterval bounds how often Put re-reads filesystem usage.
+// statfs is cheap, but a pull storm can issue thousands of Puts a second.
+const spaceCheckInterval = 5 * time.Second
+
+// hasFreeSpace reports whether the cache filesystem is above the free-space
+// threshold. Results are cached for spaceCheckInterval, and transitions into
+// and out of read-only mode are logged once.
+func (f *FSStore) hasFreeSpace() bool {
+	if f.minFreePercent <= 0 {
+		return true
+	}
+
+	f.spaceMu.Lock()
+	defer f.spaceMu.Unlock()
+
+	if time.Since(f.spaceCheckedAt) < spaceCheckInterval {
+		return !f.readOnly
+	}
+	f.spaceCheckedAt = time.Now()
+
+	avail, total, err := diskUsage(f.root)
+	if err != nil || total == 0 {
+		// Can't measure — don't block writes on an unsupported platform.
+		return !f.readOnly
+	}
+
+	freePercent := float64(avail) / float64(total) * 100
+	lowSpace := freePercent < f.minFreePercent
+	switch {
+	case lowSpace && !f.readOnly:
+		slog.Warn("cache filesystem low on space, switching to read-only caching",
+			"root", f.root, "free_percent", freePercent, "threshold_percent", f.minFreePercent)
+	case !lowSpace && f.readOnly:
+		slog.Info("cache filesystem space recovered, resuming caching",
+			"root", f.root, "free_percent", freePercent)
+	}
+	f.readOnly = lowSpace
+	return !f.readOnly
+}
@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFSPutIsCreateIfAbsent(t *testing.T) {
+	root := t.TempDir()
+	store := NewFSStore(root, 0)
+	ctx := context.Background()
+	meta := func(v string) ObjectMeta {
+		return ObjectMeta{Header: http.Header{"X-Writer": {v}}}
+	}
+
+	if err := store.Put(ctx, "blobs/sha256-aa", strings.NewReader("first"), meta("first")); err != nil {
+		t.Fatalf("first put: %v", err)
+	}
+	if err := store.Put(ctx, "blobs/sha256-aa", strings.NewReader("second"), meta("second")); err != nil {
+		t.Fatalf("second put should succeed as a no-op: %v", err)
+	}
+
+	res, err := store.GetWithMeta(ctx, "blobs/sha256-aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "first" || res.Meta.Header.Get("X-Writer") != "first" {
+		t.Fatalf("expected first writer's data and sidecar, got %q / %q", body, res.Meta.Header.Get("X-Writer"))
+	}
+
+	// A data file left without its sidecar isn't paired with a later
+	// writer's; reads recover one from the data instead.
+	if err := os.Remove(store.metaPath("blobs/sha256-aa")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "blobs/sha256-aa", strings.NewReader("third"), meta("third")); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := store.Head(ctx, "blobs/sha256-aa"); err != nil || m.Header.Get("X-Writer") == "third" {
+		t.Fatalf("expected sidecar recovered from the data, got %+v / %v", m, err)
+	}
+
+	entries, _ := os.ReadDir(store.dataPath("blobs"))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".tmp-") {
+			t.Fatalf("temp file left behind: %s", e.Name())
+		}
+	}
+}
+
+func TestFSConcurrentPutsKeepDataAndSidecarPaired(t *testing.T) {
+	store := NewFSStore(t.TempDir(), 0)
+	ctx := context.Background()
+
+	// A writer between linking its data and writing its sidecar: a
+	// loser arriving then must not supply the sidecar for it.
+	key := "manifests/ghcr.io/org/app/tags/racing"
+	if err := os.MkdirAll(filepath.Dir(store.dataPath(key)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.dataPath(key), []byte("winner's body"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loser := ObjectMeta{DockerContentDigest: "sha256:loser", Header: http.Header{"Docker-Content-Digest": {"sha256:loser"}}}
+	if err := store.Put(ctx, key, strings.NewReader("loser's longer body"), loser); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := store.Head(ctx, key); err != nil || m.DockerContentDigest == "sha256:loser" {
+		t.Fatalf("winner's data paired with the loser's sidecar: %+v / %v", m, err)
+	}
+
+	for round := range 100 {
+		key := fmt.Sprintf("manifests/ghcr.io/org/app/tags/v%d", round)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := range 32 {
+			// Bodies differ in length, as a retagged image's manifests do.
+			body := strings.Repeat("x", 10+i)
+			digest := fmt.Sprintf("sha256:%064x", i)
+			wg.Go(func() {
+				meta := ObjectMeta{ContentLength: int64(len(body)), DockerContentDigest: digest,
+					Header: http.Header{"Docker-Content-Digest": {digest}}}
+				// Hold every writer at its body, so they race to link.
+				r := io.MultiReader(readerFunc(func([]byte) (int, error) { <-start; return 0, io.EOF }), strings.NewReader(body))
+				if err := store.Put(ctx, key, r, meta); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+		close(start)
+		wg.Wait()
+
+		res, err := store.GetWithMeta(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if want := fmt.Sprintf("sha256:%064x", len(body)-10); res.Meta.DockerContentDigest != want {
+			t.Fatalf("round %d: %d-byte body stored with another writer's sidecar (digest %s)",
+				round, len(body), res.Meta.DockerContentDigest)
+		}
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestFSRejectsKeysOutsideRoot(t *testing.T) {
+	store := NewFSStore(filepath.Join(t.TempDir(), "cache"), 0)
+	ctx := context.Background()
+
+	for _, key := range []string{"../escape", "blobs/../../escape", "/abs", "blobs//x", `blobs\..\x`, "blobs/./x"} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), ObjectMeta{}); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q): expected ErrInvalidKey, got %v", key, err)
+		}
+		if _, err := store.Head(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Head(%q): expected ErrInvalidKey, got %v", key, err)
+		}
+	}
+}
+
+func TestFSEscapedNames(t *testing.T) {
+	root := t.TempDir()
+	store := &FSStore{root: root, escapeNames: true}
+	ctx := context.Background()
+	keys := []string{
+		"manifests/localhost:5000/app/tags/Latest",
+		"manifests/localhost:5000/app/tags/latest",
+		"manifests/registry/con/tags/v1.",
+		"blobs/sha256-aa",
+	}
+	for _, k := range keys {
+		if err := store.Put(ctx, k, strings.NewReader(k), ObjectMeta{}); err != nil {
+			t.Fatalf("put %s: %v", k, err)
+		}
+	}
+
+	filepath.WalkDir(root, func(p string, _ os.DirEntry, _ error) error {
+		name := filepath.Base(p)
+		if p != root && (strings.ContainsAny(name, `:<>"|?*`) || strings.ToLower(name) != name) {
+			t.Errorf("name not escaped for Windows: %s", p)
+		}
+		return nil
+	})
+
+	var listed []string
+	for info, err := range store.List(ctx, "", "") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, info.Key)
+	}
+	slices.Sort(listed)
+	want := slices.Sorted(slices.Values(keys))
+	if !slices.Equal(listed, want) {
+		t.Fatalf("listed %v, want %v", listed, want)
+	}
+
+	found, err := store.Stat(ctx, keys)
+	if err != nil || len(found) != len(keys) {
+		t.Fatalf("stat found %d of %d: %v", len(found), len(keys), err)
+	}
+	res, err := store.GetWithMeta(ctx, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != keys[0] {
+		t.Fatalf("Latest and latest collided: got %q", body)
+	}
+	if err := store.Delete(ctx, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Head(ctx, keys[1]); err != nil {
+		t.Fatalf("deleting Latest removed latest: %v", err)
+	}
+}
+
+func TestRetryFS(t *testing.T) {
+	busy := errors.New("sharing violation")
+	transient := func(err error) bool { return err == busy }
+
+	attempts := 0
+	err := retryFS(func() error {
+		if attempts++; attempts < 3 {
+			return busy
+		}
+		return nil
+	}, transient)
+	if err != nil || attempts != 3 {
+		t.Fatalf("expected success on the third attempt, got %v after %d", err, attempts)
+	}
+
+	attempts = 0
+	err = retryFS(func() error { attempts++; return os.ErrNotExist }, transient)
+	if !errors.Is(err, os.ErrNotExist) || attempts != 1 {
+		t.Fatalf("permanent errors must not be retried: %v after %d", err, attempts)
+	}
+}
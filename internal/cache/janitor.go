@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Kinds of Debris.
+const (
+	DebrisUpload   = "multipart-upload" // an S3 multipart upload never completed or aborted
+	DebrisTemp     = "temp-file"        // a temp file an interrupted write didn't rename into place
+	DebrisSidecar  = "orphan-sidecar"   // a metadata sidecar whose data object is gone
+	DebrisSelfTest = "self-test"        // a probe object SelfTest didn't get to delete
+)
+
+// Debris is something an interrupted write left in the store that no
+// request will ever read.
+type Debris struct {
+	Kind string
+	// Key is the object's key, or for a temp file its path relative to
+	// the store's root.
+	Key      string
+	Size     int64 // zero for multipart uploads
+	Modified time.Time
+}
+
+// Cleaner is implemented by stores that can find and remove the debris of
+// failed fills. Only debris last written before cutoff is touched, so
+// writes in progress are left alone. With dryRun the debris is reported
+// but kept.
+type Cleaner interface {
+	CleanUp(ctx context.Context, cutoff time.Time, dryRun bool) ([]Debris, error)
+}
+
+// CleanUp removes temp files left by writes that died before renaming
+// them into place, sidecars whose data file is gone, and self-test probes.
+func (f *FSStore) CleanUp(ctx context.Context, cutoff time.Time, dryRun bool) ([]Debris, error) {
+	var debris []Debris
+	err := filepath.WalkDir(f.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed mid-walk
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(f.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		var kind string
+		switch name := d.Name(); {
+		case strings.HasPrefix(name, ".tmp-"):
+			kind = DebrisTemp
+		case strings.HasSuffix(name, metaSuffix):
+			// WalkDir visits a data file before its sidecar, so a probe
+			// removed below takes its sidecar with it in the same pass.
+			if _, err := os.Lstat(strings.TrimSuffix(p, metaSuffix)); errors.Is(err, fs.ErrNotExist) {
+				kind = DebrisSidecar
+			}
+		case strings.HasPrefix(rel, selfTestPrefix):
+			kind = DebrisSelfTest
+		}
+		if kind == "" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		debris = append(debris, Debris{Kind: kind, Key: rel, Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	return debris, err
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func debrisKinds(debris []Debris) map[string]string {
+	kinds := make(map[string]string)
+	for _, d := range debris {
+		kinds[d.Key] = d.Kind
+	}
+	return kinds
+}
+
+func TestFSCleanUp(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	f := NewFSStore(root, 0)
+	for _, key := range []string{"blobs/sha256-keep", selfTestPrefix + "probe"} {
+		if err := f.Put(ctx, key, strings.NewReader("data"), ObjectMeta{ContentLength: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(rel string, at time.Time) {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		if err := os.WriteFile(p, []byte("junk"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, at, at)
+	}
+	write("blobs/.tmp-123", old)
+	write("blobs/.tmp-456", time.Now()) // a write in progress
+	write("blobs/sha256-gone"+metaSuffix, old)
+	for _, rel := range []string{selfTestPrefix + "probe", selfTestPrefix + "probe" + metaSuffix} {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		os.Chtimes(p, old, old)
+	}
+
+	cutoff := time.Now().Add(-24 * time.Hour)
+	dry, err := f.CleanUp(ctx, cutoff, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "blobs", ".tmp-123")); err != nil {
+		t.Fatal("dry run removed a temp file")
+	}
+	debris, err := f.CleanUp(ctx, cutoff, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"blobs/.tmp-123":                      DebrisTemp,
+		"blobs/sha256-gone" + metaSuffix:      DebrisSidecar,
+		selfTestPrefix + "probe":              DebrisSelfTest,
+		selfTestPrefix + "probe" + metaSuffix: DebrisSidecar,
+	}
+	got := debrisKinds(debris)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for k, kind := range want {
+		if got[k] != kind {
+			t.Errorf("%s: got %q, want %q", k, got[k], kind)
+		}
+	}
+	if len(dry) != 3 { // the probe's sidecar is only orphaned once the probe goes
+		t.Errorf("dry run found %v", debrisKinds(dry))
+	}
+	if _, err := f.Head(ctx, "blobs/sha256-keep"); err != nil {
+		t.Errorf("cached object was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "blobs", ".tmp-456")); err != nil {
+		t.Error("recent temp file was removed")
+	}
+}
+
+func TestS3CleanUp(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeS3Store(t)
+	if err := s.Put(ctx, "blobs/sha256-keep", strings.NewReader("data"), ObjectMeta{ContentLength: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, selfTestPrefix+"probe", strings.NewReader("data"), ObjectMeta{ContentLength: 4}); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	fake.mu.Lock()
+	for k, o := range fake.objects {
+		if strings.HasPrefix(k, selfTestPrefix) {
+			o.modified = old
+			fake.objects[k] = o
+		}
+	}
+	// A tag whose name extends another's sorts between that tag and its
+	// sidecar; neither sidecar is an orphan.
+	for _, k := range []string{"manifests/app/tags/v1", "manifests/app/tags/v1-rc", "manifests/app/tags/v1-rc" + metaSuffix, "manifests/app/tags/v1" + metaSuffix} {
+		fake.objects[k] = fakeObject{[]byte("{}"), nil, old}
+	}
+	fake.objects["blobs/sha256-gone"+metaSuffix] = fakeObject{[]byte("{}"), nil, old}
+	fake.uploads["stale"] = fakeUpload{"blobs/sha256-big", old}
+	fake.uploads["fresh"] = fakeUpload{"blobs/sha256-new", time.Now()}
+	fake.mu.Unlock()
+
+	debris, err := s.CleanUp(ctx, time.Now().Add(-24*time.Hour), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"blobs/sha256-big":               DebrisUpload,
+		"blobs/sha256-gone" + metaSuffix: DebrisSidecar,
+		selfTestPrefix + "probe":         DebrisSelfTest,
+	}
+	got := debrisKinds(debris)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for k, kind := range want {
+		if got[k] != kind {
+			t.Errorf("%s: got %q, want %q", k, got[k], kind)
+		}
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for k := range fake.objects {
+		if strings.HasPrefix(k, selfTestPrefix) || strings.HasPrefix(k, "blobs/sha256-gone") {
+			t.Errorf("%s was not removed", k)
+		}
+	}
+	if _, ok := fake.objects["manifests/app/tags/v1"+metaSuffix]; !ok {
+		t.Error("a live sidecar was removed")
+	}
+	if _, ok := fake.uploads["stale"]; ok {
+		t.Error("stale upload was not aborted")
+	}
+	if _, ok := fake.uploads["fresh"]; !ok {
+		t.Error("recent upload was aborted")
+	}
+}
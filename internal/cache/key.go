@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrInvalidKey is returned for keys that are not clean, relative,
+// slash-separated paths. The filesystem store refuses them so a key can
+// never resolve outside FS_ROOT.
+var ErrInvalidKey = errors.New("invalid cache key")
+
+// validKey reports whether key is safe to map onto a filesystem path: no
+// empty, "." or ".." segments, no leading slash, no backslashes or NULs.
+func validKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, "\\\x00") {
+		return false
+	}
+	for seg := range strings.SplitSeq(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyInfo is a decoded storage key.
+type KeyInfo struct {
+	Kind       string // "blob", "chunk", "manifest" (by digest) or "tag"
+	Repository string // "registry/name"; empty for blobs
+	Registry   string // set for blobs and chunks stored under KeySchemaRegistry
+	Tag        string // set for tag manifests
+	Digest     string // "algorithm:hex"; set for blobs and digest manifests
+	Principal  string // set for content isolated to one client; see PrivateKey
+}
+
+// ParseKey decodes a data key written by the proxy:
+//
+//	blobs/[<registry>/]<alg>-<hex>
+//	chunks/[<registry>/]<alg>-<hex>/<offset>
+//	manifests/<registry>/<name>/<alg>-<hex>
+//	manifests/<registry>/<name>/tags/<tag>
+//
+// any of which may sit under private/<principal>/.
+func ParseKey(key string) (KeyInfo, bool) {
+	if rest, ok := strings.CutPrefix(key, privatePrefix); ok {
+		principal, key, ok := strings.Cut(rest, "/")
+		if !ok || strings.HasPrefix(key, privatePrefix) {
+			return KeyInfo{}, false
+		}
+		k, ok := ParseKey(key)
+		k.Principal = principal
+		return k, ok
+	}
+	if rest, ok := strings.CutPrefix(key, "blobs/"); ok {
+		segs := strings.Split(rest, "/")
+		switch len(segs) {
+		case 1:
+			return KeyInfo{Kind: "blob", Digest: NormalizeDigest(segs[0])}, segs[0] != ""
+		case 2:
+			return KeyInfo{Kind: "blob", Registry: segs[0], Digest: NormalizeDigest(segs[1])}, segs[0] != "" && segs[1] != ""
+		}
+		return KeyInfo{}, false
+	}
+	if rest, ok := strings.CutPrefix(key, "chunks/"); ok {
+		segs := strings.Split(rest, "/")
+		switch len(segs) {
+		case 2:
+			return KeyInfo{Kind: "chunk", Digest: NormalizeDigest(segs[0])}, segs[0] != "" && segs[1] != ""
+		case 3:
+			return KeyInfo{Kind: "chunk", Registry: segs[0], Digest: NormalizeDigest(segs[1])}, segs[0] != "" && segs[1] != "" && segs[2] != ""
+		}
+		return KeyInfo{}, false
+	}
+	rest, ok := strings.CutPrefix(key, "manifests/")
+	if !ok {
+		return KeyInfo{}, false
+	}
+	segs := strings.Split(rest, "/")
+	n := len(segs)
+	if n >= 4 && segs[n-2] == "tags" {
+		return KeyInfo{Kind: "tag", Repository: strings.Join(segs[:n-2], "/"), Tag: segs[n-1]}, true
+	}
+	if n < 3 {
+		return KeyInfo{}, false
+	}
+	return KeyInfo{Kind: "manifest", Repository: strings.Join(segs[:n-1], "/"), Digest: NormalizeDigest(segs[n-1])}, true
+}
+
+// StatePrefix holds the proxy's own state kept in the store, such as
+// cache index snapshots, rather than cached content. ParseKey doesn't
+// recognise it, so retention and export leave it alone.
+const StatePrefix = "state/"
+
+// privatePrefix holds content fetched with one client's own credentials,
+// under a directory per principal.
+const privatePrefix = "private/"
+
+// PrivateKey returns the storage key for key's copy isolated to principal,
+// an opaque identifier safe to use as a path segment.
+func PrivateKey(principal, key string) string {
+	return privatePrefix + principal + "/" + key
+}
+
+// BlobKey returns the storage key for a blob digest under
+// KeySchemaGlobal.
+func BlobKey(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "-", 1)
+}
+
+// ChunkKey returns the storage key for the part of a blob starting at
+// offset, when blobs are cached in chunks. Offsets are fixed-width hex so
+// a blob's chunks list in order.
+func ChunkKey(digest string, offset int64) string {
+	return fmt.Sprintf("chunks/%s/%016x", strings.Replace(digest, ":", "-", 1), offset)
+}
+
+// KeySchema decides where blobs and their chunks are stored, trading
+// storage for control:
+//
+//   - KeySchemaGlobal keys a blob by digest alone (blobs/<alg>-<hex>), so
+//     a layer shared by images on several registries is fetched and stored
+//     once. Nothing records which registry it came from, so one
+//     registry's content can't be deleted without possibly breaking
+//     another's.
+//   - KeySchemaRegistry keys it under the registry it was pulled from
+//     (blobs/<registry>/<alg>-<hex>). Everything fetched from a registry
+//     then lies under blobs/<registry>/, chunks/<registry>/ and
+//     manifests/<registry>/, and can be deleted, audited or expired by
+//     prefix on its own. A layer on two registries (a Docker official
+//     image also mirrored on ECR Public) is fetched and stored once per
+//     registry.
+//
+// Manifest keys are the same under both. Switching schema on a populated
+// cache leaves blobs under the old keys unread until they are moved with
+// MigrateKeys; until then pulls fetch them again.
+type KeySchema string
+
+// Key schemas.
+const (
+	KeySchemaGlobal   KeySchema = "global"
+	KeySchemaRegistry KeySchema = "registry"
+)
+
+// ParseKeySchema validates a key schema name. Empty means global.
+func ParseKeySchema(s string) (KeySchema, error) {
+	switch KeySchema(strings.ToLower(s)) {
+	case "", KeySchemaGlobal:
+		return KeySchemaGlobal, nil
+	case KeySchemaRegistry:
+		return KeySchemaRegistry, nil
+	}
+	return "", fmt.Errorf("unknown key schema %q (want global or registry)", s)
+}
+
+// BlobKey returns the storage key for a blob digest pulled from registry.
+func (s KeySchema) BlobKey(registry, digest string) string {
+	if s == KeySchemaRegistry {
+		return "blobs/" + registry + "/" + strings.Replace(digest, ":", "-", 1)
+	}
+	return BlobKey(digest)
+}
+
+// ChunkKey returns the storage key for the chunk of a blob pulled from
+// registry starting at offset; see ChunkKey.
+func (s KeySchema) ChunkKey(registry, digest string, offset int64) string {
+	if s == KeySchemaRegistry {
+		return fmt.Sprintf("chunks/%s/%s/%016x", registry, strings.Replace(digest, ":", "-", 1), offset)
+	}
+	return ChunkKey(digest, offset)
+}
+
+// ManifestKey returns the storage key for a manifest of repository
+// ("registry/name") addressed by digest.
+func ManifestKey(repository, digest string) string {
+	return "manifests/" + repository + "/" + strings.Replace(digest, ":", "-", 1)
+}
+
+// TagKey returns the storage key for a cached tag manifest.
+func TagKey(repository, tag string) string {
+	return "manifests/" + repository + "/tags/" + tag
+}
+
+// MatchRepository reports whether repo matches any of patterns. Patterns
+// ending in "/*" match any repository below that namespace at any depth
+// ("myorg/*" matches "myorg/team/app"), and the namespace may itself be a
+// glob ("team-*/*"); other patterns use path.Match syntax against the full
+// name. An empty pattern list matches everything.
+func MatchRepository(patterns []string, repo string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ns, ok := strings.CutSuffix(p, "/*"); ok {
+			for i := range len(repo) {
+				if repo[i] != '/' {
+					continue
+				}
+				if ok, _ := path.Match(ns, repo[:i]); ok {
+					return true
+				}
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, repo); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+)
+
+// ListPage collects up to limit objects from store.List and returns them
+// with a continuation token for the next page ("" when the listing is
+// exhausted). Tokens are opaque to callers; they encode the last key
+// returned, so paging stays correct while objects are added or removed.
+//
+// Callers that process every object (GC, inventory scans) should range over
+// Store.List directly instead — it streams with bounded memory regardless
+// of store size. ListPage is for request/response APIs that must hand
+// pagination state to a client.
+func ListPage(ctx context.Context, store Store, prefix, token string, limit int) ([]ObjectInfo, string, error) {
+	startAfter, err := decodeListToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = 1000
+	}
+
+	var page []ObjectInfo
+	for obj, err := range store.List(ctx, prefix, startAfter) {
+		if err != nil {
+			return nil, "", err
+		}
+		if len(page) == limit {
+			// There's at least one more object, so hand out a token.
+			return page, encodeListToken(page[len(page)-1].Key), nil
+		}
+		page = append(page, obj)
+	}
+	return page, "", nil
+}
+
+func encodeListToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeListToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid continuation token: %w", err)
+	}
+	return string(b), nil
+}
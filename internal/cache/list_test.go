@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func writeFSEntries(t *testing.T, root string, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		p := filepath.Join(root, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p+metaSuffix, []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFSListResumesInWalkOrder(t *testing.T) {
+	root := t.TempDir()
+	store := NewFSStore(root, 0)
+	// "app-foo" sorts before "app/" as a plain string but after "app" as a
+	// path component — resuming must follow the walk order.
+	writeFSEntries(t, root,
+		"blobs/sha256-aa",
+		"blobs/sha256-bb",
+		"manifests/r/app/sha256-11",
+		"manifests/r/app/sha256-22",
+		"manifests/r/app-foo/sha256-33",
+	)
+
+	var all []string
+	for obj, err := range store.List(context.Background(), "", "") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, obj.Key)
+	}
+	if len(all) != 5 {
+		t.Fatalf("expected 5 keys (no sidecars), got %v", all)
+	}
+
+	for i, after := range all {
+		var rest []string
+		for obj, err := range store.List(context.Background(), "", after) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			rest = append(rest, obj.Key)
+		}
+		if !slices.Equal(rest, all[i+1:]) {
+			t.Fatalf("resume after %q: got %v, want %v", after, rest, all[i+1:])
+		}
+	}
+}
+
+func TestListPage(t *testing.T) {
+	root := t.TempDir()
+	store := NewFSStore(root, 0)
+	writeFSEntries(t, root, "blobs/a", "blobs/b", "blobs/c", "manifests/x")
+
+	var got []string
+	token := ""
+	pages := 0
+	for {
+		page, next, err := ListPage(context.Background(), store, "blobs/", token, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, obj := range page {
+			got = append(got, obj.Key)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if want := []string{"blobs/a", "blobs/b", "blobs/c"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if pages != 2 {
+		t.Fatalf("expected 2 pages, got %d", pages)
+	}
+
+	if _, _, err := ListPage(context.Background(), store, "", "!!not-base64", 2); err == nil {
+		t.Fatal("expected error for malformed token")
+	}
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// MaxMetaSize bounds a serialized metadata sidecar. Registry responses carry
+// a handful of short headers, so anything near this size is an upstream
+// stuffing headers, and is trimmed before it reaches storage.
+const MaxMetaSize = 64 << 10
+
+// ErrMetaTooLarge is returned when a sidecar exceeds MaxMetaSize even after
+// trimming, or when a stored sidecar is larger than MaxMetaSize.
+var ErrMetaTooLarge = errors.New("metadata sidecar exceeds size limit")
+
+// essentialHeaders are the headers a trimmed sidecar keeps; they are all
+// the proxy needs to serve a cached object correctly.
+var essentialHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Docker-Content-Digest",
+	"Etag",
+	"Last-Modified",
+}
+
+// trimMeta marshals h, dropping all but the essential headers if the full
+// set would exceed MaxMetaSize.
+func trimMeta(h http.Header) ([]byte, error) {
+	data, err := json.Marshal(h)
+	if err != nil || len(data) <= MaxMetaSize {
+		return data, err
+	}
+
+	trimmed := make(http.Header, len(essentialHeaders))
+	for _, k := range essentialHeaders {
+		if v := h.Values(k); len(v) > 0 {
+			trimmed[k] = v[:1]
+		}
+	}
+	data, err = json.Marshal(trimmed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxMetaSize {
+		return nil, ErrMetaTooLarge
+	}
+	slog.Warn("trimmed oversized metadata sidecar", "headers", len(h), "kept", len(trimmed))
+	return data, nil
+}
+
+// readMetaLimited reads a sidecar, refusing ones larger than MaxMetaSize
+// rather than buffering them.
+func readMetaLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxMetaSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxMetaSize {
+		return nil, ErrMetaTooLarge
+	}
+	return data, nil
+}
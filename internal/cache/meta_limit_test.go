@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMarshalMetaTrimsOversizedHeaders(t *testing.T) {
+	h := http.Header{
+		"Content-Type":          {"application/vnd.oci.image.manifest.v1+json"},
+		"Docker-Content-Digest": {"sha256:abc"},
+		"X-Junk":                {strings.Repeat("x", MaxMetaSize)},
+	}
+	data, err := MarshalMeta(ObjectMeta{Header: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := UnmarshalMeta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Header.Get("X-Junk") != "" {
+		t.Fatal("expected junk header to be dropped")
+	}
+	if meta.ContentType != h.Get("Content-Type") || meta.DockerContentDigest != "sha256:abc" {
+		t.Fatalf("essential headers lost: %v", meta.Header)
+	}
+
+	if _, err := readMetaLimited(bytes.NewReader(make([]byte, MaxMetaSize+1))); !errors.Is(err, ErrMetaTooLarge) {
+		t.Fatalf("expected ErrMetaTooLarge reading oversized sidecar, got %v", err)
+	}
+}
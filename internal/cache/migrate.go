@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// MigrateResult summarises a MigrateKeys run.
+type MigrateResult struct {
+	Copied       int   // objects copied to their key under the new schema
+	Present      int   // objects already there
+	Deleted      int   // objects removed from their old key
+	Bytes        int64 // bytes copied
+	Unreferenced int   // global blobs no cached manifest references, left in place
+}
+
+// blobScope is who a blob is stored for under KeySchemaRegistry: a
+// registry, and the principal for content isolated to one client.
+type blobScope struct {
+	principal, registry string
+}
+
+// MigrateKeys moves blobs and chunks stored under one key schema to the
+// keys of schema to, so a cache can switch schema without fetching its
+// content again. Manifests are keyed the same under both and aren't
+// touched.
+//
+// Moving to KeySchemaRegistry copies each global blob to every registry
+// with a cached manifest referencing it, which means reading every cached
+// manifest; blobs nothing references stay where they are. Moving to
+// KeySchemaGlobal copies each registry's blobs to the shared key. With
+// deleteOld, the old copies are removed once copied; otherwise both sets
+// are kept and the old one can be removed later by prefix. With dryRun
+// nothing is written.
+//
+// Running it while the proxy serves traffic is safe: a pull that misses a
+// blob not yet copied fetches it, and copies never replace a blob already
+// stored under the new key.
+func MigrateKeys(ctx context.Context, store Store, to KeySchema, deleteOld, dryRun bool) (MigrateResult, error) {
+	var res MigrateResult
+	var refs map[string][]blobScope // by digest
+	if to == KeySchemaRegistry {
+		var err error
+		if refs, err = blobReferences(ctx, store); err != nil {
+			return res, err
+		}
+	}
+
+	for _, prefix := range []string{"blobs/", "chunks/", privatePrefix} {
+		for obj, err := range store.List(ctx, prefix, "") {
+			if err != nil {
+				return res, err
+			}
+			k, ok := ParseKey(obj.Key)
+			if !ok || (k.Kind != "blob" && k.Kind != "chunk") {
+				continue
+			}
+			var dsts []string
+			switch {
+			case to == KeySchemaRegistry && k.Registry == "":
+				for _, s := range refs[k.Digest] {
+					if s.principal == k.Principal {
+						dsts = append(dsts, migratedKey(obj.Key, k, to, s.registry))
+					}
+				}
+				if len(dsts) == 0 {
+					res.Unreferenced++
+					continue
+				}
+			case to == KeySchemaGlobal && k.Registry != "":
+				dsts = []string{migratedKey(obj.Key, k, to, "")}
+			default:
+				continue
+			}
+
+			for _, dst := range dsts {
+				copied, err := copyObject(ctx, store, store, obj, dst, dryRun)
+				if err != nil {
+					return res, err
+				}
+				if copied {
+					res.Copied++
+					res.Bytes += obj.Size
+				} else {
+					res.Present++
+				}
+			}
+			if deleteOld {
+				if !dryRun {
+					if err := store.Delete(ctx, obj.Key); err != nil {
+						return res, fmt.Errorf("deleting %s: %w", obj.Key, err)
+					}
+				}
+				res.Deleted++
+			}
+		}
+	}
+	return res, nil
+}
+
+// blobReferences reads every cached manifest and records, for each blob
+// digest, the registries (and principals) whose manifests reference it.
+func blobReferences(ctx context.Context, store Store) (map[string][]blobScope, error) {
+	refs := make(map[string][]blobScope)
+	for _, prefix := range []string{"manifests/", privatePrefix} {
+		for obj, err := range store.List(ctx, prefix, "") {
+			if err != nil {
+				return nil, err
+			}
+			k, ok := ParseKey(obj.Key)
+			if !ok || (k.Kind != "manifest" && k.Kind != "tag") {
+				continue
+			}
+			res, err := store.GetWithMeta(ctx, obj.Key)
+			if err != nil {
+				slog.Warn("skipping unreadable manifest", "key", obj.Key, "error", err)
+				continue
+			}
+			m, err := manifest.Decode(res.Body, manifest.DefaultMaxSize)
+			res.Body.Close()
+			if err != nil {
+				slog.Debug("skipping undecodable manifest", "key", obj.Key, "error", err)
+				continue
+			}
+			registry, _, _ := strings.Cut(k.Repository, "/")
+			scope := blobScope{principal: k.Principal, registry: registry}
+			for _, d := range m.Blobs() {
+				if !containsScope(refs[d.Digest], scope) {
+					refs[d.Digest] = append(refs[d.Digest], scope)
+				}
+			}
+		}
+	}
+	return refs, nil
+}
+
+func containsScope(scopes []blobScope, s blobScope) bool {
+	for _, have := range scopes {
+		if have == s {
+			return true
+		}
+	}
+	return false
+}
+
+// migratedKey is where the blob or chunk at key goes under schema, for
+// registry. Chunks keep their offset, and private content its principal.
+func migratedKey(key string, k KeyInfo, schema KeySchema, registry string) string {
+	var out string
+	if k.Kind == "chunk" {
+		var offset int64
+		fmt.Sscanf(key[strings.LastIndex(key, "/")+1:], "%x", &offset)
+		out = schema.ChunkKey(registry, k.Digest, offset)
+	} else {
+		out = schema.BlobKey(registry, k.Digest)
+	}
+	if k.Principal != "" {
+		out = PrivateKey(k.Principal, out)
+	}
+	return out
+}
+
+// copyObject copies obj from one store to dst in another, or the same
+// one, unless dst is already stored there. It reports whether it copied.
+func copyObject(ctx context.Context, from, to Store, obj ObjectInfo, dst string, dryRun bool) (bool, error) {
+	found, err := to.Stat(ctx, []string{dst})
+	if err != nil {
+		return false, err
+	}
+	if _, ok := found[dst]; ok {
+		return false, nil
+	}
+	if dryRun {
+		slog.Info("would copy", "from", obj.Key, "to", dst, "size", obj.Size)
+		return true, nil
+	}
+	src, err := from.GetWithMeta(ctx, obj.Key)
+	if err != nil {
+		return false, fmt.Errorf("reading %s: %w", obj.Key, err)
+	}
+	defer src.Body.Close()
+	if err := to.Put(ctx, dst, src.Body, src.Meta); err != nil {
+		return false, fmt.Errorf("copying %s to %s: %w", obj.Key, dst, err)
+	}
+	slog.Debug("copied", "from", obj.Key, "to", dst, "size", obj.Size)
+	return true, nil
+}
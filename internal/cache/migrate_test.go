@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMigrateKeys(t *testing.T) {
+	ctx := context.Background()
+	f := NewFSStore(t.TempDir(), 0)
+	put := func(key, body string) {
+		t.Helper()
+		if err := f.Put(ctx, key, strings.NewReader(body), ObjectMeta{ContentLength: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:c0","size":2},` +
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:a1","size":5}]}`
+	put(TagKey("ghcr.io/org/app", "v1"), image)
+	put(ManifestKey("quay.io/org/app", "sha256:m1"), image)
+	put(BlobKey("sha256:c0"), "{}")
+	put(BlobKey("sha256:a1"), "layer")
+	put(ChunkKey("sha256:a1", 4), "r")
+	put(BlobKey("sha256:orphan"), "gone")
+
+	res, err := MigrateKeys(ctx, f, KeySchemaRegistry, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 6 || res.Deleted != 3 || res.Unreferenced != 1 {
+		t.Errorf("to registry: %+v", res)
+	}
+	for _, registry := range []string{"ghcr.io", "quay.io"} {
+		for _, key := range []string{KeySchemaRegistry.BlobKey(registry, "sha256:a1"), KeySchemaRegistry.ChunkKey(registry, "sha256:a1", 4)} {
+			if _, err := f.Head(ctx, key); err != nil {
+				t.Errorf("%s not migrated: %v", key, err)
+			}
+			if k, ok := ParseKey(key); !ok || k.Registry != registry || k.Digest != "sha256:a1" {
+				t.Errorf("ParseKey(%s) = %+v, %v", key, k, ok)
+			}
+		}
+	}
+	for _, key := range []string{BlobKey("sha256:a1"), ChunkKey("sha256:a1", 4)} {
+		if _, err := f.Head(ctx, key); err == nil {
+			t.Errorf("%s kept despite delete", key)
+		}
+	}
+	if _, err := f.Head(ctx, BlobKey("sha256:orphan")); err != nil {
+		t.Error("unreferenced blob was removed")
+	}
+
+	res, err = MigrateKeys(ctx, f, KeySchemaGlobal, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 3 || res.Present != 3 || res.Deleted != 0 {
+		t.Errorf("to global: %+v", res)
+	}
+	for _, key := range []string{BlobKey("sha256:a1"), BlobKey("sha256:c0"), ChunkKey("sha256:a1", 4), KeySchemaRegistry.BlobKey("ghcr.io", "sha256:a1")} {
+		if _, err := f.Head(ctx, key); err != nil {
+			t.Errorf("%s missing after migrating back: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// maxSniffSize bounds how much of a manifest is read to recover its
+// metadata; larger data objects under manifests/ are not manifests.
+const maxSniffSize = 4 << 20
+
+// needsManifestBody reports whether recovering key's metadata needs its
+// content: manifests whose digest or media type the store didn't keep.
+func needsManifestBody(key, contentType, digest string) bool {
+	return strings.HasPrefix(key, "manifests/") && (digest == "" || genericContentType(contentType))
+}
+
+// genericContentType reports whether ct says nothing about a manifest.
+func genericContentType(ct string) bool {
+	switch ct {
+	case "", "application/octet-stream", "binary/octet-stream", "application/json", "text/plain":
+		return true
+	}
+	return false
+}
+
+// recoverMeta rebuilds metadata for a data object whose sidecar is lost
+// (expired separately, or never written): Content-Length from its size,
+// the digest from the store's attributes, the key, or (for manifests) the
+// content, and a manifest's media type sniffed from the content when the
+// stored one is generic. body is the object's content, for manifests only.
+func recoverMeta(key string, size int64, contentType, digest string, body []byte) ObjectMeta {
+	if digest == "" && !strings.Contains(key, "/tags/") {
+		if d := NormalizeDigest(path.Base(key)); strings.Contains(d, ":") {
+			digest = d
+		}
+	}
+	if body != nil {
+		if digest == "" {
+			sum := sha256.Sum256(body)
+			digest = "sha256:" + hex.EncodeToString(sum[:])
+		}
+		if genericContentType(contentType) {
+			if mt := SniffManifestType(body); mt != "" {
+				contentType = mt
+			}
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h := make(http.Header)
+	h.Set("Content-Type", contentType)
+	if digest != "" {
+		h.Set("Docker-Content-Digest", digest)
+	}
+	h.Set("Content-Length", strconv.FormatInt(size, 10))
+	return ObjectMeta{
+		ContentType:         contentType,
+		DockerContentDigest: digest,
+		ContentLength:       size,
+		Header:              h,
+	}
+}
+
+// SniffManifestType infers a manifest's media type from its content, or
+// returns "" if it doesn't look like one.
+func SniffManifestType(body []byte) string {
+	var doc struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Manifests     json.RawMessage `json:"manifests"`
+		Signatures    json.RawMessage `json:"signatures"`
+		Config        *struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+	}
+	if json.Unmarshal(body, &doc) != nil {
+		return ""
+	}
+	switch {
+	case doc.MediaType != "":
+		return doc.MediaType
+	case doc.SchemaVersion == 1 && doc.Signatures != nil:
+		return manifest.MediaTypeSchema1Signed
+	case doc.SchemaVersion == 1:
+		return manifest.MediaTypeSchema1
+	case doc.SchemaVersion != 2:
+		return ""
+	case doc.Manifests != nil:
+		return manifest.MediaTypeOCIIndex
+	case doc.Config != nil && doc.Config.MediaType == "application/vnd.docker.container.image.v1+json":
+		return manifest.MediaTypeDockerManifest
+	case doc.Config != nil:
+		return manifest.MediaTypeOCIManifest
+	}
+	return ""
+}
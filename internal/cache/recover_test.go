@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFSRecoversMissingSidecar(t *testing.T) {
+	store := NewFSStore(t.TempDir(), 0)
+	ctx := context.Background()
+
+	manifest := `{"schemaVersion":2,"config":{"mediaType":"application/vnd.docker.container.image.v1+json"},"layers":[]}`
+	sum := sha256.Sum256([]byte(manifest))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	objects := map[string]string{
+		"blobs/sha256-aa":                    "layer bytes",
+		"manifests/library/alpine/tags/3.20": manifest,
+	}
+	for key, body := range objects {
+		if err := store.Put(ctx, key, strings.NewReader(body), ObjectMeta{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(store.metaPath(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := store.GetWithMeta(ctx, "blobs/sha256-aa")
+	if err != nil {
+		t.Fatalf("blob without sidecar should be served: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "layer bytes" {
+		t.Fatalf("body = %q", body)
+	}
+	if res.Meta.DockerContentDigest != "sha256:aa" || res.Meta.ContentLength != 11 || res.Meta.ContentType != "application/octet-stream" {
+		t.Fatalf("recovered blob meta = %+v", res.Meta)
+	}
+
+	meta, err := store.Head(ctx, "manifests/library/alpine/tags/3.20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.DockerContentDigest != digest || meta.ContentType != "application/vnd.docker.distribution.manifest.v2+json" {
+		t.Fatalf("recovered tag meta = %+v", meta)
+	}
+	if _, err := os.Stat(store.metaPath("manifests/library/alpine/tags/3.20")); err != nil {
+		t.Fatalf("recovered sidecar not written back: %v", err)
+	}
+
+	// A corrupt sidecar is replaced the same way.
+	if err := os.WriteFile(store.metaPath("blobs/sha256-aa"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := store.Head(ctx, "blobs/sha256-aa"); err != nil || meta.DockerContentDigest != "sha256:aa" {
+		t.Fatalf("corrupt sidecar: %+v / %v", meta, err)
+	}
+
+	if _, err := store.Head(ctx, "blobs/sha256-bb"); !os.IsNotExist(err) {
+		t.Fatalf("missing object should still be a miss, got %v", err)
+	}
+}
+
+func TestSniffManifestType(t *testing.T) {
+	cases := map[string]string{
+		`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`: "application/vnd.oci.image.index.v1+json",
+		`{"schemaVersion":2,"manifests":[]}`:                                                          "application/vnd.oci.image.index.v1+json",
+		`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json"}}`:       "application/vnd.oci.image.manifest.v1+json",
+		`{"schemaVersion":2,"config":{"mediaType":"application/vnd.docker.container.image.v1+json"}}`: "application/vnd.docker.distribution.manifest.v2+json",
+		`{"schemaVersion":1,"fsLayers":[],"signatures":[]}`:                                           "application/vnd.docker.distribution.manifest.v1+prettyjws",
+		`{"schemaVersion":1,"fsLayers":[]}`:                                                           "application/vnd.docker.distribution.manifest.v1+json",
+		`{"hello":"world"}`:                                                                           "",
+		`not json`:                                                                                    "",
+	}
+	for body, want := range cases {
+		if got := SniffManifestType([]byte(body)); got != want {
+			t.Errorf("SniffManifestType(%s) = %q, want %q", body, got, want)
+		}
+	}
+}
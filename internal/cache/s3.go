@@ -1,19 +1,19 @@
 package cache
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
-	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go/middleware"
@@ -27,6 +27,8 @@ type S3Store struct {
 	bucket        string
 	prefix        string
 	lifecycleDays int
+	skew          *clockSkew
+	limiter       *requestLimiter
 }
 
 // NewS3Store creates a new S3 cache store.
@@ -39,10 +41,13 @@ func NewS3Store(ctx context.Context, bucket, prefix string, forcePathStyle bool,
 		return nil, fmt.Errorf("loading AWS config: %w", err)
 	}
 
+	skew := new(clockSkew)
+	limiter := new(requestLimiter)
 	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.UsePathStyle = forcePathStyle
 		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
 		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		o.APIOptions = append(o.APIOptions, skew.middleware, limiter.middleware)
 	})
 
 	// Normalize prefix: ensure it ends with "/" if non-empty, so keys
@@ -52,11 +57,15 @@ func NewS3Store(ctx context.Context, bucket, prefix string, forcePathStyle bool,
 	}
 
 	return &S3Store{
-		client:        client,
-		presignClient: s3.NewPresignClient(client),
+		client: client,
+		presignClient: s3.NewPresignClient(client, func(o *s3.PresignOptions) {
+			o.Presigner = newSkewedPresigner(skew)
+		}),
 		bucket:        bucket,
 		prefix:        prefix,
 		lifecycleDays: lifecycleDays,
+		skew:          skew,
+		limiter:       limiter,
 	}, nil
 }
 
@@ -111,30 +120,12 @@ func (s *S3Store) fullKey(key string) string {
 
 // metaKey returns the S3 key for the metadata sidecar object.
 func (s *S3Store) metaKey(key string) string {
-	return s.fullKey(key) + ".meta.json"
+	return s.fullKey(key) + metaSuffix
 }
 
 // Head checks if an object exists and returns its metadata from the sidecar.
 func (s *S3Store) Head(ctx context.Context, key string) (ObjectMeta, error) {
-	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s.metaKey(key)),
-	})
-	if err != nil {
-		return ObjectMeta{}, err
-	}
-	defer out.Body.Close()
-
-	data, err := io.ReadAll(out.Body)
-	if err != nil {
-		return ObjectMeta{}, fmt.Errorf("reading meta sidecar: %w", err)
-	}
-
-	meta, err := UnmarshalMeta(data)
-	if err != nil {
-		return ObjectMeta{}, fmt.Errorf("parsing meta sidecar: %w", err)
-	}
-	return meta, nil
+	return s.readSidecar(ctx, key)
 }
 
 // RedirectURL returns a presigned S3 URL for the data object along with its
@@ -149,7 +140,7 @@ func (s *S3Store) RedirectURL(ctx context.Context, key string) (string, ObjectMe
 	presigned, err := s.presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(s.fullKey(key)),
-	}, s3.WithPresignExpires(15*time.Minute))
+	}, s3.WithPresignExpires(s.presignExpires()))
 	if err != nil {
 		return "", ObjectMeta{}, fmt.Errorf("presigning GetObject: %w", err)
 	}
@@ -158,27 +149,14 @@ func (s *S3Store) RedirectURL(ctx context.Context, key string) (string, ObjectMe
 }
 
 // GetWithMeta retrieves an object's body and metadata.
-// It reads the sidecar .meta.json first, then opens the data object.
+// It reads the sidecar .meta.json first, then opens the data object. The
+// body is an io.ReadSeeker (see s3Object), so ranged requests for S3 hits
+// are answered by http.ServeContent.
 func (s *S3Store) GetWithMeta(ctx context.Context, key string) (*GetResult, error) {
-	// Read metadata sidecar
-	metaOut, err := s.client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s.metaKey(key)),
-	})
+	meta, err := s.readSidecar(ctx, key)
 	if err != nil {
 		return nil, err
 	}
-	defer metaOut.Body.Close()
-
-	data, err := io.ReadAll(metaOut.Body)
-	if err != nil {
-		return nil, fmt.Errorf("reading meta sidecar: %w", err)
-	}
-
-	meta, err := UnmarshalMeta(data)
-	if err != nil {
-		return nil, fmt.Errorf("parsing meta sidecar: %w", err)
-	}
 
 	// Read data object
 	dataOut, err := s.client.GetObject(ctx, &s3.GetObjectInput{
@@ -189,13 +167,22 @@ func (s *S3Store) GetWithMeta(ctx context.Context, key string) (*GetResult, erro
 		return nil, err
 	}
 
-	return &GetResult{Body: dataOut.Body, Meta: meta}, nil
+	body := &s3Object{
+		ctx:  ctx,
+		s:    s,
+		key:  key,
+		size: aws.ToInt64(dataOut.ContentLength),
+		etag: aws.ToString(dataOut.ETag),
+		body: dataOut.Body,
+	}
+	return &GetResult{Body: body, Meta: meta}, nil
 }
 
-// Put writes an object and its metadata sidecar to S3.
-// Race conditions are benign: blobs are content-addressed (identical content)
-// and manifest overwrites are harmless. The proxy handler already does a HEAD
-// check before fetching from upstream, so duplicate writes are unlikely.
+// Put writes an object and its metadata sidecar to S3. Both PUTs are
+// conditional, so of concurrent writers the first to store the data also
+// describes it: a loser never writes its sidecar over the winner's data.
+// The digest is also kept as an attribute of the data object, from which
+// a missing sidecar can be regenerated.
 func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, meta ObjectMeta) error {
 	// Write data object with conditional PUT — if the key already exists
 	// another writer won the race; since blobs are content-addressed the
@@ -213,6 +200,9 @@ func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, meta Obje
 	if meta.ContentType != "" {
 		input.ContentType = aws.String(meta.ContentType)
 	}
+	if meta.DockerContentDigest != "" {
+		input.Metadata = map[string]string{digestAttr: meta.DockerContentDigest}
+	}
 
 	_, err := s.client.PutObject(ctx, input,
 		s3.WithAPIOptions(func(stack *middleware.Stack) error {
@@ -225,28 +215,156 @@ func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, meta Obje
 	if err != nil {
 		if isConditionalPutConflict(err) {
 			slog.Debug("object already cached, skipping duplicate upload", "key", key)
+			// The winner may have died before writing its sidecar; make
+			// sure one exists, derived from the winner's data.
+			if _, err := s.repairSidecar(ctx, key, "", nil); err != nil {
+				slog.Warn("failed to check meta sidecar after duplicate upload", "key", key, "error", err)
+			}
 			return nil
 		}
 		return fmt.Errorf("putting data to S3: %w", err)
 	}
 
-	// Write metadata sidecar
-	metaJSON, err := MarshalMeta(meta)
-	if err != nil {
-		return fmt.Errorf("marshalling metadata: %w", err)
+	_, err = s.putSidecar(ctx, key, meta, "")
+	return err
+}
+
+// Delete removes the sidecar and then the data object for key. S3 deletes
+// are idempotent, so missing keys succeed.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if _, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.metaKey(key)),
+	}); err != nil {
+		return fmt.Errorf("deleting meta sidecar: %w", err)
+	}
+	if _, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fullKey(key)),
+	}); err != nil {
+		return fmt.Errorf("deleting data: %w", err)
 	}
+	return nil
+}
 
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(s.bucket),
-		Key:         aws.String(s.metaKey(key)),
-		Body:        bytes.NewReader(metaJSON),
-		ContentType: aws.String("application/json"),
-	})
-	if err != nil {
-		return fmt.Errorf("putting meta sidecar to S3: %w", err)
+// List pages through ListObjectsV2 under the configured prefix and yields
+// data objects whose keys start with prefix. S3 returns keys in UTF-8 binary
+// order, so startAfter maps directly onto the StartAfter parameter.
+func (s *S3Store) List(ctx context.Context, prefix, startAfter string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(s.fullKey(prefix)),
+		}
+		if startAfter != "" {
+			input.StartAfter = aws.String(s.fullKey(startAfter))
+		}
+
+		paginator := s3.NewListObjectsV2Paginator(s.client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(ObjectInfo{}, fmt.Errorf("listing objects: %w", err))
+				return
+			}
+			for _, obj := range page.Contents {
+				key := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)
+				if strings.HasSuffix(key, metaSuffix) {
+					continue
+				}
+				info := ObjectInfo{Key: key, Size: aws.ToInt64(obj.Size)}
+				if obj.LastModified != nil {
+					info.LastModified = *obj.LastModified
+				}
+				if !yield(info, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Stat reports which keys are cached using ListObjectsV2 rather than a HEAD
+// per key. Keys are sorted and each listing starts just before the next
+// unresolved key, so runs of neighbouring keys (a repository's manifests,
+// a dense range of blobs) are answered by a single page, while sparse keys
+// cost one small listing each. A data object and its sidecar sort
+// adjacently, so both are usually seen on the same page.
+func (s *S3Store) Stat(ctx context.Context, keys []string) (map[string]ObjectInfo, error) {
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+	if len(sorted) > 0 && sorted[0] == "" {
+		sorted = sorted[1:]
 	}
 
-	return nil
+	seen := make(map[string]ObjectInfo)
+	var after string // continuation point while the current key is unresolved
+	for i := 0; i < len(sorted); {
+		key := sorted[i]
+		dir := keyDir(key)
+
+		// A strict prefix of key sorts immediately before it.
+		startAfter := max(key[:len(key)-1], after)
+		page, err := s.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:     aws.String(s.bucket),
+			Prefix:     aws.String(s.fullKey(dir)),
+			StartAfter: aws.String(s.fullKey(startAfter)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing objects: %w", err)
+		}
+
+		var last string
+		for _, obj := range page.Contents {
+			k := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)
+			info := ObjectInfo{Key: k, Size: aws.ToInt64(obj.Size)}
+			if obj.LastModified != nil {
+				info.LastModified = *obj.LastModified
+			}
+			seen[k] = info
+			last = k
+		}
+
+		// A key is resolved once the page reaches past its sidecar, or when
+		// the listing of its directory is exhausted. Keys sharing a
+		// directory are contiguous in sorted order.
+		exhausted := !aws.ToBool(page.IsTruncated)
+		resolved := false
+		for i < len(sorted) && (sorted[i]+metaSuffix <= last || (exhausted && keyDir(sorted[i]) == dir)) {
+			i++
+			resolved = true
+		}
+		switch {
+		case resolved:
+			after = ""
+		case last == "":
+			i++ // defensive: a truncated but empty page can't make progress
+		default:
+			after = last
+		}
+	}
+
+	out := make(map[string]ObjectInfo)
+	for _, key := range sorted {
+		info, ok := seen[key]
+		if !ok {
+			continue
+		}
+		if _, ok := seen[key+metaSuffix]; ok {
+			out[key] = info
+		}
+	}
+	return out, nil
+}
+
+// keyDir returns the directory portion of a key including its trailing
+// slash, or "" for top-level keys.
+func keyDir(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i+1]
+	}
+	return ""
 }
 
 // isConditionalPutConflict returns true when the S3 PutObject error indicates
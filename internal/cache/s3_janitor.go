@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// CleanUp aborts multipart uploads under the prefix started before cutoff,
+// and removes sidecars whose data object is gone and self-test probes.
+// Incomplete uploads are invisible to listings but billed until aborted.
+func (s *S3Store) CleanUp(ctx context.Context, cutoff time.Time, dryRun bool) ([]Debris, error) {
+	debris, err := s.abortUploads(ctx, cutoff, dryRun)
+	if err != nil {
+		return debris, err
+	}
+
+	// A data object sorts before its sidecar, and anything listed between
+	// the two has the data key as a prefix. So the data keys that prefix
+	// the current key are enough to tell whether a sidecar has its data.
+	var parents []string
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return debris, fmt.Errorf("listing objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			key := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)
+			for len(parents) > 0 && !strings.HasPrefix(key, parents[len(parents)-1]) {
+				parents = parents[:len(parents)-1]
+			}
+			var kind string
+			if data, ok := strings.CutSuffix(key, metaSuffix); ok {
+				if !slices.Contains(parents, data) {
+					kind = DebrisSidecar
+				}
+			} else {
+				parents = append(parents, key)
+				if strings.HasPrefix(key, selfTestPrefix) {
+					kind = DebrisSelfTest
+				}
+			}
+			if kind == "" || obj.LastModified == nil || !obj.LastModified.Before(cutoff) {
+				continue
+			}
+			if !dryRun {
+				var err error
+				if kind == DebrisSelfTest {
+					err = s.Delete(ctx, key) // and its sidecar
+				} else {
+					_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: obj.Key})
+				}
+				if err != nil {
+					return debris, fmt.Errorf("deleting %s: %w", key, err)
+				}
+			}
+			debris = append(debris, Debris{Kind: kind, Key: key, Size: aws.ToInt64(obj.Size), Modified: *obj.LastModified})
+		}
+	}
+	return debris, nil
+}
+
+// abortUploads aborts the multipart uploads under the prefix started
+// before cutoff.
+func (s *S3Store) abortUploads(ctx context.Context, cutoff time.Time, dryRun bool) ([]Debris, error) {
+	var debris []Debris
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	}
+	for {
+		page, err := s.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return debris, fmt.Errorf("listing multipart uploads: %w", err)
+		}
+		for _, u := range page.Uploads {
+			if u.Initiated == nil || !u.Initiated.Before(cutoff) {
+				continue
+			}
+			key := strings.TrimPrefix(aws.ToString(u.Key), s.prefix)
+			if !dryRun {
+				_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+					Bucket:   aws.String(s.bucket),
+					Key:      u.Key,
+					UploadId: u.UploadId,
+				})
+				if err != nil && !isNotFound(err) {
+					return debris, fmt.Errorf("aborting multipart upload of %s: %w", key, err)
+				}
+			}
+			debris = append(debris, Debris{Kind: DebrisUpload, Key: key, Modified: *u.Initiated})
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			return debris, nil
+		}
+		input.KeyMarker, input.UploadIdMarker = page.NextKeyMarker, page.NextUploadIdMarker
+	}
+}
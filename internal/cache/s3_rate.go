@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// ErrSaturated is returned for store requests shed by a limit on them,
+// such as the S3 request rate limit queuing them for longer than allowed.
+// It says the proxy held the request back, not that the store failed.
+var ErrSaturated = errors.New("store request limit reached")
+
+var (
+	rateLimited = metrics.NewCounterVec("oci_s3_rate_limited_total",
+		"S3 requests held back by S3_REQUEST_RATE, by outcome (queued, shed).", "outcome")
+	rateWait = metrics.NewHistogramVec("oci_s3_rate_limit_wait_seconds",
+		"Time S3 requests queued for the rate limit.", []float64{.01, .05, .1, .25, .5, 1, 2.5, 5})
+)
+
+type shedKey struct{}
+
+// WithShedding marks ctx's S3 requests as better dropped than queued
+// past the rate limit's maximum wait: they fail with ErrSaturated, so a
+// pull goes to upstream instead. Requests without the mark, such as
+// background scans, wait for their turn however long it takes.
+func WithShedding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, shedKey{}, true)
+}
+
+// Shedding reports whether ctx was marked WithShedding.
+func Shedding(ctx context.Context) bool {
+	shed, _ := ctx.Value(shedKey{}).(bool)
+	return shed
+}
+
+// requestLimiter is a token bucket over the S3 requests a store issues,
+// counting each attempt, retries included, so the proxy can share a small
+// MinIO or SeaweedFS deployment without a pull storm starving its other
+// users. Requests over the rate queue; tokens may go negative, and the
+// deficit is how long the next request waits. The zero value, or a rate
+// of 0, doesn't limit.
+type requestLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // requests per second
+	burst   float64
+	maxWait time.Duration
+	tokens  float64
+	last    time.Time
+}
+
+// LimitRequests caps the S3 requests the store issues at rate per second,
+// allowing bursts of burst. Requests marked WithShedding that would queue
+// for longer than maxWait fail with ErrSaturated. It must be called before
+// the store is used.
+func (s *S3Store) LimitRequests(rate float64, burst int, maxWait time.Duration) {
+	s.limiter.set(rate, burst, maxWait)
+}
+
+func (l *requestLimiter) set(rate float64, burst int, maxWait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	l.rate, l.burst, l.maxWait = rate, float64(burst), maxWait
+	l.tokens, l.last = l.burst, time.Now()
+}
+
+// reserve takes a token at now, returning how long to wait before using
+// it. ok is false, and nothing is taken, if a shedding request would wait
+// longer than maxWait.
+func (l *requestLimiter) reserve(now time.Time, shed bool) (wait time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0, true
+	}
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	if shed && wait > l.maxWait {
+		return wait, false
+	}
+	l.tokens--
+	return wait, true
+}
+
+// refund returns a token taken by a request that gave up waiting.
+func (l *requestLimiter) refund() {
+	l.mu.Lock()
+	l.tokens = min(l.burst, l.tokens+1)
+	l.mu.Unlock()
+}
+
+// wait blocks until a request may be sent.
+func (l *requestLimiter) wait(ctx context.Context) error {
+	wait, ok := l.reserve(time.Now(), Shedding(ctx))
+	if !ok {
+		rateLimited.Inc("shed")
+		return fmt.Errorf("%w: would queue for %s", ErrSaturated, wait.Round(time.Millisecond))
+	}
+	if wait <= 0 {
+		return nil
+	}
+	rateLimited.Inc("queued")
+	rateWait.Observe(wait.Seconds())
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.refund()
+		return ctx.Err()
+	}
+}
+
+// middleware returns an S3 client option that waits for the limiter
+// before every attempt at a request. It sits in the deserialize step,
+// which wraps each send, retries included, and which presigning drops, so
+// presigned redirects, which send nothing, aren't counted.
+func (l *requestLimiter) middleware(stack *middleware.Stack) error {
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("OCIRequestRate",
+		func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+			if err := l.wait(ctx); err != nil {
+				return middleware.DeserializeOutput{}, middleware.Metadata{}, err
+			}
+			return next.HandleDeserialize(ctx, in)
+		}), middleware.After)
+}
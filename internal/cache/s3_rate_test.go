@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiterReserve(t *testing.T) {
+	var l requestLimiter
+	l.set(10, 2, 150*time.Millisecond)
+	now := l.last
+
+	for i, want := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		wait, ok := l.reserve(now, false)
+		if !ok || wait.Round(time.Millisecond) != want {
+			t.Fatalf("request %d: wait %s, %v; want %s", i, wait, ok, want)
+		}
+	}
+	// Two requests are queued ahead: a shedding one would wait 300ms.
+	if wait, ok := l.reserve(now, true); ok || wait.Round(time.Millisecond) != 300*time.Millisecond {
+		t.Fatalf("shedding request: wait %s, %v", wait, ok)
+	}
+	// The bucket refills at the rate, up to the burst.
+	now = now.Add(time.Minute)
+	if wait, ok := l.reserve(now, true); !ok || wait != 0 {
+		t.Fatalf("after refill: wait %s, %v", wait, ok)
+	}
+	if l.tokens != 1 {
+		t.Fatalf("refilled past the burst: %v tokens left", l.tokens)
+	}
+
+	var off requestLimiter
+	if wait, ok := off.reserve(now, true); !ok || wait != 0 {
+		t.Fatal("the zero limiter limits")
+	}
+}
+
+func TestS3RequestRate(t *testing.T) {
+	s, _ := newFakeS3Store(t)
+	ctx := context.Background()
+	if err := s.Put(ctx, "blobs/sha256-aa", strings.NewReader("data"), ObjectMeta{ContentLength: 4}); err != nil {
+		t.Fatal(err)
+	}
+	s.LimitRequests(20, 1, 10*time.Millisecond)
+
+	if _, err := s.Head(WithShedding(ctx), "blobs/sha256-aa"); err != nil {
+		t.Fatal(err)
+	}
+	// The bucket is empty: a pull is shed, a background request queues.
+	if _, err := s.Head(WithShedding(ctx), "blobs/sha256-aa"); !errors.Is(err, ErrSaturated) {
+		t.Fatalf("shedding request: got %v, want ErrSaturated", err)
+	}
+	start := time.Now()
+	if _, err := s.Head(ctx, "blobs/sha256-aa"); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 30*time.Millisecond {
+		t.Fatalf("background request waited %s, want about 50ms", waited)
+	}
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Object reads a data object as an io.ReadSeeker, so http.ServeContent
+// can answer Range and If-Range requests for S3 hits just as it does for
+// files. It starts with the whole-object response GetWithMeta opened;
+// Seeks only move the offset, and the first Read away from the open
+// response's position replaces it with a ranged GetObject from there to
+// the end. So ServeContent's size probe (seek to the end and back) costs
+// nothing, and a plain read streams the original response.
+type s3Object struct {
+	ctx  context.Context
+	s    *S3Store
+	key  string
+	size int64
+	etag string // pins ranged reads to the object first opened
+
+	off     int64
+	body    io.ReadCloser // open response, or nil
+	bodyOff int64         // body's position in the object
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.body != nil && o.bodyOff != o.off {
+		o.body.Close()
+		o.body = nil
+	}
+	if o.body == nil {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(o.s.bucket),
+			Key:    aws.String(o.s.fullKey(o.key)),
+		}
+		if o.off > 0 {
+			input.Range = aws.String("bytes=" + strconv.FormatInt(o.off, 10) + "-")
+		}
+		if o.etag != "" {
+			input.IfMatch = aws.String(o.etag)
+		}
+		out, err := o.s.client.GetObject(o.ctx, input)
+		if err != nil {
+			return 0, fmt.Errorf("reading %s from offset %d: %w", o.key, o.off, err)
+		}
+		o.body, o.bodyOff = out.Body, o.off
+	}
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	o.bodyOff = o.off
+	if err == io.EOF && o.off < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.off + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, errors.New("s3Object.Seek: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("s3Object.Seek: negative position")
+	}
+	o.off = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3GetWithMetaSeeks(t *testing.T) {
+	s, fake := newFakeS3Store(t)
+	ctx := context.Background()
+	const data = "0123456789ABCDEF"
+	if err := s.Put(ctx, "blobs/sha256-aa", strings.NewReader(data), ObjectMeta{ContentLength: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(rangeHeader string) *httptest.ResponseRecorder {
+		t.Helper()
+		res, err := s.GetWithMeta(ctx, "blobs/sha256-aa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		seeker, ok := res.Body.(io.ReadSeeker)
+		if !ok {
+			t.Fatal("S3 body is not an io.ReadSeeker")
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", "application/octet-stream") // as the proxy replays it
+		http.ServeContent(rec, req, "", time.Time{}, seeker)
+		return rec
+	}
+
+	// A full read streams the response GetWithMeta opened; no second GET.
+	if rec := serve(""); rec.Code != http.StatusOK || rec.Body.String() != data || fake.gets != 1 {
+		t.Fatalf("full read: %d %q after %d GETs", rec.Code, rec.Body.String(), fake.gets)
+	}
+
+	rec := serve("bytes=4-7")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "4567" {
+		t.Fatalf("range read: %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 4-7/16" {
+		t.Fatalf("Content-Range = %q", got)
+	}
+
+	if rec := serve("bytes=20-"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("unsatisfiable range: %d", rec.Code)
+	}
+}
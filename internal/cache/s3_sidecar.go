@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// digestAttr is the S3 user metadata key recording a data object's digest,
+// so its sidecar can be regenerated from the data object alone.
+const digestAttr = "docker-content-digest"
+
+// readSidecar fetches and parses key's sidecar. A missing or corrupt
+// sidecar next to an existing data object (a writer that died between the
+// two PUTs, or a torn write) is regenerated from the data object's
+// attributes rather than turning the object into a permanent miss.
+func (s *S3Store) readSidecar(ctx context.Context, key string) (ObjectMeta, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.metaKey(key)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return s.repairSidecar(ctx, key, "", err)
+		}
+		return ObjectMeta{}, err
+	}
+	defer out.Body.Close()
+
+	data, err := readMetaLimited(out.Body)
+	if err != nil {
+		return ObjectMeta{}, fmt.Errorf("reading meta sidecar: %w", err)
+	}
+	meta, err := UnmarshalMeta(data)
+	if err != nil {
+		slog.Warn("corrupt meta sidecar", "key", key, "error", err)
+		return s.repairSidecar(ctx, key, aws.ToString(out.ETag), fmt.Errorf("parsing meta sidecar: %w", err))
+	}
+	return meta, nil
+}
+
+// repairSidecar regenerates key's sidecar from its data object. etag, if
+// set, is the corrupt sidecar being replaced; otherwise the sidecar is
+// only written if still absent. cause is returned when there is no data
+// object to repair from.
+func (s *S3Store) repairSidecar(ctx context.Context, key, etag string, cause error) (ObjectMeta, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fullKey(key)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return ObjectMeta{}, cause
+		}
+		return ObjectMeta{}, err
+	}
+	contentType, size, digest := aws.ToString(head.ContentType), aws.ToInt64(head.ContentLength), head.Metadata[digestAttr]
+	var body []byte
+	if needsManifestBody(key, contentType, digest) && size <= maxSniffSize {
+		out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.fullKey(key)),
+		})
+		if err != nil {
+			return ObjectMeta{}, err
+		}
+		body, err = io.ReadAll(io.LimitReader(out.Body, maxSniffSize))
+		out.Body.Close()
+		if err != nil {
+			return ObjectMeta{}, fmt.Errorf("reading data to recover metadata: %w", err)
+		}
+	}
+	meta := recoverMeta(key, size, contentType, digest, body)
+
+	written, err := s.putSidecar(ctx, key, meta, etag)
+	switch {
+	case err != nil:
+		slog.Warn("failed to repair meta sidecar", "key", key, "error", err)
+	case written:
+		slog.Info("repaired meta sidecar from data object", "key", key, "digest", meta.DockerContentDigest)
+	}
+	return meta, nil
+}
+
+// putSidecar writes key's sidecar conditionally: over the sidecar with
+// ETag ifMatch, or only if none exists. Losing the race to another writer
+// is not an error, since every sidecar written this way describes the data
+// object that won the data PUT. It reports whether this call wrote it.
+func (s *S3Store) putSidecar(ctx context.Context, key string, meta ObjectMeta, ifMatch string) (bool, error) {
+	metaJSON, err := MarshalMeta(meta)
+	if err != nil {
+		return false, fmt.Errorf("marshalling metadata: %w", err)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.metaKey(key)),
+		Body:        bytes.NewReader(metaJSON),
+		ContentType: aws.String("application/json"),
+	}
+	if ifMatch != "" {
+		input.IfMatch = aws.String(ifMatch)
+	} else {
+		input.IfNoneMatch = aws.String("*")
+	}
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		if isConditionalPutConflict(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("putting meta sidecar to S3: %w", err)
+	}
+	return true, nil
+}
+
+// isNotFound reports whether err is S3's answer for a missing key.
+func isNotFound(err error) bool {
+	var nsk *types.NoSuchKey
+	var nf *types.NotFound
+	if errors.As(err, &nsk) || errors.As(err, &nf) {
+		return true
+	}
+	var re *smithyhttp.ResponseError
+	return errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotFound
+}
@@ -0,0 +1,264 @@
+package cache
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// fakeS3 is an in-memory bucket supporting the conditional PUTs the store
+// relies on.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]fakeUpload // incomplete multipart uploads by ID
+	date    time.Time             // overrides the Date response header when set
+	gets    int                   // GETs of data objects
+	page    int                   // caps ListObjectsV2 pages when set
+	lists   int                   // ListObjectsV2 requests
+}
+
+type fakeObject struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	obj, exists := f.objects[key]
+	etag := func(b []byte) string { sum := md5.Sum(b); return `"` + hex.EncodeToString(sum[:]) + `"` }
+	if !f.date.IsZero() {
+		w.Header().Set("Date", f.date.UTC().Format(http.TimeFormat))
+	}
+	if r.Method == http.MethodGet && strings.Trim(r.URL.Path, "/") == "bucket" {
+		f.list(w, r)
+		return
+	}
+	if id := r.URL.Query().Get("uploadId"); id != "" && r.Method == http.MethodDelete {
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if (r.Header.Get("If-None-Match") == "*" && exists) ||
+			(r.Header.Get("If-Match") != "" && (!exists || r.Header.Get("If-Match") != etag(obj.data))) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		h := make(http.Header)
+		for k, v := range r.Header {
+			if k == "Content-Type" || strings.HasPrefix(k, "X-Amz-Meta-") {
+				h[k] = v
+			}
+		}
+		f.objects[key] = fakeObject{data, h, time.Now()}
+		w.Header().Set("ETag", etag(data))
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			}
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && m != etag(obj.data) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		for k, v := range obj.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", etag(obj.data))
+		data, status := obj.data, http.StatusOK
+		if rng, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			start, _ := strconv.Atoi(strings.TrimSuffix(rng, "-"))
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(len(data)-1)+"/"+strconv.Itoa(len(data)))
+			data, status = data[start:], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			if !strings.HasSuffix(key, metaSuffix) {
+				f.gets++
+			}
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list answers ListMultipartUploads in a single page, and ListObjectsV2
+// after start-after in pages of up to f.page keys.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	prefix := r.URL.Query().Get("prefix")
+	w.Header().Set("Content-Type", "application/xml")
+	if _, ok := r.URL.Query()["uploads"]; ok {
+		res := struct {
+			XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+			IsTruncated bool
+			Upload      []upload
+		}{}
+		for id, u := range f.uploads {
+			if strings.HasPrefix(u.key, prefix) {
+				res.Upload = append(res.Upload, upload{u.key, id, u.initiated.UTC().Format(time.RFC3339)})
+			}
+		}
+		xml.NewEncoder(w).Encode(res)
+		return
+	}
+	res := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		IsTruncated bool
+		Contents    []content
+	}{}
+	f.lists++
+	startAfter := r.URL.Query().Get("start-after")
+	keys := slices.Sorted(maps.Keys(f.objects))
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) || k <= startAfter {
+			continue
+		}
+		if f.page > 0 && len(res.Contents) == f.page {
+			res.IsTruncated = true
+			break
+		}
+		o := f.objects[k]
+		res.Contents = append(res.Contents, content{k, len(o.data), o.modified.UTC().Format(time.RFC3339)})
+	}
+	xml.NewEncoder(w).Encode(res)
+}
+
+func newFakeS3Store(t *testing.T) (*S3Store, *fakeS3) {
+	fake := &fakeS3{objects: make(map[string]fakeObject), uploads: make(map[string]fakeUpload)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	skew := new(clockSkew)
+	limiter := new(requestLimiter)
+	client := s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "secret", ""),
+		UsePathStyle: true,
+		APIOptions:   []func(*middleware.Stack) error{skew.middleware, limiter.middleware},
+	})
+	presign := s3.NewPresignClient(client, func(o *s3.PresignOptions) { o.Presigner = newSkewedPresigner(skew) })
+	return &S3Store{client: client, presignClient: presign, bucket: "bucket", skew: skew, limiter: limiter}, fake
+}
+
+func TestS3SidecarRace(t *testing.T) {
+	s, fake := newFakeS3Store(t)
+	ctx := context.Background()
+	key := TagKey("ghcr.io/org/app", "v1")
+	put := func(body, digest string) error {
+		h := http.Header{"Content-Type": {"application/json"}, "Docker-Content-Digest": {digest}}
+		return s.Put(ctx, key, strings.NewReader(body), ObjectMeta{
+			ContentType: "application/json", DockerContentDigest: digest, ContentLength: int64(len(body)), Header: h,
+		})
+	}
+
+	if err := put("first", "sha256:aaa"); err != nil {
+		t.Fatal(err)
+	}
+	// A second writer with different content for the same tag loses the
+	// data PUT and must not replace the winner's sidecar.
+	if err := put("second", "sha256:bbb"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.GetWithMeta(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "first" || res.Meta.DockerContentDigest != "sha256:aaa" {
+		t.Fatalf("sidecar and data disagree: body %q, digest %q", body, res.Meta.DockerContentDigest)
+	}
+
+	// A writer that died between the two PUTs leaves data without a
+	// sidecar; the next duplicate Put restores it from the data object.
+	delete(fake.objects, key+metaSuffix)
+	if err := put("third", "sha256:ccc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects[key+metaSuffix]; !ok {
+		t.Fatal("duplicate Put should have restored the missing sidecar")
+	}
+	meta, err := s.Head(ctx, key)
+	if err != nil || meta.DockerContentDigest != "sha256:aaa" {
+		t.Fatalf("restored sidecar: %+v, %v", meta, err)
+	}
+}
+
+func TestS3SidecarRepairOnRead(t *testing.T) {
+	s, fake := newFakeS3Store(t)
+	ctx := context.Background()
+	digest := "sha256:" + strings.Repeat("a", 64)
+	key := BlobKey(digest)
+	fake.objects[key] = fakeObject{[]byte("layer"), http.Header{"Content-Type": {"application/octet-stream"}}, time.Now()}
+
+	// Missing sidecar, and no digest attribute: the key supplies it.
+	meta, err := s.Head(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.DockerContentDigest != digest || meta.ContentLength != 5 || meta.ContentType != "application/octet-stream" {
+		t.Fatalf("repaired meta = %+v", meta)
+	}
+	if _, ok := fake.objects[key+metaSuffix]; !ok {
+		t.Fatal("repaired sidecar was not written")
+	}
+
+	// A corrupt sidecar is replaced.
+	fake.objects[key+metaSuffix] = fakeObject{[]byte("{not json"), nil, time.Now()}
+	if meta, err = s.Head(ctx, key); err != nil || meta.DockerContentDigest != digest {
+		t.Fatalf("corrupt sidecar: %+v, %v", meta, err)
+	}
+	if string(fake.objects[key+metaSuffix].data) == "{not json" {
+		t.Fatal("corrupt sidecar was not rewritten")
+	}
+
+	// With neither object it's an ordinary miss.
+	if _, err := s.Head(ctx, BlobKey("sha256:"+strings.Repeat("b", 64))); err == nil || !isNotFound(err) {
+		t.Fatalf("expected not-found error, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// presignExpiry is how long a presigned redirect stays valid, measured on
+// the store's clock.
+const presignExpiry = 15 * time.Minute
+
+// Skew below skewNoise is indistinguishable from the Date header's
+// one-second resolution plus request latency, and is ignored. Skew above
+// skewWarn is logged.
+const (
+	skewNoise = 2 * time.Second
+	skewWarn  = time.Minute
+)
+
+// clockSkew tracks how far the S3 endpoint's clock is ahead of ours, from
+// the Date header of its responses. Edge devices without NTP can drift by
+// hours; presigned URLs are signed on the endpoint's clock to compensate.
+// A nil *clockSkew reports no skew.
+type clockSkew struct {
+	nanos  atomic.Int64
+	warned atomic.Bool
+}
+
+func (c *clockSkew) get() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.nanos.Load())
+}
+
+// observe records the skew implied by a response dated date, logging when
+// it crosses skewWarn in either direction.
+func (c *clockSkew) observe(date time.Time) {
+	skew := time.Until(date).Round(time.Second)
+	if skew.Abs() < skewNoise {
+		skew = 0
+	}
+	c.nanos.Store(int64(skew))
+	switch large := skew.Abs() >= skewWarn; {
+	case large && !c.warned.Swap(true):
+		slog.Warn("clock differs from the S3 endpoint's; presigned URLs are signed on the endpoint's clock to compensate",
+			"skew", skew, "endpoint_time", date.UTC())
+	case !large && c.warned.Swap(false):
+		slog.Info("clock back in sync with the S3 endpoint", "skew", skew)
+	}
+}
+
+// middleware returns an S3 client option recording the Date of every
+// response.
+func (c *clockSkew) middleware(stack *middleware.Stack) error {
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("OCIClockSkew",
+		func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+			out, md, err := next.HandleDeserialize(ctx, in)
+			if resp, ok := out.RawResponse.(*smithyhttp.Response); ok {
+				if date, perr := http.ParseTime(resp.Header.Get("Date")); perr == nil {
+					c.observe(date)
+				}
+			}
+			return out, md, err
+		}), middleware.After)
+}
+
+// skewedPresigner signs at the endpoint's idea of now rather than ours, so
+// a URL is neither expired nor not-yet-valid when it arrives.
+type skewedPresigner struct {
+	next s3.HTTPPresignerV4
+	skew *clockSkew
+}
+
+func newSkewedPresigner(skew *clockSkew) *skewedPresigner {
+	return &skewedPresigner{
+		next: v4.NewSigner(func(o *v4.SignerOptions) {
+			o.DisableURIPathEscaping = true // as the S3 client's default presigner
+		}),
+		skew: skew,
+	}
+}
+
+func (p *skewedPresigner) PresignHTTP(ctx context.Context, creds aws.Credentials, r *http.Request,
+	payloadHash, service, region string, signingTime time.Time, optFns ...func(*v4.SignerOptions),
+) (string, http.Header, error) {
+	return p.next.PresignHTTP(ctx, creds, r, payloadHash, service, region, signingTime.Add(p.skew.get()), optFns...)
+}
+
+// ClockSkew reports how far the S3 endpoint's clock was ahead of the
+// proxy's (negative if behind) at the last response.
+func (s *S3Store) ClockSkew() time.Duration {
+	return s.skew.get()
+}
+
+// presignExpires pads presignExpiry by the measured skew (up to doubling
+// it): a clock that far off may be stepping back into sync between one
+// observation and the next, which would otherwise cut the URL short.
+func (s *S3Store) presignExpires() time.Duration {
+	return presignExpiry + min(s.skew.get().Abs(), presignExpiry)
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3PresignCompensatesClockSkew(t *testing.T) {
+	s, fake := newFakeS3Store(t)
+	ctx := context.Background()
+	if err := s.Put(ctx, "blobs/sha256-aa", strings.NewReader("data"), ObjectMeta{ContentLength: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The endpoint's clock runs an hour ahead of ours.
+	endpointNow := time.Now().Add(time.Hour)
+	fake.mu.Lock()
+	fake.date = endpointNow
+	fake.mu.Unlock()
+
+	u, _, err := s.RedirectURL(ctx, "blobs/sha256-aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skew := s.ClockSkew(); skew < 59*time.Minute || skew > 61*time.Minute {
+		t.Fatalf("ClockSkew = %s, want about 1h", skew)
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := parsed.Query()
+	signed, err := time.Parse("20060102T150405Z", q.Get("X-Amz-Date"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := signed.Sub(endpointNow).Abs(); d > 5*time.Second {
+		t.Fatalf("signed at %s, want the endpoint's time %s", signed, endpointNow.UTC())
+	}
+	if got := q.Get("X-Amz-Expires"); got != "1800" {
+		t.Fatalf("X-Amz-Expires = %s, want 1800 (padded for skew)", got)
+	}
+
+	// Back in sync: no correction, normal validity.
+	fake.mu.Lock()
+	fake.date = time.Time{}
+	fake.mu.Unlock()
+	if u, _, err = s.RedirectURL(ctx, "blobs/sha256-aa"); err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ = url.Parse(u)
+	if s.ClockSkew() != 0 || parsed.Query().Get("X-Amz-Expires") != "900" {
+		t.Fatalf("after resync: skew %s, expires %s", s.ClockSkew(), parsed.Query().Get("X-Amz-Expires"))
+	}
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestS3Stat(t *testing.T) {
+	cached := []string{
+		"blobs/sha256-a",
+		"blobs/sha256-ab", // a key that another extends
+		"blobs/sha256-c",
+		"manifests/ghcr.io/org/app/sha256-m",
+		"manifests/ghcr.io/org/app/tags/v1",
+		"manifests/ghcr.io/org/other/tags/v1",
+	}
+	const noSidecar = "blobs/sha256-b"
+
+	tests := []struct {
+		name  string
+		keys  []string
+		want  []string
+		lists int // ListObjectsV2 requests with unlimited pages, if checked
+	}{
+		{
+			name:  "dense run in one directory",
+			keys:  []string{"blobs/sha256-c", "blobs/sha256-a", "blobs/sha256-ab"},
+			want:  []string{"blobs/sha256-a", "blobs/sha256-ab", "blobs/sha256-c"},
+			lists: 1,
+		},
+		{
+			name: "keys spanning directories",
+			keys: []string{"manifests/ghcr.io/org/other/tags/v1", "blobs/sha256-c",
+				"manifests/ghcr.io/org/app/tags/v1", "manifests/ghcr.io/org/app/sha256-m"},
+			want: []string{"blobs/sha256-c", "manifests/ghcr.io/org/app/sha256-m",
+				"manifests/ghcr.io/org/app/tags/v1", "manifests/ghcr.io/org/other/tags/v1"},
+		},
+		{
+			name: "missing sidecar",
+			keys: []string{noSidecar, "blobs/sha256-c"},
+			want: []string{"blobs/sha256-c"},
+		},
+		{
+			name: "not cached",
+			keys: []string{"blobs/sha256-z", "blobs/sha256", "manifests/ghcr.io/org/gone/tags/v1"},
+		},
+		{
+			name: "duplicates",
+			keys: []string{"blobs/sha256-a", "blobs/sha256-c", "blobs/sha256-a"},
+			want: []string{"blobs/sha256-a", "blobs/sha256-c"},
+		},
+		{
+			name: "empty key",
+			keys: []string{"", "blobs/sha256-a"},
+			want: []string{"blobs/sha256-a"},
+		},
+		{
+			name: "no keys",
+		},
+	}
+
+	// Unlimited pages, and pages so short a key's data and sidecar, or a
+	// directory's keys, are split across them.
+	for _, page := range []int{0, 1, 2, 3} {
+		s, fake := newFakeS3Store(t)
+		fake.page = page
+		for _, key := range cached {
+			fake.objects[key] = fakeObject{data: []byte(key), modified: time.Now()}
+			fake.objects[key+metaSuffix] = fakeObject{data: []byte("{}"), modified: time.Now()}
+		}
+		fake.objects[noSidecar] = fakeObject{data: []byte(noSidecar), modified: time.Now()}
+
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/page %d", tt.name, page), func(t *testing.T) {
+				fake.lists = 0
+				got, err := s.Stat(context.Background(), tt.keys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if keys := slices.Sorted(maps.Keys(got)); !slices.Equal(keys, tt.want) {
+					t.Fatalf("got %q, want %q", keys, tt.want)
+				}
+				for key, info := range got {
+					if info.Key != key || info.Size != int64(len(key)) || info.LastModified.IsZero() {
+						t.Errorf("%s: %+v", key, info)
+					}
+				}
+				if page == 0 && tt.lists > 0 && fake.lists != tt.lists {
+					t.Errorf("%d listings, want %d", fake.lists, tt.lists)
+				}
+			})
+		}
+	}
+}
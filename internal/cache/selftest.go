@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// selfTestPrefix holds probe objects. ParseKey doesn't recognise it, so
+// retention, export and the index ignore any probe left behind.
+const selfTestPrefix = "selftest/"
+
+// maxPresignSkew is how far the store's clock may be from ours before
+// presigned URLs are rejected as expired or not yet valid.
+const maxPresignSkew = 15 * time.Minute
+
+// SelfTest writes, reads back and deletes a probe object, so missing
+// credentials, a read-only bucket policy or an unwritable directory are
+// reported at startup rather than on the first real pull. Stores that
+// implement Redirector also have a presigned URL for the probe fetched,
+// which catches clock skew and endpoints unreachable for presigned access.
+// The error says which step failed.
+func SelfTest(ctx context.Context, s Store) error {
+	var id [8]byte
+	rand.Read(id[:])
+	key := selfTestPrefix + hex.EncodeToString(id[:])
+	payload := []byte("oci-pull-through self-test " + time.Now().UTC().Format(time.RFC3339))
+
+	h := make(http.Header)
+	h.Set("Content-Type", "text/plain")
+	h.Set("Content-Length", strconv.Itoa(len(payload)))
+	meta := ObjectMeta{ContentType: "text/plain", ContentLength: int64(len(payload)), Header: h}
+	if err := s.Put(ctx, key, bytes.NewReader(payload), meta); err != nil {
+		if errors.Is(err, ErrInsufficientSpace) {
+			// Low on space is an operating condition, not misconfiguration;
+			// the store keeps serving what it has.
+			return nil
+		}
+		return fmt.Errorf("writing probe object %s (check write permissions): %w", key, err)
+	}
+	// Clean up whatever happens next; a failed delete is reported only if
+	// everything else passed.
+	deleted := false
+	defer func() {
+		if !deleted {
+			s.Delete(context.WithoutCancel(ctx), key)
+		}
+	}()
+
+	res, err := s.GetWithMeta(ctx, key)
+	if err != nil {
+		return fmt.Errorf("reading probe object %s (check read permissions): %w", key, err)
+	}
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading probe object %s: %w", key, err)
+	}
+	if !bytes.Equal(got, payload) {
+		return fmt.Errorf("probe object %s read back %d bytes that differ from the %d written", key, len(got), len(payload))
+	}
+
+	if r, ok := s.(Redirector); ok {
+		if err := checkPresigned(ctx, r, key, payload); err != nil {
+			return err
+		}
+	}
+
+	deleted = true
+	if err := s.Delete(ctx, key); err != nil {
+		return fmt.Errorf("deleting probe object %s (check delete permissions): %w", key, err)
+	}
+	return nil
+}
+
+// checkPresigned fetches key through a presigned URL, as a redirected
+// client would.
+func checkPresigned(ctx context.Context, r Redirector, key string, payload []byte) error {
+	u, _, err := r.RedirectURL(ctx, key)
+	if err != nil {
+		return fmt.Errorf("presigning probe object %s: %w", key, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("presigned probe URL: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching probe object through a presigned URL (clients sent redirects must reach the store too): %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		if skew := time.Since(date).Round(time.Second); skew > maxPresignSkew || skew < -maxPresignSkew {
+			return fmt.Errorf("clock differs from the store's by %s; check the host's time synchronisation (NTP)", skew)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching probe object through a presigned URL: status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	if !bytes.Equal(body, payload) {
+		return fmt.Errorf("presigned URL for probe object %s returned different content", key)
+	}
+	return nil
+}
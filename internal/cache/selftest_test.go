@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingPutStore rejects every write, like a bucket with a read-only policy.
+type failingPutStore struct{ Store }
+
+func (failingPutStore) Put(context.Context, string, io.Reader, ObjectMeta) error {
+	return errors.New("AccessDenied")
+}
+
+func TestSelfTest(t *testing.T) {
+	ctx := context.Background()
+
+	fsStore := NewFSStore(t.TempDir(), 0)
+	if err := SelfTest(ctx, fsStore); err != nil {
+		t.Fatalf("fs: %v", err)
+	}
+	for info, err := range fsStore.List(ctx, "", "") {
+		t.Fatalf("probe left behind: %v %v", info.Key, err)
+	}
+
+	s3Store, fake := newFakeS3Store(t)
+	if err := SelfTest(ctx, s3Store); err != nil {
+		t.Fatalf("s3: %v", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatalf("probe left behind in bucket: %v", fake.objects)
+	}
+
+	fake.date = time.Now().Add(-time.Hour)
+	if err := SelfTest(ctx, s3Store); err == nil || !strings.Contains(err.Error(), "clock") {
+		t.Fatalf("expected clock skew error, got %v", err)
+	}
+	fake.date = time.Time{}
+
+	if err := SelfTest(ctx, failingPutStore{fsStore}); err == nil || !strings.Contains(err.Error(), "writing probe object") {
+		t.Fatalf("expected write failure, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// SyncOptions select what Sync copies.
+type SyncOptions struct {
+	// Repositories are MatchRepository patterns against "registry/name".
+	// Empty copies every cached object.
+	Repositories []string
+	// Since, if set, skips manifests written before it, and without
+	// Repositories also blobs and chunks.
+	Since time.Time
+	// DryRun reports what would be copied without writing.
+	DryRun bool
+}
+
+// SyncResult summarises a Sync run.
+type SyncResult struct {
+	Copied  int   // objects copied
+	Present int   // objects the destination already had
+	Bytes   int64 // bytes copied
+}
+
+// Sync copies cached content from one store to another under the same
+// keys, e.g. to seed a new region's cache from an existing one. Objects
+// the destination already has are left alone, so an interrupted run can
+// simply be repeated.
+//
+// With Repositories set, the matching repositories' manifests are copied
+// along with every blob and chunk they reference, whichever key schema
+// the source stores them under; blobs are copied regardless of Since, as
+// a recent manifest needs its older layers. Both stores may be serving
+// traffic while this runs.
+func Sync(ctx context.Context, from, to Store, opts SyncOptions) (SyncResult, error) {
+	var res SyncResult
+	seen := make(map[string]bool) // blobs shared by several scopes
+	cp := func(obj ObjectInfo) error {
+		if seen[obj.Key] {
+			return nil
+		}
+		seen[obj.Key] = true
+		copied, err := copyObject(ctx, from, to, obj, obj.Key, opts.DryRun)
+		if err != nil {
+			return err
+		}
+		if copied {
+			res.Copied++
+			res.Bytes += obj.Size
+		} else {
+			res.Present++
+		}
+		return nil
+	}
+
+	whole := len(opts.Repositories) == 0
+	prefixes := []string{"manifests/", privatePrefix}
+	if whole {
+		prefixes = []string{"blobs/", "chunks/", "manifests/", privatePrefix}
+	}
+	refs := make(map[string][]blobScope) // by digest
+	for _, prefix := range prefixes {
+		for obj, err := range from.List(ctx, prefix, "") {
+			if err != nil {
+				return res, err
+			}
+			k, ok := ParseKey(obj.Key)
+			if !ok || obj.LastModified.Before(opts.Since) {
+				continue
+			}
+			if !whole {
+				if (k.Kind != "manifest" && k.Kind != "tag") || !MatchRepository(opts.Repositories, k.Repository) {
+					continue
+				}
+				if err := manifestBlobs(ctx, from, obj.Key, k, refs); err != nil {
+					return res, err
+				}
+			}
+			if err := cp(obj); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	for digest, scopes := range refs {
+		for _, s := range scopes {
+			objs, err := blobObjects(ctx, from, digest, s)
+			if err != nil {
+				return res, err
+			}
+			for _, obj := range objs {
+				if err := cp(obj); err != nil {
+					return res, err
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// manifestBlobs adds the blobs the manifest at key references to refs.
+func manifestBlobs(ctx context.Context, store Store, key string, k KeyInfo, refs map[string][]blobScope) error {
+	res, err := store.GetWithMeta(ctx, key)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil // removed since it was listed
+		}
+		return err
+	}
+	m, err := manifest.Decode(res.Body, manifest.DefaultMaxSize)
+	res.Body.Close()
+	if err != nil {
+		slog.Debug("skipping undecodable manifest", "key", key, "error", err)
+		return nil
+	}
+	registry, _, _ := strings.Cut(k.Repository, "/")
+	scope := blobScope{principal: k.Principal, registry: registry}
+	for _, d := range m.Blobs() {
+		if !containsScope(refs[d.Digest], scope) {
+			refs[d.Digest] = append(refs[d.Digest], scope)
+		}
+	}
+	return nil
+}
+
+// blobObjects finds the source's copies of a blob for scope, and their
+// chunks, under either key schema.
+func blobObjects(ctx context.Context, store Store, digest string, s blobScope) ([]ObjectInfo, error) {
+	scoped := func(key string) string {
+		if s.principal != "" {
+			return PrivateKey(s.principal, key)
+		}
+		return key
+	}
+	var out []ObjectInfo
+	for _, schema := range []KeySchema{KeySchemaGlobal, KeySchemaRegistry} {
+		key := scoped(schema.BlobKey(s.registry, digest))
+		found, err := store.Stat(ctx, []string{key})
+		if err != nil {
+			return nil, err
+		}
+		if obj, ok := found[key]; ok {
+			out = append(out, obj)
+		}
+		chunks := scoped(path.Dir(schema.ChunkKey(s.registry, digest, 0)) + "/")
+		for obj, err := range store.List(ctx, chunks, "") {
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, obj)
+		}
+	}
+	return out, nil
+}
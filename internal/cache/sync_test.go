@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	from := NewFSStore(t.TempDir(), 0)
+	put := func(s Store, key, body string) {
+		t.Helper()
+		if err := s.Put(ctx, key, strings.NewReader(body), ObjectMeta{ContentLength: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:c0","size":2},` +
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:a1","size":5}]}`
+	put(from, TagKey("ghcr.io/org/app", "v1"), image)
+	put(from, TagKey("quay.io/other/app", "v1"), image)
+	put(from, BlobKey("sha256:c0"), "{}")
+	put(from, KeySchemaRegistry.BlobKey("ghcr.io", "sha256:a1"), "layer")
+	put(from, KeySchemaRegistry.ChunkKey("ghcr.io", "sha256:a1", 4), "r")
+	put(from, BlobKey("sha256:unrelated"), "x")
+
+	to := NewFSStore(t.TempDir(), 0)
+	put(to, BlobKey("sha256:c0"), "{}")
+	res, err := Sync(ctx, from, to, SyncOptions{Repositories: []string{"ghcr.io/org/*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 3 || res.Present != 1 {
+		t.Errorf("repository sync: %+v", res)
+	}
+	for key, want := range map[string]bool{
+		TagKey("ghcr.io/org/app", "v1"):                       true,
+		KeySchemaRegistry.BlobKey("ghcr.io", "sha256:a1"):     true,
+		KeySchemaRegistry.ChunkKey("ghcr.io", "sha256:a1", 4): true,
+		TagKey("quay.io/other/app", "v1"):                     false,
+		BlobKey("sha256:unrelated"):                           false,
+	} {
+		if _, err := to.Head(ctx, key); (err == nil) != want {
+			t.Errorf("%s copied = %v, want %v", key, err == nil, want)
+		}
+	}
+
+	res, err = Sync(ctx, from, to, SyncOptions{Since: time.Now().Add(time.Hour)})
+	if err != nil || res.Copied != 0 || res.Present != 0 {
+		t.Errorf("sync of nothing newer: %+v, %v", res, err)
+	}
+	res, err = Sync(ctx, from, to, SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 2 || res.Present != 4 {
+		t.Errorf("full sync: %+v", res)
+	}
+}
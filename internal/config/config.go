@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // AWS SDK environment variables (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
@@ -13,20 +14,157 @@ import (
 
 type Config struct {
 	UpstreamRegistry      string
+	UpstreamNamespaces    map[string][]string
+	DigestPinned          []string
+	UpstreamHosts         map[string]string
+	UpstreamPaths         map[string]string
+	ContainerdMirrors     map[string]string
+	HarborProjects        map[string]string
+	Middleware            []string
+	UpstreamMaxRedirects  int
+	UpstreamCDNRewrites   map[string]string
+	UpstreamQuirks        map[string]string
+	UpstreamRegions       map[string]string
+	TransferPeriod        string
+	TransferSoftCaps      map[string]string
+	TransferHardCaps      map[string]string
+	UpstreamPathPrefixes  map[string]string
+	UpstreamFwdHeaders    []string
+	ArtifactSources       map[string]string
+	ArtifactGitHubToken   string
+	HelmFacade            bool
+	UpstreamUserAgent     string
+	DeploymentName        string
+	UpstreamAuthFile      string
+	DockerHubUsername     string
+	DockerHubToken        string
+	UpstreamRecordFile    string
+	UpstreamRecordMaxBody int
+	UpstreamReplayFile    string
+	UpstreamECRHosts      []string
+	UpstreamSigV4Hosts    []string
+	UpstreamSigV4Region   string
+	UpstreamSigV4Service  string
+	DNSCacheTTL           time.Duration
+	DNSCacheMaxStale      time.Duration
 	StorageBackend        string
+	StorageSelfTest       bool
+	StorageFaults         string
+	StorageKeySchema      string
+	RedirectRetryWindow   time.Duration
+	RedirectRetryCooldown time.Duration
+	V2CheckTTL            time.Duration
+	HealthWindow          time.Duration
+	HealthErrorThreshold  float64
+	HealthMinErrors       int
+	HealthProbeInterval   time.Duration
 	FSRoot                string
+	FSMinFreePercent      float64
+	FSMaxBytes            int64
+	FSMaxAge              time.Duration
+	FSEvictionInterval    time.Duration
 	ListenAddr            string
+	Mode                  string
 	S3Bucket              string
 	S3Prefix              string
 	S3ForcePathStyle      bool
 	CacheTagManifests     bool
 	CacheLatestTag        bool
+	TagManifestTTL        time.Duration
+	TagManifestMaxStale   time.Duration
+	TagStaleIfError       bool
+	PolicyCanaryFile      string
+	Schema1Policy         string
+	MaxManifestSize       int64
+	ShortRequestTimeout   time.Duration
+	ManifestTimeout       time.Duration
+	BlobTimeout           time.Duration
+	MaxBufferedBytes      int64
+	BlobChunkSize         int64
+	PrefetchBudget        int64
+	PrefetchBudgetPeriod  time.Duration
+	PrefetchWindow        time.Duration
+	PrefetchMinSupport    int
+	PrefetchConfidence    float64
+	FlattenPlatforms      []string
 	S3LifecycleDays       int
+	S3MaxBytes            int64
+	S3EvictionInterval    time.Duration
+	S3RequestRate         float64
+	S3RequestBurst        int
+	S3RequestMaxWait      time.Duration
+	UploadTimeout         time.Duration
+	UploadShutdownGrace   time.Duration
+	FinishFillBytes       int64
+	FinishFillTimeout     time.Duration
+	SpoolFillBytes        int64
+	SpoolMemoryBytes      int64
+	SpoolDir              string
+	AdaptiveConcurrency   bool
+	AdaptiveMin           int
+	AdaptiveMax           int
+	AdaptiveTolerance     float64
 	GenerateSelfSignedTLS bool
+	FIPSMode              bool
+	TLSMinVersion         string
+	TLSCipherSuites       []string
+	TLSCurves             []string
+	TLSALPN               []string
+	HSTSMaxAge            time.Duration
+	HSTSSubdomains        bool
 	LogLevel              slog.Level
+	CacheBypassCIDRs      []string
+	CacheIsolatePrivate   bool
+	CacheSharedRepos      []string
+	CacheIsolationKey     string
+	CacheIndex            bool
+	CacheIndexSnapshot    string
+	CacheIndexSnapshotKey string
+	CacheIndexWait        bool
+	Standby               bool
+	StandbyElection       bool
+	StandbyID             string
+	StandbyLeaseTTL       time.Duration
+	StandbyIndexRefresh   time.Duration
+	TagAuditLog           string
+	RetentionRulesFile    string
+	MaintenanceWindows    string
+	RetentionInterval     time.Duration
+	RetentionDryRun       bool
+	JanitorInterval       time.Duration
+	JanitorMinAge         time.Duration
+	UsageScanInterval     time.Duration
+	UsageScanConcurrency  int
+	AdminEnabled          bool
+	AdminListenAddr       string
+	AdminToken            string
+	AdminTLSCert          string
+	AdminTLSKey           string
+	AdminClientCA         string
+	ControlPlaneGRPCAddr  string
+	FleetControllerURL    string
+	FleetToken            string
+	FleetEdgeID           string
+	FleetInterval         time.Duration
+	K8sPrewarmNamespaces  []string
+	K8sPrewarmInterval    time.Duration
 }
 
+// Load reads the configuration from environment variables.
 func Load() Config {
+	return load(os.Getenv)
+}
+
+// load reads the configuration through getenv, which returns "" for
+// unset variables.
+func load(getenv func(string) string) Config {
+	envOr := func(key, fallback string) string {
+		if v := getenv(key); v != "" {
+			return v
+		}
+		return fallback
+	}
+
 	selfSigned := envOr("GENERATE_SELF_SIGNED_TLS", "false") == "true"
 	defaultAddr := ":8080"
 	if selfSigned {
@@ -34,28 +172,240 @@ func Load() Config {
 	}
 
 	lifecycleDays, _ := strconv.Atoi(envOr("S3_LIFECYCLE_DAYS", "28"))
+	minFreePercent, _ := strconv.ParseFloat(envOr("FS_MIN_FREE_PERCENT", "5"), 64)
+	dnsTTL, _ := time.ParseDuration(envOr("DNS_CACHE_TTL", "30s"))
+	hstsMaxAge, _ := time.ParseDuration(envOr("HSTS_MAX_AGE", "0"))
+	dnsMaxStale, _ := time.ParseDuration(envOr("DNS_CACHE_MAX_STALE", "5m"))
+	retentionInterval, _ := time.ParseDuration(envOr("RETENTION_INTERVAL", "1h"))
+	fleetInterval, _ := time.ParseDuration(envOr("FLEET_INTERVAL", "30s"))
+	hostname, _ := os.Hostname()
+	k8sPrewarmInterval, _ := time.ParseDuration(envOr("K8S_PREWARM_INTERVAL", "10m"))
+	tagTTL, _ := time.ParseDuration(envOr("TAG_MANIFEST_TTL", "0"))
+	tagMaxStale, _ := time.ParseDuration(envOr("TAG_MANIFEST_MAX_STALE", "0"))
+	maxRedirects, _ := strconv.Atoi(envOr("UPSTREAM_MAX_REDIRECTS", "5"))
+	recordMaxBody, _ := strconv.Atoi(envOr("UPSTREAM_RECORD_MAX_BODY", "65536"))
+	s3MaxBytes, _ := strconv.ParseInt(getenv("S3_MAX_BYTES"), 10, 64)
+	s3RequestRate, _ := strconv.ParseFloat(envOr("S3_REQUEST_RATE", "0"), 64)
+	s3RequestBurst, _ := strconv.Atoi(envOr("S3_REQUEST_BURST", "0"))
+	s3RequestMaxWait, _ := time.ParseDuration(envOr("S3_REQUEST_MAX_WAIT", "1s"))
+	s3EvictionInterval, _ := time.ParseDuration(envOr("S3_EVICTION_INTERVAL", "5m"))
+	uploadTimeout, _ := time.ParseDuration(envOr("CACHE_UPLOAD_TIMEOUT", "1h"))
+	uploadShutdownGrace, _ := time.ParseDuration(envOr("CACHE_UPLOAD_SHUTDOWN_GRACE", "10s"))
+	finishFillBytes, _ := strconv.ParseInt(getenv("FILL_AFTER_DISCONNECT_MAX_BYTES"), 10, 64)
+	spoolFillBytes, _ := strconv.ParseInt(getenv("FILL_SPOOL_MAX_BYTES"), 10, 64)
+	spoolMemoryBytes, _ := strconv.ParseInt(envOr("FILL_SPOOL_MEMORY_BYTES", "1048576"), 10, 64)
+	finishFillTimeout, _ := time.ParseDuration(envOr("FILL_AFTER_DISCONNECT_TIMEOUT", "5m"))
+	standbyLeaseTTL, _ := time.ParseDuration(envOr("STANDBY_LEASE_TTL", "15s"))
+	standbyIndexRefresh, _ := time.ParseDuration(envOr("STANDBY_INDEX_REFRESH", "1m"))
+	adaptiveMin, _ := strconv.Atoi(envOr("ADAPTIVE_CONCURRENCY_MIN", "4"))
+	adaptiveMax, _ := strconv.Atoi(envOr("ADAPTIVE_CONCURRENCY_MAX", "1000"))
+	adaptiveTolerance, _ := strconv.ParseFloat(envOr("ADAPTIVE_CONCURRENCY_TOLERANCE", "1.5"), 64)
+	fsMaxBytes, _ := strconv.ParseInt(getenv("FS_MAX_BYTES"), 10, 64)
+	fsMaxAge, _ := time.ParseDuration(envOr("FS_MAX_AGE", "0"))
+	fsEvictionInterval, _ := time.ParseDuration(envOr("FS_EVICTION_INTERVAL", "5m"))
+	janitorInterval, _ := time.ParseDuration(envOr("JANITOR_INTERVAL", "1h"))
+	janitorMinAge, _ := time.ParseDuration(envOr("JANITOR_MIN_AGE", "24h"))
+	usageScanInterval, _ := time.ParseDuration(envOr("USAGE_SCAN_INTERVAL", "0"))
+	usageScanConcurrency, _ := strconv.Atoi(envOr("USAGE_SCAN_CONCURRENCY", "2"))
+	maxManifestSize, _ := strconv.ParseInt(envOr("MAX_MANIFEST_SIZE", "4194304"), 10, 64)
+	shortTimeout, _ := time.ParseDuration(envOr("SHORT_REQUEST_TIMEOUT", "10s"))
+	manifestTimeout, _ := time.ParseDuration(envOr("MANIFEST_REQUEST_TIMEOUT", "1m"))
+	blobTimeout, _ := time.ParseDuration(envOr("BLOB_REQUEST_TIMEOUT", "0"))
+	maxBufferedBytes, _ := strconv.ParseInt(getenv("MAX_BUFFERED_BYTES"), 10, 64)
+	blobChunkSize, _ := strconv.ParseInt(getenv("BLOB_CHUNK_SIZE"), 10, 64)
+	prefetchBudget, _ := strconv.ParseInt(getenv("PREFETCH_BUDGET_BYTES"), 10, 64)
+	prefetchBudgetPeriod, _ := time.ParseDuration(envOr("PREFETCH_BUDGET_PERIOD", "1h"))
+	prefetchWindow, _ := time.ParseDuration(envOr("PREFETCH_WINDOW", "2m"))
+	prefetchMinSupport, _ := strconv.Atoi(envOr("PREFETCH_MIN_SUPPORT", "3"))
+	prefetchConfidence, _ := strconv.ParseFloat(envOr("PREFETCH_MIN_CONFIDENCE", "0.5"), 64)
+	redirectRetryWindow, _ := time.ParseDuration(envOr("REDIRECT_FALLBACK_WINDOW", "0"))
+	redirectRetryCooldown, _ := time.ParseDuration(envOr("REDIRECT_FALLBACK_COOLDOWN", "15m"))
+	v2CheckTTL, _ := time.ParseDuration(envOr("V2_CHECK_CACHE_TTL", "1m"))
+	healthWindow, _ := time.ParseDuration(envOr("HEALTH_WINDOW", "1m"))
+	healthErrorThreshold, _ := strconv.ParseFloat(envOr("HEALTH_ERROR_THRESHOLD", "0.5"), 64)
+	healthMinErrors, _ := strconv.Atoi(envOr("HEALTH_MIN_ERRORS", "5"))
+	healthProbeInterval, _ := time.ParseDuration(envOr("HEALTH_PROBE_INTERVAL", "10s"))
 
 	return Config{
-		UpstreamRegistry:      os.Getenv("UPSTREAM_REGISTRY"),
+		UpstreamRegistry:      getenv("UPSTREAM_REGISTRY"),
+		UpstreamNamespaces:    splitScopes(getenv("UPSTREAM_NAMESPACES")),
+		DigestPinned:          splitList(getenv("DIGEST_PINNED_REPOSITORIES")),
+		UpstreamHosts:         splitPairs(getenv("UPSTREAM_HOSTS")),
+		UpstreamPaths:         splitPairs(getenv("UPSTREAM_PATHS")),
+		ContainerdMirrors:     splitPairs(getenv("CONTAINERD_MIRRORS")),
+		HarborProjects:        splitPairs(getenv("HARBOR_PROJECTS")),
+		Middleware:            splitList(getenv("MIDDLEWARE")),
+		UpstreamMaxRedirects:  maxRedirects,
+		UpstreamCDNRewrites:   splitPairs(getenv("UPSTREAM_CDN_REWRITES")),
+		UpstreamQuirks:        splitPairs(getenv("UPSTREAM_QUIRKS")),
+		UpstreamRegions:       splitPairs(getenv("UPSTREAM_PREFERRED_REGIONS")),
+		TransferPeriod:        envOr("UPSTREAM_TRANSFER_PERIOD", "month"),
+		TransferSoftCaps:      splitPairs(getenv("UPSTREAM_TRANSFER_SOFT_CAPS")),
+		TransferHardCaps:      splitPairs(getenv("UPSTREAM_TRANSFER_HARD_CAPS")),
+		UpstreamPathPrefixes:  splitPairs(getenv("UPSTREAM_PATH_PREFIXES")),
+		UpstreamFwdHeaders:    splitList(getenv("UPSTREAM_FORWARD_HEADERS")),
+		ArtifactSources:       splitPairs(getenv("ARTIFACT_SOURCES")),
+		ArtifactGitHubToken:   getenv("ARTIFACT_GITHUB_TOKEN"),
+		HelmFacade:            envOr("HELM_FACADE", "false") == "true",
+		UpstreamUserAgent:     getenv("UPSTREAM_USER_AGENT"),
+		DeploymentName:        getenv("DEPLOYMENT_NAME"),
+		UpstreamAuthFile:      getenv("UPSTREAM_AUTH_FILE"),
+		DockerHubUsername:     getenv("DOCKERHUB_USERNAME"),
+		DockerHubToken:        getenv("DOCKERHUB_TOKEN"),
+		UpstreamRecordFile:    getenv("UPSTREAM_RECORD_FILE"),
+		UpstreamRecordMaxBody: recordMaxBody,
+		UpstreamReplayFile:    getenv("UPSTREAM_REPLAY_FILE"),
+		UpstreamECRHosts:      splitList(getenv("UPSTREAM_ECR_HOSTS")),
+		UpstreamSigV4Hosts:    splitList(getenv("UPSTREAM_SIGV4_HOSTS")),
+		UpstreamSigV4Region:   getenv("UPSTREAM_SIGV4_REGION"),
+		UpstreamSigV4Service:  envOr("UPSTREAM_SIGV4_SERVICE", "s3"),
+		DNSCacheTTL:           dnsTTL,
+		DNSCacheMaxStale:      dnsMaxStale,
 		StorageBackend:        envOr("STORAGE_BACKEND", "s3"),
+		StorageSelfTest:       envOr("STORAGE_SELF_TEST", "true") == "true",
+		StorageFaults:         getenv("STORAGE_FAULTS"),
+		StorageKeySchema:      envOr("STORAGE_KEY_SCHEMA", "global"),
+		RedirectRetryWindow:   redirectRetryWindow,
+		RedirectRetryCooldown: redirectRetryCooldown,
+		V2CheckTTL:            v2CheckTTL,
+		HealthWindow:          healthWindow,
+		HealthErrorThreshold:  healthErrorThreshold,
+		HealthMinErrors:       healthMinErrors,
+		HealthProbeInterval:   healthProbeInterval,
 		FSRoot:                envOr("FS_ROOT", "/data/oci-cache"),
+		FSMinFreePercent:      minFreePercent,
+		FSMaxBytes:            fsMaxBytes,
+		FSMaxAge:              fsMaxAge,
+		FSEvictionInterval:    fsEvictionInterval,
 		ListenAddr:            envOr("LISTEN_ADDR", defaultAddr),
+		Mode:                  envOr("MODE", "all"),
 		S3Bucket:              envOr("S3_BUCKET", "oci-cache"),
-		S3Prefix:              os.Getenv("S3_PREFIX"),
+		S3Prefix:              getenv("S3_PREFIX"),
 		S3ForcePathStyle:      envOr("S3_FORCE_PATH_STYLE", "true") == "true",
 		S3LifecycleDays:       lifecycleDays,
+		S3MaxBytes:            s3MaxBytes,
+		S3EvictionInterval:    s3EvictionInterval,
+		S3RequestRate:         s3RequestRate,
+		S3RequestBurst:        s3RequestBurst,
+		S3RequestMaxWait:      s3RequestMaxWait,
+		UploadTimeout:         uploadTimeout,
+		UploadShutdownGrace:   uploadShutdownGrace,
+		FinishFillBytes:       finishFillBytes,
+		FinishFillTimeout:     finishFillTimeout,
+		SpoolFillBytes:        spoolFillBytes,
+		SpoolMemoryBytes:      spoolMemoryBytes,
+		SpoolDir:              getenv("FILL_SPOOL_DIR"),
+		AdaptiveConcurrency:   envOr("ADAPTIVE_CONCURRENCY", "false") == "true",
+		AdaptiveMin:           adaptiveMin,
+		AdaptiveMax:           adaptiveMax,
+		AdaptiveTolerance:     adaptiveTolerance,
 		CacheTagManifests:     envOr("CACHE_TAG_MANIFESTS", "true") == "true",
 		CacheLatestTag:        envOr("CACHE_LATEST_TAG", "false") == "true",
+		TagManifestTTL:        tagTTL,
+		TagManifestMaxStale:   tagMaxStale,
+		TagStaleIfError:       envOr("TAG_STALE_IF_ERROR", "false") == "true",
+		PolicyCanaryFile:      getenv("POLICY_CANARY_FILE"),
+		Schema1Policy:         strings.ToLower(envOr("SCHEMA1_POLICY", "passthrough")),
+		MaxManifestSize:       maxManifestSize,
+		ShortRequestTimeout:   shortTimeout,
+		ManifestTimeout:       manifestTimeout,
+		BlobTimeout:           blobTimeout,
+		MaxBufferedBytes:      maxBufferedBytes,
+		BlobChunkSize:         blobChunkSize,
+		PrefetchBudget:        prefetchBudget,
+		PrefetchBudgetPeriod:  prefetchBudgetPeriod,
+		PrefetchWindow:        prefetchWindow,
+		PrefetchMinSupport:    prefetchMinSupport,
+		PrefetchConfidence:    prefetchConfidence,
+		FlattenPlatforms:      splitList(getenv("FLATTEN_INDEX_PLATFORMS")),
 		GenerateSelfSignedTLS: selfSigned,
+		FIPSMode:              envOr("FIPS_MODE", "false") == "true",
+		TLSMinVersion:         getenv("TLS_MIN_VERSION"),
+		TLSCipherSuites:       splitList(getenv("TLS_CIPHER_SUITES")),
+		TLSCurves:             splitList(getenv("TLS_CURVES")),
+		TLSALPN:               splitList(getenv("TLS_ALPN")),
+		HSTSMaxAge:            hstsMaxAge,
+		HSTSSubdomains:        envOr("HSTS_INCLUDE_SUBDOMAINS", "false") == "true",
 		LogLevel:              parseLogLevel(envOr("LOG_LEVEL", "info")),
+		CacheBypassCIDRs:      splitList(getenv("CACHE_BYPASS_TRUSTED_CIDRS")),
+		CacheIsolatePrivate:   envOr("CACHE_ISOLATE_PRIVATE", "false") == "true",
+		CacheSharedRepos:      splitList(getenv("CACHE_SHARED_REPOSITORIES")),
+		CacheIsolationKey:     getenv("CACHE_ISOLATION_KEY"),
+		CacheIndex:            envOr("CACHE_INDEX", "false") == "true",
+		CacheIndexSnapshot:    getenv("CACHE_INDEX_SNAPSHOT"),
+		CacheIndexSnapshotKey: getenv("CACHE_INDEX_SNAPSHOT_KEY"),
+		CacheIndexWait:        envOr("CACHE_INDEX_WAIT", "false") == "true",
+		Standby:               envOr("STANDBY", "false") == "true",
+		StandbyElection:       envOr("STANDBY_LEADER_ELECTION", "false") == "true",
+		StandbyID:             envOr("STANDBY_ID", hostname),
+		StandbyLeaseTTL:       standbyLeaseTTL,
+		StandbyIndexRefresh:   standbyIndexRefresh,
+		TagAuditLog:           getenv("TAG_AUDIT_LOG"),
+		RetentionRulesFile:    getenv("RETENTION_RULES_FILE"),
+		MaintenanceWindows:    getenv("MAINTENANCE_WINDOWS_FILE"),
+		RetentionInterval:     retentionInterval,
+		RetentionDryRun:       envOr("RETENTION_DRY_RUN", "false") == "true",
+		JanitorInterval:       janitorInterval,
+		JanitorMinAge:         janitorMinAge,
+		UsageScanInterval:     usageScanInterval,
+		UsageScanConcurrency:  usageScanConcurrency,
+		AdminEnabled:          envOr("ADMIN_ENABLED", "false") == "true",
+		AdminListenAddr:       envOr("ADMIN_LISTEN_ADDR", "127.0.0.1:9090"),
+		AdminToken:            getenv("ADMIN_TOKEN"),
+		AdminTLSCert:          getenv("ADMIN_TLS_CERT"),
+		AdminTLSKey:           getenv("ADMIN_TLS_KEY"),
+		AdminClientCA:         getenv("ADMIN_CLIENT_CA"),
+		ControlPlaneGRPCAddr:  getenv("CONTROL_PLANE_GRPC_ADDR"),
+		FleetControllerURL:    getenv("FLEET_CONTROLLER_URL"),
+		FleetToken:            getenv("FLEET_TOKEN"),
+		FleetEdgeID:           envOr("FLEET_EDGE_ID", hostname),
+		FleetInterval:         fleetInterval,
+		K8sPrewarmNamespaces:  splitList(getenv("K8S_PREWARM_NAMESPACES")),
+		K8sPrewarmInterval:    k8sPrewarmInterval,
+	}
+}
+
+// splitList splits a comma-separated value into trimmed, non-empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// splitPairs parses a comma-separated list of key=value pairs. Keys are
+// lowercased; items without "=" are ignored.
+func splitPairs(s string) map[string]string {
+	out := make(map[string]string)
+	for _, item := range splitList(s) {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		out[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
 	}
+	return out
 }
 
-func envOr(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+// splitScopes parses a comma-separated list of patterns grouped by key,
+// as in "docker.io=library/*,myorg/*,ghcr.io=org/*": an item with "="
+// starts a key's patterns, and items without one continue them. Patterns
+// before the first key are under "". Keys are lowercased.
+func splitScopes(s string) map[string][]string {
+	out := make(map[string][]string)
+	key := ""
+	for _, item := range splitList(s) {
+		if k, v, ok := strings.Cut(item, "="); ok {
+			key, item = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		}
+		if item != "" {
+			out[key] = append(out[key], item)
+		}
 	}
-	return fallback
+	return out
 }
 
 func parseLogLevel(s string) slog.Level {
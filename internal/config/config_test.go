@@ -0,0 +1,18 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitScopes(t *testing.T) {
+	got := splitScopes(" library/* ,myorg/*,Docker.io=library/*, myorg/*,ghcr.io=org/*,quay.io=")
+	want := map[string][]string{
+		"":          {"library/*", "myorg/*"},
+		"docker.io": {"library/*", "myorg/*"},
+		"ghcr.io":   {"org/*"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitScopes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadFile reads the configuration from a YAML or JSON file, with any
+// environment variable that is set, even to "", taking precedence over
+// the file.
+//
+// The file sets the same options as the environment variables. Nested
+// keys are joined with underscores and matched case-insensitively, so
+//
+//	s3:
+//	  bucket: oci-cache
+//
+// sets S3_BUCKET, as does a top-level s3_bucket key. Lists become
+// comma-separated values and mappings under a variable that takes
+// key=value pairs, such as UPSTREAM_HOSTS, become pairs. Keys that name
+// no variable are errors, so typos don't go unnoticed.
+func LoadFile(path string) (Config, error) {
+	values, err := ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	return load(func(key string) string {
+		if v, ok := os.LookupEnv(key); ok {
+			return v
+		}
+		return values[key]
+	}), nil
+}
+
+// ReadFile reads a config file into values by environment variable name.
+// Files ending in .json, or starting with "{", are read as JSON; anything
+// else as YAML.
+func ReadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if strings.EqualFold(filepath.Ext(path), ".json") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if doc == nil {
+		doc = map[string]any{} // an empty file
+	}
+	root, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: the top level must be a mapping", path)
+	}
+	values := make(map[string]string)
+	if err := flatten("", root, Variables(), values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// Variables lists the environment variables the configuration is read
+// from.
+func Variables() []string {
+	seen := make(map[string]bool)
+	load(func(key string) string {
+		seen[key] = true
+		return ""
+	})
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// flatten adds the settings in m, whose keys are under prefix, to out.
+func flatten(prefix string, m map[string]any, known []string, out map[string]string) error {
+	for key, v := range m {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		child, isMap := v.(map[string]any)
+		if isMap && (!slices.Contains(known, name) || extendsKnown(name, child, known)) {
+			if err := flatten(name, child, known, out); err != nil {
+				return err
+			}
+			continue
+		}
+		if !slices.Contains(known, name) {
+			return fmt.Errorf("unknown setting %s", strings.ToLower(name))
+		}
+		if v == nil {
+			continue
+		}
+		value, err := settingValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.ToLower(name), err)
+		}
+		out[name] = value
+	}
+	return nil
+}
+
+// extendsKnown reports whether every key of m continues name towards a
+// variable, as cache: {index: {snapshot: ...}} does CACHE_INDEX towards
+// CACHE_INDEX_SNAPSHOT, rather than being a key=value pair.
+func extendsKnown(name string, m map[string]any, known []string) bool {
+	for key := range m {
+		next := name + "_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if !slices.ContainsFunc(known, func(k string) bool { return k == next || strings.HasPrefix(k, next+"_") }) {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+// settingValue renders v the way the environment variable spells it.
+func settingValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case json.Number:
+		return v.String(), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := settingValue(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list item %q contains a comma", s)
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			switch v[k].(type) {
+			case []any, map[string]any:
+				return "", fmt.Errorf("%s: pair values must be scalars", k)
+			}
+			s, err := settingValue(v[k])
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, k+"="+s)
+		}
+		return strings.Join(pairs, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
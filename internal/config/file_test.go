@@ -0,0 +1,133 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadFileYAML(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+# upstreams
+upstream:
+  registry: https://registry-1.docker.io
+  hosts:
+    ghcr.io: https://ghcr.io
+    quay.io: "https://quay.io"   # quoted
+storage_backend: s3
+s3:
+  bucket: oci-cache
+  request-rate: 50
+cache:
+  index: true
+  index:
+    snapshot-key: 'snap'
+tls:
+  cipher_suites:
+    - TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+    - TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+  alpn: [h2, http/1.1]
+middleware: ~
+`)
+	_, err := ReadFile(path)
+	if err == nil || !strings.Contains(err.Error(), "already defined") {
+		t.Fatalf("duplicate cache.index: err = %v", err)
+	}
+
+	path = writeFile(t, "config.yaml", `
+upstream:
+  registry: https://registry-1.docker.io
+  hosts:
+    ghcr.io: https://ghcr.io
+    quay.io: "https://quay.io"   # quoted
+storage_backend: s3
+s3:
+  bucket: oci-cache
+  request-rate: 50
+cache:
+  index:
+    snapshot-key: 'snap'
+tls:
+  cipher_suites:
+  - TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+  - TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+  alpn: [h2, http/1.1]
+middleware: ~
+`)
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"UPSTREAM_REGISTRY":        "https://registry-1.docker.io",
+		"UPSTREAM_HOSTS":           "ghcr.io=https://ghcr.io,quay.io=https://quay.io",
+		"STORAGE_BACKEND":          "s3",
+		"S3_BUCKET":                "oci-cache",
+		"S3_REQUEST_RATE":          "50",
+		"CACHE_INDEX_SNAPSHOT_KEY": "snap",
+		"TLS_CIPHER_SUITES":        "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"TLS_ALPN":                 "h2,http/1.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadFile = %v\nwant %v", got, want)
+	}
+}
+
+func TestReadFileJSON(t *testing.T) {
+	path := writeFile(t, "config.json", `{"upstream_registry": "https://ghcr.io", "cache": {"index": true}, "s3": {"request_burst": 20}}`)
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"UPSTREAM_REGISTRY": "https://ghcr.io", "CACHE_INDEX": "true", "S3_REQUEST_BURST": "20"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadFile = %v, want %v", got, want)
+	}
+}
+
+func TestReadFileErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown key":    "upstream:\n  registy: https://ghcr.io\n",
+		"bad indent":     "s3:\n    bucket: a\n  region: b\n",
+		"tab":            "s3:\n\tbucket: a\n",
+		"nested pair":    "upstream_hosts:\n  ghcr.io:\n    - a\n",
+		"not a mapping":  "- a\n- b\n",
+		"non-string key": "s3:\n  1: a\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadFile(writeFile(t, "config.yaml", content)); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestLoadFileEnvOverrides(t *testing.T) {
+	path := writeFile(t, "config.yaml", "upstream_registry: https://ghcr.io\ns3:\n  bucket: from-file\n  prefix: mirror/\n")
+	t.Setenv("S3_BUCKET", "from-env")
+	t.Setenv("S3_PREFIX", "")
+	cfg, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UpstreamRegistry != "https://ghcr.io" {
+		t.Errorf("UpstreamRegistry = %q", cfg.UpstreamRegistry)
+	}
+	if cfg.S3Bucket != "from-env" {
+		t.Errorf("S3Bucket = %q, want the environment's", cfg.S3Bucket)
+	}
+	if cfg.S3Prefix != "" {
+		t.Errorf("S3Prefix = %q, want the environment's, even empty", cfg.S3Prefix)
+	}
+}
@@ -0,0 +1,251 @@
+// Package controlplane serves the gRPC control-plane API defined in
+// api/controlplane/v1, for fleet tooling that manages many caches at once.
+// It offers the same operations as the admin HTTP API plus streaming ones
+// (warming, stats, inventory) that don't fit request/response JSON.
+package controlplane
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	controlplanev1 "github.com/danielloader/oci-pull-through/api/controlplane/v1"
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/index"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+	"github.com/danielloader/oci-pull-through/internal/recovery"
+	"github.com/danielloader/oci-pull-through/internal/stream"
+)
+
+// Warmer pulls images through the cache; *proxy.Handler implements it.
+type Warmer interface {
+	Warm(ctx context.Context, image, authorization string, progress func(proxy.WarmEvent)) error
+}
+
+// Server implements controlplanev1.ControlPlaneServer.
+type Server struct {
+	controlplanev1.UnimplementedControlPlaneServer
+
+	Store    cache.Store
+	Warmer   Warmer
+	Inflight *stream.Inflight
+
+	// Index, when set, supplies stats and last-access times.
+	Index *index.Index
+}
+
+// NewGRPCServer returns a gRPC server with srv registered. token, if set,
+// must be presented as a bearer token in the "authorization" metadata;
+// tlsConfig, if set, enables TLS (and client certificate checks, if it
+// requires them).
+func NewGRPCServer(srv *Server, token string, tlsConfig *tls.Config) *grpc.Server {
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	interceptors := []grpc.StreamServerInterceptor{recoverPanics}
+	if token != "" {
+		interceptors = append(interceptors, requireToken(token))
+	}
+	opts = append(opts, grpc.ChainStreamInterceptor(interceptors...))
+	s := grpc.NewServer(opts...)
+	controlplanev1.RegisterControlPlaneServer(s, srv)
+	return s
+}
+
+// recoverPanics answers a panicking call with codes.Internal; gRPC would
+// otherwise let it crash the process.
+func recoverPanics(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := recovery.Do("grpc", func() error { return handler(srv, ss) })
+	if errors.Is(err, recovery.ErrPanic) {
+		return status.Error(codes.Internal, "internal error in "+info.FullMethod)
+	}
+	return err
+}
+
+// requireToken mirrors admin.RequireToken for gRPC metadata.
+func requireToken(token string) grpc.StreamServerInterceptor {
+	want := sha256.Sum256([]byte(token))
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		var got string
+		if v := md.Get("authorization"); len(v) > 0 {
+			got, _ = strings.CutPrefix(v[0], "Bearer ")
+		}
+		sum := sha256.Sum256([]byte(got))
+		if got == "" || subtle.ConstantTimeCompare(sum[:], want[:]) != 1 {
+			return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+		}
+		return handler(srv, ss)
+	}
+}
+
+// Purge deletes the requested keys, or everything under a prefix.
+func (s *Server) Purge(req *controlplanev1.PurgeRequest, out grpc.ServerStreamingServer[controlplanev1.PurgeProgress]) error {
+	ctx := out.Context()
+	if req.Prefix != "" && (!strings.HasSuffix(req.Prefix, "/") ||
+		!(strings.HasPrefix(req.Prefix, "blobs/") || strings.HasPrefix(req.Prefix, "manifests/"))) {
+		return status.Error(codes.InvalidArgument, `prefix must start with "blobs/" or "manifests/" and end in "/"`)
+	}
+
+	purge := func(key string, size int64) error {
+		msg := &controlplanev1.PurgeProgress{Key: key, Size: size}
+		if !req.DryRun {
+			if err := s.Store.Delete(ctx, key); err != nil {
+				msg.Error = err.Error()
+			} else {
+				slog.Info("purged cache object", "key", key, "source", "controlplane")
+			}
+		}
+		return out.Send(msg)
+	}
+
+	for _, key := range req.Keys {
+		meta, err := s.Store.Head(ctx, key)
+		if err != nil {
+			if err := out.Send(&controlplanev1.PurgeProgress{Key: key, Error: err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := purge(key, meta.ContentLength); err != nil {
+			return err
+		}
+	}
+	if req.Prefix != "" {
+		for info, err := range s.Store.List(ctx, req.Prefix, "") {
+			if err != nil {
+				return status.Error(codes.Unavailable, err.Error())
+			}
+			if err := purge(info.Key, info.Size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Warm pulls each image through the cache, streaming per-object progress.
+// A failure on one image is reported and the next is still warmed.
+func (s *Server) Warm(req *controlplanev1.WarmRequest, out grpc.ServerStreamingServer[controlplanev1.WarmProgress]) error {
+	if s.Warmer == nil {
+		return status.Error(codes.Unimplemented, "warming is not available on this instance")
+	}
+	ctx := out.Context()
+	var sendErr error
+	for _, image := range req.Images {
+		reported := false
+		err := s.Warmer.Warm(ctx, image, req.Authorization, func(ev proxy.WarmEvent) {
+			reported = true
+			if sendErr != nil {
+				return
+			}
+			msg := &controlplanev1.WarmProgress{Image: ev.Image, Kind: ev.Kind, Digest: ev.Digest, Status: ev.Status, Size: ev.Size}
+			if ev.Err != nil {
+				msg.Error = ev.Err.Error()
+			}
+			sendErr = out.Send(msg)
+		})
+		if sendErr != nil {
+			return sendErr
+		}
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		if err != nil {
+			slog.Warn("warm failed", "image", image, "error", err)
+			// Errors before the manifest fetch (bad reference, unknown
+			// registry) haven't been reported through progress yet.
+			if !reported {
+				if err := out.Send(&controlplanev1.WarmProgress{Image: image, Kind: "manifest", Status: "failed", Error: err.Error()}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Stats sends a snapshot immediately, then every interval if one was set.
+func (s *Server) Stats(req *controlplanev1.StatsRequest, out grpc.ServerStreamingServer[controlplanev1.StatsSnapshot]) error {
+	if err := out.Send(s.snapshot()); err != nil {
+		return err
+	}
+	if req.IntervalSeconds == 0 {
+		return nil
+	}
+	t := time.NewTicker(time.Duration(req.IntervalSeconds) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-out.Context().Done():
+			return nil
+		case <-t.C:
+			if err := out.Send(s.snapshot()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) snapshot() *controlplanev1.StatsSnapshot {
+	snap := &controlplanev1.StatsSnapshot{
+		TimestampUnix: time.Now().Unix(),
+		Prefixes:      make(map[string]*controlplanev1.PrefixStats),
+	}
+	if s.Index != nil {
+		snap.IndexReady = s.Index.Ready()
+		for prefix, st := range s.Index.Stats() {
+			snap.Prefixes[prefix] = &controlplanev1.PrefixStats{Objects: st.Objects, Bytes: st.Bytes}
+		}
+	}
+	if s.Inflight != nil {
+		for _, f := range s.Inflight.List() {
+			snap.Inflight = append(snap.Inflight, &controlplanev1.Fill{
+				Id:            f.ID,
+				Key:           f.Key,
+				Bytes:         f.Bytes,
+				ExpectedBytes: f.ExpectedBytes,
+				StartedUnix:   f.Started.Unix(),
+			})
+		}
+	}
+	return snap
+}
+
+// Inventory streams cached objects under a prefix, in store listing order.
+func (s *Server) Inventory(req *controlplanev1.InventoryRequest, out grpc.ServerStreamingServer[controlplanev1.InventoryEntry]) error {
+	for info, err := range s.Store.List(out.Context(), req.Prefix, req.StartAfter) {
+		if err != nil {
+			if out.Context().Err() != nil {
+				return status.FromContextError(out.Context().Err()).Err()
+			}
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		entry := &controlplanev1.InventoryEntry{
+			Key:              info.Key,
+			Size:             info.Size,
+			LastModifiedUnix: info.LastModified.Unix(),
+		}
+		if s.Index != nil {
+			if e, ok := s.Index.Get(info.Key); ok && !e.LastAccess.IsZero() {
+				entry.LastAccessUnix = e.LastAccess.Unix()
+			}
+		}
+		if err := out.Send(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	controlplanev1 "github.com/danielloader/oci-pull-through/api/controlplane/v1"
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestPurgeAndInventory(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewFSStore(t.TempDir(), 0)
+	for _, key := range []string{
+		"manifests/ghcr.io/org/app/tags/v1",
+		"manifests/ghcr.io/org/app/tags/v2",
+		"manifests/ghcr.io/org/app-other/tags/v1",
+	} {
+		if err := store.Put(ctx, key, strings.NewReader("{}"), cache.ObjectMeta{ContentLength: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := NewGRPCServer(&Server{Store: store}, "secret", nil)
+	go srv.Serve(lis)
+	defer srv.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := controlplanev1.NewControlPlaneClient(conn)
+
+	inventory := func(ctx context.Context) ([]string, error) {
+		stream, err := client.Inventory(ctx, &controlplanev1.InventoryRequest{Prefix: "manifests/"})
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		for {
+			e, err := stream.Recv()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return keys, nil
+				}
+				return keys, err
+			}
+			keys = append(keys, e.Key)
+		}
+	}
+
+	if _, err := inventory(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated without a token, got %v", err)
+	}
+
+	authed := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	purge, err := client.Purge(authed, &controlplanev1.PurgeRequest{Prefix: "manifests/ghcr.io/org/app/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var purged int
+	for {
+		p, err := purge.Recv()
+		if err != nil {
+			break
+		}
+		if p.Error != "" {
+			t.Errorf("purge %s: %s", p.Key, p.Error)
+		}
+		purged++
+	}
+	if purged != 2 {
+		t.Fatalf("purged %d keys, want 2", purged)
+	}
+
+	keys, err := inventory(authed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "manifests/ghcr.io/org/app-other/tags/v1" {
+		t.Fatalf("remaining keys %v", keys)
+	}
+
+	bad, _ := client.Purge(authed, &controlplanev1.PurgeRequest{Prefix: "manifests/ghcr.io/org/app"})
+	if _, err := bad.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for prefix without trailing slash, got %v", err)
+	}
+}
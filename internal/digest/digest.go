@@ -0,0 +1,194 @@
+// Package digest parses, validates and computes OCI content digests
+// ("algorithm:encoded"). The algorithms the proxy can verify are
+// registered here, sha256 and sha512 by default; content addressed by
+// any other algorithm is rejected, since it could be neither verified on
+// the way into the cache nor trusted on the way out.
+package digest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Canonical is the algorithm content is digested with when nothing says
+// otherwise, e.g. for a manifest upstream served without a digest.
+const Canonical = "sha256"
+
+var (
+	// ErrInvalid is returned for strings that aren't digests at all.
+	ErrInvalid = errors.New("invalid digest")
+	// ErrUnsupported is returned for well-formed digests whose algorithm
+	// isn't registered.
+	ErrUnsupported = errors.New("unsupported digest algorithm")
+	// ErrMismatch is returned when content doesn't hash to its digest.
+	ErrMismatch = errors.New("content does not match digest")
+)
+
+// grammar is the OCI image spec's digest grammar.
+var grammar = regexp.MustCompile(`^[a-z0-9]+([+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+// Algorithm is a registered digest algorithm.
+type Algorithm struct {
+	Name string
+	// Size is the length of the hex-encoded hash.
+	Size int
+	New  func() hash.Hash
+}
+
+var (
+	mu         sync.RWMutex
+	algorithms = map[string]Algorithm{
+		"sha256": {Name: "sha256", Size: 2 * sha256.Size, New: sha256.New},
+		"sha512": {Name: "sha512", Size: 2 * sha512.Size, New: sha512.New},
+	}
+)
+
+// Register makes an algorithm available for parsing and verification. It
+// panics if the name is already registered.
+func Register(a Algorithm) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := algorithms[a.Name]; dup {
+		panic("digest: duplicate algorithm " + a.Name)
+	}
+	algorithms[a.Name] = a
+}
+
+// Lookup returns the registered algorithm called name.
+func Lookup(name string) (Algorithm, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	a, ok := algorithms[name]
+	return a, ok
+}
+
+// Algorithms lists the registered algorithm names.
+func Algorithms() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(algorithms))
+	for n := range algorithms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse splits d into its algorithm and encoded hash, checking the
+// grammar, that the algorithm is registered, and the encoded length and
+// lowercase hex alphabet.
+func Parse(d string) (Algorithm, string, error) {
+	if !grammar.MatchString(d) {
+		return Algorithm{}, "", ErrInvalid
+	}
+	name, encoded, _ := strings.Cut(d, ":")
+	a, ok := Lookup(name)
+	if !ok {
+		return Algorithm{}, "", fmt.Errorf("%w %q", ErrUnsupported, name)
+	}
+	if len(encoded) != a.Size {
+		return Algorithm{}, "", fmt.Errorf("%w: %s wants %d hex characters", ErrInvalid, name, a.Size)
+	}
+	for _, c := range encoded {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return Algorithm{}, "", fmt.Errorf("%w: not lowercase hex", ErrInvalid)
+		}
+	}
+	return a, encoded, nil
+}
+
+// Validate reports whether d is a digest Parse accepts.
+func Validate(d string) error {
+	_, _, err := Parse(d)
+	return err
+}
+
+// Normalize restores the colon of a digest written as "algorithm-hex",
+// as in storage keys and in S3 metadata read back from SeaweedFS, for
+// registered algorithms. Anything else is returned as is.
+func Normalize(s string) string {
+	if strings.Contains(s, ":") {
+		return s
+	}
+	name, encoded, ok := strings.Cut(s, "-")
+	if !ok {
+		return s
+	}
+	if _, ok := Lookup(name); !ok {
+		return s
+	}
+	return name + ":" + encoded
+}
+
+// FromBytes digests data with the Canonical algorithm.
+func FromBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return Canonical + ":" + hex.EncodeToString(sum[:])
+}
+
+// Compute digests data with the algorithm d names. ok is false for
+// algorithms that aren't registered.
+func Compute(d string, data []byte) (string, bool) {
+	name, _, _ := strings.Cut(d, ":")
+	a, ok := Lookup(name)
+	if !ok {
+		return "", false
+	}
+	h := a.New()
+	h.Write(data)
+	return name + ":" + hex.EncodeToString(h.Sum(nil)), true
+}
+
+// Verifier checks streamed content against a digest. Write the content
+// to it, then call Verify.
+type Verifier struct {
+	h    hash.Hash
+	alg  string
+	want string
+}
+
+// NewVerifier returns a Verifier for d, which must parse.
+func NewVerifier(d string) (*Verifier, error) {
+	a, _, err := Parse(d)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{h: a.New(), alg: a.Name, want: d}, nil
+}
+
+// NewDigester returns a Verifier hashing in the algorithm of d, which may
+// be empty or unsupported, in which case Canonical is used. It's for
+// content whose expected digest may be unknown; Verify only succeeds if
+// d parses and matches.
+func NewDigester(d string) *Verifier {
+	name, _, _ := strings.Cut(d, ":")
+	a, ok := Lookup(name)
+	if !ok {
+		a, _ = Lookup(Canonical)
+	}
+	return &Verifier{h: a.New(), alg: a.Name, want: d}
+}
+
+func (v *Verifier) Write(p []byte) (int, error) { return v.h.Write(p) }
+
+// Digest returns the digest of what has been written so far.
+func (v *Verifier) Digest() string {
+	return v.alg + ":" + hex.EncodeToString(v.h.Sum(nil))
+}
+
+// Verify returns an error wrapping ErrMismatch unless what was written
+// hashes to the digest.
+func (v *Verifier) Verify() error {
+	if got := v.Digest(); got != v.want {
+		return fmt.Errorf("%w: got %s, want %s", ErrMismatch, got, v.want)
+	}
+	return nil
+}
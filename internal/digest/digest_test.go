@@ -0,0 +1,55 @@
+package digest
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for d, want := range map[string]error{
+		"sha256:" + strings.Repeat("ab", 32): nil,
+		"sha512:" + strings.Repeat("ab", 64): nil,
+		"sha256:" + strings.Repeat("AB", 32): ErrInvalid,
+		"sha256:abc":                         ErrInvalid,
+		"sha512:" + strings.Repeat("ab", 32): ErrInvalid,
+		"sha256:../../x":                     ErrInvalid,
+		"blake3:" + strings.Repeat("ab", 32): ErrUnsupported,
+		"latest":                             ErrInvalid,
+	} {
+		if err := Validate(d); !errors.Is(err, want) || (want == nil) != (err == nil) {
+			t.Errorf("Validate(%s) = %v, want %v", d, err, want)
+		}
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	sum := sha512.Sum512([]byte("layer"))
+	d := "sha512:" + hex.EncodeToString(sum[:])
+	if got, ok := Compute(d, []byte("layer")); !ok || got != d {
+		t.Fatalf("Compute = %s, %v", got, ok)
+	}
+
+	v, err := NewVerifier(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Write([]byte("lay"))
+	v.Write([]byte("er"))
+	if err := v.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	v.Write([]byte("!"))
+	if err := v.Verify(); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("extra byte: got %v", err)
+	}
+
+	if got := NewDigester("").Digest(); !strings.HasPrefix(got, Canonical+":") {
+		t.Fatalf("digester without a digest should use %s, got %s", Canonical, got)
+	}
+	if got := Normalize("sha512-" + d[7:]); got != d {
+		t.Fatalf("Normalize = %s", got)
+	}
+}
@@ -0,0 +1,199 @@
+// Package dnscache caches upstream hostname lookups in-process, so a busy
+// proxy doesn't send every new connection's lookup to the cluster DNS, and
+// a brief DNS outage doesn't fail pulls whose upstream address was
+// resolved moments ago.
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var (
+	lookups = metrics.NewCounterVec("oci_dns_cache_lookups_total",
+		"Upstream DNS cache lookups by result (hit, miss, stale, error).",
+		"result")
+	querySeconds = metrics.NewHistogramVec("oci_dns_cache_query_seconds",
+		"Latency of DNS queries issued by the upstream DNS cache.",
+		nil)
+)
+
+// Resolver caches successful lookups for TTL. Once an entry is older than
+// TTL the next dial refreshes it; if the refresh fails, the previous answer
+// keeps being used until it is MaxStale old.
+//
+// Go's resolver does not expose record TTLs, so TTL is configured rather
+// than taken from the DNS answer.
+type Resolver struct {
+	TTL      time.Duration
+	MaxStale time.Duration
+
+	// Lookup resolves a hostname; nil uses net.DefaultResolver.
+	Lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// errorRetry is how long a failed refresh is remembered before the next
+// dial tries DNS again, so an outage doesn't turn every dial into a query.
+const errorRetry = 5 * time.Second
+
+// lookupTimeout bounds a refresh. A refresh is shared by every dial
+// waiting on it, so it runs detached from the dial that started it.
+const lookupTimeout = 15 * time.Second
+
+type entry struct {
+	addrs    []netip.Addr
+	resolved time.Time
+	failed   time.Time
+
+	// refreshing is non-nil while a lookup is in progress; waiters block
+	// on it instead of issuing their own.
+	refreshing chan struct{}
+	err        error
+}
+
+// New returns a Resolver with the given bounds.
+func New(ttl, maxStale time.Duration) *Resolver {
+	return &Resolver{TTL: ttl, MaxStale: max(maxStale, ttl)}
+}
+
+// LookupHost returns addresses for host, from cache when fresh.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+
+	r.mu.Lock()
+	if r.entries == nil {
+		r.entries = make(map[string]*entry)
+	}
+	e, ok := r.entries[host]
+	if ok && e.refreshing == nil {
+		if e.err == nil && time.Since(e.resolved) < r.TTL {
+			addrs := e.addrs
+			r.mu.Unlock()
+			lookups.Inc("hit")
+			return addrs, nil
+		}
+		if e.err != nil && time.Since(e.failed) < errorRetry {
+			r.mu.Unlock()
+			return r.result(host, e)
+		}
+	}
+	if !ok {
+		e = &entry{}
+		r.entries[host] = e
+	}
+	wait := e.refreshing
+	if wait == nil {
+		wait = make(chan struct{})
+		e.refreshing = wait
+		go r.refresh(context.WithoutCancel(ctx), host, e)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return r.result(host, e)
+}
+
+// refresh looks host up for e and wakes the dials waiting on it. A
+// lookup that times out isn't remembered as a DNS failure, so the next
+// dial tries again.
+func (r *Resolver) refresh(ctx context.Context, host string, e *entry) {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := r.lookup(ctx, host)
+	querySeconds.Observe(time.Since(start).Seconds())
+	r.mu.Lock()
+	switch {
+	case err == nil:
+		e.addrs, e.resolved = addrs, time.Now()
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		e.failed = time.Time{}
+	default:
+		e.failed = time.Now()
+	}
+	e.err = err
+	close(e.refreshing)
+	e.refreshing = nil
+	r.mu.Unlock()
+
+	if err == nil {
+		lookups.Inc("miss")
+	}
+}
+
+// result returns e's answer after a refresh, falling back to the previous
+// addresses if the refresh failed and they are within MaxStale.
+func (r *Resolver) result(host string, e *entry) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.err == nil {
+		return e.addrs, nil
+	}
+	if len(e.addrs) > 0 && time.Since(e.resolved) < r.MaxStale {
+		lookups.Inc("stale")
+		slog.Warn("DNS refresh failed, using previous answer", "host", host, "age", time.Since(e.resolved).Round(time.Second), "error", e.err)
+		return e.addrs, nil
+	}
+	lookups.Inc("error")
+	return nil, e.err
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if r.Lookup != nil {
+		return r.Lookup(ctx, host)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// DialFunc is the signature of net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Dial wraps dial so hostnames are resolved through the cache. Addresses
+// are tried in order until one connects.
+func (r *Resolver) Dial(dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, ip := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
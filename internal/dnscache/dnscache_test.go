@@ -0,0 +1,118 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestResolverCachesAndServesStale(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	var queries int
+	var fail bool
+	r := New(time.Hour, 2*time.Hour)
+	r.Lookup = func(context.Context, string) ([]netip.Addr, error) {
+		queries++
+		if fail {
+			return nil, errors.New("dns down")
+		}
+		return []netip.Addr{addr}, nil
+	}
+	ctx := context.Background()
+
+	for range 3 {
+		got, err := r.LookupHost(ctx, "registry.test")
+		if err != nil || len(got) != 1 || got[0] != addr {
+			t.Fatalf("got %v, %v", got, err)
+		}
+	}
+	if queries != 1 {
+		t.Fatalf("expected 1 query for fresh entries, got %d", queries)
+	}
+
+	// Expire the entry; the refresh fails but the old answer is still
+	// within MaxStale.
+	r.entries["registry.test"].resolved = time.Now().Add(-90 * time.Minute)
+	fail = true
+	if got, err := r.LookupHost(ctx, "registry.test"); err != nil || got[0] != addr {
+		t.Fatalf("expected stale answer, got %v, %v", got, err)
+	}
+	// Failures are not retried immediately.
+	r.LookupHost(ctx, "registry.test")
+	if queries != 2 {
+		t.Fatalf("expected failed refresh to back off, got %d queries", queries)
+	}
+
+	// Past MaxStale the error surfaces.
+	r.entries["registry.test"].resolved = time.Now().Add(-3 * time.Hour)
+	r.entries["registry.test"].failed = time.Time{}
+	if _, err := r.LookupHost(ctx, "registry.test"); err == nil {
+		t.Fatal("expected error once the entry is past MaxStale")
+	}
+
+	if got, err := r.LookupHost(ctx, "10.0.0.1"); err != nil || got[0] != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("IP literals should bypass the cache, got %v, %v", got, err)
+	}
+}
+
+func TestResolverRefreshOutlivesCancelledDial(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	release := make(chan struct{})
+	var timeout bool
+	r := New(time.Hour, 2*time.Hour)
+	r.Lookup = func(ctx context.Context, _ string) ([]netip.Addr, error) {
+		if timeout {
+			return nil, context.DeadlineExceeded
+		}
+		select {
+		case <-release:
+			return []netip.Addr{addr}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The dial that starts the refresh gives up, but the refresh carries
+	// on for the dial waiting on it.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := r.LookupHost(ctx, "registry.test")
+		first <- err
+	}()
+	for {
+		r.mu.Lock()
+		e := r.entries["registry.test"]
+		r.mu.Unlock()
+		if e != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan []netip.Addr)
+	go func() {
+		got, _ := r.LookupHost(context.Background(), "registry.test")
+		second <- got
+	}()
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled dial got %v", err)
+	}
+	close(release)
+	if got := <-second; len(got) != 1 || got[0] != addr {
+		t.Fatalf("waiting dial got %v", got)
+	}
+
+	// A timed-out refresh isn't remembered as a DNS failure.
+	r.entries["registry.test"].resolved = time.Now().Add(-3 * time.Hour)
+	timeout = true
+	if _, err := r.LookupHost(context.Background(), "registry.test"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("timed-out refresh got %v", err)
+	}
+	timeout = false
+	if got, err := r.LookupHost(context.Background(), "registry.test"); err != nil || got[0] != addr {
+		t.Fatalf("dial after a timed-out refresh got %v, %v", got, err)
+	}
+}
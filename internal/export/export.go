@@ -0,0 +1,246 @@
+// Package export writes cached images to disk in the layout used by
+// skopeo's "dir:" transport, so air-gap pipelines built around
+// `skopeo sync --src dir` can consume the cache directly.
+//
+// Each image becomes a directory named after its repository and tag,
+// relative to the export root (e.g. "ghcr.io/org/app:v1"), containing:
+//
+//	version                 "Directory Transport Version: 1.1"
+//	manifest.json           the image manifest or index
+//	<hex>.manifest.json     per-platform manifests, for indexes
+//	<hex>                   config and layer blobs
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+const dirVersion = "Directory Transport Version: 1.1\n"
+
+// Options selects what to export.
+type Options struct {
+	// Repositories are patterns over "registry/name", matched with
+	// cache.MatchRepository. Empty exports every repository.
+	Repositories []string
+
+	// Digests also exports digest manifests as "<repo>@<digest>" images.
+	// By default only cached tags are exported.
+	Digests bool
+
+	// KeySchema is where the cache stores blobs. The zero value is
+	// cache.KeySchemaGlobal.
+	KeySchema cache.KeySchema
+}
+
+// Result summarises an export.
+type Result struct {
+	Images  int
+	Skipped int
+	Blobs   int
+	Bytes   int64
+}
+
+// ErrIncomplete marks an image whose manifest references content that
+// isn't cached.
+var ErrIncomplete = errors.New("image is not fully cached")
+
+// Export writes the selected cached images under dir.
+func Export(ctx context.Context, store cache.Store, dir string, opts Options) (Result, error) {
+	var res Result
+	for info, err := range store.List(ctx, "manifests/", "") {
+		if err != nil {
+			return res, err
+		}
+		k, ok := cache.ParseKey(info.Key)
+		if !ok || !cache.MatchRepository(opts.Repositories, k.Repository) {
+			continue
+		}
+
+		var name string
+		switch {
+		case k.Kind == "tag":
+			name = k.Repository + ":" + k.Tag
+		case opts.Digests:
+			name = k.Repository + "@" + k.Digest
+		default:
+			continue
+		}
+
+		e := &exporter{ctx: ctx, store: store, schema: opts.KeySchema, repo: k.Repository, dir: filepath.Join(dir, filepath.FromSlash(name))}
+		if err := e.image(info.Key); err != nil {
+			if ctx.Err() != nil {
+				return res, ctx.Err()
+			}
+			slog.Warn("skipping image", "image", name, "error", err)
+			os.RemoveAll(e.dir)
+			res.Skipped++
+			continue
+		}
+		slog.Info("exported image", "image", name, "blobs", e.blobs, "bytes", e.bytes)
+		res.Images++
+		res.Blobs += e.blobs
+		res.Bytes += e.bytes
+	}
+	return res, nil
+}
+
+type exporter struct {
+	ctx    context.Context
+	store  cache.Store
+	schema cache.KeySchema
+	repo   string
+	dir    string
+	blobs  int
+	bytes  int64
+}
+
+// image exports the manifest at key and everything it references.
+func (e *exporter) image(key string) error {
+	if err := os.MkdirAll(e.dir, 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(e.dir, "version"), []byte(dirVersion), 0o644); err != nil {
+		return err
+	}
+
+	data, err := e.read(key)
+	if err != nil {
+		return err
+	}
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return fmt.Errorf("parsing manifest: %w", err)
+	}
+
+	if len(m.Manifests) == 0 {
+		if err := e.layers(m); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(e.dir, "manifest.json"), data, 0o644)
+	}
+
+	// Index: export each platform manifest that is cached. A pull-through
+	// cache usually holds only the platforms clients actually pulled.
+	exported := 0
+	for _, d := range m.Manifests {
+		if !safeDigest(d.Digest) {
+			return fmt.Errorf("invalid digest %q in index", d.Digest)
+		}
+		child, err := e.read(cache.ManifestKey(e.repo, d.Digest))
+		if err != nil {
+			slog.Debug("platform manifest not cached", "repo", e.repo, "digest", d.Digest)
+			continue
+		}
+		cm, err := manifest.Parse(child)
+		if err != nil {
+			return fmt.Errorf("parsing manifest %s: %w", d.Digest, err)
+		}
+		if err := e.layers(cm); err != nil {
+			slog.Debug("platform incomplete", "repo", e.repo, "digest", d.Digest, "error", err)
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(e.dir, hex(d.Digest)+".manifest.json"), child, 0o644); err != nil {
+			return err
+		}
+		exported++
+	}
+	if exported == 0 {
+		return fmt.Errorf("%w: no platform is fully cached", ErrIncomplete)
+	}
+	if exported < len(m.Manifests) {
+		slog.Info("exporting partial index; use skopeo without --all", "repo", e.repo, "platforms", exported, "of", len(m.Manifests))
+	}
+	return os.WriteFile(filepath.Join(e.dir, "manifest.json"), data, 0o644)
+}
+
+// layers exports an image manifest's config and layer blobs.
+func (e *exporter) layers(m *manifest.Manifest) error {
+	if m.Config == nil {
+		return errors.New("manifest has no config")
+	}
+	for _, d := range m.Blobs() {
+		if err := e.blob(d.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *exporter) blob(digest string) error {
+	if !safeDigest(digest) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	dst := filepath.Join(e.dir, hex(digest))
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	registry, _, _ := strings.Cut(e.repo, "/")
+	res, err := e.store.GetWithMeta(e.ctx, e.schema.BlobKey(registry, digest))
+	if err != nil {
+		return fmt.Errorf("%w: blob %s: %v", ErrIncomplete, digest, err)
+	}
+	defer res.Body.Close()
+
+	tmp, err := os.CreateTemp(e.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, res.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("copying blob %s: %w", digest, err)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	e.blobs++
+	e.bytes += n
+	return nil
+}
+
+func (e *exporter) read(key string) ([]byte, error) {
+	res, err := e.store.GetWithMeta(e.ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(io.LimitReader(res.Body, 16<<20))
+}
+
+// hex strips the algorithm from a digest; the dir transport names blobs by
+// their encoded part only.
+func hex(digest string) string {
+	_, h, ok := strings.Cut(digest, ":")
+	if !ok {
+		return digest
+	}
+	return h
+}
+
+// safeDigest reports whether a digest from a manifest can be used as a
+// file name.
+func safeDigest(digest string) bool {
+	alg, h, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || h == "" {
+		return false
+	}
+	for _, c := range h {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '=' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
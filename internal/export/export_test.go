@@ -0,0 +1,64 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+func TestExportDirLayout(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewFSStore(t.TempDir(), 0)
+	put := func(key, body string) {
+		t.Helper()
+		if err := store.Put(ctx, key, strings.NewReader(body), cache.ObjectMeta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := "sha256:" + strings.Repeat("c", 64)
+	layer := "sha256:" + strings.Repeat("1", 64)
+	m, _ := json.Marshal(manifest.Manifest{
+		SchemaVersion: 2,
+		MediaType:     manifest.MediaTypeOCIManifest,
+		Config:        &manifest.Descriptor{Digest: cfg},
+		Layers:        []manifest.Descriptor{{Digest: layer}},
+	})
+	put(cache.TagKey("ghcr.io/org/app", "v1"), string(m))
+	put(cache.BlobKey(cfg), "{}")
+	put(cache.BlobKey(layer), "layer")
+	// A tag whose layer was never cached is skipped.
+	put(cache.TagKey("ghcr.io/org/broken", "v1"), strings.Replace(string(m), strings.Repeat("1", 64), strings.Repeat("2", 64), 1))
+	put(cache.TagKey("ghcr.io/other/app", "v1"), string(m))
+
+	out := t.TempDir()
+	res, err := Export(ctx, store, out, Options{Repositories: []string{"ghcr.io/org/*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Images != 1 || res.Skipped != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	img := filepath.Join(out, "ghcr.io", "org", "app:v1")
+	for name, want := range map[string]string{
+		"version":               dirVersion,
+		"manifest.json":         string(m),
+		strings.Repeat("c", 64): "{}",
+		strings.Repeat("1", 64): "layer",
+	} {
+		got, err := os.ReadFile(filepath.Join(img, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "ghcr.io", "org", "broken:v1")); !os.IsNotExist(err) {
+		t.Errorf("incomplete image should be removed, stat err = %v", err)
+	}
+}
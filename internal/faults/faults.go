@@ -0,0 +1,232 @@
+// Package faults injects failures into a cache.Store, so the proxy's
+// best-effort caching and fallback paths can be exercised on purpose, in
+// tests and in staging, rather than waiting for a backend to misbehave.
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// ErrInjected is the error returned by injected failures.
+var ErrInjected = errors.New("injected store fault")
+
+var injected = metrics.NewCounterVec("oci_store_faults_injected_total",
+	"Store faults injected, by operation and fault (error, partial or latency).", "op", "fault")
+
+// Operations that faults can target.
+var ops = []string{"head", "get", "put", "stat", "delete", "list", "redirect"}
+
+// Spec says which faults to inject and how often.
+type Spec struct {
+	// Errors maps an operation (see ops) to the fraction of its calls that
+	// fail with ErrInjected before reaching the store.
+	Errors map[string]float64
+	// Partial is the fraction of puts and gets cut off part way: a put
+	// reads half its body and fails, and a get's body ends early with
+	// io.ErrUnexpectedEOF.
+	Partial float64
+	// Latency is added before every operation, plus up to Jitter more.
+	Latency time.Duration
+	Jitter  time.Duration
+}
+
+// Parse reads a Spec from comma-separated settings, e.g.
+// "put=0.2,get=0.05,partial=0.1,latency=50ms,jitter=20ms". "all=<rate>"
+// sets the error rate of every operation.
+func Parse(s string) (Spec, error) {
+	spec := Spec{Errors: make(map[string]float64)}
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			return Spec{}, fmt.Errorf("%q: expected key=value", item)
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		v = strings.TrimSpace(v)
+		switch k {
+		case "latency", "jitter":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return Spec{}, fmt.Errorf("%s: invalid duration %q", k, v)
+			}
+			if k == "latency" {
+				spec.Latency = d
+			} else {
+				spec.Jitter = d
+			}
+			continue
+		}
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return Spec{}, fmt.Errorf("%s: rate must be between 0 and 1, got %q", k, v)
+		}
+		switch {
+		case k == "partial":
+			spec.Partial = rate
+		case k == "all":
+			for _, op := range ops {
+				spec.Errors[op] = rate
+			}
+		case slices.Contains(ops, k):
+			spec.Errors[k] = rate
+		default:
+			return Spec{}, fmt.Errorf("unknown setting %q", k)
+		}
+	}
+	return spec, nil
+}
+
+// Wrap returns store with spec's faults injected. The returned store
+// still implements cache.Redirector when store does. A nil rng uses the
+// global source; tests can pass a seeded one.
+func Wrap(store cache.Store, spec Spec, rng *rand.Rand) cache.Store {
+	f := &faultyStore{Store: store, spec: spec, rng: rng}
+	if r, ok := store.(cache.Redirector); ok {
+		return &faultyRedirector{faultyStore: f, Redirector: r}
+	}
+	return f
+}
+
+type faultyStore struct {
+	cache.Store
+	spec Spec
+	rng  *rand.Rand
+}
+
+func (f *faultyStore) float() float64 {
+	if f.rng != nil {
+		return f.rng.Float64()
+	}
+	return rand.Float64()
+}
+
+func (f *faultyStore) roll(rate float64) bool {
+	return rate > 0 && f.float() < rate
+}
+
+// inject delays the call and decides whether it fails outright.
+func (f *faultyStore) inject(ctx context.Context, op string) error {
+	if d := f.spec.Latency; d > 0 || f.spec.Jitter > 0 {
+		if f.spec.Jitter > 0 {
+			d += time.Duration(f.float() * float64(f.spec.Jitter))
+		}
+		injected.Inc(op, "latency")
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if f.roll(f.spec.Errors[op]) {
+		injected.Inc(op, "error")
+		return fmt.Errorf("%s: %w", op, ErrInjected)
+	}
+	return nil
+}
+
+func (f *faultyStore) Head(ctx context.Context, key string) (cache.ObjectMeta, error) {
+	if err := f.inject(ctx, "head"); err != nil {
+		return cache.ObjectMeta{}, err
+	}
+	return f.Store.Head(ctx, key)
+}
+
+func (f *faultyStore) GetWithMeta(ctx context.Context, key string) (*cache.GetResult, error) {
+	if err := f.inject(ctx, "get"); err != nil {
+		return nil, err
+	}
+	res, err := f.Store.GetWithMeta(ctx, key)
+	if err != nil || !f.roll(f.spec.Partial) {
+		return res, err
+	}
+	injected.Inc("get", "partial")
+	res.Body = &truncated{ReadCloser: res.Body, left: res.Meta.ContentLength / 2}
+	return res, nil
+}
+
+func (f *faultyStore) Put(ctx context.Context, key string, body io.Reader, meta cache.ObjectMeta) error {
+	if err := f.inject(ctx, "put"); err != nil {
+		return err
+	}
+	if !f.roll(f.spec.Partial) {
+		return f.Store.Put(ctx, key, body, meta)
+	}
+	// The store sees the body fail part way, as when a connection drops
+	// during an upload, and must not commit what it got.
+	injected.Inc("put", "partial")
+	err := f.Store.Put(ctx, key, &truncated{ReadCloser: io.NopCloser(body), left: meta.ContentLength / 2}, meta)
+	if err == nil {
+		return fmt.Errorf("put: store committed a partial upload")
+	}
+	return err
+}
+
+func (f *faultyStore) Stat(ctx context.Context, keys []string) (map[string]cache.ObjectInfo, error) {
+	if err := f.inject(ctx, "stat"); err != nil {
+		return nil, err
+	}
+	return f.Store.Stat(ctx, keys)
+}
+
+func (f *faultyStore) Delete(ctx context.Context, key string) error {
+	if err := f.inject(ctx, "delete"); err != nil {
+		return err
+	}
+	return f.Store.Delete(ctx, key)
+}
+
+func (f *faultyStore) List(ctx context.Context, prefix, startAfter string) iter.Seq2[cache.ObjectInfo, error] {
+	if err := f.inject(ctx, "list"); err != nil {
+		return func(yield func(cache.ObjectInfo, error) bool) { yield(cache.ObjectInfo{}, err) }
+	}
+	return f.Store.List(ctx, prefix, startAfter)
+}
+
+type faultyRedirector struct {
+	*faultyStore
+	cache.Redirector
+}
+
+func (f *faultyRedirector) RedirectURL(ctx context.Context, key string) (string, cache.ObjectMeta, error) {
+	if err := f.faultyStore.inject(ctx, "redirect"); err != nil {
+		return "", cache.ObjectMeta{}, err
+	}
+	return f.Redirector.RedirectURL(ctx, key)
+}
+
+// truncated passes through left bytes, then fails as a dropped connection
+// would.
+type truncated struct {
+	io.ReadCloser
+	left int64
+}
+
+func (t *truncated) Read(p []byte) (int, error) {
+	if t.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > t.left {
+		p = p[:t.left]
+	}
+	n, err := t.ReadCloser.Read(p)
+	t.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
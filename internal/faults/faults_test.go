@@ -0,0 +1,70 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestParse(t *testing.T) {
+	spec, err := Parse("put=0.2, get=0.05,partial=0.1,latency=50ms,jitter=20ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Errors["put"] != 0.2 || spec.Errors["get"] != 0.05 || spec.Partial != 0.1 ||
+		spec.Latency != 50*time.Millisecond || spec.Jitter != 20*time.Millisecond {
+		t.Errorf("Parse = %+v", spec)
+	}
+	if spec, _ := Parse("all=1"); len(spec.Errors) != len(ops) {
+		t.Errorf("all=1 set %v", spec.Errors)
+	}
+	for _, bad := range []string{"put", "put=2", "write=0.1", "latency=fast", "get=-1"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	ctx := context.Background()
+	body := strings.Repeat("x", 64)
+	meta := cache.ObjectMeta{ContentLength: int64(len(body)), Header: http.Header{"Content-Length": {"64"}}}
+	base := cache.NewFSStore(t.TempDir(), 0)
+
+	// A partial upload fails and leaves nothing behind.
+	partial := Wrap(base, Spec{Partial: 1}, nil)
+	if err := partial.Put(ctx, "blobs/a", strings.NewReader(body), meta); err == nil {
+		t.Fatal("partial put succeeded")
+	}
+	if _, err := base.Head(ctx, "blobs/a"); !cache.IsNotFound(err) {
+		t.Fatalf("partial put left an object: %v", err)
+	}
+
+	// A partial read ends early with an error rather than looking complete.
+	if err := base.Put(ctx, "blobs/a", strings.NewReader(body), meta); err != nil {
+		t.Fatal(err)
+	}
+	res, err := partial.GetWithMeta(ctx, "blobs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !errors.Is(err, io.ErrUnexpectedEOF) || len(got) != len(body)/2 {
+		t.Fatalf("partial get: %d bytes, %v", len(got), err)
+	}
+
+	failing := Wrap(base, Spec{Errors: map[string]float64{"head": 1}}, nil)
+	if _, err := failing.Head(ctx, "blobs/a"); !errors.Is(err, ErrInjected) {
+		t.Errorf("head: %v", err)
+	}
+	if _, err := failing.GetWithMeta(ctx, "blobs/a"); err != nil {
+		t.Errorf("get failed without a fault: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package fleet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+)
+
+// Agent runs on an edge proxy, heartbeating to the controller and
+// carrying out the commands it returns. Commands run one at a time, in the
+// order queued; their results go out with the following heartbeat.
+type Agent struct {
+	ControllerURL string
+	Token         string
+	ID            string
+	Upstream      string
+	Interval      time.Duration
+	Client        *http.Client
+
+	Store cache.Store
+
+	// Warm pulls an image through the cache; see proxy.Handler.Warm.
+	Warm func(ctx context.Context, image, authorization string, progress func(proxy.WarmEvent)) error
+
+	// ApplyPolicy installs a policy from the controller.
+	ApplyPolicy func(proxy.Policy)
+
+	// Stats reports the edge's current cache summary.
+	Stats func() Stats
+
+	policyVersion int64
+	results       []CommandResult
+}
+
+// Run heartbeats every Interval until ctx is cancelled. Failed heartbeats
+// are logged and retried on the next tick; unsent results are kept.
+func (a *Agent) Run(ctx context.Context) error {
+	t := time.NewTicker(a.Interval)
+	defer t.Stop()
+	for {
+		if err := a.poll(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("fleet heartbeat failed", "controller", a.ControllerURL, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// poll sends one heartbeat and executes the directive it gets back.
+func (a *Agent) poll(ctx context.Context) error {
+	hb := Heartbeat{ID: a.ID, Upstream: a.Upstream, PolicyVersion: a.policyVersion, Results: a.results}
+	if a.Stats != nil {
+		hb.Stats = a.Stats()
+	}
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(a.ControllerURL, "/")+APIPrefix+"heartbeat", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	}
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("controller returned %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	var d Directive
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&d); err != nil {
+		return fmt.Errorf("decoding directive: %w", err)
+	}
+	a.results = nil
+
+	if d.Policy != nil && a.ApplyPolicy != nil {
+		a.ApplyPolicy(*d.Policy)
+		slog.Info("applied fleet policy", "version", d.PolicyVersion)
+	}
+	a.policyVersion = d.PolicyVersion
+
+	for _, cmd := range d.Commands {
+		if ctx.Err() != nil {
+			break
+		}
+		a.results = append(a.results, a.execute(ctx, cmd))
+	}
+	return nil
+}
+
+func (a *Agent) execute(ctx context.Context, cmd Command) CommandResult {
+	slog.Info("running fleet command", "command", cmd.ID, "kind", cmd.Kind)
+	res := CommandResult{ID: cmd.ID}
+	var err error
+	switch cmd.Kind {
+	case CommandWarm:
+		err = a.warm(ctx, cmd, &res)
+	case CommandPurge:
+		err = Purge(ctx, a.Store, cmd.Keys, cmd.Prefix, func(_ string, size int64, err error) {
+			if err != nil {
+				res.Failed++
+				return
+			}
+			res.Objects++
+			res.Bytes += size
+		})
+	default:
+		err = fmt.Errorf("unknown command kind %q", cmd.Kind)
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.Finished = time.Now()
+	return res
+}
+
+func (a *Agent) warm(ctx context.Context, cmd Command, res *CommandResult) error {
+	if a.Warm == nil {
+		return errors.New("warming is not available on this edge")
+	}
+	var errs []error
+	for _, image := range cmd.Images {
+		err := a.Warm(ctx, image, "", func(ev proxy.WarmEvent) {
+			if ev.Status == "failed" {
+				res.Failed++
+				return
+			}
+			res.Objects++
+			res.Bytes += ev.Size
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", image, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validPurgePrefix guards against purging more than intended: a prefix
+// must name a whole directory under blobs/ or manifests/.
+func validPurgePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if !strings.HasSuffix(prefix, "/") || !(strings.HasPrefix(prefix, "blobs/") || strings.HasPrefix(prefix, "manifests/")) {
+		return errors.New(`prefix must start with "blobs/" or "manifests/" and end in "/"`)
+	}
+	return nil
+}
+
+// Purge deletes keys and everything under prefix from store, calling
+// report for each. It stops early only if listing fails.
+func Purge(ctx context.Context, store cache.Store, keys []string, prefix string, report func(key string, size int64, err error)) error {
+	if err := validPurgePrefix(prefix); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		meta, err := store.Head(ctx, key)
+		if err == nil {
+			err = store.Delete(ctx, key)
+		}
+		report(key, meta.ContentLength, err)
+	}
+	if prefix == "" {
+		return nil
+	}
+	for info, err := range store.List(ctx, prefix, "") {
+		if err != nil {
+			return err
+		}
+		report(info.Key, info.Size, store.Delete(ctx, info.Key))
+	}
+	return nil
+}
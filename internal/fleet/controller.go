@@ -0,0 +1,223 @@
+package fleet
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+)
+
+// maxResults bounds the command results kept per edge.
+const maxResults = 50
+
+// Controller tracks registered edges, queues commands for them and serves
+// the fleet policy. State is in memory; edges re-register on their next
+// heartbeat after a controller restart, but queued commands are lost.
+type Controller struct {
+	// StaleAfter is how long after its last heartbeat an edge is reported
+	// as stale. Stale edges still receive commands when they return.
+	StaleAfter time.Duration
+
+	mu            sync.Mutex
+	edges         map[string]*edge
+	policy        proxy.Policy
+	policyVersion int64
+	nextCommand   uint64
+	mux           *http.ServeMux
+}
+
+type edge struct {
+	Heartbeat
+	LastSeen time.Time
+	pending  []Command
+	results  []CommandResult
+}
+
+// EdgeStatus is an edge as reported by GET /fleet/v1/edges.
+type EdgeStatus struct {
+	ID            string          `json:"id"`
+	Upstream      string          `json:"upstream,omitempty"`
+	LastSeen      time.Time       `json:"last_seen"`
+	Stale         bool            `json:"stale"`
+	PolicyVersion int64           `json:"policy_version"`
+	Stats         Stats           `json:"stats"`
+	Pending       int             `json:"pending_commands"`
+	Results       []CommandResult `json:"results,omitempty"`
+}
+
+// NewController returns a controller with no policy. Until SetPolicy is
+// called (or a policy is PUT), edges keep their locally configured rules.
+func NewController() *Controller {
+	c := &Controller{
+		StaleAfter: 2 * time.Minute,
+		edges:      make(map[string]*edge),
+		mux:        http.NewServeMux(),
+	}
+	c.mux.HandleFunc("POST "+APIPrefix+"heartbeat", c.heartbeat)
+	c.mux.HandleFunc("GET "+APIPrefix+"edges", c.listEdges)
+	c.mux.HandleFunc("POST "+APIPrefix+"commands", c.queueCommand)
+	c.mux.HandleFunc("GET "+APIPrefix+"policy", c.getPolicy)
+	c.mux.HandleFunc("PUT "+APIPrefix+"policy", c.putPolicy)
+	return c
+}
+
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+// heartbeat registers or refreshes an edge, records its command results
+// and hands over everything queued for it.
+func (c *Controller) heartbeat(w http.ResponseWriter, r *http.Request) {
+	var hb Heartbeat
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&hb); err != nil || hb.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid heartbeat")
+		return
+	}
+
+	c.mu.Lock()
+	e, ok := c.edges[hb.ID]
+	if !ok {
+		e = &edge{}
+		c.edges[hb.ID] = e
+		slog.Info("edge registered", "edge", hb.ID, "upstream", hb.Upstream)
+	}
+	e.results = append(e.results, hb.Results...)
+	if n := len(e.results); n > maxResults {
+		e.results = slices.Clone(e.results[n-maxResults:])
+	}
+	e.Heartbeat = hb
+	e.Heartbeat.Results = nil
+	e.LastSeen = time.Now()
+
+	d := Directive{Commands: e.pending, PolicyVersion: c.policyVersion}
+	e.pending = nil
+	if hb.PolicyVersion != c.policyVersion {
+		p := c.policy
+		d.Policy = &p
+	}
+	c.mu.Unlock()
+
+	for _, res := range hb.Results {
+		slog.Info("edge command finished", "edge", hb.ID, "command", res.ID, "objects", res.Objects, "failed", res.Failed, "error", res.Error)
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// listEdges reports every known edge plus fleet-wide totals.
+func (c *Controller) listEdges(w http.ResponseWriter, _ *http.Request) {
+	c.mu.Lock()
+	now := time.Now()
+	out := make([]EdgeStatus, 0, len(c.edges))
+	var total Stats
+	for id, e := range c.edges {
+		out = append(out, EdgeStatus{
+			ID:            id,
+			Upstream:      e.Upstream,
+			LastSeen:      e.LastSeen,
+			Stale:         now.Sub(e.LastSeen) > c.StaleAfter,
+			PolicyVersion: e.PolicyVersion,
+			Stats:         e.Stats,
+			Pending:       len(e.pending),
+			Results:       slices.Clone(e.results),
+		})
+		total.Objects += e.Stats.Objects
+		total.Bytes += e.Stats.Bytes
+		total.InflightFills += e.Stats.InflightFills
+	}
+	c.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b EdgeStatus) int { return strings.Compare(a.ID, b.ID) })
+	writeJSON(w, http.StatusOK, map[string]any{"edges": out, "total": total})
+}
+
+// queueCommand validates a command and queues it for its target edges.
+func (c *Controller) queueCommand(w http.ResponseWriter, r *http.Request) {
+	var cmd Command
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&cmd); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid command: "+err.Error())
+		return
+	}
+	switch cmd.Kind {
+	case CommandWarm:
+		if len(cmd.Images) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "warm needs images")
+			return
+		}
+	case CommandPurge:
+		if len(cmd.Keys) == 0 && cmd.Prefix == "" {
+			writeJSONError(w, http.StatusBadRequest, "purge needs keys or a prefix")
+			return
+		}
+		if err := validPurgePrefix(cmd.Prefix); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusBadRequest, `kind must be "warm" or "purge"`)
+		return
+	}
+
+	c.mu.Lock()
+	c.nextCommand++
+	cmd.ID = strconv.FormatUint(c.nextCommand, 10)
+	var targets []string
+	for id, e := range c.edges {
+		if len(cmd.Edges) == 0 || slices.Contains(cmd.Edges, id) {
+			e.pending = append(e.pending, cmd)
+			targets = append(targets, id)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(targets) == 0 {
+		writeJSONError(w, http.StatusNotFound, "no registered edges match")
+		return
+	}
+	slices.Sort(targets)
+	slog.Info("fleet command queued", "command", cmd.ID, "kind", cmd.Kind, "edges", len(targets))
+	writeJSON(w, http.StatusAccepted, map[string]any{"id": cmd.ID, "edges": targets})
+}
+
+func (c *Controller) getPolicy(w http.ResponseWriter, _ *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"version": c.policyVersion, "policy": c.policy})
+}
+
+// putPolicy replaces the fleet policy. Edges pick it up on their next
+// heartbeat.
+func (c *Controller) putPolicy(w http.ResponseWriter, r *http.Request) {
+	var p proxy.Policy
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&p); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid policy: "+err.Error())
+		return
+	}
+	v := c.SetPolicy(p)
+	slog.Info("fleet policy updated", "version", v)
+	writeJSON(w, http.StatusOK, map[string]any{"version": v, "policy": p})
+}
+
+// SetPolicy replaces the fleet policy and returns its new version.
+func (c *Controller) SetPolicy(p proxy.Policy) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = p
+	c.policyVersion++
+	return c.policyVersion
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,74 @@
+// Package fleet lets many edge proxies be managed from one central
+// controller. Edges poll the controller with a heartbeat carrying their
+// stats and the results of earlier commands; the reply carries queued
+// commands (warm, purge) and the current policy. Polling keeps edges behind
+// NAT or egress-only firewalls reachable without inbound connections.
+package fleet
+
+import (
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+)
+
+// APIPrefix is the path under which the controller serves the fleet API.
+const APIPrefix = "/fleet/v1/"
+
+// Stats is an edge's cache summary, as reported in each heartbeat.
+type Stats struct {
+	Objects       int64 `json:"objects"`
+	Bytes         int64 `json:"bytes"`
+	InflightFills int   `json:"inflight_fills"`
+	IndexReady    bool  `json:"index_ready"`
+}
+
+// Heartbeat is sent by an edge on every poll.
+type Heartbeat struct {
+	ID            string          `json:"id"`
+	Upstream      string          `json:"upstream,omitempty"`
+	PolicyVersion int64           `json:"policy_version"`
+	Stats         Stats           `json:"stats"`
+	Results       []CommandResult `json:"results,omitempty"`
+}
+
+// Command kinds.
+const (
+	CommandWarm  = "warm"
+	CommandPurge = "purge"
+)
+
+// Command is an instruction queued for one or more edges.
+type Command struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+
+	// Images to warm: "registry/name:tag" or "registry/name@digest".
+	Images []string `json:"images,omitempty"`
+
+	// Keys to purge, and/or a key prefix ending in "/".
+	Keys   []string `json:"keys,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+
+	// Edges limits the command to these edge IDs; empty means all edges
+	// registered when it is queued.
+	Edges []string `json:"edges,omitempty"`
+}
+
+// CommandResult reports how a command went on one edge.
+type CommandResult struct {
+	ID       string    `json:"id"`
+	Finished time.Time `json:"finished"`
+	Objects  int       `json:"objects"`
+	Bytes    int64     `json:"bytes"`
+	Failed   int       `json:"failed"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Directive is the controller's reply to a heartbeat.
+type Directive struct {
+	Commands []Command `json:"commands,omitempty"`
+
+	// Policy is only sent when the edge reported an older version.
+	Policy        *proxy.Policy `json:"policy,omitempty"`
+	PolicyVersion int64         `json:"policy_version"`
+}
@@ -0,0 +1,99 @@
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+)
+
+func TestAgentControllerRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	c := NewController()
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	store := cache.NewFSStore(t.TempDir(), 0)
+	for _, key := range []string{"manifests/ghcr.io/org/app/tags/v1", "manifests/ghcr.io/org/keep/tags/v1"} {
+		if err := store.Put(ctx, key, strings.NewReader("{}"), cache.ObjectMeta{ContentLength: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var applied []proxy.Policy
+	a := &Agent{
+		ControllerURL: srv.URL,
+		ID:            "edge-1",
+		Store:         store,
+		ApplyPolicy:   func(p proxy.Policy) { applied = append(applied, p) },
+		Stats:         func() Stats { return Stats{Objects: 2, Bytes: 4} },
+	}
+
+	// Registration: no policy has been set, so local rules stay in force.
+	if err := a.poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("edge received a policy before one was set: %+v", applied)
+	}
+
+	post := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+APIPrefix+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := post(http.MethodPost, "commands", `{"kind":"purge","prefix":"manifests/ghcr.io/org/app/"}`); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("queue command: %d", resp.StatusCode)
+	}
+	if resp := post(http.MethodPost, "commands", `{"kind":"purge","prefix":"manifests/"}`); resp.StatusCode != http.StatusAccepted {
+		// A whole-tree prefix is allowed; only malformed ones are refused.
+		t.Fatalf("queue command: %d", resp.StatusCode)
+	}
+	if resp := post(http.MethodPost, "commands", `{"kind":"purge","prefix":"manifests"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected malformed prefix to be refused, got %d", resp.StatusCode)
+	}
+	post(http.MethodPut, "policy", `{"digest_pinned":["org/*"]}`)
+
+	// Second poll runs both purges and picks up the policy.
+	if err := a.poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].DigestPinned[0] != "org/*" {
+		t.Fatalf("policy not applied: %+v", applied)
+	}
+	if _, err := store.Head(ctx, "manifests/ghcr.io/org/keep/tags/v1"); err == nil {
+		t.Fatal("expected purge to delete cached object")
+	}
+
+	// Third poll reports the results.
+	if err := a.poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(srv.URL + APIPrefix + "edges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Edges []EdgeStatus `json:"edges"`
+		Total Stats        `json:"total"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Edges) != 1 || list.Total.Objects != 2 {
+		t.Fatalf("unexpected edges %+v", list)
+	}
+	res := list.Edges[0].Results
+	if len(res) != 2 || res[0].Objects != 1 || res[1].Objects != 1 || res[0].Error != "" {
+		t.Fatalf("unexpected results %+v", res)
+	}
+}
@@ -0,0 +1,104 @@
+package gc
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/index"
+)
+
+// Budget evicts the least recently pulled objects whenever the indexed
+// cache size exceeds MaxBytes. It works from the inventory index rather
+// than listing the store, so a sweep costs one DELETE per evicted object.
+// Deletes go through Store, which should be the index-tracking store so
+// evicted keys drop out of the index.
+type Budget struct {
+	Store    cache.Store
+	Index    *index.Index
+	MaxBytes int64
+
+	// Pinned, when set, reports whether a key must not be evicted, e.g.
+	// for a maintenance window.
+	Pinned func(key string) bool
+
+	// DryRun logs what would be evicted without deleting it.
+	DryRun bool
+
+	// Interval between checks.
+	Interval time.Duration
+}
+
+type indexed struct {
+	key    string
+	size   int64
+	access time.Time
+}
+
+// Run checks the budget every Interval until ctx is cancelled.
+func (b *Budget) Run(ctx context.Context) error {
+	t := time.NewTicker(b.Interval)
+	defer t.Stop()
+	for {
+		res, err := b.Enforce(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("cache size enforcement failed", "error", err)
+		} else if res.Deleted > 0 {
+			slog.Info("cache size enforced", "max_bytes", b.MaxBytes, "evicted", res.Deleted, "bytes", res.Bytes, "dry_run", b.DryRun)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Enforce evicts objects, coldest first, until the indexed total is within
+// MaxBytes. It does nothing until the index has completed its first scan,
+// since a partial index can't say which objects are coldest.
+func (b *Budget) Enforce(ctx context.Context) (Result, error) {
+	var res Result
+	if !b.Index.Ready() {
+		slog.Debug("cache index not ready, skipping size enforcement")
+		return res, nil
+	}
+
+	var total int64
+	var objs []indexed
+	b.Index.Each(func(key string, e index.Entry) bool {
+		total += e.Size
+		objs = append(objs, indexed{key: key, size: e.Size, access: cmp.Or(e.LastAccess, e.LastModified)})
+		return true
+	})
+	res.Scanned = len(objs)
+	if total <= b.MaxBytes {
+		return res, nil
+	}
+
+	slices.SortFunc(objs, func(a, b indexed) int { return a.access.Compare(b.access) })
+	for _, o := range objs {
+		if total <= b.MaxBytes {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		obj, ok := parseKey(cache.ObjectInfo{Key: o.key, Size: o.size})
+		if !ok || (b.Pinned != nil && b.Pinned(o.key)) {
+			continue
+		}
+		before := res.Deleted
+		deleteObject(ctx, b.Store, b.DryRun, obj, "max_bytes", &res)
+		if res.Deleted > before {
+			total -= o.size
+		}
+	}
+	return res, nil
+}
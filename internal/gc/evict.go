@@ -0,0 +1,79 @@
+package gc
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// Eviction keeps a store that tracks reads itself, such as the filesystem
+// store, within a size and idle-age budget. Unlike Budget it needs no
+// index: the store walks its own tree and evicts the least recently read
+// objects first.
+type Eviction struct {
+	Store  cache.Evicter
+	Limits cache.EvictLimits
+
+	// Pinned, when set, reports whether a key must not be evicted, e.g.
+	// for a maintenance window.
+	Pinned func(key string) bool
+
+	// Forget, when set, is called with each evicted key so wrappers the
+	// eviction bypassed (the cache index) can drop it.
+	Forget func(key string)
+
+	// DryRun logs what would be evicted without deleting it.
+	DryRun bool
+
+	// Interval between checks.
+	Interval time.Duration
+}
+
+// Run enforces the limits every Interval until ctx is cancelled.
+func (e *Eviction) Run(ctx context.Context) error {
+	t := time.NewTicker(e.Interval)
+	defer t.Stop()
+	for {
+		res, err := e.Enforce(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("cache eviction failed", "error", err)
+		}
+		if res.Deleted > 0 {
+			slog.Info("cache eviction complete", "evicted", res.Deleted, "bytes", res.Bytes, "dry_run", e.DryRun)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Enforce evicts once, logging and counting each object. Objects evicted
+// before an error are still counted.
+func (e *Eviction) Enforce(ctx context.Context) (Result, error) {
+	var res Result
+	evicted, err := e.Store.Evict(ctx, e.Limits, e.Pinned, e.DryRun)
+	for _, ev := range evicted {
+		res.Deleted++
+		res.Bytes += ev.Size
+		if e.DryRun {
+			slog.Info("eviction would delete", "key", ev.Key, "reason", ev.Reason, "size", ev.Size, "last_access", ev.LastAccess)
+			continue
+		}
+		slog.Debug("evicted", "key", ev.Key, "reason", ev.Reason, "size", ev.Size, "last_access", ev.LastAccess)
+		if e.Forget != nil {
+			e.Forget(ev.Key)
+		}
+		if k, ok := cache.ParseKey(ev.Key); ok {
+			deletedObjects.Inc(k.Kind)
+			deletedBytes.Add(float64(ev.Size), k.Kind)
+		}
+	}
+	return res, err
+}
@@ -0,0 +1,198 @@
+// Package gc deletes cached objects according to retention rules. It gives
+// finer control than a blanket S3 lifecycle rule: per-repository digest
+// limits, tag-pattern expiry, and expiry by last pull rather than age.
+package gc
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var (
+	deletedObjects = metrics.NewCounterVec("oci_gc_deleted_objects_total",
+		"Cached objects deleted by retention rules.", "kind")
+	deletedBytes = metrics.NewCounterVec("oci_gc_deleted_bytes_total",
+		"Bytes freed by retention rules.", "kind")
+)
+
+// Collector applies retention rules to a store.
+type Collector struct {
+	Store cache.Store
+	Rules []Rule
+
+	// LastAccess returns when a key was last pulled. When nil, or when it
+	// doesn't know the key, max_idle falls back to the object's age.
+	LastAccess func(key string) (time.Time, bool)
+
+	// Pinned, when set, reports whether a key must be kept regardless of
+	// the rules, e.g. for a maintenance window.
+	Pinned func(key string) bool
+
+	// DryRun logs what would be deleted without deleting it.
+	DryRun bool
+
+	// Interval between sweeps.
+	Interval time.Duration
+}
+
+// Result summarises one sweep.
+type Result struct {
+	Scanned int
+	Deleted int
+	Bytes   int64
+}
+
+// object is a listed cache entry with its key decoded.
+type object struct {
+	cache.ObjectInfo
+	kind string // "blob", "chunk", "manifest" or "tag"
+	repo string // "registry/name"; empty for blobs and chunks
+	tag  string // set for tag manifests
+}
+
+// Run sweeps every Interval until ctx is cancelled.
+func (c *Collector) Run(ctx context.Context) error {
+	t := time.NewTicker(c.Interval)
+	defer t.Stop()
+	for {
+		res, err := c.Sweep(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("retention sweep failed", "error", err)
+		} else {
+			slog.Info("retention sweep complete", "scanned", res.Scanned, "deleted", res.Deleted, "bytes", res.Bytes, "dry_run", c.DryRun)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Sweep lists the store once and deletes everything the rules expire.
+// Digest manifests are held in memory per repository so keep_last can rank
+// them; blobs and tag manifests are decided as they are listed.
+func (c *Collector) Sweep(ctx context.Context) (Result, error) {
+	var res Result
+	now := time.Now()
+	byRepo := make(map[string][]object)
+
+	for info, err := range c.Store.List(ctx, "", "") {
+		if err != nil {
+			return res, err
+		}
+		obj, ok := parseKey(info)
+		if !ok {
+			continue
+		}
+		res.Scanned++
+		if obj.kind == "manifest" {
+			byRepo[obj.repo] = append(byRepo[obj.repo], obj)
+			continue
+		}
+		if reason := c.expired(obj, now); reason != "" {
+			c.delete(ctx, obj, reason, &res)
+		}
+	}
+
+	for _, objs := range byRepo {
+		// Newest first, so keep_last keeps a prefix.
+		slices.SortFunc(objs, func(a, b object) int { return b.LastModified.Compare(a.LastModified) })
+		for i, obj := range objs {
+			reason := c.expired(obj, now)
+			if reason == "" {
+				reason = c.beyondKeepLast(obj, i)
+			}
+			if reason != "" {
+				c.delete(ctx, obj, reason, &res)
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// expired returns why obj is past a max_age or max_idle rule, or "".
+func (c *Collector) expired(obj object, now time.Time) string {
+	for _, r := range c.Rules {
+		if !r.selects(obj) {
+			continue
+		}
+		if r.MaxAge > 0 && now.Sub(obj.LastModified) > time.Duration(r.MaxAge) {
+			return "max_age"
+		}
+		if r.MaxIdle > 0 && now.Sub(c.lastAccess(obj)) > time.Duration(r.MaxIdle) {
+			return "max_idle"
+		}
+	}
+	return ""
+}
+
+// beyondKeepLast returns "keep_last" if obj, at position rank among its
+// repository's digest manifests (newest first), falls outside a matching
+// keep_last rule.
+func (c *Collector) beyondKeepLast(obj object, rank int) string {
+	for _, r := range c.Rules {
+		if r.KeepLast > 0 && r.selects(obj) && rank >= r.KeepLast {
+			return "keep_last"
+		}
+	}
+	return ""
+}
+
+func (c *Collector) lastAccess(obj object) time.Time {
+	if c.LastAccess != nil {
+		if t, ok := c.LastAccess(obj.Key); ok {
+			return cmp.Or(t, obj.LastModified)
+		}
+	}
+	return obj.LastModified
+}
+
+func (c *Collector) delete(ctx context.Context, obj object, reason string, res *Result) {
+	if c.Pinned != nil && c.Pinned(obj.Key) {
+		slog.Debug("retention skipped pinned object", "key", obj.Key, "reason", reason)
+		return
+	}
+	deleteObject(ctx, c.Store, c.DryRun, obj, reason, res)
+}
+
+// deleteObject removes obj from store (or, in dry-run mode, only logs it)
+// and records it in res and the deletion metrics. reason says which rule or
+// budget selected it.
+func deleteObject(ctx context.Context, store cache.Store, dryRun bool, obj object, reason string, res *Result) {
+	if dryRun {
+		slog.Info("retention would delete", "key", obj.Key, "reason", reason, "size", obj.Size)
+		res.Deleted++
+		res.Bytes += obj.Size
+		return
+	}
+	if err := store.Delete(ctx, obj.Key); err != nil {
+		slog.Warn("retention delete failed", "key", obj.Key, "error", err)
+		return
+	}
+	slog.Debug("retention deleted", "key", obj.Key, "reason", reason, "size", obj.Size)
+	res.Deleted++
+	res.Bytes += obj.Size
+	deletedObjects.Inc(obj.kind)
+	deletedBytes.Add(float64(obj.Size), obj.kind)
+}
+
+func parseKey(info cache.ObjectInfo) (object, bool) {
+	k, ok := cache.ParseKey(info.Key)
+	if !ok {
+		return object{}, false
+	}
+	return object{ObjectInfo: info, kind: k.Kind, repo: k.Repository, tag: k.Tag}, true
+}
@@ -0,0 +1,198 @@
+package gc
+
+import (
+	"context"
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/index"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// memStore lists a fixed set of objects and records deletions.
+type memStore struct {
+	cache.Store
+	objects []cache.ObjectInfo
+	deleted []string
+}
+
+func (m *memStore) List(context.Context, string, string) iter.Seq2[cache.ObjectInfo, error] {
+	return func(yield func(cache.ObjectInfo, error) bool) {
+		for _, o := range m.objects {
+			if !yield(o, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (m *memStore) Delete(_ context.Context, key string) error {
+	m.deleted = append(m.deleted, key)
+	return nil
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	age := func(d time.Duration) time.Time { return now.Add(-d) }
+	day := 24 * time.Hour
+
+	store := &memStore{objects: []cache.ObjectInfo{
+		{Key: "manifests/ghcr.io/org/app/sha256-1", LastModified: age(1 * day)},
+		{Key: "manifests/ghcr.io/org/app/sha256-2", LastModified: age(2 * day)},
+		{Key: "manifests/ghcr.io/org/app/sha256-3", LastModified: age(3 * day)},
+		{Key: "manifests/ghcr.io/other/app/sha256-4", LastModified: age(3 * day)},
+		{Key: "manifests/ghcr.io/org/app/tags/feature-dev", LastModified: age(8 * day)},
+		{Key: "manifests/ghcr.io/org/app/tags/v1", LastModified: age(8 * day)},
+		{Key: "blobs/sha256-old", LastModified: age(100 * day)},
+		{Key: "blobs/sha256-pulled", LastModified: age(100 * day)},
+	}}
+	c := &Collector{
+		Store: store,
+		Rules: []Rule{
+			{Repository: "ghcr.io/org/*", KeepLast: 2},
+			{Tag: "*-dev", MaxAge: Duration(7 * day)},
+			{MaxIdle: Duration(90 * day)},
+		},
+		LastAccess: func(key string) (time.Time, bool) {
+			if key == "blobs/sha256-pulled" {
+				return age(time.Hour), true
+			}
+			return time.Time{}, false
+		},
+	}
+
+	res, err := c.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(store.deleted)
+	want := []string{
+		"blobs/sha256-old",
+		"manifests/ghcr.io/org/app/sha256-3",
+		"manifests/ghcr.io/org/app/tags/feature-dev",
+	}
+	if !slices.Equal(store.deleted, want) {
+		t.Fatalf("deleted %v, want %v", store.deleted, want)
+	}
+	if res.Scanned != 8 || res.Deleted != 3 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
+
+func TestSweepSkipsPinned(t *testing.T) {
+	old := time.Now().Add(-100 * 24 * time.Hour)
+	store := &memStore{objects: []cache.ObjectInfo{
+		{Key: "blobs/sha256-pinned", LastModified: old},
+		{Key: "blobs/sha256-other", LastModified: old},
+	}}
+	c := &Collector{
+		Store:  store,
+		Rules:  []Rule{{MaxAge: Duration(time.Hour)}},
+		Pinned: func(key string) bool { return key == "blobs/sha256-pinned" },
+	}
+	if _, err := c.Sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(store.deleted, []string{"blobs/sha256-other"}) {
+		t.Errorf("deleted %v, want only the unpinned blob", store.deleted)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	if d, err := ParseDuration("90d"); err != nil || d != 90*24*time.Hour {
+		t.Fatalf("90d: got %v, %v", d, err)
+	}
+	if d, err := ParseDuration("12h"); err != nil || d != 12*time.Hour {
+		t.Fatalf("12h: got %v, %v", d, err)
+	}
+	if _, err := ParseDuration("xd"); err == nil {
+		t.Fatal("expected error for xd")
+	}
+}
+
+func TestBudgetEvictsColdestFirst(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	store := &memStore{objects: []cache.ObjectInfo{
+		{Key: "blobs/sha256-cold", Size: 400, LastModified: old},
+		{Key: "blobs/sha256-warm", Size: 400, LastModified: old},
+		{Key: "blobs/sha256-hot", Size: 400, LastModified: old},
+		{Key: "manifests/ghcr.io/org/app/sha256-m", Size: 10, LastModified: old.Add(time.Minute)},
+	}}
+	idx := index.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (&index.Builder{Index: idx, Store: store}).Run(ctx)
+	for !idx.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	idx.Touch("blobs/sha256-warm")
+	idx.Touch("blobs/sha256-hot")
+
+	b := &Budget{Store: store, Index: idx, MaxBytes: 900}
+	res, err := b.Enforce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1210 bytes against a 900 budget: dropping the untouched blob is enough.
+	if want := []string{"blobs/sha256-cold"}; !slices.Equal(store.deleted, want) {
+		t.Fatalf("deleted %v, want %v", store.deleted, want)
+	}
+	if res.Deleted != 1 || res.Bytes != 400 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
+
+func TestUsageScan(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewFSStore(t.TempDir(), 0)
+	put := func(key, body string) {
+		if err := store.Put(ctx, key, strings.NewReader(body), cache.ObjectMeta{ContentLength: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("blobs/sha256-0aa", "a")
+	put("blobs/sha256-1bb", "bb")
+	put("blobs/sha256-fcc", "ccc")
+	put("blobs/sha512-dd", "dddd") // outside the sha256 shards
+	put("manifests/docker.io/library/nginx/sha256-ee", "ee")
+	put("manifests/docker.io/library/nginx/tags/latest", "ee")
+	put("manifests/ghcr.io/org/app/sha256-ff", "f")
+	put("selftest/probe", "x")
+
+	u := &Usage{Store: store, Concurrency: 3}
+	totals, err := u.Scan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Totals{
+		"blobs":               {Objects: 4, Bytes: 10},
+		"manifests/docker.io": {Objects: 2, Bytes: 4},
+		"manifests/ghcr.io":   {Objects: 1, Bytes: 1},
+	}
+	if !maps.Equal(totals, want) {
+		t.Fatalf("got %v, want %v", totals, want)
+	}
+
+	if err := store.Delete(ctx, "manifests/ghcr.io/org/app/sha256-ff"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	metrics.WriteTo(&b)
+	for _, line := range []string{
+		`oci_cache_usage_bytes{prefix="blobs"} 10`,
+		`oci_cache_usage_objects{prefix="manifests/docker.io"} 2`,
+		`oci_cache_usage_objects{prefix="manifests/ghcr.io"} 0`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+}
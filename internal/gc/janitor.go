@@ -0,0 +1,74 @@
+package gc
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var (
+	janitorRemoved = metrics.NewCounterVec("oci_janitor_removed_total",
+		"Debris of failed fills removed by the janitor, by kind (multipart-upload, temp-file, orphan-sidecar, self-test).", "kind")
+	janitorBytes = metrics.NewCounterVec("oci_janitor_removed_bytes_total",
+		"Bytes freed by the janitor, by kind.", "kind")
+)
+
+// Janitor removes what failed fills leave behind and no request will read:
+// incomplete multipart uploads, temp files, orphaned sidecars and
+// self-test probes. Nothing written in the last MinAge is touched, so
+// fills in progress are safe.
+type Janitor struct {
+	Store  cache.Cleaner
+	MinAge time.Duration
+
+	// DryRun logs what would be removed without removing it.
+	DryRun bool
+
+	// Interval between sweeps.
+	Interval time.Duration
+}
+
+// Run sweeps every Interval until ctx is cancelled.
+func (j *Janitor) Run(ctx context.Context) error {
+	t := time.NewTicker(j.Interval)
+	defer t.Stop()
+	for {
+		if _, err := j.Sweep(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("janitor sweep failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Sweep removes debris older than MinAge once, logging each item. Debris
+// removed before an error is still returned and counted.
+func (j *Janitor) Sweep(ctx context.Context) ([]cache.Debris, error) {
+	debris, err := j.Store.CleanUp(ctx, time.Now().Add(-j.MinAge), j.DryRun)
+	msg := "janitor removed debris"
+	if j.DryRun {
+		msg = "janitor would remove debris"
+	}
+	var bytes int64
+	for _, d := range debris {
+		slog.Info(msg, "kind", d.Kind, "key", d.Key, "size", d.Size, "modified", d.Modified)
+		bytes += d.Size
+		if !j.DryRun {
+			janitorRemoved.Inc(d.Kind)
+			janitorBytes.Add(float64(d.Size), d.Kind)
+		}
+	}
+	if len(debris) > 0 {
+		slog.Info("janitor sweep complete", "removed", len(debris), "bytes", bytes, "dry_run", j.DryRun)
+	}
+	return debris, err
+}
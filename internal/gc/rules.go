@@ -0,0 +1,120 @@
+package gc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// Rule is a declarative retention rule. It selects cached objects by
+// repository and tag, then says which of them to delete. An object is
+// deleted when any rule selecting it says so.
+//
+// A rule with Tag set selects only tag manifests. A rule with only
+// Repository set selects that repository's manifests. A rule with neither
+// also selects blobs, which are content-addressed and shared between
+// repositories, so they can only be aged out globally.
+type Rule struct {
+	// Repository is a pattern over "registry/name" (e.g. "ghcr.io/org/*"),
+	// matched with cache.MatchRepository. Empty selects all.
+	Repository string `json:"repository,omitempty"`
+	// Tag is a path.Match glob over tag names (e.g. "*-dev").
+	Tag string `json:"tag,omitempty"`
+
+	// KeepLast keeps the N most recently cached digest manifests per
+	// repository and deletes the rest.
+	KeepLast int `json:"keep_last,omitempty"`
+	// MaxAge deletes objects cached longer ago than this.
+	MaxAge Duration `json:"max_age,omitempty"`
+	// MaxIdle deletes objects not pulled for this long.
+	MaxIdle Duration `json:"max_idle,omitempty"`
+}
+
+// Duration is a time.Duration that also accepts a day suffix ("90d") in
+// JSON, since retention periods are naturally expressed in days.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"7d\" or \"12h\"")
+	}
+	v, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ParseDuration parses a Go duration or a whole number of days ("90d").
+func ParseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// LoadRules reads a JSON array of rules from path.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r Rule) validate() error {
+	if r.KeepLast <= 0 && r.MaxAge <= 0 && r.MaxIdle <= 0 {
+		return errors.New("rule needs at least one of keep_last, max_age or max_idle")
+	}
+	if r.KeepLast > 0 && r.Tag != "" {
+		return errors.New("keep_last applies to digest manifests and can't be combined with tag")
+	}
+	for _, pat := range []string{r.Repository, r.Tag} {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pat, err)
+		}
+	}
+	return nil
+}
+
+// selects reports whether the rule applies to obj.
+func (r Rule) selects(obj object) bool {
+	if obj.repo == "" {
+		return r.Repository == "" && r.Tag == ""
+	}
+	if r.Tag != "" {
+		if obj.tag == "" {
+			return false
+		}
+		if ok, _ := path.Match(r.Tag, obj.tag); !ok {
+			return false
+		}
+	}
+	return r.Repository == "" || cache.MatchRepository([]string{r.Repository}, obj.repo)
+}
@@ -0,0 +1,208 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var (
+	usageBytes = metrics.NewGaugeVec("oci_cache_usage_bytes",
+		"Bytes stored under each cache prefix (blobs, or manifests/<registry>) at the last usage scan.", "prefix")
+	usageObjects = metrics.NewGaugeVec("oci_cache_usage_objects",
+		"Objects stored under each cache prefix at the last usage scan.", "prefix")
+)
+
+// blobShards is how many key ranges blobs/ is split into so a scan can
+// list it in parallel. Digests are hex, so ranges split on the first digit
+// are about the same size.
+const blobShards = 16
+
+// Usage periodically lists the store and exports the bytes and objects
+// under each prefix as gauges. Blobs are shared between repositories so
+// are counted once under "blobs"; manifests are counted per registry.
+type Usage struct {
+	Store cache.Store
+
+	// Concurrency is how many listings run at once. Raising it shortens
+	// scans but spends the store's LIST budget faster.
+	Concurrency int
+
+	// Interval between scans.
+	Interval time.Duration
+
+	mu       sync.Mutex
+	exported map[string]bool // prefixes set by the last scan
+}
+
+// Totals is the usage under one prefix.
+type Totals struct {
+	Objects int64
+	Bytes   int64
+}
+
+// keyRange is a slice of the key space listed by one worker: keys under
+// prefix after from and before to (unbounded when empty).
+type keyRange struct {
+	prefix, from, to string
+}
+
+// Run scans every Interval until ctx is cancelled.
+func (u *Usage) Run(ctx context.Context) error {
+	t := time.NewTicker(u.Interval)
+	defer t.Stop()
+	for {
+		start := time.Now()
+		totals, err := u.Scan(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("usage scan failed", "error", err)
+		} else {
+			var objects, bytes int64
+			for _, t := range totals {
+				objects += t.Objects
+				bytes += t.Bytes
+			}
+			slog.Info("usage scan complete", "objects", objects, "bytes", bytes, "prefixes", len(totals), "duration", time.Since(start))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Scan lists the store once and updates the gauges. Prefixes exported by
+// the previous scan that are now empty are set to zero. The gauges are
+// left alone if any listing fails, so a partial count is never exported.
+func (u *Usage) Scan(ctx context.Context) (map[string]Totals, error) {
+	ranges := []keyRange{{prefix: "manifests/"}, {prefix: "private/"}, {prefix: "chunks/"}}
+	for i := range blobShards {
+		r := keyRange{prefix: "blobs/"}
+		if i > 0 {
+			r.from = fmt.Sprintf("blobs/sha256-%x", i)
+		}
+		if i < blobShards-1 {
+			r.to = fmt.Sprintf("blobs/sha256-%x", i+1)
+		}
+		ranges = append(ranges, r)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		totals   = make(map[string]Totals)
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, max(u.Concurrency, 1))
+	)
+	for _, r := range ranges {
+		wg.Go(func() {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+			part, err := u.scanRange(ctx, r)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			for p, t := range part {
+				sum := totals[p]
+				sum.Objects += t.Objects
+				sum.Bytes += t.Bytes
+				totals[p] = sum
+			}
+		})
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for p := range u.exported {
+		if _, ok := totals[p]; !ok {
+			usageBytes.Set(0, p)
+			usageObjects.Set(0, p)
+		}
+	}
+	u.exported = make(map[string]bool, len(totals))
+	for p, t := range totals {
+		usageBytes.Set(float64(t.Bytes), p)
+		usageObjects.Set(float64(t.Objects), p)
+		u.exported[p] = true
+	}
+	return totals, nil
+}
+
+// scanRange lists one key range and totals it by usage prefix.
+func (u *Usage) scanRange(ctx context.Context, r keyRange) (map[string]Totals, error) {
+	totals := make(map[string]Totals)
+	for info, err := range u.Store.List(ctx, r.prefix, r.from) {
+		if err != nil {
+			return nil, err
+		}
+		if r.to != "" && info.Key >= r.to {
+			break
+		}
+		p := usagePrefix(info.Key)
+		if p == "" {
+			continue
+		}
+		t := totals[p]
+		t.Objects++
+		t.Bytes += info.Size
+		totals[p] = t
+	}
+	return totals, nil
+}
+
+// usagePrefix returns the prefix key is accounted under: "blobs",
+// "chunks", "manifests/<registry>" for digest and tag manifests alike, or
+// "private" for content isolated to one client, whatever its kind. Blobs
+// and chunks stored per registry (cache.KeySchemaRegistry) are accounted
+// under "blobs/<registry>" and "chunks/<registry>".
+func usagePrefix(key string) string {
+	for _, top := range []string{"blobs", "chunks"} {
+		if strings.HasPrefix(key, top+"/") {
+			if k, ok := cache.ParseKey(key); ok && k.Registry != "" {
+				return top + "/" + k.Registry
+			}
+			return top
+		}
+	}
+	if strings.HasPrefix(key, "private/") {
+		return "private"
+	}
+	rest, ok := strings.CutPrefix(key, "manifests/")
+	if !ok {
+		return ""
+	}
+	registry, _, ok := strings.Cut(rest, "/")
+	if !ok {
+		return ""
+	}
+	return "manifests/" + registry
+}
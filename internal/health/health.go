@@ -0,0 +1,223 @@
+// Package health tracks the error rates of the proxy's dependencies and
+// moves it between degraded states as they fail and recover: the proxy
+// keeps serving what it can, and /readyz and the metrics say what it
+// can't.
+package health
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// Conditions a Monitor tracks. Each is a degradation the proxy keeps
+// serving through.
+const (
+	// CacheReadOnly: writes to the store are failing. Cached objects are
+	// still served; upstream responses are streamed without being cached.
+	CacheReadOnly = "cache-read-only"
+
+	// StaleOnly: upstream is failing. Cached objects are served, tags past
+	// their maximum staleness included, while misses still go upstream.
+	StaleOnly = "stale-only"
+
+	// RedirectsDisabled: presigning redirect URLs is failing, or clients
+	// keep coming back for objects they were redirected for. Cached
+	// objects are streamed through the proxy instead.
+	RedirectsDisabled = "redirects-disabled"
+)
+
+var conditions = []string{CacheReadOnly, StaleOnly, RedirectsDisabled}
+
+var (
+	degradedGauge = metrics.NewGaugeVec("oci_health_degraded",
+		"Whether the proxy is in each degraded state (1) or not (0).", "condition")
+	transitions = metrics.NewCounterVec("oci_health_transitions_total",
+		"Entries into (state=degraded) and exits from (state=ok) each degraded state.", "condition", "state")
+)
+
+// Defaults for a Monitor's zero fields.
+const (
+	DefaultWindow    = time.Minute
+	DefaultThreshold = 0.5
+	DefaultMinErrors = 5
+	DefaultProbe     = 10 * time.Second
+)
+
+// Monitor counts successes and failures per condition over a window. A
+// condition is entered once at least MinErrors failures make up Threshold
+// of a window's attempts, and left once a later window, past any cooldown,
+// has a success and a failure ratio below Threshold. A nil Monitor never
+// degrades.
+type Monitor struct {
+	Window    time.Duration
+	Threshold float64
+	MinErrors int
+
+	// Probe is how often an attempt is let through to a dependency the
+	// proxy has stopped using (see Allow), to notice its recovery.
+	Probe time.Duration
+
+	// Cooldowns holds, by condition, the least time the proxy stays in
+	// it once entered. No probes are let through until it has passed.
+	Cooldowns map[string]time.Duration
+
+	mu      sync.Mutex
+	signals map[string]*signal
+}
+
+// signal is one condition's state.
+type signal struct {
+	degraded  bool
+	since     time.Time // of the last transition
+	lastError string
+
+	windowStart time.Time
+	ok, failed  int
+	lastProbe   time.Time
+}
+
+// Condition describes a degraded state the proxy is in.
+type Condition struct {
+	Name      string    `json:"name"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// NewMonitor returns a Monitor with every condition reported as healthy,
+// so the gauges read zero from the start.
+func NewMonitor(window time.Duration, threshold float64, minErrors int, probe time.Duration) *Monitor {
+	for _, c := range conditions {
+		degradedGauge.Set(0, c)
+	}
+	return &Monitor{Window: window, Threshold: threshold, MinErrors: minErrors, Probe: probe}
+}
+
+// Record counts an attempt against condition's dependency; err is nil for
+// a success. Cancelled requests say nothing about the dependency and are
+// ignored.
+func (m *Monitor) Record(condition string, err error) {
+	if m == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.signal(condition)
+	if now.Sub(s.windowStart) >= m.window() {
+		s.windowStart, s.ok, s.failed = now, 0, 0
+	}
+	if err != nil {
+		s.failed++
+		s.lastError = err.Error()
+	} else {
+		s.ok++
+	}
+	ratio := float64(s.failed) / float64(s.ok+s.failed)
+	switch {
+	case !s.degraded && s.failed >= m.minErrors() && ratio >= m.threshold():
+		s.degraded, s.since = true, now
+		degradedGauge.Set(1, condition)
+		transitions.Inc(condition, "degraded")
+		slog.Warn("entering degraded state", "condition", condition, "failures", s.failed, "attempts", s.ok+s.failed, "error", s.lastError)
+	case s.degraded && s.ok > 0 && ratio < m.threshold() && s.windowStart.After(s.since) && now.Sub(s.since) >= m.Cooldowns[condition]:
+		slog.Info("leaving degraded state", "condition", condition, "degraded_for", now.Sub(s.since))
+		s.degraded, s.since = false, now
+		degradedGauge.Set(0, condition)
+		transitions.Inc(condition, "ok")
+	}
+}
+
+// Degraded reports whether the proxy is in condition.
+func (m *Monitor) Degraded(condition string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.signal(condition).degraded
+}
+
+// Allow reports whether to attempt an operation that condition's
+// dependency is failing. Outside the condition it always is; inside it,
+// one attempt per Probe goes through so recovery can be recorded.
+func (m *Monitor) Allow(condition string) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.signal(condition)
+	if !s.degraded {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(s.since) < m.Cooldowns[condition] || now.Sub(s.lastProbe) < m.probe() {
+		return false
+	}
+	s.lastProbe = now
+	return true
+}
+
+// Conditions returns the degraded states the proxy is in, by name.
+func (m *Monitor) Conditions() []Condition {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []Condition
+	for name, s := range m.signals {
+		if s.degraded {
+			out = append(out, Condition{Name: name, Since: s.since, LastError: s.lastError})
+		}
+	}
+	slices.SortFunc(out, func(a, b Condition) int { return cmp.Compare(a.Name, b.Name) })
+	return out
+}
+
+func (m *Monitor) signal(condition string) *signal {
+	if m.signals == nil {
+		m.signals = make(map[string]*signal)
+	}
+	s, ok := m.signals[condition]
+	if !ok {
+		s = &signal{}
+		m.signals[condition] = s
+	}
+	return s
+}
+
+func (m *Monitor) window() time.Duration {
+	if m.Window > 0 {
+		return m.Window
+	}
+	return DefaultWindow
+}
+
+func (m *Monitor) threshold() float64 {
+	if m.Threshold > 0 {
+		return m.Threshold
+	}
+	return DefaultThreshold
+}
+
+func (m *Monitor) minErrors() int {
+	if m.MinErrors > 0 {
+		return m.MinErrors
+	}
+	return DefaultMinErrors
+}
+
+func (m *Monitor) probe() time.Duration {
+	if m.Probe > 0 {
+		return m.Probe
+	}
+	return DefaultProbe
+}
@@ -0,0 +1,137 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestMonitorTransitions(t *testing.T) {
+	m := NewMonitor(50*time.Millisecond, 0.5, 3, time.Hour)
+	boom := errors.New("boom")
+
+	m.Record(StaleOnly, nil)
+	m.Record(StaleOnly, boom)
+	m.Record(StaleOnly, boom)
+	if m.Degraded(StaleOnly) {
+		t.Fatal("degraded below MinErrors")
+	}
+	m.Record(StaleOnly, context.Canceled)
+	m.Record(StaleOnly, boom)
+	if !m.Degraded(StaleOnly) {
+		t.Fatal("not degraded at 3 of 4 attempts failing")
+	}
+	if c := m.Conditions(); len(c) != 1 || c[0].Name != StaleOnly || c[0].LastError != "boom" {
+		t.Fatalf("conditions = %+v", c)
+	}
+
+	// Successes in the window that tripped it don't clear it.
+	m.Record(StaleOnly, nil)
+	m.Record(StaleOnly, nil)
+	m.Record(StaleOnly, nil)
+	if !m.Degraded(StaleOnly) {
+		t.Fatal("cleared within the tripping window")
+	}
+	time.Sleep(60 * time.Millisecond)
+	m.Record(StaleOnly, nil)
+	if m.Degraded(StaleOnly) || len(m.Conditions()) != 0 {
+		t.Fatal("still degraded after a healthy window")
+	}
+}
+
+func TestMonitorAllowProbes(t *testing.T) {
+	m := NewMonitor(time.Minute, 0.5, 1, time.Hour)
+	if !m.Allow(CacheReadOnly) {
+		t.Fatal("healthy condition refused")
+	}
+	m.Record(CacheReadOnly, errors.New("AccessDenied"))
+	if !m.Allow(CacheReadOnly) {
+		t.Fatal("first probe refused")
+	}
+	if m.Allow(CacheReadOnly) {
+		t.Fatal("second attempt allowed within the probe interval")
+	}
+
+	var nilMonitor *Monitor
+	nilMonitor.Record(CacheReadOnly, errors.New("x"))
+	if !nilMonitor.Allow(CacheReadOnly) || nilMonitor.Degraded(CacheReadOnly) {
+		t.Fatal("nil monitor degraded")
+	}
+}
+
+// failingStore fails every Put, and every RedirectURL with presignErr.
+type failingStore struct {
+	cache.Store
+	puts       int
+	presignErr error
+}
+
+func (f *failingStore) Put(_ context.Context, _ string, body io.Reader, _ cache.ObjectMeta) error {
+	f.puts++
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	return errors.New("disk full")
+}
+
+func (f *failingStore) RedirectURL(context.Context, string) (string, cache.ObjectMeta, error) {
+	return "", cache.ObjectMeta{}, f.presignErr
+}
+
+func TestTrack(t *testing.T) {
+	ctx := context.Background()
+	m := NewMonitor(time.Minute, 0.5, 2, time.Hour)
+	base := &failingStore{presignErr: fs.ErrNotExist}
+	store := Track(base, m)
+	redirector, ok := store.(cache.Redirector)
+	if !ok {
+		t.Fatal("Track dropped cache.Redirector")
+	}
+
+	// Bodies that fail to arrive aren't held against the store.
+	for range 3 {
+		store.Put(ctx, "k", io.MultiReader(strings.NewReader("x"), errReaderFunc{}), cache.ObjectMeta{})
+	}
+	if m.Degraded(CacheReadOnly) {
+		t.Fatal("body errors counted as store failures")
+	}
+	for range 2 {
+		store.Put(ctx, "k", strings.NewReader("x"), cache.ObjectMeta{})
+	}
+	if !m.Degraded(CacheReadOnly) {
+		t.Fatal("not read-only after write failures")
+	}
+	puts := base.puts
+	store.Put(ctx, "k", strings.NewReader("x"), cache.ObjectMeta{}) // the probe
+	if err := store.Put(ctx, "k", strings.NewReader("x"), cache.ObjectMeta{}); !errors.Is(err, errReadOnly) {
+		t.Fatalf("write while read-only: %v", err)
+	}
+	if base.puts != puts+1 {
+		t.Fatalf("store saw %d writes while read-only, want 1 probe", base.puts-puts)
+	}
+
+	// Misses aren't presign failures.
+	for range 3 {
+		redirector.RedirectURL(ctx, "k")
+	}
+	if m.Degraded(RedirectsDisabled) {
+		t.Fatal("misses counted as presign failures")
+	}
+	base.presignErr = errors.New("no credentials")
+	for range 2 {
+		redirector.RedirectURL(ctx, "k")
+	}
+	if !m.Degraded(RedirectsDisabled) {
+		t.Fatal("redirects not disabled after presign failures")
+	}
+}
+
+type errReaderFunc struct{}
+
+func (errReaderFunc) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
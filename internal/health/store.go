@@ -0,0 +1,71 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+var errReadOnly = errors.New("cache is read-only: store writes are failing")
+
+// Track wraps store so that write and presign outcomes are recorded in m,
+// and so that writes are skipped (bar probes) while they're failing.
+// Skipped writes fail fast, which callers already treat as an uncached
+// response. Whether to redirect at all is the caller's decision (see
+// Monitor.Allow). The returned store still implements cache.Redirector
+// when store does.
+func Track(store cache.Store, m *Monitor) cache.Store {
+	t := &trackingStore{Store: store, m: m}
+	if r, ok := store.(cache.Redirector); ok {
+		return &trackingRedirector{trackingStore: t, Redirector: r}
+	}
+	return t
+}
+
+type trackingStore struct {
+	cache.Store
+	m *Monitor
+}
+
+func (t *trackingStore) Put(ctx context.Context, key string, body io.Reader, meta cache.ObjectMeta) error {
+	if !t.m.Allow(CacheReadOnly) {
+		return errReadOnly
+	}
+	er := &errReader{r: body}
+	err := t.Store.Put(ctx, key, er, meta)
+	// A body that failed to arrive (upstream error, client gone) is no
+	// fault of the store, and nor is a write the proxy shed itself.
+	if er.err == nil && !errors.Is(err, cache.ErrSaturated) {
+		t.m.Record(CacheReadOnly, err)
+	}
+	return err
+}
+
+type trackingRedirector struct {
+	*trackingStore
+	cache.Redirector
+}
+
+func (t *trackingRedirector) RedirectURL(ctx context.Context, key string) (string, cache.ObjectMeta, error) {
+	url, meta, err := t.Redirector.RedirectURL(ctx, key)
+	if !cache.IsNotFound(err) {
+		t.m.Record(RedirectsDisabled, err)
+	}
+	return url, meta, err
+}
+
+// errReader remembers the error, other than EOF, its reader returned.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
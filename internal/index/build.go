@@ -0,0 +1,187 @@
+package index
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+const (
+	// scanRetryDelay is the pause before resuming a scan that failed.
+	scanRetryDelay = 30 * time.Second
+	// storeSaveTimeout bounds writing a snapshot to the store.
+	storeSaveTimeout = time.Minute
+)
+
+// Builder populates an Index by scanning a store. Scans are incremental:
+// progress is logged periodically and, when SnapshotPath or SnapshotKey is
+// set, the index and scan cursor are persisted so a restarted proxy
+// resumes an interrupted scan instead of starting over. A snapshot in the
+// store outlives the instance's disk, so a replacement starts with the
+// key set, tag targets and access times its predecessor had.
+type Builder struct {
+	Index        *Index
+	Store        cache.Store
+	SnapshotPath string        // empty disables persistence
+	SnapshotKey  string        // store key to also persist to, under cache.StatePrefix; empty disables
+	LogEvery     time.Duration // progress log interval
+	SaveEvery    time.Duration // snapshot interval, during and after the scan
+
+	// Standby, when set, reports a warm standby, whose index a primary
+	// sharing the store keeps changing: it rescans every RefreshEvery to
+	// follow, and leaves SnapshotKey, the primary's, alone.
+	Standby      func() bool
+	RefreshEvery time.Duration
+}
+
+// Run loads any existing snapshot, scans the store to completion, then keeps
+// saving snapshots until ctx is cancelled. A final snapshot is written on
+// the way out. It blocks, so callers normally run it in a goroutine.
+func (b *Builder) Run(ctx context.Context) error {
+	if b.SnapshotPath != "" {
+		if err := b.Index.LoadFile(b.SnapshotPath); err != nil {
+			slog.Warn("ignoring unreadable cache index snapshot", "path", b.SnapshotPath, "error", err)
+		} else if n := b.Index.Len(); n > 0 {
+			slog.Info("loaded cache index snapshot", "path", b.SnapshotPath, "keys", n, "ready", b.Index.Ready())
+		}
+	}
+	if b.SnapshotKey != "" && b.Index.Len() == 0 {
+		// The local file, when there is one, is this instance's own and
+		// at least as recent.
+		if err := b.Index.LoadStore(ctx, b.Store, b.SnapshotKey); err != nil {
+			slog.Warn("ignoring unreadable cache index snapshot", "key", b.SnapshotKey, "error", err)
+		} else if n := b.Index.Len(); n > 0 {
+			slog.Info("loaded cache index snapshot", "key", b.SnapshotKey, "keys", n, "ready", b.Index.Ready())
+		}
+	}
+	defer b.save()
+
+	// Retry failed scans from the last confirmed key; transient store errors
+	// shouldn't leave the index permanently partial.
+	for {
+		err := b.scan(ctx)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(scanRetryDelay):
+		}
+	}
+
+	var saves, refreshes <-chan time.Time
+	if (b.SnapshotPath != "" || b.SnapshotKey != "") && b.SaveEvery > 0 {
+		ticker := time.NewTicker(b.SaveEvery)
+		defer ticker.Stop()
+		saves = ticker.C
+	}
+	if b.Standby != nil && b.RefreshEvery > 0 {
+		ticker := time.NewTicker(b.RefreshEvery)
+		defer ticker.Stop()
+		refreshes = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-saves:
+			b.save()
+		case <-refreshes:
+			// A failed rescan resumes from its cursor next time.
+			if b.standby() {
+				b.scan(ctx)
+			}
+		}
+	}
+}
+
+func (b *Builder) standby() bool {
+	return b.Standby != nil && b.Standby()
+}
+
+func (b *Builder) scan(ctx context.Context) error {
+	cursor := b.Index.scanCursor()
+	if cursor != "" {
+		slog.Info("resuming cache index scan", "after", cursor)
+	} else {
+		slog.Info("starting cache index scan")
+	}
+
+	start := time.Now()
+	lastLog, lastSave := start, start
+	var scanned, bytes, resolved int64
+
+	for obj, err := range b.Store.List(ctx, "", cursor) {
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("cache index scan failed, will resume", "error", err, "scanned", scanned, "retry_in", scanRetryDelay)
+			}
+			return err
+		}
+		if strings.HasPrefix(obj.Key, cache.StatePrefix) {
+			continue // the proxy's own state, not cached content
+		}
+		b.Index.confirm(obj.Key, obj.Size, obj.LastModified)
+		if b.Index.unresolvedTag(obj.Key) {
+			if digest, children, err := resolveTag(ctx, b.Store, obj.Key); err == nil {
+				b.Index.resolve(obj.Key, digest, children)
+				resolved++
+			}
+		}
+		scanned++
+		bytes += obj.Size
+
+		now := time.Now()
+		if b.LogEvery > 0 && now.Sub(lastLog) >= b.LogEvery {
+			lastLog = now
+			slog.Info("cache index scan progress",
+				"scanned", scanned,
+				"bytes", bytes,
+				"keys_per_sec", int64(float64(scanned)/now.Sub(start).Seconds()),
+				"cursor", obj.Key,
+			)
+		}
+		if b.SaveEvery > 0 && now.Sub(lastSave) >= b.SaveEvery {
+			lastSave = now
+			b.save()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	pruned := b.Index.finishScan()
+	slog.Info("cache index scan complete",
+		"scanned", scanned,
+		"bytes", bytes,
+		"pruned", pruned,
+		"tags_resolved", resolved,
+		"keys", b.Index.Len(),
+		"duration", time.Since(start).Round(time.Millisecond),
+	)
+	b.save()
+	return nil
+}
+
+func (b *Builder) save() {
+	if b.SnapshotPath != "" {
+		if err := b.Index.SaveFile(b.SnapshotPath); err != nil {
+			slog.Warn("failed to save cache index snapshot", "path", b.SnapshotPath, "error", err)
+		}
+	}
+	if b.SnapshotKey != "" && !b.standby() {
+		// Saves run on the way out too, after ctx is cancelled.
+		ctx, cancel := context.WithTimeout(context.Background(), storeSaveTimeout)
+		defer cancel()
+		if err := b.Index.SaveStore(ctx, b.Store, b.SnapshotKey); err != nil {
+			slog.Warn("failed to save cache index snapshot", "key", b.SnapshotKey, "error", err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package index maintains an in-memory inventory of cached keys, built by
+// scanning the store at startup and kept current as the proxy writes new
+// entries.
+package index
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is the indexed state of a single cached data object.
+type Entry struct {
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+
+	// LastAccess is when the object was last served from the cache (or
+	// written). Zero if it hasn't been read since the index learned of it.
+	LastAccess time.Time `json:"last_access,omitzero"`
+
+	// Digest is, for a tag, the manifest it points at, and Children the
+	// platform manifests of that manifest if it is an index. Empty until
+	// learned; see References.
+	Digest   string   `json:"digest,omitempty"`
+	Children []string `json:"children,omitempty"`
+
+	// gen is the scan generation that last confirmed this entry exists.
+	// Entries not confirmed by a completed scan are pruned.
+	gen uint64
+}
+
+// Stats summarises the indexed objects under a top-level key prefix
+// (e.g. "blobs" or "manifests").
+type Stats struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Index is a concurrency-safe set of cached keys with their sizes.
+// Until the first full scan completes (or a complete snapshot is loaded),
+// the index is partial and Ready reports false — callers must not treat an
+// absent key as a definitive miss before then.
+type Index struct {
+	mu      sync.RWMutex
+	entries map[string]Entry
+	ready   bool
+
+	// Scan state, persisted in snapshots so an interrupted build resumes.
+	gen    uint64
+	cursor string
+}
+
+// New returns an empty, not-yet-ready index.
+func New() *Index {
+	return &Index{entries: make(map[string]Entry), gen: 1}
+}
+
+// Add records a key as present. It is called for freshly written entries,
+// which count as confirmed by the scan currently in progress.
+func (x *Index) Add(key string, size int64, modTime time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries[key] = Entry{Size: size, LastModified: modTime, LastAccess: modTime, gen: x.gen}
+}
+
+// Touch records that key was just served. Unindexed keys are ignored.
+func (x *Index) Touch(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[key]; ok {
+		e.LastAccess = time.Now()
+		x.entries[key] = e
+	}
+}
+
+// LastAccess returns when key was last served, falling back to when it was
+// cached if it hasn't been read since.
+func (x *Index) LastAccess(key string) (time.Time, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	e, ok := x.entries[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	if e.LastAccess.IsZero() {
+		return e.LastModified, true
+	}
+	return e.LastAccess, true
+}
+
+// Remove drops a key from the index.
+func (x *Index) Remove(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.entries, key)
+}
+
+// Get returns the entry for key, if indexed.
+func (x *Index) Get(key string) (Entry, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	e, ok := x.entries[key]
+	return e, ok
+}
+
+// Ready reports whether the index reflects a complete scan of the store.
+func (x *Index) Ready() bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.ready
+}
+
+// Len returns the number of indexed keys.
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.entries)
+}
+
+// Stats returns object counts and total bytes grouped by the first key
+// segment ("blobs", "manifests", ...).
+func (x *Index) Stats() map[string]Stats {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	out := make(map[string]Stats)
+	for key, e := range x.entries {
+		top, _, _ := strings.Cut(key, "/")
+		s := out[top]
+		s.Objects++
+		s.Bytes += e.Size
+		out[top] = s
+	}
+	return out
+}
+
+// Each calls fn for every indexed key until fn returns false. The index is
+// read-locked for the duration, so fn must not call back into the index.
+func (x *Index) Each(fn func(key string, e Entry) bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for key, e := range x.entries {
+		if !fn(key, e) {
+			return
+		}
+	}
+}
+
+// confirm marks a key as seen by the current scan and advances the cursor.
+// A tag's learned target is kept unless the object looks rewritten: the
+// index records writes at their own clock, so the stored time may differ
+// by a little.
+func (x *Index) confirm(key string, size int64, modTime time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	prev := x.entries[key]
+	e := Entry{Size: size, LastModified: modTime, LastAccess: prev.LastAccess, gen: x.gen}
+	if prev.Size == size && !modTime.After(prev.LastModified.Add(time.Minute)) {
+		e.Digest, e.Children = prev.Digest, prev.Children
+	}
+	x.entries[key] = e
+	x.cursor = key
+}
+
+// finishScan prunes entries the completed scan did not see, marks the index
+// ready, and starts a new generation for the next scan.
+func (x *Index) finishScan() (pruned int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key, e := range x.entries {
+		if e.gen < x.gen {
+			delete(x.entries, key)
+			pruned++
+		}
+	}
+	x.ready = true
+	x.gen++
+	x.cursor = ""
+	return pruned
+}
+
+// scanCursor returns the key the current scan should resume after.
+func (x *Index) scanCursor() string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.cursor
+}
@@ -0,0 +1,224 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"iter"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// sliceLister is a cache.Store whose listing is a sorted slice of keys.
+type sliceLister struct {
+	cache.Store
+	keys []string
+}
+
+func (l *sliceLister) List(_ context.Context, prefix, startAfter string) iter.Seq2[cache.ObjectInfo, error] {
+	return func(yield func(cache.ObjectInfo, error) bool) {
+		for _, k := range l.keys {
+			if !strings.HasPrefix(k, prefix) || (startAfter != "" && k <= startAfter) {
+				continue
+			}
+			if !yield(cache.ObjectInfo{Key: k, Size: 10}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func TestScanPrunesMissingKeys(t *testing.T) {
+	idx := New()
+	idx.Add("blobs/stale", 5, time.Now())
+	idx.finishScan() // pretend a previous scan saw "stale"
+
+	b := &Builder{Index: idx, Store: &sliceLister{keys: []string{"blobs/a", "blobs/b", "manifests/x"}}}
+	if err := b.scan(context.Background()); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+
+	if !idx.Ready() {
+		t.Fatal("expected index to be ready after scan")
+	}
+	if _, ok := idx.Get("blobs/stale"); ok {
+		t.Fatal("expected stale key to be pruned")
+	}
+	stats := idx.Stats()
+	if stats["blobs"].Objects != 2 || stats["blobs"].Bytes != 20 || stats["manifests"].Objects != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSnapshotResumesScan(t *testing.T) {
+	lister := &sliceLister{keys: []string{"blobs/a", "blobs/b", "blobs/c"}}
+
+	// Interrupt a scan after the first key.
+	idx := New()
+	for obj := range lister.List(context.Background(), "", "") {
+		idx.confirm(obj.Key, obj.Size, obj.LastModified)
+		break
+	}
+
+	var buf bytes.Buffer
+	if err := idx.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("write snapshot: %v", err)
+	}
+
+	restored := New()
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+	if restored.Ready() {
+		t.Fatal("partial snapshot must not be ready")
+	}
+	if got := restored.scanCursor(); got != "blobs/a" {
+		t.Fatalf("expected cursor blobs/a, got %q", got)
+	}
+
+	b := &Builder{Index: restored, Store: lister}
+	if err := b.scan(context.Background()); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if restored.Len() != 3 {
+		t.Fatalf("expected 3 keys after resumed scan, got %d", restored.Len())
+	}
+}
+
+func TestReferences(t *testing.T) {
+	ctx := context.Background()
+	base := cache.NewFSStore(t.TempDir(), 0)
+	idx := New()
+	store := Track(base, idx)
+	put := func(s cache.Store, key, digest, body string) {
+		t.Helper()
+		meta := cache.ObjectMeta{DockerContentDigest: digest, ContentLength: int64(len(body)),
+			Header: http.Header{"Docker-Content-Digest": {digest}}}
+		if err := s.Put(ctx, key, strings.NewReader(body), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json",` +
+		`"manifests":[{"digest":"sha256:amd64"},{"digest":"sha256:arm64"}]}`
+	put(store, cache.TagKey("ghcr.io/org/app", "v1"), "sha256:index", index)
+	put(store, cache.TagKey("ghcr.io/org/app", "latest"), "sha256:index", index)
+	put(store, cache.TagKey("ghcr.io/org/tool", "v2"), "sha256:other", `{"schemaVersion":2}`)
+	// Written behind the index's back, e.g. by another process: learned by the scan.
+	put(base, cache.PrivateKey("abc", cache.TagKey("ghcr.io/org/private", "1")), "sha256:arm64", `{"schemaVersion":2}`)
+
+	if err := (&Builder{Index: idx, Store: base}).scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tags := func(x *Index, digest string) []string {
+		var out []string
+		for _, r := range x.References(digest) {
+			out = append(out, r.Repository+":"+r.Tag)
+		}
+		return out
+	}
+	if got := strings.Join(tags(idx, "sha256:arm64"), ","); got != "ghcr.io/org/app:latest,ghcr.io/org/app:v1,ghcr.io/org/private:1" {
+		t.Errorf("platform digest: %s", got)
+	}
+	if got := idx.References("sha256:index"); len(got) != 2 || got[0].Manifest != "sha256:index" || got[0].Private {
+		t.Errorf("index digest: %+v", got)
+	}
+	if got := idx.References("sha256:missing"); len(got) != 0 {
+		t.Errorf("unknown digest: %+v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := idx.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := New()
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := tags(restored, "sha256:other"); len(got) != 1 || got[0] != "ghcr.io/org/tool:v2" {
+		t.Errorf("after snapshot: %v", got)
+	}
+}
+
+func TestSnapshotInStore(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewFSStore(t.TempDir(), 0)
+	key := cache.StatePrefix + "index/test"
+	if err := New().LoadStore(ctx, store, key); err != nil {
+		t.Fatalf("missing snapshot: %v", err)
+	}
+
+	meta := cache.ObjectMeta{ContentLength: 4, Header: http.Header{"Content-Length": {"4"}}}
+	if err := store.Put(ctx, "blobs/sha256-a", strings.NewReader("blob"), meta); err != nil {
+		t.Fatal(err)
+	}
+	idx := New()
+	b := &Builder{Index: idx, Store: store, SnapshotKey: key}
+	if err := b.scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	idx.Touch("blobs/sha256-a")
+	accessed, _ := idx.LastAccess("blobs/sha256-a")
+	// Saving again replaces the previous snapshot.
+	b.save()
+	b.save()
+
+	// The snapshot itself is state, not cached content.
+	if err := b.scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.Get(key); ok || idx.Len() != 1 {
+		t.Fatalf("snapshot object indexed: %d keys", idx.Len())
+	}
+
+	restored := New()
+	if err := restored.LoadStore(ctx, store, key); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Ready() || restored.Len() != 1 {
+		t.Fatalf("restored %d keys, ready %v", restored.Len(), restored.Ready())
+	}
+	if got, ok := restored.LastAccess("blobs/sha256-a"); !ok || !got.Equal(accessed) {
+		t.Errorf("access time %v, want %v", got, accessed)
+	}
+}
+
+func TestStandbyFollowsStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := cache.NewFSStore(t.TempDir(), 0)
+	put := func(key string) {
+		t.Helper()
+		if err := store.Put(ctx, key, strings.NewReader("x"), cache.ObjectMeta{ContentLength: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("blobs/sha256-a")
+
+	idx := New()
+	snapshotKey := cache.StatePrefix + "index/test"
+	b := &Builder{Index: idx, Store: store, SnapshotKey: snapshotKey, SaveEvery: 10 * time.Millisecond,
+		Standby: func() bool { return true }, RefreshEvery: 10 * time.Millisecond}
+	done := make(chan error)
+	go func() { done <- b.Run(ctx) }()
+
+	// Written by the primary: learned by a rescan.
+	put("blobs/sha256-b")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := idx.Get("blobs/sha256-b"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("standby index never learned of a new key")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if _, err := store.Head(context.Background(), snapshotKey); !cache.IsNotFound(err) {
+		t.Errorf("standby wrote the primary's snapshot: %v", err)
+	}
+}
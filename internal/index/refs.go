@@ -0,0 +1,129 @@
+package index
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// Reference is a cached tag resolving to a digest, either directly or
+// through the index (manifest list) the tag points at.
+type Reference struct {
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Manifest   string    `json:"manifest"` // the digest the tag points at
+	Private    bool      `json:"private,omitempty"`
+	CachedAt   time.Time `json:"cached_at"`
+}
+
+// References lists the cached tags that resolve to the manifest digest,
+// by repository and tag: "which tags point at this image?". Tags whose
+// target the index hasn't learned yet (written by another process since
+// the last scan) are missing until the next scan.
+func (x *Index) References(digest string) []Reference {
+	x.mu.RLock()
+	var refs []Reference
+	for key, e := range x.entries {
+		if e.Digest == "" || (e.Digest != digest && !slices.Contains(e.Children, digest)) {
+			continue
+		}
+		k, ok := cache.ParseKey(key)
+		if !ok || k.Kind != "tag" {
+			continue
+		}
+		refs = append(refs, Reference{
+			Repository: k.Repository,
+			Tag:        k.Tag,
+			Manifest:   e.Digest,
+			Private:    k.Principal != "",
+			CachedAt:   e.LastModified,
+		})
+	}
+	x.mu.RUnlock()
+	slices.SortFunc(refs, func(a, b Reference) int {
+		return cmp.Or(cmp.Compare(a.Repository, b.Repository), cmp.Compare(a.Tag, b.Tag), cmp.Compare(a.Manifest, b.Manifest))
+	})
+	return refs
+}
+
+// resolve records what the tag at key points at. Unindexed keys are
+// ignored.
+func (x *Index) resolve(key, digest string, children []string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[key]; ok {
+		e.Digest, e.Children = digest, children
+		x.entries[key] = e
+	}
+}
+
+// unresolvedTag reports whether key is a tag whose target isn't known.
+func (x *Index) unresolvedTag(key string) bool {
+	if k, ok := cache.ParseKey(key); !ok || k.Kind != "tag" {
+		return false
+	}
+	e, ok := x.Get(key)
+	return ok && e.Digest == ""
+}
+
+// tagTarget works out the digest a cached tag manifest points at and, for
+// an index, the digests of its platform manifests. body may be cut short,
+// in which case only the recorded digest is used.
+func tagTarget(meta cache.ObjectMeta, body []byte, complete bool) (digest string, children []string) {
+	digest = meta.DockerContentDigest
+	if digest == "" && complete {
+		sum := sha256.Sum256(body)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	if !complete {
+		return digest, nil
+	}
+	m, err := manifest.Parse(body)
+	if err != nil || !m.IsIndex() {
+		return digest, nil
+	}
+	for _, d := range m.Manifests {
+		children = append(children, d.Digest)
+	}
+	return digest, children
+}
+
+// resolveTag reads a cached tag manifest to learn its target.
+func resolveTag(ctx context.Context, store cache.Store, key string) (digest string, children []string, err error) {
+	res, err := store.GetWithMeta(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, manifest.DefaultMaxSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+	digest, children = tagTarget(res.Meta, body, len(body) <= manifest.DefaultMaxSize)
+	return digest, children, nil
+}
+
+// cappedBuffer keeps the first max bytes written to it, so a tag manifest
+// can be inspected after it is stored without buffering anything larger.
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.truncated = true
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,166 @@
+package index
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// snapshotVersion is bumped whenever the on-disk format changes; snapshots
+// with a different version are ignored and the index is rebuilt.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int                      `json:"version"`
+	SavedAt time.Time                `json:"saved_at"`
+	Ready   bool                     `json:"ready"`
+	Gen     uint64                   `json:"gen"`
+	Cursor  string                   `json:"cursor"`
+	Entries map[string]snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Size         int64     `json:"s"`
+	LastModified time.Time `json:"m"`
+	Gen          uint64    `json:"g"`
+	LastAccess   time.Time `json:"a,omitzero"`
+	Digest       string    `json:"d,omitempty"`
+	Children     []string  `json:"c,omitempty"`
+}
+
+// WriteSnapshot serialises the index, including in-progress scan state, as
+// gzipped JSON.
+func (x *Index) WriteSnapshot(w io.Writer) error {
+	x.mu.RLock()
+	snap := snapshot{
+		Version: snapshotVersion,
+		SavedAt: time.Now().UTC(),
+		Ready:   x.ready,
+		Gen:     x.gen,
+		Cursor:  x.cursor,
+		Entries: make(map[string]snapshotEntry, len(x.entries)),
+	}
+	for key, e := range x.entries {
+		snap.Entries[key] = snapshotEntry{Size: e.Size, LastModified: e.LastModified, Gen: e.gen, LastAccess: e.LastAccess,
+			Digest: e.Digest, Children: e.Children}
+	}
+	x.mu.RUnlock()
+
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(snap); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadSnapshot replaces the index contents with a snapshot written by
+// WriteSnapshot.
+func (x *Index) ReadSnapshot(r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	var snap snapshot
+	if err := json.NewDecoder(zr).Decode(&snap); err != nil {
+		return err
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	entries := make(map[string]Entry, len(snap.Entries))
+	for key, e := range snap.Entries {
+		entries[key] = Entry{Size: e.Size, LastModified: e.LastModified, LastAccess: e.LastAccess, gen: e.Gen,
+			Digest: e.Digest, Children: e.Children}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries = entries
+	x.ready = snap.Ready
+	x.gen = max(snap.Gen, 1)
+	x.cursor = snap.Cursor
+	return nil
+}
+
+// SaveFile atomically writes a snapshot to path via a temp file + rename.
+func (x *Index) SaveFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-index-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if err := x.WriteSnapshot(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+// LoadFile restores a snapshot from path. A missing file is not an error.
+func (x *Index) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return x.ReadSnapshot(f)
+}
+
+// SaveStore writes a snapshot to key in store, so an instance without the
+// previous one's disk can still start from it. Stores only create
+// objects, so the previous snapshot is deleted first; a crash in between
+// leaves none, and the next start scans from scratch.
+func (x *Index) SaveStore(ctx context.Context, store cache.Store, key string) error {
+	var buf bytes.Buffer
+	if err := x.WriteSnapshot(&buf); err != nil {
+		return err
+	}
+	if err := store.Delete(ctx, key); err != nil && !cache.IsNotFound(err) {
+		return err
+	}
+	h := make(http.Header)
+	h.Set("Content-Type", "application/gzip")
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	meta := cache.ObjectMeta{ContentType: "application/gzip", ContentLength: int64(buf.Len()), Header: h}
+	return store.Put(ctx, key, &buf, meta)
+}
+
+// LoadStore restores a snapshot from key in store. A missing object is
+// not an error.
+func (x *Index) LoadStore(ctx context.Context, store cache.Store, key string) error {
+	res, err := store.GetWithMeta(ctx, key)
+	if cache.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return x.ReadSnapshot(res.Body)
+}
@@ -0,0 +1,100 @@
+package index
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// Track wraps store so that successful writes and deletes are reflected
+// in idx, and cache hits update entries' last-access time. The
+// returned store still implements cache.Redirector when the wrapped store
+// does, so S3 hits keep redirecting.
+func Track(store cache.Store, idx *Index) cache.Store {
+	t := &trackingStore{Store: store, idx: idx}
+	if r, ok := store.(cache.Redirector); ok {
+		return &trackingRedirector{trackingStore: t, Redirector: r}
+	}
+	return t
+}
+
+type trackingStore struct {
+	cache.Store
+	idx *Index
+}
+
+func (t *trackingStore) Put(ctx context.Context, key string, body io.Reader, meta cache.ObjectMeta) error {
+	// Tag manifests are kept as they stream past, to learn their target.
+	var tag *cappedBuffer
+	if k, ok := cache.ParseKey(key); ok && k.Kind == "tag" {
+		tag = &cappedBuffer{max: manifest.DefaultMaxSize}
+		body = io.TeeReader(body, tag)
+	}
+	cr := &countingReader{r: body}
+	if err := t.Store.Put(ctx, key, cr, meta); err != nil {
+		return err
+	}
+	size := meta.ContentLength
+	if size <= 0 {
+		size = cr.n
+	}
+	t.idx.Add(key, size, time.Now())
+	if tag != nil {
+		digest, children := tagTarget(meta, tag.Bytes(), !tag.truncated)
+		t.idx.resolve(key, digest, children)
+	}
+	return nil
+}
+
+func (t *trackingStore) Head(ctx context.Context, key string) (cache.ObjectMeta, error) {
+	meta, err := t.Store.Head(ctx, key)
+	if err == nil {
+		t.idx.Touch(key)
+	}
+	return meta, err
+}
+
+func (t *trackingStore) GetWithMeta(ctx context.Context, key string) (*cache.GetResult, error) {
+	res, err := t.Store.GetWithMeta(ctx, key)
+	if err == nil {
+		t.idx.Touch(key)
+	}
+	return res, err
+}
+
+func (t *trackingStore) Delete(ctx context.Context, key string) error {
+	if err := t.Store.Delete(ctx, key); err != nil {
+		return err
+	}
+	t.idx.Remove(key)
+	return nil
+}
+
+type trackingRedirector struct {
+	*trackingStore
+	cache.Redirector
+}
+
+func (t *trackingRedirector) RedirectURL(ctx context.Context, key string) (string, cache.ObjectMeta, error) {
+	url, meta, err := t.Redirector.RedirectURL(ctx, key)
+	if err == nil {
+		t.idx.Touch(key)
+	}
+	return url, meta, err
+}
+
+// countingReader counts bytes read, so the index records the stored size
+// even when the upstream response had no Content-Length.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,211 @@
+// Package k8swarm keeps the images used by Kubernetes workloads warm in
+// the cache, so node replacements and scale-ups pull from the cache rather
+// than the upstream registry. It talks to the Kubernetes API over plain
+// REST with the pod's service account, so it adds no client libraries.
+package k8swarm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Discoverer lists the images referenced by workloads in a set of
+// namespaces.
+type Discoverer struct {
+	// APIServer is the base URL of the Kubernetes API, e.g.
+	// "https://10.0.0.1:443".
+	APIServer string
+
+	// Namespaces to scan. A single "*" scans the whole cluster.
+	Namespaces []string
+
+	// TokenFile holds the bearer token. It is re-read on every request
+	// because projected service account tokens rotate.
+	TokenFile string
+
+	Client *http.Client
+}
+
+// InCluster returns a Discoverer that uses the pod's service account.
+func InCluster(namespaces []string) (*Discoverer, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod (KUBERNETES_SERVICE_HOST is unset)")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("service account CA contains no certificates")
+	}
+	return &Discoverer{
+		APIServer:  "https://" + net.JoinHostPort(host, port),
+		Namespaces: namespaces,
+		TokenFile:  serviceAccountDir + "/token",
+		Client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		},
+	}, nil
+}
+
+// workloadResources are the API paths listed per namespace, relative to
+// the group-version root.
+var workloadResources = []string{
+	"/apis/apps/v1/%sdeployments",
+	"/apis/apps/v1/%sdaemonsets",
+	"/apis/apps/v1/%sstatefulsets",
+	"/apis/batch/v1/%scronjobs",
+}
+
+// podSpec is the subset of a pod spec that names images.
+type podSpec struct {
+	Containers     []struct{ Image string } `json:"containers"`
+	InitContainers []struct{ Image string } `json:"initContainers"`
+}
+
+// workloadList decodes deployments, daemonsets and statefulsets
+// (spec.template.spec) as well as cronjobs
+// (spec.jobTemplate.spec.template.spec).
+type workloadList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Spec struct {
+			Template struct {
+				Spec podSpec `json:"spec"`
+			} `json:"template"`
+			JobTemplate struct {
+				Spec struct {
+					Template struct {
+						Spec podSpec `json:"spec"`
+					} `json:"template"`
+				} `json:"spec"`
+			} `json:"jobTemplate"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// Images returns the distinct, normalised image references used by
+// workloads in the configured namespaces, sorted.
+func (d *Discoverer) Images(ctx context.Context) ([]string, error) {
+	seen := make(map[string]struct{})
+	add := func(spec podSpec) {
+		for _, c := range append(spec.Containers, spec.InitContainers...) {
+			if img := NormalizeImage(c.Image); img != "" {
+				seen[img] = struct{}{}
+			}
+		}
+	}
+
+	for _, ns := range d.Namespaces {
+		scope := "namespaces/" + url.PathEscape(ns) + "/"
+		if ns == "*" {
+			scope = ""
+		}
+		for _, res := range workloadResources {
+			path := fmt.Sprintf(res, scope)
+			for cont := ""; ; {
+				var list workloadList
+				if err := d.get(ctx, path, cont, &list); err != nil {
+					return nil, err
+				}
+				for _, item := range list.Items {
+					add(item.Spec.Template.Spec)
+					add(item.Spec.JobTemplate.Spec.Template.Spec)
+				}
+				if cont = list.Metadata.Continue; cont == "" {
+					break
+				}
+			}
+		}
+	}
+
+	out := make([]string, 0, len(seen))
+	for img := range seen {
+		out = append(out, img)
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+func (d *Discoverer) get(ctx context.Context, path, cont string, v any) error {
+	q := url.Values{"limit": {"500"}}
+	if cont != "" {
+		q.Set("continue", cont)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.APIServer+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if d.TokenFile != "" {
+		token, err := os.ReadFile(d.TokenFile)
+		if err != nil {
+			return fmt.Errorf("reading service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("listing %s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// NormalizeImage expands a Kubernetes image reference to the fully
+// qualified form the proxy warms: "nginx" becomes
+// "docker.io/library/nginx:latest", and a reference with both a tag and a
+// digest keeps only the digest, as the runtime would.
+func NormalizeImage(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	first, rest, ok := strings.Cut(ref, "/")
+	if !ok || !(strings.ContainsAny(first, ".:") || first == "localhost") {
+		first, rest = "docker.io", ref
+	}
+	if first == "docker.io" && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+
+	name, digest, hasDigest := strings.Cut(rest, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		if hasDigest {
+			name = name[:i]
+		}
+	} else if !hasDigest {
+		name += ":latest"
+	}
+	if hasDigest {
+		return first + "/" + name + "@" + digest
+	}
+	return first + "/" + name
+}
@@ -0,0 +1,60 @@
+package k8swarm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestNormalizeImage(t *testing.T) {
+	for in, want := range map[string]string{
+		"nginx":                              "docker.io/library/nginx:latest",
+		"bitnami/redis:7":                    "docker.io/bitnami/redis:7",
+		"ghcr.io/org/app":                    "ghcr.io/org/app:latest",
+		"localhost:5000/app:v1":              "localhost:5000/app:v1",
+		"quay.io/org/app:v1@sha256:abc":      "quay.io/org/app@sha256:abc",
+		"registry.k8s.io/pause@sha256:abc":   "registry.k8s.io/pause@sha256:abc",
+		"mirror.internal:8443/library/nginx": "mirror.internal:8443/library/nginx:latest",
+	} {
+		if got := NormalizeImage(in); got != want {
+			t.Errorf("NormalizeImage(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDiscovererImages(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apis/apps/v1/namespaces/prod/deployments":
+			if r.URL.Query().Get("continue") == "" {
+				fmt.Fprint(w, `{"metadata":{"continue":"next"},"items":[{"spec":{"template":{"spec":{
+					"containers":[{"image":"nginx"}],"initContainers":[{"image":"busybox:1.36"}]}}}}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"items":[{"spec":{"template":{"spec":{"containers":[{"image":"nginx:latest"}]}}}}]}`)
+		case "/apis/batch/v1/namespaces/prod/cronjobs":
+			fmt.Fprint(w, `{"items":[{"spec":{"jobTemplate":{"spec":{"template":{"spec":{
+				"containers":[{"image":"ghcr.io/org/backup:v2"}]}}}}}}]}`)
+		default:
+			fmt.Fprint(w, `{"items":[]}`)
+		}
+	}))
+	defer api.Close()
+
+	d := &Discoverer{APIServer: api.URL, Namespaces: []string{"prod"}}
+	got, err := d.Images(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"docker.io/library/busybox:1.36",
+		"docker.io/library/nginx:latest",
+		"ghcr.io/org/backup:v2",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
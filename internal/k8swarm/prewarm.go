@@ -0,0 +1,85 @@
+package k8swarm
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+)
+
+var (
+	prewarmObjects = metrics.NewCounterVec("oci_k8s_prewarm_objects_total",
+		"Manifests and blobs resolved by Kubernetes prewarming, by outcome.", "status")
+	prewarmImages = metrics.NewCounterVec("oci_k8s_prewarm_images_total",
+		"Images processed by Kubernetes prewarming, by outcome.", "result")
+)
+
+// Prewarmer periodically discovers workload images and warms them.
+type Prewarmer struct {
+	Discoverer *Discoverer
+
+	// Warm pulls an image through the cache; see proxy.Handler.Warm.
+	Warm func(ctx context.Context, image, authorization string, progress func(proxy.WarmEvent)) error
+
+	// Serves reports whether an image's registry is proxied by this
+	// cache. Images from other registries are skipped.
+	Serves func(image string) bool
+
+	Interval time.Duration
+}
+
+// Run warms the discovered images every Interval until ctx is cancelled.
+func (p *Prewarmer) Run(ctx context.Context) error {
+	t := time.NewTicker(p.Interval)
+	defer t.Stop()
+	for {
+		p.sync(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// sync runs one discovery and warm pass. Already-cached objects cost only
+// a store lookup, so re-warming the full set each pass is cheap and also
+// picks up tags that moved since the last pass.
+func (p *Prewarmer) sync(ctx context.Context) {
+	images, err := p.Discoverer.Images(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("kubernetes image discovery failed", "error", err)
+		}
+		return
+	}
+
+	var warmed, skipped, failed int
+	for _, image := range images {
+		if ctx.Err() != nil {
+			return
+		}
+		if p.Serves != nil && !p.Serves(image) {
+			slog.Debug("prewarm skipping image from unproxied registry", "image", image)
+			skipped++
+			prewarmImages.Inc("skipped")
+			continue
+		}
+		err := p.Warm(ctx, image, "", func(ev proxy.WarmEvent) {
+			prewarmObjects.Inc(ev.Status)
+			if ev.Err != nil {
+				slog.Warn("prewarm object failed", "image", image, "kind", ev.Kind, "digest", ev.Digest, "error", ev.Err)
+			}
+		})
+		if err != nil {
+			failed++
+			prewarmImages.Inc("failed")
+			continue
+		}
+		warmed++
+		prewarmImages.Inc("warmed")
+	}
+	slog.Info("kubernetes prewarm pass complete", "images", len(images), "warmed", warmed, "skipped", skipped, "failed", failed)
+}
@@ -0,0 +1,163 @@
+// Package lifecycle starts the proxy's long-running subsystems (servers,
+// collectors, pollers), tracks their health, and stops them in reverse
+// start order on shutdown so that, for example, listeners drain before the
+// cache index writes its final snapshot.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/recovery"
+)
+
+// State is a subsystem's position in its lifecycle.
+type State string
+
+const (
+	StateRunning State = "running"
+	StateStopped State = "stopped"
+	StateFailed  State = "failed"
+)
+
+// Subsystem is a named long-running component.
+type Subsystem struct {
+	Name string
+
+	// Run blocks until ctx is cancelled (or Stop is called) and then
+	// returns nil or ctx's error. Any other return is a failure.
+	Run func(ctx context.Context) error
+
+	// Stop, if set, asks Run to return, within ctx's deadline; servers use
+	// it to drain connections. Without it Run's context is cancelled.
+	Stop func(ctx context.Context) error
+
+	// Critical subsystems end the process when they fail: the failure is
+	// delivered on Manager.Fatal.
+	Critical bool
+}
+
+// Status reports one subsystem's health.
+type Status struct {
+	Name  string    `json:"name"`
+	State State     `json:"state"`
+	Since time.Time `json:"since"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Manager runs subsystems. The zero value is not usable; call New.
+type Manager struct {
+	mu       sync.Mutex
+	subs     []*running
+	stopping bool
+	fatal    chan error
+}
+
+type running struct {
+	Subsystem
+	cancel context.CancelFunc
+	done   chan struct{}
+	status Status
+}
+
+// New returns an empty manager.
+func New() *Manager {
+	return &Manager{fatal: make(chan error, 1)}
+}
+
+// Start runs s in the background under a context derived from ctx. ctx
+// should outlive the shutdown signal: Shutdown cancels subsystems one at a
+// time, in order, and cancelling ctx would stop them all at once.
+func (m *Manager) Start(ctx context.Context, s Subsystem) {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &running{
+		Subsystem: s,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		status:    Status{Name: s.Name, State: StateRunning, Since: time.Now()},
+	}
+	m.mu.Lock()
+	m.subs = append(m.subs, r)
+	m.mu.Unlock()
+
+	go func() {
+		defer close(r.done)
+		// A panicking subsystem fails like one returning an error, so a
+		// critical one still shuts the process down in order.
+		err := recovery.Do(s.Name, func() error { return s.Run(ctx) })
+		m.finished(r, err)
+	}()
+}
+
+// finished records how a subsystem's Run returned.
+func (m *Manager) finished(r *running, err error) {
+	m.mu.Lock()
+	r.status.Since = time.Now()
+	if err == nil || errors.Is(err, context.Canceled) || m.stopping {
+		r.status.State = StateStopped
+	} else {
+		r.status.State = StateFailed
+		r.status.Error = err.Error()
+	}
+	failed := r.status.State == StateFailed
+	m.mu.Unlock()
+
+	if !failed {
+		slog.Debug("subsystem stopped", "subsystem", r.Name)
+		return
+	}
+	slog.Error("subsystem failed", "subsystem", r.Name, "critical", r.Critical, "error", err)
+	if r.Critical {
+		select {
+		case m.fatal <- fmt.Errorf("%s: %w", r.Name, err):
+		default:
+		}
+	}
+}
+
+// Fatal delivers the first failure of a critical subsystem.
+func (m *Manager) Fatal() <-chan error {
+	return m.fatal
+}
+
+// Shutdown stops every subsystem, most recently started first, waiting for
+// each to return before moving on to the next. Subsystems still running
+// when ctx expires are abandoned and reported in the returned error.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.stopping = true
+	subs := append([]*running(nil), m.subs...)
+	m.mu.Unlock()
+
+	var errs []error
+	for i := len(subs) - 1; i >= 0; i-- {
+		r := subs[i]
+		if r.Stop != nil {
+			if err := r.Stop(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("stopping %s: %w", r.Name, err))
+			}
+		}
+		r.cancel()
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("%s did not stop: %w", r.Name, ctx.Err()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Statuses reports every subsystem in start order.
+func (m *Manager) Statuses() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Status, len(m.subs))
+	for i, r := range m.subs {
+		out[i] = r.status
+	}
+	return out
+}
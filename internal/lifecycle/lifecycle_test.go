@@ -0,0 +1,96 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownOrder(t *testing.T) {
+	m := New()
+	var mu sync.Mutex
+	var order []string
+	for _, name := range []string{"index", "server"} {
+		m.Start(context.Background(), Subsystem{Name: name, Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return ctx.Err()
+		}})
+	}
+	stopped := make(chan struct{})
+	m.Start(context.Background(), Subsystem{
+		Name: "listener",
+		Run:  func(context.Context) error { <-stopped; return nil },
+		Stop: func(context.Context) error { close(stopped); return nil },
+	})
+
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != "server" || order[1] != "index" {
+		t.Fatalf("expected reverse start order, got %v", order)
+	}
+	for _, s := range m.Statuses() {
+		if s.State != StateStopped {
+			t.Errorf("%s: %s", s.Name, s.State)
+		}
+	}
+}
+
+func TestCriticalFailure(t *testing.T) {
+	m := New()
+	m.Start(context.Background(), Subsystem{Name: "gc", Run: func(context.Context) error { return errors.New("boom") }})
+	m.Start(context.Background(), Subsystem{Name: "server", Critical: true, Run: func(context.Context) error { return errors.New("bind failed") }})
+
+	select {
+	case err := <-m.Fatal():
+		if err.Error() != "server: bind failed" {
+			t.Fatalf("unexpected fatal error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("critical failure not reported")
+	}
+	waitUntil := func(done func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !done() && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitUntil(func() bool { return m.Statuses()[0].State != StateRunning })
+	for _, s := range m.Statuses() {
+		if s.State != StateFailed || s.Error == "" {
+			t.Errorf("%s: expected failed, got %+v", s.Name, s)
+		}
+	}
+	m.Shutdown(context.Background())
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	m := New()
+	m.Start(context.Background(), Subsystem{Name: "stuck", Run: func(context.Context) error { select {} }})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); err == nil {
+		t.Fatal("expected a stuck subsystem to be reported")
+	}
+}
+
+func TestPanickingSubsystemFails(t *testing.T) {
+	m := New()
+	m.Start(context.Background(), Subsystem{Name: "server", Critical: true, Run: func(context.Context) error {
+		panic("nil dereference")
+	}})
+
+	select {
+	case err := <-m.Fatal():
+		if err == nil || !strings.Contains(err.Error(), "nil dereference") {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic was not reported as a failure")
+	}
+}
@@ -0,0 +1,329 @@
+// Package maintenance keeps image sets warm for scheduled maintenance
+// windows. Shortly before each window its images are revalidated upstream
+// and warmed, and everything warmed is pinned until the window ends:
+// retention and size eviction skip it, and its cached tags are served
+// without going back upstream. A cluster upgrade at 2 a.m. then pulls
+// entirely from the cache, even with the WAN link down for servicing.
+package maintenance
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/gc"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+)
+
+// defaultLead is how long before a window its images are warmed when the
+// window doesn't say.
+const defaultLead = time.Hour
+
+// maxSleep bounds how long Run sleeps at once, so a changed wall clock
+// (suspend, NTP step) is noticed.
+const maxSleep = 15 * time.Minute
+
+var (
+	warmObjects = metrics.NewCounterVec("oci_maintenance_warm_objects_total",
+		"Manifests and blobs resolved while preparing maintenance windows, by window and outcome.", "window", "status")
+	warmImages = metrics.NewCounterVec("oci_maintenance_warm_images_total",
+		"Images warmed for maintenance windows, by window and result.", "window", "result")
+	pinnedObjects = metrics.NewGaugeVec("oci_maintenance_pinned_objects",
+		"Objects pinned for an upcoming or open maintenance window, by window.", "window")
+)
+
+// Window is a recurring maintenance window with the images it needs.
+type Window struct {
+	// Name labels the window in logs and metrics.
+	Name string `json:"name"`
+	// Schedule is when the window opens: "02:00" daily, or "Sun 02:00"
+	// weekly, in Timezone (default UTC).
+	Schedule string `json:"schedule"`
+	Timezone string `json:"timezone,omitempty"`
+	// Duration is how long the window stays open.
+	Duration gc.Duration `json:"duration"`
+	// Lead is how long before the window opens its images are warmed
+	// and pinned (default 1h).
+	Lead gc.Duration `json:"lead,omitempty"`
+	// Images are fully qualified references ("registry/name:tag").
+	Images []string `json:"images"`
+
+	weekday  time.Weekday
+	weekly   bool
+	at       time.Duration // since midnight
+	location *time.Location
+}
+
+// Load reads a JSON array of windows from path.
+func Load(path string) ([]Window, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var windows []Window
+	if err := json.Unmarshal(data, &windows); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i := range windows {
+		if err := windows[i].parse(); err != nil {
+			return nil, fmt.Errorf("window %d: %w", i, err)
+		}
+		if names[windows[i].Name] {
+			return nil, fmt.Errorf("window %d: duplicate name %q", i, windows[i].Name)
+		}
+		names[windows[i].Name] = true
+	}
+	return windows, nil
+}
+
+func (w *Window) parse() error {
+	if w.Name == "" {
+		return errors.New("window needs a name")
+	}
+	if w.Duration <= 0 || w.Lead < 0 {
+		return errors.New("duration must be positive and lead not negative")
+	}
+	if len(w.Images) == 0 {
+		return errors.New("window lists no images")
+	}
+	for _, image := range w.Images {
+		if _, _, _, err := proxy.ParseImage(image); err != nil {
+			return err
+		}
+	}
+	loc, err := time.LoadLocation(cmp.Or(w.Timezone, "UTC"))
+	if err != nil {
+		return err
+	}
+	w.location = loc
+
+	clock := w.Schedule
+	if day, rest, ok := strings.Cut(clock, " "); ok {
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.EqualFold(day, d.String()[:3]) || strings.EqualFold(day, d.String()) {
+				w.weekday, w.weekly, found = d, true, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid day in schedule %q", w.Schedule)
+		}
+		clock = strings.TrimSpace(rest)
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q: want \"HH:MM\" or \"Day HH:MM\"", w.Schedule)
+	}
+	w.at = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	return nil
+}
+
+func (w *Window) lead() time.Duration {
+	if w.Lead == 0 {
+		return defaultLead
+	}
+	return time.Duration(w.Lead)
+}
+
+// occurrence returns the start of the window's first occurrence that
+// hasn't ended by now.
+func (w *Window) occurrence(now time.Time) time.Time {
+	after := now.Add(-time.Duration(w.Duration))
+	local := after.In(w.location)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, w.location)
+	for i := range 8 {
+		d := day.AddDate(0, 0, i)
+		if w.weekly && d.Weekday() != w.weekday {
+			continue
+		}
+		// Adding the clock time to midnight, rather than building the
+		// date with it, keeps DST-shifted days well defined.
+		if start := d.Add(w.at); start.After(after) {
+			return start
+		}
+	}
+	panic("unreachable: every week has a matching day")
+}
+
+// Scheduler prepares and pins the images of maintenance windows.
+type Scheduler struct {
+	Windows []Window
+
+	// Warm revalidates and pulls an image through the cache; see
+	// proxy.Handler.WarmFresh.
+	Warm func(ctx context.Context, image, authorization string, progress func(proxy.WarmEvent)) error
+
+	// Serves reports whether an image's registry is proxied by this
+	// cache. Images from other registries are skipped.
+	Serves func(image string) bool
+
+	// now is time.Now, replaceable in tests.
+	now func() time.Time
+
+	mu   sync.Mutex
+	pins map[string]*pinSet // by window name
+}
+
+// pinSet is what one window has pinned, until its occurrence ends.
+type pinSet struct {
+	start, end time.Time
+	digests    map[string]bool
+	tags       map[string]bool // "name:tag"
+}
+
+// Run prepares each window Lead before it opens, and releases its pins
+// when it closes, until ctx is cancelled. A window that should already be
+// prepared when Run starts is prepared at once.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		now := s.clock()
+		wake := now.Add(maxSleep)
+		for i := range s.Windows {
+			w := &s.Windows[i]
+			start := w.occurrence(now)
+			end := start.Add(time.Duration(w.Duration))
+			if prep := start.Add(-w.lead()); now.Before(prep) {
+				s.release(w.Name, now)
+				wake = earliest(wake, prep)
+				continue
+			}
+			if !s.prepared(w.Name, start) {
+				s.prepare(ctx, w, start, end)
+			}
+			wake = earliest(wake, end)
+		}
+		t := time.NewTimer(max(wake.Sub(now), time.Second))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func (s *Scheduler) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func (s *Scheduler) prepared(name string, start time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pins[name]
+	return ok && p.start.Equal(start)
+}
+
+// release drops a window's pins once its occurrence has ended.
+func (s *Scheduler) release(name string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.pins[name]; ok && !now.Before(p.end) {
+		delete(s.pins, name)
+		pinnedObjects.Set(0, name)
+		slog.Info("maintenance window closed, pins released", "window", name)
+	}
+}
+
+// prepare warms a window's images, pinning each object as it's resolved
+// so nothing warmed early in the pass is evicted before the pass ends.
+func (s *Scheduler) prepare(ctx context.Context, w *Window, start, end time.Time) {
+	p := &pinSet{start: start, end: end, digests: make(map[string]bool), tags: make(map[string]bool)}
+	s.mu.Lock()
+	if s.pins == nil {
+		s.pins = make(map[string]*pinSet)
+	}
+	s.pins[w.Name] = p
+	s.mu.Unlock()
+
+	slog.Info("preparing maintenance window", "window", w.Name, "opens", start, "closes", end, "images", len(w.Images))
+	var warmed, failed int
+	for _, image := range w.Images {
+		if ctx.Err() != nil {
+			return
+		}
+		if s.Serves != nil && !s.Serves(image) {
+			slog.Warn("maintenance window image is not from a proxied registry", "window", w.Name, "image", image)
+			warmImages.Inc(w.Name, "skipped")
+			continue
+		}
+		if _, name, ref, _ := proxy.ParseImage(image); !strings.Contains(ref, ":") {
+			s.pin(w.Name, p, "", name+":"+ref)
+		}
+		err := s.Warm(ctx, image, "", func(ev proxy.WarmEvent) {
+			warmObjects.Inc(w.Name, ev.Status)
+			if ev.Status == "failed" {
+				slog.Warn("maintenance warm object failed", "window", w.Name, "image", image, "kind", ev.Kind, "digest", ev.Digest, "error", ev.Err)
+				return
+			}
+			s.pin(w.Name, p, ev.Digest, "")
+		})
+		if err != nil {
+			slog.Error("maintenance warm failed", "window", w.Name, "image", image, "error", err)
+			failed++
+			warmImages.Inc(w.Name, "failed")
+			continue
+		}
+		warmed++
+		warmImages.Inc(w.Name, "warmed")
+	}
+	slog.Info("maintenance window prepared", "window", w.Name, "warmed", warmed, "failed", failed)
+}
+
+func (s *Scheduler) pin(window string, p *pinSet, digest, tag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if digest != "" {
+		p.digests[cache.NormalizeDigest(digest)] = true
+	}
+	if tag != "" {
+		p.tags[tag] = true
+	}
+	pinnedObjects.Set(float64(len(p.digests)+len(p.tags)), window)
+}
+
+// Pinned reports whether the object at a storage key is pinned for a
+// maintenance window. Tags are matched by repository name and tag rather
+// than registry, since an image's registry may be an alias of the one its
+// keys are stored under; the overlap can only pin more.
+func (s *Scheduler) Pinned(key string) bool {
+	k, ok := cache.ParseKey(key)
+	if !ok || k.Principal != "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pins {
+		switch k.Kind {
+		case "tag":
+			_, name, _ := strings.Cut(k.Repository, "/")
+			if p.tags[name+":"+k.Tag] {
+				return true
+			}
+		default:
+			if p.digests[k.Digest] {
+				return true
+			}
+		}
+	}
+	return false
+}
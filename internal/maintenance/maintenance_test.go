@@ -0,0 +1,108 @@
+package maintenance
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/gc"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	for name, tc := range map[string]struct {
+		json string
+		ok   bool
+	}{
+		"weekly":       {`[{"name":"upgrade","schedule":"Sun 02:00","duration":"4h","images":["ghcr.io/org/app:1"]}]`, true},
+		"daily zone":   {`[{"name":"nightly","schedule":"23:30","timezone":"Europe/London","duration":"30m","images":["ghcr.io/org/app:1"]}]`, true},
+		"bad day":      {`[{"name":"x","schedule":"Someday 02:00","duration":"1h","images":["ghcr.io/org/app:1"]}]`, false},
+		"bad clock":    {`[{"name":"x","schedule":"25:00","duration":"1h","images":["ghcr.io/org/app:1"]}]`, false},
+		"no images":    {`[{"name":"x","schedule":"02:00","duration":"1h"}]`, false},
+		"no duration":  {`[{"name":"x","schedule":"02:00","images":["ghcr.io/org/app:1"]}]`, false},
+		"bad image":    {`[{"name":"x","schedule":"02:00","duration":"1h","images":["app"]}]`, false},
+		"duplicate":    {`[{"name":"x","schedule":"02:00","duration":"1h","images":["ghcr.io/a:1"]},{"name":"x","schedule":"03:00","duration":"1h","images":["ghcr.io/a:1"]}]`, false},
+		"bad timezone": {`[{"name":"x","schedule":"02:00","timezone":"Mars/Base","duration":"1h","images":["ghcr.io/a:1"]}]`, false},
+	} {
+		path := filepath.Join(dir, "windows.json")
+		if err := os.WriteFile(path, []byte(tc.json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok %v", name, err, tc.ok)
+		}
+	}
+}
+
+func TestOccurrence(t *testing.T) {
+	w := Window{Name: "upgrade", Schedule: "Sun 02:00", Duration: gc.Duration(4 * time.Hour), Images: []string{"ghcr.io/a:1"}}
+	if err := w.parse(); err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for now, want := range map[string]string{
+		"2026-10-14T12:00:00Z": "2026-10-18T02:00:00Z", // Wednesday: the coming Sunday
+		"2026-10-18T03:00:00Z": "2026-10-18T02:00:00Z", // open now
+		"2026-10-18T06:00:00Z": "2026-10-25T02:00:00Z", // just closed
+	} {
+		if got := w.occurrence(at(now)); !got.Equal(at(want)) {
+			t.Errorf("occurrence(%s) = %s, want %s", now, got, want)
+		}
+	}
+}
+
+func TestPrepareAndRelease(t *testing.T) {
+	now := time.Date(2026, 10, 18, 1, 30, 0, 0, time.UTC) // Sunday, within the lead
+	s := &Scheduler{
+		Windows: []Window{{Name: "upgrade", Schedule: "Sun 02:00", Duration: gc.Duration(time.Hour),
+			Images: []string{"quay.io/other/tool:2", "ghcr.io/org/app:1"}}},
+		Serves: func(image string) bool { return image != "quay.io/other/tool:2" },
+		now:    func() time.Time { return now },
+	}
+	if err := s.Windows[0].parse(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var warmed []string
+	s.Warm = func(_ context.Context, image, _ string, progress func(proxy.WarmEvent)) error {
+		warmed = append(warmed, image)
+		progress(proxy.WarmEvent{Image: image, Kind: "manifest", Digest: "sha256:aa", Status: "fetched"})
+		progress(proxy.WarmEvent{Image: image, Kind: "blob", Digest: "sha256:bb", Status: "cached"})
+		progress(proxy.WarmEvent{Image: image, Kind: "blob", Digest: "sha256:cc", Status: "failed"})
+		cancel() // one pass is enough
+		return nil
+	}
+	s.Run(ctx)
+
+	if len(warmed) != 1 || warmed[0] != "ghcr.io/org/app:1" {
+		t.Fatalf("warmed %v, want only the proxied image", warmed)
+	}
+	for key, want := range map[string]bool{
+		"manifests/ghcr.io/org/app/tags/1":     true,
+		"manifests/mirror.test/org/app/tags/1": true, // the same image by a registry alias
+		"manifests/ghcr.io/org/app/tags/2":     false,
+		"manifests/ghcr.io/org/app/sha256-aa":  true,
+		"blobs/sha256-bb":                      true,
+		"blobs/sha256-cc":                      false,
+		"private/abc/blobs/sha256-bb":          false,
+	} {
+		if got := s.Pinned(key); got != want {
+			t.Errorf("Pinned(%s) = %v, want %v", key, got, want)
+		}
+	}
+
+	// Once the window has closed, the pins go.
+	s.release("upgrade", time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC))
+	if s.Pinned("blobs/sha256-bb") {
+		t.Error("pin kept after the window closed")
+	}
+}
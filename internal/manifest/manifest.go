@@ -0,0 +1,162 @@
+// Package manifest decodes OCI and Docker image manifests and indexes.
+// Manifests come from upstream registries and clients alike, so decoding
+// is bounded in size and strict about the few fields the proxy relies on;
+// everything else is left to the registry protocol.
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Manifest media types.
+const (
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeSchema1        = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeSchema1Signed  = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// Accept asks for every manifest type a modern client accepts, for use as
+// an Accept header.
+var Accept = strings.Join([]string{
+	MediaTypeOCIIndex,
+	MediaTypeOCIManifest,
+	MediaTypeDockerList,
+	MediaTypeDockerManifest,
+}, ", ")
+
+// DefaultMaxSize bounds manifests decoded without an explicit limit. It
+// follows the distribution spec's guidance that registries accept
+// manifests of at least 4 MiB; real manifests are far smaller.
+const DefaultMaxSize = 4 << 20
+
+var (
+	// ErrTooLarge is returned for a manifest over the size limit.
+	ErrTooLarge = errors.New("manifest exceeds size limit")
+	// ErrUnsupported is returned for documents that aren't schema 2
+	// manifests or indexes, such as Docker schema 1 manifests.
+	ErrUnsupported = errors.New("unsupported manifest format")
+)
+
+// Platform is the platform an index entry is built for.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String formats p as os/arch[/variant].
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Descriptor references a blob or manifest by digest.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// MatchesPlatform reports whether an index entry is for platform, given as
+// os/arch or os/arch/variant. Entries without a platform match nothing.
+func (d Descriptor) MatchesPlatform(platform string) bool {
+	if d.Platform == nil {
+		return false
+	}
+	p := *d.Platform
+	return p.String() == platform || p.OS+"/"+p.Architecture == platform
+}
+
+// Manifest is an image manifest or an index. Which one is told by
+// IsIndex; the fields of the other kind are empty.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        *Descriptor       `json:"config,omitempty"`
+	Layers        []Descriptor      `json:"layers,omitempty"`
+	Manifests     []Descriptor      `json:"manifests,omitempty"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// IsIndexType reports whether mediaType is an OCI index or Docker
+// manifest list.
+func IsIndexType(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerList
+}
+
+// IsIndex reports whether m lists other manifests rather than blobs.
+func (m *Manifest) IsIndex() bool {
+	if m.MediaType != "" {
+		return IsIndexType(m.MediaType)
+	}
+	return len(m.Manifests) > 0
+}
+
+// Blobs returns the config and layers of an image manifest, config first.
+func (m *Manifest) Blobs() []Descriptor {
+	if m.Config == nil {
+		return m.Layers
+	}
+	return append([]Descriptor{*m.Config}, m.Layers...)
+}
+
+// Decode reads a manifest from r, reading at most limit bytes
+// (DefaultMaxSize if limit is 0 or less). The body is decoded as it is
+// read rather than buffered first.
+func Decode(r io.Reader, limit int64) (*Manifest, error) {
+	if limit <= 0 {
+		limit = DefaultMaxSize
+	}
+	lr := &io.LimitedReader{R: r, N: limit + 1}
+	var m Manifest
+	err := json.NewDecoder(lr).Decode(&m)
+	if lr.N == 0 {
+		return nil, ErrTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Parse decodes a manifest already in memory, which the caller has
+// bounded.
+func Parse(data []byte) (*Manifest, error) {
+	return Decode(bytes.NewReader(data), int64(len(data)))
+}
+
+// check rejects documents whose schema version or media type doesn't fit
+// their content. A missing schemaVersion is tolerated, as some registries
+// omit it from indexes.
+func (m *Manifest) check() error {
+	switch {
+	case m.SchemaVersion != 2 && m.SchemaVersion != 0:
+		return fmt.Errorf("%w: schema version %d", ErrUnsupported, m.SchemaVersion)
+	case m.MediaType == MediaTypeSchema1 || m.MediaType == MediaTypeSchema1Signed:
+		return fmt.Errorf("%w: %s", ErrUnsupported, m.MediaType)
+	case IsIndexType(m.MediaType) && (m.Config != nil || len(m.Layers) > 0):
+		return fmt.Errorf("%w: index with config or layers", ErrUnsupported)
+	case m.MediaType != "" && !IsIndexType(m.MediaType) && len(m.Manifests) > 0:
+		return fmt.Errorf("%w: %s with child manifests", ErrUnsupported, m.MediaType)
+	}
+	return nil
+}
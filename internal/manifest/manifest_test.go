@@ -0,0 +1,65 @@
+package manifest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	image := `{"schemaVersion":2,"mediaType":"` + MediaTypeOCIManifest + `",
+		"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:c","size":2},
+		"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:l","size":10}]}`
+	m, err := Parse([]byte(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.IsIndex() {
+		t.Error("image manifest reported as an index")
+	}
+	if blobs := m.Blobs(); len(blobs) != 2 || blobs[0].Digest != "sha256:c" || blobs[1].Size != 10 {
+		t.Errorf("Blobs() = %+v", blobs)
+	}
+
+	index := `{"schemaVersion":2,"manifests":[
+		{"digest":"sha256:a","platform":{"os":"linux","architecture":"arm64","variant":"v8"}},
+		{"digest":"sha256:b"}]}`
+	m, err = Parse([]byte(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsIndex() || len(m.Blobs()) != 0 {
+		t.Error("index without a media type not recognised")
+	}
+	for platform, want := range map[string]bool{"linux/arm64": true, "linux/arm64/v8": true, "linux/amd64": false} {
+		if got := m.Manifests[0].MatchesPlatform(platform); got != want {
+			t.Errorf("MatchesPlatform(%s) = %v", platform, got)
+		}
+	}
+	if m.Manifests[1].MatchesPlatform("linux/arm64") {
+		t.Error("entry without a platform matched")
+	}
+
+	for name, doc := range map[string]string{
+		"schema 1":           `{"schemaVersion":1,"name":"app","fsLayers":[]}`,
+		"index with layers":  `{"schemaVersion":2,"mediaType":"` + MediaTypeOCIIndex + `","layers":[{"digest":"sha256:l"}]}`,
+		"image with entries": `{"schemaVersion":2,"mediaType":"` + MediaTypeDockerManifest + `","manifests":[{"digest":"sha256:a"}]}`,
+	} {
+		if _, err := Parse([]byte(doc)); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: err = %v, want ErrUnsupported", name, err)
+		}
+	}
+	if _, err := Parse([]byte(`{"schemaVersion":`)); err == nil {
+		t.Error("truncated manifest accepted")
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	doc := `{"schemaVersion":2,"annotations":{"pad":"` + strings.Repeat("x", 100) + `"}}`
+	if _, err := Decode(strings.NewReader(doc), int64(len(doc))); err != nil {
+		t.Errorf("manifest at the limit: %v", err)
+	}
+	if _, err := Decode(strings.NewReader(doc), 64); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("manifest over the limit: err = %v, want ErrTooLarge", err)
+	}
+}
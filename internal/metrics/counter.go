@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// CounterVec is a monotonically increasing counter partitioned by labels.
+type CounterVec struct {
+	metricName string
+	help       string
+	s          series[atomic.Uint64]
+}
+
+// NewCounterVec registers a counter family.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricName: name,
+		help:       help,
+		s: series[atomic.Uint64]{
+			labels: labels,
+			values: make(map[string]*atomic.Uint64),
+			newT:   func() *atomic.Uint64 { return new(atomic.Uint64) },
+		},
+	}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series for labelValues.
+func (c *CounterVec) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+// Add adds v (which must be non-negative) to the series for labelValues.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	bits := c.s.get(labelValues)
+	for {
+		old := bits.Load()
+		if bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (c *CounterVec) name() string { return c.metricName }
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	c.s.each(func(labels string, v *atomic.Uint64) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, labels, formatFloat(math.Float64frombits(v.Load())))
+	})
+}
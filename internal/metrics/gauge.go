@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// GaugeFunc is a gauge whose value is read from fn at scrape time.
+type GaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+// NewGaugeFunc registers a gauge backed by fn.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string { return g.metricName }
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+// GaugeVec is a gauge partitioned by labels whose series are set
+// explicitly, for values computed periodically rather than at scrape time.
+type GaugeVec struct {
+	metricName string
+	help       string
+	s          series[atomic.Uint64]
+}
+
+// NewGaugeVec registers a gauge family.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		metricName: name,
+		help:       help,
+		s: series[atomic.Uint64]{
+			labels: labels,
+			values: make(map[string]*atomic.Uint64),
+			newT:   func() *atomic.Uint64 { return new(atomic.Uint64) },
+		},
+	}
+	register(g)
+	return g
+}
+
+// Set sets the series for labelValues to v.
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.s.get(labelValues).Store(math.Float64bits(v))
+}
+
+func (g *GaugeVec) name() string { return g.metricName }
+
+func (g *GaugeVec) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	g.s.each(func(labels string, v *atomic.Uint64) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, labels, formatFloat(math.Float64frombits(v.Load())))
+	})
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultBuckets suit request latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// HistogramVec counts observations into cumulative buckets, partitioned by
+// labels.
+type HistogramVec struct {
+	metricName string
+	help       string
+	buckets    []float64
+	s          series[histogram]
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram family. buckets must be sorted
+// ascending; nil uses DefaultBuckets.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{metricName: name, help: help, buckets: buckets}
+	h.s = series[histogram]{
+		labels: labels,
+		values: make(map[string]*histogram),
+		newT:   func() *histogram { return &histogram{counts: make([]uint64, len(buckets))} },
+	}
+	register(h)
+	return h
+}
+
+// Observe records v in the series for labelValues.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	hist := h.s.get(labelValues)
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) name() string { return h.metricName }
+
+func (h *HistogramVec) write(w io.Writer) {
+	writeHeader(w, h.metricName, h.help, "histogram")
+	h.s.each(func(labels string, hist *histogram) {
+		hist.mu.Lock()
+		defer hist.mu.Unlock()
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, withLabel(labels, "le", formatFloat(upper)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, withLabel(labels, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, labels, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, labels, hist.count)
+	})
+}
@@ -0,0 +1,143 @@
+// Package metrics is a small Prometheus-compatible metrics registry. It
+// covers the handful of counters and histograms the proxy exports and
+// renders them in the text exposition format, without pulling in the full
+// client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is a metric family that can render itself.
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, existing := range registry {
+		if existing.name() == c.name() {
+			panic("metrics: duplicate metric " + c.name())
+		}
+	}
+	registry = append(registry, c)
+}
+
+// Handler serves all registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// WriteTo renders all registered metrics, sorted by name.
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	cs := slices.Clone(registry)
+	registryMu.Unlock()
+	slices.SortFunc(cs, func(a, b collector) int { return strings.Compare(a.name(), b.name()) })
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+// series holds per-label-set state for a metric family, keyed by the
+// joined label values.
+type series[T any] struct {
+	mu     sync.Mutex
+	labels []string
+	values map[string]*T
+	order  []string
+	newT   func() *T
+}
+
+func (s *series[T]) get(values []string) *T {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(s.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		v = s.newT()
+		s.values[key] = v
+		s.order = append(s.order, key)
+	}
+	return v
+}
+
+// each calls fn for every series in label order.
+func (s *series[T]) each(fn func(labels string, v *T)) {
+	s.mu.Lock()
+	keys := slices.Clone(s.order)
+	s.mu.Unlock()
+	slices.Sort(keys)
+	for _, key := range keys {
+		s.mu.Lock()
+		v := s.values[key]
+		s.mu.Unlock()
+		fn(formatLabels(s.labels, strings.Split(key, "\xff")), v)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// withLabel appends one more label to a rendered label set.
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + escapeLabel(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Requests.", "code")
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc(`a"b`)
+	h := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.5)
+	g := NewGaugeVec("test_bytes", "Bytes.", "prefix")
+	g.Set(7, "blobs")
+	g.Set(1.5, "blobs")
+
+	var b strings.Builder
+	WriteTo(&b)
+	out := b.String()
+
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{code="200"} 3` + "\n",
+		`test_requests_total{code="a\"b"} 1` + "\n",
+		`test_latency_seconds_bucket{le="0.1"} 0` + "\n",
+		`test_latency_seconds_bucket{le="1"} 1` + "\n",
+		`test_latency_seconds_bucket{le="+Inf"} 1` + "\n",
+		"test_latency_seconds_sum 0.5\n",
+		"test_latency_seconds_count 1\n",
+		"# TYPE test_bytes gauge\n",
+		`test_bytes{prefix="blobs"} 1.5` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
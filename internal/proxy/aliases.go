@@ -0,0 +1,54 @@
+package proxy
+
+import "strings"
+
+// registryAlias is a public registry known by a name other than the host
+// serving its API, or one whose repository names need filling in.
+type registryAlias struct {
+	// host serves the registry API. Empty keeps the name as given.
+	host string
+	// namespace is prepended to single-component repository names, as
+	// Docker Hub does with "library".
+	namespace string
+}
+
+// registryAliases are the public registries that work without users
+// having to find their API endpoints themselves. Keys are lowercase.
+var registryAliases = map[string]registryAlias{
+	// Docker Hub serves its API from a different host than image
+	// references name.
+	"docker.io":            {host: "registry-1.docker.io", namespace: "library"},
+	"index.docker.io":      {host: "registry-1.docker.io", namespace: "library"},
+	"registry.docker.io":   {host: "registry-1.docker.io", namespace: "library"},
+	"registry-1.docker.io": {namespace: "library"},
+	// The ECR Public Gallery's web address is often copied into image
+	// references. Single-component names, which ECR Public doesn't
+	// otherwise serve, resolve to its copies of Docker official images.
+	"gallery.ecr.aws": {host: "public.ecr.aws", namespace: "docker/library"},
+	"public.ecr.aws":  {namespace: "docker/library"},
+	// k8s.gcr.io is frozen; its images are served by registry.k8s.io,
+	// which redirects pulls to a backend near the client.
+	"k8s.gcr.io": {host: "registry.k8s.io"},
+}
+
+// resolveRegistry maps well-known registry aliases to their API endpoints.
+func resolveRegistry(registry string) string {
+	if a, ok := registryAliases[strings.ToLower(registry)]; ok && a.host != "" {
+		return a.host
+	}
+	return registry
+}
+
+// normalizeName applies a registry's implicit namespace to single-segment
+// names (Docker Hub's "library/"), as Harbor does for Docker Hub proxy
+// projects, so "proxy-dockerhub/nginx" and "proxy-dockerhub/library/nginx"
+// share one upstream repository and cache entry.
+func normalizeName(registry, name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	if a, ok := registryAliases[strings.ToLower(resolveRegistry(registry))]; ok && a.namespace != "" {
+		return a.namespace + "/" + name
+	}
+	return name
+}
@@ -0,0 +1,400 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+	"github.com/danielloader/oci-pull-through/internal/recovery"
+	"github.com/danielloader/oci-pull-through/internal/stream"
+)
+
+// External artifact sources. Node bootstrap needs more than images: CNI
+// plugin tarballs, kubelet binaries and the like, usually downloaded from
+// a plain HTTP server or a GitHub release. An ArtifactSource serves such
+// files under a repository of their own, as synthetic OCI artifacts: a
+// tag's manifest has one layer, the file at the source's URL for that
+// tag, and an empty config. oras, crane or containerd can then pull them
+// through the cache like any image.
+//
+// A tag is materialised the first time it's pulled: the file is
+// downloaded, hashed and cached as a blob, and its manifest cached under
+// both the tag and its digest. The file's URL is kept in the layer's
+// annotations, so a blob evicted later is downloaded again (and checked
+// against its digest) from there. Tags are treated as immutable.
+
+const (
+	// ArtifactType is the artifactType of synthetic artifact manifests.
+	ArtifactType = "application/vnd.oci-pull-through.file.v1"
+
+	// Standard OCI annotations set on the file's layer.
+	annotationTitle = "org.opencontainers.image.title"
+	annotationURL   = "org.opencontainers.image.url"
+)
+
+// The OCI empty descriptor, used as every artifact's config.
+const (
+	emptyConfigType   = "application/vnd.oci.empty.v1+json"
+	emptyConfigDigest = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+	emptyConfig       = "{}"
+)
+
+// artifactFetchTimeout bounds one download from an artifact source. It
+// isn't tied to the request that started it, so clients waiting on the
+// same file share one download.
+const artifactFetchTimeout = 30 * time.Minute
+
+var artifactFetches = metrics.NewCounterVec("oci_artifact_fetches_total",
+	"Files downloaded from external artifact sources, by result (fetched, not_found or failed).", "result")
+
+// errArtifactNotFound means the source has no file for the reference.
+var errArtifactNotFound = errors.New("artifact not found at source")
+
+// ArtifactSource maps a repository to files on an HTTP server.
+type ArtifactSource struct {
+	// Repository is the repository name the files are served under.
+	Repository string
+	// URL is the file's URL, with {tag} replaced by the pulled tag and
+	// {version} by the tag without a leading "v".
+	URL string
+	// Token, when set, is sent as a bearer token to the URL's own host
+	// (e.g. GitHub, for private repositories and higher rate limits).
+	Token string
+}
+
+// ParseArtifactSources builds sources from repository=source pairs. A
+// source is an http(s) URL template, or "github:owner/repo/asset" for an
+// asset of a GitHub release tagged with the pulled tag. githubToken is
+// used for GitHub sources.
+func ParseArtifactSources(pairs map[string]string, githubToken string) ([]ArtifactSource, error) {
+	var sources []ArtifactSource
+	for repo, spec := range pairs {
+		src := ArtifactSource{Repository: repo, URL: spec}
+		if rest, ok := strings.CutPrefix(spec, "github:"); ok {
+			parts := strings.SplitN(rest, "/", 3)
+			if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+				return nil, fmt.Errorf("%s: github source must be github:owner/repo/asset, got %q", repo, spec)
+			}
+			src.URL = "https://github.com/" + parts[0] + "/" + parts[1] + "/releases/download/{tag}/" + parts[2]
+			src.Token = githubToken
+		}
+		u, err := url.Parse(strings.NewReplacer("{tag}", "x", "{version}", "x").Replace(src.URL))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: source %q is not an http(s) URL", repo, spec)
+		}
+		if !strings.Contains(src.URL, "{tag}") && !strings.Contains(src.URL, "{version}") {
+			return nil, fmt.Errorf("%s: source %q has no {tag} or {version}", repo, spec)
+		}
+		if !validName(repo) {
+			return nil, fmt.Errorf("invalid repository name %q", repo)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+func (s *ArtifactSource) url(tag string) string {
+	return strings.NewReplacer("{tag}", tag, "{version}", strings.TrimPrefix(tag, "v")).Replace(s.URL)
+}
+
+// artifactSource returns the source serving a repository, if any.
+func (h *Handler) artifactSource(name string) (*ArtifactSource, bool) {
+	for i := range h.Artifacts {
+		if h.Artifacts[i].Repository == name {
+			return &h.Artifacts[i], true
+		}
+	}
+	return nil, false
+}
+
+// serveArtifact answers a request for a repository backed by src.
+// Manifests and blobs are materialised from the source on a miss and
+// served from the cache; tag lists show the tags materialised so far.
+func (h *Handler) serveArtifact(w http.ResponseWriter, r *http.Request, info requestInfo, src *ArtifactSource) {
+	switch info.Kind {
+	case "tags":
+		h.serveArtifactTags(w, r, info)
+		return
+	case "referrers":
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		io.WriteString(w, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+		return
+	}
+
+	key := h.storageKey(info)
+	if _, err := h.Cache.Head(r.Context(), key); err != nil {
+		if err := h.fillArtifact(r.Context(), info, key, src); err != nil {
+			code := "MANIFEST_UNKNOWN"
+			if info.Kind == "blobs" {
+				code = "BLOB_UNKNOWN"
+			}
+			if errors.Is(err, errArtifactNotFound) {
+				writeOCIError(w, http.StatusNotFound, code, err.Error())
+				return
+			}
+			slog.Error("artifact source failed", "image", info.image(), "ref", info.shortRef(), "error", err)
+			writeOCIError(w, http.StatusBadGateway, "UNAVAILABLE", err.Error())
+			return
+		}
+	}
+
+	res, err := h.Cache.GetWithMeta(r.Context(), key)
+	if err != nil {
+		writeOCIError(w, http.StatusBadGateway, "UNAVAILABLE", "artifact was evicted while being served")
+		return
+	}
+	defer res.Body.Close()
+	slog.Info("cache hit (artifact)", "image", info.image(), "kind", info.Kind, "ref", info.shortRef())
+	replayStoredHeaders(w, res.Meta)
+	setCacheControl(w, info)
+	if seeker, ok := res.Body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, seeker)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		copyToClient(w, res.Body)
+	}
+}
+
+func (h *Handler) serveArtifactTags(w http.ResponseWriter, r *http.Request, info requestInfo) {
+	prefix := cache.TagKey(info.Registry+"/"+info.Name, "")
+	tags := []string{}
+	for obj, err := range h.Cache.List(r.Context(), prefix, "") {
+		if err != nil {
+			writeOCIError(w, http.StatusBadGateway, "UNAVAILABLE", err.Error())
+			return
+		}
+		if tag := strings.TrimPrefix(obj.Key, prefix); !strings.Contains(tag, "/") {
+			tags = append(tags, tag)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"name": info.Name, "tags": tags})
+}
+
+// artifactFill is a materialisation in progress, shared by the requests
+// waiting on it.
+type artifactFill struct {
+	done chan struct{}
+	err  error
+
+	// fill records it in Handler.Inflight, if set, once started is closed.
+	started chan struct{}
+	fill    *stream.Fill
+}
+
+// fillArtifact caches the object at key from src, joining a fill already
+// under way for it.
+func (h *Handler) fillArtifact(ctx context.Context, info requestInfo, key string, src *ArtifactSource) error {
+	f := &artifactFill{done: make(chan struct{}), started: make(chan struct{})}
+	if v, busy := h.artifactFills.LoadOrStore(key, f); busy {
+		f = v.(*artifactFill)
+		<-f.started
+		if f.fill != nil {
+			f.fill.Join()
+		}
+	} else {
+		fillCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), artifactFetchTimeout)
+		if h.Inflight != nil {
+			f.fill = h.Inflight.Start(key, src.url(info.Reference), -1, cancel)
+		}
+		close(f.started)
+		recovery.Go("artifact-fill", func() {
+			defer close(f.done)
+			defer h.artifactFills.Delete(key)
+			defer cancel()
+			if f.fill != nil {
+				defer f.fill.Done()
+			}
+			f.err = h.materialize(fillCtx, info, key, src)
+		})
+	}
+	if f.fill != nil {
+		defer f.fill.Leave()
+	}
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// materialize caches the object a request for info asks for.
+func (h *Handler) materialize(ctx context.Context, info requestInfo, key string, src *ArtifactSource) error {
+	repo := info.Registry + "/" + info.Name
+	switch {
+	case info.Kind == "blobs" && info.Reference == emptyConfigDigest:
+		return h.putBlob(ctx, info.Registry, strings.NewReader(emptyConfig), emptyConfigType, emptyConfigDigest, int64(len(emptyConfig)))
+	case info.Kind == "blobs":
+		// Only a file some cached tag points at can be fetched again.
+		u, ok := h.artifactURL(ctx, repo, info.Reference)
+		if !ok {
+			return fmt.Errorf("%w: no cached tag of %s references %s", errArtifactNotFound, info.Name, info.Reference)
+		}
+		digest, _, _, err := h.downloadArtifact(ctx, info.Registry, src, u, info.Reference)
+		if err == nil && digest != info.Reference {
+			err = fmt.Errorf("%s no longer has digest %s (got %s)", u, info.Reference, digest)
+		}
+		return err
+	case !info.isTagManifest():
+		return fmt.Errorf("%w: manifests of %s are only known by tag", errArtifactNotFound, info.Name)
+	}
+
+	u := src.url(info.Reference)
+	digest, size, contentType, err := h.downloadArtifact(ctx, info.Registry, src, u, "")
+	if err != nil {
+		return err
+	}
+	if err := h.putBlob(ctx, info.Registry, strings.NewReader(emptyConfig), emptyConfigType, emptyConfigDigest, int64(len(emptyConfig))); err != nil {
+		return err
+	}
+	manifest, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"artifactType":  ArtifactType,
+		"config": map[string]any{
+			"mediaType": emptyConfigType, "digest": emptyConfigDigest, "size": len(emptyConfig), "data": "e30=",
+		},
+		"layers": []map[string]any{{
+			"mediaType": contentType,
+			"digest":    digest,
+			"size":      size,
+			"annotations": map[string]string{
+				annotationTitle: path.Base(strings.SplitN(u, "?", 2)[0]),
+				annotationURL:   u,
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(manifest)
+	mdigest := "sha256:" + hex.EncodeToString(sum[:])
+	meta := manifestMeta("application/vnd.oci.image.manifest.v1+json", mdigest, len(manifest))
+	if err := h.Cache.Put(ctx, cache.ManifestKey(repo, mdigest), bytes.NewReader(manifest), meta); err != nil {
+		return err
+	}
+	if err := h.Cache.Put(ctx, key, bytes.NewReader(manifest), meta); err != nil {
+		return err
+	}
+	slog.Info("materialized artifact", "image", info.image(), "tag", info.Reference, "url", u, "digest", digest, "size", size)
+	return nil
+}
+
+// artifactURL finds the source URL of a blob among the repository's cached
+// tag manifests.
+func (h *Handler) artifactURL(ctx context.Context, repo, digest string) (string, bool) {
+	for obj, err := range h.Cache.List(ctx, cache.TagKey(repo, ""), "") {
+		if err != nil {
+			return "", false
+		}
+		res, err := h.Cache.GetWithMeta(ctx, obj.Key)
+		if err != nil {
+			continue
+		}
+		m, err := manifest.Decode(res.Body, DefaultMaxManifestSize)
+		res.Body.Close()
+		if err != nil {
+			continue
+		}
+		for _, l := range m.Layers {
+			if u := l.Annotations[annotationURL]; l.Digest == digest && u != "" {
+				return u, true
+			}
+		}
+	}
+	return "", false
+}
+
+// downloadArtifact fetches u into a spool file, hashing it, and caches it
+// as a blob of registry. want, if set, is the digest it must have to be
+// cached.
+func (h *Handler) downloadArtifact(ctx context.Context, registry string, src *ArtifactSource, u, want string) (digest string, size int64, contentType string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if src.Token != "" {
+		// The client drops it if the file redirects to another host.
+		req.Header.Set("Authorization", "Bearer "+src.Token)
+	}
+	if h.Upstream != nil && h.Upstream.UserAgent != "" {
+		req.Header.Set("User-Agent", h.Upstream.UserAgent)
+	}
+	client := h.ArtifactClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		artifactFetches.Inc("failed")
+		return "", 0, "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		artifactFetches.Inc("not_found")
+		return "", 0, "", fmt.Errorf("%w: %s", errArtifactNotFound, u)
+	case resp.StatusCode != http.StatusOK:
+		artifactFetches.Inc("failed")
+		return "", 0, "", fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+
+	spool, err := os.CreateTemp("", "oci-artifact-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	hash := newDigester(want)
+	size, err = io.Copy(io.MultiWriter(spool, hash), resp.Body)
+	if err != nil {
+		artifactFetches.Inc("failed")
+		return "", 0, "", fmt.Errorf("downloading %s: %w", u, err)
+	}
+	if resp.ContentLength >= 0 && size != resp.ContentLength {
+		artifactFetches.Inc("failed")
+		return "", 0, "", fmt.Errorf("downloading %s: got %d of %d bytes", u, size, resp.ContentLength)
+	}
+	artifactFetches.Inc("fetched")
+	digest = hash.Digest()
+	if want != "" && digest != want {
+		return digest, size, "", nil
+	}
+	contentType = "application/octet-stream"
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return "", 0, "", err
+	}
+	return digest, size, contentType, h.putBlob(ctx, registry, spool, contentType, digest, size)
+}
+
+func (h *Handler) putBlob(ctx context.Context, registry string, body io.Reader, contentType, digest string, size int64) error {
+	return h.Cache.Put(ctx, h.KeySchema.BlobKey(registry, digest), body, cache.ObjectMeta{
+		ContentType:         contentType,
+		DockerContentDigest: digest,
+		ContentLength:       size,
+		Header: http.Header{
+			"Content-Type":          {contentType},
+			"Content-Length":        {strconv.FormatInt(size, 10)},
+			"Docker-Content-Digest": {digest},
+		},
+	})
+}
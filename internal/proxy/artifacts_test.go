@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/stream"
+)
+
+func TestArtifactSource(t *testing.T) {
+	const file = "cni plugins tarball"
+	var downloads atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/releases/v1.5.1/cni-plugins-1.5.1.tgz" {
+			http.NotFound(w, r)
+			return
+		}
+		downloads.Add(1)
+		w.Write([]byte(file))
+	}))
+	defer srv.Close()
+	h := &Handler{
+		Registry:       "registry.test",
+		Cache:          cache.NewFSStore(t.TempDir(), 0),
+		Artifacts:      []ArtifactSource{{Repository: "bootstrap/cni", URL: srv.URL + "/releases/{tag}/cni-plugins-{version}.tgz"}},
+		ArtifactClient: srv.Client(),
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/bootstrap/cni/"+path, nil))
+		return rec
+	}
+
+	rec := get("manifests/v1.5.1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("manifest: got %d %s", rec.Code, rec.Body)
+	}
+	var m struct {
+		ArtifactType string `json:"artifactType"`
+		Config       struct{ Digest string }
+		Layers       []struct {
+			Digest      string
+			Size        int64
+			Annotations map[string]string
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(file))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if m.ArtifactType != ArtifactType || len(m.Layers) != 1 || m.Layers[0].Digest != digest || m.Layers[0].Size != int64(len(file)) {
+		t.Fatalf("unexpected manifest %s", rec.Body)
+	}
+	if title := m.Layers[0].Annotations[annotationTitle]; title != "cni-plugins-1.5.1.tgz" {
+		t.Errorf("title = %q", title)
+	}
+	mdigest := rec.Header().Get("Docker-Content-Digest")
+	if rec := get("manifests/" + mdigest); rec.Code != http.StatusOK {
+		t.Errorf("manifest by digest: got %d", rec.Code)
+	}
+	if rec := get("blobs/" + digest); rec.Code != http.StatusOK || rec.Body.String() != file {
+		t.Errorf("blob: got %d %q", rec.Code, rec.Body)
+	}
+	if rec := get("blobs/" + m.Config.Digest); rec.Code != http.StatusOK || rec.Body.String() != "{}" {
+		t.Errorf("config: got %d %q", rec.Code, rec.Body)
+	}
+	if rec := get("tags/list"); rec.Body.String() != "{\"name\":\"bootstrap/cni\",\"tags\":[\"v1.5.1\"]}\n" {
+		t.Errorf("tags: got %s", rec.Body)
+	}
+	if n := downloads.Load(); n != 1 {
+		t.Errorf("%d downloads, want 1", n)
+	}
+
+	// An evicted blob is downloaded again from the URL its manifest records.
+	if err := h.Cache.Delete(t.Context(), cache.BlobKey(digest)); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("blobs/" + digest); rec.Code != http.StatusOK || rec.Body.String() != file {
+		t.Errorf("evicted blob: got %d %q", rec.Code, rec.Body)
+	}
+	if n := downloads.Load(); n != 2 {
+		t.Errorf("%d downloads, want 2", n)
+	}
+
+	if rec := get("manifests/v9.9.9"); rec.Code != http.StatusNotFound {
+		t.Errorf("missing release: got %d", rec.Code)
+	}
+	if rec := get("blobs/sha256:" + hex.EncodeToString(make([]byte, 32))); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown blob: got %d", rec.Code)
+	}
+}
+
+func TestParseArtifactSources(t *testing.T) {
+	sources, err := ParseArtifactSources(map[string]string{
+		"bootstrap/cni": "github:containernetworking/plugins/cni-plugins-linux-amd64-{tag}.tgz",
+	}, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "https://github.com/containernetworking/plugins/releases/download/v1.5.1/cni-plugins-linux-amd64-v1.5.1.tgz"
+	if got := sources[0].url("v1.5.1"); got != want || sources[0].Token != "token" {
+		t.Errorf("url = %q, token %q", got, sources[0].Token)
+	}
+
+	for _, spec := range []string{
+		"github:containernetworking/plugins",
+		"ftp://files.test/{tag}.tgz",
+		"https://files.test/kubelet",
+		"files.test/{tag}",
+	} {
+		if _, err := ParseArtifactSources(map[string]string{"bootstrap/x": spec}, ""); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+	if _, err := ParseArtifactSources(map[string]string{"Bad Name": "https://files.test/{tag}"}, ""); err == nil {
+		t.Error("invalid repository name accepted")
+	}
+}
+
+func TestArtifactFillCountsJoiningRequests(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("file"))
+	}))
+	defer srv.Close()
+	h := &Handler{
+		Registry:       "registry.test",
+		Cache:          cache.NewFSStore(t.TempDir(), 0),
+		Artifacts:      []ArtifactSource{{Repository: "bootstrap/cni", URL: srv.URL + "/{tag}.tgz"}},
+		ArtifactClient: srv.Client(),
+		Inflight:       stream.NewInflight(),
+	}
+	codes := make(chan int, 2)
+	for range 2 {
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/bootstrap/cni/manifests/v1", nil))
+			codes <- rec.Code
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fills := h.Inflight.List()
+		if len(fills) == 1 && fills[0].Clients == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fills = %+v, want one with both requests", fills)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+	for range 2 {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("got %d", code)
+		}
+	}
+	if fills := h.Inflight.List(); len(fills) != 0 {
+		t.Errorf("fills after both requests = %+v", fills)
+	}
+}
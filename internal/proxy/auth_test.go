@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// stubAuth replaces client credentials with a fixed token.
+type stubAuth struct{ managed bool }
+
+func (a stubAuth) Authorize(req *http.Request, _, _ string) error {
+	req.Header.Set("Authorization", "Bearer proxy-token")
+	return nil
+}
+
+func (a stubAuth) ProxyManaged(string) bool { return a.managed }
+
+func TestUpstreamAuthenticator(t *testing.T) {
+	var registryAuth, cdnAuth []string
+	cdn := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnAuth = append(cdnAuth, r.Header.Get("Authorization"))
+		io.WriteString(w, "blob")
+	}))
+	defer cdn.Close()
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryAuth = append(registryAuth, r.Header.Get("Authorization"))
+		if r.URL.Path == "/v2/" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="https://auth.example/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/hop/") {
+			http.Redirect(w, r, "/hop"+r.URL.Path, http.StatusTemporaryRedirect)
+			return
+		}
+		http.Redirect(w, r, cdn.URL+"/blob", http.StatusTemporaryRedirect)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "https://")
+
+	h := &Handler{
+		Registry: host,
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &UpstreamClient{Client: cdn.Client(), Scheme: "https", Auth: stubAuth{managed: true}},
+	}
+	h.Upstream.Client.CheckRedirect = noFollow
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/team/app/blobs/sha256:"+strings.Repeat("a", 64), nil)
+	req.Header.Set("Authorization", "Bearer client-token")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if len(registryAuth) != 2 || registryAuth[0] != "Bearer proxy-token" || registryAuth[1] != "Bearer proxy-token" {
+		t.Fatalf("registry should see proxy credentials on every same-host hop, got %q", registryAuth)
+	}
+	if len(cdnAuth) != 1 || cdnAuth[0] != "" {
+		t.Fatalf("credentials leaked to redirect target: %q", cdnAuth)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if rec.Code != http.StatusOK || len(registryAuth) != 2 {
+		t.Fatalf("/v2/ with proxy-managed auth should be answered locally, got %d", rec.Code)
+	}
+
+	h.Upstream.Auth = stubAuth{managed: false}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("/v2/ challenge should be relayed, got %d", rec.Code)
+	}
+}
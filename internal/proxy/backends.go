@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// BackendHeader names the host an upstream response was finally served
+// from when the registry redirected to it. It is stored with cached
+// objects, so where a copy came from can be told later.
+const BackendHeader = "X-Oci-Upstream-Backend"
+
+var upstreamBackends = metrics.NewCounterVec("oci_upstream_backend_responses_total",
+	"Upstream responses served from a regional backing store a registry redirected to, by registry, backend kind and region.",
+	"registry", "backend", "region")
+
+// Regional backing stores. registry.k8s.io redirects pulls to the one
+// nearest the client: Artifact Registry ("us-east4-docker.pkg.dev") or an
+// S3 bucket ("prod-registry-k8s-io-us-east-2.s3.dualstack.us-east-2.amazonaws.com").
+var (
+	artifactRegistryHost = regexp.MustCompile(`^([a-z]+-[a-z]+[0-9]+)-docker\.pkg\.dev$`)
+	s3Host               = regexp.MustCompile(`^[a-z0-9.-]+\.s3(?:\.dualstack)?\.([a-z]{2}(?:-gov)?-[a-z]+-[0-9]+)\.amazonaws\.com$`)
+	gcpRegion            = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+$`)
+	awsRegion            = regexp.MustCompile(`^[a-z]{2}(?:-gov)?-[a-z]+-[0-9]+$`)
+)
+
+// backend identifies the kind and region of a regional backing store
+// host, reporting false for any other host.
+func backend(host string) (kind, region string, ok bool) {
+	host = strings.ToLower(host)
+	if m := artifactRegistryHost.FindStringSubmatch(host); m != nil {
+		return "artifact-registry", m[1], true
+	}
+	if m := s3Host.FindStringSubmatch(host); m != nil {
+		return "s3", m[1], true
+	}
+	return "", "", false
+}
+
+// ParseRegions parses a "+"-separated list of preferred backend regions,
+// at most one per backend kind: a Google Cloud region for Artifact
+// Registry ("us-east4") and an AWS region for S3 ("us-east-2").
+func ParseRegions(spec string) ([]string, error) {
+	var regions []string
+	var gcp, aws bool
+	for _, r := range strings.Split(spec, "+") {
+		r = strings.ToLower(strings.TrimSpace(r))
+		switch {
+		case r == "":
+			continue
+		case gcpRegion.MatchString(r) && !gcp:
+			gcp = true
+		case awsRegion.MatchString(r) && !aws:
+			aws = true
+		case gcpRegion.MatchString(r) || awsRegion.MatchString(r):
+			return nil, fmt.Errorf("more than one region for the backend of %q", r)
+		default:
+			return nil, fmt.Errorf("unrecognised region %q", r)
+		}
+		regions = append(regions, r)
+	}
+	return regions, nil
+}
+
+// pinRegion rewrites a redirect target on a regional backing store to the
+// registry's preferred region for that kind of store, if one is set.
+// Stores hold the same content at the same path in every region.
+func (u *UpstreamClient) pinRegion(registry, host string) string {
+	kind, region, ok := backend(host)
+	if !ok {
+		return host
+	}
+	for _, want := range u.PreferredRegions[strings.ToLower(registry)] {
+		if want == region {
+			return host
+		}
+		if (kind == "artifact-registry" && gcpRegion.MatchString(want)) || (kind == "s3" && awsRegion.MatchString(want)) {
+			// S3 bucket names repeat the region.
+			return strings.ReplaceAll(strings.ToLower(host), region, want)
+		}
+	}
+	return host
+}
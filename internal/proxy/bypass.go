@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// BypassHeader is the request header a trusted client sets to force a direct
+// upstream fetch that neither reads from nor writes to the cache.
+const BypassHeader = "X-Oci-Cache-Bypass"
+
+// bypassQueryParam is the query-string equivalent of BypassHeader, for
+// clients that can't set custom headers (e.g. curl one-liners in a browser).
+const bypassQueryParam = "oci-cache-bypass"
+
+// ParseCIDRs parses a list of CIDR prefixes (or bare IP addresses, treated as
+// single-host prefixes) into netip.Prefix values.
+func ParseCIDRs(items []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", item, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", item, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// wantsBypass reports whether the request asks for the cache to be bypassed
+// and comes from a trusted client. Untrusted requests carrying the header are
+// served normally so the cache can't be defeated from arbitrary networks.
+func (h *Handler) wantsBypass(r *http.Request) bool {
+	if len(h.BypassTrustedNets) == 0 {
+		return false
+	}
+	if !isTruthy(r.Header.Get(BypassHeader)) && !isTruthy(r.URL.Query().Get(bypassQueryParam)) {
+		return false
+	}
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return false
+	}
+	for _, prefix := range h.BypassTrustedNets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr extracts the client IP from the connection's remote address.
+// X-Forwarded-For is deliberately ignored since clients control it.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func isTruthy(s string) bool {
+	switch strings.ToLower(s) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
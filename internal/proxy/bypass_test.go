@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestBypassTrustedClient(t *testing.T) {
+	var upstreamHits int
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits++
+		w.Write([]byte("fresh"))
+	}))
+	defer upstream.Close()
+
+	newHandler := func() *Handler {
+		return &Handler{
+			Registry: strings.TrimPrefix(upstream.URL, "https://"),
+			Cache: &mockStore{result: &cache.GetResult{
+				Body: &seekableBody{bytes.NewReader([]byte(testBlob))},
+				Meta: blobMeta(),
+			}},
+			Upstream:          &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+			BypassTrustedNets: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		remote     string
+		target     string
+		header     string
+		wantBody   string
+		wantBypass bool
+	}{
+		{name: "trusted header", remote: "10.1.2.3:5000", target: blobPath(), header: "true", wantBody: "fresh", wantBypass: true},
+		{name: "trusted query", remote: "10.1.2.3:5000", target: blobPath() + "?oci-cache-bypass=1", wantBody: "fresh", wantBypass: true},
+		{name: "untrusted header", remote: "192.0.2.1:5000", target: blobPath(), header: "true", wantBody: testBlob},
+		{name: "trusted without header", remote: "10.1.2.3:5000", target: blobPath(), wantBody: testBlob},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamHits = 0
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.RemoteAddr = tt.remote
+			if tt.header != "" {
+				req.Header.Set(BypassHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			newHandler().ServeHTTP(rec, req)
+
+			if body := rec.Body.String(); body != tt.wantBody {
+				t.Fatalf("expected body %q, got %q", tt.wantBody, body)
+			}
+			if gotBypass := upstreamHits > 0; gotBypass != tt.wantBypass {
+				t.Fatalf("expected bypass=%v, upstream hits=%d", tt.wantBypass, upstreamHits)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	got, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.7", "::1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.7/32", "::1/128"}
+	for i, p := range got {
+		if p.String() != want[i] {
+			t.Fatalf("prefix %d: got %s, want %s", i, p, want[i])
+		}
+	}
+
+	if _, err := ParseCIDRs([]string{"not-an-ip"}); err == nil {
+		t.Fatal("expected error for invalid address")
+	}
+}
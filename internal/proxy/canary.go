@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/gc"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// controlCohort labels requests no canary applies to.
+const controlCohort = "control"
+
+var (
+	cohortRequests = metrics.NewCounterVec("oci_policy_cohort_requests_total",
+		"Tag manifest requests while policy canaries are configured, by cohort (a canary's name, or control) and how they were answered (hit, stale, upstream).",
+		"cohort", "result")
+	cohortSeconds = metrics.NewHistogramVec("oci_policy_cohort_request_seconds",
+		"Time to answer tag manifest requests while policy canaries are configured, by cohort.",
+		nil, "cohort")
+)
+
+// Canary applies different tag caching settings to a share of
+// repositories, so a change such as a shorter TagTTL can be tried on part
+// of a busy cache and compared with the rest before it is rolled out.
+// Settings left unset keep the Handler's.
+type Canary struct {
+	// Name labels the canary's cohort in metrics.
+	Name string `json:"name"`
+	// Repositories are patterns over "registry/name", matched with
+	// cache.MatchRepository. Empty selects every repository.
+	Repositories []string `json:"repositories,omitempty"`
+	// Percent is the share of the selected repositories the canary covers;
+	// zero covers all of them. Membership is fixed by a hash of the
+	// repository's name rather than drawn per request, so each
+	// repository's cached tags age under one set of rules.
+	Percent float64 `json:"percent,omitempty"`
+
+	CacheTagManifests *bool        `json:"cache_tag_manifests,omitempty"`
+	CacheLatestTag    *bool        `json:"cache_latest_tag,omitempty"`
+	TagTTL            *gc.Duration `json:"tag_manifest_ttl,omitempty"`
+	TagMaxStale       *gc.Duration `json:"tag_manifest_max_stale,omitempty"`
+}
+
+// LoadCanaries reads a JSON array of canaries from path. The first canary
+// covering a repository applies to it.
+func LoadCanaries(path string) ([]Canary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var canaries []Canary
+	if err := json.Unmarshal(data, &canaries); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i, c := range canaries {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("canary %d: %w", i, err)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("canary %d: duplicate name %q", i, c.Name)
+		}
+		names[c.Name] = true
+	}
+	return canaries, nil
+}
+
+func (c Canary) validate() error {
+	if c.Name == "" || c.Name == controlCohort {
+		return fmt.Errorf("canary needs a name other than %q", controlCohort)
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100, got %v", c.Percent)
+	}
+	if c.CacheTagManifests == nil && c.CacheLatestTag == nil && c.TagTTL == nil && c.TagMaxStale == nil {
+		return errors.New("canary changes no settings")
+	}
+	if (c.TagTTL != nil && *c.TagTTL < 0) || (c.TagMaxStale != nil && *c.TagMaxStale < 0) {
+		return errors.New("durations must not be negative")
+	}
+	for _, pat := range c.Repositories {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pat, err)
+		}
+	}
+	return nil
+}
+
+// covers reports whether the canary applies to repo ("registry/name").
+func (c *Canary) covers(repo string) bool {
+	if !cache.MatchRepository(c.Repositories, repo) {
+		return false
+	}
+	if c.Percent <= 0 || c.Percent >= 100 {
+		return true
+	}
+	// Hashing the name in keeps two canaries' shares independent.
+	f := fnv.New32a()
+	io.WriteString(f, c.Name+"\x00"+repo)
+	return float64(f.Sum32()%10000) < c.Percent*100
+}
+
+// tagPolicy is the tag caching settings in force for one repository.
+type tagPolicy struct {
+	cohort      string
+	cacheTags   bool
+	cacheLatest bool
+	ttl         time.Duration
+	maxStale    time.Duration
+}
+
+// tagPolicy returns the Handler's tag settings with the overrides of the
+// first canary covering info's repository.
+func (h *Handler) tagPolicy(info requestInfo) tagPolicy {
+	p := tagPolicy{
+		cohort:      controlCohort,
+		cacheTags:   h.CacheTagManifests,
+		cacheLatest: h.CacheLatestTag,
+		ttl:         h.TagTTL,
+		maxStale:    h.TagMaxStale,
+	}
+	repo := info.Registry + "/" + info.Name
+	for i := range h.Canaries {
+		c := &h.Canaries[i]
+		if !c.covers(repo) {
+			continue
+		}
+		p.cohort = c.Name
+		if c.CacheTagManifests != nil {
+			p.cacheTags = *c.CacheTagManifests
+		}
+		if c.CacheLatestTag != nil {
+			p.cacheLatest = *c.CacheLatestTag
+		}
+		if c.TagTTL != nil {
+			p.ttl = time.Duration(*c.TagTTL)
+		}
+		if c.TagMaxStale != nil {
+			p.maxStale = time.Duration(*c.TagMaxStale)
+		}
+		break
+	}
+	return p
+}
+
+// countCohort records how a tag manifest request was answered, for
+// comparing canaries with the control cohort.
+func (h *Handler) countCohort(info requestInfo, result string) {
+	if len(h.Canaries) == 0 || !info.isTagManifest() {
+		return
+	}
+	cohortRequests.Inc(h.tagPolicy(info).cohort, result)
+}
+
+// observeCohort records the time since start taken to answer a tag
+// manifest request.
+func (h *Handler) observeCohort(info requestInfo, start time.Time) {
+	if len(h.Canaries) == 0 || !info.isTagManifest() {
+		return
+	}
+	cohortSeconds.Observe(time.Since(start).Seconds(), h.tagPolicy(info).cohort)
+}
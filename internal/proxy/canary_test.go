@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestCanaryOverridesTagCaching(t *testing.T) {
+	var mu sync.Mutex
+	fetches := make(map[string]int)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches[r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		io.WriteString(w, `{"schemaVersion":2}`)
+	}))
+	defer upstream.Close()
+
+	registry := strings.TrimPrefix(upstream.URL, "https://")
+	on := true
+	h := &Handler{
+		Registry: registry,
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		Canaries: []Canary{{Name: "tag-cache", Repositories: []string{registry + "/org/*"}, CacheTagManifests: &on}},
+	}
+	for range 3 {
+		for _, path := range []string{"/v2/org/app/manifests/v1", "/v2/other/app/manifests/v1"} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: got %d", path, rec.Code)
+			}
+		}
+	}
+	if got := fetches["/v2/org/app/manifests/v1"]; got != 1 {
+		t.Errorf("canary repository fetched %d times, want 1 (cached)", got)
+	}
+	if got := fetches["/v2/other/app/manifests/v1"]; got != 3 {
+		t.Errorf("control repository fetched %d times, want 3 (uncached)", got)
+	}
+}
+
+func TestCanaryPercentIsStable(t *testing.T) {
+	c := &Canary{Name: "quarter", Percent: 25}
+	var in int
+	for i := range 2000 {
+		repo := fmt.Sprintf("ghcr.io/org/app-%d", i)
+		covered := c.covers(repo)
+		if covered != c.covers(repo) {
+			t.Fatalf("%s flipped between calls", repo)
+		}
+		if covered {
+			in++
+		}
+	}
+	if in < 400 || in > 600 {
+		t.Fatalf("25%% canary covered %d of 2000 repositories", in)
+	}
+}
+
+func TestLoadCanariesRejectsBadEntries(t *testing.T) {
+	for name, body := range map[string]string{
+		"no name":      `[{"tag_manifest_ttl":"5m"}]`,
+		"control name": `[{"name":"control","tag_manifest_ttl":"5m"}]`,
+		"no settings":  `[{"name":"a","percent":10}]`,
+		"percent":      `[{"name":"a","percent":150,"tag_manifest_ttl":"5m"}]`,
+		"duplicate":    `[{"name":"a","tag_manifest_ttl":"5m"},{"name":"a","cache_latest_tag":true}]`,
+		"pattern":      `[{"name":"a","repositories":["["],"tag_manifest_ttl":"5m"}]`,
+	} {
+		path := filepath.Join(t.TempDir(), "canaries.json")
+		os.WriteFile(path, []byte(body), 0o644)
+		if _, err := LoadCanaries(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "canaries.json")
+	os.WriteFile(path, []byte(`[{"name":"short-ttl","repositories":["ghcr.io/org/*"],"tag_manifest_ttl":"1d"}]`), 0o644)
+	canaries, err := LoadCanaries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{TagTTL: time.Hour, Canaries: canaries}
+	if p := h.tagPolicy(requestInfo{Registry: "ghcr.io", Name: "org/app"}); p.cohort != "short-ttl" || p.ttl != 24*time.Hour {
+		t.Fatalf("canary repository got %+v", p)
+	}
+	if p := h.tagPolicy(requestInfo{Registry: "ghcr.io", Name: "other/app"}); p.cohort != controlCohort || p.ttl != time.Hour {
+		t.Fatalf("control repository got %+v", p)
+	}
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+	"github.com/danielloader/oci-pull-through/internal/stream"
+)
+
+// Chunked blob caching. Clients that read large blobs by range (model
+// loaders, lazy-pulling snapshotters) may never fetch a whole blob, so
+// nothing of it would be cached. With ChunkSize set, a range request for
+// an uncached blob is served from fixed-size chunks (cache.ChunkKey),
+// each fetched from upstream by range the first time any client needs
+// part of it. A blob cached whole is still served from the whole copy.
+
+var blobChunks = metrics.NewCounterVec("oci_blob_chunks_total",
+	"Blob chunks read for range requests, by result (hit or miss).", "result")
+
+// errNoChunk means upstream didn't answer a chunk request with the range
+// asked for, so the request is better served the ordinary way.
+var errNoChunk = errors.New("upstream did not return the requested chunk")
+
+// serveChunks answers a range request for an uncached blob from chunks.
+// It returns false, having written nothing, when the request isn't one it
+// handles (no single byte range, If-Range) or upstream won't serve ranges.
+func (h *Handler) serveChunks(w http.ResponseWriter, r *http.Request, info requestInfo, key string) bool {
+	first, last, ok := parseByteRange(r.Header.Get("Range"))
+	if !ok || r.Header.Get("If-Range") != "" {
+		return false
+	}
+	size := h.ChunkSize
+	offset := first - first%size
+	c, err := h.openChunk(r, info, key, offset)
+	if err != nil {
+		if !errors.Is(err, errNoChunk) {
+			slog.Debug("chunk unavailable, fetching range directly", "image", info.image(), "ref", info.shortRef(), "error", err)
+		}
+		return false
+	}
+	total := c.total
+	if first >= total {
+		c.Close()
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		writeOCIError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UNKNOWN", "range starts past the end of the blob")
+		return true
+	}
+	if last < 0 || last >= total {
+		last = total - 1
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", info.Reference)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, total))
+	w.Header().Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+	setCacheControl(w, info)
+	w.WriteHeader(http.StatusPartialContent)
+
+	for {
+		// Each chunk is read whole, so a miss caches all of it; only the
+		// part within the range reaches the client.
+		end := min(offset+size, total) - 1
+		win := &window{w: w, skip: max(first-offset, 0), n: min(last, end) - max(first, offset) + 1}
+		err := c.copyTo(r.Context(), win)
+		c.Close()
+		if err != nil {
+			slog.Debug("chunked range cut short", "image", info.image(), "offset", offset, "error", err)
+			return true
+		}
+		offset += size
+		if offset > last {
+			return true
+		}
+		if c, err = h.openChunk(r, info, key, offset); err != nil {
+			// The status is out; all that's left is to end short.
+			slog.Warn("chunked range cut short", "image", info.image(), "offset", offset, "error", err)
+			return true
+		}
+	}
+}
+
+// chunk is one chunk being read, from the cache or from upstream.
+type chunk struct {
+	total   int64 // size of the whole blob
+	cached  io.ReadCloser
+	resp    *http.Response
+	key     string
+	meta    cache.ObjectMeta
+	store   cache.Store
+	uploads *stream.Uploads
+	cancel  context.CancelFunc
+}
+
+// openChunk opens the chunk of info's blob at offset. key is the blob's
+// own storage key, whose partition chunks share.
+func (h *Handler) openChunk(r *http.Request, info requestInfo, key string, offset int64) (*chunk, error) {
+	ck := sibling(key, h.KeySchema.ChunkKey(info.Registry, info.Reference, offset))
+	if res, err := h.Cache.GetWithMeta(r.Context(), ck); err == nil {
+		if _, _, total, ok := parseContentRange(res.Meta.Header.Get("Content-Range")); ok {
+			blobChunks.Inc("hit")
+			return &chunk{total: total, cached: res.Body}, nil
+		}
+		res.Body.Close()
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	req := r.Clone(ctx)
+	req.Header.Del("If-Range")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+h.ChunkSize-1))
+	resp, err := h.Upstream.Do(req, info)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	start, end, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if resp.StatusCode != http.StatusPartialContent || !ok || start != offset ||
+		end != min(offset+h.ChunkSize, total)-1 {
+		resp.Body.Close()
+		cancel()
+		return nil, errNoChunk
+	}
+	blobChunks.Inc("miss")
+	meta := cache.ObjectMeta{
+		ContentType:         "application/octet-stream",
+		DockerContentDigest: info.Reference,
+		ContentLength:       end - start + 1,
+		Header: http.Header{
+			"Content-Type":          {"application/octet-stream"},
+			"Content-Range":         {resp.Header.Get("Content-Range")},
+			"Content-Length":        {strconv.FormatInt(end-start+1, 10)},
+			"Docker-Content-Digest": {info.Reference},
+		},
+	}
+	return &chunk{total: total, resp: resp, key: ck, meta: meta, store: h.Cache, uploads: h.Uploads, cancel: cancel}, nil
+}
+
+// copyTo writes the whole chunk to dst, caching it on the way when it
+// came from upstream.
+func (c *chunk) copyTo(ctx context.Context, dst io.Writer) error {
+	if c.cached != nil {
+		_, err := io.Copy(dst, c.cached)
+		return err
+	}
+	body := io.LimitReader(c.resp.Body, c.meta.ContentLength)
+	// A chunk is part of a blob, so there is no digest to check it against.
+	return c.uploads.TeeToStore(ctx, body, dst, c.store, c.key, c.meta, "")
+}
+
+func (c *chunk) Close() {
+	if c.cached != nil {
+		c.cached.Close()
+		return
+	}
+	c.resp.Body.Close()
+	c.cancel()
+}
+
+// window writes the n bytes after the first skip it's given, and quietly
+// drops the rest.
+type window struct {
+	w       io.Writer
+	skip, n int64
+}
+
+func (v *window) Write(p []byte) (int, error) {
+	written := len(p)
+	if v.skip > 0 {
+		s := min(v.skip, int64(len(p)))
+		p, v.skip = p[s:], v.skip-s
+	}
+	if int64(len(p)) > v.n {
+		p = p[:v.n]
+	}
+	if len(p) == 0 {
+		return written, nil
+	}
+	n, err := v.w.Write(p)
+	v.n -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return written, nil
+}
+
+// parseByteRange parses a single "bytes=first-last" or "bytes=first-"
+// range; last is -1 when open. Suffix and multiple ranges aren't
+// supported.
+func parseByteRange(s string) (first, last int64, ok bool) {
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	a, b, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok || a == "" {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseInt(a, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+	if b == "" {
+		return first, -1, true
+	}
+	last, err = strconv.ParseInt(b, 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// parseContentRange parses "bytes start-end/total" with a known total.
+func parseContentRange(s string) (start, end, total int64, ok bool) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	span, size, ok := strings.Cut(spec, "/")
+	a, b, ok2 := strings.Cut(span, "-")
+	if !ok || !ok2 {
+		return 0, 0, 0, false
+	}
+	var err1, err2, err3 error
+	start, err1 = strconv.ParseInt(a, 10, 64)
+	end, err2 = strconv.ParseInt(b, 10, 64)
+	total, err3 = strconv.ParseInt(size, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || start < 0 || end < start || total <= end {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
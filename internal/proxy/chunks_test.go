@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestChunkedRanges(t *testing.T) {
+	blob := "0123456789abcdefghijklmnopqrstuvwxy" // 35 bytes
+	digest := "sha256:" + strings.Repeat("cd", 32)
+	var requests atomic.Int32
+	ranges := true
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if !ranges {
+			w.Write([]byte(blob))
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(blob))
+	}))
+	defer upstream.Close()
+
+	store := cache.NewFSStore(t.TempDir(), 0)
+	h := &Handler{
+		Registry:  strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:     store,
+		Upstream:  &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		ChunkSize: 10,
+	}
+	get := func(rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/org/model/blobs/"+digest, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	check := func(rng, want, contentRange string, upstreamRequests int32) {
+		t.Helper()
+		requests.Store(0)
+		rec := get(rng)
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != want || rec.Header().Get("Content-Range") != contentRange {
+			t.Fatalf("%s: got %d %q %q", rng, rec.Code, rec.Body, rec.Header().Get("Content-Range"))
+		}
+		if n := requests.Load(); n != upstreamRequests {
+			t.Errorf("%s: %d upstream requests, want %d", rng, n, upstreamRequests)
+		}
+	}
+
+	check("bytes=5-24", blob[5:25], "bytes 5-24/35", 3)
+	for _, off := range []int64{0, 10, 20} {
+		if _, err := store.Head(context.Background(), cache.ChunkKey(digest, off)); err != nil {
+			t.Errorf("chunk at %d not cached: %v", off, err)
+		}
+	}
+	check("bytes=12-34", blob[12:], "bytes 12-34/35", 1) // only the last chunk is new
+	check("bytes=30-", blob[30:], "bytes 30-34/35", 0)
+	check("bytes=0-1000", blob, "bytes 0-34/35", 0)
+
+	if rec := get("bytes=40-"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: got %d", rec.Code)
+	}
+	// Requests chunks can't answer go upstream as before.
+	if rec := get("bytes=0-1,5-6"); rec.Code != http.StatusPartialContent || !strings.HasPrefix(rec.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Errorf("multiple ranges: got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	ranges = false
+	h.Cache = cache.NewFSStore(t.TempDir(), 0)
+	if rec := get("bytes=5-9"); rec.Code != http.StatusOK || rec.Body.String() != blob {
+		t.Errorf("upstream without ranges: got %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	for s, want := range map[string][3]int64{
+		"bytes=0-9":     {0, 9, 1},
+		"bytes=10-":     {10, -1, 1},
+		"bytes=-5":      {0, 0, 0},
+		"bytes=5-1":     {0, 0, 0},
+		"bytes=0-1,3-4": {0, 0, 0},
+		"items=0-1":     {0, 0, 0},
+	} {
+		first, last, ok := parseByteRange(s)
+		if ok != (want[2] == 1) || ok && (first != want[0] || last != want[1]) {
+			t.Errorf("parseByteRange(%q) = %d, %d, %v", s, first, last, ok)
+		}
+	}
+}
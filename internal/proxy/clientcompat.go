@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// This file holds the handling of known client quirks. Each is covered by
+// the request fixtures in testdata/clients, replayed against one handler
+// so that a fix for one client is checked against the others.
+//
+//   - Older Docker daemons reject responses, errors included, without
+//     Docker-Distribution-API-Version: ServeHTTP sets it on every
+//     registry response, and upstream's copy is dropped so it's never
+//     doubled.
+//   - Docker sends each accepted manifest type as its own Accept line:
+//     acceptHeader joins them, so upstream sees them all rather than the
+//     first.
+//   - Podman (containers/image) resolves tags with HEAD and needs
+//     Docker-Content-Digest and Content-Length on the answer: completeHead
+//     fetches the manifest to fill them when upstream leaves them out.
+//   - Kaniko and other clients that ask for single-image manifests only
+//     must not be served a cached index they can't parse: acceptable
+//     sends such tag requests upstream instead, without caching the
+//     narrower answer over the index.
+
+// apiVersionHeader is the header Docker clients check on every response.
+const apiVersionHeader = "Docker-Distribution-API-Version"
+
+// maxHeadManifest bounds the manifest fetched to complete a HEAD answer
+// when MaxManifestSize is unset.
+const maxHeadManifest = 4 << 20
+
+var clientQuirks = metrics.NewCounterVec("oci_client_quirk_total",
+	"Requests adjusted for a known client quirk (head-digest, not-acceptable).", "quirk")
+
+// acceptHeader returns all of r's Accept lines as one comma-separated
+// header value.
+func acceptHeader(r *http.Request) string {
+	return strings.Join(r.Header.Values("Accept"), ", ")
+}
+
+// acceptable reports whether r accepts mediaType. Requests without
+// Accept, with a wildcard, or for a digest (whose content is fixed)
+// accept anything; so does a cached object whose type was never recorded.
+func acceptable(r *http.Request, info requestInfo, mediaType string) bool {
+	accept := acceptHeader(r)
+	if accept == "" || mediaType == "" || !info.isTagManifest() {
+		return true
+	}
+	want, _, _ := mime.ParseMediaType(mediaType)
+	for _, part := range strings.Split(accept, ",") {
+		t, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if t == "*/*" || t == "application/*" || t == want {
+			return true
+		}
+	}
+	return false
+}
+
+// completeHead fills Docker-Content-Digest and Content-Length on an
+// upstream 200 answer to a manifest HEAD that lacks them. A digest
+// reference names its own digest; a tag needs the manifest fetched and
+// hashed.
+func (h *Handler) completeHead(r *http.Request, info requestInfo, resp *http.Response) {
+	if info.Kind != "manifests" || resp.StatusCode != http.StatusOK ||
+		(resp.Header.Get("Docker-Content-Digest") != "" && resp.Header.Get("Content-Length") != "") {
+		return
+	}
+	if !info.isTagManifest() && resp.Header.Get("Content-Length") != "" {
+		resp.Header.Set("Docker-Content-Digest", info.Reference)
+		clientQuirks.Inc("head-digest")
+		return
+	}
+	digest, size, err := h.manifestDigest(r, info)
+	if err != nil {
+		slog.Debug("could not complete manifest HEAD", "image", info.image(), "ref", info.shortRef(), "error", err)
+		return
+	}
+	resp.Header.Set("Docker-Content-Digest", digest)
+	resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	clientQuirks.Inc("head-digest")
+}
+
+// manifestDigest GETs the manifest r asks HEAD for and returns its digest
+// and size.
+func (h *Handler) manifestDigest(r *http.Request, info requestInfo) (string, int64, error) {
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+	resp, err := h.Upstream.Do(get, info)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("upstream GET returned %s", resp.Status)
+	}
+	limit := h.MaxManifestSize
+	if limit <= 0 {
+		limit = maxHeadManifest
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return "", 0, err
+	}
+	if n > limit {
+		return "", 0, fmt.Errorf("manifest is over %d bytes", limit)
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+// errNotAcceptable marks a cached tag in a media type the client didn't ask
+// for.
+var errNotAcceptable = errors.New("cached manifest type not acceptable to the client")
+
+// notAcceptable counts and logs a cached tag passed over for its type.
+func notAcceptable(info requestInfo, mediaType string) {
+	clientQuirks.Inc("not-acceptable")
+	slog.Debug("cached tag manifest type not acceptable to client; asking upstream",
+		"image", info.image(), "tag", info.Reference, "type", mediaType)
+}
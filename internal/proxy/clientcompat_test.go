@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clientFixture is a recorded sequence of requests from one client, with
+// what each must get back. {{blob}} in paths is replaced with the digest
+// of the upstream fixture's blob.
+type clientFixture struct {
+	UserAgent string `json:"user_agent"`
+	Requests  []struct {
+		Method      string              `json:"method"`
+		Path        string              `json:"path"`
+		Header      map[string][]string `json:"header"`
+		Status      int                 `json:"status"`
+		ContentType string              `json:"content_type"`
+	} `json:"requests"`
+}
+
+// TestClientConformance replays each client's requests against one
+// handler and cache, in an order where each client meets what the ones
+// before it left cached.
+func TestClientConformance(t *testing.T) {
+	srv, upstream := serveFixtures(t, "clients")
+	h := quirksHandler(t, srv, nil)
+	h.CacheTagManifests = true
+	var blob string
+	for _, f := range upstream {
+		if strings.Contains(f.Path, "/blobs/") {
+			blob = f.digest()
+		}
+	}
+
+	for _, client := range []string{"docker", "podman", "kaniko", "containerd"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "clients", client+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fx clientFixture
+		if err := json.Unmarshal(data, &fx); err != nil {
+			t.Fatalf("%s: %v", client, err)
+		}
+		for _, step := range fx.Requests {
+			name := client + " " + step.Method + " " + step.Path
+			req := httptest.NewRequest(step.Method, strings.ReplaceAll(step.Path, "{{blob}}", blob), nil)
+			req.Header = http.Header(step.Header).Clone()
+			if req.Header == nil {
+				req.Header = make(http.Header)
+			}
+			req.Header.Set("User-Agent", fx.UserAgent)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != step.Status {
+				t.Errorf("%s: status %d, want %d: %s", name, rec.Code, step.Status, rec.Body)
+				continue
+			}
+			if v := rec.Header().Values(apiVersionHeader); len(v) != 1 || v[0] != "registry/2.0" {
+				t.Errorf("%s: %s = %q", name, apiVersionHeader, v)
+			}
+			if step.ContentType != "" && rec.Header().Get("Content-Type") != step.ContentType {
+				t.Errorf("%s: Content-Type %q, want %q", name, rec.Header().Get("Content-Type"), step.ContentType)
+			}
+			if step.Method == http.MethodHead && rec.Code == http.StatusOK {
+				for _, k := range []string{"Docker-Content-Digest", "Content-Length"} {
+					if rec.Header().Get(k) == "" {
+						t.Errorf("%s: HEAD answer without %s", name, k)
+					}
+				}
+				if rec.Body.Len() != 0 {
+					t.Errorf("%s: HEAD answer with a body", name)
+				}
+			}
+		}
+	}
+}
+
+func TestAcceptable(t *testing.T) {
+	tag := requestInfo{Kind: "manifests", Reference: "1.0"}
+	digest := requestInfo{Kind: "manifests", Reference: "sha256:abc"}
+	index := "application/vnd.oci.image.index.v1+json"
+	for _, tc := range []struct {
+		accept []string
+		info   requestInfo
+		want   bool
+	}{
+		{nil, tag, true},
+		{[]string{"application/vnd.oci.image.manifest.v1+json", index}, tag, true},
+		{[]string{"application/vnd.oci.image.manifest.v1+json; q=0.9, " + index + "; q=0.5"}, tag, true},
+		{[]string{"application/vnd.oci.image.manifest.v1+json"}, tag, false},
+		{[]string{"application/vnd.oci.image.manifest.v1+json"}, digest, true},
+		{[]string{"*/*"}, tag, true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header["Accept"] = tc.accept
+		if got := acceptable(r, tc.info, index); got != tc.want {
+			t.Errorf("Accept %q for %s: got %v, want %v", tc.accept, tc.info.Reference, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// openUpstreamConns counts upstream connections dialled and not yet closed,
+// across all upstream clients.
+var openUpstreamConns atomic.Int64
+
+var (
+	upstreamConnections = metrics.NewCounterVec("oci_upstream_connections_total",
+		"Connections obtained for upstream requests; reused=false is a new dial.",
+		"registry", "reused")
+	upstreamDNSSeconds = metrics.NewHistogramVec("oci_upstream_dns_lookup_seconds",
+		"DNS lookup latency for upstream connections.",
+		nil, "registry")
+	upstreamDialSeconds = metrics.NewHistogramVec("oci_upstream_dial_seconds",
+		"Time to establish a TCP connection to an upstream.",
+		nil)
+	_ = metrics.NewGaugeFunc("oci_upstream_open_connections",
+		"Upstream connections currently open, idle or in use.",
+		func() float64 { return float64(openUpstreamConns.Load()) })
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// trackDial wraps dial so connections are counted while open.
+func trackDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreamDialSeconds.Observe(time.Since(start).Seconds())
+		openUpstreamConns.Add(1)
+		return &trackedConn{Conn: conn}, nil
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { openUpstreamConns.Add(-1) })
+	return c.Conn.Close()
+}
+
+// withConnTrace attaches an httptrace that records connection reuse and DNS
+// latency for req.
+func withConnTrace(req *http.Request, registry string) *http.Request {
+	var dnsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			upstreamDNSSeconds.Observe(time.Since(dnsStart).Seconds(), registry)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			upstreamConnections.Inc(registry, strconv.FormatBool(info.Reused))
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// RecycleConnections closes the upstream transport's idle keep-alive
+// connections, so subsequent requests dial fresh ones. Use it when an
+// upstream load balancer has gone bad behind long-lived connections.
+// Connections mid-transfer are unaffected. It returns how many connections
+// were closed.
+func (u *UpstreamClient) RecycleConnections() int {
+	before := openUpstreamConns.Load()
+	u.Client.CloseIdleConnections()
+	return int(max(before-openUpstreamConns.Load(), 0))
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecycleConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	u := &UpstreamClient{Client: &http.Client{
+		Transport: &http.Transport{DialContext: trackDial((&net.Dialer{}).DialContext)},
+	}}
+	base := openUpstreamConns.Load()
+
+	for range 2 {
+		resp, err := u.Client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if open := openUpstreamConns.Load() - base; open != 1 {
+		t.Fatalf("expected one pooled connection, got %d", open)
+	}
+
+	if closed := u.RecycleConnections(); closed != 1 {
+		t.Fatalf("expected 1 connection closed, got %d", closed)
+	}
+	if open := openUpstreamConns.Load() - base; open != 0 {
+		t.Fatalf("expected no open connections after recycle, got %d", open)
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/faults"
+)
+
+// TestStoreFaults checks that caching stays best-effort: whatever the store
+// does, clients get upstream's bytes, and a failed write never leaves a
+// partial object behind.
+func TestStoreFaults(t *testing.T) {
+	layer := strings.Repeat("layer bytes ", 1024)
+	sum := sha256.Sum256([]byte(layer))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", digest)
+		io.WriteString(w, layer)
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		spec   string
+		cached bool // whether the fill should land
+	}{
+		{"put=1", false},
+		{"partial=1", false},
+		{"head=1,get=1", true},
+		{"all=1", false},
+		{"latency=5ms,jitter=5ms", true},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			spec, err := faults.Parse(tc.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := cache.NewFSStore(t.TempDir(), 0)
+			h := &Handler{
+				Registry: strings.TrimPrefix(upstream.URL, "https://"),
+				Cache:    faults.Wrap(base, spec, nil),
+				Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+			}
+			for pull := range 2 {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/org/app/blobs/"+digest, nil))
+				if rec.Code != http.StatusOK || rec.Body.String() != layer {
+					t.Fatalf("pull %d: got %d, %d of %d bytes", pull, rec.Code, rec.Body.Len(), len(layer))
+				}
+			}
+			_, err = base.Head(context.Background(), cache.BlobKey(digest))
+			if cached := err == nil; cached != tc.cached {
+				t.Errorf("cached = %v, want %v (%v)", cached, tc.cached, err)
+			}
+		})
+	}
+
+	// A hit whose read fails part way can't be taken back once headers are
+	// out, so the client must see a short body rather than a complete one.
+	base := cache.NewFSStore(t.TempDir(), 0)
+	meta := cache.ObjectMeta{Header: http.Header{"Content-Length": {strconv.Itoa(len(layer))}}}
+	if err := base.Put(context.Background(), cache.BlobKey(digest), strings.NewReader(layer), meta); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{Cache: faults.Wrap(base, faults.Spec{Partial: 1}, nil), Upstream: &UpstreamClient{}, Registry: "registry.test"}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/v2/org/app/blobs/" + digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err == nil || len(body) == len(layer) {
+		t.Errorf("partial read: got %d bytes, err %v; want a truncated response", len(body), err)
+	}
+}
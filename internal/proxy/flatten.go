@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// FlattenedFromAnnotation is added to flattened indexes, naming the digest
+// of the upstream index they were derived from.
+const FlattenedFromAnnotation = "io.github.oci-pull-through.flattened-from"
+
+// Platform is an os/architecture[/variant] selector for index flattening.
+// An empty Variant matches any variant.
+type Platform struct {
+	OS, Architecture, Variant string
+}
+
+// ParsePlatforms parses "os/arch[/variant]" strings.
+func ParsePlatforms(specs []string) ([]Platform, error) {
+	out := make([]Platform, 0, len(specs))
+	for _, s := range specs {
+		parts := strings.Split(s, "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid platform %q (expected os/arch or os/arch/variant)", s)
+		}
+		p := Platform{OS: parts[0], Architecture: parts[1]}
+		if len(parts) == 3 {
+			p.Variant = parts[2]
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func (p Platform) matches(os, arch, variant string) bool {
+	return p.OS == os && p.Architecture == arch && (p.Variant == "" || p.Variant == variant)
+}
+
+// flattens reports whether info's response may be rewritten: only tag
+// manifests, so digest pulls always get exactly the bytes they name.
+func (h *Handler) flattens(info requestInfo) bool {
+	return len(h.FlattenPlatforms) > 0 && info.isTagManifest()
+}
+
+func isIndex(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return manifest.IsIndexType(mt)
+}
+
+// flattenIndex drops index entries whose platform isn't in keep. It
+// reports changed=false, returning data unmodified, if every entry is kept
+// or none would be (serving an empty index helps nobody).
+func flattenIndex(data []byte, origDigest string, keep []Platform) (out []byte, digest string, changed bool, err error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, "", false, err
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(doc["manifests"], &entries); err != nil {
+		return nil, "", false, fmt.Errorf("parsing manifests: %w", err)
+	}
+
+	kept := entries[:0:0]
+	for _, raw := range entries {
+		var e struct {
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		}
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return nil, "", false, err
+		}
+		for _, p := range keep {
+			if p.matches(e.Platform.OS, e.Platform.Architecture, e.Platform.Variant) {
+				kept = append(kept, raw)
+				break
+			}
+		}
+	}
+	if len(kept) == len(entries) || len(kept) == 0 {
+		return data, origDigest, false, nil
+	}
+
+	annotations := map[string]string{}
+	if raw, ok := doc["annotations"]; ok {
+		json.Unmarshal(raw, &annotations)
+	}
+	annotations[FlattenedFromAnnotation] = origDigest
+	doc["annotations"], _ = json.Marshal(annotations)
+	doc["manifests"], _ = json.Marshal(kept)
+
+	out, err = json.Marshal(doc)
+	if err != nil {
+		return nil, "", false, err
+	}
+	sum := sha256.Sum256(out)
+	return out, "sha256:" + hex.EncodeToString(sum[:]), true, nil
+}
+
+// serveFlattened answers a tag request whose upstream response is an index
+// with the index reduced to FlattenPlatforms.
+func (h *Handler) serveFlattened(w http.ResponseWriter, r *http.Request, info requestInfo, key string, resp *http.Response) {
+	body, digest, contentType, err := h.flattenResponse(r.Context(), info, key, resp)
+	if err != nil {
+		writeError(w, "upstream error", http.StatusBadGateway)
+		return
+	}
+	if h.shouldCache(info) || h.keepsTagFallback(info) {
+		if err := h.Cache.Put(r.Context(), key, bytes.NewReader(body), manifestMeta(contentType, digest, len(body))); err != nil {
+			slog.Debug("caching index failed", "key", key, "error", err)
+		}
+	}
+
+	replayStoredHeaders(w, manifestMeta(contentType, digest, len(body)))
+	copyNoticeHeaders(w, resp)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	setCacheControl(w, info)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// flattenResponse reads an upstream index and returns it reduced to
+// FlattenPlatforms. The flattened index is cached under its own digest
+// (clients resolve the tag, then fetch by digest) and the original under
+// the upstream digest, so pulls by the original digest still get the
+// unmodified index, both beside key (the tag's own storage key). Caching
+// the tag itself is left to the caller.
+func (h *Handler) flattenResponse(ctx context.Context, info requestInfo, key string, resp *http.Response) (body []byte, digest, contentType string, err error) {
+	limit := h.MaxManifestSize
+	if limit <= 0 {
+		limit = DefaultMaxManifestSize
+	}
+	orig, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if int64(len(orig)) > limit {
+		return nil, "", "", fmt.Errorf("index is over the %d byte limit", limit)
+	}
+	origDigest := resp.Header.Get("Docker-Content-Digest")
+	if origDigest == "" {
+		sum := sha256.Sum256(orig)
+		origDigest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	contentType = resp.Header.Get("Content-Type")
+
+	body, digest, changed, err := flattenIndex(orig, origDigest, h.FlattenPlatforms)
+	if err != nil {
+		slog.Warn("could not flatten index, serving as-is", "image", info.image(), "ref", info.shortRef(), "error", err)
+		body, digest, changed = orig, origDigest, false
+	}
+
+	if changed {
+		slog.Info("flattened index", "image", info.image(), "ref", info.shortRef(), "from", origDigest, "to", digest)
+		repo := info.Registry + "/" + info.Name
+		put := func(key string, data []byte, d string) {
+			if err := h.Cache.Put(ctx, key, bytes.NewReader(data), manifestMeta(contentType, d, len(data))); err != nil {
+				slog.Debug("caching index failed", "key", key, "error", err)
+			}
+		}
+		put(sibling(key, cache.ManifestKey(repo, origDigest)), orig, origDigest)
+		put(sibling(key, cache.ManifestKey(repo, digest)), body, digest)
+	}
+	return body, digest, contentType, nil
+}
+
+func manifestMeta(contentType, digest string, size int) cache.ObjectMeta {
+	return cache.ObjectMeta{
+		ContentType:         contentType,
+		DockerContentDigest: digest,
+		ContentLength:       int64(size),
+		Header: http.Header{
+			"Content-Type":          {contentType},
+			"Docker-Content-Digest": {digest},
+			"Content-Length":        {strconv.Itoa(size)},
+			"Date":                  {time.Now().UTC().Format(http.TimeFormat)},
+		},
+	}
+}
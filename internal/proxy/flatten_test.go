@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFlattenIndex(t *testing.T) {
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[
+		{"digest":"sha256:amd","platform":{"os":"linux","architecture":"amd64"}},
+		{"digest":"sha256:arm7","platform":{"os":"linux","architecture":"arm","variant":"v7"}},
+		{"digest":"sha256:att","platform":{"os":"unknown","architecture":"unknown"}}]}`
+	keep, err := ParsePlatforms([]string{"linux/amd64", "linux/arm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, digest, changed, err := flattenIndex([]byte(index), "sha256:orig", keep)
+	if err != nil || !changed {
+		t.Fatalf("expected a rewrite, got changed=%v err=%v", changed, err)
+	}
+	if !strings.HasPrefix(digest, "sha256:") || digest == "sha256:orig" {
+		t.Fatalf("expected a new digest, got %q", digest)
+	}
+	var got struct {
+		SchemaVersion int `json:"schemaVersion"`
+		Manifests     []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Manifests) != 2 || got.Manifests[0].Digest != "sha256:amd" || got.Manifests[1].Digest != "sha256:arm7" {
+		t.Fatalf("unexpected entries %+v", got.Manifests)
+	}
+	if got.SchemaVersion != 2 || got.Annotations[FlattenedFromAnnotation] != "sha256:orig" {
+		t.Fatalf("fields not preserved: %s", out)
+	}
+
+	// Nothing matches: serve as-is rather than an empty index.
+	if _, d, changed, _ := flattenIndex([]byte(index), "sha256:orig", []Platform{{OS: "windows", Architecture: "amd64"}}); changed || d != "sha256:orig" {
+		t.Fatalf("expected unchanged index, got changed=%v digest=%s", changed, d)
+	}
+
+	if _, err := ParsePlatforms([]string{"linux"}); err == nil {
+		t.Fatal("expected error for platform without arch")
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// forwardedByProtocol are the request headers Do always forwards, as the
+// registry protocol depends on them. They can't be listed again.
+var forwardedByProtocol = map[string]struct{}{
+	"Authorization":     {},
+	"Accept":            {},
+	"Range":             {},
+	"If-Range":          {},
+	"If-None-Match":     {},
+	"If-Modified-Since": {},
+}
+
+// unforwardable are request headers that describe the client's connection
+// to the proxy, or carry its credentials for other services, so must never
+// be sent upstream.
+var unforwardable = map[string]struct{}{
+	"Host":            {},
+	"Content-Length":  {},
+	"Cookie":          {},
+	"Forwarded":       {},
+	"X-Forwarded-For": {},
+	"Accept-Encoding": {},
+}
+
+// ParseForwardHeaders validates a list of extra request header names to
+// forward upstream and returns them in canonical form. Headers the
+// protocol already forwards, hop-by-hop headers and those tied to the
+// client's connection are rejected.
+func ParseForwardHeaders(items []string) ([]string, error) {
+	headers := make([]string, 0, len(items))
+	for _, item := range items {
+		name := http.CanonicalHeaderKey(strings.TrimSpace(item))
+		if name == "" || strings.ContainsAny(name, " :") {
+			return nil, fmt.Errorf("invalid header name %q", item)
+		}
+		if _, ok := forwardedByProtocol[name]; ok {
+			return nil, fmt.Errorf("%s is always forwarded", name)
+		}
+		_, hop := hopByHopHeaders[name]
+		_, conn := unforwardable[name]
+		if hop || conn {
+			return nil, fmt.Errorf("%s can't be forwarded upstream", name)
+		}
+		headers = append(headers, name)
+	}
+	return headers, nil
+}
+
+// forwardHeaders copies the ForwardHeaders the client sent onto req.
+func (u *UpstreamClient) forwardHeaders(req, r *http.Request) {
+	for _, name := range u.ForwardHeaders {
+		if vs := r.Header.Values(name); len(vs) > 0 {
+			req.Header[name] = append([]string(nil), vs...)
+		}
+	}
+}
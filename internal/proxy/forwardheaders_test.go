@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestForwardHeaders(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	forward, err := ParseForwardHeaders([]string{"user-agent", " X-Org-Team "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https", ForwardHeaders: forward},
+	}
+	pull := func(path string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("User-Agent", "docker/27.0.3")
+		req.Header.Set("X-Org-Team", "payments")
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("X-Internal-Trace", "abc")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for _, path := range []string{"/v2/org/app/manifests/latest", "/v2/"} {
+		pull(path)
+		if got.Get("User-Agent") != "docker/27.0.3" || got.Get("X-Org-Team") != "payments" {
+			t.Errorf("%s: allowlisted headers not forwarded: %v", path, got)
+		}
+		if got.Get("Authorization") != "Bearer token" {
+			t.Errorf("%s: Authorization not forwarded", path)
+		}
+		if got.Get("Cookie") != "" || got.Get("X-Internal-Trace") != "" {
+			t.Errorf("%s: unlisted headers forwarded: %v", path, got)
+		}
+	}
+
+	// By default only the protocol's headers go upstream.
+	h.Upstream.ForwardHeaders = nil
+	pull("/v2/org/app/manifests/latest")
+	if got.Get("X-Org-Team") != "" || got.Get("User-Agent") == "docker/27.0.3" {
+		t.Errorf("headers forwarded without an allowlist: %v", got)
+	}
+}
+
+func TestParseForwardHeaders(t *testing.T) {
+	for _, bad := range []string{"Authorization", "range", "Connection", "Host", "Cookie", "Proxy-Authorization", "", "X Bad"} {
+		if _, err := ParseForwardHeaders([]string{bad}); err == nil {
+			t.Errorf("ParseForwardHeaders(%q) succeeded", bad)
+		}
+	}
+	got, err := ParseForwardHeaders([]string{"x-request-id"})
+	if err != nil || len(got) != 1 || got[0] != "X-Request-Id" {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var agents []string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.Header.Get("User-Agent"))
+		if !strings.HasPrefix(r.URL.Path, "/cdn/") {
+			http.Redirect(w, r, "/cdn"+r.URL.Path, http.StatusTemporaryRedirect)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	if ua := UserAgent("v1.4.0", "prod-eu"); ua != "oci-pull-through/v1.4.0 (prod-eu)" {
+		t.Fatalf("UserAgent = %q", ua)
+	}
+	h := &Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https", UserAgent: UserAgent("v1.4.0", "")},
+	}
+	pull := func() {
+		req := httptest.NewRequest(http.MethodGet, "/v2/org/app/blobs/sha256:"+strings.Repeat("ab", 32), nil)
+		req.Header.Set("User-Agent", "docker/27.0.3")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	pull()
+	if len(agents) != 2 || agents[0] != "oci-pull-through/v1.4.0" || agents[1] != agents[0] {
+		t.Errorf("upstream and redirect target saw %q", agents)
+	}
+	// A forwarded client User-Agent takes its place.
+	agents = nil
+	h.Upstream.ForwardHeaders = []string{"User-Agent"}
+	pull()
+	if len(agents) != 2 || agents[0] != "docker/27.0.3" || agents[1] != agents[0] {
+		t.Errorf("with User-Agent forwarded, upstream saw %q", agents)
+	}
+}
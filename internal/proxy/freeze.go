@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// ErrFrozen is returned for upstream requests to a frozen registry.
+var ErrFrozen = errors.New("upstream access is frozen")
+
+// AllRegistries freezes every upstream at once.
+const AllRegistries = "*"
+
+var frozenRequests = metrics.NewCounterVec("oci_upstream_frozen_total",
+	"Upstream requests refused because access to the registry is frozen.", "registry")
+
+// Frozen is a freeze in force.
+type Frozen struct {
+	Registry string    `json:"registry"` // AllRegistries for every upstream
+	Reason   string    `json:"reason,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+// Freeze cuts the proxy off from upstream registries, all of them or
+// named ones, without a redeploy: cached content is still served, but
+// misses are refused instead of fetched. It is meant for upstream
+// security incidents. The zero value freezes nothing; a nil *Freeze is
+// never frozen.
+type Freeze struct {
+	mu      sync.RWMutex
+	entries map[string]Frozen
+}
+
+// registryKey names the API host a freeze or cap applies to, so
+// "docker.io" and "registry-1.docker.io" are one registry.
+func registryKey(registry string) string {
+	if registry == "" || registry == AllRegistries {
+		return AllRegistries
+	}
+	return strings.ToLower(resolveRegistry(registry))
+}
+
+// Set freezes registry, or every registry for "" or AllRegistries.
+// Freezing a frozen registry updates the reason but keeps its start.
+func (f *Freeze) Set(registry, reason string) Frozen {
+	key := registryKey(registry)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.entries == nil {
+		f.entries = make(map[string]Frozen)
+	}
+	e, ok := f.entries[key]
+	if !ok {
+		e = Frozen{Registry: key, Since: time.Now().UTC()}
+	}
+	e.Reason = reason
+	f.entries[key] = e
+	slog.Warn("upstream access frozen", "registry", key, "reason", reason)
+	return e
+}
+
+// Lift ends the freeze on registry, reporting whether there was one.
+// Lifting the freeze on every registry leaves per-registry ones alone.
+func (f *Freeze) Lift(registry string) bool {
+	key := registryKey(registry)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.entries[key]; !ok {
+		return false
+	}
+	delete(f.entries, key)
+	slog.Info("upstream access unfrozen", "registry", key)
+	return true
+}
+
+// List returns the freezes in force, by registry.
+func (f *Freeze) List() []Frozen {
+	if f == nil {
+		return nil
+	}
+	f.mu.RLock()
+	list := slices.Collect(maps.Values(f.entries))
+	f.mu.RUnlock()
+	slices.SortFunc(list, func(a, b Frozen) int { return cmp.Compare(a.Registry, b.Registry) })
+	return list
+}
+
+// Frozen reports whether requests to registry are refused.
+func (f *Freeze) Frozen(registry string) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.entries) == 0 {
+		return false
+	}
+	_, all := f.entries[AllRegistries]
+	_, one := f.entries[registryKey(registry)]
+	return all || one
+}
+
+// check returns ErrFrozen if registry is frozen, counting the refusal.
+func (f *Freeze) check(registry string) error {
+	if !f.Frozen(registry) {
+		return nil
+	}
+	frozenRequests.Inc(registry)
+	return fmt.Errorf("%w: %s", ErrFrozen, registry)
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestFreezeServesCacheOnly(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "layer")
+	}))
+	defer upstream.Close()
+
+	freeze := &Freeze{}
+	h := &Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https", Freeze: freeze},
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	sum := sha256.Sum256([]byte("layer"))
+	cached := "/v2/org/app/blobs/sha256:" + hex.EncodeToString(sum[:])
+	uncached := "/v2/org/app/blobs/sha256:" + strings.Repeat("b", 64)
+	if rec := get(cached); rec.Code != http.StatusOK {
+		t.Fatalf("fill: got %d", rec.Code)
+	}
+
+	freeze.Set("", "incident")
+	before := hits.Load()
+	if rec := get(cached); rec.Code != http.StatusOK || rec.Body.String() != "layer" {
+		t.Errorf("cached blob while frozen: got %d %q", rec.Code, rec.Body)
+	}
+	rec := get(uncached)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "UNAVAILABLE") {
+		t.Errorf("miss while frozen: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := get("/v2/"); rec.Code != http.StatusOK {
+		t.Errorf("version check while frozen: got %d", rec.Code)
+	}
+	if hits.Load() != before {
+		t.Errorf("upstream contacted %d times while frozen", hits.Load()-before)
+	}
+
+	if !freeze.Lift(AllRegistries) {
+		t.Fatal("Lift reported no freeze")
+	}
+	if rec := get(uncached); rec.Code != http.StatusOK {
+		t.Errorf("miss after unfreezing: got %d", rec.Code)
+	}
+}
+
+func TestFreezeByRegistry(t *testing.T) {
+	var f Freeze
+	f.Set("docker.io", "")
+	if !f.Frozen("registry-1.docker.io") || !f.Frozen("index.docker.io") {
+		t.Error("freeze on docker.io doesn't cover its aliases")
+	}
+	if f.Frozen("ghcr.io") {
+		t.Error("ghcr.io frozen")
+	}
+	if got := f.List(); len(got) != 1 || got[0].Registry != "registry-1.docker.io" {
+		t.Errorf("List = %+v", got)
+	}
+	if f.Lift("") {
+		t.Error("lifting the global freeze removed a per-registry one")
+	}
+	var nilFreeze *Freeze
+	if nilFreeze.Frozen("ghcr.io") {
+		t.Error("nil Freeze is frozen")
+	}
+}
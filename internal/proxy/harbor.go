@@ -0,0 +1,20 @@
+package proxy
+
+import "strings"
+
+// stripProject selects the upstream registry for a /v2/ sub-path from its
+// leading Harbor proxy-project segment, and removes it, so clients
+// configured for Harbor ("/v2/proxy-dockerhub/library/nginx/...") work
+// unchanged. ok is false when the path doesn't start with a configured
+// project.
+func (h *Handler) stripProject(path string) (registry, rest string, ok bool) {
+	seg, rest, ok := strings.Cut(path, "/")
+	if !ok {
+		return "", path, false
+	}
+	registry, ok = h.Projects[strings.ToLower(seg)]
+	if !ok {
+		return "", path, false
+	}
+	return registry, rest, true
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestStripProject(t *testing.T) {
+	projects := map[string]string{"proxy-dockerhub": "registry-1.docker.io", "library": "registry-1.docker.io", "proxy-ghcr": "ghcr.io"}
+	tests := []struct {
+		name     string
+		projects map[string]string
+		path     string
+		want     string
+		wantReg  string
+		wantOK   bool
+	}{
+		{"no projects", nil, "library/nginx/manifests/1.27", "library/nginx/manifests/1.27", "", false},
+		{"known project", projects, "proxy-dockerhub/library/nginx/manifests/1.27", "library/nginx/manifests/1.27", "registry-1.docker.io", true},
+		{"known project, single-segment name", projects, "proxy-dockerhub/nginx/manifests/1.27", "nginx/manifests/1.27", "registry-1.docker.io", true},
+		{"project for another registry", projects, "proxy-ghcr/org/app/manifests/v1", "org/app/manifests/v1", "ghcr.io", true},
+		{"project case-insensitive", projects, "Proxy-GHCR/org/app/manifests/v1", "org/app/manifests/v1", "ghcr.io", true},
+		{"unknown project", projects, "proxy-quay/org/app/manifests/v1", "proxy-quay/org/app/manifests/v1", "", false},
+		{"project as a prefix of another", projects, "proxy-dockerhubx/nginx/manifests/1.27", "proxy-dockerhubx/nginx/manifests/1.27", "", false},
+		{"project only later in the path", projects, "org/proxy-dockerhub/app/manifests/v1", "org/proxy-dockerhub/app/manifests/v1", "", false},
+		// Only the leading segment is the project; the same name after it
+		// is the repository's own.
+		{"project that is also a repository segment", projects, "library/library/nginx/manifests/1.27", "library/nginx/manifests/1.27", "registry-1.docker.io", true},
+		{"project repeated", projects, "proxy-dockerhub/proxy-dockerhub/app/manifests/v1", "proxy-dockerhub/app/manifests/v1", "registry-1.docker.io", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{Projects: tt.projects}
+			reg, got, ok := h.stripProject(tt.path)
+			if reg != tt.wantReg || got != tt.want || ok != tt.wantOK {
+				t.Errorf("stripProject(%q) = %q, %q, %v, want %q, %q, %v", tt.path, reg, got, ok, tt.wantReg, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestHarborNormalizeName(t *testing.T) {
+	// Harbor's Docker Hub proxy projects take single-segment names as
+	// library images; other registries have no implicit namespace.
+	for _, tc := range []struct{ registry, name, want string }{
+		{"docker.io", "nginx", "library/nginx"},
+		{"docker.io", "library/nginx", "library/nginx"},
+		{"docker.io", "library", "library/library"},
+		{"registry-1.docker.io", "redis", "library/redis"},
+		{"docker.io", "bitnami/redis", "bitnami/redis"},
+		{"ghcr.io", "app", "app"},
+		{"quay.io", "org/app", "org/app"},
+	} {
+		if got := normalizeName(tc.registry, tc.name); got != tc.want {
+			t.Errorf("normalizeName(%q, %q) = %q, want %q", tc.registry, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHarborProjects(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		io.WriteString(w, `{"schemaVersion":2}`)
+	}))
+	defer upstream.Close()
+
+	// The project, not the default registry, selects the upstream.
+	h := &Handler{
+		Registry: "default.invalid",
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		Projects: map[string]string{"proxy-ghcr": strings.TrimPrefix(upstream.URL, "https://")},
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/v2/proxy-ghcr/org/proxy-ghcr/manifests/v1"); rec.Code != http.StatusOK {
+		t.Fatalf("project pull: got %d %s", rec.Code, rec.Body)
+	}
+	if len(paths) != 1 || paths[0] != "/v2/org/proxy-ghcr/manifests/v1" {
+		t.Errorf("upstream saw %v, want only the leading project stripped", paths)
+	}
+	if rec := get("/v2/org/app/manifests/v1"); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "NAME_UNKNOWN") {
+		t.Errorf("path outside any project: got %d %s", rec.Code, rec.Body)
+	}
+	if len(paths) != 1 {
+		t.Errorf("a path outside any project reached the upstream: %v", paths)
+	}
+}
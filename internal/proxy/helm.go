@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// Helm repository facade. Helm 3.8+ pulls charts from OCI registries, but
+// older tooling only knows classic chart repositories: an index.yaml
+// listing every version, and a URL per chart archive. With HelmFacade,
+//
+//	/helm/<namespace>/index.yaml
+//	/helm/<namespace>/charts/<name>/<name>-<version>.tgz
+//
+// present the OCI charts cached under <namespace> (charts at
+// <namespace>/<name>, on the request's registry) as such a repository.
+// The index only lists what is cached; archives are served through the
+// usual blob path, so one evicted since is fetched from upstream again.
+
+// OCI media types of Helm charts.
+const (
+	helmConfigType  = "application/vnd.cncf.helm.config.v1+json"
+	helmContentType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+var helmRequests = metrics.NewCounterVec("oci_helm_facade_requests_total",
+	"Requests to the Helm repository facade, by endpoint (index or chart) and result.", "endpoint", "result")
+
+// helmChart is a cached chart version.
+type helmChart struct {
+	name, version string
+	layer         string // digest of the chart archive
+	metadata      map[string]any
+	created       time.Time
+}
+
+// serveHelm answers a Helm facade request for registry. p is the request
+// path below /helm/.
+func (h *Handler) serveHelm(w http.ResponseWriter, r *http.Request, registry, p string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ns, ok := strings.CutSuffix(p, "index.yaml"); ok && (ns == "" || strings.HasSuffix(ns, "/")) {
+		h.serveHelmIndex(w, r, registry, strings.TrimSuffix(ns, "/"))
+		return
+	}
+	q := "/" + p
+	i := strings.LastIndex(q, "/charts/")
+	if i < 0 {
+		writeError(w, "not found", http.StatusNotFound)
+		return
+	}
+	ns, file := strings.TrimPrefix(q[:i], "/"), q[i+len("/charts/"):]
+	name, base, ok := strings.Cut(file, "/")
+	version, ok2 := strings.CutPrefix(strings.TrimSuffix(base, ".tgz"), name+"-")
+	if !ok || !ok2 || !strings.HasSuffix(base, ".tgz") || version == "" {
+		writeError(w, "not found", http.StatusNotFound)
+		return
+	}
+	h.serveHelmChart(w, r, registry, ns, name, version)
+}
+
+// serveHelmIndex writes index.yaml for the charts cached under ns. JSON is
+// YAML, and Helm reads it as such, so no YAML encoder is needed.
+func (h *Handler) serveHelmIndex(w http.ResponseWriter, r *http.Request, registry, ns string) {
+	charts, err := h.helmCharts(r, registry, ns)
+	if err != nil {
+		helmRequests.Inc("index", "error")
+		slog.Error("listing cached helm charts failed", "namespace", ns, "error", err)
+		writeError(w, "listing cached charts failed", http.StatusBadGateway)
+		return
+	}
+	entries := make(map[string][]map[string]any)
+	for _, c := range charts {
+		entry := make(map[string]any, len(c.metadata)+3)
+		for k, v := range c.metadata {
+			entry[k] = v
+		}
+		entry["urls"] = []string{"charts/" + c.name + "/" + c.name + "-" + c.version + ".tgz"}
+		entry["digest"] = strings.TrimPrefix(c.layer, "sha256:")
+		entry["created"] = c.created.UTC().Format(time.RFC3339)
+		entries[c.name] = append(entries[c.name], entry)
+	}
+	helmRequests.Inc("index", "ok")
+	w.Header().Set("Content-Type", "application/x-yaml")
+	json.NewEncoder(w).Encode(map[string]any{
+		"apiVersion": "v1",
+		"entries":    entries,
+		"generated":  time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// serveHelmChart serves the archive of one chart version.
+func (h *Handler) serveHelmChart(w http.ResponseWriter, r *http.Request, registry, ns, name, version string) {
+	charts, err := h.helmCharts(r, registry, ns)
+	if err != nil {
+		helmRequests.Inc("chart", "error")
+		writeError(w, "listing cached charts failed", http.StatusBadGateway)
+		return
+	}
+	i := slices.IndexFunc(charts, func(c helmChart) bool { return c.name == name && c.version == version })
+	if i < 0 {
+		helmRequests.Inc("chart", "not_found")
+		writeError(w, "chart not cached", http.StatusNotFound)
+		return
+	}
+	helmRequests.Inc("chart", "ok")
+	info := requestInfo{Registry: registry, Name: path.Join(ns, name), Kind: "blobs", Reference: charts[i].layer}
+	r, cancel := withBudget(r, h.Timeouts.forRequest(r.Method, info))
+	defer cancel()
+	if r.Method == http.MethodHead {
+		h.handleHead(w, r, info, h.storageKey(info))
+		return
+	}
+	h.handleGet(w, r, info, h.storageKey(info))
+}
+
+// helmCharts lists the chart versions cached in repositories directly
+// under ns, by name and newest first. A version cached under several keys (its tag
+// and its digest) is listed once; one whose config blob isn't cached is
+// skipped, having no metadata to list.
+func (h *Handler) helmCharts(r *http.Request, registry, ns string) ([]helmChart, error) {
+	parent := strings.Trim(registry+"/"+ns, "/")
+	prefix := "manifests/" + parent + "/"
+	allowed := h.allowedNamespaces(h.policy(), registry)
+	seen := make(map[string]bool)
+	var charts []helmChart
+	for obj, err := range h.Cache.List(r.Context(), prefix, "") {
+		if err != nil {
+			return nil, err
+		}
+		k, ok := cache.ParseKey(obj.Key)
+		if !ok || path.Dir(k.Repository) != parent ||
+			!nameAllowed(allowed, strings.TrimPrefix(k.Repository, registry+"/")) {
+			continue
+		}
+		c, ok := h.helmChart(r, registry, obj)
+		if !ok || seen[c.name+"\x00"+c.version] {
+			continue
+		}
+		seen[c.name+"\x00"+c.version] = true
+		charts = append(charts, c)
+	}
+	slices.SortFunc(charts, func(a, b helmChart) int {
+		return cmp.Or(strings.Compare(a.name, b.name), b.created.Compare(a.created))
+	})
+	return charts, nil
+}
+
+// helmChart reads a cached manifest, reporting false if it isn't a Helm
+// chart whose config is cached.
+func (h *Handler) helmChart(r *http.Request, registry string, obj cache.ObjectInfo) (helmChart, bool) {
+	res, err := h.Cache.GetWithMeta(r.Context(), obj.Key)
+	if err != nil {
+		return helmChart{}, false
+	}
+	m, err := manifest.Decode(res.Body, DefaultMaxManifestSize)
+	res.Body.Close()
+	if err != nil || m.Config == nil || m.Config.MediaType != helmConfigType {
+		return helmChart{}, false
+	}
+	var layer string
+	for _, l := range m.Layers {
+		if l.MediaType == helmContentType && validDigest(l.Digest) {
+			layer = l.Digest
+			break
+		}
+	}
+	if layer == "" {
+		return helmChart{}, false
+	}
+
+	res, err = h.Cache.GetWithMeta(r.Context(), h.KeySchema.BlobKey(registry, m.Config.Digest))
+	if err != nil {
+		return helmChart{}, false
+	}
+	var metadata map[string]any
+	err = json.NewDecoder(io.LimitReader(res.Body, DefaultMaxManifestSize)).Decode(&metadata)
+	res.Body.Close()
+	if err != nil {
+		return helmChart{}, false
+	}
+	name, _ := metadata["name"].(string)
+	version, _ := metadata["version"].(string)
+	if name == "" || version == "" || strings.Contains(name, "/") {
+		return helmChart{}, false
+	}
+	return helmChart{name: name, version: version, layer: layer, metadata: metadata, created: obj.LastModified}, true
+}
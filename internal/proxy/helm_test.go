@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestHelmFacade(t *testing.T) {
+	h := &Handler{Registry: "registry.test", Cache: cache.NewFSStore(t.TempDir(), 0), HelmFacade: true}
+	put := func(key string, body []byte, contentType string) string {
+		sum := sha256.Sum256(body)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		if key == "" {
+			key = cache.BlobKey(digest)
+		}
+		if err := h.Cache.Put(t.Context(), key, bytes.NewReader(body), manifestMeta(contentType, digest, len(body))); err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+	chart := []byte("chart archive")
+	chartDigest := put("", chart, "application/octet-stream")
+	config := put("", []byte(`{"apiVersion":"v2","name":"app","version":"1.2.0","appVersion":"3.0"}`), helmConfigType)
+	manifest := []byte(`{"schemaVersion":2,"config":{"mediaType":"` + helmConfigType + `","digest":"` + config + `"},` +
+		`"layers":[{"mediaType":"` + helmContentType + `","digest":"` + chartDigest + `"}]}`)
+	digest := put(cache.TagKey("registry.test/charts/app", "1.2.0"), manifest, "application/vnd.oci.image.manifest.v1+json")
+	put(cache.ManifestKey("registry.test/charts/app", digest), manifest, "application/vnd.oci.image.manifest.v1+json")
+	// Neither an image nor a chart in a nested repository is listed.
+	put(cache.TagKey("registry.test/charts/web", "1"), []byte(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json"}}`), "application/vnd.oci.image.manifest.v1+json")
+	put(cache.TagKey("registry.test/charts/team/app", "1.2.0"), manifest, "application/vnd.oci.image.manifest.v1+json")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	rec := get("/helm/charts/index.yaml")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("index: got %d", rec.Code)
+	}
+	var index struct {
+		APIVersion string `json:"apiVersion"`
+		Entries    map[string][]struct {
+			Name, Version, AppVersion, Digest string
+			URLs                              []string
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	versions := index.Entries["app"]
+	if index.APIVersion != "v1" || len(index.Entries) != 1 || len(versions) != 1 {
+		t.Fatalf("unexpected index %s", rec.Body)
+	}
+	v := versions[0]
+	if v.Version != "1.2.0" || v.AppVersion != "3.0" || v.Digest != chartDigest[len("sha256:"):] ||
+		len(v.URLs) != 1 || v.URLs[0] != "charts/app/app-1.2.0.tgz" {
+		t.Errorf("unexpected entry %+v", v)
+	}
+
+	if rec := get("/helm/charts/" + v.URLs[0]); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), chart) {
+		t.Errorf("chart: got %d %q", rec.Code, rec.Body)
+	}
+	if rec := get("/helm/charts/charts/app/app-9.9.9.tgz"); rec.Code != http.StatusNotFound {
+		t.Errorf("uncached version: got %d", rec.Code)
+	}
+	if rec := get("/helm/charts/team/index.yaml"); !bytes.Contains(rec.Body.Bytes(), []byte(`"app"`)) {
+		t.Errorf("nested namespace index: %s", rec.Body)
+	}
+
+	h.HelmFacade = false
+	if rec := get("/helm/charts/index.yaml"); rec.Code == http.StatusOK {
+		t.Error("facade served while disabled")
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// routeRegistry selects the upstream registry for a request from its Host
+// header (or TLS SNI when the Host header is absent), falling back to the
+// default Registry. It reports false if nothing matches and there is no
+// default.
+func (h *Handler) routeRegistry(r *http.Request) (string, bool) {
+	if len(h.HostRoutes) > 0 {
+		host := r.Host
+		if host == "" && r.TLS != nil {
+			host = r.TLS.ServerName
+		}
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if registry, ok := h.HostRoutes[strings.ToLower(host)]; ok {
+			return registry, true
+		}
+	}
+	return h.Registry, h.Registry != ""
+}
+
+// routePath selects the upstream registry for a repository path from its
+// first segment, per PathRoutes ("ghcr.io/org/app/manifests/1" routes to
+// ghcr.io as "org/app/manifests/1").
+func (h *Handler) routePath(path string) (registry, rest string, ok bool) {
+	if len(h.PathRoutes) == 0 {
+		return "", path, false
+	}
+	seg, rest, ok := strings.Cut(path, "/")
+	if !ok {
+		return "", path, false
+	}
+	registry, ok = h.PathRoutes[strings.ToLower(seg)]
+	if !ok {
+		return "", path, false
+	}
+	return registry, rest, true
+}
+
+// routeMirror selects the upstream registry for a request from the ns
+// query parameter containerd adds when the proxy is configured as a
+// mirror in hosts.toml. found reports whether ns was given with
+// MirrorRoutes configured; allowed whether its registry is listed.
+func (h *Handler) routeMirror(r *http.Request) (registry string, found, allowed bool) {
+	if len(h.MirrorRoutes) == 0 {
+		return "", false, false
+	}
+	ns := r.URL.Query().Get("ns")
+	if ns == "" {
+		return "", false, false
+	}
+	registry, allowed = h.MirrorRoutes[strings.ToLower(ns)]
+	return registry, true, allowed
+}
+
+// withoutNS drops containerd's ns parameter from a raw query, so it isn't
+// forwarded upstream with listings.
+func withoutNS(raw string) string {
+	q, err := url.ParseQuery(raw)
+	if err != nil {
+		return raw
+	}
+	q.Del("ns")
+	return q.Encode()
+}
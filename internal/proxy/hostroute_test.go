@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestPathRoutes(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		io.WriteString(w, `{"schemaVersion":2}`)
+	}))
+	defer upstream.Close()
+
+	registry := strings.TrimPrefix(upstream.URL, "https://")
+	h := &Handler{
+		Cache:      cache.NewFSStore(t.TempDir(), 0),
+		Upstream:   &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		PathRoutes: map[string]string{"ghcr.io": registry},
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/v2/"); rec.Code != http.StatusOK {
+		t.Errorf("version check: got %d", rec.Code)
+	}
+	if rec := get("/v2/GHCR.io/org/app/manifests/v1"); rec.Code != http.StatusOK {
+		t.Fatalf("routed manifest: got %d %s", rec.Code, rec.Body)
+	}
+	if len(paths) != 1 || paths[0] != "/v2/org/app/manifests/v1" {
+		t.Errorf("upstream saw %v, want the prefix stripped", paths)
+	}
+	if rec := get("/v2/quay.io/org/app/manifests/v1"); rec.Code != http.StatusNotFound {
+		t.Errorf("unrouted prefix without a default upstream: got %d", rec.Code)
+	}
+	if !h.ServesImage("ghcr.io/org/app:v1") {
+		t.Error("path-routed registry not served")
+	}
+}
+
+func TestMirrorRoutes(t *testing.T) {
+	var mu sync.Mutex
+	var urls []string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		urls = append(urls, r.URL.String())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name":"library/nginx","tags":["1.27"]}`)
+	}))
+	defer upstream.Close()
+
+	registry := strings.TrimPrefix(upstream.URL, "https://")
+	h := &Handler{
+		Registry:     "default.test",
+		Cache:        cache.NewFSStore(t.TempDir(), 0),
+		Upstream:     &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		MirrorRoutes: map[string]string{"docker.io": registry},
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/v2/library/nginx/tags/list?ns=docker.io&n=10"); rec.Code != http.StatusOK {
+		t.Fatalf("mirrored listing: got %d %s", rec.Code, rec.Body)
+	}
+	if len(urls) != 1 || urls[0] != "/v2/library/nginx/tags/list?n=10" {
+		t.Errorf("upstream saw %v, want ns dropped", urls)
+	}
+	if rec := get("/v2/org/app/manifests/v1?ns=quay.io"); rec.Code != http.StatusNotFound {
+		t.Errorf("unlisted registry: got %d", rec.Code)
+	}
+	if !h.ServesImage("docker.io/library/nginx:1.27") {
+		t.Error("mirrored registry not served")
+	}
+}
+
+func TestHostRoutes(t *testing.T) {
+	routes := map[string]string{
+		"ghcr-mirror.internal": "ghcr.io",
+		"quay-mirror.internal": "quay.io",
+		"::1":                  "registry.local",
+	}
+	tests := []struct {
+		name     string
+		host     string
+		sni      string
+		routes   map[string]string
+		fallback string
+		want     string
+		wantOK   bool
+	}{
+		{name: "exact host", host: "ghcr-mirror.internal", routes: routes, want: "ghcr.io", wantOK: true},
+		{name: "port stripped", host: "quay-mirror.internal:5000", routes: routes, want: "quay.io", wantOK: true},
+		{name: "case folded", host: "GHCR-Mirror.Internal:443", routes: routes, want: "ghcr.io", wantOK: true},
+		{name: "IPv6 literal with port", host: "[::1]:5000", routes: routes, want: "registry.local", wantOK: true},
+		{name: "TLS server name without Host", sni: "quay-mirror.internal", routes: routes, want: "quay.io", wantOK: true},
+		{name: "unknown host falls back to the default", host: "other.internal", routes: routes, fallback: "docker.io", want: "docker.io", wantOK: true},
+		{name: "unknown host without a default", host: "other.internal:5000", routes: routes},
+		{name: "no host routes", host: "ghcr-mirror.internal", fallback: "docker.io", want: "docker.io", wantOK: true},
+		{name: "nothing configured", host: "ghcr-mirror.internal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{Registry: tt.fallback, HostRoutes: tt.routes}
+			r := httptest.NewRequest(http.MethodGet, "/v2/org/app/manifests/v1", nil)
+			r.Host = tt.host
+			if tt.sni != "" {
+				r.TLS = &tls.ConnectionState{ServerName: tt.sni}
+			}
+			got, ok := h.routeRegistry(r)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("routeRegistry = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	// A host nothing routes is refused rather than sent anywhere.
+	h := &Handler{Cache: cache.NewFSStore(t.TempDir(), 0), HostRoutes: routes}
+	r := httptest.NewRequest(http.MethodGet, "/v2/org/app/manifests/v1", nil)
+	r.Host = "other.internal"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "NAME_UNKNOWN") {
+		t.Errorf("unrouted host: got %d %s", rec.Code, rec.Body)
+	}
+}
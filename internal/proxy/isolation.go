@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// Private content isolation. With auth passthrough, a client's
+// credentials decide what upstream lets it pull, but a shared cache would
+// serve whatever one tenant fetched to every other. With IsolatePrivate,
+// content fetched with credentials is stored under its principal
+// (private/<principal>/...) so only that principal is served it, while
+// content in the shared cache, which only anonymous requests fill, stays
+// shared by everyone.
+//
+// A principal is an HMAC of the client's credential: the secret itself for
+// Basic auth and opaque bearer tokens, and the issuer and subject for
+// registry JWTs, which are reissued every few minutes. A JWT's claims are
+// only as good as its signature, which the proxy can't check, so before a
+// JWT principal is served a private hit, upstream is asked (HEAD) whether
+// the token may pull that object.
+
+// principalLen is how many hex characters of the HMAC name a principal.
+const principalLen = 32
+
+// verifiedMax bounds the memo of upstream-verified tokens; past it,
+// expired entries are pruned on insert, then the soonest to expire.
+const verifiedMax = 4096
+
+// anonymousIssuers are token issuers that name every authenticated user
+// in the sub claim, so a token of theirs without one is anonymous.
+var anonymousIssuers = map[string]bool{
+	"auth.docker.io": true,
+}
+
+// Verified tokens are trusted until their exp claim, bounded by these.
+const (
+	verifiedDefaultTTL = 5 * time.Minute
+	verifiedMaxTTL     = time.Hour
+)
+
+var isolationRequests = metrics.NewCounterVec("oci_isolation_requests_total",
+	"Cacheable requests by the cache partition they were served from (shared or private).", "partition")
+
+// isolate returns the storage key to serve r from: key itself for shared
+// content, or the client's private copy of it. It returns false when it
+// has answered r itself, because upstream refused to verify its token.
+func (h *Handler) isolate(w http.ResponseWriter, r *http.Request, info requestInfo, key string) (string, bool) {
+	if !h.IsolatePrivate || h.Upstream.ProxyManagedAuth(info.Registry) ||
+		(len(h.SharedRepositories) > 0 && cache.MatchRepository(h.SharedRepositories, info.Name)) {
+		return key, true
+	}
+	id, verify := principal(r.Header.Get("Authorization"))
+	if id == "" {
+		isolationRequests.Inc("shared")
+		return key, true
+	}
+	// Anonymous clients could pull it, so it's public.
+	if _, err := h.Cache.Head(r.Context(), key); err == nil {
+		isolationRequests.Inc("shared")
+		return key, true
+	}
+	isolationRequests.Inc("private")
+	mac := hmac.New(sha256.New, h.IsolationKey)
+	mac.Write([]byte(id))
+	private := cache.PrivateKey(hex.EncodeToString(mac.Sum(nil))[:principalLen], key)
+	if !verify {
+		return private, true
+	}
+	// A miss goes upstream with the client's token anyway.
+	if _, err := h.Cache.Head(r.Context(), private); err != nil {
+		return private, true
+	}
+	return private, h.verifyToken(w, r, info)
+}
+
+// principal returns the identity behind an Authorization header, and
+// whether it rests on claims upstream must vouch for. Anonymous requests,
+// including those carrying a registry's anonymous token, have none. A JWT
+// without a subject is only taken as anonymous when it grants no access
+// or comes from one of anonymousIssuers; otherwise the token itself is
+// the principal, as for opaque tokens.
+func principal(auth string) (id string, verify bool) {
+	scheme, credential, _ := strings.Cut(strings.TrimSpace(auth), " ")
+	credential = strings.TrimSpace(credential)
+	if credential == "" {
+		return "", false
+	}
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return "basic:" + credential, false
+	case "bearer":
+		claims, ok := jwtClaims(credential)
+		if !ok {
+			return "bearer:" + credential, false
+		}
+		if claims.Subject == "" {
+			if !claims.grantsAccess() || anonymousIssuers[claims.Issuer] {
+				return "", false
+			}
+			return "bearer:" + credential, false
+		}
+		return "jwt:" + claims.Issuer + "\x00" + claims.Subject, true
+	}
+	return auth, false
+}
+
+// sibling moves shared, a storage key in the shared partition, into key's
+// partition, for objects cached alongside the one at key.
+func sibling(key, shared string) string {
+	if k, ok := cache.ParseKey(key); ok && k.Principal != "" {
+		return cache.PrivateKey(k.Principal, shared)
+	}
+	return shared
+}
+
+type tokenClaims struct {
+	Issuer  string `json:"iss"`
+	Subject string `json:"sub"`
+	Expiry  int64  `json:"exp"`
+	Access  []struct {
+		Type    string   `json:"type"`
+		Name    string   `json:"name"`
+		Actions []string `json:"actions"`
+	} `json:"access"`
+}
+
+// grantsAccess reports whether the token's access claim allows any
+// action on any resource.
+func (c tokenClaims) grantsAccess() bool {
+	for _, a := range c.Access {
+		if len(a.Actions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtClaims decodes the claims of a JWT without checking its signature.
+func jwtClaims(token string) (tokenClaims, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return tokenClaims{}, false
+	}
+	var c tokenClaims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return tokenClaims{}, false
+	}
+	return c, true
+}
+
+// verifyToken reports whether upstream accepts r's token for the object
+// it asks for, answering r with upstream's refusal when it doesn't.
+// Acceptances are remembered per token and object until the token expires.
+func (h *Handler) verifyToken(w http.ResponseWriter, r *http.Request, info requestInfo) bool {
+	auth := r.Header.Get("Authorization")
+	sum := sha256.Sum256([]byte(auth + "\x00" + info.image() + "/" + info.Kind + "/" + info.Reference))
+	vk := hex.EncodeToString(sum[:])
+	t := &h.verified
+	now := time.Now()
+	t.mu.Lock()
+	until, ok := t.until[vk]
+	t.mu.Unlock()
+	if ok && now.Before(until) {
+		return true
+	}
+
+	head := r.Clone(r.Context())
+	head.Method = http.MethodHead
+	resp, err := h.Upstream.Do(head, info)
+	if err != nil {
+		slog.Debug("could not verify token for private content", "image", info.image(), "error", err)
+		writeUpstreamError(w, err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Info("upstream refused a token for private cached content",
+			"image", info.image(), "ref", info.shortRef(), "status", resp.StatusCode)
+		copyResponseHeaders(w, resp)
+		w.WriteHeader(resp.StatusCode)
+		return false
+	}
+
+	ttl := verifiedDefaultTTL
+	_, token, _ := strings.Cut(auth, " ")
+	if claims, ok := jwtClaims(strings.TrimSpace(token)); ok && claims.Expiry > 0 {
+		ttl = min(time.Until(time.Unix(claims.Expiry, 0)), verifiedMaxTTL)
+	}
+	t.remember(vk, now, now.Add(ttl))
+	return true
+}
+
+// tokenVerifier remembers, by token and object, until when upstream's
+// acceptance of a token is trusted. The zero value is ready to use.
+type tokenVerifier struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// remember trusts the acceptance at key until the given time. When the
+// memo is full, expired entries are pruned, then the soonest to expire
+// evicted, so it never holds more than verifiedMax.
+func (t *tokenVerifier) remember(key string, now, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.until == nil {
+		t.until = make(map[string]time.Time)
+	}
+	if _, ok := t.until[key]; !ok && len(t.until) >= verifiedMax {
+		for k, u := range t.until {
+			if !now.Before(u) {
+				delete(t.until, k)
+			}
+		}
+		for len(t.until) >= verifiedMax {
+			var oldest string
+			for k, u := range t.until {
+				if oldest == "" || u.Before(t.until[oldest]) {
+					oldest = k
+				}
+			}
+			delete(t.until, oldest)
+		}
+	}
+	t.until[key] = until
+}
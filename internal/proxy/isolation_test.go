@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// isolationUpstream serves a public blob to anyone and a private one only
+// to the allowed Authorization values, counting the requests it gets.
+func isolationUpstream(t *testing.T, allowed ...string) (h *Handler, public, private string, hits *atomic.Int32) {
+	blob := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	public, private = blob("public layer"), blob("private layer")
+	hits = new(atomic.Int32)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body := "public layer"
+		if strings.HasSuffix(r.URL.Path, private) {
+			body = "private layer"
+			ok := false
+			for _, a := range allowed {
+				ok = ok || r.Header.Get("Authorization") == a
+			}
+			if !ok {
+				w.Header().Set("Www-Authenticate", `Bearer realm="https://auth.test/token"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", blob(body))
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	h = &Handler{
+		Registry:       strings.TrimPrefix(srv.URL, "https://"),
+		Cache:          cache.NewFSStore(t.TempDir(), 0),
+		Upstream:       &UpstreamClient{Client: srv.Client(), Scheme: "https"},
+		IsolatePrivate: true,
+		IsolationKey:   []byte("test key"),
+	}
+	return h, public, private, hits
+}
+
+func getBlob(h *Handler, digest, auth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/v2/org/app/blobs/"+digest, nil)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIsolationSeparatesTenants(t *testing.T) {
+	h, public, private, hits := isolationUpstream(t, "Basic YTph")
+
+	if rec := getBlob(h, private, "Basic YTph"); rec.Code != http.StatusOK {
+		t.Fatalf("tenant A: got %d", rec.Code)
+	}
+	// Tenant B isn't served A's copy: it goes upstream, which refuses it.
+	if rec := getBlob(h, private, "Basic Yjpi"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("tenant B: got %d %q, want upstream's 401", rec.Code, rec.Body)
+	}
+	if rec := getBlob(h, private, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous: got %d, want upstream's 401", rec.Code)
+	}
+	before := hits.Load()
+	if rec := getBlob(h, private, "Basic YTph"); rec.Code != http.StatusOK || rec.Body.String() != "private layer" {
+		t.Fatalf("tenant A again: got %d %q", rec.Code, rec.Body)
+	}
+	if hits.Load() != before {
+		t.Error("tenant A's second pull went upstream")
+	}
+
+	// Public content fetched anonymously is shared with everyone.
+	if rec := getBlob(h, public, ""); rec.Code != http.StatusOK {
+		t.Fatalf("anonymous public: got %d", rec.Code)
+	}
+	before = hits.Load()
+	if rec := getBlob(h, public, "Basic Yjpi"); rec.Code != http.StatusOK || rec.Body.String() != "public layer" {
+		t.Fatalf("tenant B public: got %d %q", rec.Code, rec.Body)
+	}
+	if hits.Load() != before {
+		t.Error("shared public content was fetched again")
+	}
+}
+
+func TestIsolationVerifiesTokenClaims(t *testing.T) {
+	jwt := func(claims, sig string) string {
+		return "Bearer e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + "." + sig
+	}
+	alice := jwt(`{"iss":"auth.test","sub":"alice","exp":4102444800}`, "c2lnbmVk")
+	renewed := jwt(`{"iss":"auth.test","sub":"alice","exp":4102444801}`, "cmVuZXdlZA")
+	forged := jwt(`{"iss":"auth.test","sub":"alice","exp":4102444800}`, "Zm9yZ2Vk")
+	h, _, private, hits := isolationUpstream(t, alice, renewed)
+
+	if rec := getBlob(h, private, alice); rec.Code != http.StatusOK {
+		t.Fatalf("alice: got %d", rec.Code)
+	}
+	if rec := getBlob(h, private, forged); rec.Code != http.StatusUnauthorized || rec.Body.String() == "private layer" {
+		t.Fatalf("forged token for alice: got %d %q", rec.Code, rec.Body)
+	}
+
+	// A renewed token keeps alice's partition, once upstream vouches for it.
+	before := hits.Load()
+	for range 2 {
+		if rec := getBlob(h, private, renewed); rec.Code != http.StatusOK || rec.Body.String() != "private layer" {
+			t.Fatalf("renewed token: got %d %q", rec.Code, rec.Body)
+		}
+	}
+	if n := hits.Load() - before; n != 1 {
+		t.Errorf("renewed token: %d upstream requests, want one verification", n)
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	token := func(claims string) string {
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2ln"
+	}
+	anonymous := token(`{"iss":"auth.test","sub":""}`)
+	noAccess := token(`{"iss":"auth.test","access":[{"type":"repository","name":"org/app","actions":[]}]}`)
+	unnamed := token(`{"iss":"auth.test","access":[{"type":"repository","name":"org/app","actions":["pull"]}]}`)
+	hub := token(`{"iss":"auth.docker.io","access":[{"type":"repository","name":"library/nginx","actions":["pull"]}]}`)
+	for auth, want := range map[string]string{
+		"":                    "",
+		"Basic YTph":          "basic:YTph",
+		"Bearer opaque":       "bearer:opaque",
+		"Bearer " + anonymous: "",
+		"Bearer " + noAccess:  "",
+		// A subject-less token granting access may still be private.
+		"Bearer " + unnamed: "bearer:" + unnamed,
+		"Bearer " + hub:     "",
+		"Bearer ":           "",
+		"Token abc":         "Token abc",
+		"  basic  YTph ":    "basic:YTph",
+	} {
+		if got, _ := principal(auth); got != want {
+			t.Errorf("principal(%q) = %q, want %q", auth, got, want)
+		}
+	}
+}
+
+func TestTokenVerifierBounded(t *testing.T) {
+	var v tokenVerifier
+	now := time.Now()
+	for i := range verifiedMax {
+		v.remember(fmt.Sprint(i), now, now.Add(time.Duration(i+1)*time.Second))
+	}
+	v.remember("new", now, now.Add(time.Hour))
+	if len(v.until) != verifiedMax {
+		t.Fatalf("%d entries, want %d", len(v.until), verifiedMax)
+	}
+	if _, ok := v.until["0"]; ok {
+		t.Error("the entry expiring soonest was kept")
+	}
+	if _, ok := v.until["new"]; !ok {
+		t.Error("the new entry was not remembered")
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// DefaultMaxManifestSize follows the distribution spec's guidance that
+// registries accept manifests of at least 4 MiB; real manifests are far
+// smaller.
+const DefaultMaxManifestSize = manifest.DefaultMaxSize
+
+// limitedBody fails the read once more than limit bytes have been read, so
+// a manifest that lied about (or omitted) its Content-Length is never
+// committed to the cache.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+}
+
+func newLimitedBody(rc io.ReadCloser, limit int64) *limitedBody {
+	return &limitedBody{ReadCloser: rc, remaining: limit, limit: limit}
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, fmt.Errorf("manifest exceeds %d bytes", l.limit)
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), fmt.Errorf("manifest exceeds %d bytes", l.limit)
+	}
+	return n, err
+}
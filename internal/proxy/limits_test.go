@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLimitedBody(t *testing.T) {
+	ok := newLimitedBody(io.NopCloser(strings.NewReader("12345")), 5)
+	if b, err := io.ReadAll(ok); err != nil || string(b) != "12345" {
+		t.Fatalf("body at limit: got %q, %v", b, err)
+	}
+
+	over := newLimitedBody(io.NopCloser(strings.NewReader("123456")), 5)
+	b, err := io.ReadAll(over)
+	if err == nil {
+		t.Fatal("expected error for body over limit")
+	}
+	if len(b) > 5 {
+		t.Fatalf("read %d bytes past a 5 byte limit", len(b))
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// streamBufferBytes is charged for each upstream fill while it streams: the
+// 32 KiB copy buffer shared by the client write and the cache pipe, plus
+// the transport's read and write buffers on both connections.
+const streamBufferBytes = 64 << 10
+
+// bufferedBytes is the memory reserved across all handlers.
+var bufferedBytes atomic.Int64
+
+var (
+	memoryShed = metrics.NewCounterVec("oci_memory_shed_total",
+		"Requests refused with 503 because MAX_BUFFERED_BYTES was reached, by what needed the memory (stream, manifest).", "kind")
+	_ = metrics.NewGaugeFunc("oci_buffered_bytes",
+		"Bytes reserved for upstream streams and buffered manifests.",
+		func() float64 { return float64(bufferedBytes.Load()) })
+)
+
+// reserveMemory reserves n bytes against MaxBufferedBytes. It returns false
+// if that would exceed the cap; otherwise the returned func gives the bytes
+// back. A reservation larger than the cap succeeds when nothing else is
+// reserved, so it can't be refused forever. With no cap every reservation
+// succeeds, but is still counted.
+func (h *Handler) reserveMemory(n int64) (release func(), ok bool) {
+	for {
+		used := bufferedBytes.Load()
+		if h.MaxBufferedBytes > 0 && used+n > h.MaxBufferedBytes && used > 0 {
+			return nil, false
+		}
+		if bufferedBytes.CompareAndSwap(used, used+n) {
+			return func() { bufferedBytes.Add(-n) }, true
+		}
+	}
+}
+
+// reserveManifest reserves room to buffer an upstream manifest: its
+// Content-Length, or the manifest size limit when it's unknown.
+func (h *Handler) reserveManifest(resp *http.Response) (release func(), ok bool) {
+	n := resp.ContentLength
+	if n <= 0 {
+		n = h.MaxManifestSize
+		if n <= 0 {
+			n = DefaultMaxManifestSize
+		}
+	}
+	return h.reserveMemory(n)
+}
+
+// shedLoad refuses a request for lack of memory. Clients retry 503s with
+// Retry-After, by which time other streams have usually finished.
+func shedLoad(w http.ResponseWriter, info requestInfo, kind string) {
+	memoryShed.Inc(kind)
+	slog.Warn("shedding request, buffered bytes at limit", "image", info.image(), "kind", info.Kind, "ref", info.shortRef(),
+		"buffered", bufferedBytes.Load())
+	w.Header().Set("Retry-After", "5")
+	writeOCIError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "proxy is at its memory limit, retry shortly")
+}
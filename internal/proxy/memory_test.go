@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMemoryLimitShedsLoad(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "layer")
+	}))
+	defer upstream.Close()
+
+	h := &Handler{
+		Registry:         strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:            &mockStore{err: errors.New("miss")},
+		Upstream:         &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		MaxBufferedBytes: streamBufferBytes,
+	}
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/org/app/blobs/sha256:"+strings.Repeat("ab", 32), nil))
+		return rec
+	}
+
+	// Another stream holds the whole budget.
+	release, ok := h.reserveMemory(streamBufferBytes)
+	if !ok {
+		t.Fatal("first reservation refused")
+	}
+	rec := get()
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d %v", rec.Code, rec.Header())
+	}
+
+	release()
+	if rec := get(); rec.Code != http.StatusOK {
+		t.Fatalf("expected the fill once memory was released, got %d", rec.Code)
+	}
+	if n := bufferedBytes.Load(); n != 0 {
+		t.Fatalf("%d bytes still reserved after the request", n)
+	}
+}
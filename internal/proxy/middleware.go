@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+	"github.com/danielloader/oci-pull-through/internal/recovery"
+)
+
+// Middleware wraps a handler with behaviour that runs around every
+// request, such as logging or panic recovery. Policy that needs the
+// parsed repository, such as the namespace allowlist, digest pinning and
+// the freeze, runs in Handler.ServeHTTP rather than as middleware.
+type Middleware func(http.Handler) http.Handler
+
+// DefaultMiddleware is the chain used when none is configured, outermost
+// first.
+var DefaultMiddleware = []string{"tracing", "logging", "metrics", "recovery"}
+
+var (
+	middlewareMu sync.RWMutex
+	middlewares  = map[string]Middleware{
+		"logging":  LoggingMiddleware,
+		"metrics":  MetricsMiddleware,
+		"recovery": recovery.Middleware,
+		"tracing":  TracingMiddleware,
+	}
+)
+
+// RegisterMiddleware makes mw available to NewChain under name, so a
+// program embedding the proxy can add stages that configuration can then
+// place. Registering an existing name replaces it.
+func RegisterMiddleware(name string, mw Middleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	middlewares[name] = mw
+}
+
+// Chain is an ordered list of named middleware. The first stage is the
+// outermost: it sees the request first and the response last.
+type Chain struct {
+	stages []stage
+}
+
+type stage struct {
+	name string
+	mw   Middleware
+}
+
+// NewChain builds a chain from registered middleware names, outermost
+// first. An empty list yields DefaultMiddleware.
+func NewChain(names []string) (*Chain, error) {
+	if len(names) == 0 {
+		names = DefaultMiddleware
+	}
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	c := &Chain{}
+	for _, name := range names {
+		mw, ok := middlewares[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		if err := c.Use(name, mw); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Use appends mw as the innermost stage.
+func (c *Chain) Use(name string, mw Middleware) error {
+	if c.index(name) >= 0 {
+		return fmt.Errorf("middleware %q is already in the chain", name)
+	}
+	c.stages = append(c.stages, stage{name, mw})
+	return nil
+}
+
+// InsertBefore adds mw just outside the stage called before.
+func (c *Chain) InsertBefore(before, name string, mw Middleware) error {
+	return c.insert(before, 0, name, mw)
+}
+
+// InsertAfter adds mw just inside the stage called after.
+func (c *Chain) InsertAfter(after, name string, mw Middleware) error {
+	return c.insert(after, 1, name, mw)
+}
+
+func (c *Chain) insert(anchor string, offset int, name string, mw Middleware) error {
+	i := c.index(anchor)
+	if i < 0 {
+		return fmt.Errorf("middleware %q is not in the chain", anchor)
+	}
+	if c.index(name) >= 0 {
+		return fmt.Errorf("middleware %q is already in the chain", name)
+	}
+	c.stages = slices.Insert(c.stages, i+offset, stage{name, mw})
+	return nil
+}
+
+// Remove drops the stage called name, reporting whether it was present.
+func (c *Chain) Remove(name string) bool {
+	i := c.index(name)
+	if i < 0 {
+		return false
+	}
+	c.stages = slices.Delete(c.stages, i, i+1)
+	return true
+}
+
+// Names lists the stages, outermost first.
+func (c *Chain) Names() []string {
+	names := make([]string, len(c.stages))
+	for i, s := range c.stages {
+		names[i] = s.name
+	}
+	return names
+}
+
+// Then wraps h in the chain.
+func (c *Chain) Then(h http.Handler) http.Handler {
+	for _, s := range slices.Backward(c.stages) {
+		h = s.mw(h)
+	}
+	return h
+}
+
+func (c *Chain) index(name string) int {
+	return slices.IndexFunc(c.stages, func(s stage) bool { return s.name == name })
+}
+
+var (
+	httpRequests = metrics.NewCounterVec("oci_http_requests_total",
+		"Requests served on the proxy listener, by method and status code.", "method", "code")
+	httpRequestSeconds = metrics.NewHistogramVec("oci_http_request_duration_seconds",
+		"Time to serve requests on the proxy listener, by method.", nil, "method")
+)
+
+// MetricsMiddleware counts requests by method and status and records how
+// long they took. Methods a registry doesn't serve are counted as "other"
+// to bound the label set.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		method := r.Method
+		if method != http.MethodGet && method != http.MethodHead {
+			method = "other"
+		}
+		httpRequests.Inc(method, strconv.Itoa(rec.status))
+		httpRequestSeconds.Observe(time.Since(start).Seconds(), method)
+	})
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	RegisterMiddleware("test-trace", trace("configured"))
+
+	c, err := NewChain([]string{"recovery", "test-trace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.InsertBefore("test-trace", "auth", trace("auth")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.InsertAfter("test-trace", "policy", trace("policy")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Use("auth", trace("again")); err == nil {
+		t.Error("duplicate stage accepted")
+	}
+	if err := c.InsertAfter("missing", "x", trace("x")); err == nil {
+		t.Error("insert relative to a missing stage accepted")
+	}
+	if got, want := c.Names(), []string{"recovery", "auth", "test-trace", "policy"}; !slices.Equal(got, want) {
+		t.Fatalf("Names() = %v, want %v", got, want)
+	}
+
+	h := c.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if want := []string{"auth", "configured", "policy", "handler"}; !slices.Equal(order, want) {
+		t.Errorf("ran %v, want %v", order, want)
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("recovery stage: got %d", rec.Code)
+	}
+
+	if !c.Remove("auth") || c.Remove("auth") {
+		t.Error("Remove reported the wrong presence")
+	}
+	if _, err := NewChain([]string{"logging", "nonesuch"}); err == nil || !strings.Contains(err.Error(), "nonesuch") {
+		t.Errorf("unknown middleware: err = %v", err)
+	}
+	if c, err := NewChain(nil); err != nil || !slices.Equal(c.Names(), DefaultMiddleware) {
+		t.Errorf("default chain: %v %v", c, err)
+	}
+}
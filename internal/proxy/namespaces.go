@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// nameAllowed reports whether an image name is permitted by the configured
+// namespace patterns; see cache.MatchRepository for the pattern syntax.
+// An empty pattern list allows everything.
+func nameAllowed(patterns []string, name string) bool {
+	return cache.MatchRepository(patterns, name)
+}
+
+// allowedNamespaces returns the patterns p scopes registry to, or nil if
+// it doesn't scope it. Entries keyed by an alias of registry, such as
+// docker.io for registry-1.docker.io, apply too.
+func (h *Handler) allowedNamespaces(p Policy, registry string) []string {
+	var patterns []string
+	for key, scope := range p.AllowedNamespaces {
+		if key == "" {
+			key = h.Registry
+		}
+		if key != "" && strings.EqualFold(resolveRegistry(key), resolveRegistry(registry)) {
+			patterns = append(patterns, scope...)
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestNameAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		repo     string
+		want     bool
+	}{
+		{"no patterns", nil, "anyone/app", true},
+
+		{"namespace wildcard, one level down", []string{"library/*"}, "library/nginx", true},
+		{"namespace wildcard, two levels down", []string{"library/*"}, "library/team/nginx", true},
+		{"namespace wildcard, deeper", []string{"library/*"}, "library/a/b/c/nginx", true},
+		{"namespace alone", []string{"library/*"}, "library", false},
+		{"namespace as a prefix of another", []string{"library/*"}, "libraryx/nginx", false},
+		{"namespace below the top level", []string{"library/*"}, "mirror/library/nginx", false},
+		{"nested namespace wildcard", []string{"myorg/team/*"}, "myorg/team/app", true},
+		{"nested namespace wildcard, sibling", []string{"myorg/team/*"}, "myorg/other/app", false},
+
+		{"exact name", []string{"myorg/app"}, "myorg/app", true},
+		{"exact name, longer", []string{"myorg/app"}, "myorg/app2", false},
+		{"exact name, below", []string{"myorg/app"}, "myorg/app/sub", false},
+		{"any of several", []string{"library/*", "myorg/app"}, "myorg/app", true},
+
+		{"star within a segment", []string{"myorg/app-*"}, "myorg/app-api", true},
+		{"star doesn't cross a slash", []string{"*/nginx"}, "a/b/nginx", false},
+		{"star in the first segment", []string{"*/nginx"}, "library/nginx", true},
+		{"question mark", []string{"myorg/app-?"}, "myorg/app-1", true},
+		{"question mark, one character only", []string{"myorg/app-?"}, "myorg/app-10", false},
+		{"character class", []string{"myorg/[ab]*"}, "myorg/api", true},
+		{"character class, outside it", []string{"myorg/[ab]*"}, "myorg/cli", false},
+		{"glob namespace wildcard", []string{"team-*/*"}, "team-a/app", true},
+		{"glob namespace wildcard, deeper", []string{"team-*/*"}, "team-a/b/app", true},
+		{"glob namespace wildcard, no match", []string{"team-*/*"}, "other/app", false},
+		{"malformed pattern", []string{"myorg/[app"}, "myorg/[app", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nameAllowed(tt.patterns, tt.repo); got != tt.want {
+				t.Errorf("nameAllowed(%q, %q) = %v, want %v", tt.patterns, tt.repo, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespacesRejectWithoutUpstream(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	h := &Handler{
+		Registry:          strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:             cache.NewFSStore(t.TempDir(), 0),
+		Upstream:          &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		AllowedNamespaces: map[string][]string{"": {"library/*"}},
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/other/app/manifests/v1", nil))
+	var body struct {
+		Errors []struct{ Code, Message string }
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusForbidden || len(body.Errors) != 1 || body.Errors[0].Code != "DENIED" ||
+		!strings.Contains(body.Errors[0].Message, "other/app") {
+		t.Errorf("got %d %s", rec.Code, rec.Body)
+	}
+	if calls.Load() != 0 {
+		t.Error("rejected request reached the upstream")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/nginx/manifests/v1", nil))
+	if rec.Code != http.StatusNotFound || calls.Load() != 1 {
+		t.Errorf("allowed repository: got %d after %d upstream calls", rec.Code, calls.Load())
+	}
+}
+
+func TestNamespacesPerUpstream(t *testing.T) {
+	serve := func() (*httptest.Server, *atomic.Int32) {
+		var calls atomic.Int32
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		t.Cleanup(srv.Close)
+		return srv, &calls
+	}
+	hub, hubCalls := serve()
+	ghcr, ghcrCalls := serve()
+	ghcrHost := strings.TrimPrefix(ghcr.URL, "https://")
+
+	// Only the default upstream is scoped.
+	h := &Handler{
+		Registry:          strings.TrimPrefix(hub.URL, "https://"),
+		Cache:             cache.NewFSStore(t.TempDir(), 0),
+		Upstream:          &UpstreamClient{Client: hub.Client(), Scheme: "https"},
+		PathRoutes:        map[string]string{"ghcr.io": ghcrHost},
+		AllowedNamespaces: map[string][]string{"": {"library/*", "myorg/*"}},
+	}
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := get("/v2/other/app/manifests/v1"); code != http.StatusForbidden || hubCalls.Load() != 0 {
+		t.Errorf("unscoped repository on the scoped upstream: got %d", code)
+	}
+	if code := get("/v2/myorg/app/manifests/v1"); code != http.StatusNotFound || hubCalls.Load() != 1 {
+		t.Errorf("scoped repository on the scoped upstream: got %d", code)
+	}
+	if code := get("/v2/ghcr.io/other/app/manifests/v1"); code != http.StatusNotFound || ghcrCalls.Load() != 1 {
+		t.Errorf("repository on the unscoped upstream: got %d", code)
+	}
+
+	// Scoping the routed upstream by its host leaves the default open.
+	h.AllowedNamespaces = map[string][]string{ghcrHost: {"org/*"}}
+	if code := get("/v2/ghcr.io/other/app/manifests/v1"); code != http.StatusForbidden || ghcrCalls.Load() != 1 {
+		t.Errorf("unscoped repository on the routed upstream: got %d", code)
+	}
+	if code := get("/v2/other/app/manifests/v1"); code != http.StatusNotFound {
+		t.Errorf("repository on the default upstream: got %d", code)
+	}
+}
+
+func TestAllowedNamespacesByAlias(t *testing.T) {
+	h := &Handler{Registry: "registry-1.docker.io"}
+	p := Policy{AllowedNamespaces: map[string][]string{"docker.io": {"library/*"}, "ghcr.io": {"org/*"}}}
+	if got := h.allowedNamespaces(p, "registry-1.docker.io"); len(got) != 1 || got[0] != "library/*" {
+		t.Errorf("Docker Hub scope = %q", got)
+	}
+	if got := h.allowedNamespaces(p, "quay.io"); got != nil {
+		t.Errorf("unscoped registry got %q", got)
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// noticeHeaders are upstream response headers describing the upstream's
+// state when it answered, such as a pull quota or a deprecation, rather
+// than the content. They reach clients on responses fetched from upstream,
+// so a quota running out isn't hidden by the cache, but are never stored:
+// replaying a remaining count from the day an object was cached would be
+// wrong on every hit after.
+var noticeHeaders = map[string]struct{}{
+	"Ratelimit":               {},
+	"Ratelimit-Policy":        {},
+	"Docker-Ratelimit-Source": {},
+	"Retry-After":             {},
+	"Warning":                 {},
+	"Deprecation":             {},
+	"Sunset":                  {},
+}
+
+// noticePrefixes cover the draft and vendor rate limit families
+// (RateLimit-Limit, X-RateLimit-Remaining, ...).
+var noticePrefixes = []string{"Ratelimit-", "X-Ratelimit-"}
+
+// isNoticeHeader reports whether the canonical header name is a notice.
+func isNoticeHeader(name string) bool {
+	if _, ok := noticeHeaders[name]; ok {
+		return true
+	}
+	for _, p := range noticePrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyNoticeHeaders forwards only the notice headers of resp, for answers
+// the proxy builds itself from an upstream response.
+func copyNoticeHeaders(w http.ResponseWriter, resp *http.Response) {
+	for key, values := range resp.Header {
+		if isNoticeHeader(http.CanonicalHeaderKey(key)) {
+			w.Header()[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+		}
+	}
+}
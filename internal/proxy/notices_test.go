@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestNoticeHeadersNotReplayedFromCache(t *testing.T) {
+	body := []byte("layer")
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Remaining", "3;w=21600")
+		w.Header().Set("Docker-RateLimit-Source", "203.0.113.7")
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("X-Upstream-Id", "abc")
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	store := cache.NewFSStore(t.TempDir(), 0)
+	h := &Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    store,
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+	}
+	pull := func() http.Header {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/org/app/blobs/"+digest, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d", rec.Code)
+		}
+		return rec.Header()
+	}
+
+	miss := pull()
+	for _, name := range []string{"RateLimit-Remaining", "Docker-RateLimit-Source", "Deprecation", "X-Upstream-Id"} {
+		if miss.Get(name) == "" {
+			t.Errorf("miss: %s not forwarded", name)
+		}
+	}
+
+	hit := pull()
+	for _, name := range []string{"RateLimit-Remaining", "Docker-RateLimit-Source", "Deprecation"} {
+		if v := hit.Get(name); v != "" {
+			t.Errorf("hit: %s replayed from cache: %q", name, v)
+		}
+	}
+	if hit.Get("X-Upstream-Id") != "abc" {
+		t.Error("hit: stored header not replayed")
+	}
+}
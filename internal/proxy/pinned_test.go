@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDigestPinnedRejectsTagPulls(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	h := &Handler{
+		Registry:     strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:        &mockStore{err: errors.New("miss")},
+		Upstream:     &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		DigestPinned: []string{"myorg/*"},
+	}
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/v2/myorg/app/manifests/1.2", http.StatusForbidden},
+		{"/v2/myorg/app/manifests/" + digest, http.StatusNotFound},
+		{"/v2/other/app/manifests/1.2", http.StatusNotFound},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(method, tt.path, nil))
+			if rec.Code != tt.want {
+				t.Errorf("%s %s: got %d, want %d", method, tt.path, rec.Code, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package proxy
+
+// Policy holds the access rules that can be replaced while the proxy is
+// running, e.g. by a fleet controller. Field semantics match the Handler
+// fields of the same name.
+type Policy struct {
+	AllowedNamespaces map[string][]string `json:"allowed_namespaces,omitempty"`
+	DigestPinned      []string            `json:"digest_pinned,omitempty"`
+}
+
+// SetPolicy replaces the handler's AllowedNamespaces and DigestPinned for
+// subsequent requests. It is safe to call while serving.
+func (h *Handler) SetPolicy(p Policy) {
+	h.policyOverride.Store(&p)
+}
+
+// policy returns the rules in effect: the last SetPolicy, or the Handler
+// fields if it was never called.
+func (h *Handler) policy() Policy {
+	if p := h.policyOverride.Load(); p != nil {
+		return *p
+	}
+	return Policy{AllowedNamespaces: h.AllowedNamespaces, DigestPinned: h.DigestPinned}
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+	"github.com/danielloader/oci-pull-through/internal/recovery"
+)
+
+// Predictive prefetch. Node bootstrap pulls the same image sets over and
+// over: an application's tag is followed, from the same client, by its
+// sidecars' manifests and blobs. The Prefetcher learns which objects from
+// other repositories follow each tag pull within Window, and once one has
+// followed often enough, fetches it into the cache as soon as the tag is
+// pulled again, before the client gets around to asking.
+//
+// Objects in the tag's own repository aren't predicted: the client asks
+// for them straight away, and two fills of one object aren't coalesced.
+// Prefetches use the triggering client's credentials, so objects in other
+// repositories are only fetched where upstream accepts them (anonymous
+// registries, or proxy-managed credentials).
+
+// Bounds on what the Prefetcher remembers. Past them new tags, followers
+// and clients are ignored (clients once expired sessions are pruned).
+const (
+	prefetchMaxTriggers  = 1024
+	prefetchMaxFollowers = 256
+	prefetchMaxClients   = 4096
+	prefetchMaxActive    = 4 // tag pulls a client's requests are counted against at once
+)
+
+// prefetchTimeout bounds one round of prefetching.
+const prefetchTimeout = 10 * time.Minute
+
+var (
+	prefetchObjects = metrics.NewCounterVec("oci_prefetch_objects_total",
+		"Objects prefetched on a predicted pull, by result (cached, fetched, failed or budget).", "result")
+	prefetchBytes = metrics.NewCounterVec("oci_prefetch_bytes_total",
+		"Bytes fetched from upstream by prefetching, by kind.", "kind")
+)
+
+// Prefetcher learns pull sequences and prefetches what they predict. Set
+// Budget to enable it; the other fields have defaults.
+type Prefetcher struct {
+	// Budget is how many bytes prefetching may fetch from upstream per
+	// BudgetPeriod (default an hour). A round stops when it's spent.
+	Budget       int64
+	BudgetPeriod time.Duration
+
+	// Window is how long after a tag pull a client's requests count as
+	// following it (default 2m).
+	Window time.Duration
+
+	// MinSupport is how many times an object must have followed a tag
+	// (default 3), and Confidence the fraction of the tag's pulls it must
+	// have followed (default 0.5), before it is prefetched.
+	MinSupport int
+	Confidence float64
+
+	mu       sync.Mutex
+	clients  map[netip.Addr][]*prefetchSession
+	patterns map[string]*pullPattern
+	running  map[string]bool
+	spent    int64
+	spentAt  time.Time
+}
+
+// pullPattern is what has been seen to follow pulls of one tag.
+type pullPattern struct {
+	pulls     int
+	followers map[string]*follower
+}
+
+type follower struct {
+	info  requestInfo
+	count int
+}
+
+// prefetchSession is one client's pull of a tag, open for Window.
+type prefetchSession struct {
+	trigger string
+	image   string
+	until   time.Time
+	seen    map[string]bool
+}
+
+// predict learns from a cacheable request and, when it pulls a tag whose
+// followers are known, starts prefetching them. Only shared content is
+// learned, so nothing private is fetched into the shared cache.
+func (h *Handler) predict(r *http.Request, info requestInfo, key string) {
+	p := h.Prefetch
+	if p == nil || p.Budget <= 0 || key != h.storageKey(info) {
+		return
+	}
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return
+	}
+	if id, _ := principal(r.Header.Get("Authorization")); h.IsolatePrivate && id != "" {
+		return
+	}
+	if predicted := p.observe(addr, info, time.Now()); len(predicted) > 0 {
+		trigger := info.image() + ":" + info.Reference
+		auth := r.Header.Get("Authorization")
+		recovery.Go("prefetch", func() { h.prefetch(trigger, auth, predicted) })
+	}
+}
+
+// observe records info as requested by addr at now. For a tag pull it
+// returns the followers to prefetch, unless a round for the tag is
+// already running.
+func (p *Prefetcher) observe(addr netip.Addr, info requestInfo, now time.Time) []requestInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients == nil {
+		p.clients = make(map[netip.Addr][]*prefetchSession)
+		p.patterns = make(map[string]*pullPattern)
+		p.running = make(map[string]bool)
+	}
+	sessions := slices.DeleteFunc(p.clients[addr], func(s *prefetchSession) bool { return !now.Before(s.until) })
+
+	obj := info.image() + "/" + info.Kind + "/" + info.Reference
+	for _, s := range sessions {
+		if s.image == info.image() || s.seen[obj] {
+			continue
+		}
+		s.seen[obj] = true
+		pat := p.patterns[s.trigger]
+		if f, ok := pat.followers[obj]; ok {
+			f.count++
+		} else if len(pat.followers) < prefetchMaxFollowers {
+			pat.followers[obj] = &follower{info: info, count: 1}
+		}
+	}
+
+	var predicted []requestInfo
+	trigger := info.image() + ":" + info.Reference
+	if info.isTagManifest() && !slices.ContainsFunc(sessions, func(s *prefetchSession) bool { return s.trigger == trigger }) {
+		pat, ok := p.patterns[trigger]
+		if !ok && len(p.patterns) < prefetchMaxTriggers {
+			pat = &pullPattern{followers: make(map[string]*follower)}
+			p.patterns[trigger] = pat
+		}
+		if pat != nil {
+			predicted = p.predicted(pat)
+			pat.pulls++
+			if len(sessions) < prefetchMaxActive {
+				sessions = append(sessions, &prefetchSession{
+					trigger: trigger, image: info.image(), until: now.Add(p.window()), seen: make(map[string]bool),
+				})
+			}
+		}
+		if len(predicted) > 0 && !p.running[trigger] {
+			p.running[trigger] = true
+		} else {
+			predicted = nil
+		}
+	}
+
+	if len(sessions) == 0 {
+		delete(p.clients, addr)
+		return predicted
+	}
+	if _, ok := p.clients[addr]; !ok && len(p.clients) >= prefetchMaxClients {
+		p.pruneClients(now)
+		if len(p.clients) >= prefetchMaxClients {
+			return predicted
+		}
+	}
+	p.clients[addr] = sessions
+	return predicted
+}
+
+// predicted returns pat's followers confident enough to prefetch, the
+// most frequent first.
+func (p *Prefetcher) predicted(pat *pullPattern) []requestInfo {
+	minSupport, confidence := cmp.Or(p.MinSupport, 3), cmp.Or(p.Confidence, 0.5)
+	if pat.pulls < minSupport {
+		return nil
+	}
+	var fs []*follower
+	for _, f := range pat.followers {
+		if f.count >= minSupport && float64(f.count) >= confidence*float64(pat.pulls) {
+			fs = append(fs, f)
+		}
+	}
+	slices.SortFunc(fs, func(a, b *follower) int { return cmp.Compare(b.count, a.count) })
+	infos := make([]requestInfo, len(fs))
+	for i, f := range fs {
+		infos[i] = f.info
+	}
+	return infos
+}
+
+func (p *Prefetcher) pruneClients(now time.Time) {
+	for addr, sessions := range p.clients {
+		if !slices.ContainsFunc(sessions, func(s *prefetchSession) bool { return now.Before(s.until) }) {
+			delete(p.clients, addr)
+		}
+	}
+}
+
+func (p *Prefetcher) window() time.Duration {
+	return cmp.Or(p.Window, 2*time.Minute)
+}
+
+// spend charges n fetched bytes to the budget, and reports whether any of
+// the current period's budget is left.
+func (p *Prefetcher) spend(n int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now := time.Now(); now.Sub(p.spentAt) >= cmp.Or(p.BudgetPeriod, time.Hour) {
+		p.spent, p.spentAt = 0, now
+	}
+	p.spent += n
+	return p.spent < p.Budget
+}
+
+// prefetch fetches a tag's predicted followers into the cache.
+func (h *Handler) prefetch(trigger, auth string, objects []requestInfo) {
+	p := h.Prefetch
+	defer func() {
+		p.mu.Lock()
+		delete(p.running, trigger)
+		p.mu.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+
+	w := &warmer{h: h, image: trigger, auth: auth}
+	var fetched int
+	for i, info := range objects {
+		if !p.spend(0) {
+			prefetchObjects.Add(float64(len(objects)-i), "budget")
+			slog.Info("prefetch budget spent", "trigger", trigger, "skipped", len(objects)-i)
+			break
+		}
+		_, _, status, size, err := w.fetch(ctx, info)
+		if err != nil {
+			prefetchObjects.Inc("failed")
+			slog.Debug("prefetch failed", "trigger", trigger, "image", info.image(), "ref", info.shortRef(), "error", err)
+			continue
+		}
+		prefetchObjects.Inc(status)
+		if status == "fetched" {
+			fetched++
+			kind := "blob"
+			if info.Kind == "manifests" {
+				kind = "manifest"
+			}
+			prefetchBytes.Add(float64(size), kind)
+			p.spend(size)
+		}
+	}
+	if fetched > 0 {
+		slog.Debug("prefetched predicted objects", "trigger", trigger, "fetched", fetched, "predicted", len(objects))
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestPrefetcherLearnsFollowers(t *testing.T) {
+	p := &Prefetcher{Budget: 1 << 20}
+	node := func(i int) netip.Addr { return netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}) }
+	app := requestInfo{Registry: "r.test", Name: "org/app", Kind: "manifests", Reference: "1"}
+	ownBlob := requestInfo{Registry: "r.test", Name: "org/app", Kind: "blobs", Reference: "sha256:aa"}
+	sidecar := requestInfo{Registry: "r.test", Name: "org/sidecar", Kind: "blobs", Reference: "sha256:bb"}
+	rare := requestInfo{Registry: "r.test", Name: "org/debug", Kind: "blobs", Reference: "sha256:cc"}
+	now := time.Now()
+
+	for i := range 3 {
+		if got := p.observe(node(i), app, now); len(got) > 0 {
+			t.Fatalf("pull %d predicted %v before enough support", i, got)
+		}
+		p.observe(node(i), app, now) // a HEAD then GET is one pull
+		p.observe(node(i), ownBlob, now)
+		p.observe(node(i), sidecar, now)
+		p.observe(node(i), sidecar, now)
+		if i == 0 {
+			p.observe(node(i), rare, now)
+		}
+	}
+	// Requests after the window don't count.
+	p.observe(node(0), rare, now.Add(time.Hour))
+
+	got := p.observe(node(9), app, now)
+	if len(got) != 1 || got[0] != sidecar {
+		t.Fatalf("predicted %v, want only the sidecar blob", got)
+	}
+	if p.patterns["r.test/org/app:1"].followers["r.test/org/sidecar/blobs/sha256:bb"].count != 3 {
+		t.Error("a follower was counted more than once per pull")
+	}
+	// A round for the tag is already running.
+	if got := p.observe(node(10), app, now); len(got) != 0 {
+		t.Errorf("second concurrent round predicted %v", got)
+	}
+}
+
+func TestPrefetchFetchesPredicted(t *testing.T) {
+	body := "sidecar layer"
+	sum := sha256.Sum256([]byte(body))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/blobs/"+digest) {
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Write([]byte(manifest))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+	h := &Handler{
+		Registry:          host,
+		Cache:             cache.NewFSStore(t.TempDir(), 0),
+		Upstream:          &UpstreamClient{Client: srv.Client(), Scheme: "https"},
+		CacheTagManifests: true,
+		Prefetch:          &Prefetcher{Budget: 1 << 20, MinSupport: 1},
+	}
+	sidecar := requestInfo{Registry: host, Name: "org/sidecar", Kind: "blobs", Reference: digest}
+	tag := requestInfo{Registry: host, Name: "org/app", Kind: "manifests", Reference: "1"}
+	h.Prefetch.observe(netip.MustParseAddr("192.0.2.1"), tag, time.Now())
+	h.Prefetch.observe(netip.MustParseAddr("192.0.2.1"), sidecar, time.Now())
+
+	// Another node pulls the tag; the sidecar blob arrives without asking.
+	req := httptest.NewRequest(http.MethodGet, "/v2/org/app/manifests/1", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("tag pull: got %d", rec.Code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := h.Cache.Head(t.Context(), h.storageKey(sidecar)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("predicted blob was not prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrefetchBudget(t *testing.T) {
+	p := &Prefetcher{Budget: 100}
+	if !p.spend(60) {
+		t.Fatal("budget spent after 60 of 100 bytes")
+	}
+	if p.spend(60) {
+		t.Fatal("budget left after 120 of 100 bytes")
+	}
+	p.spentAt = time.Now().Add(-2 * time.Hour)
+	if !p.spend(0) {
+		t.Error("budget not renewed after the period")
+	}
+}
@@ -3,23 +3,31 @@ package proxy
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/danielloader/oci-pull-through/internal/audit"
 	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/health"
 	"github.com/danielloader/oci-pull-through/internal/stream"
+	"github.com/danielloader/oci-pull-through/internal/tracing"
 )
 
 // requestInfo holds the parsed components of an OCI registry request.
 type requestInfo struct {
 	Registry  string // e.g. "ghcr.io"
 	Name      string // e.g. "org/image"
-	Kind      string // "manifests" or "blobs"
-	Reference string // tag or digest
+	Kind      string // "manifests", "blobs", "referrers" or "tags"
+	Reference string // tag or digest ("list" for tags)
+	Query     string // raw query, forwarded for listings
 }
 
 // isTagManifest returns true if the request is for a manifest by tag (not digest).
@@ -30,15 +38,17 @@ func (r requestInfo) isTagManifest() bool {
 // shouldCache reports whether this request's response should be cached.
 // Blobs and digest manifests are always cached (content-addressed, immutable).
 // Tag manifests are controlled by CacheTagManifests, with an extra gate
-// on the "latest" tag via CacheLatestTag.
+// on the "latest" tag via CacheLatestTag, either of which a canary may
+// override.
 func (h *Handler) shouldCache(info requestInfo) bool {
 	if !info.isTagManifest() {
 		return true
 	}
-	if !h.CacheTagManifests {
+	p := h.tagPolicy(info)
+	if !p.cacheTags {
 		return false
 	}
-	if info.Reference == "latest" && !h.CacheLatestTag {
+	if info.Reference == "latest" && !p.cacheLatest {
 		return false
 	}
 	return true
@@ -60,13 +70,194 @@ func (r requestInfo) shortRef() string {
 
 // Handler is the main HTTP handler for the OCI proxy.
 type Handler struct {
-	Registry          string
+	Registry          string // default upstream; may be empty when HostRoutes or PathRoutes cover all traffic
 	Cache             cache.Store
 	Upstream          *UpstreamClient
 	CacheTagManifests bool
 	CacheLatestTag    bool
+
+	// MaxManifestSize bounds manifests fetched from upstream. Larger ones
+	// are rejected (or, without a Content-Length, cut off uncached). Zero
+	// disables the limit.
+	MaxManifestSize int64
+
+	// Schema1Policy controls handling of Docker schema 1 manifests.
+	// The zero value behaves as Schema1Passthrough.
+	Schema1Policy Schema1Policy
+
+	// HostRoutes maps incoming hostnames (lowercase, without port) to
+	// upstream registries, e.g. "ghcr-mirror.internal" → "ghcr.io", so
+	// clients can keep unmodified image references and only change DNS.
+	// Unmatched hosts fall back to Registry.
+	HostRoutes map[string]string
+
+	// PathRoutes maps the first segment of a repository path (lowercase)
+	// to upstream registries, e.g. "ghcr.io" → "ghcr.io", so one proxy
+	// can front many registries: /v2/ghcr.io/org/app/... pulls org/app
+	// from ghcr.io. The segment is stripped before anything else sees
+	// the name. Paths without a matching segment are routed as before.
+	PathRoutes map[string]string
+
+	// MirrorRoutes maps registries named by containerd's ns query
+	// parameter (lowercase) to upstream registries, so one proxy can be
+	// the hosts.toml mirror for several. It is also the allowlist: a
+	// request naming an unlisted registry is refused rather than served
+	// from another upstream. Empty ignores ns.
+	MirrorRoutes map[string]string
+
+	// Projects enables Harbor proxy-cache compatibility by mapping Harbor
+	// proxy-project names (lowercase) to the upstream registry each
+	// caches. Request paths not routed by PathRoutes must begin with a
+	// project, which selects the upstream and is stripped (e.g.
+	// /v2/proxy-dockerhub/library/nginx/manifests/latest).
+	Projects map[string]string
+
+	// AllowedNamespaces restricts which repositories may be pulled from
+	// an upstream registry (e.g. "docker.io": {"library/*", "myorg/*"}).
+	// Keys are registries, by API host or alias; "" is the default
+	// Registry. Upstreams without an entry serve every repository.
+	AllowedNamespaces map[string][]string
+
+	// DigestPinned lists repository patterns (same syntax as
+	// AllowedNamespaces) for which pulling a manifest by tag is refused,
+	// so clients must reference images by digest.
+	DigestPinned []string
+
+	// FlattenPlatforms, when set, reduces indexes served by tag to these
+	// platforms. The original index remains available by its digest.
+	FlattenPlatforms []Platform
+
+	// TagTTL, when positive, is how long a cached tag manifest is served
+	// without checking upstream. Past it the cached copy is still served
+	// while a background request revalidates it, until TagMaxStale more
+	// has elapsed (zero: no bound), after which the tag is fetched from
+	// upstream before answering. Zero keeps cached tags indefinitely.
+	TagTTL      time.Duration
+	TagMaxStale time.Duration
+
+	// TagStaleIfError answers a tag manifest request whose upstream fetch
+	// fails (an error or a 5xx) with the cached copy instead, however
+	// old, so pulls keep working through registry outages. Tags that
+	// aren't cached for serving are still stored, as the copy to fall
+	// back on.
+	TagStaleIfError bool
+
+	// Canaries override the tag settings above for some repositories, and
+	// split tag manifest metrics by cohort so the two can be compared.
+	Canaries []Canary
+
+	// Timeouts bounds each request end to end by its class. The zero value
+	// applies no budgets.
+	Timeouts Timeouts
+
+	// MaxBufferedBytes caps the memory held by concurrent upstream fills
+	// and buffered manifests. Requests that would exceed it get 503 with
+	// Retry-After. Zero disables the cap.
+	MaxBufferedBytes int64
+
+	// KeySchema decides whether blobs are stored once globally or once per
+	// registry. The zero value is cache.KeySchemaGlobal.
+	KeySchema cache.KeySchema
+
+	// TagAudit, when set, records upstream tags that change digest.
+	TagAudit *audit.TagLog
+
+	// Inflight, when set, records cache fills in progress.
+	Inflight *stream.Inflight
+
+	// Uploads bounds cache uploads; see stream.Uploads. When nil they
+	// run until the store finishes them.
+	Uploads *stream.Uploads
+
+	// Ready, when set, gates traffic: while it returns an error /readyz
+	// reports 503 and registry requests are rejected with 503 + Retry-After.
+	Ready func() error
+
+	// Health, when set, tracks the degraded states the proxy is in, which
+	// /readyz reports. Set the same Monitor as the store's (health.Track)
+	// and the upstream client's.
+	Health *health.Monitor
+
+	// SelfTest, when set, exercises the storage backend for
+	// /readyz?deep=1. Results are reused for deepReadyInterval so frequent
+	// probes don't turn into a stream of storage writes.
+	SelfTest func(ctx context.Context) error
+
+	// RedirectRetryWindow, when positive, treats a client requesting an
+	// object again within this long of being redirected for it as unable to
+	// reach the object store: it is streamed cached objects instead for
+	// RedirectRetryCooldown. Requests with ?direct=1 are always streamed.
+	RedirectRetryWindow   time.Duration
+	RedirectRetryCooldown time.Duration
+
+	// V2CheckTTL, when positive, answers anonymous /v2/ checks from the
+	// last upstream answer for this long instead of forwarding each one.
+	V2CheckTTL time.Duration
+
+	// BypassTrustedNets lists client networks allowed to skip the cache via
+	// BypassHeader. Empty disables the bypass entirely.
+	BypassTrustedNets []netip.Prefix
+
+	// ChunkSize, when positive, serves range requests for uncached blobs
+	// from chunks of this size, cached as they're fetched, so blobs read
+	// piecemeal are cached piecemeal. See chunks.go.
+	ChunkSize int64
+
+	// IsolatePrivate stores content fetched with a client's credentials
+	// under that client's principal, so tenants sharing the proxy aren't
+	// served each other's private content. Content anonymous clients fill
+	// stays shared, as does everything in SharedRepositories (same syntax
+	// as AllowedNamespaces). IsolationKey keys the principal HMAC and must
+	// be set with IsolatePrivate. See isolation.go.
+	IsolatePrivate     bool
+	SharedRepositories []string
+	IsolationKey       []byte
+
+	// Prefetch, when set, learns which objects follow each tag pull and
+	// fetches them ahead of the client. See prefetch.go.
+	Prefetch *Prefetcher
+
+	// Artifacts serve files from HTTP servers and GitHub releases as
+	// synthetic OCI artifacts, each under its own repository, fetched with
+	// ArtifactClient (nil uses http.DefaultClient). See artifacts.go.
+	Artifacts      []ArtifactSource
+	ArtifactClient *http.Client
+
+	// HelmFacade serves the Helm charts cached under each namespace as a
+	// classic chart repository at /helm/<namespace>/. See helm.go.
+	HelmFacade bool
+
+	// Pinned, when set, reports whether the object at a storage key is
+	// pinned (see maintenance.Scheduler). A pinned tag is served from the
+	// cache however old, without revalidating it upstream.
+	Pinned func(key string) bool
+
+	// policyOverride is set by SetPolicy.
+	policyOverride atomic.Pointer[Policy]
+
+	// tagValidated records when a cached tag (by key) was last confirmed
+	// unchanged upstream; tagRevalidating holds keys being revalidated.
+	tagValidated    sync.Map
+	tagRevalidating sync.Map
+
+	// artifactFills holds *artifactFill by key for artifacts being
+	// materialised.
+	artifactFills sync.Map
+
+	redirects redirectTracker
+	verified  tokenVerifier
+
+	// v2CheckCache holds *v2CheckResponse by method and registry.
+	v2CheckCache sync.Map
+
+	deepMu    sync.Mutex
+	deepAt    time.Time
+	deepError error
 }
 
+// deepReadyInterval is how long a /readyz?deep=1 self-test result is reused.
+const deepReadyInterval = 30 * time.Second
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/healthz" {
 		w.WriteHeader(http.StatusOK)
@@ -74,12 +265,92 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The server only starts listening once the store has initialised, so
+	// readiness only depends on the optional Ready gate, plus the storage
+	// self-test in deep mode.
+	if r.URL.Path == "/readyz" {
+		if err := h.ready(); err != nil {
+			h.writeReadyz(w, err)
+			return
+		}
+		if r.URL.Query().Get("deep") != "" {
+			if err := h.deepReady(r.Context()); err != nil {
+				h.writeReadyz(w, fmt.Errorf("storage self-test failed: %w", err))
+				return
+			}
+		}
+		h.writeReadyz(w, nil)
+		return
+	}
+
+	// Every registry response carries the API version; see clientcompat.go.
+	w.Header().Set(apiVersionHeader, "registry/2.0")
+
+	// When the store is rate limited, a pull would rather go upstream than
+	// queue behind a storm of others.
+	r = r.WithContext(cache.WithShedding(r.Context()))
+
+	if err := h.ready(); err != nil {
+		w.Header().Set("Retry-After", "10")
+		writeOCIError(w, http.StatusServiceUnavailable, "UNAVAILABLE", err.Error())
+		return
+	}
+
+	// Routing and parsing, up to knowing which content is asked for.
+	_, parse := tracing.Start(r.Context(), "proxy.parse")
+	defer parse.End()
+
+	registry, ok := h.routeRegistry(r)
+
+	if p, ok := strings.CutPrefix(r.URL.Path, "/helm/"); ok && h.HelmFacade {
+		h.serveHelm(w, r, registry, p)
+		return
+	}
+
 	path := strings.TrimPrefix(r.URL.Path, "/v2")
 	path = strings.TrimPrefix(path, "/")
 
+	routed, rest, byPath := h.routePath(path)
+	if byPath {
+		registry, path, ok = routed, rest, true
+	}
+	var byMirror bool
+	if !byPath {
+		mirrored, found, allowed := h.routeMirror(r)
+		if found && !allowed {
+			writeOCIError(w, http.StatusNotFound, "NAME_UNKNOWN", "registry "+r.URL.Query().Get("ns")+" is not mirrored")
+			return
+		}
+		if found {
+			registry, ok, byMirror = mirrored, true, true
+		}
+	}
+	var byProject bool
+	if !byPath && len(h.Projects) > 0 && path != "" && path != "/" {
+		projected, rest, found := h.stripProject(path)
+		if !found {
+			writeOCIError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository is not under a configured project")
+			return
+		}
+		registry, path, ok, byProject = projected, rest, true, true
+	}
+	if !ok {
+		if (path == "" || path == "/") && len(h.PathRoutes)+len(h.MirrorRoutes)+len(h.Projects) > 0 {
+			// No single upstream to ask; path-routed and mirrored pulls
+			// are anonymous or use the proxy's own credentials.
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, "{}")
+			return
+		}
+		writeOCIError(w, http.StatusNotFound, "NAME_UNKNOWN", "no upstream registry is configured for host "+r.Host)
+		return
+	}
+
 	// GET /v2/ — proxy to upstream so auth challenges (401 + Www-Authenticate) flow through
 	if path == "" || path == "/" {
-		h.handleV2Check(w, r)
+		r, cancel := withBudget(r, h.Timeouts.Short)
+		defer cancel()
+		h.handleV2Check(w, r, registry)
 		return
 	}
 
@@ -93,17 +364,66 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	info.Registry = h.Registry
+	if perr := validateReference(info); perr != nil {
+		writeOCIError(w, http.StatusBadRequest, perr.code, perr.msg)
+		return
+	}
+	info.Registry = registry
+	info.Query = r.URL.RawQuery
+	if byMirror {
+		info.Query = withoutNS(info.Query)
+	}
+	if byProject || byPath || byMirror {
+		info.Name = normalizeName(registry, info.Name)
+	}
+
+	policy := h.policy()
+	if !nameAllowed(h.allowedNamespaces(policy, info.Registry), info.Name) {
+		slog.Debug("repository outside allowed namespaces", "image", info.image())
+		writeOCIError(w, http.StatusForbidden, "DENIED", "repository "+info.Name+" is not served by this mirror")
+		return
+	}
+
+	if info.isTagManifest() && len(policy.DigestPinned) > 0 && cache.MatchRepository(policy.DigestPinned, info.Name) {
+		slog.Info("rejected tag pull for digest-pinned repository", "image", info.image(), "tag", info.Reference)
+		writeOCIError(w, http.StatusForbidden, "DENIED",
+			"repository "+info.Name+" only allows pulls by digest; reference it as "+info.Name+"@sha256:<digest> instead of :"+info.Reference)
+		return
+	}
 
 	slog.Debug("request", "method", r.Method, "image", info.image(), "kind", info.Kind, "ref", info.shortRef())
+	traceRequest(parse, info)
+	parse.End()
+
+	// Artifact downloads aren't bounded by the request budget: a client
+	// waiting on one gives up alone, leaving it to finish for the next.
+	if src, ok := h.artifactSource(info.Name); ok {
+		h.serveArtifact(w, r, info, src)
+		return
+	}
+
+	r, cancel := withBudget(r, h.Timeouts.forRequest(r.Method, info))
+	defer cancel()
 
-	// Referrers — pass through to upstream, no caching
-	if info.Kind == "referrers" {
+	// Referrers and tag lists — pass through to upstream, no caching
+	if info.Kind == "referrers" || info.Kind == "tags" {
 		h.handlePassthrough(w, r, info)
 		return
 	}
 
-	storageKey := storageKey(info)
+	if h.wantsBypass(r) {
+		h.handleBypass(w, r, info)
+		return
+	}
+
+	storageKey := h.storageKey(info)
+	if h.shouldCache(info) {
+		if storageKey, ok = h.isolate(w, r, info, storageKey); !ok {
+			return
+		}
+		h.predict(r, info, storageKey)
+	}
+	defer h.observeCohort(info, time.Now())
 
 	// HEAD request — check cache, otherwise forward upstream
 	if r.Method == http.MethodHead {
@@ -115,8 +435,72 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.handleGet(w, r, info, storageKey)
 }
 
-func (h *Handler) handleV2Check(w http.ResponseWriter, r *http.Request) {
-	resp, err := h.Upstream.DoV2Check(r, h.Registry)
+func (h *Handler) ready() error {
+	if h.Ready == nil {
+		return nil
+	}
+	return h.Ready()
+}
+
+// readyzResponse is the /readyz body. Status is "serving", "degraded"
+// (serving, with the listed conditions) or "unavailable" (503, see Error).
+type readyzResponse struct {
+	Status     string             `json:"status"`
+	Conditions []health.Condition `json:"conditions,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+func (h *Handler) writeReadyz(w http.ResponseWriter, err error) {
+	resp := readyzResponse{Status: "serving", Conditions: h.Health.Conditions()}
+	status := http.StatusOK
+	switch {
+	case err != nil:
+		resp.Status, resp.Error = "unavailable", err.Error()
+		status = http.StatusServiceUnavailable
+	case len(resp.Conditions) > 0:
+		resp.Status = "degraded"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// deepReady runs SelfTest, or returns its result from the last
+// deepReadyInterval. Concurrent probes share one run.
+func (h *Handler) deepReady(ctx context.Context) error {
+	if h.SelfTest == nil {
+		return nil
+	}
+	h.deepMu.Lock()
+	defer h.deepMu.Unlock()
+	if !h.deepAt.IsZero() && time.Since(h.deepAt) < deepReadyInterval {
+		return h.deepError
+	}
+	err := h.SelfTest(ctx)
+	if ctx.Err() != nil {
+		return err // the prober gave up; don't cache its cancellation
+	}
+	h.deepError, h.deepAt = err, time.Now()
+	if h.deepError != nil {
+		slog.Warn("storage self-test failed", "error", h.deepError)
+	}
+	return h.deepError
+}
+
+func (h *Handler) handleV2Check(w http.ResponseWriter, r *http.Request, registry string) {
+	// The proxy holds the credentials, so there is no challenge to relay
+	// (and static layouts in S3 have no /v2/ endpoint at all).
+	if h.Upstream.ProxyManagedAuth(registry) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if c, ok := h.cachedV2Check(r, registry); ok {
+		v2Checks.Inc(registry, "cached")
+		c.write(w)
+		return
+	}
+	resp, err := h.Upstream.DoV2Check(r, registry)
 	if err != nil {
 		slog.Debug("upstream /v2/ check failed", "error", err)
 		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
@@ -124,6 +508,11 @@ func (h *Handler) handleV2Check(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer resp.Body.Close()
+	v2Checks.Inc(registry, "upstream")
+	if c := h.storeV2Check(r, registry, resp); c != nil {
+		c.write(w)
+		return
+	}
 
 	copyResponseHeaders(w, resp)
 	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
@@ -135,8 +524,22 @@ func (h *Handler) handleV2Check(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) handleHead(w http.ResponseWriter, r *http.Request, info requestInfo, key string) {
 	if h.shouldCache(info) {
+		_, lookup := tracing.Start(r.Context(), "cache.lookup")
 		meta, err := h.Cache.Head(r.Context(), key)
+		if err == nil && !acceptable(r, info, meta.ContentType) {
+			notAcceptable(info, meta.ContentType)
+			err = errNotAcceptable
+		}
+		if err == nil && !h.usableCached(r, info, key, meta) {
+			// Answer from upstream, and refresh the cache behind it.
+			h.revalidate(r, info, key, meta.DockerContentDigest)
+			err = errTagExpired
+		}
+		endLookup(lookup, key, err)
 		if err == nil {
+			if h.rejectSchema1(w, info, meta.ContentType) {
+				return
+			}
 			replayStoredHeaders(w, meta)
 			w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 			setCacheControl(w, info)
@@ -145,27 +548,58 @@ func (h *Handler) handleHead(w http.ResponseWriter, r *http.Request, info reques
 		}
 	}
 
-	// Cache miss or tag manifest — forward HEAD to upstream
-	resp, err := h.Upstream.Do(r, info)
+	// Cache miss or tag manifest — forward HEAD to upstream. When indexes
+	// are flattened the tag's digest depends on the body, so fetch it.
+	h.countCohort(info, "upstream")
+	upstreamReq := r
+	if h.flattens(info) {
+		upstreamReq = r.Clone(r.Context())
+		upstreamReq.Method = http.MethodGet
+	}
+	resp, err := h.Upstream.Do(upstreamReq, info)
 	if err != nil {
 		slog.Debug("upstream HEAD failed", "error", err)
-		writeError(w, "upstream error", http.StatusBadGateway)
+		if h.serveStaleTag(w, r, info, key, err) {
+			return
+		}
+		writeUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 500 && h.serveStaleTag(w, r, info, key, errors.New("upstream returned "+resp.Status)) {
+		return
+	}
+
+	if resp.StatusCode == http.StatusOK && h.rejectSchema1(w, info, resp.Header.Get("Content-Type")) {
+		return
+	}
+	h.observeTag(r.Context(), info, resp)
+
+	if h.flattens(info) && resp.StatusCode == http.StatusOK && isIndex(resp.Header.Get("Content-Type")) {
+		release, ok := h.reserveManifest(resp)
+		if !ok {
+			shedLoad(w, info, "manifest")
+			return
+		}
+		defer release()
+		h.serveFlattened(w, r, info, key, resp)
+		return
+	}
 
+	h.completeHead(r, info, resp)
 	copyResponseHeaders(w, resp)
 	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 	w.WriteHeader(resp.StatusCode)
 }
 
 func (h *Handler) handlePassthrough(w http.ResponseWriter, r *http.Request, info requestInfo) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
-	defer cancel()
-
-	resp, err := h.Upstream.Do(r.WithContext(ctx), info)
+	resp, err := h.Upstream.Do(r, info)
 	if err != nil {
 		slog.Debug("upstream passthrough failed", "kind", info.Kind, "error", err)
+		if errors.Is(err, ErrFrozen) || errors.Is(err, ErrTransferCap) {
+			writeUpstreamError(w, err)
+			return
+		}
 		writeError(w, "upstream unavailable", http.StatusGatewayTimeout)
 		return
 	}
@@ -179,32 +613,86 @@ func (h *Handler) handlePassthrough(w http.ResponseWriter, r *http.Request, info
 	}
 }
 
+// handleBypass forwards the request straight to upstream without consulting or
+// populating the cache, for debugging suspected stale or corrupt entries.
+func (h *Handler) handleBypass(w http.ResponseWriter, r *http.Request, info requestInfo) {
+	slog.Info("cache bypass", "image", info.image(), "kind", info.Kind, "ref", info.shortRef(), "remote", r.RemoteAddr)
+
+	resp, err := h.Upstream.Do(r, info)
+	if err != nil {
+		slog.Error("upstream failed", "image", info.image(), "error", err)
+		writeUpstreamError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	h.observeTag(r.Context(), info, resp)
+
+	copyResponseHeaders(w, resp)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(resp.StatusCode)
+	if _, err := copyToClient(w, resp.Body); err != nil {
+		slog.Debug("error forwarding bypass response", "error", err)
+	}
+}
+
 func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, info requestInfo, key string) {
 	// 1. Try redirect for backends that support presigned URLs (e.g. S3)
-	if redirector, ok := h.Cache.(cache.Redirector); ok && h.shouldCache(info) {
+	// A cached tag in a type the client can't take is passed over, and the
+	// narrower answer upstream gives it isn't cached in its place.
+	cacheable := h.shouldCache(info)
+	if redirector, ok := h.Cache.(cache.Redirector); ok && cacheable && h.allowRedirect(r, key) {
+		_, lookup := tracing.Start(r.Context(), "cache.lookup")
+		lookup.SetAttr("cache.redirect", true)
 		url, meta, err := redirector.RedirectURL(r.Context(), key)
+		if err == nil && !acceptable(r, info, meta.ContentType) {
+			notAcceptable(info, meta.ContentType)
+			cacheable, err = false, errNotAcceptable
+		}
+		if err == nil && !h.usableCached(r, info, key, meta) {
+			err = errTagExpired
+		}
+		endLookup(lookup, key, err)
 		if err == nil {
+			if h.rejectSchema1(w, info, meta.ContentType) {
+				return
+			}
 			slog.Info("cache hit (redirect)", "image", info.image(), "kind", info.Kind, "ref", info.shortRef())
 			replayStoredHeaders(w, meta)
 			w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 			setCacheControl(w, info)
 			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			h.redirected(r, key)
 			return
 		}
 		// Fall through to upstream on error (cache miss or presign failure)
 	}
 
-	// 2. Check cache with streaming (FS backend with seekable files)
-	if h.shouldCache(info) {
+	// 2. Check cache with streaming (seekable bodies support ranges)
+	if cacheable {
+		_, lookup := tracing.Start(r.Context(), "cache.lookup")
 		result, err := h.Cache.GetWithMeta(r.Context(), key)
+		if err == nil && !acceptable(r, info, result.Meta.ContentType) {
+			result.Body.Close()
+			notAcceptable(info, result.Meta.ContentType)
+			cacheable, err = false, errNotAcceptable
+		}
+		if err == nil && !h.usableCached(r, info, key, result.Meta) {
+			result.Body.Close()
+			err = errTagExpired
+		}
+		endLookup(lookup, key, err)
 		if err == nil {
-			slog.Info("cache hit", "image", info.image(), "kind", info.Kind, "ref", info.shortRef())
 			defer result.Body.Close()
+			if h.rejectSchema1(w, info, result.Meta.ContentType) {
+				return
+			}
+			slog.Info("cache hit", "image", info.image(), "kind", info.Kind, "ref", info.shortRef())
 			replayStoredHeaders(w, result.Meta)
 			w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 			setCacheControl(w, info)
 			if seeker, ok := result.Body.(io.ReadSeeker); ok {
-				// FS backend returns *os.File (seekable) — let ServeContent
+				// FS files and S3 objects are seekable — let ServeContent
 				// handle Range negotiation, 206 responses, and Content-Range.
 				http.ServeContent(w, r, "", time.Time{}, seeker)
 			} else {
@@ -218,19 +706,42 @@ func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, info request
 		}
 	}
 
-	// 2. Cache miss or tag manifest — fetch from upstream
+	// 2. Cache miss or tag manifest — fetch from upstream. The fetch gets its
+	// own cancel func so a stuck fill can be aborted via the admin API.
+	release, ok := h.reserveMemory(streamBufferBytes)
+	if !ok {
+		shedLoad(w, info, "stream")
+		return
+	}
+	defer release()
+	if h.ChunkSize > 0 && info.Kind == "blobs" && cacheable && r.Header.Get("Range") != "" &&
+		h.serveChunks(w, r, info, key) {
+		return
+	}
 	slog.Info("upstream fetch", "image", info.image(), "kind", info.Kind, "ref", info.shortRef())
-	resp, err := h.Upstream.Do(r, info)
+	h.countCohort(info, "upstream")
+	ctx, cancel := h.Uploads.FetchContext(r.Context())
+	defer cancel()
+	resp, err := h.Upstream.Do(r.WithContext(ctx), info)
 	if err != nil {
 		slog.Error("upstream failed", "image", info.image(), "error", err)
-		writeError(w, "upstream error", http.StatusBadGateway)
+		if h.serveStaleTag(w, r, info, key, err) {
+			return
+		}
+		writeUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	// Non-200 responses (401, 404, etc.) — forward as-is without caching
+	// Non-200 responses (304, 401, 404, etc.) — forward as-is without caching
 	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode >= 500 && h.serveStaleTag(w, r, info, key, errors.New("upstream returned "+resp.Status)) {
+			return
+		}
 		slog.Debug("upstream non-200", "image", info.image(), "status", resp.StatusCode)
+		if resp.StatusCode == http.StatusNotModified {
+			h.revalidateNotModified(r.Context(), info, key, resp)
+		}
 		copyResponseHeaders(w, resp)
 		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 		w.WriteHeader(resp.StatusCode)
@@ -240,10 +751,50 @@ func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, info request
 		return
 	}
 
+	if h.rejectSchema1Response(w, info, resp) {
+		return
+	}
+	h.observeTag(r.Context(), info, resp)
+
+	if info.Kind == "manifests" && h.MaxManifestSize > 0 {
+		if resp.ContentLength > h.MaxManifestSize {
+			slog.Warn("upstream manifest too large", "image", info.image(), "ref", info.shortRef(), "size", resp.ContentLength)
+			writeOCIError(w, http.StatusBadGateway, "MANIFEST_INVALID",
+				fmt.Sprintf("upstream manifest is %d bytes, over the %d byte limit", resp.ContentLength, h.MaxManifestSize))
+			return
+		}
+		resp.Body = newLimitedBody(resp.Body, h.MaxManifestSize)
+	}
+	flatten := h.flattens(info) && isIndex(resp.Header.Get("Content-Type"))
+	if info.Kind == "manifests" && (flatten || !info.isTagManifest()) {
+		release, ok := h.reserveManifest(resp)
+		if !ok {
+			shedLoad(w, info, "manifest")
+			return
+		}
+		defer release()
+	}
+	if info.Kind == "manifests" && !info.isTagManifest() && !h.verifyManifest(w, info, resp) {
+		return
+	}
+
+	if info.isTagManifest() && h.tagPolicy(info).ttl > 0 && cacheable {
+		// This is a miss or an expired copy; clear the way for the fresh one.
+		if err := h.Cache.Delete(r.Context(), key); err != nil {
+			slog.Debug("removing expired tag failed", "key", key, "error", err)
+		}
+	}
+	fallback := h.keepsTagFallback(info) && h.replaceTagFallback(r.Context(), key, resp)
+
+	if flatten {
+		h.serveFlattened(w, r, info, key, resp)
+		return
+	}
+
 	// 3. 200 OK — tag manifests forward directly, everything else tee-streams to S3
 	copyResponseHeaders(w, resp)
 	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
-	if !h.shouldCache(info) {
+	if !cacheable && !fallback {
 		w.WriteHeader(http.StatusOK)
 		if _, err := copyToClient(w, resp.Body); err != nil {
 			slog.Debug("error forwarding tag manifest", "error", err)
@@ -251,7 +802,9 @@ func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, info request
 		return
 	}
 
-	setCacheControl(w, info)
+	if cacheable {
+		setCacheControl(w, info)
+	}
 	w.WriteHeader(http.StatusOK)
 
 	putMeta := cache.ObjectMeta{
@@ -260,8 +813,49 @@ func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, info request
 		ContentLength:       resp.ContentLength,
 		Header:              cloneResponseHeaders(resp),
 	}
+	if putMeta.Header.Get("Date") == "" {
+		// Tag freshness is measured from Date.
+		putMeta.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
 
-	err = stream.TeeToStore(r.Context(), resp.Body, w, h.Cache, key, putMeta)
+	var body io.Reader = resp.Body
+	var client io.Writer = w
+	if h.Inflight != nil {
+		fill := h.Inflight.Start(key, h.Upstream.upstreamURL(info), resp.ContentLength, cancel)
+		defer fill.Done()
+		body, client = fill.Reader(body), fill.Writer(client)
+	}
+
+	// Blobs and manifests requested by digest are checked as they stream;
+	// tags name no digest to check against.
+	var digest string
+	if !info.isTagManifest() {
+		digest = info.Reference
+	}
+	fillCache := h.Uploads.TeeToStore
+	if spool, inMemory := h.Uploads.Spools(resp.ContentLength); spool {
+		fillCache = h.Uploads.SpoolToStore
+		if inMemory {
+			// Spools in memory are charged like buffered manifests; with no
+			// room the fill streams instead.
+			if release, ok := h.reserveMemory(resp.ContentLength); ok {
+				defer release()
+			} else {
+				fillCache = h.Uploads.TeeToStore
+			}
+		}
+	}
+	err = fillCache(ctx, body, client, h.Cache, key, putMeta, digest)
+	if errors.Is(err, stream.ErrDigestMismatch) {
+		digestMismatches.Inc(info.Kind, info.Registry)
+		slog.Error("upstream content does not match its digest; not cached", "image", info.image(), "ref", info.shortRef(), "error", err)
+		if resp.ContentLength < 0 {
+			// Cut the chunked response short so the client sees a failed
+			// transfer rather than a complete, corrupt one.
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
 	if err != nil {
 		slog.Debug("tee stream error", "key", key, "error", err)
 	}
@@ -285,6 +879,9 @@ func copyResponseHeaders(w http.ResponseWriter, resp *http.Response) {
 		if _, hop := hopByHopHeaders[http.CanonicalHeaderKey(key)]; hop {
 			continue
 		}
+		if http.CanonicalHeaderKey(key) == http.CanonicalHeaderKey(apiVersionHeader) {
+			continue // set by the proxy itself
+		}
 		for _, v := range values {
 			w.Header().Add(key, v)
 		}
@@ -292,13 +889,17 @@ func copyResponseHeaders(w http.ResponseWriter, resp *http.Response) {
 }
 
 // cloneResponseHeaders returns a copy of the upstream response headers,
-// excluding hop-by-hop headers, suitable for persisting in cache metadata.
+// excluding hop-by-hop and notice headers, suitable for persisting in
+// cache metadata.
 func cloneResponseHeaders(resp *http.Response) http.Header {
 	h := make(http.Header)
 	for key, values := range resp.Header {
 		if _, hop := hopByHopHeaders[http.CanonicalHeaderKey(key)]; hop {
 			continue
 		}
+		if isNoticeHeader(http.CanonicalHeaderKey(key)) {
+			continue
+		}
 		h[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
 	}
 	return h
@@ -306,9 +907,13 @@ func cloneResponseHeaders(resp *http.Response) http.Header {
 
 // replayStoredHeaders writes all headers from cached metadata onto the response.
 // Headers like Content-Type, Docker-Content-Digest, and Content-Length are
-// included in the stored set, so no special-casing is needed.
+// included in the stored set, so no special-casing is needed. Notice
+// headers stored by older versions are dropped.
 func replayStoredHeaders(w http.ResponseWriter, meta cache.ObjectMeta) {
 	for key, values := range meta.Header {
+		if isNoticeHeader(http.CanonicalHeaderKey(key)) {
+			continue
+		}
 		for _, v := range values {
 			w.Header().Add(key, v)
 		}
@@ -372,10 +977,13 @@ func parsePath(path string) (requestInfo, error) {
 	path = strings.TrimSuffix(path, "/")
 	segments := strings.Split(path, "/")
 
-	// Find "manifests" or "blobs" from the end
+	// Find "manifests" or "blobs" from the end. "tags" is only the kind in
+	// a tag listing, <name>/tags/list; elsewhere it is a tag or part of
+	// the name, as in <name>/manifests/tags.
 	kindIdx := -1
 	for i := len(segments) - 1; i >= 0; i-- {
-		if segments[i] == "manifests" || segments[i] == "blobs" || segments[i] == "referrers" {
+		if segments[i] == "manifests" || segments[i] == "blobs" || segments[i] == "referrers" ||
+			segments[i] == "tags" && i == len(segments)-2 && segments[i+1] == "list" {
 			kindIdx = i
 			break
 		}
@@ -405,20 +1013,21 @@ func parsePath(path string) (requestInfo, error) {
 // storageKey computes the storage key for a request.
 // Digest colons are replaced with hyphens (sha256:abc → sha256-abc) to keep
 // keys as single path segments.
-func storageKey(info requestInfo) string {
+func (h *Handler) storageKey(info requestInfo) string {
 	if info.Kind == "blobs" {
-		// blobs are content-addressed; key by digest only
-		return "blobs/" + strings.Replace(info.Reference, ":", "-", 1)
+		// blobs are content-addressed; key by digest, and by registry if
+		// the schema scopes them
+		return h.KeySchema.BlobKey(info.Registry, info.Reference)
 	}
 
+	repo := info.Registry + "/" + info.Name
 	// Manifests — check if reference is a digest or tag
 	if strings.Contains(info.Reference, ":") {
-		return fmt.Sprintf("manifests/%s/%s/%s", info.Registry, info.Name, strings.Replace(info.Reference, ":", "-", 1))
+		return cache.ManifestKey(repo, info.Reference)
 	}
 
-	// Tag references are never cached — this shouldn't be reached.
-	// Return a key anyway for safety, but it will never be written to or read from S3.
-	return fmt.Sprintf("manifests/%s/%s/tags/%s", info.Registry, info.Name, info.Reference)
+	// Tag manifests are only written when CacheTagManifests is on.
+	return cache.TagKey(repo, info.Reference)
 }
 
 func copyToClient(w http.ResponseWriter, src io.Reader) (int64, error) {
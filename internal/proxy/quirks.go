@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Quirks are compatibility toggles for upstreams that bend the
+// distribution spec. Most registries need none.
+type Quirks struct {
+	// PathPrefix is inserted before /v2/ in upstream URLs, for Artifactory's
+	// repository path method ("/artifactory/api/docker/docker-remote").
+	PathPrefix string
+	// RelativeLinks rewrites Link headers that point at the upstream (Quay
+	// and Artifactory paginate tag lists with absolute URLs) into paths
+	// relative to the proxy, so clients fetch the next page through it.
+	RelativeLinks bool
+	// FillDigest sets a missing Docker-Content-Digest on responses for
+	// digest references; Artifactory drops it for some repository types,
+	// and containerd refuses manifests without it.
+	FillDigest bool
+}
+
+// quirkPresets name the toggles known registries need.
+var quirkPresets = map[string]Quirks{
+	"quay":        {RelativeLinks: true},
+	"artifactory": {RelativeLinks: true, FillDigest: true},
+}
+
+// defaultQuirks apply to public registries without configuration, keyed
+// by the host serving their API so every alias shares them.
+var defaultQuirks = map[string]Quirks{
+	"quay.io": quirkPresets["quay"],
+	// Blobs redirected to registry.k8s.io's S3 buckets come back without
+	// a Docker-Content-Digest.
+	"registry.k8s.io": {FillDigest: true},
+}
+
+// ParseQuirks parses a "+"-separated list of presets ("quay",
+// "artifactory") and toggles ("relative-links", "fill-digest").
+func ParseQuirks(spec string) (Quirks, error) {
+	var q Quirks
+	for _, name := range strings.Split(spec, "+") {
+		name = strings.TrimSpace(name)
+		if p, ok := quirkPresets[name]; ok {
+			q.RelativeLinks = q.RelativeLinks || p.RelativeLinks
+			q.FillDigest = q.FillDigest || p.FillDigest
+			continue
+		}
+		switch name {
+		case "relative-links":
+			q.RelativeLinks = true
+		case "fill-digest":
+			q.FillDigest = true
+		case "", "none":
+		default:
+			return Quirks{}, fmt.Errorf("unknown upstream quirk %q", name)
+		}
+	}
+	return q, nil
+}
+
+func (u *UpstreamClient) quirks(registry string) Quirks {
+	registry = strings.ToLower(registry)
+	if q, ok := u.Quirks[registry]; ok {
+		return q
+	}
+	host := strings.ToLower(resolveRegistry(registry))
+	if q, ok := u.Quirks[host]; ok {
+		return q
+	}
+	return defaultQuirks[host]
+}
+
+var linkTarget = regexp.MustCompile(`<([^>]*)>`)
+
+// fixResponse applies the toggles to an upstream response. host is the
+// upstream host the request was sent to.
+func (q Quirks) fixResponse(resp *http.Response, info requestInfo, host string) {
+	if q.RelativeLinks {
+		for i, v := range resp.Header.Values("Link") {
+			resp.Header["Link"][i] = linkTarget.ReplaceAllStringFunc(v, func(m string) string {
+				return "<" + q.relativeLink(m[1:len(m)-1], host) + ">"
+			})
+		}
+	}
+	if q.FillDigest && resp.StatusCode == http.StatusOK && resp.Header.Get("Docker-Content-Digest") == "" &&
+		(info.Kind == "manifests" || info.Kind == "blobs") && strings.Contains(info.Reference, ":") {
+		resp.Header.Set("Docker-Content-Digest", info.Reference)
+	}
+}
+
+// relativeLink turns a link to the upstream into a proxy path, leaving
+// links elsewhere alone.
+func (q Quirks) relativeLink(link, host string) string {
+	u, err := url.Parse(link)
+	if err != nil || (u.Host != "" && !strings.EqualFold(u.Host, host)) {
+		return link
+	}
+	u.Scheme, u.Host, u.User = "", "", nil
+	u.Path = strings.TrimPrefix(u.Path, q.PathPrefix)
+	return u.String()
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// fixture is a recorded upstream response. {{upstream}} in headers is
+// replaced with the fixture server's URL, and {{digest}} in paths and
+// headers with the digest of the body. A fixture with Accept only answers
+// requests whose Accept header contains it.
+type fixture struct {
+	Path   string              `json:"path"`
+	Query  string              `json:"query"`
+	Accept string              `json:"accept"`
+	Status int                 `json:"status"`
+	Header map[string][]string `json:"header"`
+	Body   json.RawMessage     `json:"body"`
+}
+
+func (f fixture) digest() string {
+	sum := sha256.Sum256(f.Body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// serveFixtures starts a TLS upstream replaying testdata/quirks/<name>.json.
+func serveFixtures(t *testing.T, name string) (*httptest.Server, []fixture) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "quirks", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []fixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, f := range fixtures {
+			if strings.ReplaceAll(f.Path, "{{digest}}", f.digest()) != r.URL.Path || f.Query != r.URL.RawQuery ||
+				!strings.Contains(r.Header.Get("Accept"), f.Accept) {
+				continue
+			}
+			for k, vs := range f.Header {
+				for _, v := range vs {
+					v = strings.ReplaceAll(v, "{{upstream}}", srv.URL)
+					w.Header().Add(k, strings.ReplaceAll(v, "{{digest}}", f.digest()))
+				}
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(f.Body)))
+			w.WriteHeader(f.Status)
+			if r.Method != http.MethodHead {
+				w.Write(f.Body)
+			}
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, fixtures
+}
+
+func quirksHandler(t *testing.T, srv *httptest.Server, q *Quirks) *Handler {
+	host := strings.TrimPrefix(srv.URL, "https://")
+	u := &UpstreamClient{Client: srv.Client(), Scheme: "https"}
+	if q != nil {
+		u.Quirks = map[string]Quirks{host: *q}
+	}
+	return &Handler{Registry: host, Cache: cache.NewFSStore(t.TempDir(), 0), Upstream: u}
+}
+
+func TestQuayTagPagination(t *testing.T) {
+	srv, _ := serveFixtures(t, "quay")
+	q, _ := ParseQuirks("quay")
+	h := quirksHandler(t, srv, &q)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/coreos/etcd/tags/list?n=2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("page 1: expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	next := rec.Header().Get("Link")
+	want := `</v2/coreos/etcd/tags/list?n=2&next_page=gAAAAABmQ2tZbFhx>; rel="next"`
+	if next != want {
+		t.Fatalf("Link = %q, want %q", next, want)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/coreos/etcd/tags/list?n=2&next_page=gAAAAABmQ2tZbFhx", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "v3.5.2") || rec.Header().Get("Link") != "" {
+		t.Fatalf("page 2: got %d %q, Link %q", rec.Code, rec.Body, rec.Header().Get("Link"))
+	}
+
+	// Without the toggle the upstream's absolute link leaks to the client.
+	h = quirksHandler(t, srv, nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/coreos/etcd/tags/list?n=2", nil))
+	if !strings.Contains(rec.Header().Get("Link"), srv.URL) {
+		t.Fatalf("expected absolute upstream link without quirks, got %q", rec.Header().Get("Link"))
+	}
+}
+
+func TestArtifactoryRepositoryPath(t *testing.T) {
+	srv, fixtures := serveFixtures(t, "artifactory")
+	q, _ := ParseQuirks("artifactory")
+	q.PathPrefix = "/artifactory/api/docker/docker-remote"
+	h := quirksHandler(t, srv, &q)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/v2/: expected 200, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/alpine/tags/list?n=2", nil))
+	if got, want := rec.Header().Get("Link"), `</v2/library/alpine/tags/list?last=3.19&n=2>; rel="next"`; got != want {
+		t.Fatalf("Link = %q, want %q", got, want)
+	}
+
+	digest := fixtures[2].digest()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/"+digest, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("manifest: expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Docker-Content-Digest"); got != digest {
+		t.Fatalf("Docker-Content-Digest = %q, want %q", got, digest)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if string(body) != string(fixtures[2].Body) {
+		t.Fatalf("manifest body mismatch: %s", body)
+	}
+}
+
+func TestParseQuirks(t *testing.T) {
+	q, err := ParseQuirks("quay+fill-digest")
+	if err != nil || !q.RelativeLinks || !q.FillDigest {
+		t.Fatalf("got %+v, %v", q, err)
+	}
+	if _, err := ParseQuirks("nexus"); err == nil {
+		t.Fatal("expected error for unknown quirk")
+	}
+}
+
+func TestRegistryAliases(t *testing.T) {
+	for _, tc := range []struct{ registry, host, name, want string }{
+		{"docker.io", "registry-1.docker.io", "nginx", "library/nginx"},
+		{"Index.Docker.io", "registry-1.docker.io", "bitnami/redis", "bitnami/redis"},
+		{"gallery.ecr.aws", "public.ecr.aws", "nginx", "docker/library/nginx"},
+		{"public.ecr.aws", "public.ecr.aws", "nginx/nginx", "nginx/nginx"},
+		{"k8s.gcr.io", "registry.k8s.io", "pause", "pause"},
+		{"ghcr.io", "ghcr.io", "app", "app"},
+	} {
+		if got := resolveRegistry(tc.registry); got != tc.host {
+			t.Errorf("resolveRegistry(%q) = %q, want %q", tc.registry, got, tc.host)
+		}
+		if got := normalizeName(tc.registry, tc.name); got != tc.want {
+			t.Errorf("normalizeName(%q, %q) = %q, want %q", tc.registry, tc.name, got, tc.want)
+		}
+	}
+
+	// Quirks configured or defaulted for a registry's API host apply to
+	// its aliases.
+	u := &UpstreamClient{Quirks: map[string]Quirks{"registry-1.docker.io": {FillDigest: true}}}
+	if !u.quirks("docker.io").FillDigest {
+		t.Error("quirks for registry-1.docker.io not applied to docker.io")
+	}
+}
+
+func TestECRPublicGalleryAlias(t *testing.T) {
+	srv, fixtures := serveFixtures(t, "ecr-public")
+	host := strings.TrimPrefix(srv.URL, "https://")
+	registryAliases["gallery.test"] = registryAlias{host: host, namespace: "docker/library"}
+	registryAliases[host] = registryAlias{namespace: "docker/library"}
+	t.Cleanup(func() {
+		delete(registryAliases, "gallery.test")
+		delete(registryAliases, host)
+	})
+	h := &Handler{
+		Cache:      cache.NewFSStore(t.TempDir(), 0),
+		Upstream:   &UpstreamClient{Client: srv.Client(), Scheme: "https"},
+		PathRoutes: map[string]string{"gallery.test": "gallery.test"},
+	}
+
+	// A Docker official image by its short name resolves to the
+	// registry's copy.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/gallery.test/nginx/manifests/1.27", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("manifest: expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Docker-Content-Digest"); got != fixtures[0].digest() {
+		t.Fatalf("Docker-Content-Digest = %q, want %q", got, fixtures[0].digest())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/gallery.test/nginx/nginx/tags/list", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "stable") {
+		t.Fatalf("tags: got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"iter"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -49,6 +50,13 @@ func (m *mockStore) Put(_ context.Context, _ string, body io.Reader, _ cache.Obj
 	io.Copy(io.Discard, body)
 	return nil
 }
+func (m *mockStore) Stat(_ context.Context, _ []string) (map[string]cache.ObjectInfo, error) {
+	return nil, m.err
+}
+func (m *mockStore) Delete(_ context.Context, _ string) error { return nil }
+func (m *mockStore) List(_ context.Context, _, _ string) iter.Seq2[cache.ObjectInfo, error] {
+	return func(func(cache.ObjectInfo, error) bool) {}
+}
 
 // --- shared fixtures ---
 
@@ -57,18 +65,18 @@ const testBlob = "0123456789ABCDEF" // 16 bytes
 func blobMeta() cache.ObjectMeta {
 	return cache.ObjectMeta{
 		ContentType:         "application/octet-stream",
-		DockerContentDigest: "sha256:abcdef1234567890",
+		DockerContentDigest: "sha256:abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890",
 		ContentLength:       int64(len(testBlob)),
 		Header: http.Header{
 			"Content-Type":          {"application/octet-stream"},
-			"Docker-Content-Digest": {"sha256:abcdef1234567890"},
+			"Docker-Content-Digest": {"sha256:abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890"},
 			"Content-Length":        {fmt.Sprintf("%d", len(testBlob))},
 		},
 	}
 }
 
 func blobPath() string {
-	return "/v2/test/image/blobs/sha256:abcdef1234567890"
+	return "/v2/test/image/blobs/sha256:abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890"
 }
 
 // --- tests ---
@@ -230,6 +238,26 @@ func TestParsePath(t *testing.T) {
 			path: "library/manifests/latest",
 			want: requestInfo{Name: "library", Kind: "manifests", Reference: "latest"},
 		},
+		{
+			name: "tag list",
+			path: "org/image/tags/list",
+			want: requestInfo{Name: "org/image", Kind: "tags", Reference: "list"},
+		},
+		{
+			name: "manifest tagged tags",
+			path: "org/image/manifests/tags",
+			want: requestInfo{Name: "org/image", Kind: "manifests", Reference: "tags"},
+		},
+		{
+			name: "manifest tagged list in a repository named tags",
+			path: "org/tags/manifests/list",
+			want: requestInfo{Name: "org/tags", Kind: "manifests", Reference: "list"},
+		},
+		{
+			name: "blob in a repository named tags",
+			path: "tags/blobs/sha256:abc123",
+			want: requestInfo{Name: "tags", Kind: "blobs", Reference: "sha256:abc123"},
+		},
 		{
 			name:    "no kind keyword",
 			path:    "org/image/v1.0",
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/health"
+)
+
+func TestDeepReadyz(t *testing.T) {
+	runs := 0
+	var result error
+	h := &Handler{SelfTest: func(context.Context) error { runs++; return result }}
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := get("/readyz"); code != http.StatusOK || runs != 0 {
+		t.Fatalf("shallow readyz: status %d, %d self-tests", code, runs)
+	}
+	result = errors.New("AccessDenied")
+	if code := get("/readyz?deep=1"); code != http.StatusServiceUnavailable {
+		t.Fatalf("deep readyz with failing store: status %d", code)
+	}
+	// The failure is reused rather than re-probing storage on every call.
+	result = nil
+	if code := get("/readyz?deep=1"); code != http.StatusServiceUnavailable || runs != 1 {
+		t.Fatalf("second deep readyz: status %d, %d self-tests", code, runs)
+	}
+}
+
+func TestReadyzReportsDegradedStates(t *testing.T) {
+	m := health.NewMonitor(time.Minute, 0.5, 1, 0)
+	h := &Handler{Health: m}
+	get := func() (int, readyzResponse) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var body readyzResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("readyz body %q: %v", rec.Body, err)
+		}
+		return rec.Code, body
+	}
+
+	if code, body := get(); code != http.StatusOK || body.Status != "serving" {
+		t.Fatalf("healthy: %d %+v", code, body)
+	}
+	m.Record(health.StaleOnly, errors.New("dial tcp: connection refused"))
+	code, body := get()
+	if code != http.StatusOK || body.Status != "degraded" || len(body.Conditions) != 1 || body.Conditions[0].Name != health.StaleOnly {
+		t.Fatalf("upstream down: %d %+v", code, body)
+	}
+
+	h.Ready = func() error { return errors.New("cache index build in progress") }
+	if code, body := get(); code != http.StatusServiceUnavailable || body.Status != "unavailable" || body.Error == "" {
+		t.Fatalf("not ready: %d %+v", code, body)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// DefaultMaxRedirects bounds the redirect chain for a single upstream
+// request. Registries normally bounce a blob fetch once, to a CDN.
+const DefaultMaxRedirects = 5
+
+var (
+	upstreamRedirects = metrics.NewCounterVec("oci_upstream_redirects_total",
+		"Redirects followed for upstream requests, by registry and redirect target host.",
+		"registry", "target")
+	upstreamRedirectSeconds = metrics.NewHistogramVec("oci_upstream_redirect_hop_seconds",
+		"Time from following a redirect to receiving the target's response headers.",
+		nil, "target")
+	upstreamRedirectLimit = metrics.NewCounterVec("oci_upstream_redirect_limit_exceeded_total",
+		"Upstream requests abandoned for exceeding the redirect limit.",
+		"registry")
+)
+
+// noFollow stops http.Client from following redirects itself, so do can
+// follow them explicitly.
+func noFollow(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// do sends req and follows any redirects itself, timing each hop and
+// applying CDN host rewrites. Registries answer blob fetches with a 307 to
+// a CDN; this makes a slow CDN edge visible rather than folding it into
+// the upstream request.
+func (u *UpstreamClient) do(req *http.Request, registry string) (*http.Response, error) {
+	// Do and DoV2Check copy the client's credentials onto req; Auth may
+	// replace them.
+	clientAuth := req.Header.Get("Authorization")
+	req.Header.Del("Authorization")
+	if err := u.authorize(req, registry, clientAuth); err != nil {
+		return nil, err
+	}
+	u.setUserAgent(req)
+	first := req
+	resp, err := u.Client.Do(withConnTrace(req, registry))
+	for hops := 0; err == nil && isRedirect(resp.StatusCode); hops++ {
+		if hops >= u.maxRedirects() {
+			resp.Body.Close()
+			upstreamRedirectLimit.Inc(registry)
+			return nil, fmt.Errorf("upstream %s: stopped after %d redirects", registry, hops)
+		}
+
+		loc, locErr := resp.Location()
+		if locErr != nil {
+			// A redirect without a usable Location is returned as-is.
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if to, ok := u.CDNRewrites[strings.ToLower(loc.Hostname())]; ok {
+			slog.Debug("rewriting upstream redirect", "from", loc.Host, "to", to)
+			loc.Host = to
+		}
+		if pinned := u.pinRegion(registry, loc.Host); pinned != loc.Host {
+			slog.Debug("pinning upstream redirect to preferred region", "from", loc.Host, "to", pinned)
+			loc.Host = pinned
+		}
+
+		next, newErr := http.NewRequestWithContext(req.Context(), req.Method, loc.String(), nil)
+		if newErr != nil {
+			return nil, fmt.Errorf("following upstream redirect: %w", newErr)
+		}
+		for _, k := range []string{"Accept", "Range", "If-Range", "User-Agent"} {
+			if v := req.Header.Get(k); v != "" {
+				next.Header.Set(k, v)
+			}
+		}
+		// Credentials only go back to the host that issued them; presigned
+		// CDN URLs carry their own.
+		if strings.EqualFold(loc.Host, req.URL.Host) {
+			if err := u.authorize(next, registry, clientAuth); err != nil {
+				return nil, err
+			}
+		}
+
+		start := time.Now()
+		resp, err = u.Client.Do(withConnTrace(next, registry))
+		upstreamRedirects.Inc(registry, loc.Hostname())
+		upstreamRedirectSeconds.Observe(time.Since(start).Seconds(), loc.Hostname())
+		if err == nil {
+			slog.Debug("followed upstream redirect", "registry", registry, "target", loc.Hostname(), "status", resp.StatusCode, "duration", time.Since(start))
+		}
+		req = next
+	}
+	if err == nil {
+		resp.Body = u.Transfer.countBody(registry, resp.Body)
+	}
+	if err == nil && req != first {
+		resp.Header.Set(BackendHeader, req.URL.Host)
+		if kind, region, ok := backend(req.URL.Hostname()); ok {
+			upstreamBackends.Inc(registry, kind, region)
+		}
+	}
+	return resp, err
+}
+
+func (u *UpstreamClient) maxRedirects() int {
+	if u.MaxRedirects > 0 {
+		return u.MaxRedirects
+	}
+	return DefaultMaxRedirects
+}
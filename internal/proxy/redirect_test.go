@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamFollowsRedirects(t *testing.T) {
+	var cdnAuth string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnAuth = r.Header.Get("Authorization")
+		io.WriteString(w, "blob")
+	}))
+	defer cdn.Close()
+	cdnURL, _ := url.Parse(cdn.URL)
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusTemporaryRedirect)
+			return
+		}
+		// Redirect to a host that only resolves via the rewrite table.
+		http.Redirect(w, r, "http://cdn.invalid/blob?sig=x", http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+
+	u := &UpstreamClient{
+		Client:      &http.Client{CheckRedirect: noFollow},
+		CDNRewrites: map[string]string{"cdn.invalid": cdnURL.Host},
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, registry.URL+"/v2/x/blobs/d", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := u.do(req, "registry.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "blob" {
+		t.Fatalf("expected CDN body, got %q", body)
+	}
+	if cdnAuth != "" {
+		t.Fatalf("Authorization leaked to redirect target: %q", cdnAuth)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, registry.URL+"/loop", nil)
+	if _, err := u.do(req, "registry.test"); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Fatalf("expected redirect limit error, got %v", err)
+	}
+}
+
+func TestRedirectPinnedToPreferredRegion(t *testing.T) {
+	var backendHost string
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHost = r.Host
+		io.WriteString(w, "blob")
+	}))
+	defer store.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://prod-registry-k8s-io-us-west-1.s3.dualstack.us-west-1.amazonaws.com/containers/images/sha256:ab", http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+	registryHost := strings.TrimPrefix(registry.URL, "http://")
+	storeHost := strings.TrimPrefix(store.URL, "http://")
+
+	// Every backing store host dials the one test store.
+	dialer := &net.Dialer{}
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != registryHost {
+			addr = storeHost
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}}
+	regions, err := ParseRegions("us-east4+us-east-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &UpstreamClient{
+		Client:           &http.Client{Transport: transport, CheckRedirect: noFollow},
+		PreferredRegions: map[string][]string{"registry.k8s.io": regions},
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, registry.URL+"/v2/pause/blobs/sha256:ab", nil)
+	resp, err := u.do(req, "registry.k8s.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	want := "prod-registry-k8s-io-us-east-2.s3.dualstack.us-east-2.amazonaws.com"
+	if backendHost != want {
+		t.Fatalf("backing store asked for %q, want %q", backendHost, want)
+	}
+	if got := resp.Header.Get(BackendHeader); got != want {
+		t.Fatalf("%s = %q, want %q", BackendHeader, got, want)
+	}
+
+	// Other registries aren't pinned.
+	req, _ = http.NewRequest(http.MethodGet, registry.URL+"/v2/pause/blobs/sha256:ab", nil)
+	resp, err = u.do(req, "registry.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !strings.Contains(backendHost, "us-west-1") {
+		t.Fatalf("unpinned registry redirected to %q", backendHost)
+	}
+}
+
+func TestParseRegions(t *testing.T) {
+	if _, err := ParseRegions("us-east4+europe-west1"); err == nil {
+		t.Error("expected error for two Artifact Registry regions")
+	}
+	if _, err := ParseRegions("mars-north"); err == nil {
+		t.Error("expected error for an unrecognised region")
+	}
+	if kind, region, ok := backend("us-east4-docker.pkg.dev"); !ok || kind != "artifact-registry" || region != "us-east4" {
+		t.Errorf("backend = %q %q %v", kind, region, ok)
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/health"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// directQueryParam asks for a cached object to be streamed through the
+// proxy instead of redirected to the object store, for clients on networks
+// that can't reach it.
+const directQueryParam = "direct"
+
+// redirectTrackerMax bounds the tracker's maps; past it, expired entries
+// are pruned on insert.
+const redirectTrackerMax = 4096
+
+var redirectFallbacks = metrics.NewCounterVec("oci_redirect_fallback_total",
+	"Cached objects streamed instead of redirected to the object store, by reason (direct, rerequest or disabled).",
+	"reason")
+
+// errRerequested is recorded against redirects when a client comes back
+// for an object it was just redirected for.
+var errRerequested = errors.New("client re-requested an object it was redirected for")
+
+// redirectTracker notices clients that come back for an object they were
+// just redirected for, which is what a client that can't reach the object
+// store does after its redirected fetch fails. Such clients are streamed
+// cached objects for a cooldown rather than sent back to the store.
+// The zero value is ready to use.
+type redirectTracker struct {
+	mu     sync.Mutex
+	sent   map[redirectKey]time.Time // when a client was redirected for a key
+	direct map[netip.Addr]time.Time  // clients streamed until this time
+}
+
+type redirectKey struct {
+	client netip.Addr
+	key    string
+}
+
+// allowRedirect reports whether r may be answered with a redirect. It
+// returns false (and records why) for ?direct=1 requests, while redirects
+// are disabled for everyone, for clients in their cooldown, and for a
+// re-request of key within window of its redirect, which starts the
+// client's cooldown and counts against redirects as a whole.
+func (h *Handler) allowRedirect(r *http.Request, key string) bool {
+	if isTruthy(r.URL.Query().Get(directQueryParam)) {
+		redirectFallbacks.Inc("direct")
+		return false
+	}
+	if !h.Health.Allow(health.RedirectsDisabled) {
+		redirectFallbacks.Inc("disabled")
+		return false
+	}
+	if h.RedirectRetryWindow <= 0 {
+		return true
+	}
+	client, ok := remoteAddr(r)
+	if !ok {
+		return true
+	}
+
+	t := &h.redirects
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until, ok := t.direct[client]; ok {
+		if now.Before(until) {
+			redirectFallbacks.Inc("rerequest")
+			return false
+		}
+		delete(t.direct, client)
+	}
+	rk := redirectKey{client, key}
+	if at, ok := t.sent[rk]; ok && now.Sub(at) < h.RedirectRetryWindow {
+		delete(t.sent, rk)
+		if t.direct == nil {
+			t.direct = make(map[netip.Addr]time.Time)
+		}
+		pruneBefore(t.direct, now)
+		t.direct[client] = now.Add(h.RedirectRetryCooldown)
+		slog.Warn("client re-requested an object it was just redirected for; streaming cached objects to it instead",
+			"client", client, "key", key, "cooldown", h.RedirectRetryCooldown)
+		redirectFallbacks.Inc("rerequest")
+		h.Health.Record(health.RedirectsDisabled, errRerequested)
+		return false
+	}
+	return true
+}
+
+// redirected records that r's client was sent to the object store for key.
+func (h *Handler) redirected(r *http.Request, key string) {
+	if h.RedirectRetryWindow <= 0 {
+		return
+	}
+	client, ok := remoteAddr(r)
+	if !ok {
+		return
+	}
+	t := &h.redirects
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sent == nil {
+		t.sent = make(map[redirectKey]time.Time)
+	}
+	if len(t.sent) >= redirectTrackerMax {
+		for k, at := range t.sent {
+			if now.Sub(at) >= h.RedirectRetryWindow {
+				delete(t.sent, k)
+			}
+		}
+	}
+	t.sent[redirectKey{client, key}] = now
+}
+
+// pruneBefore drops expired cooldowns once the map is large.
+func pruneBefore(m map[netip.Addr]time.Time, now time.Time) {
+	if len(m) < redirectTrackerMax {
+		return
+	}
+	for k, until := range m {
+		if !now.Before(until) {
+			delete(m, k)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/health"
+)
+
+// redirectingStore is a cache that hands out redirects, like the S3 store.
+type redirectingStore struct{ cache.Store }
+
+func (s redirectingStore) RedirectURL(ctx context.Context, key string) (string, cache.ObjectMeta, error) {
+	meta, err := s.Head(ctx, key)
+	return "https://store.invalid/" + key, meta, err
+}
+
+func TestRedirectFallback(t *testing.T) {
+	store := cache.NewFSStore(t.TempDir(), 0)
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	if err := store.Put(context.Background(), cache.BlobKey(digest), strings.NewReader(testBlob), blobMeta()); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		Registry:              "registry.test",
+		Cache:                 redirectingStore{store},
+		Upstream:              &UpstreamClient{Client: http.DefaultClient},
+		RedirectRetryWindow:   time.Minute,
+		RedirectRetryCooldown: time.Hour,
+	}
+	get := func(client, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest+query, nil)
+		req.RemoteAddr = client + ":40000"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	streamed := func(rec *httptest.ResponseRecorder) bool {
+		body, _ := io.ReadAll(rec.Body)
+		return rec.Code == http.StatusOK && string(body) == testBlob
+	}
+
+	if rec := get("192.0.2.1", "?direct=1"); !streamed(rec) {
+		t.Fatalf("?direct=1 should stream, got %d", rec.Code)
+	}
+	if rec := get("192.0.2.1", ""); rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("first request should redirect, got %d", rec.Code)
+	}
+	// Coming straight back means the redirect couldn't be followed.
+	if rec := get("192.0.2.1", ""); !streamed(rec) {
+		t.Fatalf("re-request should stream, got %d", rec.Code)
+	}
+	// The client stays on streaming for its cooldown; others still redirect.
+	if rec := get("192.0.2.1", ""); !streamed(rec) {
+		t.Fatalf("client in cooldown should stream, got %d", rec.Code)
+	}
+	if rec := get("192.0.2.2", ""); rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("other client should redirect, got %d", rec.Code)
+	}
+}
+
+func TestRedirectFallbackForEveryone(t *testing.T) {
+	store := cache.NewFSStore(t.TempDir(), 0)
+	digest := "sha256:" + strings.Repeat("cd", 32)
+	if err := store.Put(context.Background(), cache.BlobKey(digest), strings.NewReader(testBlob), blobMeta()); err != nil {
+		t.Fatal(err)
+	}
+	m := health.NewMonitor(time.Minute, 0.5, 2, 0)
+	m.Cooldowns = map[string]time.Duration{health.RedirectsDisabled: time.Hour}
+	h := &Handler{
+		Registry:              "registry.test",
+		Cache:                 health.Track(redirectingStore{store}, m),
+		Upstream:              &UpstreamClient{Client: http.DefaultClient},
+		Health:                m,
+		RedirectRetryWindow:   time.Minute,
+		RedirectRetryCooldown: time.Hour,
+	}
+	get := func(client string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+		req.RemoteAddr = client + ":40000"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Half of all redirects coming straight back means the object store is
+	// out of reach, not that a few clients are misconfigured.
+	for _, client := range []string{"192.0.2.1", "192.0.2.2"} {
+		if code := get(client); code != http.StatusTemporaryRedirect {
+			t.Fatalf("%s: first request got %d", client, code)
+		}
+		if code := get(client); code != http.StatusOK {
+			t.Fatalf("%s: re-request got %d", client, code)
+		}
+	}
+	if !m.Degraded(health.RedirectsDisabled) {
+		t.Fatal("redirects not disabled")
+	}
+	if code := get("192.0.2.3"); code != http.StatusOK {
+		t.Fatalf("new client during cooldown got %d, want a streamed 200", code)
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/danielloader/oci-pull-through/internal/digest"
+)
+
+// Grammar from the OCI distribution spec. Names and references are
+// validated before they are used in upstream URLs or storage keys, so path
+// segments like ".." or encoded separators can never reach the store.
+// Digests are checked by the digest package.
+var (
+	nameRe = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagRe  = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+// maxNameLength bounds a repository name; the spec recommends registries
+// accept at least 255 characters including the hostname.
+const maxNameLength = 255
+
+// pathError is a parse failure that maps onto an OCI error code.
+type pathError struct {
+	code string
+	msg  string
+}
+
+func (e *pathError) Error() string { return e.msg }
+
+func validName(name string) bool {
+	return len(name) <= maxNameLength && nameRe.MatchString(name)
+}
+
+// validDigest reports whether d is a digest in an algorithm the proxy can
+// verify, well formed for that algorithm.
+func validDigest(d string) bool {
+	return digest.Validate(d) == nil
+}
+
+// validateReference checks a parsed request. Blobs and referrers must be
+// addressed by digest; manifests by tag or digest. Tags only has "list".
+func validateReference(info requestInfo) *pathError {
+	if !validName(info.Name) {
+		return &pathError{"NAME_INVALID", "invalid repository name " + quoteTrunc(info.Name)}
+	}
+	if info.Kind == "tags" {
+		if info.Reference != "list" {
+			return &pathError{"UNSUPPORTED", "unsupported tags endpoint " + quoteTrunc(info.Reference)}
+		}
+		return nil
+	}
+	isDigest := strings.Contains(info.Reference, ":")
+	if info.Kind != "manifests" || isDigest {
+		if err := digest.Validate(info.Reference); err != nil {
+			msg := "invalid digest "
+			if errors.Is(err, digest.ErrUnsupported) {
+				msg = "unsupported digest algorithm in "
+			}
+			return &pathError{"DIGEST_INVALID", msg + quoteTrunc(info.Reference)}
+		}
+		return nil
+	}
+	if !tagRe.MatchString(info.Reference) {
+		return &pathError{"MANIFEST_INVALID", "invalid tag " + quoteTrunc(info.Reference)}
+	}
+	return nil
+}
+
+// quoteTrunc quotes s for an error message, truncating long input.
+func quoteTrunc(s string) string {
+	if len(s) > 128 {
+		s = s[:128] + "..."
+	}
+	return `"` + s + `"`
+}
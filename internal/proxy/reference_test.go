@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		name     string
+		info     requestInfo
+		wantCode string
+	}{
+		{name: "tag", info: requestInfo{Name: "org/image", Kind: "manifests", Reference: "v1.2.3"}},
+		{name: "digest manifest", info: requestInfo{Name: "org/image", Kind: "manifests", Reference: digest}},
+		{name: "blob", info: requestInfo{Name: "my-org/sub_repo/x.y", Kind: "blobs", Reference: digest}},
+		{name: "sha512", info: requestInfo{Name: "a", Kind: "blobs", Reference: "sha512:" + strings.Repeat("ab", 64)}},
+		{name: "unsupported algorithm", info: requestInfo{Name: "a", Kind: "blobs", Reference: "blake3:" + strings.Repeat("a", 64)}, wantCode: "DIGEST_INVALID"},
+		{name: "dotdot segment", info: requestInfo{Name: "org/../../etc", Kind: "manifests", Reference: "latest"}, wantCode: "NAME_INVALID"},
+		{name: "dot segment", info: requestInfo{Name: "org/./image", Kind: "manifests", Reference: "latest"}, wantCode: "NAME_INVALID"},
+		{name: "uppercase", info: requestInfo{Name: "Org/Image", Kind: "manifests", Reference: "latest"}, wantCode: "NAME_INVALID"},
+		{name: "empty segment", info: requestInfo{Name: "org//image", Kind: "manifests", Reference: "latest"}, wantCode: "NAME_INVALID"},
+		{name: "backslash", info: requestInfo{Name: `org\..\image`, Kind: "manifests", Reference: "latest"}, wantCode: "NAME_INVALID"},
+		{name: "too long", info: requestInfo{Name: strings.Repeat("a", 256), Kind: "manifests", Reference: "latest"}, wantCode: "NAME_INVALID"},
+		{name: "tag with slash", info: requestInfo{Name: "org/image", Kind: "manifests", Reference: "../../x"}, wantCode: "MANIFEST_INVALID"},
+		{name: "tag leading dot", info: requestInfo{Name: "org/image", Kind: "manifests", Reference: ".."}, wantCode: "MANIFEST_INVALID"},
+		{name: "blob by tag", info: requestInfo{Name: "org/image", Kind: "blobs", Reference: "latest"}, wantCode: "DIGEST_INVALID"},
+		{name: "short sha256", info: requestInfo{Name: "org/image", Kind: "blobs", Reference: "sha256:abc"}, wantCode: "DIGEST_INVALID"},
+		{name: "uppercase hex", info: requestInfo{Name: "org/image", Kind: "blobs", Reference: "sha256:" + strings.Repeat("AB", 32)}, wantCode: "DIGEST_INVALID"},
+		{name: "digest traversal", info: requestInfo{Name: "org/image", Kind: "manifests", Reference: "sha256:../../x"}, wantCode: "DIGEST_INVALID"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perr := validateReference(tt.info)
+			switch {
+			case tt.wantCode == "" && perr != nil:
+				t.Fatalf("unexpected error: %v", perr)
+			case tt.wantCode != "" && perr == nil:
+				t.Fatalf("expected %s, got nil", tt.wantCode)
+			case tt.wantCode != "" && perr.code != tt.wantCode:
+				t.Fatalf("expected %s, got %s", tt.wantCode, perr.code)
+			}
+		})
+	}
+}
+
+func TestTraversalRejectedBeforeStore(t *testing.T) {
+	store := &mockStore{}
+	h := &Handler{Registry: "registry.example.com", Cache: store, Upstream: NewUpstreamClient(nil)}
+
+	for _, p := range []string{
+		"/v2/org/../../../etc/manifests/latest",
+		"/v2/org/%2e%2e/%2e%2e/etc/manifests/latest",
+		"/v2/org/image/blobs/sha256:..%2f..%2fx",
+	} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", p, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/health"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+	"github.com/danielloader/oci-pull-through/internal/recovery"
+)
+
+// revalidateTimeout bounds a background tag revalidation.
+const revalidateTimeout = 30 * time.Second
+
+var (
+	tagRevalidations = metrics.NewCounterVec("oci_tag_revalidations_total",
+		"Background revalidations of cached tag manifests, by result (unchanged, updated, error).", "result")
+	tagStaleServed = metrics.NewCounterVec("oci_tag_stale_served_total",
+		"Cached tag manifests served past TAG_MANIFEST_TTL while a revalidation runs.", "registry")
+	tagStaleIfError = metrics.NewCounterVec("oci_tag_stale_if_error_total",
+		"Cached tag manifests served because the upstream fetch failed (TAG_STALE_IF_ERROR).", "registry")
+)
+
+// errTagExpired turns a cached tag past its maximum staleness into a miss.
+var errTagExpired = errors.New("cached tag manifest is past its maximum staleness")
+
+type tagFreshness int
+
+const (
+	tagFresh tagFreshness = iota
+	tagStale
+	tagExpired
+)
+
+// tagFreshness classifies a cached copy of info. Only tag manifests age;
+// everything else, and every tag whose TTL is zero, is always fresh. A
+// tag's age counts from when it was stored (its Date header) or last
+// confirmed unchanged upstream, whichever is later.
+func (h *Handler) tagFreshness(info requestInfo, key string, meta cache.ObjectMeta) tagFreshness {
+	if !info.isTagManifest() {
+		return tagFresh
+	}
+	p := h.tagPolicy(info)
+	if p.ttl <= 0 || (h.Pinned != nil && h.Pinned(key)) {
+		return tagFresh
+	}
+	validated, _ := http.ParseTime(meta.Header.Get("Date"))
+	if t, ok := h.tagValidated.Load(key); ok && t.(time.Time).After(validated) {
+		validated = t.(time.Time)
+	}
+	age := time.Since(validated)
+	switch {
+	case age <= p.ttl:
+		return tagFresh
+	case p.maxStale > 0 && age > p.ttl+p.maxStale:
+		return tagExpired
+	}
+	return tagStale
+}
+
+// usableCached reports whether a cached copy of info may be served. A
+// stale tag is served and revalidated in the background; an expired one
+// must be fetched from upstream first, unless upstream is down.
+func (h *Handler) usableCached(r *http.Request, info requestInfo, key string, meta cache.ObjectMeta) bool {
+	f := h.tagFreshness(info, key, meta)
+	if f == tagExpired && (h.Health.Degraded(health.StaleOnly) || h.Upstream.Freeze.Frozen(info.Registry)) {
+		f = tagStale // fetching first would only fail
+	}
+	switch f {
+	case tagFresh:
+		h.countCohort(info, "hit")
+	case tagStale:
+		h.countCohort(info, "stale")
+		tagStaleServed.Inc(info.Registry)
+		h.revalidate(r, info, key, meta.DockerContentDigest)
+	case tagExpired:
+		slog.Debug("cached tag past maximum staleness", "image", info.image(), "tag", info.Reference)
+		return false
+	}
+	return true
+}
+
+// revalidate refreshes a cached tag in the background, at most once at a
+// time per key. The client's Authorization header is reused so registries
+// that require a token can still be asked.
+func (h *Handler) revalidate(r *http.Request, info requestInfo, key, cachedDigest string) {
+	if h.Upstream.Freeze.Frozen(info.Registry) {
+		return
+	}
+	if _, busy := h.tagRevalidating.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	recovery.Go("tag-revalidation", func() {
+		defer h.tagRevalidating.Delete(key)
+		ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+		defer cancel()
+		result, err := h.refreshTag(ctx, info, key, cachedDigest, auth)
+		if err != nil {
+			slog.Warn("tag revalidation failed, keeping cached copy", "image", info.image(), "tag", info.Reference, "error", err)
+			result = "error"
+		}
+		tagRevalidations.Inc(result)
+	})
+}
+
+// refreshTag asks upstream for the tag's current digest and, if it moved,
+// replaces the cached copy. A HEAD is enough to confirm an unchanged tag
+// except when indexes are flattened, where the served digest depends on
+// the body.
+func (h *Handler) refreshTag(ctx context.Context, info requestInfo, key, cachedDigest, auth string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "/", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", warmAccept)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	if !h.flattens(info) {
+		resp, err := h.Upstream.Do(req, info)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("upstream HEAD returned %d", resp.StatusCode)
+		}
+		if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d == cachedDigest {
+			h.tagValidated.Store(key, time.Now())
+			return "unchanged", nil
+		}
+	}
+
+	req.Method = http.MethodGet
+	resp, err := h.Upstream.Do(req, info)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream GET returned %d", resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if isSchema1(contentType) && h.Schema1Policy == Schema1Reject {
+		return "", errors.New("upstream now serves a schema 1 manifest")
+	}
+	h.observeTag(ctx, info, resp)
+
+	release, ok := h.reserveManifest(resp)
+	if !ok {
+		memoryShed.Inc("manifest")
+		return "", errors.New("buffered bytes at limit")
+	}
+	defer release()
+
+	var body []byte
+	var digest string
+	if h.flattens(info) && isIndex(contentType) {
+		body, digest, contentType, err = h.flattenResponse(ctx, info, key, resp)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		limit := h.MaxManifestSize
+		if limit <= 0 {
+			limit = DefaultMaxManifestSize
+		}
+		body, err = io.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if err != nil {
+			return "", err
+		}
+		if int64(len(body)) > limit {
+			return "", fmt.Errorf("manifest is over the %d byte limit", limit)
+		}
+		if digest = resp.Header.Get("Docker-Content-Digest"); digest == "" {
+			sum := sha256.Sum256(body)
+			digest = "sha256:" + hex.EncodeToString(sum[:])
+		}
+	}
+
+	if digest == cachedDigest {
+		h.tagValidated.Store(key, time.Now())
+		return "unchanged", nil
+	}
+	// Stores are create-if-absent, so the old copy has to go first.
+	// Requests in the gap miss and fetch from upstream themselves.
+	if err := h.Cache.Delete(ctx, key); err != nil {
+		return "", fmt.Errorf("removing old copy: %w", err)
+	}
+	if err := h.Cache.Put(ctx, key, bytes.NewReader(body), manifestMeta(contentType, digest, len(body))); err != nil {
+		return "", fmt.Errorf("storing new copy: %w", err)
+	}
+	h.tagValidated.Delete(key)
+	slog.Info("revalidated tag moved", "image", info.image(), "tag", info.Reference, "from", cachedDigest, "to", digest)
+	return "updated", nil
+}
+
+// revalidateNotModified uses an upstream 304, answered to a client's
+// conditional request that missed the cache, to confirm the cached copy of
+// a tag is still current: when the digest upstream vouched for is the one
+// cached, the copy is marked validated instead of waiting for a refetch.
+func (h *Handler) revalidateNotModified(ctx context.Context, info requestInfo, key string, resp *http.Response) {
+	if !info.isTagManifest() || !h.shouldCache(info) || h.flattens(info) {
+		return
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		// Registries use the manifest digest as its ETag.
+		digest = strings.Trim(strings.TrimPrefix(resp.Header.Get("ETag"), "W/"), `"`)
+	}
+	if !strings.Contains(digest, ":") {
+		return
+	}
+	meta, err := h.Cache.Head(ctx, key)
+	if err != nil || meta.DockerContentDigest != digest {
+		return
+	}
+	h.tagValidated.Store(key, time.Now())
+	tagRevalidations.Inc("unchanged")
+	slog.Debug("upstream 304 revalidated cached tag", "image", info.image(), "tag", info.Reference, "digest", digest)
+}
+
+// keepsTagFallback reports whether a tag manifest that isn't cached for
+// serving is still stored, as the copy TagStaleIfError falls back on.
+func (h *Handler) keepsTagFallback(info requestInfo) bool {
+	return h.TagStaleIfError && info.isTagManifest() && !h.shouldCache(info)
+}
+
+// replaceTagFallback clears the way for storing resp as the fallback copy
+// of a tag, reporting whether it should be stored: a copy of the same
+// digest is kept rather than rewritten on every pull.
+func (h *Handler) replaceTagFallback(ctx context.Context, key string, resp *http.Response) bool {
+	if meta, err := h.Cache.Head(ctx, key); err == nil {
+		if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d == meta.DockerContentDigest {
+			return false
+		}
+	}
+	if err := h.Cache.Delete(ctx, key); err != nil {
+		slog.Debug("removing old tag fallback failed", "key", key, "error", err)
+	}
+	return true
+}
+
+// serveStaleTag answers a tag manifest request that upstream failed
+// (an error, or a 5xx status) with the cached copy of the tag, however
+// old, when TagStaleIfError is set. It reports whether it answered.
+func (h *Handler) serveStaleTag(w http.ResponseWriter, r *http.Request, info requestInfo, key string, cause error) bool {
+	if !h.TagStaleIfError || !info.isTagManifest() {
+		return false
+	}
+	// The request's own budget may be what ran out upstream.
+	result, err := h.Cache.GetWithMeta(context.WithoutCancel(r.Context()), key)
+	if err != nil {
+		return false
+	}
+	defer result.Body.Close()
+	if !acceptable(r, info, result.Meta.ContentType) {
+		return false
+	}
+	if h.rejectSchema1(w, info, result.Meta.ContentType) {
+		return true
+	}
+	tagStaleIfError.Inc(info.Registry)
+	slog.Warn("upstream failed, serving cached tag", "image", info.image(), "tag", info.Reference,
+		"digest", result.Meta.DockerContentDigest, "error", cause)
+	replayStoredHeaders(w, result.Meta)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	if seeker, ok := result.Body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, seeker)
+		return true
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := copyToClient(w, result.Body); err != nil {
+		slog.Debug("error streaming cached tag", "error", err)
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestStaleTagServedWhileRevalidating(t *testing.T) {
+	digestOf := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	var current atomic.Value
+	current.Store(`{"schemaVersion":2,"v":1}`)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := current.Load().(string)
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Docker-Content-Digest", digestOf(body))
+		if r.Method == http.MethodGet {
+			io.WriteString(w, body)
+		}
+	}))
+	defer upstream.Close()
+
+	store := cache.NewFSStore(t.TempDir(), 0)
+	h := &Handler{
+		Registry:          strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:             store,
+		Upstream:          &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		CacheTagManifests: true,
+		TagTTL:            time.Nanosecond,
+	}
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/org/app/manifests/v1", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+	key := h.storageKey(requestInfo{Registry: h.Registry, Name: "org/app", Kind: "manifests", Reference: "v1"})
+	cachedDigest := func() string {
+		meta, err := store.Head(context.Background(), key)
+		if err != nil {
+			return ""
+		}
+		return meta.DockerContentDigest
+	}
+
+	if got := get(); !strings.Contains(got, `"v":1`) {
+		t.Fatalf("first pull served %s", got)
+	}
+
+	// The tag moves: the stale copy is served, then replaced in the background.
+	current.Store(`{"schemaVersion":2,"v":2}`)
+	if got := get(); !strings.Contains(got, `"v":1`) {
+		t.Fatalf("expected the stale copy, got %s", got)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cachedDigest() != digestOf(current.Load().(string)) {
+		if time.Now().After(deadline) {
+			t.Fatal("cache was not revalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		if _, busy := h.tagRevalidating.Load(key); !busy {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Past the maximum staleness the new tag is fetched before answering.
+	h.TagMaxStale = time.Nanosecond
+	current.Store(`{"schemaVersion":2,"v":3}`)
+	if got := get(); !strings.Contains(got, `"v":3`) {
+		t.Fatalf("expected a synchronous refresh, got %s", got)
+	}
+	if cachedDigest() != digestOf(current.Load().(string)) {
+		t.Fatal("expired copy was not replaced in the cache")
+	}
+}
+
+func TestConditionalMissRevalidatesTag(t *testing.T) {
+	const body = `{"schemaVersion":2,"v":1}`
+	sum := sha256.Sum256([]byte(body))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	var gets, conditionals atomic.Int32
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("ETag", `"`+digest+`"`)
+		if r.Header.Get("If-None-Match") == `"`+digest+`"` {
+			conditionals.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		gets.Add(1)
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+
+	store := cache.NewFSStore(t.TempDir(), 0)
+	h := &Handler{
+		Registry:          strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:             store,
+		Upstream:          &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		CacheTagManifests: true,
+		TagTTL:            time.Hour,
+		TagMaxStale:       time.Minute,
+	}
+	key := h.storageKey(requestInfo{Registry: h.Registry, Name: "org/app", Kind: "manifests", Reference: "v1"})
+
+	// A copy cached long enough ago to be past its maximum staleness.
+	meta := manifestMeta("application/vnd.oci.image.manifest.v1+json", digest, len(body))
+	meta.Header.Set("Date", time.Now().Add(-2*time.Hour).UTC().Format(http.TimeFormat))
+	if err := store.Put(context.Background(), key, strings.NewReader(body), meta); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/org/app/manifests/v1", nil)
+	req.Header.Set("If-None-Match", `"`+digest+`"`)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || conditionals.Load() != 1 {
+		t.Fatalf("conditional request: got %d, %d conditional upstream requests", rec.Code, conditionals.Load())
+	}
+
+	// Upstream's 304 vouched for the cached digest, so the copy is fresh again.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/org/app/manifests/v1", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != body || gets.Load() != 0 {
+		t.Fatalf("after revalidation: got %d %q with %d upstream GETs", rec.Code, rec.Body, gets.Load())
+	}
+}
+
+func TestTagServedStaleIfUpstreamFails(t *testing.T) {
+	var down atomic.Bool
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		io.WriteString(w, `{"schemaVersion":2,"v":1}`)
+	}))
+	defer upstream.Close()
+
+	// Tags aren't cached for serving; a copy is kept only to fall back on.
+	h := &Handler{
+		Registry:        strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:           cache.NewFSStore(t.TempDir(), 0),
+		Upstream:        &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		TagStaleIfError: true,
+	}
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/v2/org/app/manifests/v1"); rec.Code != http.StatusOK {
+		t.Fatalf("first pull: got %d", rec.Code)
+	}
+
+	down.Store(true)
+	rec := do(http.MethodGet, "/v2/org/app/manifests/v1")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"v":1`) {
+		t.Fatalf("upstream 503: got %d %s, want the cached copy", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Warning") == "" {
+		t.Error("stale response carries no Warning header")
+	}
+	if rec := do(http.MethodHead, "/v2/org/app/manifests/v1"); rec.Code != http.StatusOK {
+		t.Errorf("HEAD with upstream 503: got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/v2/org/app/manifests/v2"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("uncached tag: got %d, want upstream's 503", rec.Code)
+	}
+
+	// Unreachable upstream.
+	upstream.Close()
+	if rec := do(http.MethodGet, "/v2/org/app/manifests/v1"); rec.Code != http.StatusOK {
+		t.Fatalf("unreachable upstream: got %d", rec.Code)
+	}
+
+	h.TagStaleIfError = false
+	if rec := do(http.MethodGet, "/v2/org/app/manifests/v1"); rec.Code != http.StatusBadGateway {
+		t.Errorf("without TagStaleIfError: got %d, want 502", rec.Code)
+	}
+}
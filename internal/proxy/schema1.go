@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// Schema1Policy controls how Docker schema 1 manifests from upstream are
+// handled. Newer containerd releases refuse to pull them.
+type Schema1Policy string
+
+const (
+	// Schema1Passthrough serves and caches schema 1 manifests untouched.
+	Schema1Passthrough Schema1Policy = "passthrough"
+	// Schema1Reject answers schema 1 manifests with an OCI UNSUPPORTED
+	// error instead of the manifest, so clients fail with a clear reason
+	// rather than an opaque parse error.
+	Schema1Reject Schema1Policy = "reject"
+)
+
+// isSchema1 reports whether a Content-Type is a Docker schema 1 manifest.
+func isSchema1(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch mt {
+	case manifest.MediaTypeSchema1, manifest.MediaTypeSchema1Signed:
+		return true
+	}
+	return false
+}
+
+// rejectSchema1 writes an UNSUPPORTED error and returns true if the policy
+// rejects schema 1 and the manifest is one.
+func (h *Handler) rejectSchema1(w http.ResponseWriter, info requestInfo, contentType string) bool {
+	if h.Schema1Policy != Schema1Reject || info.Kind != "manifests" || !isSchema1(contentType) {
+		return false
+	}
+	slog.Info("rejected schema 1 manifest", "image", info.image(), "ref", info.shortRef())
+	writeOCIError(w, http.StatusUnsupportedMediaType, "UNSUPPORTED",
+		"image "+info.image()+":"+info.Reference+" uses a Docker schema 1 manifest, which this mirror does not serve; rebuild or re-push it with a schema 2 or OCI manifest")
+	return true
+}
+
+// rejectSchema1Response is rejectSchema1 for a manifest fetched from
+// upstream. Some registries serve schema 1 as plain JSON, so a manifest
+// served as application/json, or with no Content-Type, is also checked for
+// schemaVersion 1 in its body, which is put back in front of resp.Body.
+// HEAD responses and cached copies carry no body to check and go by their
+// Content-Type alone.
+func (h *Handler) rejectSchema1Response(w http.ResponseWriter, info requestInfo, resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	if h.Schema1Policy == Schema1Reject && info.Kind == "manifests" && isPlainJSON(contentType) &&
+		sniffSchemaVersion(resp) == 1 {
+		contentType = manifest.MediaTypeSchema1
+	}
+	return h.rejectSchema1(w, info, contentType)
+}
+
+// isPlainJSON reports whether a Content-Type names no manifest type.
+func isPlainJSON(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "" || mt == "application/json" || mt == "text/plain"
+}
+
+// sniffSchemaVersion returns the schemaVersion of a manifest body, or 0 if
+// it can't be read within manifest.DefaultMaxSize. What was read is put
+// back in front of resp.Body.
+func sniffSchemaVersion(resp *http.Response) int {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, manifest.DefaultMaxSize+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil || len(body) > manifest.DefaultMaxSize {
+		return 0
+	}
+	var doc struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if json.Unmarshal(body, &doc) != nil {
+		return 0
+	}
+	return doc.SchemaVersion
+}
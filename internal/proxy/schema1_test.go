@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+func TestSchema1Policy(t *testing.T) {
+	const (
+		schema1 = `{"schemaVersion":1,"name":"org/app","tag":"v1","fsLayers":[]}`
+		schema2 = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	)
+	// Manifests by tag name their body and the Content-Type to serve it as.
+	manifests := map[string]struct{ body, contentType string }{
+		"typed":       {schema1, manifest.MediaTypeSchema1},
+		"signed":      {schema1, manifest.MediaTypeSchema1Signed + "; charset=utf-8"},
+		"plain":       {schema1, "application/json"},
+		"untyped":     {schema1, ""},
+		"plain-v2":    {schema2, "application/json"},
+		"schema2":     {schema2, "application/vnd.oci.image.manifest.v1+json"},
+		"mislabelled": {schema2, manifest.MediaTypeSchema1},
+	}
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m, ok := manifests[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header()["Content-Type"] = []string{m.contentType}
+		io.WriteString(w, m.body)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		tag        string
+		policy     Schema1Policy
+		wantReject bool
+	}{
+		{"typed", Schema1Reject, true},
+		{"signed", Schema1Reject, true},
+		{"plain", Schema1Reject, true},
+		{"untyped", Schema1Reject, true},
+		{"plain-v2", Schema1Reject, false},
+		{"schema2", Schema1Reject, false},
+		{"mislabelled", Schema1Reject, true}, // the Content-Type is trusted
+		{"typed", Schema1Passthrough, false},
+		{"plain", Schema1Passthrough, false},
+		{"typed", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag+"/"+string(tt.policy), func(t *testing.T) {
+			h := &Handler{
+				Registry:      strings.TrimPrefix(upstream.URL, "https://"),
+				Cache:         cache.NewFSStore(t.TempDir(), 0),
+				Upstream:      &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+				Schema1Policy: tt.policy,
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/org/app/manifests/"+tt.tag, nil))
+			if tt.wantReject {
+				if rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Body.String(), "UNSUPPORTED") ||
+					!strings.Contains(rec.Body.String(), "schema 1") {
+					t.Errorf("got %d %s, want 415 UNSUPPORTED", rec.Code, rec.Body)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK || rec.Body.String() != manifests[tt.tag].body {
+				t.Errorf("got %d %q, want the manifest untouched", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestSchema1RejectsCachedCopies(t *testing.T) {
+	const body = `{"schemaVersion":1,"name":"org/app","tag":"v1","fsLayers":[]}`
+	sum := sha256.Sum256([]byte(body))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	var fetches int
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", manifest.MediaTypeSchema1)
+		w.Header().Set("Docker-Content-Digest", digest)
+		io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+
+	h := &Handler{
+		Registry:      strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:         cache.NewFSStore(t.TempDir(), 0),
+		Upstream:      &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		Schema1Policy: Schema1Passthrough,
+	}
+	serve := func(method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/v2/org/app/manifests/"+digest, nil))
+		return rec
+	}
+
+	if rec := serve(http.MethodGet); rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Fatalf("passthrough: got %d %q", rec.Code, rec.Body)
+	}
+
+	// Switching to reject applies to what passthrough cached.
+	h.Schema1Policy = Schema1Reject
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if rec := serve(method); rec.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s cached copy: got %d, want 415", method, rec.Code)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("%d upstream fetches, want the cached copy used", fetches)
+	}
+}
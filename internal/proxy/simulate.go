@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// Simulation is what pulling an image through the cache would do, worked
+// out without pulling it: which objects would be served from the cache
+// and which fetched upstream.
+type Simulation struct {
+	Image string `json:"image"`
+	// Auth says whose credentials go upstream: "proxy" when the proxy
+	// holds the registry's, "client" when the caller's would be
+	// forwarded, or "anonymous".
+	Auth    string            `json:"auth"`
+	Objects []SimulatedObject `json:"objects"`
+	// CachedBytes and UpstreamBytes total the objects the cache would
+	// serve and those it would fetch.
+	CachedBytes   int64 `json:"cached_bytes"`
+	UpstreamBytes int64 `json:"upstream_bytes"`
+}
+
+// SimulatedObject is one manifest or blob of a simulated pull.
+type SimulatedObject struct {
+	Kind      string `json:"kind"`      // "manifest" or "blob"
+	Reference string `json:"reference"` // tag or digest as a client would request it
+	Digest    string `json:"digest,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
+	Size      int64  `json:"size"`
+	// Status is "cached", "stale" (served while the tag is revalidated),
+	// "miss" (fetched upstream and cached), "expired" (a tag past its
+	// maximum staleness, fetched again), "uncached" (fetched upstream on
+	// every pull, by policy) or "failed".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Simulate walks the pull of image as Warm does, without filling the
+// cache. Cached objects are only inspected; manifests that would come from
+// upstream are fetched but not stored, so their layers can be listed, and
+// blob sizes are taken from the manifests. platform ("os/arch[/variant]"),
+// if set, follows only that entry of an index, as a client pull would.
+// authorization is forwarded upstream like a client's header.
+func (h *Handler) Simulate(ctx context.Context, image, platform, authorization string) (*Simulation, error) {
+	info, err := h.imageRequest(image)
+	if err != nil {
+		return nil, err
+	}
+	s := &simulator{h: h, auth: authorization, seen: make(map[string]bool), sim: &Simulation{Image: image, Objects: []SimulatedObject{}}}
+	if platform != "" {
+		ps, err := ParsePlatforms([]string{platform})
+		if err != nil {
+			return nil, err
+		}
+		s.platform = &ps[0]
+	}
+	switch {
+	case h.Upstream.ProxyManagedAuth(info.Registry):
+		s.sim.Auth = "proxy"
+	case authorization != "":
+		s.sim.Auth = "client"
+	default:
+		s.sim.Auth = "anonymous"
+	}
+	if p := h.policy(); info.isTagManifest() && len(p.DigestPinned) > 0 && cache.MatchRepository(p.DigestPinned, info.Name) {
+		s.add(SimulatedObject{Kind: "manifest", Reference: info.Reference, Status: "failed",
+			Error: "repository " + info.Name + " only allows pulls by digest"})
+		return s.sim, nil
+	}
+	s.manifest(ctx, info, true)
+	return s.sim, nil
+}
+
+type simulator struct {
+	h        *Handler
+	auth     string
+	platform *Platform
+	seen     map[string]bool // blobs already listed
+	sim      *Simulation
+}
+
+func (s *simulator) add(o SimulatedObject) {
+	switch o.Status {
+	case "cached", "stale":
+		s.sim.CachedBytes += o.Size
+	case "miss", "expired", "uncached":
+		s.sim.UpstreamBytes += o.Size
+	}
+	s.sim.Objects = append(s.sim.Objects, o)
+}
+
+// manifest simulates a manifest and everything it references. Only the
+// top-level manifest may recurse into an index's children.
+func (s *simulator) manifest(ctx context.Context, info requestInfo, top bool) {
+	obj := SimulatedObject{Kind: "manifest", Reference: info.Reference}
+	body, err := s.manifestBody(ctx, info, &obj)
+	if err != nil {
+		obj.Status, obj.Error = "failed", err.Error()
+		s.add(obj)
+		return
+	}
+	s.add(obj)
+
+	m, err := manifest.Parse(body)
+	if err != nil {
+		return // not an OCI or Docker v2 manifest; nothing more to follow
+	}
+	if top {
+		for _, child := range m.Manifests {
+			if ctx.Err() != nil {
+				return
+			}
+			if s.platform != nil && (child.Platform == nil ||
+				!s.platform.matches(child.Platform.OS, child.Platform.Architecture, child.Platform.Variant)) {
+				continue
+			}
+			s.manifest(ctx, requestInfo{Registry: info.Registry, Name: info.Name, Kind: "manifests", Reference: child.Digest}, false)
+		}
+	}
+	for _, d := range m.Blobs() {
+		if ctx.Err() != nil {
+			return
+		}
+		s.blob(ctx, info, d)
+	}
+}
+
+// manifestBody reads a manifest from the cache when a pull would be
+// served from it, and from upstream otherwise, filling in obj.
+func (s *simulator) manifestBody(ctx context.Context, info requestInfo, obj *SimulatedObject) ([]byte, error) {
+	limit := max(s.h.MaxManifestSize, DefaultMaxManifestSize)
+	key := s.h.storageKey(info)
+	obj.Status = "uncached"
+	if s.h.shouldCache(info) {
+		obj.Status = "miss"
+		if res, err := s.h.Cache.GetWithMeta(ctx, key); err == nil {
+			defer res.Body.Close()
+			switch s.h.tagFreshness(info, key, res.Meta) {
+			case tagFresh:
+				obj.Status = "cached"
+			case tagStale:
+				obj.Status = "stale"
+			case tagExpired:
+				obj.Status = "expired"
+			}
+			if obj.Status != "expired" {
+				body, err := io.ReadAll(io.LimitReader(res.Body, limit))
+				if err != nil {
+					return nil, err
+				}
+				obj.MediaType = res.Meta.ContentType
+				obj.Digest = res.Meta.DockerContentDigest
+				if obj.Digest == "" && !info.isTagManifest() {
+					obj.Digest = info.Reference
+				}
+				obj.Size = int64(len(body))
+				return body, nil
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", warmAccept)
+	if s.auth != "" {
+		req.Header.Set("Authorization", s.auth)
+	}
+	resp, err := s.h.Upstream.Do(req, info)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, errors.New("upstream requires authorization")
+	default:
+		return nil, fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, err
+	}
+	obj.MediaType = resp.Header.Get("Content-Type")
+	obj.Digest = resp.Header.Get("Docker-Content-Digest")
+	if obj.Digest == "" {
+		sum := sha256.Sum256(body)
+		obj.Digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	obj.Size = int64(len(body))
+	return body, nil
+}
+
+// blob checks whether d is cached. Blobs shared by several manifests are
+// listed once, as a pull fetches them once.
+func (s *simulator) blob(ctx context.Context, info requestInfo, d manifest.Descriptor) {
+	if s.seen[d.Digest] {
+		return
+	}
+	s.seen[d.Digest] = true
+	obj := SimulatedObject{Kind: "blob", Reference: d.Digest, Digest: d.Digest, MediaType: d.MediaType, Size: d.Size}
+	if !validDigest(d.Digest) {
+		obj.Status, obj.Error = "failed", "invalid digest"
+		s.add(obj)
+		return
+	}
+	blob := requestInfo{Registry: info.Registry, Name: info.Name, Kind: "blobs", Reference: d.Digest}
+	obj.Status = "miss"
+	if meta, err := s.h.Cache.Head(ctx, s.h.storageKey(blob)); err == nil {
+		obj.Status = "cached"
+		if meta.ContentLength > 0 {
+			obj.Size = meta.ContentLength
+		}
+	}
+	s.add(obj)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestSimulateDoesNotFill(t *testing.T) {
+	digestOf := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	config, layer := `{"architecture":"amd64"}`, "layer-bytes"
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+		`"config":{"digest":%q,"size":%d},"layers":[{"digest":%q,"size":%d}]}`,
+		digestOf(config), len(config), digestOf(layer), len(layer))
+	var blobFetches atomic.Int32
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/org/app/manifests/v1" {
+			blobFetches.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Docker-Content-Digest", digestOf(manifest))
+		fmt.Fprint(w, manifest)
+	}))
+	defer upstream.Close()
+
+	store := cache.NewFSStore(t.TempDir(), 0)
+	registry := strings.TrimPrefix(upstream.URL, "https://")
+	h := &Handler{
+		Registry:          registry,
+		Cache:             store,
+		Upstream:          &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		CacheTagManifests: true,
+	}
+	configKey := h.storageKey(requestInfo{Registry: registry, Name: "org/app", Kind: "blobs", Reference: digestOf(config)})
+	if err := store.Put(context.Background(), configKey, strings.NewReader(config), cache.ObjectMeta{ContentLength: int64(len(config))}); err != nil {
+		t.Fatal(err)
+	}
+
+	sim, err := h.Simulate(context.Background(), registry+"/org/app:v1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ kind, status string }{{"manifest", "miss"}, {"blob", "cached"}, {"blob", "miss"}}
+	if len(sim.Objects) != len(want) {
+		t.Fatalf("got %+v", sim.Objects)
+	}
+	for i, w := range want {
+		if o := sim.Objects[i]; o.Kind != w.kind || o.Status != w.status {
+			t.Errorf("object %d: got %s %s (%s), want %s %s", i, o.Kind, o.Status, o.Error, w.kind, w.status)
+		}
+	}
+	if sim.Objects[0].Digest != digestOf(manifest) || sim.Auth != "anonymous" {
+		t.Errorf("unexpected simulation %+v", sim)
+	}
+	if sim.CachedBytes != int64(len(config)) || sim.UpstreamBytes != int64(len(manifest)+len(layer)) {
+		t.Errorf("cached %d, upstream %d", sim.CachedBytes, sim.UpstreamBytes)
+	}
+	if n := blobFetches.Load(); n != 0 {
+		t.Errorf("simulation fetched %d blobs upstream", n)
+	}
+	manifestKey := h.storageKey(requestInfo{Registry: registry, Name: "org/app", Kind: "manifests", Reference: "v1"})
+	if _, err := store.Head(context.Background(), manifestKey); err == nil {
+		t.Error("simulation cached the manifest")
+	}
+
+	if _, err := h.Simulate(context.Background(), registry+"/org/app:v1", "linux", ""); err == nil {
+		t.Error("expected an error for a malformed platform")
+	}
+}
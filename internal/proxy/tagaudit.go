@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// observeTag feeds the digest an upstream returned for a tag to the tag
+// audit log. A cached copy of the tag, if any, provides the baseline after
+// a restart.
+func (h *Handler) observeTag(ctx context.Context, info requestInfo, resp *http.Response) {
+	if h.TagAudit == nil || !info.isTagManifest() || resp.StatusCode != http.StatusOK {
+		return
+	}
+	var previous func() string
+	if h.shouldCache(info) {
+		previous = func() string {
+			meta, err := h.Cache.Head(ctx, h.storageKey(info))
+			if err != nil {
+				return ""
+			}
+			return meta.DockerContentDigest
+		}
+	}
+	h.TagAudit.Observe(info.Registry, info.Name, info.Reference, resp.Header.Get("Docker-Content-Digest"), previous)
+}
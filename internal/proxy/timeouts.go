@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Timeouts are end-to-end budgets, covering the upstream round trip and the
+// response to the client, for each class of request. Zero leaves a class
+// unbounded.
+type Timeouts struct {
+	// Short covers /v2/ checks, HEADs, referrers and tag listings: requests
+	// with no body worth waiting for.
+	Short time.Duration
+	// Manifest covers manifest GETs.
+	Manifest time.Duration
+	// Blob covers blob GETs, which can legitimately stream for a long time.
+	Blob time.Duration
+}
+
+// forRequest returns the budget for a registry request.
+func (t Timeouts) forRequest(method string, info requestInfo) time.Duration {
+	switch {
+	case method == http.MethodHead || info.Kind == "referrers" || info.Kind == "tags":
+		return t.Short
+	case info.Kind == "manifests":
+		return t.Manifest
+	}
+	return t.Blob
+}
+
+// withBudget bounds r's context by d, if positive.
+func withBudget(r *http.Request, d time.Duration) (*http.Request, context.CancelFunc) {
+	if d <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	return r.WithContext(ctx), cancel
+}
+
+// writeUpstreamError answers a failed upstream request: 504 when the
+// request's budget ran out, 429 past a hard transfer cap, 503 when the
+// registry is frozen, 502 otherwise.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	if capErr := (*TransferCapError)(nil); errors.As(err, &capErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(time.Until(capErr.Resets).Seconds())+1, 1)))
+		writeOCIError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS", err.Error()+"; only cached content is served")
+		return
+	}
+	if errors.Is(err, ErrFrozen) {
+		writeOCIError(w, http.StatusServiceUnavailable, "UNAVAILABLE", err.Error()+"; only cached content is served")
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("upstream request exceeded its timeout budget", "error", err)
+		writeError(w, "upstream timed out", http.StatusGatewayTimeout)
+		return
+	}
+	writeError(w, "upstream error", http.StatusBadGateway)
+}
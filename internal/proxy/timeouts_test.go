@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutBudgets(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	h := &Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    &mockStore{err: errors.New("miss")},
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		Timeouts: Timeouts{Short: 50 * time.Millisecond, Manifest: 50 * time.Millisecond},
+	}
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodHead, "/v2/org/app/blobs/" + digest, http.StatusGatewayTimeout},
+		{http.MethodGet, "/v2/org/app/manifests/v1", http.StatusGatewayTimeout},
+		{http.MethodGet, "/v2/org/app/referrers/" + digest, http.StatusGatewayTimeout},
+		// Blobs have no budget here, so the slow upstream is waited for.
+		{http.MethodGet, "/v2/org/app/blobs/" + digest, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
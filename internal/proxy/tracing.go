@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/tracing"
+)
+
+// TracingMiddleware starts a server span for every request, continuing
+// the client's trace if it sent a traceparent. It does nothing unless a
+// tracer is installed.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.StartKind(tracing.Extract(r.Context(), r.Header), r.Method, tracing.KindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		span.SetAttr("server.address", r.Host)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttr("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			span.SetError(errors.New(http.StatusText(rec.status)))
+		}
+	})
+}
+
+// traceRequest records what a parsed request asks for on span.
+func traceRequest(span *tracing.Span, info requestInfo) {
+	span.SetAttr("oci.registry", info.Registry)
+	span.SetAttr("oci.repository", info.Name)
+	span.SetAttr("oci.kind", info.Kind)
+	span.SetAttr("oci.reference", info.Reference)
+}
+
+// endLookup ends a cache lookup span, recording whether the cached copy
+// was served. Misses and copies passed over aren't errors.
+func endLookup(span *tracing.Span, key string, err error) {
+	span.SetAttr("cache.key", key)
+	span.SetAttr("cache.hit", err == nil)
+	if err != nil && !cache.IsNotFound(err) && !errors.Is(err, errNotAcceptable) && !errors.Is(err, errTagExpired) {
+		span.SetError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	var names []string
+	var traces = make(map[string]bool)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID string `json:"traceId"`
+						Name    string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					names = append(names, s.Name)
+					traces[s.TraceID] = true
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+	tracer := tracing.New(tracing.Config{Endpoint: collector.URL + "/v1/traces"})
+	tracing.SetDefault(tracer)
+	defer tracing.SetDefault(nil)
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { tracer.Run(ctx); close(done) }()
+
+	var traceparent string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		w.Write([]byte("layer"))
+	}))
+	defer upstream.Close()
+	h := &Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/v2/org/app/blobs/sha256:"+strings.Repeat("a", 64), nil)
+	req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	TracingMiddleware(h).ServeHTTP(httptest.NewRecorder(), req)
+
+	if sc, ok := tracing.ParseTraceparent(traceparent); !ok || sc.TraceID.String() != traceID || sc.SpanID.String() == "00f067aa0ba902b7" {
+		t.Errorf("upstream got traceparent %q, want a child span of trace %s", traceparent, traceID)
+	}
+
+	stop()
+	<-done
+	want := map[string]bool{"GET": true, "proxy.parse": true, "cache.lookup": true, "upstream.fetch": true, "cache.tee": true}
+	for _, n := range names {
+		delete(want, n)
+	}
+	if len(want) > 0 {
+		t.Errorf("spans %v not exported; got %v", want, names)
+	}
+	if len(traces) != 1 || !traces[traceID] {
+		t.Errorf("spans in traces %v, want only %s", traces, traceID)
+	}
+}
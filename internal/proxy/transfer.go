@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// ErrTransferCap is returned for upstream requests to a registry whose
+// hard transfer cap has been reached for the current period.
+var ErrTransferCap = errors.New("upstream transfer cap reached")
+
+var (
+	transferBytes = metrics.NewCounterVec("oci_upstream_transfer_bytes_total",
+		"Bytes read from upstream responses, by registry.", "registry")
+	transferPeriodBytes = metrics.NewGaugeVec("oci_upstream_transfer_period_bytes",
+		"Bytes read from upstream responses in the current UTC day or month, by registry (\"*\" for all).", "registry", "period")
+	transferCapExceeded = metrics.NewCounterVec("oci_upstream_transfer_cap_exceeded_total",
+		"Transfer caps crossed, by registry (\"*\" for all) and cap (soft, hard); hard caps count each refused request.", "registry", "cap")
+)
+
+// Transfer periods.
+const (
+	TransferDaily   = "day"
+	TransferMonthly = "month"
+)
+
+// TransferCapError reports a request refused under a hard transfer cap.
+type TransferCapError struct {
+	Registry string    // the capped registry, or AllRegistries
+	Cap      int64     // bytes per period
+	Resets   time.Time // when the period ends
+}
+
+func (e *TransferCapError) Error() string {
+	return fmt.Sprintf("%v: %s has used its %d bytes until %s", ErrTransferCap, e.Registry, e.Cap, e.Resets.Format(time.RFC3339))
+}
+
+func (e *TransferCapError) Unwrap() error { return ErrTransferCap }
+
+// TransferCaps bound the bytes fetched from a registry per period. Past
+// the soft cap a warning is logged and counted; past the hard cap new
+// upstream requests are refused until the period ends. Zero is no cap.
+type TransferCaps struct {
+	Soft int64 `json:"soft,omitempty"`
+	Hard int64 `json:"hard,omitempty"`
+}
+
+// Transfer accounts the bytes read from upstream registries, by registry
+// and in total, for the current UTC day and month, and enforces caps over
+// one of those periods. Counts are kept in memory, so a restart starts
+// them over; oci_upstream_transfer_bytes_total is the record to bill
+// from. A nil *Transfer counts and caps nothing.
+type Transfer struct {
+	period string
+	caps   map[string]TransferCaps // by registryKey
+	now    func() time.Time
+
+	mu    sync.Mutex
+	day   time.Time // start of the current day and month
+	month time.Time
+	usage map[string]*transferUsage
+}
+
+type transferUsage struct {
+	day, month int64
+	warned     bool // soft cap crossed this period
+}
+
+// NewTransfer accounts transfers with caps, keyed by registry host or
+// AllRegistries for the total, applied per period (TransferDaily or
+// TransferMonthly; empty is monthly).
+func NewTransfer(period string, caps map[string]TransferCaps) (*Transfer, error) {
+	period = cmp.Or(period, TransferMonthly)
+	if period != TransferDaily && period != TransferMonthly {
+		return nil, fmt.Errorf("unknown transfer period %q (want %s or %s)", period, TransferDaily, TransferMonthly)
+	}
+	t := &Transfer{period: period, caps: make(map[string]TransferCaps), now: time.Now, usage: make(map[string]*transferUsage)}
+	for registry, c := range caps {
+		if c.Soft < 0 || c.Hard < 0 {
+			return nil, fmt.Errorf("negative transfer cap for %s", registry)
+		}
+		t.caps[registryKey(registry)] = c
+	}
+	return t, nil
+}
+
+// roll starts new periods when the clock has passed into them.
+func (t *Transfer) roll(now time.Time) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	newDay, newMonth := !day.Equal(t.day), !month.Equal(t.month)
+	if !newDay && !newMonth {
+		return
+	}
+	for _, u := range t.usage {
+		if newDay {
+			u.day = 0
+		}
+		if newMonth {
+			u.month = 0
+		}
+		if (newDay && t.period == TransferDaily) || newMonth {
+			u.warned = false
+		}
+	}
+	t.day, t.month = day, month
+}
+
+func (t *Transfer) get(key string) *transferUsage {
+	u, ok := t.usage[key]
+	if !ok {
+		u = &transferUsage{}
+		t.usage[key] = u
+	}
+	return u
+}
+
+// used returns the usage counted against caps.
+func (t *Transfer) used(u *transferUsage) int64 {
+	if t.period == TransferDaily {
+		return u.day
+	}
+	return u.month
+}
+
+// resets returns when the current cap period ends.
+func (t *Transfer) resets() time.Time {
+	if t.period == TransferDaily {
+		return t.day.AddDate(0, 0, 1)
+	}
+	return t.month.AddDate(0, 1, 0)
+}
+
+// add counts n bytes read from registry.
+func (t *Transfer) add(registry string, n int64) {
+	if t == nil || n <= 0 {
+		return
+	}
+	transferBytes.Add(float64(n), registryKey(registry))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roll(t.now())
+	for _, key := range []string{registryKey(registry), AllRegistries} {
+		u := t.get(key)
+		u.day += n
+		u.month += n
+		transferPeriodBytes.Set(float64(u.day), key, TransferDaily)
+		transferPeriodBytes.Set(float64(u.month), key, TransferMonthly)
+		if soft := t.caps[key].Soft; soft > 0 && t.used(u) >= soft && !u.warned {
+			u.warned = true
+			transferCapExceeded.Inc(key, "soft")
+			slog.Warn("upstream transfer soft cap reached", "registry", key, "cap", soft, "period", t.period, "used", t.used(u))
+		}
+	}
+}
+
+// check refuses a request to registry if it, or the total, is at its
+// hard cap. Requests already under way run to completion, so a cap can
+// be overshot by the transfers in progress when it is reached.
+func (t *Transfer) check(registry string) error {
+	if t == nil || len(t.caps) == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roll(t.now())
+	for _, key := range []string{registryKey(registry), AllRegistries} {
+		if hard := t.caps[key].Hard; hard > 0 && t.used(t.get(key)) >= hard {
+			transferCapExceeded.Inc(key, "hard")
+			return &TransferCapError{Registry: key, Cap: hard, Resets: t.resets()}
+		}
+	}
+	return nil
+}
+
+// TransferUsage is one registry's transfer so far, or the total.
+type TransferUsage struct {
+	Registry   string       `json:"registry"` // AllRegistries for the total
+	DayBytes   int64        `json:"day_bytes"`
+	MonthBytes int64        `json:"month_bytes"`
+	Caps       TransferCaps `json:"caps"`
+}
+
+// TransferReport is the transfer accounting for the current periods.
+type TransferReport struct {
+	Day        time.Time       `json:"day"`
+	Month      time.Time       `json:"month"`
+	CapPeriod  string          `json:"cap_period"`
+	Registries []TransferUsage `json:"registries"`
+}
+
+// Report returns usage by registry, including registries with caps that
+// haven't transferred anything yet.
+func (t *Transfer) Report() TransferReport {
+	if t == nil {
+		return TransferReport{Registries: []TransferUsage{}}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roll(t.now())
+	for key := range t.caps {
+		t.get(key)
+	}
+	t.get(AllRegistries)
+	r := TransferReport{Day: t.day, Month: t.month, CapPeriod: t.period}
+	for key, u := range t.usage {
+		r.Registries = append(r.Registries, TransferUsage{Registry: key, DayBytes: u.day, MonthBytes: u.month, Caps: t.caps[key]})
+	}
+	slices.SortFunc(r.Registries, func(a, b TransferUsage) int { return cmp.Compare(a.Registry, b.Registry) })
+	return r
+}
+
+// countBody wraps an upstream response body so the bytes read from it
+// are accounted to registry.
+func (t *Transfer) countBody(registry string, body io.ReadCloser) io.ReadCloser {
+	if t == nil {
+		return body
+	}
+	return &transferBody{ReadCloser: body, t: t, registry: registry}
+}
+
+type transferBody struct {
+	io.ReadCloser
+	t        *Transfer
+	registry string
+}
+
+func (b *transferBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.t.add(b.registry, int64(n))
+	return n, err
+}
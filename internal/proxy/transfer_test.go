@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestTransferHardCap(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "layer")
+	}))
+	defer upstream.Close()
+
+	registry := strings.TrimPrefix(upstream.URL, "https://")
+	transfer, err := NewTransfer(TransferMonthly, map[string]TransferCaps{registry: {Soft: 3, Hard: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)
+	transfer.now = func() time.Time { return now }
+	h := &Handler{
+		Registry: registry,
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https", Transfer: transfer},
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	sum := sha256.Sum256([]byte("layer"))
+	cached := "/v2/org/app/blobs/sha256:" + hex.EncodeToString(sum[:])
+	uncached := "/v2/org/app/blobs/sha256:" + strings.Repeat("b", 64)
+	if rec := get(cached); rec.Code != http.StatusOK {
+		t.Fatalf("fill: got %d", rec.Code)
+	}
+
+	report := transfer.Report()
+	if len(report.Registries) != 2 || report.Registries[0].Registry != AllRegistries || report.Registries[1].MonthBytes != 5 {
+		t.Fatalf("Report = %+v", report)
+	}
+	if rec := get(cached); rec.Code != http.StatusOK {
+		t.Errorf("cached blob at cap: got %d", rec.Code)
+	}
+	rec := get(uncached)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("miss at cap: got %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	now = now.Add(2 * time.Hour)
+	if rec := get(uncached); rec.Code == http.StatusTooManyRequests {
+		t.Error("cap still applied in the next month")
+	}
+}
+
+func TestTransferPeriods(t *testing.T) {
+	transfer, err := NewTransfer(TransferDaily, map[string]TransferCaps{AllRegistries: {Hard: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 30, 12, 0, 0, 0, time.UTC)
+	transfer.now = func() time.Time { return now }
+	transfer.add("docker.io", 6)
+	transfer.add("ghcr.io", 4)
+	if err := transfer.check("quay.io"); err == nil {
+		t.Error("total cap not applied to another registry")
+	}
+	now = now.Add(24 * time.Hour)
+	if err := transfer.check("quay.io"); err != nil {
+		t.Errorf("daily cap applied the next day: %v", err)
+	}
+	transfer.add("docker.io", 1)
+	for _, u := range transfer.Report().Registries {
+		if u.Registry == "registry-1.docker.io" && (u.DayBytes != 1 || u.MonthBytes != 7) {
+			t.Errorf("docker.io usage = %+v", u)
+		}
+	}
+
+	if _, err := NewTransfer("week", nil); err == nil {
+		t.Error("NewTransfer accepted an unknown period")
+	}
+	var nilTransfer *Transfer
+	if err := nilTransfer.check("ghcr.io"); err != nil {
+		t.Errorf("nil Transfer refused a request: %v", err)
+	}
+}
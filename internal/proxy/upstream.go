@@ -4,24 +4,96 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"strings"
 	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/adaptive"
+	"github.com/danielloader/oci-pull-through/internal/dnscache"
+	"github.com/danielloader/oci-pull-through/internal/health"
+	"github.com/danielloader/oci-pull-through/internal/tracing"
 )
 
 // UpstreamClient handles HTTP requests to upstream OCI registries.
 type UpstreamClient struct {
 	Client *http.Client
 	Scheme string // "https" or "http"
+
+	// Schemes overrides Scheme for individual registry hosts, for setups
+	// that route to a mix of HTTPS and plain-HTTP upstreams.
+	Schemes map[string]string
+
+	// MaxRedirects bounds the redirect chain per request; zero uses
+	// DefaultMaxRedirects.
+	MaxRedirects int
+
+	// CDNRewrites maps redirect target hosts (lowercase) to replacement
+	// hosts, e.g. to send blob fetches to a nearer CDN mirror.
+	CDNRewrites map[string]string
+
+	// Freeze, when set, refuses requests to frozen registries before they
+	// leave the proxy.
+	Freeze *Freeze
+
+	// Transfer, when set, accounts the bytes read from each upstream and
+	// refuses requests past a hard cap.
+	Transfer *Transfer
+
+	// PreferredRegions pins redirects to regional backing stores (see
+	// ParseRegions) to the listed regions, by registry host (lowercase).
+	PreferredRegions map[string][]string
+
+	// Quirks holds compatibility toggles by registry host (lowercase);
+	// see defaultQuirks for hosts covered without configuration.
+	Quirks map[string]Quirks
+
+	// Auth decides the credentials sent upstream. When nil the client's
+	// Authorization header is passed through.
+	Auth Authenticator
+
+	// Health, when set, records whether registry requests succeed, so the
+	// proxy can tell when upstream is down.
+	Health *health.Monitor
+
+	// ForwardHeaders lists client request headers (canonical names; see
+	// ParseForwardHeaders) sent upstream in addition to the ones the
+	// protocol needs. Others are dropped.
+	ForwardHeaders []string
+
+	// UserAgent is sent on registry requests that don't carry a forwarded
+	// client User-Agent; see UserAgent. Empty leaves Go's default.
+	UserAgent string
+
+	// Concurrency, when set, limits the requests in flight to each
+	// registry host, adapting to its latency and errors. Requests over the
+	// limit wait for a slot, which is held until the response headers
+	// arrive.
+	Concurrency *adaptive.Set
+}
+
+// Authenticator sets upstream credentials on outgoing requests; see
+// upstreamauth.Chain.
+type Authenticator interface {
+	// Authorize sets req's Authorization for registry. clientAuth is the
+	// header the client sent, if any.
+	Authorize(req *http.Request, registry, clientAuth string) error
+	// ProxyManaged reports whether the proxy holds registry's credentials
+	// itself rather than relying on the client's.
+	ProxyManaged(registry string) bool
 }
 
 // NewUpstreamClient creates an UpstreamClient with a configured http.Transport.
-// The default client follows redirects automatically (needed for blob redirects).
-func NewUpstreamClient() *UpstreamClient {
+// If resolver is non-nil, upstream hostnames are resolved through it.
+// Redirects (used by registries to send blob fetches to a CDN) are
+// followed explicitly by do rather than by the http.Client.
+func NewUpstreamClient(resolver *dnscache.Resolver) *UpstreamClient {
+	dial := (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	if resolver != nil {
+		dial = resolver.Dial(dial)
+	}
 	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		DialContext:            trackDial(dial),
 		TLSHandshakeTimeout:   10 * time.Second,
 		ResponseHeaderTimeout:  30 * time.Second,
 		MaxIdleConns:           100,
@@ -30,7 +102,7 @@ func NewUpstreamClient() *UpstreamClient {
 		DisableCompression:     true,
 	}
 	return &UpstreamClient{
-		Client: &http.Client{Transport: transport},
+		Client: &http.Client{Transport: transport, CheckRedirect: noFollow},
 		Scheme: "https",
 	}
 }
@@ -38,8 +110,11 @@ func NewUpstreamClient() *UpstreamClient {
 // DoV2Check forwards a /v2/ version check to the upstream registry.
 // This relays auth challenges (401 + Www-Authenticate) back to the client.
 func (u *UpstreamClient) DoV2Check(r *http.Request, registry string) (*http.Response, error) {
+	if err := u.Freeze.check(registry); err != nil {
+		return nil, err
+	}
 	host := resolveRegistry(registry)
-	url := fmt.Sprintf("%s://%s/v2/", u.Scheme, host)
+	url := fmt.Sprintf("%s://%s%s/v2/", u.scheme(registry), host, u.quirks(registry).PathPrefix)
 
 	req, err := http.NewRequestWithContext(r.Context(), r.Method, url, nil)
 	if err != nil {
@@ -49,15 +124,34 @@ func (u *UpstreamClient) DoV2Check(r *http.Request, registry string) (*http.Resp
 	if auth := r.Header.Get("Authorization"); auth != "" {
 		req.Header.Set("Authorization", auth)
 	}
+	u.forwardHeaders(req, r)
 
-	return u.Client.Do(req)
+	return u.do(req, registry)
 }
 
-// Do forwards a request to the upstream registry.
-func (u *UpstreamClient) Do(r *http.Request, info requestInfo) (*http.Response, error) {
+// Do forwards a request to the upstream registry. Its trace span ends
+// once the response headers arrive; the body is read by the caller.
+func (u *UpstreamClient) Do(r *http.Request, info requestInfo) (resp *http.Response, err error) {
+	ctx, span := tracing.StartKind(r.Context(), "upstream.fetch", tracing.KindClient)
+	defer func() {
+		if resp != nil {
+			span.SetAttr("http.response.status_code", resp.StatusCode)
+		}
+		span.SetError(err)
+		span.End()
+	}()
+	span.SetAttr("http.request.method", r.Method)
+	span.SetAttr("server.address", info.Registry)
+
+	if err := u.Freeze.check(info.Registry); err != nil {
+		return nil, err
+	}
+	if err := u.Transfer.check(info.Registry); err != nil {
+		return nil, err
+	}
 	upstreamURL := u.upstreamURL(info)
 
-	req, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, nil)
+	req, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating upstream request: %w", err)
 	}
@@ -68,7 +162,7 @@ func (u *UpstreamClient) Do(r *http.Request, info requestInfo) (*http.Response,
 	}
 
 	// Forward Accept header (critical for manifest content negotiation)
-	if accept := r.Header.Get("Accept"); accept != "" {
+	if accept := acceptHeader(r); accept != "" {
 		req.Header.Set("Accept", accept)
 	}
 
@@ -82,20 +176,76 @@ func (u *UpstreamClient) Do(r *http.Request, info requestInfo) (*http.Response,
 		req.Header.Set("If-Range", ifRange)
 	}
 
-	return u.Client.Do(req)
+	// Forward the client's own cache validators. A 304 goes back to the
+	// client as-is, and also revalidates a cached tag it matches.
+	for _, k := range []string{"If-None-Match", "If-Modified-Since"} {
+		if v := r.Header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	u.forwardHeaders(req, r)
+	tracing.Inject(ctx, req.Header)
+
+	slot, err := u.Concurrency.Get(info.Registry).Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err = u.do(req, info.Registry)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		slot.Ignore()
+	case err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		slot.Dropped()
+	default:
+		slot.Success(time.Since(start))
+	}
+	if err != nil {
+		u.Health.Record(health.StaleOnly, err)
+		return nil, err
+	}
+	if resp.StatusCode >= 500 {
+		u.Health.Record(health.StaleOnly, fmt.Errorf("upstream %s returned %s", info.Registry, resp.Status))
+	} else {
+		u.Health.Record(health.StaleOnly, nil)
+	}
+	u.quirks(info.Registry).fixResponse(resp, info, req.URL.Host)
+	return resp, nil
 }
 
 // upstreamURL constructs the full upstream registry URL.
 func (u *UpstreamClient) upstreamURL(info requestInfo) string {
 	registry := resolveRegistry(info.Registry)
-	return fmt.Sprintf("%s://%s/v2/%s/%s/%s", u.Scheme, registry, info.Name, info.Kind, info.Reference)
+	url := fmt.Sprintf("%s://%s%s/v2/%s/%s/%s", u.scheme(info.Registry), registry, u.quirks(info.Registry).PathPrefix,
+		info.Name, info.Kind, info.Reference)
+	// Listings take filter and pagination parameters (n, last, artifactType).
+	if info.Query != "" && (info.Kind == "tags" || info.Kind == "referrers") {
+		url += "?" + info.Query
+	}
+	return url
+}
+
+// scheme returns the URL scheme to use for a registry host.
+func (u *UpstreamClient) scheme(registry string) string {
+	if s, ok := u.Schemes[registry]; ok {
+		return s
+	}
+	return u.Scheme
+}
+
+// ProxyManagedAuth reports whether the proxy supplies registry's
+// credentials, so clients shouldn't be challenged for their own.
+func (u *UpstreamClient) ProxyManagedAuth(registry string) bool {
+	return u.Auth != nil && u.Auth.ProxyManaged(registry)
 }
 
-// resolveRegistry maps well-known registry aliases to their API endpoints.
-func resolveRegistry(registry string) string {
-	// Docker Hub uses a different host for API calls
-	if strings.EqualFold(registry, "docker.io") || strings.EqualFold(registry, "registry.docker.io") {
-		return "registry-1.docker.io"
+// authorize sets req's upstream credentials from clientAuth or Auth.
+func (u *UpstreamClient) authorize(req *http.Request, registry, clientAuth string) error {
+	if u.Auth == nil {
+		if clientAuth != "" {
+			req.Header.Set("Authorization", clientAuth)
+		}
+		return nil
 	}
-	return registry
+	return u.Auth.Authorize(req, registry, clientAuth)
 }
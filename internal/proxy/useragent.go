@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// UserAgent returns the User-Agent sent upstream, so registry operators
+// can tell the proxy's traffic apart, and which deployment it's from, when
+// looking into quota or abuse reports: "oci-pull-through/<version>",
+// followed by "(<deployment>)" when deployment is set.
+func UserAgent(version, deployment string) string {
+	if version == "" {
+		version = "unknown"
+	}
+	ua := "oci-pull-through/" + version
+	if deployment = strings.TrimSpace(deployment); deployment != "" {
+		ua += " (" + deployment + ")"
+	}
+	return ua
+}
+
+// setUserAgent sets UserAgent on req unless a client's own was forwarded
+// (see ForwardHeaders).
+func (u *UpstreamClient) setUserAgent(req *http.Request) {
+	if u.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", u.UserAgent)
+	}
+}
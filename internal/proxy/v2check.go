@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// v2CheckMaxBody bounds a cached /v2/ response; challenges are tiny.
+const v2CheckMaxBody = 64 << 10
+
+var v2Checks = metrics.NewCounterVec("oci_v2_checks_total",
+	"/v2/ version checks, by registry and how they were answered (cached, upstream).", "registry", "result")
+
+// v2CheckResponse is an upstream /v2/ answer kept for V2CheckTTL.
+type v2CheckResponse struct {
+	expires time.Time
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+func (c *v2CheckResponse) write(w http.ResponseWriter) {
+	for k, v := range c.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.WriteHeader(c.status)
+	w.Write(c.body)
+}
+
+// cachedV2Check returns a live cached answer for r, if r may use one:
+// only anonymous checks are cached, as their answer (usually a 401
+// challenge) is the same for every client.
+func (h *Handler) cachedV2Check(r *http.Request, registry string) (*v2CheckResponse, bool) {
+	if h.V2CheckTTL <= 0 || r.Header.Get("Authorization") != "" {
+		return nil, false
+	}
+	v, ok := h.v2CheckCache.Load(r.Method + " " + registry)
+	if !ok || time.Now().After(v.(*v2CheckResponse).expires) {
+		return nil, false
+	}
+	return v.(*v2CheckResponse), true
+}
+
+// storeV2Check keeps resp for later anonymous checks if it is a settled
+// answer (200, or a 401 challenge) and returns it. Otherwise it returns
+// nil for the caller to forward resp; a body read but too large to keep
+// is put back first.
+func (h *Handler) storeV2Check(r *http.Request, registry string, resp *http.Response) *v2CheckResponse {
+	if h.V2CheckTTL <= 0 || r.Header.Get("Authorization") != "" ||
+		(resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized) {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, v2CheckMaxBody+1))
+	if err != nil || len(body) > v2CheckMaxBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	c := &v2CheckResponse{
+		expires: time.Now().Add(h.V2CheckTTL),
+		status:  resp.StatusCode,
+		header:  cloneResponseHeaders(resp),
+		body:    body,
+	}
+	c.header.Del("Date") // the server sets a current one
+	h.v2CheckCache.Store(r.Method+" "+registry, c)
+	return c
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestV2CheckCached(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Www-Authenticate", `Bearer realm="https://auth.test/token",service="registry.test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+
+	h := &Handler{
+		Registry:   strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:      &mockStore{},
+		Upstream:   &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		V2CheckTTL: time.Minute,
+	}
+	check := func(auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := range 3 {
+		rec := check("")
+		if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("Www-Authenticate"), "auth.test") {
+			t.Fatalf("check %d: got %d, challenge %q", i, rec.Code, rec.Header().Get("Www-Authenticate"))
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("anonymous checks reached upstream %d times, want 1", n)
+	}
+
+	// Authenticated checks are always forwarded: the answer depends on the token.
+	if rec := check("Bearer tok"); rec.Code != http.StatusOK || calls.Load() != 2 {
+		t.Fatalf("authenticated check: got %d after %d upstream calls", rec.Code, calls.Load())
+	}
+}
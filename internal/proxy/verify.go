@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/danielloader/oci-pull-through/internal/digest"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// newDigester hashes content in the algorithm of want, an expected digest
+// that may be empty, for callers whose own digest variables shadow the
+// package.
+func newDigester(want string) *digest.Verifier { return digest.NewDigester(want) }
+
+var (
+	manifestDigestMismatches = metrics.NewCounterVec("oci_manifest_digest_mismatch_total",
+		"Manifests requested by digest whose upstream content hashed to something else.", "registry")
+	digestMismatches = metrics.NewCounterVec("oci_fill_digest_mismatch_total",
+		"Cache fills aborted because the streamed content hashed to something other than its digest, by kind (blobs or manifests).", "kind", "registry")
+)
+
+// verifyManifest buffers a manifest requested by digest and checks its
+// content against the digest before anything is cached or sent. On success
+// resp.Body is replaced with the buffered copy; on failure a 502 is written
+// and false returned. Digests with an algorithm we can't compute are passed
+// through unverified.
+func (h *Handler) verifyManifest(w http.ResponseWriter, info requestInfo, resp *http.Response) bool {
+	limit := h.MaxManifestSize
+	if limit <= 0 {
+		limit = DefaultMaxManifestSize
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err == nil && int64(len(body)) > limit {
+		err = fmt.Errorf("manifest exceeds %d bytes", limit)
+	}
+	if err != nil {
+		slog.Warn("reading upstream manifest failed", "image", info.image(), "ref", info.shortRef(), "error", err)
+		writeOCIError(w, http.StatusBadGateway, "MANIFEST_INVALID", "reading upstream manifest: "+err.Error())
+		return false
+	}
+
+	if got, ok := digest.Compute(info.Reference, body); ok && got != info.Reference {
+		manifestDigestMismatches.Inc(info.Registry)
+		slog.Error("upstream manifest does not match its digest", "image", info.image(), "want", info.Reference, "got", got)
+		writeOCIError(w, http.StatusBadGateway, "MANIFEST_INVALID",
+			fmt.Sprintf("upstream returned content with digest %s for %s", got, info.Reference))
+		return false
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return true
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestManifestDigestVerified(t *testing.T) {
+	good := `{"schemaVersion":2}`
+	sum := sha256.Sum256([]byte(good))
+	goodDigest := "sha256:" + hex.EncodeToString(sum[:])
+	badDigest := "sha256:" + strings.Repeat("ab", 32)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		io.WriteString(w, good)
+	}))
+	defer upstream.Close()
+
+	store := cache.NewFSStore(t.TempDir(), 0)
+	h := &Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    store,
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+	}
+	get := func(digest string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/org/app/manifests/"+digest, nil))
+		return rec
+	}
+	cached := func(digest string) bool {
+		_, err := store.Head(context.Background(), h.storageKey(requestInfo{Registry: h.Registry, Name: "org/app", Kind: "manifests", Reference: digest}))
+		return err == nil
+	}
+
+	if rec := get(goodDigest); rec.Code != http.StatusOK || rec.Body.String() != good {
+		t.Fatalf("matching manifest: got %d %q", rec.Code, rec.Body)
+	}
+	if !cached(goodDigest) {
+		t.Error("matching manifest was not cached")
+	}
+
+	rec := get(badDigest)
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "MANIFEST_INVALID") {
+		t.Fatalf("mismatched manifest: got %d %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "schemaVersion") {
+		t.Error("mismatched content was sent to the client")
+	}
+	if cached(badDigest) {
+		t.Error("mismatched manifest was cached")
+	}
+}
+
+func TestBlobDigestVerifiedWhileStreaming(t *testing.T) {
+	const layer = "layer content"
+	sum := sha256.Sum256([]byte(layer))
+	goodDigest := "sha256:" + hex.EncodeToString(sum[:])
+	badDigest := "sha256:" + strings.Repeat("cd", 32)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", "13")
+		io.WriteString(w, layer)
+	}))
+	defer upstream.Close()
+
+	store := cache.NewFSStore(t.TempDir(), 0)
+	h := &Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    store,
+		Upstream: &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+	}
+	for digest, want := range map[string]bool{goodDigest: true, badDigest: false} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/org/app/blobs/"+digest, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", digest, rec.Code)
+		}
+		_, err := store.Head(context.Background(), cache.BlobKey(digest))
+		if cached := err == nil; cached != want {
+			t.Errorf("%s: cached = %v, want %v", digest, cached, want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// warmAccept is sent when warming manifests so upstream returns the same
+// representation a modern client would get.
+var warmAccept = manifest.Accept
+
+// WarmEvent reports one manifest or blob resolved while warming an image.
+type WarmEvent struct {
+	Image  string
+	Kind   string // "manifest" or "blob"
+	Digest string
+	Status string // "cached", "fetched" or "failed"
+	Size   int64
+	Err    error
+}
+
+// ParseImage splits a fully qualified reference ("registry/name:tag" or
+// "registry/name@sha256:...") into its parts.
+func ParseImage(image string) (registry, name, reference string, err error) {
+	registry, rest, ok := strings.Cut(image, "/")
+	if !ok || registry == "" || rest == "" {
+		return "", "", "", fmt.Errorf("%q is not a fully qualified image reference", image)
+	}
+	if n, d, ok := strings.Cut(rest, "@"); ok {
+		return registry, n, d, nil
+	}
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		return registry, rest[:i], rest[i+1:], nil
+	}
+	return registry, rest, "latest", nil
+}
+
+// Warm pulls an image through the cache as a client would: the manifest,
+// every child manifest of an index, then each referenced blob. Objects
+// already cached are reported without being read. authorization, if set,
+// is forwarded upstream like a client's Authorization header. progress is
+// called once per object; Warm returns an error only if the top-level
+// manifest can't be resolved.
+func (h *Handler) Warm(ctx context.Context, image, authorization string, progress func(WarmEvent)) error {
+	info, err := h.imageRequest(image)
+	if err != nil {
+		return err
+	}
+	w := &warmer{h: h, image: image, auth: authorization, progress: progress}
+	return w.manifest(ctx, info, true)
+}
+
+// WarmFresh is Warm, except that a cached tag is first revalidated
+// upstream, so what gets warmed is the image the tag names now rather than
+// whatever was cached. A tag that can't be revalidated keeps its cached
+// copy, and Warm proceeds from that.
+func (h *Handler) WarmFresh(ctx context.Context, image, authorization string, progress func(WarmEvent)) error {
+	info, err := h.imageRequest(image)
+	if err != nil {
+		return err
+	}
+	if key := h.storageKey(info); info.isTagManifest() && h.shouldCache(info) {
+		if meta, err := h.Cache.Head(ctx, key); err == nil {
+			result, err := h.refreshTag(ctx, info, key, meta.DockerContentDigest, authorization)
+			if err != nil {
+				slog.Warn("tag revalidation failed, warming cached copy", "image", image, "error", err)
+				result = "error"
+			}
+			tagRevalidations.Inc(result)
+		}
+	}
+	return h.Warm(ctx, image, authorization, progress)
+}
+
+// imageRequest resolves a fully qualified image reference to the request
+// for its top-level manifest, as a client pull through this handler would
+// make it.
+func (h *Handler) imageRequest(image string) (requestInfo, error) {
+	registry, name, ref, err := ParseImage(image)
+	if err != nil {
+		return requestInfo{}, err
+	}
+	served, ok := h.servedRegistry(registry)
+	if !ok {
+		return requestInfo{}, fmt.Errorf("registry %s is not configured on this cache", registry)
+	}
+	info := requestInfo{Registry: served, Name: name, Kind: "manifests", Reference: ref}
+	if perr := validateReference(info); perr != nil {
+		return requestInfo{}, errors.New(perr.msg)
+	}
+	if !nameAllowed(h.allowedNamespaces(h.policy(), served), name) {
+		return requestInfo{}, fmt.Errorf("repository %s is not served by this mirror", name)
+	}
+	return info, nil
+}
+
+// CacheKey returns the storage key a fully qualified image reference is
+// cached under: its tag manifest, or its manifest by digest.
+func (h *Handler) CacheKey(image string) (string, error) {
+	info, err := h.imageRequest(image)
+	if err != nil {
+		return "", err
+	}
+	return h.storageKey(info), nil
+}
+
+// CacheRepository returns the "registry/name" a repository's manifests are
+// cached under, resolving registry aliases and host routes as pulls do.
+// Any tag or digest in repository is ignored.
+func (h *Handler) CacheRepository(repository string) (string, error) {
+	info, err := h.imageRequest(repository)
+	if err != nil {
+		return "", err
+	}
+	return info.Registry + "/" + info.Name, nil
+}
+
+// ServesImage reports whether a fully qualified image reference names a
+// registry this handler proxies, i.e. whether Warm would accept it.
+func (h *Handler) ServesImage(image string) bool {
+	registry, _, _, err := ParseImage(image)
+	if err != nil {
+		return false
+	}
+	_, ok := h.servedRegistry(registry)
+	return ok
+}
+
+// servedRegistry maps a registry as written in an image reference to the
+// name client pulls are cached under: the default upstream or a host route
+// target, matched after resolving aliases such as docker.io. A host route's
+// incoming hostname (a mirror name used in image references) maps to its
+// target.
+func (h *Handler) servedRegistry(registry string) (string, bool) {
+	host := registry
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if r, ok := h.HostRoutes[strings.ToLower(host)]; ok {
+		return r, true
+	}
+	if r, ok := h.PathRoutes[strings.ToLower(registry)]; ok {
+		return r, true
+	}
+	if r, ok := h.MirrorRoutes[strings.ToLower(registry)]; ok {
+		return r, true
+	}
+	want := resolveRegistry(registry)
+	if h.Registry != "" && resolveRegistry(h.Registry) == want {
+		return h.Registry, true
+	}
+	for _, routes := range []map[string]string{h.HostRoutes, h.PathRoutes, h.MirrorRoutes} {
+		for _, r := range routes {
+			if resolveRegistry(r) == want {
+				return r, true
+			}
+		}
+	}
+	return "", false
+}
+
+type warmer struct {
+	h        *Handler
+	image    string
+	auth     string
+	progress func(WarmEvent)
+}
+
+func (w *warmer) report(kind, digest, status string, size int64, err error) {
+	w.progress(WarmEvent{Image: w.image, Kind: kind, Digest: digest, Status: status, Size: size, Err: err})
+}
+
+// manifest warms a manifest and everything it references. Only the
+// top-level manifest (from the caller's reference) may recurse into an
+// index's children.
+func (w *warmer) manifest(ctx context.Context, info requestInfo, top bool) error {
+	body, digest, status, size, err := w.fetch(ctx, info)
+	if err != nil {
+		w.report("manifest", info.Reference, "failed", 0, err)
+		return err
+	}
+	w.report("manifest", digest, status, size, nil)
+
+	m, err := manifest.Parse(body)
+	if err != nil {
+		// Not an OCI or Docker v2 manifest (e.g. schema 1); nothing more to warm.
+		return nil
+	}
+
+	if top {
+		for _, child := range m.Manifests {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			w.manifest(ctx, requestInfo{Registry: info.Registry, Name: info.Name, Kind: "manifests", Reference: child.Digest}, false)
+		}
+	}
+
+	for _, b := range m.Blobs() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		d := b.Digest
+		blob := requestInfo{Registry: info.Registry, Name: info.Name, Kind: "blobs", Reference: d}
+		if !validDigest(d) {
+			w.report("blob", d, "failed", 0, errors.New("invalid digest"))
+			continue
+		}
+		_, _, status, size, err := w.fetch(ctx, blob)
+		if err != nil {
+			w.report("blob", d, "failed", 0, err)
+			continue
+		}
+		w.report("blob", d, status, size, nil)
+	}
+	return nil
+}
+
+// fetch resolves one object. Cached objects are answered from the store
+// (manifests are read, blobs only stat'ed); misses go through handleGet so
+// they are filled exactly as a client pull would fill them.
+func (w *warmer) fetch(ctx context.Context, info requestInfo) (body []byte, digest, status string, size int64, err error) {
+	key := w.h.storageKey(info)
+	// Aging tags go through handleGet so TagTTL applies as for a client.
+	if w.h.shouldCache(info) && !(info.isTagManifest() && w.h.tagPolicy(info).ttl > 0) {
+		if body, digest, size, ok := w.fromCache(ctx, info, key); ok {
+			return body, digest, "cached", size, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return nil, "", "", 0, err
+	}
+	req.Header.Set("Accept", warmAccept)
+	if w.auth != "" {
+		req.Header.Set("Authorization", w.auth)
+	}
+	rec := &warmWriter{header: make(http.Header), keep: info.Kind == "manifests"}
+	w.h.handleGet(rec, req, info, key)
+
+	switch rec.status {
+	case http.StatusOK:
+	case http.StatusTemporaryRedirect:
+		// Filled by a concurrent pull between our check and the GET.
+		if body, digest, size, ok := w.fromCache(ctx, info, key); ok {
+			return body, digest, "cached", size, nil
+		}
+		return nil, "", "", 0, errors.New("cache redirect for an object that is no longer cached")
+	case http.StatusUnauthorized:
+		return nil, "", "", 0, errors.New("upstream requires authorization")
+	default:
+		return nil, "", "", 0, fmt.Errorf("upstream returned %d", rec.status)
+	}
+	if cl := rec.header.Get("Content-Length"); cl != "" && cl != strconv.FormatInt(rec.n, 10) {
+		return nil, "", "", 0, fmt.Errorf("upstream response truncated after %d of %s bytes", rec.n, cl)
+	}
+	digest = rec.header.Get("Docker-Content-Digest")
+	if info.Kind == "manifests" && digest == "" {
+		sum := sha256.Sum256(rec.body.Bytes())
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return rec.body.Bytes(), digest, "fetched", rec.n, nil
+}
+
+// fromCache returns a cached manifest's body and digest, or just confirms
+// a cached blob exists.
+func (w *warmer) fromCache(ctx context.Context, info requestInfo, key string) ([]byte, string, int64, bool) {
+	if info.Kind != "manifests" {
+		meta, err := w.h.Cache.Head(ctx, key)
+		return nil, info.Reference, meta.ContentLength, err == nil
+	}
+	res, err := w.h.Cache.GetWithMeta(ctx, key)
+	if err != nil {
+		return nil, "", 0, false
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, max(w.h.MaxManifestSize, DefaultMaxManifestSize)))
+	if err != nil {
+		return nil, "", 0, false
+	}
+	digest := res.Meta.DockerContentDigest
+	if digest == "" && !info.isTagManifest() {
+		digest = info.Reference
+	}
+	return body, digest, int64(len(body)), true
+}
+
+// warmWriter is the ResponseWriter handleGet writes to while warming. Blob
+// bodies are discarded; manifest bodies are kept so their references can
+// be followed.
+type warmWriter struct {
+	header http.Header
+	status int
+	keep   bool
+	body   bytes.Buffer
+	n      int64
+}
+
+func (w *warmWriter) Header() http.Header { return w.header }
+
+func (w *warmWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *warmWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.n += int64(len(p))
+	if w.keep {
+		w.body.Write(p)
+	}
+	return len(p), nil
+}
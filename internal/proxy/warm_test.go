@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestWarm(t *testing.T) {
+	digestOf := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	config, layer := `{"architecture":"amd64"}`, "layer-bytes"
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+		`"config":{"digest":%q},"layers":[{"digest":%q}]}`, digestOf(config), digestOf(layer))
+	objects := map[string]string{
+		"/v2/org/app/manifests/v1":              manifest,
+		"/v2/org/app/blobs/" + digestOf(config): config,
+		"/v2/org/app/blobs/" + digestOf(layer):  layer,
+	}
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", digestOf(body))
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		fmt.Fprint(w, body)
+	}))
+	defer upstream.Close()
+
+	store := cache.NewFSStore(t.TempDir(), 0)
+	registry := strings.TrimPrefix(upstream.URL, "https://")
+	h := &Handler{
+		Registry:          registry,
+		Cache:             store,
+		Upstream:          &UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+		CacheTagManifests: true,
+	}
+
+	warm := func() []WarmEvent {
+		var events []WarmEvent
+		if err := h.Warm(context.Background(), registry+"/org/app:v1", "", func(ev WarmEvent) { events = append(events, ev) }); err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+
+	first := warm()
+	if len(first) != 3 {
+		t.Fatalf("expected manifest + 2 blobs, got %+v", first)
+	}
+	for _, ev := range first {
+		if ev.Status != "fetched" {
+			t.Errorf("%s %s: status %s, err %v", ev.Kind, ev.Digest, ev.Status, ev.Err)
+		}
+	}
+	if first[0].Digest != digestOf(manifest) || first[2].Size != int64(len(layer)) {
+		t.Errorf("unexpected events %+v", first)
+	}
+
+	for _, ev := range warm() {
+		if ev.Status != "cached" {
+			t.Errorf("second warm: %s %s was %s", ev.Kind, ev.Digest, ev.Status)
+		}
+	}
+
+	if err := h.Warm(context.Background(), "elsewhere.io/org/app:v1", "", func(WarmEvent) {}); err == nil {
+		t.Error("expected unconfigured registry to be refused")
+	}
+}
+
+func TestParseImage(t *testing.T) {
+	for in, want := range map[string][3]string{
+		"ghcr.io/org/app:v1":                  {"ghcr.io", "org/app", "v1"},
+		"localhost:5000/app":                  {"localhost:5000", "app", "latest"},
+		"docker.io/library/nginx@sha256:abcd": {"docker.io", "library/nginx", "sha256:abcd"},
+	} {
+		r, n, ref, err := ParseImage(in)
+		if err != nil || [3]string{r, n, ref} != want {
+			t.Errorf("ParseImage(%q) = %q %q %q %v, want %v", in, r, n, ref, err, want)
+		}
+	}
+	if _, _, _, err := ParseImage("nginx"); err == nil {
+		t.Error("expected error for unqualified reference")
+	}
+}
+
+func TestServesImage(t *testing.T) {
+	h := &Handler{
+		Registry:   "registry-1.docker.io",
+		HostRoutes: map[string]string{"ghcr-mirror.internal": "ghcr.io"},
+	}
+	for image, want := range map[string]string{
+		"docker.io/library/nginx:latest":       "registry-1.docker.io",
+		"ghcr.io/org/app:v1":                   "ghcr.io",
+		"ghcr-mirror.internal:8443/org/app:v1": "ghcr.io",
+		"quay.io/org/app:v1":                   "",
+	} {
+		registry, _, _, _ := ParseImage(image)
+		got, ok := h.servedRegistry(registry)
+		if got != want || ok != (want != "") || h.ServesImage(image) != ok {
+			t.Errorf("%s: served as %q (%v), want %q", image, got, ok, want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Package recording captures upstream registry traffic to a file and
+// replays it, so an incompatibility seen against a private registry can be
+// reproduced (and turned into a regression test) without access to it.
+//
+// A recording is JSON lines, one Exchange per upstream round trip.
+// Credentials are redacted and bodies truncated before anything is written.
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultMaxBody is how much of each response body is kept by default:
+// enough for any manifest or error document, but not a layer.
+const DefaultMaxBody = 64 << 10
+
+// redacted replaces secrets in headers and query strings.
+const redacted = "REDACTED"
+
+// sensitiveHeaders are never recorded verbatim.
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Amz-Security-Token", "X-Vault-Token"}
+
+// sensitiveParams are query parameters carrying signatures or tokens, as
+// found in presigned CDN redirect URLs.
+var sensitiveParams = map[string]bool{
+	"x-amz-signature": true, "x-amz-credential": true, "x-amz-security-token": true,
+	"signature": true, "sig": true, "token": true, "policy": true, "key-pair-id": true,
+	"se": true, "sp": true, "sv": true, // Azure SAS
+}
+
+// Exchange is one recorded upstream round trip.
+type Exchange struct {
+	Time          time.Time   `json:"time"`
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	Status        int         `json:"status,omitempty"`
+	Header        http.Header `json:"header,omitempty"`
+	// Body holds the (possibly truncated) response body as text, or
+	// BodyBase64 when it isn't UTF-8.
+	Body       string `json:"body,omitempty"`
+	BodyBase64 []byte `json:"body_base64,omitempty"`
+	// BodySize is the number of body bytes the client read; Truncated is
+	// set when only the first MaxBody of them were kept.
+	BodySize  int64  `json:"body_size"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// body returns the recorded body bytes.
+func (e *Exchange) body() []byte {
+	if e.BodyBase64 != nil {
+		return e.BodyBase64
+	}
+	return []byte(e.Body)
+}
+
+// Recorder is an http.RoundTripper that records each exchange through
+// Next to W.
+type Recorder struct {
+	Next    http.RoundTripper
+	W       io.Writer
+	MaxBody int // DefaultMaxBody when zero
+
+	mu sync.Mutex
+}
+
+// RoundTrip forwards req and records the exchange once the response body
+// has been read and closed, so streaming to the client is unaffected.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	ex := &Exchange{
+		Time:          time.Now().UTC(),
+		Method:        req.Method,
+		URL:           RedactURL(req.URL),
+		RequestHeader: redactHeader(req.Header),
+	}
+	resp, err := r.Next.RoundTrip(req)
+	if err != nil {
+		ex.Error = err.Error()
+		r.write(ex)
+		return nil, err
+	}
+	ex.Status = resp.StatusCode
+	ex.Header = redactHeader(resp.Header)
+	max := r.MaxBody
+	if max <= 0 {
+		max = DefaultMaxBody
+	}
+	resp.Body = &capture{ReadCloser: resp.Body, max: max, done: func(buf []byte, n int64) {
+		ex.BodySize, ex.Truncated = n, n > int64(len(buf))
+		if utf8.Valid(buf) {
+			ex.Body = string(buf)
+		} else {
+			ex.BodyBase64 = buf
+		}
+		r.write(ex)
+	}}
+	return resp, nil
+}
+
+func (r *Recorder) write(ex *Exchange) {
+	line, err := json.Marshal(ex)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.W.Write(append(line, '\n'))
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach Next.
+func (r *Recorder) CloseIdleConnections() {
+	if c, ok := r.Next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// capture keeps the first max bytes read through it and reports them on
+// Close.
+type capture struct {
+	io.ReadCloser
+	max  int
+	buf  bytes.Buffer
+	n    int64
+	once sync.Once
+	done func(buf []byte, n int64)
+}
+
+func (c *capture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	if room := c.max - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(n, room)])
+	}
+	return n, err
+}
+
+func (c *capture) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() { c.done(c.buf.Bytes(), c.n) })
+	return err
+}
+
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, k := range sensitiveHeaders {
+		if out.Get(k) != "" {
+			out.Set(k, redacted)
+		}
+	}
+	return out
+}
+
+// RedactURL renders u with signature and token query parameters replaced.
+func RedactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	q := u.Query()
+	for k := range q {
+		if sensitiveParams[strings.ToLower(k)] {
+			q.Set(k, redacted)
+		}
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// Replayer is an http.RoundTripper answering from a recording instead of
+// the network. Exchanges are matched on method and redacted URL; repeated
+// requests get successive recordings, and the last one is reused after
+// that. Truncated bodies are replayed as recorded, with Content-Length
+// adjusted to match.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges map[string][]*Exchange
+}
+
+// Load reads a recording from path.
+func Load(path string) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read parses a recording.
+func Read(r io.Reader) (*Replayer, error) {
+	rp := &Replayer{exchanges: make(map[string][]*Exchange)}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		ex := new(Exchange)
+		if err := json.Unmarshal(sc.Bytes(), ex); err != nil {
+			return nil, fmt.Errorf("recording line %d: %w", line, err)
+		}
+		k := ex.Method + " " + ex.URL
+		rp.exchanges[k] = append(rp.exchanges[k], ex)
+	}
+	return rp, sc.Err()
+}
+
+func (rp *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	k := req.Method + " " + RedactURL(req.URL)
+	rp.mu.Lock()
+	queue := rp.exchanges[k]
+	var ex *Exchange
+	if len(queue) > 0 {
+		ex = queue[0]
+		if len(queue) > 1 {
+			rp.exchanges[k] = queue[1:]
+		}
+	}
+	rp.mu.Unlock()
+	if ex == nil {
+		return nil, fmt.Errorf("no recorded response for %s", k)
+	}
+	if ex.Error != "" {
+		return nil, fmt.Errorf("recorded error: %s", ex.Error)
+	}
+	body := ex.body()
+	header := ex.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if header.Get("Content-Length") != "" {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
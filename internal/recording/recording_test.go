@@ -0,0 +1,79 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	blob := bytes.Repeat([]byte{0xff}, 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/org/app/manifests/v1":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Set-Cookie", "session=secret")
+			io.WriteString(w, manifest)
+		case "/v2/org/app/blobs/sha256:abc":
+			w.Write(blob)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	var rec bytes.Buffer
+	client := &http.Client{Transport: &Recorder{Next: http.DefaultTransport, W: &rec, MaxBody: 10}}
+	get := func(c *http.Client, path string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, body
+	}
+
+	if _, body := get(client, "/v2/org/app/manifests/v1"); string(body) != manifest {
+		t.Fatalf("recording must not alter the body seen by the client, got %q", body)
+	}
+	if _, body := get(client, "/v2/org/app/blobs/sha256:abc"); !bytes.Equal(body, blob) {
+		t.Fatal("recording must not truncate the body seen by the client")
+	}
+	get(client, "/v2/org/app/manifests/v1?X-Amz-Signature=deadbeef&n=1")
+
+	if strings.Contains(rec.String(), "secret") || strings.Contains(rec.String(), "deadbeef") {
+		t.Fatalf("credentials leaked into recording:\n%s", rec.String())
+	}
+	lines := strings.Split(strings.TrimSpace(rec.String()), "\n")
+	var ex Exchange
+	json.Unmarshal([]byte(lines[1]), &ex)
+	if !ex.Truncated || ex.BodySize != 100 || len(ex.BodyBase64) != 10 {
+		t.Fatalf("blob exchange: truncated=%v size=%d kept=%d", ex.Truncated, ex.BodySize, len(ex.BodyBase64))
+	}
+
+	rp, err := Read(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Close() // replay must not need the network
+	replay := &http.Client{Transport: rp}
+	resp, body := get(replay, "/v2/org/app/manifests/v1")
+	if resp.StatusCode != http.StatusOK || string(body) != manifest[:10] || resp.Header.Get("Content-Type") != "application/vnd.oci.image.manifest.v1+json" {
+		t.Fatalf("replayed manifest: %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if resp, _ := get(replay, "/v2/org/app/manifests/v1?X-Amz-Signature=other&n=1"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("signed URL should match its redacted recording, got %d", resp.StatusCode)
+	}
+	if _, err := replay.Get(upstream.URL + "/v2/unknown/manifests/v1"); err == nil {
+		t.Fatal("expected error for an unrecorded request")
+	}
+}
@@ -0,0 +1,94 @@
+// Package recovery keeps a panic in one request or background task from
+// taking down the whole proxy: the panic is logged with its stack,
+// counted, and turned into a 500 or an error.
+package recovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var panicsTotal = metrics.NewCounterVec("oci_panics_total",
+	"Panics recovered, by where they happened (http, grpc, or a background task's name).", "where")
+
+// Middleware recovers panics in next. The client gets a 500 OCI error if
+// nothing has been written yet; otherwise the response is cut short.
+// http.ErrAbortHandler is passed through, as net/http uses it to abort a
+// response silently.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &trackingWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			report("http", p, "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			if tw.wrote {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]any{
+				"errors": []map[string]string{
+					{"code": "UNKNOWN", "message": "internal error"},
+				},
+			})
+		}()
+		next.ServeHTTP(tw, r)
+	})
+}
+
+// trackingWriter notes whether a response has been started.
+type trackingWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *trackingWriter) WriteHeader(code int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *trackingWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *trackingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// ErrPanic is wrapped by the errors Do returns for a panic.
+var ErrPanic = errors.New("panic")
+
+// Do runs fn, returning a panic in it as an error wrapping ErrPanic.
+func Do(where string, fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			report(where, p)
+			err = fmt.Errorf("%w: %v", ErrPanic, p)
+		}
+	}()
+	return fn()
+}
+
+// Go runs fn in a new goroutine, logging a panic in it instead of
+// crashing the process.
+func Go(where string, fn func()) {
+	go Do(where, func() error { fn(); return nil })
+}
+
+func report(where string, p any, attrs ...any) {
+	panicsTotal.Inc(where)
+	attrs = append(attrs, "where", where, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+	slog.Error("recovered panic", attrs...)
+}
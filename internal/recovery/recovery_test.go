@@ -0,0 +1,46 @@
+package recovery
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/partial" {
+			io.WriteString(w, "half a blob")
+		}
+		var m map[string]int
+		m["boom"]++ // nil map write
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/x/manifests/latest", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), `"UNKNOWN"`) {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+
+	// Once the response has started, the connection is aborted instead.
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("expected http.ErrAbortHandler, got %v", p)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/partial", nil))
+	t.Fatal("expected a panic")
+}
+
+func TestDo(t *testing.T) {
+	err := Do("test", func() error { panic("bad input") })
+	if !errors.Is(err, ErrPanic) || !strings.Contains(err.Error(), "bad input") {
+		t.Fatalf("got %v", err)
+	}
+	want := errors.New("plain")
+	if err := Do("test", func() error { return want }); err != want {
+		t.Fatalf("got %v", err)
+	}
+}
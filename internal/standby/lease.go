@@ -0,0 +1,156 @@
+package standby
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// LeaseKey is where instances sharing a store keep their leader lease.
+const LeaseKey = cache.StatePrefix + "leader"
+
+// lease is the stored leader lease.
+type lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// Election elects a leader among instances sharing Store through a lease
+// object the leader renews every TTL/3. The instance holding it promotes
+// its Gate; the others stay standbys until it lapses, when the first to
+// see that takes it over.
+//
+// The lease is only as strong as the store's consistency and the
+// instances' clocks, and an instance that loses it keeps serving rather
+// than drop traffic. That is safe here: instances sharing a cache
+// tolerate each other's writes, so two active at once cost nothing but
+// duplicate fills. The lease decides which instance is sent traffic, not
+// which may write.
+type Election struct {
+	Gate  *Gate
+	Store cache.Store
+	ID    string        // this instance's name, unique among those sharing Store
+	TTL   time.Duration // how long a lease outlives its last renewal
+
+	held bool
+}
+
+// Run campaigns for the lease until ctx is cancelled, then gives it up if
+// held, so that a standby takes over without waiting for it to lapse.
+func (e *Election) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.TTL / 3)
+	defer ticker.Stop()
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			e.resign()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// campaign renews the lease if held, or takes it if it has lapsed.
+func (e *Election) campaign(ctx context.Context) {
+	cur, err := e.read(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("reading leader lease failed", "error", err)
+		}
+		return
+	}
+	if cur.Holder != e.ID && time.Now().Before(cur.Expires) {
+		if e.held {
+			slog.Warn("leader lease taken by another instance, still serving", "holder", cur.Holder)
+			e.held = false
+		}
+		return
+	}
+	if err := e.write(ctx, lease{Holder: e.ID, Expires: time.Now().Add(e.TTL)}); err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("writing leader lease failed", "error", err)
+		}
+		return
+	}
+	if cur.Holder != e.ID {
+		// Another standby may have seen the same lapse. Whichever wrote
+		// last holds the lease; let its write land, then look.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.settle()):
+		}
+		if cur, err = e.read(ctx); err != nil || cur.Holder != e.ID {
+			return
+		}
+		slog.Info("took leader lease", "id", e.ID)
+	}
+	e.held = true
+	e.Gate.Promote("leader_election")
+}
+
+// resign deletes the lease if this instance holds it.
+func (e *Election) resign() {
+	if !e.held {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if cur, err := e.read(ctx); err != nil || cur.Holder != e.ID {
+		return
+	}
+	if err := e.Store.Delete(ctx, LeaseKey); err != nil && !cache.IsNotFound(err) {
+		slog.Warn("releasing leader lease failed", "error", err)
+		return
+	}
+	slog.Info("released leader lease", "id", e.ID)
+}
+
+// settle is how long a taker waits before confirming it holds the lease.
+func (e *Election) settle() time.Duration {
+	return min(e.TTL/10, time.Second)
+}
+
+// read returns the stored lease, or the zero lease, long lapsed, if there
+// is none.
+func (e *Election) read(ctx context.Context) (lease, error) {
+	var l lease
+	res, err := e.Store.GetWithMeta(ctx, LeaseKey)
+	if cache.IsNotFound(err) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(&l); err != nil {
+		// A torn or foreign object is as good as no lease.
+		slog.Warn("ignoring unreadable leader lease", "error", err)
+		return lease{}, nil
+	}
+	return l, nil
+}
+
+// write replaces the stored lease. Stores that keep the first write of a
+// key, like the filesystem store, need the old one deleted first.
+func (e *Election) write(ctx context.Context, l lease) error {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := e.Store.Delete(ctx, LeaseKey); err != nil && !cache.IsNotFound(err) {
+		return err
+	}
+	h := make(http.Header)
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	meta := cache.ObjectMeta{ContentType: "application/json", ContentLength: int64(len(body)), Header: h}
+	return e.Store.Put(ctx, LeaseKey, bytes.NewReader(body), meta)
+}
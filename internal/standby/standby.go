@@ -0,0 +1,100 @@
+// Package standby lets an instance run as a warm standby for a primary
+// sharing its storage: it keeps its cache index current and reports
+// healthy but not ready, so load balancers send it nothing, until it is
+// promoted by an operator or by winning a leader lease.
+package standby
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+// ErrStandby is the readiness error of an instance that hasn't been
+// promoted.
+var ErrStandby = errors.New("warm standby, awaiting promotion")
+
+var (
+	standbyGauge = metrics.NewGaugeVec("oci_standby",
+		"1 while the instance is a warm standby, 0 once it is active.")
+	promotions = metrics.NewCounterVec("oci_standby_promotions_total",
+		"Promotions of a warm standby to active, by trigger (admin, leader_election).", "trigger")
+)
+
+// Status reports an instance's role.
+type Status struct {
+	Role    string    `json:"role"` // "standby" or "active"
+	Since   time.Time `json:"since"`
+	Trigger string    `json:"trigger,omitempty"` // what promoted it, once active
+}
+
+// Gate holds an instance back from serving until it is promoted. Promotion
+// is one way: an active instance never returns to standby without a
+// restart. A nil *Gate is always active.
+type Gate struct {
+	mu     sync.Mutex
+	status Status
+}
+
+// New returns a Gate in standby, or already active if standby is false.
+func New(standby bool) *Gate {
+	role := "active"
+	if standby {
+		role = "standby"
+	}
+	g := &Gate{status: Status{Role: role, Since: time.Now().UTC()}}
+	g.report()
+	return g
+}
+
+// Standby reports whether the instance is still a standby.
+func (g *Gate) Standby() bool {
+	return g.Status().Role == "standby"
+}
+
+// Ready returns ErrStandby until the instance is promoted.
+func (g *Gate) Ready() error {
+	if g.Standby() {
+		return ErrStandby
+	}
+	return nil
+}
+
+// Status returns the instance's role.
+func (g *Gate) Status() Status {
+	if g == nil {
+		return Status{Role: "active"}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.status
+}
+
+// Promote makes the instance active, reporting whether it was a standby.
+// trigger names what promoted it, for logs and metrics.
+func (g *Gate) Promote(trigger string) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.status.Role != "standby" {
+		return false
+	}
+	g.status = Status{Role: "active", Since: time.Now().UTC(), Trigger: trigger}
+	g.report()
+	promotions.Inc(trigger)
+	slog.Warn("promoted from warm standby", "trigger", trigger)
+	return true
+}
+
+func (g *Gate) report() {
+	v := 0.0
+	if g.status.Role == "standby" {
+		v = 1
+	}
+	standbyGauge.Set(v)
+}
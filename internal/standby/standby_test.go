@@ -0,0 +1,73 @@
+package standby
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+func TestGate(t *testing.T) {
+	g := New(true)
+	if !errors.Is(g.Ready(), ErrStandby) {
+		t.Fatalf("standby Ready() = %v", g.Ready())
+	}
+	if !g.Promote("admin") {
+		t.Fatal("promoting a standby reported no change")
+	}
+	if err := g.Ready(); err != nil {
+		t.Fatalf("promoted Ready() = %v", err)
+	}
+	if g.Promote("admin") {
+		t.Error("promoting an active instance reported a change")
+	}
+	if s := g.Status(); s.Role != "active" || s.Trigger != "admin" {
+		t.Errorf("status %+v", s)
+	}
+
+	var none *Gate
+	if none.Ready() != nil || none.Standby() {
+		t.Error("nil gate not active")
+	}
+}
+
+func TestElection(t *testing.T) {
+	store := cache.NewFSStore(t.TempDir(), 0)
+	ttl := 60 * time.Millisecond
+	primary := &Election{Gate: New(true), Store: store, ID: "a", TTL: ttl}
+	standby := &Election{Gate: New(true), Store: store, ID: "b", TTL: ttl}
+
+	ctx, stopPrimary := context.WithCancel(context.Background())
+	primaryDone := make(chan error)
+	go func() { primaryDone <- primary.Run(ctx) }()
+	waitFor(t, "first instance to take the lease", func() bool { return !primary.Gate.Standby() })
+
+	ctx, stopStandby := context.WithCancel(context.Background())
+	defer stopStandby()
+	go standby.Run(ctx)
+	time.Sleep(2 * ttl)
+	if !standby.Gate.Standby() {
+		t.Fatal("second instance promoted while the lease was held")
+	}
+
+	// Shutting down gives the lease up.
+	stopPrimary()
+	<-primaryDone
+	waitFor(t, "standby to take over", func() bool { return !standby.Gate.Standby() })
+	if s := standby.Gate.Status(); s.Trigger != "leader_election" {
+		t.Errorf("status %+v", s)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,167 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Inflight tracks cache fills currently streaming from upstream, so operators
+// can see why the proxy is busy and cancel fills that have stalled.
+type Inflight struct {
+	mu     sync.Mutex
+	nextID uint64
+	fills  map[string]*Fill
+}
+
+// NewInflight returns an empty registry.
+func NewInflight() *Inflight {
+	return &Inflight{fills: make(map[string]*Fill)}
+}
+
+// Fill is a single in-progress upstream fetch being teed into the cache.
+type Fill struct {
+	ID            string
+	Key           string
+	Source        string // upstream URL
+	Started       time.Time
+	ExpectedBytes int64 // -1 when upstream sent no Content-Length
+
+	bytes   atomic.Int64
+	clients atomic.Int32 // requests being served by the fill
+	cancel  context.CancelFunc
+	reg     *Inflight
+}
+
+// FillStatus is a point-in-time snapshot of a Fill for reporting.
+type FillStatus struct {
+	ID            string    `json:"id"`
+	Key           string    `json:"key"`
+	Source        string    `json:"source"`
+	Started       time.Time `json:"started"`
+	ElapsedSec    float64   `json:"elapsed_seconds"`
+	Bytes         int64     `json:"bytes"`
+	ExpectedBytes int64     `json:"expected_bytes"`
+	Clients       int32     `json:"clients"`
+}
+
+// Start registers a fill, with the request that started it as its one
+// client. cancel aborts the fill's upstream request; the caller must call
+// Done when the fill finishes.
+func (in *Inflight) Start(key, source string, expected int64, cancel context.CancelFunc) *Fill {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.nextID++
+	f := &Fill{
+		ID:            strconv.FormatUint(in.nextID, 10),
+		Key:           key,
+		Source:        source,
+		Started:       time.Now(),
+		ExpectedBytes: expected,
+		cancel:        cancel,
+		reg:           in,
+	}
+	f.clients.Store(1)
+	in.fills[f.ID] = f
+	return f
+}
+
+// List returns the current fills, oldest first.
+func (in *Inflight) List() []FillStatus {
+	in.mu.Lock()
+	out := make([]FillStatus, 0, len(in.fills))
+	for _, f := range in.fills {
+		out = append(out, f.Status())
+	}
+	in.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b FillStatus) int { return a.Started.Compare(b.Started) })
+	return out
+}
+
+// Cancel aborts the fill with the given ID. It reports false if no such
+// fill is in progress.
+func (in *Inflight) Cancel(id string) bool {
+	in.mu.Lock()
+	f, ok := in.fills[id]
+	in.mu.Unlock()
+	if !ok {
+		return false
+	}
+	f.cancel()
+	return true
+}
+
+// Done removes the fill from the registry.
+func (f *Fill) Done() {
+	f.reg.mu.Lock()
+	delete(f.reg.fills, f.ID)
+	f.reg.mu.Unlock()
+}
+
+// Join counts another request waiting on the fill; it must call Leave
+// once it stops waiting.
+func (f *Fill) Join() {
+	f.clients.Add(1)
+}
+
+// Leave stops counting a request the fill was serving, such as one whose
+// client went away while the fill carries on into the cache.
+func (f *Fill) Leave() {
+	f.clients.Add(-1)
+}
+
+// Status returns a snapshot of the fill's progress.
+func (f *Fill) Status() FillStatus {
+	return FillStatus{
+		ID:            f.ID,
+		Key:           f.Key,
+		Source:        f.Source,
+		Started:       f.Started,
+		ElapsedSec:    time.Since(f.Started).Seconds(),
+		Bytes:         f.bytes.Load(),
+		ExpectedBytes: f.ExpectedBytes,
+		Clients:       f.clients.Load(),
+	}
+}
+
+// Reader wraps r so bytes read through it are counted as fill progress.
+func (f *Fill) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, f: f}
+}
+
+// Writer wraps the starting request's client w so that the request
+// leaves the fill when a write to its client fails.
+func (f *Fill) Writer(w io.Writer) io.Writer {
+	return &clientLeaver{w: w, f: f}
+}
+
+type clientLeaver struct {
+	w    io.Writer
+	f    *Fill
+	left bool
+}
+
+func (c *clientLeaver) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil && !c.left {
+		c.left = true
+		c.f.Leave()
+	}
+	return n, err
+}
+
+type progressReader struct {
+	r io.Reader
+	f *Fill
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.f.bytes.Add(int64(n))
+	return n, err
+}
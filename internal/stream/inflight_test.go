@@ -0,0 +1,64 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestInflight(t *testing.T) {
+	in := NewInflight()
+	var cancelled bool
+	f := in.Start("blobs/sha256-a", "https://registry.test/v2/app/blobs/sha256:a", 10, func() { cancelled = true })
+	in.Start("blobs/sha256-b", "https://registry.test/v2/app/blobs/sha256:b", -1, func() {})
+
+	if _, err := io.Copy(io.Discard, f.Reader(strings.NewReader("12345"))); err != nil {
+		t.Fatal(err)
+	}
+	fills := in.List()
+	if len(fills) != 2 || fills[0].ID != f.ID {
+		t.Fatalf("fills = %+v, want both, oldest first", fills)
+	}
+	if s := fills[0]; s.Key != "blobs/sha256-a" || s.Bytes != 5 || s.ExpectedBytes != 10 || s.Clients != 1 {
+		t.Errorf("snapshot %+v", s)
+	}
+
+	// Requests joining and leaving the fill are counted.
+	f.Join()
+	f.Join()
+	f.Leave()
+	if c := f.Status().Clients; c != 2 {
+		t.Errorf("clients after two joins and a leave = %d, want 2", c)
+	}
+
+	if in.Cancel("missing") {
+		t.Error("cancelled a fill that doesn't exist")
+	}
+	if !in.Cancel(f.ID) || !cancelled {
+		t.Error("fill not cancelled")
+	}
+
+	f.Done()
+	if fills := in.List(); len(fills) != 1 || fills[0].Key != "blobs/sha256-b" {
+		t.Errorf("fills after Done = %+v", fills)
+	}
+	if in.Cancel(f.ID) {
+		t.Error("cancelled a finished fill")
+	}
+}
+
+// failWriter fails every write, like a client that has gone away.
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errors.New("client gone") }
+
+func TestFillWriterLeavesOnce(t *testing.T) {
+	f := NewInflight().Start("k", "src", -1, func() {})
+	w := f.Writer(failWriter{})
+	w.Write([]byte("a"))
+	w.Write([]byte("b"))
+	if c := f.Status().Clients; c != 0 {
+		t.Errorf("clients after the client went away = %d, want 0", c)
+	}
+}
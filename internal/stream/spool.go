@@ -0,0 +1,187 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var spooledFills = metrics.NewCounterVec("oci_spooled_fills_total",
+	"Fills downloaded into a spool and served to their client from it, by where the spool was kept (memory, file).", "medium")
+
+// Spools reports whether a fill of length bytes, or -1 if unknown, is
+// spooled (see SpoolToStore), and if so whether in memory rather than in
+// a file. Only fills of known length are spooled.
+func (u *Uploads) Spools(length int64) (spool, inMemory bool) {
+	if u == nil || length < 0 || length > u.SpoolBytes {
+		return false, false
+	}
+	return true, length <= u.SpoolMemoryBytes
+}
+
+// SpoolToStore fills the cache like TeeToStore, but from a spool rather
+// than in step with the client: the upstream body is read as fast as it
+// arrives into the spool, and on into the store, while the client is
+// served from the spool at its own pace. A slow client then holds neither
+// the upstream connection nor the cache fill open. The spool is held in
+// memory when Spools says so, and in a temporary file in SpoolDir
+// otherwise; if that can't be created the fill is teed instead.
+//
+// The client's bytes end at meta.ContentLength, which must be known. A
+// client that goes away leaves the fill to finish as TeeToStore's would.
+func (u *Uploads) SpoolToStore(ctx context.Context, src io.Reader, dst io.Writer, store cache.Store, key string, meta cache.ObjectMeta, digest string) error {
+	_, inMemory := u.Spools(meta.ContentLength)
+	sp, err := newSpool(u.SpoolDir, meta.ContentLength, inMemory)
+	if err != nil {
+		slog.Warn("creating fill spool failed, streaming instead", "key", key, "error", err)
+		return u.TeeToStore(ctx, src, dst, store, key, meta, digest)
+	}
+	defer sp.remove()
+	if inMemory {
+		spooledFills.Inc("memory")
+	} else {
+		spooledFills.Inc("file")
+	}
+
+	// The spool stands in for the client in the tee, so the download never
+	// waits on it.
+	filled := make(chan error, 1)
+	go func() {
+		err := u.TeeToStore(ctx, src, sp, store, key, meta, digest)
+		sp.closeWithError(err)
+		filled <- err
+	}()
+
+	_, copyErr := io.Copy(dst, io.LimitReader(&spoolReader{s: sp}, meta.ContentLength))
+	if copyErr != nil {
+		// The client went away: the tee's next write to the spool fails,
+		// and it finishes or abandons the fill as for a client of its own.
+		sp.abandon()
+	}
+	fillErr := <-filled
+	if copyErr == nil {
+		copyErr = fillErr
+	}
+	return copyErr
+}
+
+// spool buffers a fill for its client: in memory, or in a file read back
+// at the client's offset. It has one writer and one reader.
+type spool struct {
+	file *os.File // nil in memory
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	mem       []byte
+	written   int64
+	closed    bool
+	err       error
+	abandoned bool
+}
+
+func newSpool(dir string, length int64, inMemory bool) (*spool, error) {
+	s := &spool{}
+	s.cond = sync.NewCond(&s.mu)
+	if inMemory {
+		s.mem = make([]byte, 0, length)
+		return s, nil
+	}
+	f, err := os.CreateTemp(dir, "oci-fill-*")
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+// Write appends p for the reader, failing once the reader has gone.
+func (s *spool) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	abandoned := s.abandoned
+	s.mu.Unlock()
+	if abandoned {
+		return 0, errClientGone
+	}
+	n := len(p)
+	if s.file != nil {
+		// Only the writer moves the file offset; the reader uses ReadAt.
+		var err error
+		if n, err = s.file.Write(p); err != nil {
+			return n, err
+		}
+	}
+	s.mu.Lock()
+	if s.file == nil {
+		s.mem = append(s.mem, p...)
+	}
+	s.written += int64(n)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return n, nil
+}
+
+// closeWithError ends the spool: the reader sees err once it has read
+// everything written, or EOF if err is nil.
+func (s *spool) closeWithError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed, s.err = true, err
+	s.cond.Broadcast()
+}
+
+// abandon fails the writer's next write, as the reader has gone.
+func (s *spool) abandon() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.abandoned = true
+}
+
+func (s *spool) remove() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
+
+// spoolReader reads a spool from the start, waiting for the writer to
+// catch up.
+type spoolReader struct {
+	s   *spool
+	off int64
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	s := r.s
+	s.mu.Lock()
+	for r.off >= s.written && !s.closed {
+		s.cond.Wait()
+	}
+	avail := s.written - r.off
+	if avail == 0 {
+		err := s.err
+		s.mu.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	p = p[:min(int64(len(p)), avail)]
+	if s.file == nil {
+		n := copy(p, s.mem[r.off:])
+		s.mu.Unlock()
+		r.off += int64(n)
+		return n, nil
+	}
+	s.mu.Unlock()
+	n, err := s.file.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
@@ -4,10 +4,11 @@ import (
 	"context"
 	"io"
 	"log/slog"
-	"net/http"
 	"sync/atomic"
 
 	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/recovery"
+	"github.com/danielloader/oci-pull-through/internal/tracing"
 )
 
 // TeeToStore streams the upstream response body to the HTTP client while
@@ -15,14 +16,44 @@ import (
 // best-effort: if the upload fails, the client still receives all bytes
 // uninterrupted.
 //
+// When digest is set, the content is hashed as it streams and the upload
+// only completes if it matches; otherwise it is aborted, so a corrupted
+// or truncated upstream response is never committed, and
+// ErrDigestMismatch is returned. The client has already been sent the
+// bytes by then and is left to verify them itself.
+//
+// The upload runs under u's context rather than ctx's (see Uploads). If
+// that ends first the upload is abandoned and the client stream carries
+// on without it. If instead the client goes away, the rest of the fill is
+// read into the cache when u finishes abandoned fills (see
+// Uploads.FinishBytes), so the next pull is a hit; ctx should then come
+// from Uploads.FetchContext, so the upstream read outlives the client.
+//
 // The flow:
 //
 //	upstream.Body → TeeReader → io.Copy(w, tee) → client
 //	                   │
 //	                   └→ safeWriter → PipeWriter → PipeReader → store.Put
-func TeeToStore(ctx context.Context, src io.Reader, dst http.ResponseWriter, store cache.Store, key string, meta cache.ObjectMeta) error {
+func (u *Uploads) TeeToStore(ctx context.Context, src io.Reader, dst io.Writer, store cache.Store, key string, meta cache.ObjectMeta, digest string) error {
+	ctx, span := tracing.Start(ctx, "cache.tee")
+	defer span.End()
+	span.SetAttr("cache.key", key)
 	pr, pw := io.Pipe()
 
+	// Under a store limit the upload is dropped rather than left to stall
+	// the client behind it.
+	uploadCtx, cancel := u.context(cache.WithShedding(ctx))
+	defer cancel()
+	// A store that blocks without watching its context still lets go of
+	// the pipe, so the client isn't held up behind an abandoned upload.
+	stop := context.AfterFunc(uploadCtx, func() { pr.CloseWithError(context.Cause(uploadCtx)) })
+	defer stop()
+
+	digester := newDigester(digest)
+	if digester != nil {
+		src = io.TeeReader(src, digester)
+	}
+
 	// Wrap the pipe writer so errors never propagate to the TeeReader.
 	// If the store stops reading or the pipe errors, writes are silently discarded.
 	sw := &safeWriter{w: pw}
@@ -34,8 +65,12 @@ func TeeToStore(ctx context.Context, src io.Reader, dst http.ResponseWriter, sto
 		defer close(uploadDone)
 		// Wrap the PipeReader to hide its concrete type from store
 		// implementations that may treat *io.PipeReader specially.
-		err := store.Put(context.Background(), key, readerOnly{pr}, meta)
+		err := recovery.Do("cache-upload", func() error {
+			return store.Put(uploadCtx, key, readerOnly{pr}, meta)
+		})
+		span.SetAttr("cache.stored", err == nil)
 		if err != nil {
+			countAborted(uploadCtx)
 			slog.Debug("cache upload failed", "key", key, "error", err)
 			// Drain the pipe so writes from the TeeReader don't block.
 			io.Copy(io.Discard, pr)
@@ -45,15 +80,86 @@ func TeeToStore(ctx context.Context, src io.Reader, dst http.ResponseWriter, sto
 	}()
 
 	// Drive both streams: copy to the client, which also feeds the pipe.
-	_, copyErr := io.Copy(dst, tee)
+	cr := &countingReader{r: tee}
+	cw := &clientWriter{w: dst}
+	n, copyErr := io.Copy(cw, cr)
+	span.SetAttr("cache.bytes", n)
+	fillErr := copyErr
+	if cw.err != nil && !sw.failed.Load() {
+		fillErr = u.finish(cr, meta.ContentLength)
+		span.SetAttr("cache.finished", fillErr == nil)
+	}
+	if fillErr == nil && digester != nil {
+		fillErr = digester.Verify()
+	}
 
-	// Signal EOF to the store uploader and wait for it to finish.
-	pw.Close()
+	// Signal EOF to the store uploader and wait for it to finish. If the
+	// fill failed (upstream error, client gone, fill cancelled) or the
+	// content didn't match its digest, the upload is aborted instead, so a
+	// truncated or corrupted object is never committed.
+	if fillErr != nil {
+		pw.CloseWithError(fillErr)
+	} else {
+		pw.Close()
+	}
 	<-uploadDone
 
+	if copyErr == nil {
+		copyErr = fillErr
+	}
+	span.SetError(copyErr)
 	return copyErr
 }
 
+// finish reads the rest of a fill whose client went away into the cache,
+// within u's budget. length is the fill's, or -1 if unknown.
+func (u *Uploads) finish(cr *countingReader, length int64) error {
+	if u == nil || u.FinishBytes <= 0 {
+		return errClientGone
+	}
+	if length >= 0 && length-cr.n > u.FinishBytes {
+		abandonedFills.Inc("over_budget")
+		return errClientGone
+	}
+	m, err := io.Copy(io.Discard, io.LimitReader(cr, u.FinishBytes+1))
+	switch {
+	case err != nil:
+		abandonedFills.Inc("failed")
+		return err
+	case m > u.FinishBytes:
+		abandonedFills.Inc("over_budget")
+		return errClientGone
+	}
+	abandonedFills.Inc("finished")
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// clientWriter remembers the error writing to the client failed with.
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
 // readerOnly wraps an io.Reader to hide its concrete type.
 type readerOnly struct{ io.Reader }
 
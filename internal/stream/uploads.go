@@ -0,0 +1,126 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var (
+	// ErrUploadTimeout ends cache uploads that run past Uploads' timeout.
+	ErrUploadTimeout = errors.New("cache upload timed out")
+	// ErrShuttingDown ends cache uploads still running when shutdown can
+	// no longer wait for them.
+	ErrShuttingDown = errors.New("cache upload aborted: shutting down")
+)
+
+// errClientGone aborts the upload of a fill whose client went away.
+var errClientGone = errors.New("client went away before the fill completed")
+
+var (
+	uploadsAborted = metrics.NewCounterVec("oci_cache_uploads_aborted_total",
+		"Cache uploads cut short by their own bounds, by reason (timeout, shutdown).", "reason")
+	abandonedFills = metrics.NewCounterVec("oci_abandoned_fills_total",
+		"Fills whose client went away, read on into the cache, by outcome (finished, over_budget, failed).", "outcome")
+)
+
+// Uploads bounds the context cache uploads run under. An upload outlives
+// the request that started it being cancelled, as the tee decides from
+// the copy's outcome whether to commit it, but it is cut off after a
+// timeout, and when the process is shutting down and can't wait any
+// longer, so a slow store can't hang either. A nil *Uploads detaches
+// uploads without bounding them.
+type Uploads struct {
+	// FinishBytes, when positive, lets a fill whose client went away read
+	// on into the cache, if no more than this many bytes of it remain.
+	FinishBytes int64
+	// FinishTimeout bounds how long such a fill reads on after its client
+	// went away.
+	FinishTimeout time.Duration
+
+	// SpoolBytes, when positive, spools fills of known length up to this
+	// size rather than teeing them, so slow clients don't slow them; see
+	// SpoolToStore. Those up to SpoolMemoryBytes are spooled in memory,
+	// larger ones in a temporary file in SpoolDir, or the system's
+	// temporary directory if empty.
+	SpoolBytes       int64
+	SpoolMemoryBytes int64
+	SpoolDir         string
+
+	timeout time.Duration
+	ctx     context.Context
+	abort   context.CancelCauseFunc
+}
+
+// NewUploads returns an Uploads ending each upload after timeout, or
+// never if it is zero.
+func NewUploads(timeout time.Duration) *Uploads {
+	ctx, abort := context.WithCancelCause(context.Background())
+	return &Uploads{timeout: timeout, ctx: ctx, abort: abort}
+}
+
+// AbortAfter cancels every upload still running, and any started later,
+// after grace. Call it when shutdown begins.
+func (u *Uploads) AbortAfter(grace time.Duration) {
+	if u == nil {
+		return
+	}
+	time.AfterFunc(grace, func() { u.abort(ErrShuttingDown) })
+}
+
+// FetchContext returns the context to fetch a fill from upstream under.
+// It ends with the request's, except that when abandoned fills are
+// finished (FinishBytes) a client going away leaves it FinishTimeout
+// longer. The request's deadline, and shutdown, still end it.
+func (u *Uploads) FetchContext(req context.Context) (context.Context, context.CancelFunc) {
+	if u == nil || u.FinishBytes <= 0 {
+		return context.WithCancel(req)
+	}
+	base, stopDeadline := context.WithoutCancel(req), context.CancelFunc(func() {})
+	if deadline, ok := req.Deadline(); ok {
+		base, stopDeadline = context.WithDeadline(base, deadline)
+	}
+	ctx, cancel := context.WithCancelCause(base)
+	stopReq := context.AfterFunc(req, func() {
+		time.AfterFunc(u.FinishTimeout, func() { cancel(errClientGone) })
+	})
+	stopShutdown := context.AfterFunc(u.ctx, func() { cancel(context.Cause(u.ctx)) })
+	return ctx, func() {
+		stopReq()
+		stopShutdown()
+		cancel(nil)
+		stopDeadline()
+	}
+}
+
+// context derives an upload's context from parent, keeping its values,
+// such as the trace span, but not its cancellation.
+func (u *Uploads) context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx := context.WithoutCancel(parent)
+	if u == nil {
+		return context.WithCancel(ctx)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(u.ctx, func() { cancel(context.Cause(u.ctx)) })
+	cancelTimeout := context.CancelFunc(func() {})
+	if u.timeout > 0 {
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, u.timeout, ErrUploadTimeout)
+	}
+	return ctx, func() {
+		cancelTimeout()
+		stop()
+		cancel(nil)
+	}
+}
+
+// countAborted counts an upload that ctx's bounds cut short.
+func countAborted(ctx context.Context) {
+	switch context.Cause(ctx) {
+	case ErrUploadTimeout:
+		uploadsAborted.Inc("timeout")
+	case ErrShuttingDown:
+		uploadsAborted.Inc("shutdown")
+	}
+}
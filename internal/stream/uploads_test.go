@@ -0,0 +1,265 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+)
+
+// putFunc is a store whose Put is fn.
+type putFunc struct {
+	cache.Store
+	fn func(ctx context.Context, body io.Reader) error
+}
+
+func (p putFunc) Put(ctx context.Context, _ string, body io.Reader, _ cache.ObjectMeta) error {
+	return p.fn(ctx, body)
+}
+
+func TestTeeOutlivesRequest(t *testing.T) {
+	var stored bytes.Buffer
+	store := putFunc{fn: func(ctx context.Context, body io.Reader) error {
+		if _, err := io.Copy(&stored, body); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var client bytes.Buffer
+	if err := NewUploads(time.Minute).TeeToStore(ctx, strings.NewReader("layer"), &client, store, "k", cache.ObjectMeta{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if stored.String() != "layer" || client.String() != "layer" {
+		t.Errorf("stored %q, sent %q; want both complete", stored.String(), client.String())
+	}
+}
+
+func TestTeeUploadTimeout(t *testing.T) {
+	// A store that never reads its body, and only gives up when its
+	// context ends.
+	var cause error
+	store := putFunc{fn: func(ctx context.Context, _ io.Reader) error {
+		<-ctx.Done()
+		cause = context.Cause(ctx)
+		return ctx.Err()
+	}}
+	var client bytes.Buffer
+	start := time.Now()
+	err := NewUploads(20*time.Millisecond).TeeToStore(context.Background(), strings.NewReader("layer"), &client, store, "k", cache.ObjectMeta{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.String() != "layer" {
+		t.Errorf("client got %q", client.String())
+	}
+	if !errors.Is(cause, ErrUploadTimeout) {
+		t.Errorf("upload ended with %v, want ErrUploadTimeout", cause)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("tee took %s", d)
+	}
+}
+
+func TestTeeAbortedOnShutdown(t *testing.T) {
+	var cause error
+	store := putFunc{fn: func(ctx context.Context, body io.Reader) error {
+		_, err := io.Copy(io.Discard, body)
+		<-ctx.Done()
+		cause = context.Cause(ctx)
+		return errors.Join(err, ctx.Err())
+	}}
+	u := NewUploads(0)
+	u.AbortAfter(20 * time.Millisecond)
+	if err := u.TeeToStore(context.Background(), strings.NewReader("layer"), io.Discard, store, "k", cache.ObjectMeta{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(cause, ErrShuttingDown) {
+		t.Errorf("upload ended with %v, want ErrShuttingDown", cause)
+	}
+
+	// Uploads started after the abort end straight away.
+	if err := u.TeeToStore(context.Background(), strings.NewReader("layer"), io.Discard, store, "k", cache.ObjectMeta{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(cause, ErrShuttingDown) {
+		t.Errorf("later upload ended with %v, want ErrShuttingDown", cause)
+	}
+}
+
+// brokenClient accepts limit bytes and then fails, as a client that went
+// away does.
+type brokenClient struct{ limit int }
+
+func (b *brokenClient) Write(p []byte) (int, error) {
+	if len(p) > b.limit {
+		n := b.limit
+		b.limit = 0
+		return n, errors.New("broken pipe")
+	}
+	b.limit -= len(p)
+	return len(p), nil
+}
+
+func TestTeeFinishesAbandonedFill(t *testing.T) {
+	body := strings.Repeat("x", 100<<10)
+	for _, tc := range []struct {
+		name        string
+		finishBytes int64
+		length      int64
+		stored      bool
+	}{
+		{"off", 0, int64(len(body)), false},
+		{"within budget", 1 << 20, int64(len(body)), true},
+		{"within budget, unknown length", 1 << 20, -1, true},
+		{"over budget", 10 << 10, int64(len(body)), false},
+		{"over budget, unknown length", 10 << 10, -1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var stored bytes.Buffer
+			store := putFunc{fn: func(_ context.Context, r io.Reader) error {
+				_, err := io.Copy(&stored, r)
+				return err
+			}}
+			u := NewUploads(0)
+			u.FinishBytes = tc.finishBytes
+			meta := cache.ObjectMeta{ContentLength: tc.length}
+			// Hide WriteTo so the copy is buffered and fails part way.
+			src := io.LimitReader(strings.NewReader(body), int64(len(body)))
+			err := u.TeeToStore(context.Background(), src, &brokenClient{limit: 1000}, store, "k", meta, "")
+			if err == nil {
+				t.Fatal("no error for the client that went away")
+			}
+			if got := stored.String() == body; got != tc.stored {
+				t.Errorf("stored %d of %d bytes, want cached %v", stored.Len(), len(body), tc.stored)
+			}
+		})
+	}
+}
+
+func TestFetchContext(t *testing.T) {
+	u := NewUploads(0)
+	u.FinishBytes = 1
+	u.FinishTimeout = 30 * time.Millisecond
+
+	req, cancelReq := context.WithCancel(context.Background())
+	ctx, cancel := u.FetchContext(req)
+	defer cancel()
+	cancelReq()
+	select {
+	case <-ctx.Done():
+		t.Fatal("fetch ended with its client")
+	case <-time.After(10 * time.Millisecond):
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("fetch outlived FinishTimeout")
+	}
+
+	// A request out of budget ends the fetch with it.
+	req, cancelReq = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelReq()
+	ctx, cancel = u.FetchContext(req)
+	defer cancel()
+	<-ctx.Done()
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("fetch ended with %v, want DeadlineExceeded", ctx.Err())
+	}
+}
+
+// gatedClient blocks its first write until open is closed.
+type gatedClient struct {
+	open chan struct{}
+	buf  bytes.Buffer
+}
+
+func (g *gatedClient) Write(p []byte) (int, error) {
+	<-g.open
+	return g.buf.Write(p)
+}
+
+func TestSpoolOutpacesClient(t *testing.T) {
+	body := strings.Repeat("x", 100<<10)
+	for _, tc := range []struct {
+		name        string
+		memoryBytes int64
+	}{
+		{"memory", 1 << 20},
+		{"file", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stored := make(chan string, 1)
+			store := putFunc{fn: func(_ context.Context, r io.Reader) error {
+				b, err := io.ReadAll(r)
+				stored <- string(b)
+				return err
+			}}
+			u := NewUploads(0)
+			u.SpoolBytes = 1 << 20
+			u.SpoolMemoryBytes = tc.memoryBytes
+			u.SpoolDir = t.TempDir()
+			if spool, _ := u.Spools(int64(len(body))); !spool {
+				t.Fatal("fill not spooled")
+			}
+
+			client := &gatedClient{open: make(chan struct{})}
+			done := make(chan error)
+			meta := cache.ObjectMeta{ContentLength: int64(len(body))}
+			go func() {
+				done <- u.SpoolToStore(context.Background(), strings.NewReader(body), client, store, "k", meta, "")
+			}()
+			// The fill reaches the store while the client hasn't read a byte.
+			select {
+			case got := <-stored:
+				if got != body {
+					t.Fatalf("stored %d of %d bytes", len(got), len(body))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("fill waited on its client")
+			}
+			close(client.open)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if client.buf.String() != body {
+				t.Errorf("client got %d of %d bytes", client.buf.Len(), len(body))
+			}
+		})
+	}
+}
+
+func TestSpoolClientGone(t *testing.T) {
+	body := strings.Repeat("x", 100<<10)
+	// A source that delivers the body only after the client has gone.
+	pr, pw := io.Pipe()
+	var stored bytes.Buffer
+	store := putFunc{fn: func(_ context.Context, r io.Reader) error {
+		_, err := io.Copy(&stored, r)
+		return err
+	}}
+	u := NewUploads(0)
+	u.SpoolBytes = 1 << 20
+	u.SpoolMemoryBytes = 1 << 20
+	meta := cache.ObjectMeta{ContentLength: int64(len(body))}
+	go func() {
+		pw.Write([]byte(body[:10<<10]))
+		time.Sleep(20 * time.Millisecond)
+		pw.Write([]byte(body[10<<10:]))
+		pw.Close()
+	}()
+	if err := u.SpoolToStore(context.Background(), pr, &brokenClient{limit: 1000}, store, "k", meta, ""); err == nil {
+		t.Fatal("no error for the client that went away")
+	}
+	pr.Close()
+	if stored.Len() == len(body) {
+		t.Error("fill committed after its client went away without FinishBytes")
+	}
+}
@@ -0,0 +1,20 @@
+package stream
+
+import (
+	"github.com/danielloader/oci-pull-through/internal/digest"
+)
+
+// ErrDigestMismatch is returned by TeeToStore when the streamed content
+// doesn't hash to the expected digest. The cache write is aborted.
+var ErrDigestMismatch = digest.ErrMismatch
+
+// newDigester returns a verifier for d, or nil when d is empty or not a
+// digest the proxy can verify; such content is passed through unverified.
+// Requests for unsupported algorithms are rejected before they get here.
+func newDigester(d string) *digest.Verifier {
+	v, err := digest.NewVerifier(d)
+	if err != nil {
+		return nil
+	}
+	return v
+}
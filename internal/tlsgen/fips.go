@@ -0,0 +1,65 @@
+package tlsgen
+
+import (
+	"crypto/fips140"
+	"crypto/tls"
+	"errors"
+	"slices"
+)
+
+// fipsCipherSuites are the TLS 1.2 suites FIPS 140-3 approves: ECDHE key
+// exchange with AES-GCM. TLS 1.3 suites can't be configured; Go's FIPS
+// mode limits them to AES-GCM itself.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// fipsCurves are the approved NIST curves, in order of preference.
+var fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+// CheckFIPS returns an error unless the binary is running Go's FIPS 140-3
+// cryptographic module, i.e. was built with GOFIPS140 set or runs with
+// GODEBUG=fips140=on. Without it, restricting TLS settings alone doesn't
+// make the proxy's cryptography FIPS compliant.
+func CheckFIPS() error {
+	if !fips140.Enabled() {
+		return errors.New("the Go FIPS 140-3 module is not enabled; use the -fips build or set GODEBUG=fips140=on")
+	}
+	return nil
+}
+
+// RestrictFIPS limits c to FIPS-approved TLS: version 1.2 or later,
+// AES-GCM cipher suites and NIST curves. It applies to both servers and
+// clients. Stricter settings already in c are kept: cipher suites and
+// curves it names are narrowed to the approved ones, and it's an error if
+// none are.
+func RestrictFIPS(c *tls.Config) error {
+	if c.MinVersion < tls.VersionTLS12 {
+		c.MinVersion = tls.VersionTLS12
+	}
+	if c.CipherSuites = approved(c.CipherSuites, fipsCipherSuites); len(c.CipherSuites) == 0 {
+		return errors.New("none of the configured cipher suites is FIPS approved")
+	}
+	if c.CurvePreferences = approved(c.CurvePreferences, fipsCurves); len(c.CurvePreferences) == 0 {
+		return errors.New("none of the configured curves is FIPS approved")
+	}
+	return nil
+}
+
+// approved returns the members of configured that are in allowed, or all
+// of allowed if nothing is configured.
+func approved[T comparable](configured, allowed []T) []T {
+	if len(configured) == 0 {
+		return allowed
+	}
+	var out []T
+	for _, v := range configured {
+		if slices.Contains(allowed, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
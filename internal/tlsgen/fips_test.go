@@ -0,0 +1,42 @@
+package tlsgen
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+)
+
+func TestRestrictFIPSNarrows(t *testing.T) {
+	c := &tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}}
+	if err := RestrictFIPS(c); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(c.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}) || !slices.Equal(c.CurvePreferences, fipsCurves) {
+		t.Errorf("got suites %v, curves %v", c.CipherSuites, c.CurvePreferences)
+	}
+	if err := RestrictFIPS(&tls.Config{CurvePreferences: []tls.CurveID{tls.X25519}}); err == nil {
+		t.Error("X25519 alone accepted")
+	}
+}
+
+func TestRestrictFIPSDefaults(t *testing.T) {
+	// An empty config, as the upstream client starts with, gets every
+	// approved suite and curve.
+	c := &tls.Config{}
+	if err := RestrictFIPS(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.MinVersion != tls.VersionTLS12 || !slices.Equal(c.CipherSuites, fipsCipherSuites) || !slices.Equal(c.CurvePreferences, fipsCurves) {
+		t.Errorf("got version %x, suites %v, curves %v", c.MinVersion, c.CipherSuites, c.CurvePreferences)
+	}
+
+	// A stricter minimum version is kept.
+	c = &tls.Config{MinVersion: tls.VersionTLS13}
+	if err := RestrictFIPS(c); err != nil || c.MinVersion != tls.VersionTLS13 {
+		t.Errorf("got version %x, %v", c.MinVersion, err)
+	}
+
+	if err := RestrictFIPS(&tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}}); err == nil {
+		t.Error("ChaCha20 alone accepted")
+	}
+}
@@ -0,0 +1,123 @@
+package tlsgen
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerOptions narrow a listener's TLS settings from Go's defaults, for
+// deployments whose security baseline names versions, cipher suites and
+// curves. Zero values keep the defaults.
+type ServerOptions struct {
+	// MinVersion is "1.2" or "1.3".
+	MinVersion string
+	// CipherSuites are TLS 1.2 suite names as crypto/tls spells them,
+	// e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites can't
+	// be configured. Go chooses their order itself.
+	CipherSuites []string
+	// Curves are key exchange groups: X25519MLKEM768, X25519, P256, P384
+	// and P521. Go chooses their order itself.
+	Curves []string
+	// ALPN lists the protocols offered, h2 and http/1.1, in order of
+	// preference. Leaving h2 out serves HTTP/1.1 only.
+	ALPN []string
+}
+
+var curveNames = map[string]tls.CurveID{
+	"x25519mlkem768": tls.X25519MLKEM768,
+	"x25519":         tls.X25519,
+	"p256":           tls.CurveP256,
+	"p-256":          tls.CurveP256,
+	"p384":           tls.CurveP384,
+	"p-384":          tls.CurveP384,
+	"p521":           tls.CurveP521,
+	"p-521":          tls.CurveP521,
+}
+
+// Apply sets the options on c. Insecure cipher suites and unknown names
+// are errors, as are cipher suites alongside a 1.3 minimum, which would
+// never be used.
+func (o ServerOptions) Apply(c *tls.Config) error {
+	switch o.MinVersion {
+	case "":
+	case "1.2":
+		c.MinVersion = tls.VersionTLS12
+	case "1.3":
+		c.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("TLS version %q is not supported; use 1.2 or 1.3", o.MinVersion)
+	}
+	if c.MinVersion < tls.VersionTLS12 {
+		c.MinVersion = tls.VersionTLS12
+	}
+
+	if len(o.CipherSuites) > 0 {
+		if c.MinVersion == tls.VersionTLS13 {
+			return fmt.Errorf("cipher suites can't be set with a TLS 1.3 minimum")
+		}
+		c.CipherSuites = nil
+		for _, name := range o.CipherSuites {
+			i := slices.IndexFunc(tls.CipherSuites(), func(s *tls.CipherSuite) bool { return s.Name == name })
+			if i < 0 {
+				return fmt.Errorf("cipher suite %q is unknown or insecure", name)
+			}
+			s := tls.CipherSuites()[i]
+			if !slices.Contains(s.SupportedVersions, tls.VersionTLS12) {
+				return fmt.Errorf("cipher suite %s is TLS 1.3 only, and TLS 1.3 suites can't be configured", name)
+			}
+			c.CipherSuites = append(c.CipherSuites, s.ID)
+		}
+	}
+
+	if len(o.Curves) > 0 {
+		c.CurvePreferences = nil
+		for _, name := range o.Curves {
+			id, ok := curveNames[strings.ToLower(name)]
+			if !ok {
+				return fmt.Errorf("unknown curve %q", name)
+			}
+			c.CurvePreferences = append(c.CurvePreferences, id)
+		}
+	}
+
+	if len(o.ALPN) > 0 {
+		c.NextProtos = nil
+		for _, p := range o.ALPN {
+			if p != "h2" && p != "http/1.1" {
+				return fmt.Errorf("ALPN protocol %q is not supported; use h2 or http/1.1", p)
+			}
+			c.NextProtos = append(c.NextProtos, p)
+		}
+	}
+	return nil
+}
+
+// Protocols returns the HTTP versions to serve, for http.Server.Protocols.
+// net/http offers http/1.1 however ALPN is set, as Go clients need it.
+func (o ServerOptions) Protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(len(o.ALPN) == 0 || slices.Contains(o.ALPN, "h2"))
+	return p
+}
+
+// HSTS sets Strict-Transport-Security on responses to HTTPS requests, so
+// browsers and scanners see the listener insist on TLS. Plain HTTP
+// responses are left alone, as the header means nothing there.
+func HSTS(next http.Handler, maxAge time.Duration, includeSubdomains bool) http.Handler {
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
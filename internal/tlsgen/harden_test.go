@@ -0,0 +1,72 @@
+package tlsgen
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServerOptionsApply(t *testing.T) {
+	var c tls.Config
+	err := ServerOptions{
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+		Curves:       []string{"X25519", "P-384"},
+		ALPN:         []string{"http/1.1"},
+	}.Apply(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MinVersion != tls.VersionTLS12 || len(c.CipherSuites) != 2 || !slices.Equal(c.CurvePreferences, []tls.CurveID{tls.X25519, tls.CurveP384}) {
+		t.Errorf("got version %x, suites %v, curves %v", c.MinVersion, c.CipherSuites, c.CurvePreferences)
+	}
+
+	for name, o := range map[string]ServerOptions{
+		"old version":      {MinVersion: "1.1"},
+		"insecure suite":   {CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		"tls 1.3 suite":    {CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		"suites on 1.3":    {MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}},
+		"unknown curve":    {Curves: []string{"secp256k1"}},
+		"unknown protocol": {ALPN: []string{"h3"}},
+	} {
+		if err := o.Apply(&tls.Config{}); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestHardenedListener(t *testing.T) {
+	opts := ServerOptions{MinVersion: "1.3", ALPN: []string{"http/1.1"}}
+	srv := httptest.NewUnstartedServer(HSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 365*24*time.Hour, true))
+	srv.EnableHTTP2 = true
+	srv.Config.Protocols = opts.Protocols()
+	srv.TLS = new(tls.Config)
+	if err := opts.Apply(srv.TLS); err != nil {
+		t.Fatal(err)
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := srv.Client()
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 || resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("served %s over TLS %x, want HTTP/1.1 over 1.3", resp.Proto, resp.TLS.Version)
+	}
+	if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=31536000; includeSubDomains" {
+		t.Errorf("HSTS %q", got)
+	}
+
+	old := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	if conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), old); err == nil {
+		conn.Close()
+		t.Error("TLS 1.2 handshake succeeded with a 1.3 minimum")
+	}
+}
@@ -13,7 +13,9 @@ import (
 )
 
 // SelfSignedCert generates an in-memory self-signed TLS certificate valid for 10 years.
-func SelfSignedCert() (tls.Certificate, error) {
+// extraDNSNames are added to the certificate's SANs alongside the defaults.
+// The key is ECDSA P-256 signed with SHA-256, which FIPS 186-5 approves.
+func SelfSignedCert(extraDNSNames ...string) (tls.Certificate, error) {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return tls.Certificate{}, err
@@ -25,14 +27,15 @@ func SelfSignedCert() (tls.Certificate, error) {
 	}
 
 	tmpl := &x509.Certificate{
-		SerialNumber: serial,
-		Subject:      pkix.Name{CommonName: "oci-pull-through"},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
-		KeyUsage:     x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
-		DNSNames:     []string{"localhost", "host.docker.internal"},
+		SerialNumber:       serial,
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+		Subject:            pkix.Name{CommonName: "oci-pull-through"},
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:        []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:           append([]string{"localhost", "host.docker.internal"}, extraDNSNames...),
 	}
 
 	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
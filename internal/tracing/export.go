@@ -0,0 +1,366 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+const (
+	// queueSize bounds the spans waiting for export; past it new spans
+	// are dropped rather than holding up requests.
+	queueSize = 4096
+	// batchSize is the most spans sent in one export request.
+	batchSize = 512
+	// exportInterval is how often a partial batch is sent.
+	exportInterval = 5 * time.Second
+)
+
+var spansExported = metrics.NewCounterVec("oci_tracing_spans_total",
+	"Spans handed to the OTLP exporter, by outcome (exported, failed, dropped).", "outcome")
+
+// Config configures a Tracer.
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces URL, e.g.
+	// http://collector:4318/v1/traces.
+	Endpoint string
+	// Headers are sent with every export, e.g. for collector auth.
+	Headers map[string]string
+	// Resource describes this process; service.name should be set.
+	Resource map[string]string
+	Sampler  Sampler
+	Timeout  time.Duration
+}
+
+// Tracer batches ended spans and exports them from Run.
+type Tracer struct {
+	cfg     Config
+	sampler Sampler
+	client  *http.Client
+	queue   chan *Span
+}
+
+// New returns a Tracer for cfg. Spans are only exported while Run runs.
+func New(cfg Config) *Tracer {
+	if cfg.Sampler == nil {
+		cfg.Sampler = ParentBased(AlwaysOn)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return &Tracer{
+		cfg:     cfg,
+		sampler: cfg.Sampler,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		queue:   make(chan *Span, queueSize),
+	}
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		spansExported.Inc("dropped")
+	}
+}
+
+// Run exports spans in batches until ctx is cancelled, then sends what's
+// left and returns nil.
+func (t *Tracer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, batchSize)
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(ctx, batch); err != nil {
+			slog.Warn("exporting spans failed", "spans", len(batch), "error", err)
+			spansExported.Add(float64(len(batch)), "failed")
+		} else {
+			spansExported.Add(float64(len(batch)), "exported")
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) == batchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			// Spans from the last requests to drain are still queued.
+			final, cancel := context.WithTimeout(context.WithoutCancel(ctx), t.cfg.Timeout)
+			defer cancel()
+			for {
+				select {
+				case s := <-t.queue:
+					if batch = append(batch, s); len(batch) == batchSize {
+						flush(final)
+					}
+				default:
+					flush(final)
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// The OTLP JSON encoding: IDs are hex, 64-bit integers are strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string          `json:"traceId"`
+		SpanID       string          `json:"spanId"`
+		ParentSpanID string          `json:"parentSpanId,omitempty"`
+		Name         string          `json:"name"`
+		Kind         Kind            `json:"kind"`
+		Start        string          `json:"startTimeUnixNano"`
+		End          string          `json:"endTimeUnixNano"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		Status       otlpStatus      `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 2 is error
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		String *string  `json:"stringValue,omitempty"`
+		Int    *string  `json:"intValue,omitempty"`
+		Double *float64 `json:"doubleValue,omitempty"`
+		Bool   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+const scopeName = "github.com/danielloader/oci-pull-through"
+
+func (t *Tracer) encode(spans []*Span) otlpRequest {
+	var resource []otlpAttribute
+	for k, v := range t.cfg.Resource {
+		resource = append(resource, otlpAttribute{k, stringValue(v)})
+	}
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID: s.sc.TraceID.String(),
+			SpanID:  s.sc.SpanID.String(),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != (SpanID{}) {
+			o.ParentSpanID = s.parent.String()
+		}
+		for _, a := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttribute{a.key, encodeValue(a.value)})
+		}
+		if s.failed {
+			o.Status = otlpStatus{Code: 2, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: out}},
+	}}}
+}
+
+func stringValue(s string) otlpValue { return otlpValue{String: &s} }
+
+func encodeValue(v any) otlpValue {
+	switch v := v.(type) {
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{Int: &s}
+	case float64:
+		return otlpValue{Double: &v}
+	case bool:
+		return otlpValue{Bool: &v}
+	default:
+		return stringValue(v.(string))
+	}
+}
+
+// ConfigFromEnv reads the standard OpenTelemetry SDK variables. ok is
+// false if tracing isn't configured: no OTLP endpoint is set and
+// OTEL_TRACES_EXPORTER isn't otlp, or the SDK or exporter is disabled.
+func ConfigFromEnv() (cfg Config, ok bool, err error) {
+	if b, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); b {
+		return Config{}, false, nil
+	}
+	exporter := os.Getenv("OTEL_TRACES_EXPORTER")
+	switch exporter {
+	case "", "otlp":
+	case "none":
+		return Config{}, false, nil
+	default:
+		return Config{}, false, fmt.Errorf("OTEL_TRACES_EXPORTER: unsupported exporter %q (want otlp or none)", exporter)
+	}
+
+	cfg.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if cfg.Endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			cfg.Endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if cfg.Endpoint == "" {
+		if exporter == "" {
+			return Config{}, false, nil
+		}
+		cfg.Endpoint = "http://localhost:4318/v1/traces"
+	}
+	if _, err := url.ParseRequestURI(cfg.Endpoint); err != nil {
+		return Config{}, false, fmt.Errorf("OTLP traces endpoint: %w", err)
+	}
+
+	protocol := envFirst("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL")
+	if protocol != "" && protocol != "http/json" {
+		return Config{}, false, fmt.Errorf("OTLP protocol %q is not supported; set http/json", protocol)
+	}
+
+	cfg.Headers = make(map[string]string)
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		if err := parsePairs(os.Getenv(name), cfg.Headers); err != nil {
+			return Config{}, false, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	cfg.Resource = make(map[string]string)
+	if err := parsePairs(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"), cfg.Resource); err != nil {
+		return Config{}, false, fmt.Errorf("OTEL_RESOURCE_ATTRIBUTES: %w", err)
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		cfg.Resource["service.name"] = name
+	} else if cfg.Resource["service.name"] == "" {
+		cfg.Resource["service.name"] = "oci-pull-through"
+	}
+
+	if ms := envFirst("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", "OTEL_EXPORTER_OTLP_TIMEOUT"); ms != "" {
+		n, err := strconv.Atoi(ms)
+		if err != nil || n <= 0 {
+			return Config{}, false, fmt.Errorf("OTLP timeout %q is not a positive number of milliseconds", ms)
+		}
+		cfg.Timeout = time.Duration(n) * time.Millisecond
+	}
+
+	if cfg.Sampler, err = samplerFromEnv(os.Getenv("OTEL_TRACES_SAMPLER"), os.Getenv("OTEL_TRACES_SAMPLER_ARG")); err != nil {
+		return Config{}, false, err
+	}
+	return cfg, true, nil
+}
+
+func samplerFromEnv(name, arg string) (Sampler, error) {
+	ratio := 1.0
+	if arg != "" {
+		var err error
+		if ratio, err = strconv.ParseFloat(arg, 64); err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG: %q is not a ratio between 0 and 1", arg)
+		}
+	}
+	switch name {
+	case "always_on":
+		return AlwaysOn, nil
+	case "always_off":
+		return AlwaysOff, nil
+	case "traceidratio":
+		return TraceIDRatio(ratio), nil
+	case "", "parentbased_always_on":
+		return ParentBased(AlwaysOn), nil
+	case "parentbased_always_off":
+		return ParentBased(AlwaysOff), nil
+	case "parentbased_traceidratio":
+		return ParentBased(TraceIDRatio(ratio)), nil
+	}
+	return nil, fmt.Errorf("OTEL_TRACES_SAMPLER: unsupported sampler %q", name)
+}
+
+func envFirst(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parsePairs adds the comma-separated key=value pairs in s, with
+// percent-encoded values as the OTEL variables allow, to into.
+func parsePairs(s string, into map[string]string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return fmt.Errorf("%q is not key=value", pair)
+		}
+		v, err := url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		into[strings.TrimSpace(k)] = v
+	}
+	return nil
+}
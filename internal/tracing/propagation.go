@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+)
+
+const traceparentHeader = "Traceparent"
+
+// ParseTraceparent reads a W3C traceparent header value
+// ("00-<trace-id>-<parent-id>-<flags>").
+func ParseTraceparent(v string) (SpanContext, bool) {
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return SpanContext{}, false
+	}
+	// Later versions may append fields; version ff is forbidden.
+	version := v[:2]
+	if version == "ff" || (version == "00" && len(v) != 55) || (len(v) > 55 && v[55] != '-') {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(v[3:35])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(v[36:52])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(v[53:55])); err != nil {
+		return SpanContext{}, false
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	sc.Remote = true
+	return sc, true
+}
+
+// Traceparent formats sc as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// Extract returns ctx carrying the remote span context in h's
+// traceparent, if it has a valid one, as the parent for spans started
+// from it.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := ParseTraceparent(h.Get(traceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// Inject sets h's traceparent to the current span in ctx, so the
+// receiving service continues the trace.
+func Inject(ctx context.Context, h http.Header) {
+	if sc := FromContext(ctx); sc.IsValid() {
+		h.Set(traceparentHeader, sc.Traceparent())
+	}
+}
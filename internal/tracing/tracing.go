@@ -0,0 +1,221 @@
+// Package tracing records OpenTelemetry spans for the proxy's request
+// path and exports them over OTLP/HTTP (JSON) to a collector, configured
+// with the standard OTEL_* environment variables. Trace context is read
+// from and passed on in W3C traceparent headers.
+//
+// Instrumented code calls Start with no setup of its own: until a Tracer
+// is installed with SetDefault, Start returns a nil *Span, whose methods
+// do nothing, so tracing costs next to nothing when it's off.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	// Remote is set for a context read from an incoming request.
+	Remote bool
+}
+
+// IsValid reports whether both IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Kind is a span's role, as OTLP numbers them.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is one timed operation. A nil *Span is valid and records nothing.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent SpanID
+	name   string
+	kind   Kind
+	start  time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []attribute
+	errMsg string
+	failed bool
+	ended  bool
+}
+
+type attribute struct {
+	key   string
+	value any // string, int64, float64 or bool
+}
+
+var global atomic.Pointer[Tracer]
+
+// SetDefault installs t as the tracer Start records to. A nil t turns
+// tracing off.
+func SetDefault(t *Tracer) { global.Store(t) }
+
+type spanKey struct{}
+
+// Start begins an internal span called name, a child of the span in ctx,
+// and returns a context carrying it. End must be called on the span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal)
+}
+
+// StartKind is Start for a span of another kind.
+func StartKind(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	t := global.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	parent := FromContext(ctx)
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.parent = parent.SpanID
+	} else {
+		s.sc.TraceID = newTraceID()
+	}
+	s.sc.SpanID = newSpanID()
+	s.sc.Sampled = t.sampler(parent, s.sc.TraceID)
+	return context.WithValue(ctx, spanKey{}, s.sc), s
+}
+
+// FromContext returns the context of the current span in ctx, which may
+// be a remote parent set by Extract. It is invalid if there's none.
+func FromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanKey{}).(SpanContext)
+	return sc
+}
+
+// SpanContext returns the span's IDs.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttr records an attribute. Values other than strings, integers,
+// floats and bools are ignored.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case int64, float64, bool, string:
+	default:
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attribute{key, value})
+	s.mu.Unlock()
+}
+
+// SetError marks the span failed with err. A nil err, and context
+// cancellation, which is how clients going away surfaces, are ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	s.mu.Lock()
+	s.failed, s.errMsg = true, err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export if sampled. Calls after
+// the first do nothing, so End can be both deferred and called early.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+	if s.sc.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// Sampler decides whether a new span in trace id, under parent (which may
+// be invalid), is recorded.
+type Sampler func(parent SpanContext, id TraceID) bool
+
+// AlwaysOn records every span.
+func AlwaysOn(SpanContext, TraceID) bool { return true }
+
+// AlwaysOff records nothing.
+func AlwaysOff(SpanContext, TraceID) bool { return false }
+
+// TraceIDRatio records the given fraction of traces, deciding by trace
+// ID so that every process sampling at the same ratio agrees.
+func TraceIDRatio(ratio float64) Sampler {
+	if ratio >= 1 {
+		return AlwaysOn
+	}
+	if ratio <= 0 {
+		return AlwaysOff
+	}
+	bound := uint64(ratio * (1 << 63))
+	return func(_ SpanContext, id TraceID) bool {
+		return binary.BigEndian.Uint64(id[8:])>>1 < bound
+	}
+}
+
+// ParentBased follows the parent's decision, and root for spans without
+// one.
+func ParentBased(root Sampler) Sampler {
+	return func(parent SpanContext, id TraceID) bool {
+		if parent.IsValid() {
+			return parent.Sampled
+		}
+		return root(parent, id)
+	}
+}
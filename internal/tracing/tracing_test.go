@@ -0,0 +1,133 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(tp)
+	if !ok || !sc.Sampled || !sc.Remote {
+		t.Fatalf("ParseTraceparent(%q) = %+v, %v", tp, sc, ok)
+	}
+	if got := sc.Traceparent(); got != tp {
+		t.Errorf("round trip: got %q", got)
+	}
+	// A later version may append fields.
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !ok {
+		t.Error("future version rejected")
+	}
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Errorf("ParseTraceparent(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestStartAndPropagate(t *testing.T) {
+	ctx, span := Start(context.Background(), "off")
+	if span != nil {
+		t.Fatal("span recorded without a tracer")
+	}
+	span.SetAttr("k", "v") // nil spans are safe
+	span.End()
+
+	tracer := New(Config{Sampler: ParentBased(AlwaysOff)})
+	SetDefault(tracer)
+	defer SetDefault(nil)
+
+	h := http.Header{}
+	h.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := StartKind(Extract(ctx, h), "server", KindServer)
+	_, child := Start(ctx, "child")
+	if child.sc.TraceID != parent.sc.TraceID || child.parent != parent.sc.SpanID || !child.sc.Sampled {
+		t.Errorf("child %+v doesn't continue parent %+v", child.sc, parent.sc)
+	}
+	child.End()
+	child.End()
+	if len(tracer.queue) != 1 {
+		t.Errorf("queued %d spans for one End", len(tracer.queue))
+	}
+
+	out := http.Header{}
+	Inject(ctx, out)
+	if got, _ := ParseTraceparent(out.Get("Traceparent")); got.SpanID != parent.sc.SpanID {
+		t.Errorf("injected %q", out.Get("Traceparent"))
+	}
+
+	// Without a sampled parent, the root sampler decides.
+	if _, root := Start(context.Background(), "root"); root.sc.Sampled {
+		t.Error("root span sampled by always_off")
+	}
+}
+
+func TestTraceIDRatio(t *testing.T) {
+	s := TraceIDRatio(0.25)
+	var n int
+	for range 10000 {
+		if s(SpanContext{}, newTraceID()) {
+			n++
+		}
+	}
+	if n < 2200 || n > 2800 {
+		t.Errorf("sampled %d of 10000 at 0.25", n)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	if _, ok, err := ConfigFromEnv(); ok || err != nil {
+		t.Fatalf("enabled without an endpoint: %v, %v", ok, err)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "x-team=registry,authorization=Bearer%20abc")
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "deployment.environment=prod")
+	t.Setenv("OTEL_TRACES_SAMPLER", "parentbased_traceidratio")
+	t.Setenv("OTEL_TRACES_SAMPLER_ARG", "0.1")
+	cfg, ok, err := ConfigFromEnv()
+	if !ok || err != nil {
+		t.Fatalf("ConfigFromEnv: %v, %v", ok, err)
+	}
+	if cfg.Endpoint != "http://collector:4318/v1/traces" {
+		t.Errorf("endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Headers["authorization"] != "Bearer abc" || cfg.Headers["x-team"] != "registry" {
+		t.Errorf("headers %v", cfg.Headers)
+	}
+	if cfg.Resource["service.name"] != "oci-pull-through" || cfg.Resource["deployment.environment"] != "prod" {
+		t.Errorf("resource %v", cfg.Resource)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://traces:4318/custom")
+	if cfg, _, _ := ConfigFromEnv(); cfg.Endpoint != "http://traces:4318/custom" {
+		t.Errorf("traces endpoint not used as is: %q", cfg.Endpoint)
+	}
+
+	for name, value := range map[string]string{
+		"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc",
+		"OTEL_TRACES_SAMPLER":         "sometimes",
+		"OTEL_TRACES_SAMPLER_ARG":     "2",
+		"OTEL_TRACES_EXPORTER":        "zipkin",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, _, err := ConfigFromEnv(); err == nil {
+				t.Errorf("%s=%s accepted", name, value)
+			}
+		})
+	}
+
+	t.Setenv("OTEL_SDK_DISABLED", "true")
+	if _, ok, _ := ConfigFromEnv(); ok {
+		t.Error("enabled with OTEL_SDK_DISABLED")
+	}
+}
@@ -0,0 +1,283 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() { Register("acr", newACR) }
+
+// imdsTokenURL is the Azure Instance Metadata Service token endpoint, used
+// for managed identities.
+var imdsTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// aadResource is the audience ACR expects of the AAD token it exchanges.
+const aadResource = "https://management.azure.com/"
+
+// acrTokenTTL is assumed for tokens whose expiry can't be read.
+const acrTokenTTL = time.Hour
+
+type acrOptions struct {
+	Type string `json:"type"`
+	// TenantID and ClientID default to $AZURE_TENANT_ID and $AZURE_CLIENT_ID.
+	// ClientID alone selects a user-assigned managed identity.
+	TenantID string `json:"tenant_id"`
+	ClientID string `json:"client_id"`
+	// ClientSecretEnv names the variable holding a service principal's
+	// secret. Without it the provider uses workload identity when
+	// $AZURE_FEDERATED_TOKEN_FILE is set (as on AKS), and the VM's managed
+	// identity otherwise.
+	ClientSecretEnv string `json:"client_secret_env"`
+}
+
+// acr authenticates to Azure Container Registry with an AAD identity. The
+// AAD token is exchanged at the registry's /oauth2/exchange for a refresh
+// token, which buys a pull-scoped access token per repository from
+// /oauth2/token. Each token is cached until shortly before it expires.
+type acr struct {
+	tenantID     string
+	clientID     string
+	clientSecret string
+	tokenFile    string
+
+	mu      sync.Mutex
+	aad     Credential
+	refresh map[string]Credential // by registry
+	access  map[string]Credential // by registry and scope
+}
+
+func newACR(_ context.Context, raw json.RawMessage) (Provider, error) {
+	o := acrOptions{
+		TenantID: os.Getenv("AZURE_TENANT_ID"),
+		ClientID: os.Getenv("AZURE_CLIENT_ID"),
+	}
+	if err := decode(raw, &o); err != nil {
+		return nil, err
+	}
+	a := &acr{
+		tenantID:  o.TenantID,
+		clientID:  o.ClientID,
+		tokenFile: os.Getenv("AZURE_FEDERATED_TOKEN_FILE"),
+		refresh:   make(map[string]Credential),
+		access:    make(map[string]Credential),
+	}
+	if o.ClientSecretEnv != "" {
+		a.clientSecret = os.Getenv(o.ClientSecretEnv)
+		if a.clientSecret == "" {
+			return nil, fmt.Errorf("%s is not set", o.ClientSecretEnv)
+		}
+	}
+	if (a.clientSecret != "" || a.tokenFile != "") && (a.tenantID == "" || a.clientID == "") {
+		return nil, errors.New("service principals and workload identities need a tenant_id and client_id")
+	}
+	return a, nil
+}
+
+// Authorize sets a bearer token scoped to pulls from the request's
+// repository.
+func (a *acr) Authorize(req *http.Request, registry, _ string) (bool, error) {
+	scope := "registry:catalog:*"
+	if name, ok := repositoryName(req.URL.Path); ok {
+		scope = "repository:" + name + ":pull"
+	}
+	ctx := req.Context()
+
+	// Holding the lock across token fetches means concurrent misses wait
+	// for one exchange rather than each starting their own.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	access, ok := a.access[registry+" "+scope]
+	observeCache(registry, "acr", ok && !expiring(access))
+	if !ok || expiring(access) {
+		refresh, ok := a.refresh[registry]
+		if !ok || expiring(refresh) {
+			aad := a.aad
+			if expiring(aad) {
+				start := time.Now()
+				var err error
+				aad, err = a.aadToken(ctx)
+				observeFetch(registry, "acr", start, err)
+				if err != nil {
+					return false, err
+				}
+				a.aad = aad
+			}
+			start := time.Now()
+			var err error
+			refresh, err = a.exchange(ctx, registry, aad.Token)
+			observeFetch(registry, "acr", start, err)
+			if err != nil {
+				return false, err
+			}
+			a.refresh[registry] = refresh
+		}
+		start := time.Now()
+		var err error
+		access, err = a.accessToken(ctx, registry, scope, refresh.Token)
+		observeFetch(registry, "acr", start, err)
+		if err != nil {
+			return false, err
+		}
+		a.access[registry+" "+scope] = access
+	}
+	access.apply(req)
+	return true, nil
+}
+
+func expiring(c Credential) bool {
+	return c.Token == "" || time.Until(c.Expires) < refreshMargin
+}
+
+// repositoryName extracts <name> from /v2/<name>/(manifests|blobs|tags|referrers)/...
+func repositoryName(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	if !ok {
+		return "", false
+	}
+	for _, kind := range []string{"/manifests/", "/blobs/", "/tags/", "/referrers/"} {
+		if i := strings.LastIndex(rest, kind); i > 0 {
+			return rest[:i], true
+		}
+	}
+	return "", false
+}
+
+// aadToken gets an AAD access token for the configured identity.
+func (a *acr) aadToken(ctx context.Context) (Credential, error) {
+	var req *http.Request
+	var err error
+	if a.clientSecret != "" || a.tokenFile != "" {
+		form := url.Values{
+			"grant_type": {"client_credentials"},
+			"client_id":  {a.clientID},
+			"scope":      {aadResource + ".default"},
+		}
+		if a.clientSecret != "" {
+			form.Set("client_secret", a.clientSecret)
+		} else {
+			assertion, err := os.ReadFile(a.tokenFile)
+			if err != nil {
+				return Credential{}, fmt.Errorf("reading federated token: %w", err)
+			}
+			form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+			form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+		}
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = "https://login.microsoftonline.com/"
+		}
+		tokenURL := strings.TrimSuffix(authority, "/") + "/" + a.tenantID + "/oauth2/v2.0/token"
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return Credential{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		q := url.Values{"api-version": {"2018-02-01"}, "resource": {aadResource}}
+		if a.clientID != "" {
+			q.Set("client_id", a.clientID)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, imdsTokenURL+"?"+q.Encode(), nil)
+		if err != nil {
+			return Credential{}, err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := postJSON(req, "AAD token", &tok); err != nil {
+		return Credential{}, err
+	}
+	return Credential{Token: tok.AccessToken, Expires: tokenExpiry(tok.AccessToken)}, nil
+}
+
+// exchange trades an AAD token for an ACR refresh token.
+func (a *acr) exchange(ctx context.Context, registry, aadToken string) (Credential, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"access_token": {aadToken},
+	}
+	if a.tenantID != "" {
+		form.Set("tenant", a.tenantID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+registry+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return Credential{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := postJSON(req, "ACR refresh token", &tok); err != nil {
+		return Credential{}, err
+	}
+	return Credential{Token: tok.RefreshToken, Expires: tokenExpiry(tok.RefreshToken)}, nil
+}
+
+// accessToken trades a refresh token for an access token limited to scope.
+func (a *acr) accessToken(ctx context.Context, registry, scope, refreshToken string) (Credential, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"service":       {registry},
+		"scope":         {scope},
+		"refresh_token": {refreshToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+registry+"/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return Credential{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := postJSON(req, "ACR access token", &tok); err != nil {
+		return Credential{}, err
+	}
+	return Credential{Token: tok.AccessToken, Expires: tokenExpiry(tok.AccessToken)}, nil
+}
+
+// postJSON sends req and decodes a JSON response into v.
+func postJSON(req *http.Request, what string, v any) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", what, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{resp.StatusCode, fmt.Sprintf("fetching %s: status %d: %s", what, resp.StatusCode, strings.TrimSpace(string(body)))}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding %s: %w", what, err)
+	}
+	return nil
+}
+
+// tokenExpiry reads the exp claim of a JWT, or assumes acrTokenTTL.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+			var claims struct {
+				Exp int64 `json:"exp"`
+			}
+			if json.Unmarshal(payload, &claims) == nil && claims.Exp > 0 {
+				return time.Unix(claims.Exp, 0)
+			}
+		}
+	}
+	return time.Now().Add(acrTokenTTL)
+}
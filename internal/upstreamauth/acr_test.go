@@ -0,0 +1,97 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeJWT returns a token whose exp claim is ttl from now.
+func fakeJWT(ttl time.Duration) string {
+	claims, _ := json.Marshal(map[string]int64{"exp": time.Now().Add(ttl).Unix()})
+	return "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+func TestACRTokenExchange(t *testing.T) {
+	aad := fakeJWT(time.Hour)
+	refresh := fakeJWT(3 * time.Hour)
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != aadResource {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":%q,"expires_in":"3599"}`, aad)
+	}))
+	defer imds.Close()
+	defer func(u string) { imdsTokenURL = u }(imdsTokenURL)
+	imdsTokenURL = imds.URL
+
+	var exchanges, tokens int
+	var scopes []string
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/oauth2/exchange":
+			exchanges++
+			if r.Form.Get("grant_type") != "access_token" || r.Form.Get("access_token") != aad {
+				http.Error(w, "bad exchange", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"refresh_token":%q}`, refresh)
+		case "/oauth2/token":
+			tokens++
+			if r.Form.Get("refresh_token") != refresh {
+				http.Error(w, "bad refresh token", http.StatusUnauthorized)
+				return
+			}
+			scopes = append(scopes, r.Form.Get("scope"))
+			io.WriteString(w, `{"access_token":"access-`+r.Form.Get("scope")+`"}`)
+		}
+	}))
+	defer registry.Close()
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = registry.Client()
+	host := strings.TrimPrefix(registry.URL, "https://")
+
+	c, err := Build(context.Background(), []Entry{{Registry: host, Providers: []json.RawMessage{
+		json.RawMessage(`{"type":"acr"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) string {
+		req := httptest.NewRequest(http.MethodGet, "https://"+host+path, nil)
+		if err := c.Authorize(req, host, ""); err != nil {
+			t.Fatal(err)
+		}
+		return req.Header.Get("Authorization")
+	}
+
+	if got := get("/v2/team/app/manifests/v1"); got != "Bearer access-repository:team/app:pull" {
+		t.Fatalf("got %q", got)
+	}
+	get("/v2/team/app/blobs/sha256:abc")
+	if got := get("/v2/other/blobs/sha256:abc"); got != "Bearer access-repository:other:pull" {
+		t.Fatalf("got %q", got)
+	}
+	if exchanges != 1 || tokens != 2 {
+		t.Fatalf("expected 1 exchange and 2 access tokens (one per repository), got %d and %d: %q", exchanges, tokens, scopes)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Now().Add(75 * time.Minute).Truncate(time.Second)
+	if got := tokenExpiry(fakeJWT(75 * time.Minute)); !got.Equal(exp) && !got.Equal(exp.Add(time.Second)) {
+		t.Fatalf("tokenExpiry = %v, want %v", got, exp)
+	}
+	if got := time.Until(tokenExpiry("opaque")); got < 59*time.Minute || got > acrTokenTTL {
+		t.Fatalf("opaque token should get the default TTL, got %v", got)
+	}
+}
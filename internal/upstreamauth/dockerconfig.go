@@ -0,0 +1,181 @@
+package upstreamauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() { Register("dockerconfig", newDockerConfig) }
+
+// helperTTL bounds how long a credential from a Docker credential helper is
+// cached; helpers such as docker-credential-ecr-login hand out tokens that
+// expire, but don't say when.
+const helperTTL = 15 * time.Minute
+
+// dockerHubKey is the key Docker Hub credentials are stored under.
+const dockerHubKey = "https://index.docker.io/v1/"
+
+type dockerConfigOptions struct {
+	Type string `json:"type"`
+	// Path is the config.json to read. It defaults to $DOCKER_CONFIG/config.json,
+	// then ~/.docker/config.json, as for the docker CLI.
+	Path string `json:"path"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// dockerConfigFile is the subset of ~/.docker/config.json used here.
+type dockerConfigFile struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+// dockerConfig reads credentials as `docker login` leaves them, including
+// via credential helpers, so an existing pull secret or node login can be
+// reused. The file is re-read when it changes.
+type dockerConfig struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	file    dockerConfigFile
+}
+
+func newDockerConfig(_ context.Context, raw json.RawMessage) (Provider, error) {
+	var o dockerConfigOptions
+	if err := decode(raw, &o); err != nil {
+		return nil, err
+	}
+	if o.Path == "" {
+		dir := os.Getenv("DOCKER_CONFIG")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			dir = filepath.Join(home, ".docker")
+		}
+		o.Path = filepath.Join(dir, "config.json")
+	}
+	return FromSource(&dockerConfig{path: o.Path}), nil
+}
+
+func (d *dockerConfig) load() (dockerConfigFile, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return dockerConfigFile{}, err
+	}
+	if !fi.ModTime().Equal(d.modTime) {
+		data, err := os.ReadFile(d.path)
+		if err != nil {
+			return dockerConfigFile{}, err
+		}
+		var f dockerConfigFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return dockerConfigFile{}, fmt.Errorf("parsing %s: %w", d.path, err)
+		}
+		d.file, d.modTime = f, fi.ModTime()
+	}
+	return d.file, nil
+}
+
+func (d *dockerConfig) Credential(ctx context.Context, registry string) (Credential, bool, error) {
+	f, err := d.load()
+	if err != nil {
+		return Credential{}, false, err
+	}
+	key := registry
+	if strings.EqualFold(registry, "docker.io") || strings.EqualFold(registry, "registry-1.docker.io") {
+		key = dockerHubKey
+	}
+
+	if helper := f.CredHelpers[key]; helper != "" {
+		return runCredentialHelper(ctx, helper, key)
+	}
+	if a, ok := lookupAuth(f, key); ok {
+		switch {
+		case a.RegistryToken != "":
+			return Credential{Token: a.RegistryToken, Expires: time.Now().Add(helperTTL)}, true, nil
+		case a.Auth != "":
+			dec, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return Credential{}, false, fmt.Errorf("decoding auth for %s: %w", key, err)
+			}
+			user, pass, _ := strings.Cut(string(dec), ":")
+			return Credential{Username: user, Password: pass, Expires: time.Now().Add(helperTTL)}, true, nil
+		case a.Username != "":
+			return Credential{Username: a.Username, Password: a.Password, Expires: time.Now().Add(helperTTL)}, true, nil
+		}
+	}
+	if f.CredsStore != "" {
+		return runCredentialHelper(ctx, f.CredsStore, key)
+	}
+	return Credential{}, false, nil
+}
+
+// lookupAuth finds key in auths, which may be stored with a scheme
+// ("https://ghcr.io") or a trailing path.
+func lookupAuth(f dockerConfigFile, key string) (a struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	RegistryToken string `json:"registrytoken"`
+}, ok bool) {
+	if a, ok := f.Auths[key]; ok {
+		return a, true
+	}
+	for k, v := range f.Auths {
+		host := strings.TrimPrefix(strings.TrimPrefix(k, "https://"), "http://")
+		host, _, _ = strings.Cut(host, "/")
+		if strings.EqualFold(host, key) {
+			return v, true
+		}
+	}
+	return dockerAuth{}, false
+}
+
+// runCredentialHelper asks docker-credential-<helper> for key's credentials.
+func runCredentialHelper(ctx context.Context, helper, key string) (Credential, bool, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(key)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Helpers report an unknown server on stdout, and exit non-zero.
+		if strings.Contains(string(out), "credentials not found") {
+			return Credential{}, false, nil
+		}
+		return Credential{}, false, fmt.Errorf("docker-credential-%s: %w: %s", helper, err, strings.TrimSpace(stderr.String()))
+	}
+	var resp struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return Credential{}, false, fmt.Errorf("docker-credential-%s: %w", helper, err)
+	}
+	// Identity tokens come back under this placeholder username; they are
+	// OAuth refresh tokens, not something a registry accepts directly.
+	if resp.Username == "<token>" {
+		return Credential{}, false, fmt.Errorf("docker-credential-%s returned an identity token, which is not supported", helper)
+	}
+	return Credential{Username: resp.Username, Password: resp.Secret, Expires: time.Now().Add(helperTTL)}, true, nil
+}
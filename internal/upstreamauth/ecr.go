@@ -0,0 +1,152 @@
+package upstreamauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+func init() { Register("ecr", newECR) }
+
+// ecrGetToken is the ECR API body and target for GetAuthorizationToken.
+// The call is made directly rather than through the ECR SDK, which the
+// proxy has no other use for.
+const (
+	ecrGetTokenBody   = "{}"
+	ecrGetTokenTarget = "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken"
+)
+
+// ecrTokenTTL is how long ECR authorization tokens last, assumed when a
+// response doesn't say.
+const ecrTokenTTL = 12 * time.Hour
+
+type ecrOptions struct {
+	Type string `json:"type"`
+	// Region defaults to the one in the registry host
+	// (<account>.dkr.ecr.<region>.amazonaws.com).
+	Region string `json:"region"`
+	// Endpoint overrides the ECR API endpoint, e.g. for a VPC endpoint.
+	Endpoint string `json:"endpoint"`
+}
+
+// ECR logs in to Amazon ECR registries as `aws ecr get-login-password`
+// does: it calls GetAuthorizationToken with the AWS credentials it is
+// given and presents the returned password as Basic auth. Tokens last 12
+// hours; wrapped by FromSource they are refreshed shortly before expiry,
+// so no job has to rotate a pull secret.
+type ECR struct {
+	Credentials aws.CredentialsProvider
+	Region      string // defaults to the registry host's region
+	Endpoint    string // defaults to https://api.ecr.<region>.amazonaws.com
+
+	signer *v4.Signer
+}
+
+// NewECR returns an ECR login using creds, which are cached and refreshed
+// before they expire, wrapped as a Provider.
+func NewECR(creds aws.CredentialsProvider, region, endpoint string) Provider {
+	return FromSource(&ECR{
+		Credentials: aws.NewCredentialsCache(creds),
+		Region:      region,
+		Endpoint:    endpoint,
+		signer:      v4.NewSigner(),
+	})
+}
+
+func newECR(ctx context.Context, raw json.RawMessage) (Provider, error) {
+	var o ecrOptions
+	if err := decode(raw, &o); err != nil {
+		return nil, err
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	return NewECR(cfg.Credentials, o.Region, o.Endpoint), nil
+}
+
+// ecrRegion reads the region from an ECR registry host such as
+// 123456789012.dkr.ecr.eu-west-1.amazonaws.com (or dkr.ecr-fips, or
+// amazonaws.com.cn).
+func ecrRegion(registry string) (string, bool) {
+	host, _, _ := strings.Cut(strings.ToLower(registry), ":")
+	parts := strings.Split(host, ".")
+	for i := 1; i+2 < len(parts); i++ {
+		if parts[i-1] == "dkr" && (parts[i] == "ecr" || parts[i] == "ecr-fips") && parts[i+2] == "amazonaws" {
+			return parts[i+1], true
+		}
+	}
+	return "", false
+}
+
+// Credential fetches an authorization token for registry.
+func (e *ECR) Credential(ctx context.Context, registry string) (Credential, bool, error) {
+	region := e.Region
+	if region == "" {
+		var ok bool
+		if region, ok = ecrRegion(registry); !ok {
+			return Credential{}, false, fmt.Errorf("%s is not an ECR registry host; set a region", registry)
+		}
+	}
+	endpoint := e.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.ecr." + region + ".amazonaws.com"
+		if strings.HasPrefix(region, "cn-") {
+			endpoint += ".cn"
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", bytes.NewReader([]byte(ecrGetTokenBody)))
+	if err != nil {
+		return Credential{}, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", ecrGetTokenTarget)
+	creds, err := e.Credentials.Retrieve(ctx)
+	if err != nil {
+		return Credential{}, false, fmt.Errorf("retrieving AWS credentials: %w", err)
+	}
+	sum := sha256.Sum256([]byte(ecrGetTokenBody))
+	if err := e.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "ecr", region, time.Now()); err != nil {
+		return Credential{}, false, err
+	}
+
+	var out struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"`
+		} `json:"authorizationData"`
+	}
+	if err := postJSON(req, "ECR authorization token", &out); err != nil {
+		return Credential{}, false, err
+	}
+	if len(out.AuthorizationData) == 0 {
+		return Credential{}, false, errors.New("ECR returned no authorization token")
+	}
+	data := out.AuthorizationData[0]
+	login, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+	if err != nil {
+		return Credential{}, false, fmt.Errorf("decoding ECR authorization token: %w", err)
+	}
+	user, pass, ok := strings.Cut(string(login), ":")
+	if !ok {
+		return Credential{}, false, errors.New("malformed ECR authorization token")
+	}
+	cred := Credential{Username: user, Password: pass, Expires: time.Now().Add(ecrTokenTTL)}
+	if data.ExpiresAt > 0 {
+		cred.Expires = time.Unix(int64(data.ExpiresAt), 0)
+	}
+	return cred, true, nil
+}
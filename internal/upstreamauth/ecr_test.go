@@ -0,0 +1,55 @@
+package upstreamauth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestECRLogin(t *testing.T) {
+	var calls int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("X-Amz-Target") != ecrGetTokenTarget ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/ecr/aws4_request") {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		token := base64.StdEncoding.EncodeToString([]byte("AWS:ecr-password"))
+		fmt.Fprintf(w, `{"authorizationData":[{"authorizationToken":%q,"expiresAt":%d}]}`, token, time.Now().Add(12*time.Hour).Unix())
+	}))
+	defer api.Close()
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = api.Client()
+
+	registry := "123456789012.dkr.ecr.eu-west-1.amazonaws.com"
+	c := NewChain()
+	c.Add(registry, "ecr", NewECR(credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""), "", api.URL))
+	for range 2 {
+		if got := authorize(t, c, registry, "Bearer client"); got != basic("AWS", "ecr-password") {
+			t.Fatalf("got %q", got)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("token should be cached until it expires, fetched %d times", calls)
+	}
+}
+
+func TestECRRegion(t *testing.T) {
+	for host, want := range map[string]string{
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com":      "eu-west-1",
+		"123456789012.dkr.ecr-fips.us-east-1.amazonaws.com": "us-east-1",
+		"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn":  "cn-north-1",
+		"public.ecr.aws": "",
+	} {
+		if got, _ := ecrRegion(host); got != want {
+			t.Errorf("ecrRegion(%s) = %q, want %q", host, got, want)
+		}
+	}
+}
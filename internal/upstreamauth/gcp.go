@@ -0,0 +1,71 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+func init() { Register("gcp", newGCP) }
+
+// httpClient fetches tokens from metadata servers and secret stores.
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+type gcpOptions struct {
+	Type string `json:"type"`
+	// ServiceAccount is the attached service account to act as; "default"
+	// unless the instance has several.
+	ServiceAccount string `json:"service_account"`
+}
+
+// gcp presents the workload's Google service account, from the GCE/GKE
+// metadata server, to Artifact Registry and GCR. Their access tokens last
+// an hour and are refreshed before they run out.
+type gcp struct {
+	tokenURL string
+}
+
+func newGCP(_ context.Context, raw json.RawMessage) (Provider, error) {
+	o := gcpOptions{ServiceAccount: "default"}
+	if err := decode(raw, &o); err != nil {
+		return nil, err
+	}
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	return FromSource(&gcp{
+		tokenURL: "http://" + host + "/computeMetadata/v1/instance/service-accounts/" + o.ServiceAccount + "/token",
+	}), nil
+}
+
+func (g *gcp) Credential(ctx context.Context, _ string) (Credential, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.tokenURL, nil)
+	if err != nil {
+		return Credential{}, false, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Credential{}, false, fmt.Errorf("fetching GCP access token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Credential{}, false, &statusError{resp.StatusCode, fmt.Sprintf("fetching GCP access token: metadata server returned %d", resp.StatusCode)}
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return Credential{}, false, fmt.Errorf("decoding GCP access token: %w", err)
+	}
+	return Credential{
+		Username: "oauth2accesstoken",
+		Password: tok.AccessToken,
+		Expires:  time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second),
+	}, true, nil
+}
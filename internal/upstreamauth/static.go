@@ -0,0 +1,57 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+func init() { Register("static", newStatic) }
+
+// staticOptions configure a fixed credential. Secrets can be read from the
+// environment rather than written into the auth file.
+type staticOptions struct {
+	Type        string `json:"type"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	PasswordEnv string `json:"password_env"`
+	Token       string `json:"token"`
+	TokenEnv    string `json:"token_env"`
+}
+
+type staticSource Credential
+
+func (s staticSource) Credential(context.Context, string) (Credential, bool, error) {
+	return Credential(s), true, nil
+}
+
+// Static returns a provider that always presents cred.
+func Static(cred Credential) Provider { return FromSource(staticSource(cred)) }
+
+// StaticSource returns a source that always has cred, e.g. for Exchange.
+func StaticSource(cred Credential) CredentialSource { return staticSource(cred) }
+
+func newStatic(_ context.Context, raw json.RawMessage) (Provider, error) {
+	var o staticOptions
+	if err := decode(raw, &o); err != nil {
+		return nil, err
+	}
+	if o.PasswordEnv != "" {
+		o.Password = os.Getenv(o.PasswordEnv)
+		if o.Password == "" {
+			return nil, fmt.Errorf("%s is not set", o.PasswordEnv)
+		}
+	}
+	if o.TokenEnv != "" {
+		o.Token = os.Getenv(o.TokenEnv)
+		if o.Token == "" {
+			return nil, fmt.Errorf("%s is not set", o.TokenEnv)
+		}
+	}
+	if o.Token == "" && o.Username == "" {
+		return nil, errors.New("needs a username and password, or a token")
+	}
+	return Static(Credential{Username: o.Username, Password: o.Password, Token: o.Token}), nil
+}
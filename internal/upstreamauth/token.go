@@ -0,0 +1,232 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() { Register("token", newToken) }
+
+// defaultTokenTTL is what the distribution token spec says to assume when
+// a token response has no expires_in.
+const defaultTokenTTL = 60 * time.Second
+
+// tokenMargin renews exchanged tokens this long before they expire.
+// Registry tokens often last a minute or less, so refreshMargin would
+// never let one be reused.
+const tokenMargin = 10 * time.Second
+
+type tokenOptions struct {
+	Type        string `json:"type"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	PasswordEnv string `json:"password_env"`
+}
+
+// bearerChallenge is where a registry sends clients for tokens, from the
+// Www-Authenticate header of its /v2/ endpoint.
+type bearerChallenge struct {
+	realm, service string
+}
+
+// tokenExchange answers registries' bearer challenges itself, as docker
+// does: it reads the token realm from the registry's /v2/ challenge, then
+// trades its credential (or nothing, for anonymous pulls) there for a
+// token scoped to pulls from the requested repository. Challenges are
+// remembered per registry and tokens per registry and scope, each token
+// until shortly before it expires.
+type tokenExchange struct {
+	src CredentialSource // nil for anonymous tokens
+
+	mu         sync.Mutex
+	challenges map[string]*bearerChallenge // by registry; nil if it issues no tokens
+	tokens     map[string]Credential       // by registry and scope
+}
+
+// Exchange returns a provider that fetches registry tokens with the
+// credentials from src, or anonymously if src is nil. Registries that
+// don't issue tokens are sent src's credential directly.
+func Exchange(src CredentialSource) Provider {
+	return &tokenExchange{
+		src:        src,
+		challenges: make(map[string]*bearerChallenge),
+		tokens:     make(map[string]Credential),
+	}
+}
+
+func newToken(_ context.Context, raw json.RawMessage) (Provider, error) {
+	var o tokenOptions
+	if err := decode(raw, &o); err != nil {
+		return nil, err
+	}
+	if o.PasswordEnv != "" {
+		o.Password = os.Getenv(o.PasswordEnv)
+		if o.Password == "" {
+			return nil, fmt.Errorf("%s is not set", o.PasswordEnv)
+		}
+	}
+	if o.Username == "" {
+		if o.Password != "" {
+			return nil, errors.New("a password needs a username")
+		}
+		return Exchange(nil), nil
+	}
+	return Exchange(staticSource{Username: o.Username, Password: o.Password}), nil
+}
+
+// Authorize sets a bearer token scoped to pulls from the request's
+// repository.
+func (t *tokenExchange) Authorize(req *http.Request, registry, _ string) (bool, error) {
+	scope := ""
+	if name, ok := repositoryName(req.URL.Path); ok {
+		scope = "repository:" + name + ":pull"
+	}
+	ctx := req.Context()
+
+	// As for acr, concurrent misses wait for one fetch.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tok, ok := t.tokens[registry+" "+scope]
+	fresh := ok && time.Until(tok.Expires) >= tokenMargin
+	observeCache(registry, "token", fresh)
+	if fresh {
+		tok.apply(req)
+		return true, nil
+	}
+
+	ch, known := t.challenges[registry]
+	if !known {
+		var err error
+		if ch, err = ping(ctx, req.URL.Scheme+"://"+req.URL.Host); err != nil {
+			return false, err
+		}
+		t.challenges[registry] = ch
+	}
+	var cred Credential
+	var haveCred bool
+	if t.src != nil {
+		var err error
+		if cred, haveCred, err = t.src.Credential(ctx, registry); err != nil {
+			return false, err
+		}
+	}
+	if ch == nil {
+		// The registry takes credentials as they are, or none.
+		if haveCred {
+			cred.apply(req)
+		}
+		return haveCred, nil
+	}
+
+	start := time.Now()
+	tok, err := fetchToken(ctx, ch, scope, cred, haveCred)
+	observeFetch(registry, "token", start, err)
+	if err != nil {
+		return false, err
+	}
+	t.tokens[registry+" "+scope] = tok
+	tok.apply(req)
+	return true, nil
+}
+
+// ping reads the bearer challenge of the registry at base. It returns nil
+// when the registry doesn't ask for a token.
+func ping(ctx context.Context, base string) (*bearerChallenge, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/v2/", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading auth challenge: %w", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil, nil
+	case http.StatusUnauthorized:
+	default:
+		return nil, fmt.Errorf("reading auth challenge: %s/v2/ returned %d", base, resp.StatusCode)
+	}
+	scheme, params, _ := strings.Cut(resp.Header.Get("Www-Authenticate"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, nil
+	}
+	p := parseChallenge(params)
+	if p["realm"] == "" {
+		return nil, errors.New("bearer challenge without a realm")
+	}
+	return &bearerChallenge{realm: p["realm"], service: p["service"]}, nil
+}
+
+// fetchToken asks ch's realm for a token for scope, presenting cred if
+// haveCred.
+func fetchToken(ctx context.Context, ch *bearerChallenge, scope string, cred Credential, haveCred bool) (Credential, error) {
+	q := url.Values{}
+	if ch.service != "" {
+		q.Set("service", ch.service)
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	u := ch.realm
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return Credential{}, err
+	}
+	if haveCred {
+		cred.apply(req)
+	}
+	var tok struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
+	}
+	if err := postJSON(req, "registry token", &tok); err != nil {
+		return Credential{}, err
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	if tok.Token == "" {
+		return Credential{}, errors.New("token endpoint returned no token")
+	}
+	ttl := defaultTokenTTL
+	if tok.ExpiresIn > 0 {
+		ttl = time.Duration(tok.ExpiresIn) * time.Second
+	}
+	issued := tok.IssuedAt
+	if issued.IsZero() || issued.After(time.Now()) {
+		issued = time.Now()
+	}
+	return Credential{Token: tok.Token, Expires: issued.Add(ttl)}, nil
+}
+
+// parseChallenge parses the key="value" pairs of a Www-Authenticate
+// challenge.
+func parseChallenge(params string) map[string]string {
+	out := make(map[string]string)
+	for params != "" {
+		var key, value string
+		key, params, _ = strings.Cut(strings.TrimLeft(params, " ,"), "=")
+		if strings.HasPrefix(params, `"`) {
+			value, params, _ = strings.Cut(params[1:], `"`)
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		out[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return out
+}
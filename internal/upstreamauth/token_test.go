@@ -0,0 +1,100 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTokenExchange(t *testing.T) {
+	var pings, fetches int
+	var registry *httptest.Server
+	registry = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			pings++
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, registry.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			fetches++
+			if r.URL.Query().Get("service") != "registry.test" {
+				http.Error(w, "bad service", http.StatusBadRequest)
+				return
+			}
+			user := "anonymous"
+			if u, p, ok := r.BasicAuth(); ok {
+				if p != "hub-token" {
+					http.Error(w, "denied", http.StatusUnauthorized)
+					return
+				}
+				user = u
+			}
+			fmt.Fprintf(w, `{"token":"%s:%s","expires_in":300}`, user, r.URL.Query().Get("scope"))
+		}
+	}))
+	defer registry.Close()
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = registry.Client()
+	host := strings.TrimPrefix(registry.URL, "https://")
+
+	t.Setenv("HUB_TOKEN", "hub-token")
+	c, err := Build(context.Background(), []Entry{
+		{Registry: host, Providers: []json.RawMessage{json.RawMessage(`{"type":"token","username":"bot","password_env":"HUB_TOKEN"}`)}},
+		{Registry: "*", Providers: []json.RawMessage{json.RawMessage(`{"type":"token"}`)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(registry, path string) string {
+		req := httptest.NewRequest(http.MethodGet, "https://"+host+path, nil)
+		if err := c.Authorize(req, registry, "Bearer client"); err != nil {
+			t.Fatal(err)
+		}
+		return req.Header.Get("Authorization")
+	}
+
+	if got := get(host, "/v2/library/nginx/manifests/1.27"); got != "Bearer bot:repository:library/nginx:pull" {
+		t.Fatalf("got %q", got)
+	}
+	get(host, "/v2/library/nginx/blobs/sha256:abc")
+	if got := get(host, "/v2/org/app/blobs/sha256:abc"); got != "Bearer bot:repository:org/app:pull" {
+		t.Fatalf("got %q", got)
+	}
+	if pings != 1 || fetches != 2 {
+		t.Fatalf("expected 1 challenge and 2 tokens (one per repository), got %d and %d", pings, fetches)
+	}
+
+	// Routed through the "*" chain under another name: no credentials.
+	if got := get("mirror.test", "/v2/library/nginx/manifests/1.27"); got != "Bearer anonymous:repository:library/nginx:pull" {
+		t.Fatalf("anonymous: got %q", got)
+	}
+	if !c.ProxyManaged("mirror.test") {
+		t.Fatal("token chains should be proxy-managed")
+	}
+}
+
+func TestTokenExchangeWithoutChallenge(t *testing.T) {
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer registry.Close()
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = registry.Client()
+	host := strings.TrimPrefix(registry.URL, "https://")
+
+	for _, tc := range []struct {
+		p    Provider
+		want string
+	}{
+		{Exchange(nil), ""},
+		{Exchange(staticSource{Username: "u", Password: "p"}), basic("u", "p")},
+	} {
+		c := NewChain()
+		c.Add(host, "token", tc.p)
+		if got := authorize(t, c, host, ""); got != tc.want {
+			t.Errorf("registry without tokens: got %q, want %q", got, tc.want)
+		}
+	}
+}
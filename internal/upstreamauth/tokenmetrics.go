@@ -0,0 +1,63 @@
+package upstreamauth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var (
+	tokenFetches = metrics.NewCounterVec("oci_upstream_token_fetches_total",
+		"Credential and token fetches from token endpoints, metadata servers, secret stores and credential helpers, by registry, provider and result (ok, denied, throttled, error).",
+		"registry", "provider", "result")
+	tokenFetchSeconds = metrics.NewHistogramVec("oci_upstream_token_fetch_seconds",
+		"Time taken by credential and token fetches, by registry and provider.",
+		nil, "registry", "provider")
+	tokenCacheLookups = metrics.NewCounterVec("oci_upstream_token_cache_total",
+		"Credential lookups by registry, provider and result (hit when a cached credential was still fresh, miss when it had to be fetched).",
+		"registry", "provider", "result")
+)
+
+// statusError is a token endpoint's non-200 answer, kept apart from
+// transport errors so rejections and throttling can be counted.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// fetchResult classifies a fetch's error for tokenFetches.
+func fetchResult(err error) string {
+	var se *statusError
+	switch {
+	case err == nil:
+		return "ok"
+	case !errors.As(err, &se):
+		return "error"
+	case se.code == http.StatusUnauthorized || se.code == http.StatusForbidden:
+		return "denied"
+	case se.code == http.StatusTooManyRequests:
+		return "throttled"
+	default:
+		return "error"
+	}
+}
+
+// observeFetch records a fetch for registry by provider that began at
+// start.
+func observeFetch(registry, provider string, start time.Time, err error) {
+	tokenFetches.Inc(registry, provider, fetchResult(err))
+	tokenFetchSeconds.Observe(time.Since(start).Seconds(), registry, provider)
+}
+
+// observeCache records whether a cached credential served a lookup.
+func observeCache(registry, provider string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	tokenCacheLookups.Inc(registry, provider, result)
+}
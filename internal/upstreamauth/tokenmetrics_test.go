@@ -0,0 +1,67 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+func TestTokenMetrics(t *testing.T) {
+	throttle := true
+	md := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if throttle {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, `{"access_token":"ya29.token","expires_in":3599}`)
+	}))
+	defer md.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(md.URL, "http://"))
+
+	const registry = "metrics.pkg.dev"
+	c, err := Build(context.Background(), []Entry{{Registry: registry, Providers: []json.RawMessage{
+		json.RawMessage(`{"type":"gcp"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize(t, c, registry, "")
+	throttle = false
+	authorize(t, c, registry, "")
+	authorize(t, c, registry, "")
+
+	var b strings.Builder
+	metrics.WriteTo(&b)
+	for _, want := range []string{
+		`oci_upstream_token_fetches_total{registry="metrics.pkg.dev",provider="gcp",result="throttled"} 1`,
+		`oci_upstream_token_fetches_total{registry="metrics.pkg.dev",provider="gcp",result="ok"} 1`,
+		`oci_upstream_token_cache_total{registry="metrics.pkg.dev",provider="gcp",result="miss"} 2`,
+		`oci_upstream_token_cache_total{registry="metrics.pkg.dev",provider="gcp",result="hit"} 1`,
+		`oci_upstream_token_fetch_seconds_count{registry="metrics.pkg.dev",provider="gcp"} 2`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+func TestFetchResult(t *testing.T) {
+	for err, want := range map[error]string{
+		nil: "ok",
+		&statusError{http.StatusUnauthorized, "denied"}:      "denied",
+		&statusError{http.StatusForbidden, "denied"}:         "denied",
+		&statusError{http.StatusTooManyRequests, "throttle"}: "throttled",
+		&statusError{http.StatusBadGateway, "bad gateway"}:   "error",
+		io.ErrUnexpectedEOF: "error",
+	} {
+		if got := fetchResult(err); got != want {
+			t.Errorf("fetchResult(%v) = %q, want %q", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Package upstreamauth decides which credentials the proxy presents to
+// upstream registries. Each registry gets an ordered chain of providers
+// (a static secret, the Docker config file, a cloud identity, Vault, a
+// registry token fetched by the proxy, or the client's own header) and the
+// first provider with something to offer authorizes the request. New providers plug in through Register without
+// touching the proxy's upstream client.
+package upstreamauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielloader/oci-pull-through/internal/metrics"
+)
+
+var authResults = metrics.NewCounterVec("oci_upstream_auth_total",
+	"Upstream requests by registry, the auth provider that authorized them (\"none\" for anonymous) and result (ok, error).",
+	"registry", "provider", "result")
+
+// Provider authorizes upstream requests. Authorize sets credentials on req,
+// an outgoing request to registry; clientAuth is the Authorization header
+// the client sent, if any. It returns false, leaving req untouched, when it
+// has nothing for this registry, and the chain moves on to the next one.
+type Provider interface {
+	Authorize(req *http.Request, registry, clientAuth string) (bool, error)
+}
+
+// Credential is a username and password, sent as HTTP Basic auth, or a
+// bearer token. Expires, if set, is when a cached credential must be
+// fetched again.
+type Credential struct {
+	Username string
+	Password string
+	Token    string
+	Expires  time.Time
+}
+
+func (c Credential) apply(req *http.Request) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+		return
+	}
+	basic := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+	req.Header.Set("Authorization", "Basic "+basic)
+}
+
+// CredentialSource looks up a credential for a registry. ok is false when
+// the source has none.
+type CredentialSource interface {
+	Credential(ctx context.Context, registry string) (cred Credential, ok bool, err error)
+}
+
+// refreshMargin renews cached credentials this long before they expire, so
+// a request doesn't race the expiry upstream.
+const refreshMargin = time.Minute
+
+// FromSource adapts a CredentialSource to a Provider, caching credentials
+// per registry until shortly before they expire. Credentials without an
+// expiry are cached for the life of the process.
+func FromSource(src CredentialSource) Provider {
+	return &sourceProvider{src: src, typ: "source", cache: make(map[string]Credential)}
+}
+
+type sourceProvider struct {
+	src   CredentialSource
+	typ   string // names the provider in metrics; set by Chain.Add
+	mu    sync.Mutex
+	cache map[string]Credential
+}
+
+func (p *sourceProvider) Authorize(req *http.Request, registry, _ string) (bool, error) {
+	p.mu.Lock()
+	cred, ok := p.cache[registry]
+	p.mu.Unlock()
+	fresh := ok && (cred.Expires.IsZero() || time.Until(cred.Expires) >= refreshMargin)
+	observeCache(registry, p.typ, fresh)
+	if !fresh {
+		start := time.Now()
+		var err error
+		cred, ok, err = p.src.Credential(req.Context(), registry)
+		observeFetch(registry, p.typ, start, err)
+		if err != nil || !ok {
+			return false, err
+		}
+		p.mu.Lock()
+		p.cache[registry] = cred
+		p.mu.Unlock()
+	}
+	cred.apply(req)
+	return true, nil
+}
+
+// passthrough forwards the client's own Authorization header, which is the
+// proxy's behaviour when no chain is configured.
+type passthrough struct{}
+
+func (passthrough) Authorize(req *http.Request, _, clientAuth string) (bool, error) {
+	if clientAuth == "" {
+		return false, nil
+	}
+	req.Header.Set("Authorization", clientAuth)
+	return true, nil
+}
+
+// Passthrough returns the provider that forwards the client's credentials.
+func Passthrough() Provider { return passthrough{} }
+
+// Factory builds a provider from its entry in the auth file. raw is the
+// provider's JSON object, including its "type".
+type Factory func(ctx context.Context, raw json.RawMessage) (Provider, error)
+
+var factories = map[string]Factory{
+	"passthrough": func(context.Context, json.RawMessage) (Provider, error) { return passthrough{}, nil },
+}
+
+// Register makes a provider type available to the auth file. It panics if
+// the type is already registered.
+func Register(typ string, f Factory) {
+	if _, dup := factories[typ]; dup {
+		panic("upstreamauth: duplicate provider type " + typ)
+	}
+	factories[typ] = f
+}
+
+type link struct {
+	typ string
+	Provider
+}
+
+// Chain holds the providers for each registry. Registries without a chain
+// of their own use the "*" chain, and with neither the client's
+// credentials are passed through.
+type Chain struct {
+	chains map[string][]link
+}
+
+// NewChain returns an empty chain, which passes client credentials through.
+func NewChain() *Chain {
+	return &Chain{chains: make(map[string][]link)}
+}
+
+// Add appends a provider to registry's chain. typ names it in logs and
+// metrics.
+func (c *Chain) Add(registry, typ string, p Provider) {
+	registry = strings.ToLower(registry)
+	if sp, ok := p.(*sourceProvider); ok {
+		sp.typ = typ
+	}
+	c.chains[registry] = append(c.chains[registry], link{typ, p})
+}
+
+func (c *Chain) links(registry string) ([]link, bool) {
+	if l, ok := c.chains[strings.ToLower(registry)]; ok {
+		return l, true
+	}
+	l, ok := c.chains["*"]
+	return l, ok
+}
+
+// Authorize sets credentials on req from the first provider in registry's
+// chain that has any. A provider that fails is logged and skipped. When no
+// provider applies the request goes out anonymously.
+func (c *Chain) Authorize(req *http.Request, registry, clientAuth string) error {
+	links, ok := c.links(registry)
+	if !ok {
+		links = []link{{"passthrough", passthrough{}}}
+	}
+	req.Header.Del("Authorization")
+	for _, l := range links {
+		ok, err := l.Authorize(req, registry, clientAuth)
+		if err != nil {
+			authResults.Inc(registry, l.typ, "error")
+			slog.Warn("upstream auth provider failed", "registry", registry, "provider", l.typ, "error", err)
+			continue
+		}
+		if ok {
+			authResults.Inc(registry, l.typ, "ok")
+			return nil
+		}
+	}
+	authResults.Inc(registry, "none", "ok")
+	return nil
+}
+
+// ProxyManaged reports whether the proxy supplies registry's credentials
+// itself, i.e. its chain doesn't fall back to the client's. Clients of
+// such registries are not sent upstream auth challenges.
+func (c *Chain) ProxyManaged(registry string) bool {
+	links, ok := c.links(registry)
+	if !ok {
+		return false
+	}
+	for _, l := range links {
+		if _, client := l.Provider.(passthrough); client {
+			return false
+		}
+	}
+	return true
+}
+
+// Entry is one registry's chain in the auth file.
+type Entry struct {
+	// Registry is the upstream host as clients address it ("ghcr.io",
+	// "docker.io"), or "*" for every registry without an entry.
+	Registry string `json:"registry"`
+	// Providers are tried in order. Each is an object with a "type" and
+	// that provider's options.
+	Providers []json.RawMessage `json:"providers"`
+}
+
+// LoadFile reads a JSON array of entries from path and builds their chain.
+func LoadFile(ctx context.Context, path string) (*Chain, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return Build(ctx, entries)
+}
+
+// Build constructs the providers for entries.
+func Build(ctx context.Context, entries []Entry) (*Chain, error) {
+	c := NewChain()
+	for _, e := range entries {
+		if e.Registry == "" {
+			return nil, fmt.Errorf("auth entry without a registry")
+		}
+		for _, raw := range e.Providers {
+			var head struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(raw, &head); err != nil {
+				return nil, fmt.Errorf("%s: %w", e.Registry, err)
+			}
+			f, ok := factories[head.Type]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown auth provider %q (have %s)", e.Registry, head.Type, strings.Join(Types(), ", "))
+			}
+			p, err := f(ctx, raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s provider: %w", e.Registry, head.Type, err)
+			}
+			c.Add(e.Registry, head.Type, p)
+		}
+	}
+	return c, nil
+}
+
+// Types lists the registered provider types.
+func Types() []string {
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// decode unmarshals a provider's options, rejecting unknown fields so a
+// typo doesn't silently drop a setting.
+func decode(raw json.RawMessage, v any) error {
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
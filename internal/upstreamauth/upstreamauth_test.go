@@ -0,0 +1,182 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func authorize(t *testing.T, c *Chain, registry, clientAuth string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "https://"+registry+"/v2/x/blobs/d", nil)
+	if err := c.Authorize(req, registry, clientAuth); err != nil {
+		t.Fatal(err)
+	}
+	return req.Header.Get("Authorization")
+}
+
+func basic(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestChainOrderAndFallback(t *testing.T) {
+	t.Setenv("GHCR_TOKEN", "ghp_secret")
+	c, err := Build(context.Background(), []Entry{
+		{Registry: "ghcr.io", Providers: []json.RawMessage{
+			json.RawMessage(`{"type":"static","username":"bot","password_env":"GHCR_TOKEN"}`),
+			json.RawMessage(`{"type":"passthrough"}`),
+		}},
+		{Registry: "quay.io", Providers: []json.RawMessage{
+			json.RawMessage(`{"type":"passthrough"}`),
+			json.RawMessage(`{"type":"static","token":"robot"}`),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := authorize(t, c, "ghcr.io", "Bearer client"); got != basic("bot", "ghp_secret") {
+		t.Fatalf("ghcr.io: first provider should win, got %q", got)
+	}
+	if got := authorize(t, c, "quay.io", "Bearer client"); got != "Bearer client" {
+		t.Fatalf("quay.io with client auth: got %q", got)
+	}
+	if got := authorize(t, c, "quay.io", ""); got != "Bearer robot" {
+		t.Fatalf("quay.io without client auth should fall back, got %q", got)
+	}
+	if got := authorize(t, c, "docker.io", "Bearer client"); got != "Bearer client" {
+		t.Fatalf("unconfigured registry should pass through, got %q", got)
+	}
+	if c.ProxyManaged("ghcr.io") || c.ProxyManaged("docker.io") {
+		t.Fatal("chains with passthrough are not proxy-managed")
+	}
+
+	c.Add("*", "static", Static(Credential{Token: "default"}))
+	if got := authorize(t, c, "docker.io", "Bearer client"); got != "Bearer default" {
+		t.Fatalf("\"*\" chain should apply to docker.io, got %q", got)
+	}
+	if !c.ProxyManaged("docker.io") {
+		t.Fatal("\"*\" chain without passthrough should be proxy-managed")
+	}
+}
+
+func TestBuildRejectsBadEntries(t *testing.T) {
+	for _, raw := range []string{
+		`{"type":"nope"}`,
+		`{"type":"static"}`,
+		`{"type":"static","username":"u","pasword":"typo"}`,
+	} {
+		_, err := Build(context.Background(), []Entry{{Registry: "r", Providers: []json.RawMessage{json.RawMessage(raw)}}})
+		if err == nil {
+			t.Errorf("%s: expected error", raw)
+		}
+	}
+}
+
+func TestDockerConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	auth := base64.StdEncoding.EncodeToString([]byte("hubuser:hubpass"))
+	os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"auths":{
+		"https://index.docker.io/v1/":{"auth":"`+auth+`"},
+		"https://ghcr.io":{"username":"gh","password":"pat"}
+	}}`), 0o600)
+
+	c, err := Build(context.Background(), []Entry{{Registry: "*", Providers: []json.RawMessage{
+		json.RawMessage(`{"type":"dockerconfig"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := authorize(t, c, "docker.io", ""); got != basic("hubuser", "hubpass") {
+		t.Fatalf("docker.io: got %q", got)
+	}
+	if got := authorize(t, c, "ghcr.io", ""); got != basic("gh", "pat") {
+		t.Fatalf("ghcr.io: got %q", got)
+	}
+	if got := authorize(t, c, "quay.io", "Bearer client"); got != "" {
+		t.Fatalf("quay.io: expected anonymous, got %q", got)
+	}
+}
+
+func TestGCPMetadataToken(t *testing.T) {
+	var calls int
+	md := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Metadata-Flavor") != "Google" || !strings.HasSuffix(r.URL.Path, "/service-accounts/default/token") {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `{"access_token":"ya29.token","expires_in":3599,"token_type":"Bearer"}`)
+	}))
+	defer md.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(md.URL, "http://"))
+
+	c, err := Build(context.Background(), []Entry{{Registry: "europe-docker.pkg.dev", Providers: []json.RawMessage{
+		json.RawMessage(`{"type":"gcp"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if got := authorize(t, c, "europe-docker.pkg.dev", ""); got != basic("oauth2accesstoken", "ya29.token") {
+			t.Fatalf("got %q", got)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("token should be cached, metadata server called %d times", calls)
+	}
+}
+
+func TestVaultSecret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.root" || r.URL.Path != "/v1/secret/data/registries/ghcr" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, `{"lease_duration":0,"data":{"data":{"username":"gh","password":"rotated"}}}`)
+	}))
+	defer srv.Close()
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", "s.root")
+
+	c, err := Build(context.Background(), []Entry{{Registry: "ghcr.io", Providers: []json.RawMessage{
+		json.RawMessage(`{"type":"vault","secret":"secret/data/registries/ghcr"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := authorize(t, c, "ghcr.io", ""); got != basic("gh", "rotated") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestSigV4ReplacesClientAuth(t *testing.T) {
+	c := NewChain()
+	c.Add("bucket.s3.eu-west-1.amazonaws.com", "sigv4",
+		NewSigV4(credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""), "eu-west-1", ""))
+
+	req := httptest.NewRequest(http.MethodGet, "https://bucket.s3.eu-west-1.amazonaws.com/v2/x/blobs/d", nil)
+	if err := c.Authorize(req, "bucket.s3.eu-west-1.amazonaws.com", "Bearer client"); err != nil {
+		t.Fatal(err)
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+		t.Fatalf("expected SigV4 Authorization, got %q", auth)
+	}
+	if got := req.Header.Get("X-Amz-Content-Sha256"); got != emptyPayloadHash {
+		t.Fatalf("X-Amz-Content-Sha256 = %q", got)
+	}
+	if !c.ProxyManaged("bucket.s3.eu-west-1.amazonaws.com") {
+		t.Fatal("sigv4 chain should be proxy-managed")
+	}
+}
@@ -0,0 +1,107 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() { Register("vault", newVault) }
+
+// vaultDefaultTTL caches secrets that come without a lease, as KV secrets
+// do, so a rotated password is picked up within minutes.
+const vaultDefaultTTL = 5 * time.Minute
+
+type vaultOptions struct {
+	Type string `json:"type"`
+	// Address defaults to $VAULT_ADDR.
+	Address string `json:"address"`
+	// Secret is the path read, e.g. "secret/data/registries/ghcr" for a
+	// KV v2 mount.
+	Secret string `json:"secret"`
+	// TokenEnv names the variable holding the Vault token; VAULT_TOKEN by
+	// default.
+	TokenEnv string `json:"token_env"`
+	// UsernameField and PasswordField name the secret's keys.
+	UsernameField string `json:"username_field"`
+	PasswordField string `json:"password_field"`
+}
+
+// vault reads a registry username and password from a HashiCorp Vault
+// secret, so pull credentials can be rotated centrally.
+type vault struct {
+	url   string
+	token string
+	opts  vaultOptions
+}
+
+func newVault(_ context.Context, raw json.RawMessage) (Provider, error) {
+	o := vaultOptions{
+		Address:       os.Getenv("VAULT_ADDR"),
+		TokenEnv:      "VAULT_TOKEN",
+		UsernameField: "username",
+		PasswordField: "password",
+	}
+	if err := decode(raw, &o); err != nil {
+		return nil, err
+	}
+	if o.Address == "" || o.Secret == "" {
+		return nil, errors.New("needs an address (or VAULT_ADDR) and a secret")
+	}
+	token := os.Getenv(o.TokenEnv)
+	if token == "" {
+		return nil, fmt.Errorf("%s is not set", o.TokenEnv)
+	}
+	return FromSource(&vault{
+		url:   strings.TrimSuffix(o.Address, "/") + "/v1/" + strings.TrimPrefix(o.Secret, "/"),
+		token: token,
+		opts:  o,
+	}), nil
+}
+
+func (v *vault) Credential(ctx context.Context, _ string) (Credential, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return Credential{}, false, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Credential{}, false, fmt.Errorf("reading vault secret: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Credential{}, false, &statusError{resp.StatusCode, fmt.Sprintf("reading vault secret %s: status %d", v.opts.Secret, resp.StatusCode)}
+	}
+	var secret struct {
+		LeaseDuration int                        `json:"lease_duration"`
+		Data          map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return Credential{}, false, fmt.Errorf("decoding vault secret: %w", err)
+	}
+	// KV v2 nests the secret's fields under data.data.
+	fields := secret.Data
+	if nested, ok := secret.Data["data"]; ok {
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return Credential{}, false, fmt.Errorf("decoding vault secret: %w", err)
+		}
+	}
+	var user, pass string
+	json.Unmarshal(fields[v.opts.UsernameField], &user)
+	json.Unmarshal(fields[v.opts.PasswordField], &pass)
+	if pass == "" {
+		return Credential{}, false, fmt.Errorf("vault secret %s has no %q field", v.opts.Secret, v.opts.PasswordField)
+	}
+
+	ttl := vaultDefaultTTL
+	if secret.LeaseDuration > 0 {
+		ttl = time.Duration(secret.LeaseDuration) * time.Second
+	}
+	return Credential{Username: user, Password: pass, Expires: time.Now().Add(ttl)}, true, nil
+}
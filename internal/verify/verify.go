@@ -0,0 +1,370 @@
+// Package verify pulls an image both directly from its registry and
+// through the proxy and compares the two byte for byte, so operators can
+// check that the proxy serves content exactly as upstream does.
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/danielloader/oci-pull-through/internal/manifest"
+)
+
+// maxManifest bounds the manifests read for comparison.
+const maxManifest = manifest.DefaultMaxSize
+
+// comparedHeaders are the response headers clients act on, which must
+// match between upstream and the proxy.
+var comparedHeaders = []string{"Content-Type", "Docker-Content-Digest", "Content-Length"}
+
+// Options describes an image to verify.
+type Options struct {
+	// Upstream and Proxy are base URLs, e.g. https://registry-1.docker.io
+	// and http://cache.internal:8080.
+	Upstream string
+	Proxy    string
+	// Image is the repository reference upstream ("library/alpine:3.20",
+	// "org/app@sha256:..."). ProxyImage, if set, is its name on the proxy,
+	// e.g. with a Harbor project prefix.
+	Image      string
+	ProxyImage string
+	// Platform, if set, limits an index to its child for this "os/arch".
+	// Otherwise every child is verified.
+	Platform string
+	// Username and Password are used for registry token requests and
+	// Basic auth, on both sides.
+	Username string
+	Password string
+	Client   *http.Client
+}
+
+// Object is the comparison of one object fetched from both sides.
+type Object struct {
+	Method      string   `json:"method"`
+	Kind        string   `json:"kind"` // "manifest" or "blob"
+	Reference   string   `json:"reference"`
+	Digest      string   `json:"digest"` // of the upstream body
+	Size        int64    `json:"size"`
+	Differences []string `json:"differences,omitempty"`
+}
+
+// Report lists every object compared.
+type Report struct {
+	Image      string   `json:"image"`
+	Objects    []Object `json:"objects"`
+	Mismatches int      `json:"mismatches"`
+}
+
+// Run verifies opts.Image: its manifest by reference (HEAD and GET), the
+// manifests an index points to, and every blob they reference. It returns
+// an error when an object can't be fetched from upstream at all; any
+// difference in what the proxy serves is recorded in the report.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	name, reference := splitRef(opts.Image)
+	proxyName := name
+	if opts.ProxyImage != "" {
+		proxyName, _ = splitRef(opts.ProxyImage)
+	}
+	v := &verifier{
+		opts:     opts,
+		upstream: &registry{base: strings.TrimSuffix(opts.Upstream, "/"), name: name, opts: &opts},
+		proxy:    &registry{base: strings.TrimSuffix(opts.Proxy, "/"), name: proxyName, opts: &opts},
+		report:   &Report{Image: opts.Image},
+		seen:     make(map[string]bool),
+	}
+	if err := v.manifest(ctx, reference); err != nil {
+		return v.report, err
+	}
+	return v.report, nil
+}
+
+type verifier struct {
+	opts     Options
+	upstream *registry
+	proxy    *registry
+	report   *Report
+	seen     map[string]bool
+}
+
+func (v *verifier) add(o Object) {
+	if len(o.Differences) > 0 {
+		v.report.Mismatches++
+	}
+	v.report.Objects = append(v.report.Objects, o)
+}
+
+// manifest compares the manifest at reference, then what it references.
+func (v *verifier) manifest(ctx context.Context, reference string) error {
+	if v.seen[reference] {
+		return nil
+	}
+	v.seen[reference] = true
+	path := "manifests/" + reference
+
+	up, err := v.upstream.get(ctx, http.MethodHead, path)
+	if err != nil {
+		return fmt.Errorf("upstream HEAD %s: %w", reference, err)
+	}
+	head := Object{Method: http.MethodHead, Kind: "manifest", Reference: reference}
+	via, err := v.proxy.get(ctx, http.MethodHead, path)
+	head.Differences = compare(up, via, err, true)
+	head.Digest = up.header.Get("Docker-Content-Digest")
+	v.add(head)
+
+	up, err = v.upstream.get(ctx, http.MethodGet, path)
+	if err != nil {
+		return fmt.Errorf("upstream GET %s: %w", reference, err)
+	}
+	via, err = v.proxy.get(ctx, http.MethodGet, path)
+	v.add(Object{Method: http.MethodGet, Kind: "manifest", Reference: reference,
+		Digest: up.digest, Size: up.size, Differences: compare(up, via, err, true)})
+
+	m, err := manifest.Parse(up.body)
+	if err != nil {
+		return fmt.Errorf("parsing manifest %s: %w", reference, err)
+	}
+	for _, c := range m.Manifests {
+		if v.opts.Platform != "" && !c.MatchesPlatform(v.opts.Platform) {
+			continue
+		}
+		if err := v.manifest(ctx, c.Digest); err != nil {
+			return err
+		}
+	}
+	for _, b := range m.Blobs() {
+		if err := v.blob(ctx, b.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blob compares the blob with digest, fetched from both sides in parallel.
+func (v *verifier) blob(ctx context.Context, digest string) error {
+	if v.seen[digest] {
+		return nil
+	}
+	v.seen[digest] = true
+	path := "blobs/" + digest
+
+	var (
+		wg     sync.WaitGroup
+		via    *response
+		viaErr error
+	)
+	wg.Go(func() { via, viaErr = v.proxy.get(ctx, http.MethodGet, path) })
+	up, err := v.upstream.get(ctx, http.MethodGet, path)
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("upstream GET blob %s: %w", digest, err)
+	}
+	o := Object{Method: http.MethodGet, Kind: "blob", Reference: digest, Digest: up.digest, Size: up.size,
+		Differences: compare(up, via, viaErr, false)}
+	if up.digest != digest {
+		o.Differences = append(o.Differences, "upstream body digest "+up.digest+" doesn't match")
+	}
+	v.add(o)
+	return nil
+}
+
+// compare lists how the proxy's answer differs from upstream's. Blob
+// headers aren't compared: registries redirect blobs to storage whose
+// headers are its own.
+func compare(up, via *response, err error, headers bool) []string {
+	if err != nil {
+		return []string{"proxy: " + err.Error()}
+	}
+	var diffs []string
+	if up.status != via.status {
+		diffs = append(diffs, fmt.Sprintf("status: upstream %d, proxy %d", up.status, via.status))
+	}
+	for _, h := range comparedHeaders {
+		u, p := up.header.Get(h), via.header.Get(h)
+		// A chunked response has no Content-Length; its body is compared.
+		if headers && u != p && (u != "" && p != "" || h != "Content-Length") {
+			diffs = append(diffs, fmt.Sprintf("%s: upstream %q, proxy %q", h, u, p))
+		}
+	}
+	if up.size != via.size {
+		diffs = append(diffs, fmt.Sprintf("body size: upstream %d, proxy %d", up.size, via.size))
+	}
+	if up.digest != via.digest {
+		diffs = append(diffs, fmt.Sprintf("body digest: upstream %s, proxy %s", up.digest, via.digest))
+	}
+	return diffs
+}
+
+// response is what one side answered. Manifest bodies are kept; blobs
+// are only hashed.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+	size   int64
+	digest string
+}
+
+// registry fetches one repository's objects from one side, answering
+// bearer token challenges as a client would.
+type registry struct {
+	base  string
+	name  string
+	opts  *Options
+	token string
+}
+
+func (r *registry) get(ctx context.Context, method, path string) (*response, error) {
+	resp, err := r.do(ctx, method, path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && r.token == "" {
+		challenge := resp.Header.Get("Www-Authenticate")
+		resp.Body.Close()
+		if r.token, err = r.fetchToken(ctx, challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = r.do(ctx, method, path); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+
+	out := &response{status: resp.StatusCode, header: resp.Header}
+	hash := sha256.New()
+	var src io.Reader = resp.Body
+	if strings.HasPrefix(path, "manifests/") {
+		if out.body, err = io.ReadAll(io.LimitReader(resp.Body, maxManifest)); err != nil {
+			return nil, err
+		}
+		src = bytes.NewReader(out.body)
+	}
+	if out.size, err = io.Copy(hash, src); err != nil {
+		return nil, err
+	}
+	out.digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if method == http.MethodHead {
+		out.digest, out.size = "", 0
+	}
+	return out, nil
+}
+
+func (r *registry) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, r.base+"/v2/"+r.name+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", manifest.Accept)
+	switch {
+	case r.token != "":
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	case r.opts.Username != "":
+		req.SetBasicAuth(r.opts.Username, r.opts.Password)
+	}
+	return r.opts.Client.Do(req)
+}
+
+// fetchToken answers a Bearer challenge from its token endpoint.
+func (r *registry) fetchToken(ctx context.Context, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", errors.New("unauthorized, and no bearer challenge to answer")
+	}
+	p := parseChallenge(params)
+	if p["realm"] == "" {
+		return "", errors.New("bearer challenge without a realm")
+	}
+	q := url.Values{}
+	if p["service"] != "" {
+		q.Set("service", p["service"])
+	}
+	q.Set("scope", "repository:"+r.name+":pull")
+	if p["scope"] != "" {
+		q.Set("scope", p["scope"])
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if r.opts.Username != "" {
+		req.SetBasicAuth(r.opts.Username, r.opts.Password)
+	}
+	resp, err := r.opts.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("decoding token: %w", err)
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	return tok.Token, nil
+}
+
+// parseChallenge parses the key="value" pairs of a Www-Authenticate
+// challenge.
+func parseChallenge(params string) map[string]string {
+	out := make(map[string]string)
+	for params != "" {
+		var key, value string
+		key, params, _ = strings.Cut(strings.TrimLeft(params, " ,"), "=")
+		if strings.HasPrefix(params, `"`) {
+			value, params, _ = strings.Cut(params[1:], `"`)
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		out[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return out
+}
+
+// splitRef splits "name:tag" or "name@digest"; a bare name means latest.
+func splitRef(ref string) (name, reference string) {
+	if name, reference, ok := strings.Cut(ref, "@"); ok {
+		return name, reference
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, "latest"
+}
+
+// WriteText renders the report for a terminal.
+func (r *Report) WriteText(w io.Writer) {
+	for _, o := range r.Objects {
+		result := "ok"
+		if len(o.Differences) > 0 {
+			result = "MISMATCH"
+		}
+		fmt.Fprintf(w, "%-8s %-4s %-8s %s\n", result, o.Method, o.Kind, o.Reference)
+		for _, d := range o.Differences {
+			fmt.Fprintf(w, "           %s\n", d)
+		}
+	}
+	fmt.Fprintf(w, "\n%s: %d objects compared, %d mismatched\n", r.Image, len(r.Objects), r.Mismatches)
+}
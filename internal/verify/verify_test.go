@@ -0,0 +1,133 @@
+package verify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielloader/oci-pull-through/internal/cache"
+	"github.com/danielloader/oci-pull-through/internal/proxy"
+)
+
+func digestOf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// registryServer serves one multi-arch image behind a token challenge.
+func registryServer(t *testing.T) *httptest.Server {
+	config, layer := `{"architecture":"amd64"}`, "layer bytes"
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":%q},"layers":[{"digest":%q}]}`,
+		digestOf(config), digestOf(layer))
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"digest":%q,"platform":{"os":"linux","architecture":"amd64"}}]}`,
+		digestOf(manifest))
+	objects := map[string][2]string{
+		"manifests/v1":                    {index, "application/vnd.oci.image.index.v1+json"},
+		"manifests/" + digestOf(index):    {index, "application/vnd.oci.image.index.v1+json"},
+		"manifests/" + digestOf(manifest): {manifest, "application/vnd.oci.image.manifest.v1+json"},
+		"blobs/" + digestOf(config):       {config, "application/octet-stream"},
+		"blobs/" + digestOf(layer):        {layer, "application/octet-stream"},
+	}
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"token":"pull-token"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer pull-token" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		obj, ok := objects[strings.TrimPrefix(r.URL.Path, "/v2/org/app/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", obj[1])
+		w.Header().Set("Docker-Content-Digest", digestOf(obj[0]))
+		w.Header().Set("Content-Length", fmt.Sprint(len(obj[0])))
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, obj[0])
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRunThroughProxy(t *testing.T) {
+	upstream := registryServer(t)
+	h := &proxy.Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &proxy.UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+	}
+	proxySrv := httptest.NewServer(h)
+	defer proxySrv.Close()
+
+	opts := Options{Upstream: upstream.URL, Proxy: proxySrv.URL, Image: "org/app:v1", Client: upstream.Client()}
+	// The first run fills the cache; the second is served from it.
+	for _, pass := range []string{"fill", "cached"} {
+		rep, err := Run(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("%s: %v", pass, err)
+		}
+		if rep.Mismatches != 0 || len(rep.Objects) != 6 {
+			var out strings.Builder
+			rep.WriteText(&out)
+			t.Fatalf("%s: expected 6 matching objects:\n%s", pass, out.String())
+		}
+	}
+}
+
+func TestRunReportsMutations(t *testing.T) {
+	upstream := registryServer(t)
+	h := &proxy.Handler{
+		Registry: strings.TrimPrefix(upstream.URL, "https://"),
+		Cache:    cache.NewFSStore(t.TempDir(), 0),
+		Upstream: &proxy.UpstreamClient{Client: upstream.Client(), Scheme: "https"},
+	}
+	// A proxy that rewrites what it serves: the layer loses a byte and
+	// manifests change type.
+	mutating := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		body := rec.Body.String()
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if body == "layer bytes" {
+			body = "layer byte"
+			w.Header().Del("Content-Length")
+		}
+		w.WriteHeader(rec.Code)
+		fmt.Fprint(w, body)
+	}))
+	defer mutating.Close()
+
+	rep, err := Run(context.Background(), Options{Upstream: upstream.URL, Proxy: mutating.URL, Image: "org/app:v1", Client: upstream.Client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	rep.WriteText(&out)
+	// Four manifest requests and the layer.
+	if rep.Mismatches != 5 || !strings.Contains(out.String(), "body digest") || !strings.Contains(out.String(), "Content-Type") {
+		t.Fatalf("expected five mismatches:\n%s", out.String())
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	got := parseChallenge(`realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`)
+	if got["realm"] != "https://auth.docker.io/token" || got["service"] != "registry.docker.io" || got["scope"] != "repository:library/alpine:pull" {
+		t.Errorf("parseChallenge = %v", got)
+	}
+}